@@ -0,0 +1,116 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// ErrBindToDeviceUnsupported is returned when binding the outgoing connections
+// to a network interface isn't supported on the current platform.
+const ErrBindToDeviceUnsupported errors.Error = "binding to a network interface is not supported on this platform"
+
+// Bind is the configuration of the local end of the outgoing connections.  A
+// nil *Bind leaves the choice to the operating system.
+type Bind struct {
+	// Interface is the name of the network interface the connections are
+	// bound to.  It's only supported on Linux.
+	Interface string
+
+	// IPv4 is the source address of the connections to the IPv4 addresses.
+	IPv4 netip.Addr
+
+	// IPv6 is the source address of the connections to the IPv6 addresses.
+	IPv6 netip.Addr
+}
+
+// Validate returns an error if b can't be applied on the current platform.
+func (b *Bind) Validate() (err error) {
+	switch {
+	case b == nil:
+		return nil
+	case b.Interface != "" && !bindToDeviceSupported:
+		return ErrBindToDeviceUnsupported
+	case b.IPv4.IsValid() && !b.IPv4.Unmap().Is4():
+		return fmt.Errorf("bad ipv4 source address %s", b.IPv4)
+	case b.IPv6.IsValid() && !b.IPv6.Is6():
+		return fmt.Errorf("bad ipv6 source address %s", b.IPv6)
+	default:
+		return nil
+	}
+}
+
+// source returns the source address for the connections to remote, if any.
+func (b *Bind) source(remote netip.Addr) (src netip.Addr) {
+	if b == nil {
+		return netip.Addr{}
+	}
+
+	if remote.Unmap().Is4() {
+		return b.IPv4.Unmap()
+	}
+
+	return b.IPv6
+}
+
+// localAddr returns the local address of the connection of the given network
+// to remote, or nil if there is no source address configured for it.
+func (b *Bind) localAddr(network Network, remote netip.Addr) (addr net.Addr) {
+	src := b.source(remote)
+	if !src.IsValid() {
+		return nil
+	}
+
+	switch network {
+	case NetworkTCP:
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, 0))
+	case NetworkUDP:
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(src, 0))
+	default:
+		return nil
+	}
+}
+
+// control returns the function to use as the Control of the dialers and
+// listeners, or nil if there is no interface to bind to.
+func (b *Bind) control() (f func(network, address string, c syscall.RawConn) (err error)) {
+	if b == nil || b.Interface == "" {
+		return nil
+	}
+
+	return func(_, _ string, c syscall.RawConn) (err error) {
+		return bindToDevice(c, b.Interface)
+	}
+}
+
+// dialer returns a dialer for the connections of the given network to remote.
+func (b *Bind) dialer(timeout time.Duration, network Network, remote netip.Addr) (d *net.Dialer) {
+	return &net.Dialer{
+		Timeout:   timeout,
+		LocalAddr: b.localAddr(network, remote),
+		Control:   b.control(),
+	}
+}
+
+// ListenPacket returns a new unconnected UDP connection to use for sending
+// packets to remote, e.g. for QUIC.
+func (b *Bind) ListenPacket(ctx context.Context, remote netip.Addr) (conn net.PacketConn, err error) {
+	network, src := "udp4", b.source(remote)
+	if !remote.Unmap().Is4() {
+		network = "udp6"
+	}
+
+	laddr := ""
+	if src.IsValid() {
+		laddr = netip.AddrPortFrom(src, 0).String()
+	}
+
+	lc := &net.ListenConfig{Control: b.control()}
+
+	return lc.ListenPacket(ctx, network, laddr)
+}
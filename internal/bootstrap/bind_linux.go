@@ -0,0 +1,29 @@
+//go:build linux
+
+package bootstrap
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// bindToDeviceSupported is true if the connections may be bound to a network
+// interface on the current platform.
+const bindToDeviceSupported = true
+
+// bindToDevice binds the socket c to the network interface with the given
+// name using the SO_BINDTODEVICE socket option.
+func bindToDevice(c syscall.RawConn, iface string) (err error) {
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		opErr = unix.BindToDevice(int(fd), iface)
+		if opErr != nil {
+			opErr = fmt.Errorf("setting SO_BINDTODEVICE to %q: %w", iface, opErr)
+		}
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package bootstrap
+
+import (
+	"syscall"
+)
+
+// bindToDeviceSupported is true if the connections may be bound to a network
+// interface on the current platform.
+const bindToDeviceSupported = false
+
+// bindToDevice always returns [ErrBindToDeviceUnsupported].
+func bindToDevice(_ syscall.RawConn, _ string) (err error) {
+	return ErrBindToDeviceUnsupported
+}
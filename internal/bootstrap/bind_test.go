@@ -0,0 +1,93 @@
+package bootstrap_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBind_Validate(t *testing.T) {
+	testCases := []struct {
+		bind       *bootstrap.Bind
+		name       string
+		wantErrMsg string
+	}{{
+		bind:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		bind: &bootstrap.Bind{
+			IPv4: netip.MustParseAddr("192.0.2.1"),
+			IPv6: netip.MustParseAddr("2001:db8::1"),
+		},
+		name:       "addresses",
+		wantErrMsg: "",
+	}, {
+		bind:       &bootstrap.Bind{IPv4: netip.MustParseAddr("2001:db8::1")},
+		name:       "bad_ipv4",
+		wantErrMsg: "bad ipv4 source address 2001:db8::1",
+	}, {
+		bind:       &bootstrap.Bind{IPv6: netip.MustParseAddr("192.0.2.1")},
+		name:       "bad_ipv6",
+		wantErrMsg: "bad ipv6 source address 192.0.2.1",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.bind.Validate())
+		})
+	}
+
+	t.Run("interface", func(t *testing.T) {
+		err := (&bootstrap.Bind{Interface: "lo"}).Validate()
+		if runtime.GOOS == "linux" {
+			assert.NoError(t, err)
+		} else {
+			assert.ErrorIs(t, err, bootstrap.ErrBindToDeviceUnsupported)
+		}
+	})
+}
+
+func TestNewBoundDialContext(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only linux routes the whole 127.0.0.0/8 to the loopback by default")
+	}
+
+	src := netip.MustParseAddr("127.0.0.2")
+	b := &bootstrap.Bind{IPv4: src}
+
+	sig := make(chan net.Addr, 1)
+	ipp := newListener(t, bootstrap.NetworkTCP, sig)
+
+	dialContext := bootstrap.NewBoundDialContext(testTimeout, b, ipp.String())
+
+	conn, err := dialContext(context.Background(), bootstrap.NetworkTCP, "")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	_, ok := testutil.RequireReceive(t, sig, testTimeout)
+	require.True(t, ok)
+
+	local, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	require.NoError(t, err)
+
+	assert.Equal(t, src, local.Addr())
+
+	t.Run("listen_packet", func(t *testing.T) {
+		pconn, lerr := b.ListenPacket(context.Background(), ipp.Addr())
+		require.NoError(t, lerr)
+		testutil.CleanupAndRequireSuccess(t, pconn.Close)
+
+		local, lerr = netip.ParseAddrPort(pconn.LocalAddr().String())
+		require.NoError(t, lerr)
+
+		assert.Equal(t, src, local.Addr())
+	})
+}
@@ -49,6 +49,18 @@ func ResolveDialContext(
 	timeout time.Duration,
 	r Resolver,
 	preferV6 bool,
+) (h DialHandler, err error) {
+	return ResolveBoundDialContext(u, timeout, r, preferV6, nil)
+}
+
+// ResolveBoundDialContext is like [ResolveDialContext] but binds the local end
+// of the connections according to b, which may be nil.
+func ResolveBoundDialContext(
+	u *url.URL,
+	timeout time.Duration,
+	r Resolver,
+	preferV6 bool,
+	b *Bind,
 ) (h DialHandler, err error) {
 	defer func() { err = errors.Annotate(err, "dialing %q: %w", u.Host) }()
 
@@ -87,12 +99,19 @@ func ResolveDialContext(
 		addrs = append(addrs, netip.AddrPortFrom(ip, port).String())
 	}
 
-	return NewDialContext(timeout, addrs...), nil
+	return NewBoundDialContext(timeout, b, addrs...), nil
 }
 
 // NewDialContext returns a DialHandler that dials addrs and returns the first
 // successful connection.  At least a single addr should be specified.
 func NewDialContext(timeout time.Duration, addrs ...string) (h DialHandler) {
+	return NewBoundDialContext(timeout, nil, addrs...)
+}
+
+// NewBoundDialContext is like [NewDialContext] but binds the local end of the
+// connections according to b, which may be nil.  addrs must be IP addresses
+// with ports for the binding to the source addresses to work.
+func NewBoundDialContext(timeout time.Duration, b *Bind, addrs ...string) (h DialHandler) {
 	l := len(addrs)
 	if l == 0 {
 		//log.Debug("bootstrap: no addresses to dial")
@@ -114,8 +133,14 @@ func NewDialContext(timeout time.Duration, addrs ...string) (h DialHandler) {
 		for _, addr := range addrs {
 			//log.Debug("bootstrap: dialing %s (%d/%d)", addr, i+1, l)
 
+			d := dialer
+			if b != nil {
+				remote, _ := netip.ParseAddrPort(addr)
+				d = b.dialer(timeout, network, remote.Addr())
+			}
+
 			start := time.Now()
-			conn, err = dialer.DialContext(ctx, network, addr)
+			conn, err = d.DialContext(ctx, network, addr)
 			elapsed := time.Since(start)
 			if err != nil {
 				log.Debug("bootstrap: connection to %s failed in %s: %s", addr, elapsed, err)
@@ -2,14 +2,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"github.com/ameshkov/dnscrypt/v2"
-	"github.com/barweiss/go-tuple"
 	"github.com/gin-gonic/gin"
 	"github.com/go-co-op/gocron"
 	"gopkg.in/yaml.v3"
+	"io"
+	"io/fs"
+	"math"
 	"net"
 	"net/http"
 	"net/http/pprof"
@@ -17,8 +23,13 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -26,33 +37,73 @@ import (
 	"github.com/AdguardTeam/dnsproxy/internal/version"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/dnsproxy/utils"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/hostsfile"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/osutil"
 	"github.com/AdguardTeam/golibs/timeutil"
 	goFlags "github.com/jessevdk/go-flags"
+	"github.com/miekg/dns"
 )
 
-// Options represents console arguments.  For further additions, please do not
-// use the default option since it will cause some problems when config files
-// are used.
+// Options represents console arguments and the configuration file fields.
 //
 // TODO(a.garipov): Consider extracting conf blocks for better fieldalignment.
 type Options struct {
-	// Configuration file path (yaml), the config path should be read without
-	// using goFlags in order not to have default values overriding yaml
-	// options.
+	// ConfigPath is the path to the YAML configuration file.  The options
+	// specified on the command line override the ones from it.
 	ConfigPath string `long:"config-path" description:"yaml configuration file. Minimal working configuration in config.yaml.dist. Options passed through command line will override the ones from this file." default:""`
 
+	// ConfigStrict makes the unknown keys in the configuration file errors.
+	ConfigStrict bool `long:"config-strict" description:"If specified, fail on the unknown keys in the configuration file." optional:"yes" optional-value:"true"`
+
+	// CheckConfig makes dnsproxy check the configuration and exit instead of
+	// starting, see [checkConfig].
+	CheckConfig string `long:"check-config" description:"Check the configuration, the listen addresses, the TLS certificates, the domains lists, and the upstreams, print the problems found as JSON, and exit with a non-zero code if there are any. 'online' also downloads the remote lists." optional:"yes" optional-value:"offline" choice:"offline" choice:"online"`
+
 	// LogOutput is the path to the log file.
 	LogOutput string `yaml:"output" short:"o" long:"output" description:"Path to the log file. If not set, write to stdout."`
 
+	// LogMaxSize is the size of the log file in megabytes it's rotated after.
+	LogMaxSize int `yaml:"log-max-size" long:"log-max-size" description:"Size of the log file in megabytes it's rotated after. Default is 128."`
+
+	// LogMaxBackups is the number of the rotated log files kept.
+	LogMaxBackups int `yaml:"log-max-backups" long:"log-max-backups" description:"Number of the rotated log files kept. A negative value means the log file is truncated instead. Default is 3."`
+
+	// LogCompress makes the rotated log files compressed.
+	LogCompress bool `yaml:"log-compress" long:"log-compress" description:"If specified, the rotated log files are compressed with gzip." optional:"yes" optional-value:"true"`
+
+	// LogRotateCheckInterval is the interval the size of the log file is
+	// checked with.
+	LogRotateCheckInterval duration `yaml:"log-rotate-check-interval" long:"log-rotate-check-interval" description:"Interval the size of the log file is checked with in a human-readable form. Default is 1m."`
+
 	// TLSCertPath is the path to the .crt with the certificate chain.
 	TLSCertPath string `yaml:"tls-crt" short:"c" long:"tls-crt" description:"Path to a file with the certificate chain"`
 
 	// TLSKeyPath is the path to the file with the private key.
 	TLSKeyPath string `yaml:"tls-key" short:"k" long:"tls-key" description:"Path to a file with the private key"`
 
+	// TLSExtraCerts are the additional certificates selected by the server
+	// name requested by the client, each as "<crt-path>,<key-path>".
+	TLSExtraCerts []string `yaml:"tls-extra-cert" long:"tls-extra-cert" description:"Additional certificate chain and private key, as '<crt-path>,<key-path>', served to the clients requesting one of its names via SNI. Can be specified multiple times. The certificate from --tls-crt and --tls-key is served to the other clients."`
+
+	// TLSClientCAPath is the path to the file with the CA certificates to
+	// verify the client certificates against.
+	TLSClientCAPath string `yaml:"tls-client-ca" long:"tls-client-ca" description:"Path to a file with the PEM-encoded CA certificates to verify the client certificates of DoT, DoH, and DoQ clients against"`
+
+	// TLSClientAuth is the client certificate authentication mode.
+	TLSClientAuth string `yaml:"tls-client-auth" long:"tls-client-auth" description:"Client certificate authentication mode: none, verify-if-given, or require. With require, the clients without a valid certificate are rejected during the handshake. Defaults to require if --tls-client-ca is set and to none otherwise."`
+
+	// TLSClientIDFromCert makes the common name of the client certificate the
+	// client ID.
+	TLSClientIDFromCert bool `yaml:"tls-client-id-from-cert" long:"tls-client-id-from-cert" description:"Use the subject common name of the verified client certificate as the client ID. Takes precedence over the client ID from the server name or the DoH path." optional:"yes" optional-value:"true"`
+
+	// TLSReloadInterval is the interval between the checks of the certificate
+	// and key files for changes.
+	TLSReloadInterval duration `yaml:"tls-reload-interval" long:"tls-reload-interval" description:"Interval between the checks of the certificate and key files for changes in a human-readable form. The changed certificate is used for the new connections without restarting the listeners. Also reloaded on SIGHUP. Default is 1m."`
+
 	// HTTPSServerName sets Server header for the HTTPS server.
 	HTTPSServerName string `yaml:"https-server-name" long:"https-server-name" description:"Set the Server header for the responses from the HTTPS server." default:"dnsproxy"`
 
@@ -61,8 +112,27 @@ type Options struct {
 	// basic authentication information.
 	HTTPSUserinfo string `yaml:"https-userinfo" long:"https-userinfo" description:"If set, all DoH queries are required to have this basic authentication information."`
 
+	// ClientIDServerName is the server name of the DoT and DoQ servers, the
+	// subdomains of which are used to identify the clients.
+	ClientIDServerName string `yaml:"client-id-server-name" long:"client-id-server-name" description:"Server name of the DoT and DoQ servers. The first label of its subdomain the client connects to, e.g. phone in phone.dns.example, is the client ID used in blocking policies and client stats. DoH clients send their IDs in the path, e.g. /dns-query/phone."`
+
+	// HTTPSPaths are the URL paths the DoH requests are served on.
+	HTTPSPaths []string `yaml:"https-path" long:"https-path" description:"URL path to serve DoH requests on, both over HTTP/2 and HTTP/3. Can be specified multiple times. Only /dns-query is served by default."`
+
+	// HTTPSJSON enables the JSON DoH API.
+	HTTPSJSON bool `yaml:"https-json" long:"https-json" description:"Serve the JSON DoH API (GET /resolve?name=&type=) with application/dns-json responses" optional:"yes" optional-value:"true"`
+
+	// TrustedProxies are the networks of the proxy servers the DoH requests
+	// may come through.  The client address is only taken from the HTTP
+	// headers of the requests from these networks.
+	TrustedProxies []string `yaml:"trusted-proxies" long:"trusted-proxies" description:"CIDR of the reverse proxies trusted to set X-Forwarded-For and similar headers for DoH requests. Can be specified multiple times. Only the loopback addresses are trusted by default."`
+
 	// DNSCryptConfigPath is the path to the DNSCrypt configuration file.
-	DNSCryptConfigPath string `yaml:"dnscrypt-config" short:"g" long:"dnscrypt-config" description:"Path to a file with DNSCrypt configuration. You can generate one using https://github.com/ameshkov/dnscrypt"`
+	DNSCryptConfigPath string `yaml:"dnscrypt-config" short:"g" long:"dnscrypt-config" description:"Path to a file with DNSCrypt configuration. You can generate one using --dnscrypt-generate or https://github.com/ameshkov/dnscrypt"`
+
+	// DNSCryptGenerate is the provider name to generate a new DNSCrypt
+	// provider identity for.
+	DNSCryptGenerate string `yaml:"dnscrypt-generate" long:"dnscrypt-generate" description:"Generate a new DNSCrypt provider identity for this provider name, write it to the file from --dnscrypt-config readable only by the owner, print the DNS stamp for the first --listen address and --dnscrypt-port, and exit."`
 
 	// EDNSAddr is the custom EDNS Client Address to send.
 	EDNSAddr string `yaml:"edns-addr" long:"edns-addr" description:"Send EDNS Client Address"`
@@ -85,15 +155,53 @@ type Options struct {
 	// DNSCryptListenPorts are the ports server listens on for DNSCrypt.
 	DNSCryptListenPorts []int `yaml:"dnscrypt-port" short:"y" long:"dnscrypt-port" description:"Listening ports for DNSCrypt"`
 
+	// ListenUnix are the paths of the Unix domain sockets server listens on
+	// for plain DNS-over-TCP.
+	ListenUnix []string `yaml:"listen-unix" long:"listen-unix" description:"Path of the Unix domain socket to listen on for plain DNS-over-TCP. Can be specified multiple times. A stale socket file left by a crash is removed."`
+
+	// ListenUnixMode is the octal permissions of the Unix domain sockets.
+	ListenUnixMode string `yaml:"listen-unix-mode" long:"listen-unix-mode" description:"Octal permissions of the Unix domain sockets. Default is 0660."`
+
+	// TCPMaxConns is the maximum number of the concurrent TCP connections.
+	TCPMaxConns int `yaml:"tcp-max-conns" long:"tcp-max-conns" description:"Maximum number of the concurrent plain TCP, DoT, and Unix domain socket connections. Zero means no limit."`
+
+	// TCPMaxConnsPerIP is the maximum number of the concurrent TCP connections
+	// from a single client IP address.
+	TCPMaxConnsPerIP int `yaml:"tcp-max-conns-per-ip" long:"tcp-max-conns-per-ip" description:"Maximum number of the concurrent plain TCP and DoT connections from a single client IP address. Zero means no limit."`
+
+	// TCPIdleTimeout is the time a TCP connection is kept open while waiting
+	// for the next request.
+	TCPIdleTimeout duration `yaml:"tcp-idle-timeout" long:"tcp-idle-timeout" description:"Time a plain TCP, DoT, or Unix domain socket connection is kept open while waiting for the next request in a human-readable form. Default is 10s."`
+
+	// TCPMaxQueriesPerConn is the maximum number of requests served over a
+	// single TCP connection.
+	TCPMaxQueriesPerConn int `yaml:"tcp-max-queries-per-conn" long:"tcp-max-queries-per-conn" description:"Maximum number of requests served over a single plain TCP, DoT, or Unix domain socket connection, after which it's closed. Zero means no limit."`
+
+	// ShutdownGracePeriod is the maximum time to wait for the requests in
+	// flight to be handled on shutdown.
+	ShutdownGracePeriod duration `yaml:"shutdown-grace-period" long:"shutdown-grace-period" description:"Maximum time to wait for the requests in flight to be handled on shutdown in a human-readable form." default:"5s"`
+
 	// Upstreams is the list of DNS upstream servers.
-	Upstreams []string `yaml:"upstream" short:"u" long:"upstream" description:"An upstream to be used (can be specified multiple times). You can also specify path to a file with the list of servers" optional:"false"`
+	Upstreams []string `yaml:"upstream" short:"u" long:"upstream" description:"An upstream to be used (can be specified multiple times). You can also specify path to a file with the list of servers. Optional |weight=N and |timeout=D suffixes set the load-balancing weight, zero meaning backup only, and the timeout of the upstream" optional:"false"`
 
 	// BootstrapDNS is the list of bootstrap DNS upstream servers.
 	BootstrapDNS []string `yaml:"bootstrap" short:"b" long:"bootstrap" description:"Bootstrap DNS for DoH and DoT, can be specified multiple times (default: use system-provided)"`
 
+	// BootstrapCacheFile is the path to the file the results of the lookups of
+	// the bootstrap DNS servers are persisted to.
+	BootstrapCacheFile string `yaml:"bootstrap-cache-file" long:"bootstrap-cache-file" description:"Path to the file to persist the addresses resolved with the bootstrap DNS servers to. On start, the upstreams are dialed with the last known addresses right away while those are re-validated in the background. Has no effect without --bootstrap."`
+
 	// Fallbacks is the list of fallback DNS upstream servers.
 	Fallbacks []string `yaml:"fallback" short:"f" long:"fallback" description:"Fallback resolvers to use when regular ones are unavailable, can be specified multiple times. You can also specify path to a file with the list of servers"`
 
+	// FallbackTriggers are the results of the exchange with the regular
+	// upstreams which make the proxy use the fallbacks.
+	FallbackTriggers []string `yaml:"fallback-on" long:"fallback-on" description:"Result of the regular upstreams exchange making the proxy use the fallbacks: error, servfail, refused, or nxdomain. Can be specified multiple times. Defaults to error." required:"false"`
+
+	// ForwardingZonesFile is the path to the file with the conditional
+	// forwarding zones.  The file is reloaded on SIGHUP.
+	ForwardingZonesFile string `yaml:"forwarding-zones" long:"forwarding-zones" description:"Path to the file with the conditional forwarding zones, one '<zone> <upstream>... [cache=<bool>]' per line. Reloaded on SIGHUP"`
+
 	// PrivateRDNSUpstreams are upstreams to use for reverse DNS lookups of
 	// private addresses, including the requests for authority records, such as
 	// SOA and NS.
@@ -115,9 +223,21 @@ type Options struct {
 	// go-flags doesn't support text unmarshalers.
 	BogusNXDomain []string `yaml:"bogus-nxdomain" long:"bogus-nxdomain" description:"Transform the responses containing at least a single IP that matches specified addresses and CIDRs into NXDOMAIN.  Can be specified multiple times."`
 
+	// OutboundInterface is the name of the network interface the connections
+	// to the upstreams are bound to.
+	OutboundInterface string `yaml:"outbound-interface" long:"outbound-interface" description:"Network interface to send the queries to the upstreams from. Only supported on Linux."`
+
+	// OutboundIPv4 is the source address of the connections to the IPv4
+	// addresses of the upstreams.
+	OutboundIPv4 string `yaml:"outbound-ipv4" long:"outbound-ipv4" description:"Source IPv4 address of the queries to the upstreams"`
+
+	// OutboundIPv6 is the source address of the connections to the IPv6
+	// addresses of the upstreams.
+	OutboundIPv6 string `yaml:"outbound-ipv6" long:"outbound-ipv6" description:"Source IPv6 address of the queries to the upstreams"`
+
 	// Timeout for outbound DNS queries to remote upstream servers in a
 	// human-readable form.  Default is 10s.
-	Timeout timeutil.Duration `yaml:"timeout" long:"timeout" description:"Timeout for outbound DNS queries to remote upstream servers in a human-readable form" default:"10s"`
+	Timeout duration `yaml:"timeout" long:"timeout" description:"Timeout for outbound DNS queries to remote upstream servers in a human-readable form" default:"10s"`
 
 	// CacheMinTTL is the minimum TTL value for caching DNS entries, in seconds.
 	// It overrides the TTL value from the upstream server, if the one is less.
@@ -128,8 +248,8 @@ type Options struct {
 	// greater.
 	CacheMaxTTL uint32 `yaml:"cache-max-ttl" long:"cache-max-ttl" description:"Maximum TTL value for DNS entries, in seconds."`
 
-	// CacheSizeBytes is the cache size in bytes.  Default is 64k.
-	CacheSizeBytes int `yaml:"cache-size" long:"cache-size" description:"Cache size (in bytes). Default: 64k"`
+	// CacheSizeBytes is the cache size in bytes.  Default is 4M.
+	CacheSizeBytes int `yaml:"cache-size" long:"cache-size" description:"Cache size (in bytes). Default: 4M"`
 
 	// Ratelimit is the maximum number of requests per second.
 	Ratelimit int `yaml:"ratelimit" short:"r" long:"ratelimit" description:"Ratelimit (requests per second)"`
@@ -142,6 +262,17 @@ type Options struct {
 	// rate limiting requests.
 	RatelimitSubnetLenIPv6 int `yaml:"ratelimit-subnet-len-ipv6" long:"ratelimit-subnet-len-ipv6" description:"Ratelimit subnet length for IPv6." default:"56"`
 
+	// RatelimitSlip is the ratio of the ratelimited UDP requests answered with
+	// a truncated response instead of being dropped.
+	RatelimitSlip uint `yaml:"ratelimit-slip" long:"ratelimit-slip" description:"Answer every Nth ratelimited UDP request with a truncated response so that the clients retry over TCP. 0 drops all of them."`
+
+	// RatelimitCookie is the maximum number of requests per second presenting
+	// valid DNS cookies.
+	RatelimitCookie int `yaml:"ratelimit-cookie" long:"ratelimit-cookie" description:"Ratelimit (requests per second) for the UDP requests presenting valid DNS cookies, which are counted separately. 0 means the same as --ratelimit."`
+
+	// RatelimitWhitelist are the IP addresses excluded from rate limiting.
+	RatelimitWhitelist []string `yaml:"ratelimit-whitelist" long:"ratelimit-whitelist" description:"IP address excluded from rate limiting. Can be specified multiple times. The ratelimit settings are reloaded from the config file on SIGHUP."`
+
 	// UDPBufferSize is the size of the UDP buffer in bytes.  A value <= 0 will
 	// use the system default.
 	UDPBufferSize int `yaml:"udp-buf-size" long:"udp-buf-size" description:"Set the size of the UDP buffer in bytes. A value <= 0 will use the system default."`
@@ -156,8 +287,18 @@ type Options struct {
 	TLSMaxVersion float32 `yaml:"tls-max-version" long:"tls-max-version" description:"Maximum TLS version, for example 1.3" optional:"yes"`
 
 	// Pprof defines whether the pprof information needs to be exposed via
-	// localhost:6060 or not.
-	Pprof bool `yaml:"pprof" long:"pprof" description:"If present, exposes pprof information on localhost:6060." optional:"yes" optional-value:"true"`
+	// PprofAddr or not.
+	Pprof bool `yaml:"pprof" long:"pprof" description:"If present, exposes pprof information on pprof-addr." optional:"yes" optional-value:"true"`
+
+	// PprofAddr is the address the pprof server listens on.  The non-loopback
+	// addresses require the stats server authentication to be configured.
+	PprofAddr string `yaml:"pprof-addr" long:"pprof-addr" description:"Address the pprof server listens on. Binding to a non-loopback address requires stats-auth-token or stats-auth-user and stats-auth-password, which are also required by the pprof server then. Default is localhost:6060."`
+
+	// User is the user the process switches to after binding the sockets.
+	User string `yaml:"user" long:"user" description:"Name or ID of the user to switch to after binding the listen sockets. The working directory, the log file, and the blocked domains files must be writable by it."`
+
+	// Group is the group the process switches to after binding the sockets.
+	Group string `yaml:"group" long:"group" description:"Name or ID of the group to switch to after binding the listen sockets. Default is the primary group of user."`
 
 	// Version, if true, prints the program version, and exits.
 	Version bool `yaml:"version" long:"version" description:"Prints the program version"`
@@ -166,11 +307,186 @@ type Options struct {
 	///////////////////////////////////////////////////////////////////////////////
 	StatsPort int `yaml:"stats_port" long:"stats_port" description:"Port on which to expose statistics." default:"9999"`
 
-	BlockedDomainsLists []string `yaml:"blocked_domains_lists" long:"blocked_domains_lists" description:"The blocked domains list to be used (can be specified multiple times)."`
+	// StatsListenAddr is the address the stats server listens on.
+	StatsListenAddr string `yaml:"stats-listen-addr" long:"stats-listen-addr" description:"Address the stats server listens on. Default is 127.0.0.1."`
+
+	// StatsDisabled disables the stats server.
+	StatsDisabled bool `yaml:"stats-disabled" long:"stats-disabled" description:"If specified, the stats server is not started." optional:"yes" optional-value:"true"`
+
+	// StatsAuthToken is the bearer token required by the stats server.
+	StatsAuthToken string `yaml:"stats-auth-token" long:"stats-auth-token" description:"Bearer token required by the stats server."`
+
+	// StatsAuthUser and StatsAuthPassword are the basic authentication
+	// credentials required by the stats server.
+	StatsAuthUser     string `yaml:"stats-auth-user" long:"stats-auth-user" description:"Basic authentication user name required by the stats server."`
+	StatsAuthPassword string `yaml:"stats-auth-password" long:"stats-auth-password" description:"Basic authentication password required by the stats server."`
+
+	// StatsTLS makes the stats server use TLS with the certificate from
+	// TLSCertPath and the key from TLSKeyPath.
+	StatsTLS bool `yaml:"stats-tls" long:"stats-tls" description:"If specified, the stats server uses HTTPS with the certificate and key from tls-crt and tls-key." optional:"yes" optional-value:"true"`
+
+	BlockedDomainsLists []string `yaml:"blocked_domains_lists" long:"blocked_domains_lists" description:"The URL, file:// URL or local path of the blocked domains list to be used (can be specified multiple times)."`
+
+	// BlockedDomainsUpdateSchedule is the schedule of the blocked domains
+	// lists updates, either a cron expression or an interval.
+	BlockedDomainsUpdateSchedule string `yaml:"blocked-domains-update-schedule" long:"blocked-domains-update-schedule" description:"Schedule of the blocked domains lists updates, either a cron expression in UTC or an interval in a human-readable form, for example 1h. Default is daily at 02:01."`
+
+	// BlockedDomainsSnapshot is the path to the file with the compiled
+	// blocked domains lists loaded on startup.
+	BlockedDomainsSnapshot string `yaml:"blocked-domains-snapshot" long:"blocked-domains-snapshot" description:"Path to the file with the compiled blocked domains lists used to start blocking without parsing the lists. Default is blocked_domains.snapshot."`
+
+	// BlockedDomainsRuntimeFile is the path to the file the domains blocked
+	// at runtime via the stats server API are persisted to.
+	BlockedDomainsRuntimeFile string `yaml:"blocked-domains-runtime-file" long:"blocked-domains-runtime-file" description:"Path to the file the domains blocked at runtime via the API are persisted to. Default is blocked_domains_runtime.json."`
+
+	// BlockedDomainsMaxAge is the age after which the downloaded blocked
+	// domains list is downloaded again on update.
+	BlockedDomainsMaxAge duration `yaml:"blocked-domains-max-age" long:"blocked-domains-max-age" description:"Age after which the downloaded blocked domains list is downloaded again on update in a human-readable form. Default is 6h."`
+
+	// AllowedDomainsLists are the allowlists, the domains from which are never
+	// blocked.
+	AllowedDomainsLists []string `yaml:"allowed-domains-lists" long:"allowed-domains-lists" description:"The URL, file:// URL or local path of the allowlist in any of the blocked domains lists formats, the domains from which are never blocked (can be specified multiple times)."`
 
 	DomainsExcludedFromBlockingLists []string `yaml:"domains_excluded_from_blocking" long:"domains_excluded_from_blocking" description:"A list of domains to be excluded from blocking lists (can be specified multiple times)."`
 
 	ExcludedFromCachingLists []string `yaml:"domains_excluded_from_caching" long:"domains_excluded_from_caching" description:"The list of domains to be excluded from caching (can be specified multiple times)."`
+
+	// ExcludedFromCachingSources are the lists of the domains excluded from
+	// caching.
+	ExcludedFromCachingSources []string `yaml:"excluded-from-caching-lists" long:"excluded-from-caching-lists" description:"The URL, file:// URL or local path of the list in any of the blocked domains lists formats, the domains from which are excluded from caching along with their subdomains (can be specified multiple times)."`
+
+	// BlockingMode defines the response for blocked domains.
+	BlockingMode string `yaml:"blocking-mode" long:"blocking-mode" description:"Response type for blocked domains: null-ip (default), nxdomain, refused or custom-ip."`
+
+	// BlockingIPv4 is the address used for A responses in custom-ip blocking
+	// mode.
+	BlockingIPv4 string `yaml:"blocking-ipv4" long:"blocking-ipv4" description:"IPv4 address to respond with to A requests for blocked domains in custom-ip blocking mode."`
+
+	// BlockingIPv6 is the address used for AAAA responses in custom-ip
+	// blocking mode.
+	BlockingIPv6 string `yaml:"blocking-ipv6" long:"blocking-ipv6" description:"IPv6 address to respond with to AAAA requests for blocked domains in custom-ip blocking mode."`
+
+	// BlockingPolicies are the per-client sets of blocked domains lists in the
+	// "subnet=list1,list2" or "clientid=list1,list2" format.
+	BlockingPolicies []string `yaml:"blocking-policies" long:"blocking-policy" description:"Blocked domains lists applied to the clients from a subnet or with a client ID in the subnet=list1,list2 or clientid=list1,list2 format, where list names are the lists' file names without extensions (can be specified multiple times)."`
+
+	// BlockingDryRun makes the blocked domains only counted and logged, but
+	// still resolved.
+	BlockingDryRun bool `yaml:"blocking-dry-run" long:"blocking-dry-run" description:"If specified, queries for blocked domains are counted and logged, but resolved normally." optional:"yes" optional-value:"true"`
+
+	// BlockedAnswerSubnets are the addresses and CIDRs the answers of the
+	// responses are blocked within.
+	BlockedAnswerSubnets []string `yaml:"blocked-answer-subnets" long:"blocked-answer-subnet" description:"Remove the A and AAAA records matching specified addresses and CIDRs from the responses, and block the responses left with no addresses (can be specified multiple times)."`
+
+	// BlockedAnswersStrict makes the responses with any of the blocked
+	// answers blocked entirely.
+	BlockedAnswersStrict bool `yaml:"blocked-answers-strict" long:"blocked-answers-strict" description:"If specified, responses containing any address matching blocked-answer-subnet are blocked entirely instead of having the matching records removed." optional:"yes" optional-value:"true"`
+
+	// ClientStatsLimit is the maximum number of the clients tracked in the
+	// per-client statistics.
+	ClientStatsLimit int `yaml:"client-stats-limit" long:"client-stats-limit" description:"Maximum number of clients tracked in the per-client statistics, the least recently active ones are evicted. A negative value means no limit. Default is 1000."`
+
+	// ClientAnonymization defines how the client addresses are recorded in
+	// the logs and statistics.
+	ClientAnonymization string `yaml:"client-anonymization" long:"client-anonymization" description:"How client addresses are recorded in the logs and statistics: empty for full addresses, truncate for /24 and /48 subnets, or hash."`
+
+	// BlockedDomainsStatsLimit is the maximum number of the blocked domains
+	// tracked in the per-domain statistics.
+	BlockedDomainsStatsLimit int `yaml:"blocked-domains-stats-limit" long:"blocked-domains-stats-limit" description:"Maximum number of blocked domains tracked in the per-domain statistics, the least recently blocked ones are counted in the (other) counter of their list. The same limit applies to the allowed domains. A negative value means no limit. Default is 10000."`
+
+	// QueryLogFormat defines how the queries and responses are logged.
+	QueryLogFormat string `yaml:"query-log-format" long:"query-log-format" description:"Format of the query log: empty for the human-readable lines in the main log, or json for a JSON object per line in query-log-file."`
+
+	// QueryLogFilter defines which queries and responses are logged.
+	QueryLogFilter string `yaml:"query-log-filter" long:"query-log-filter" description:"Queries and responses to log: empty for all, blocked for the blocked responses only, or none. The statistics are collected regardless."`
+
+	// QueryLogFile is the path to the file the structured query log is
+	// written to.
+	QueryLogFile string `yaml:"query-log-file" long:"query-log-file" description:"Path to the file the json query log is written to."`
+
+	// SlowQueryThreshold is the duration of the exchange with the upstream
+	// after which the query is logged as slow.
+	SlowQueryThreshold duration `yaml:"slow-query-threshold" long:"slow-query-threshold" description:"Duration of the exchange with the upstream after which the query is logged as slow in a human-readable form. Zero disables the slow query log."`
+
+	// UpstreamHealthCheckInterval is the interval between the probes of the
+	// upstreams.
+	UpstreamHealthCheckInterval duration `yaml:"upstream-health-check-interval" long:"upstream-health-check-interval" description:"Interval between the health probes of the upstreams in a human-readable form. Zero disables the health checking."`
+
+	// UpstreamHealthCheckFailures is the number of the consecutive failed
+	// probes after which an upstream is skipped.
+	UpstreamHealthCheckFailures int `yaml:"upstream-health-check-failures" long:"upstream-health-check-failures" description:"Number of consecutive failed health probes after which an upstream is skipped. Default is 3."`
+
+	// UpstreamHealthCheckSuccesses is the number of the consecutive successful
+	// probes after which a skipped upstream is used again.
+	UpstreamHealthCheckSuccesses int `yaml:"upstream-health-check-successes" long:"upstream-health-check-successes" description:"Number of consecutive successful health probes after which a skipped upstream is used again. Default is 2."`
+
+	// UpstreamRetries is the number of times the failed exchange with the
+	// upstreams is retried.
+	UpstreamRetries int `yaml:"upstream-retries" long:"upstream-retries" description:"Number of times the failed exchange with the upstreams is retried, preferring another upstream. Zero disables the retries."`
+
+	// UpstreamTryTimeout is the timeout of a single try of the exchange with
+	// the upstreams.
+	UpstreamTryTimeout duration `yaml:"upstream-try-timeout" long:"upstream-try-timeout" description:"Timeout of a single try of the exchange with the upstreams in a human-readable form. Zero means the upstream timeout."`
+
+	// UpstreamRetryBackoff is the delay before the first retry.
+	UpstreamRetryBackoff duration `yaml:"upstream-retry-backoff" long:"upstream-retry-backoff" description:"Delay before the first retry, doubled for each next one, in a human-readable form. Default is 50ms."`
+
+	// UpstreamQueryDeadline is the overall time for the exchange with the
+	// upstreams, including the retries.
+	UpstreamQueryDeadline duration `yaml:"upstream-query-deadline" long:"upstream-query-deadline" description:"Overall time for the exchange with the upstreams including the retries in a human-readable form. Zero means no deadline."`
+
+	// MDNS makes the server resolve the .local names using multicast DNS.
+	MDNS bool `yaml:"mdns" long:"mdns" description:"If specified, resolve the .local names using multicast DNS and answer NXDOMAIN if there is no response, without contacting the upstreams." optional:"yes" optional-value:"true"`
+
+	// MDNSSingleLabel makes the server resolve the single-label names using
+	// multicast DNS as well.
+	MDNSSingleLabel bool `yaml:"mdns-single-label" long:"mdns-single-label" description:"If specified, also resolve the single-label names using multicast DNS. Requires --mdns." optional:"yes" optional-value:"true"`
+
+	// MDNSTimeout is the time to wait for the multicast DNS responses.
+	MDNSTimeout duration `yaml:"mdns-timeout" long:"mdns-timeout" description:"Time to wait for the multicast DNS responses in a human-readable form." default:"500ms"`
+
+	// LocalZones are the zones answered authoritatively in the "<zone>=<path>"
+	// format, where path is the RFC 1035 zone file.
+	LocalZones []string `yaml:"local-zone" long:"local-zone" description:"Zone to answer authoritatively from the RFC 1035 zone file, as '<zone>=<path>', e.g. 'home.arpa=/etc/dnsproxy/home.arpa.zone'. Can be specified multiple times. Reloaded on SIGHUP." required:"false"`
+
+	// Rewrites are the static rewrite rules in the "<domain> <answer>" format.
+	Rewrites []string `yaml:"rewrite" long:"rewrite" description:"Static rewrite rule '<domain> <answer>', where the domain may start with '*.' to match its subdomains and the answer is an IP address or a CNAME target. Can be specified multiple times." required:"false"`
+
+	// RewritesFile is the path to the file with the static rewrite rules, one
+	// per line.
+	RewritesFile string `yaml:"rewrites-file" long:"rewrites-file" description:"Path to the file with the static rewrite rules, one per line in the same format as --rewrite."`
+
+	// HostsFiles are the paths to the hosts files to answer the requests from
+	// before the blocking and the upstreams.
+	HostsFiles []string `yaml:"hosts-file" long:"hosts-file" description:"Path to the hosts file to answer A, AAAA, and PTR requests from before the blocked domains lists and the upstreams. Can be specified multiple times." required:"false"`
+
+	// SystemHosts makes the requests answered from the system hosts files
+	// along with HostsFiles.
+	SystemHosts bool `yaml:"system-hosts" long:"system-hosts" description:"Answer A, AAAA, and PTR requests from the system hosts file, e.g. /etc/hosts, along with the ones from --hosts-file." optional:"yes" optional-value:"true"`
+
+	// HostsReloadInterval is the interval between the checks of the hosts files
+	// and the DHCP leases file for changes.
+	HostsReloadInterval duration `yaml:"hosts-reload-interval" long:"hosts-reload-interval" description:"Interval between the checks of the hosts files and the DHCP leases file for changes in a human-readable form. Default is 1m."`
+
+	// DHCPLeasesFile is the path to the DHCP leases file to answer the
+	// requests for the leased hostnames and addresses from.
+	DHCPLeasesFile string `yaml:"dhcp-leases-file" long:"dhcp-leases-file" description:"Path to the DHCP leases file in the dnsmasq format, e.g. /var/lib/misc/dnsmasq.leases, to answer A, AAAA, and PTR requests for the leased hostnames and addresses from."`
+
+	// RebindingProtection is the handling of the upstream responses with the
+	// private addresses for the public domain names.
+	RebindingProtection string `yaml:"rebinding-protection" long:"rebinding-protection" description:"DNS rebinding protection: 'strip' removes the private and special-purpose addresses from the upstream responses for the public domain names, 'reject' refuses such responses. Disabled by default."`
+
+	// RebindingAllowlist are the domains allowed to resolve to the private
+	// addresses.
+	RebindingAllowlist []string `yaml:"rebinding-allowlist" long:"rebinding-allowlist" description:"Domain, along with its subdomains, allowed to resolve to the private addresses despite --rebinding-protection. Can be specified multiple times." required:"false"`
+
+	// StatsHistoryDays is the number of days the daily statistics are kept
+	// for.
+	StatsHistoryDays int `yaml:"stats-history-days" long:"stats-history-days" description:"Number of days the daily statistics are kept for. Default is 30."`
+
+	// BlockedQueryTypes are the types of queries for blocked domains which
+	// are blocked, all types are blocked if empty.
+	BlockedQueryTypes []string `yaml:"blocked-query-types" long:"blocked-query-type" description:"Type of queries for blocked domains to block, for example A or HTTPS. All types are blocked if not set (can be specified multiple times)."`
 	///////////////////////////////////////////////////////////////////////////////
 	// end rafal code
 
@@ -180,6 +496,9 @@ type Options struct {
 	// Insecure disables upstream servers TLS certificate verification.
 	Insecure bool `yaml:"insecure" long:"insecure" description:"Disable secure TLS certificate validation" optional:"yes" optional-value:"false"`
 
+	// FilterAAAA are the domains the AAAA records are filtered for.
+	FilterAAAA []string `yaml:"filter-aaaa" long:"filter-aaaa" description:"Domain to answer AAAA requests for with NODATA and to remove AAAA records for from the responses, e.g. for the services with broken IPv6. '*.' prefix matches the domain and all its subdomains. Can be specified multiple times." required:"false"`
+
 	// IPv6Disabled makes the server to respond with NODATA to all AAAA queries.
 	IPv6Disabled bool `yaml:"ipv6-disabled" long:"ipv6-disabled" description:"If specified, all AAAA requests will be replied with NoError RCode and empty answer" optional:"yes" optional-value:"true"`
 
@@ -196,20 +515,98 @@ type Options struct {
 	// or TCP connection time.
 	FastestAddress bool `yaml:"fastest-addr" long:"fastest-addr" description:"Respond to A or AAAA requests only with the fastest IP address" optional:"yes" optional-value:"true"`
 
+	// RandomUpstream makes server to query a single upstream server chosen at
+	// random for each request.
+	RandomUpstream bool `yaml:"random-upstream" long:"random-upstream" description:"If specified, each request is sent to a single upstream server chosen at random" optional:"yes" optional-value:"true"`
+
 	// CacheOptimistic, if set to true, enables the optimistic DNS cache. That
 	// means that cached results will be served even if their cache TTL has
 	// already expired.
 	CacheOptimistic bool `yaml:"cache-optimistic" long:"cache-optimistic" description:"If specified, optimistic DNS cache is enabled" optional:"yes" optional-value:"true"`
 
+	// CacheOptimisticTTL is the TTL of the expired cached responses served by
+	// the optimistic cache in seconds.
+	CacheOptimisticTTL uint32 `yaml:"cache-optimistic-ttl" long:"cache-optimistic-ttl" description:"TTL of the expired cached responses served by the optimistic cache in seconds. Default is 43200."`
+
+	// CachePrefetch, if set to true, makes the cached responses for the most
+	// queried domains refreshed before they expire.
+	CachePrefetch bool `yaml:"cache-prefetch" long:"cache-prefetch" description:"If specified, cached responses for the most queried domains are refreshed before they expire" optional:"yes" optional-value:"true"`
+
+	// CachePrefetchHotSize is the number of the most hit cache entries which
+	// are prefetched.
+	CachePrefetchHotSize int `yaml:"cache-prefetch-hot-size" long:"cache-prefetch-hot-size" description:"Number of the most hit cache entries within the last minute which are prefetched. Default is 100."`
+
+	// CachePrefetchRate is the maximum number of the prefetches per second.
+	CachePrefetchRate int `yaml:"cache-prefetch-rate" long:"cache-prefetch-rate" description:"Maximum number of prefetches per second. Default is 10."`
+
+	// CacheServeStale, if set to true, makes the expired cached responses
+	// served when the upstreams fail to resolve the request.
+	CacheServeStale bool `yaml:"cache-serve-stale" long:"cache-serve-stale" description:"If specified, expired cached responses are served when all upstreams fail" optional:"yes" optional-value:"true"`
+
+	// CacheStaleTTL is the TTL of the expired cached responses served when
+	// the upstreams fail in seconds.
+	CacheStaleTTL uint32 `yaml:"cache-stale-ttl" long:"cache-stale-ttl" description:"TTL of the expired cached responses served when all upstreams fail in seconds. Default is 30."`
+
+	// CacheExcludedClients are the IP addresses and CIDR networks of the
+	// clients which always get the responses from the upstreams.
+	CacheExcludedClients []string `yaml:"cache-excluded-clients" long:"cache-excluded-clients" description:"IP address or CIDR network of the client for which the cache is bypassed. Can be specified multiple times." required:"false"`
+
 	// Cache controls whether DNS responses are cached or not.
 	Cache bool `yaml:"cache" long:"cache" description:"If specified, DNS cache is enabled" optional:"yes" optional-value:"true"`
 
 	// RefuseAny makes the server to refuse requests of type ANY.
 	RefuseAny bool `yaml:"refuse-any" long:"refuse-any" description:"If specified, refuse ANY requests" optional:"yes" optional-value:"true"`
 
+	// AnyHINFO makes the server answer requests of type ANY with the
+	// synthetic HINFO record.
+	AnyHINFO bool `yaml:"any-hinfo" long:"any-hinfo" description:"If specified, answer ANY requests with the synthetic HINFO record as RFC 8482 describes. --refuse-any takes precedence." optional:"yes" optional-value:"true"`
+
+	// AnyHINFOTTL is the TTL of the synthetic HINFO record in seconds.
+	AnyHINFOTTL uint32 `yaml:"any-hinfo-ttl" long:"any-hinfo-ttl" description:"TTL of the synthetic HINFO record for ANY requests in seconds. Default is 3789."`
+
 	// EnableEDNSSubnet uses EDNS Client Subnet extension.
 	EnableEDNSSubnet bool `yaml:"edns" long:"edns" description:"Use EDNS Client Subnet extension" optional:"yes" optional-value:"true"`
 
+	// ECSPrefixLenIPv4 is the source prefix length of the IPv4 client subnet
+	// sent to the upstreams.
+	ECSPrefixLenIPv4 int `yaml:"edns-prefix-ipv4" long:"edns-prefix-ipv4" description:"Prefix length of the IPv4 client subnet sent with --edns, 0 hides the address" default:"24"`
+
+	// ECSPrefixLenIPv6 is the source prefix length of the IPv6 client subnet
+	// sent to the upstreams.
+	ECSPrefixLenIPv6 int `yaml:"edns-prefix-ipv6" long:"edns-prefix-ipv6" description:"Prefix length of the IPv6 client subnet sent with --edns, 0 hides the address" default:"56"`
+
+	// ECSMode defines how the client-supplied EDNS Client Subnet option is
+	// sent to the upstreams.
+	ECSMode string `yaml:"ecs-mode" long:"ecs-mode" description:"Treatment of the client-supplied EDNS Client Subnet: off, strip, or clamp" default:"off"`
+
+	// ECSClampPrefixLenIPv4 is the longest IPv4 client subnet prefix sent to
+	// the upstreams in the clamp ECS mode.
+	ECSClampPrefixLenIPv4 int `yaml:"ecs-clamp-ipv4" long:"ecs-clamp-ipv4" description:"Longest IPv4 client subnet prefix sent upstream with --ecs-mode=clamp, 0 strips the option" default:"24"`
+
+	// ECSClampPrefixLenIPv6 is the longest IPv6 client subnet prefix sent to
+	// the upstreams in the clamp ECS mode.
+	ECSClampPrefixLenIPv6 int `yaml:"ecs-clamp-ipv6" long:"ecs-clamp-ipv6" description:"Longest IPv6 client subnet prefix sent upstream with --ecs-mode=clamp, 0 strips the option" default:"56"`
+
+	// EDNSPadding pads the responses sent over the encrypted transports.
+	EDNSPadding bool `yaml:"edns-padding" long:"edns-padding" description:"Pad the responses sent over DoT, DoH and DoQ as RFC 8467 recommends" optional:"yes" optional-value:"true"`
+
+	// EDNSPaddingUpstream pads the queries sent to the encrypted upstreams.
+	EDNSPaddingUpstream bool `yaml:"edns-padding-upstream" long:"edns-padding-upstream" description:"Pad the queries sent to DoT, DoH and DoQ upstreams as RFC 8467 recommends" optional:"yes" optional-value:"true"`
+
+	// UpstreamForceTCP makes the plain upstreams use TCP only.
+	UpstreamForceTCP bool `yaml:"upstream-force-tcp" long:"upstream-force-tcp" description:"Send all the queries to plain DNS upstreams over TCP, like the |tcp upstream parameter does" optional:"yes" optional-value:"true"`
+
+	// UpstreamRandomizeCase randomizes the case of the query names sent to
+	// the plain UDP upstreams.
+	UpstreamRandomizeCase bool `yaml:"upstream-randomize-case" long:"upstream-randomize-case" description:"Randomize the case of the query names sent to plain UDP upstreams and retry over TCP if the response doesn't echo it" optional:"yes" optional-value:"true"`
+
+	// DNSCookies enables the server DNS cookies on the UDP listeners.
+	DNSCookies bool `yaml:"dns-cookies" long:"dns-cookies" description:"Enable server DNS cookies (RFC 7873) on the UDP listeners" optional:"yes" optional-value:"true"`
+
+	// DNSCookiesRequire requires valid cookies from the ratelimited clients
+	// which have presented them before.
+	DNSCookiesRequire bool `yaml:"dns-cookies-require" long:"dns-cookies-require" description:"Answer the ratelimited UDP requests without valid DNS cookies from the clients which have presented them before with BADCOOKIE or a truncated response instead of dropping them" optional:"yes" optional-value:"true"`
+
 	// DNS64 defines whether DNS64 functionality is enabled or not.
 	DNS64 bool `yaml:"dns64" long:"dns64" description:"If specified, dnsproxy will act as a DNS64 server" optional:"yes" optional-value:"true"`
 
@@ -224,71 +621,151 @@ const (
 )
 
 func main() {
-	options := &Options{}
-
 	for _, arg := range os.Args {
 		if arg == "--version" {
 			fmt.Printf("dnsproxy version: %s\n", version.Version())
 
 			os.Exit(0)
 		}
+	}
 
-		// TODO(e.burkov, a.garipov):  Use flag package and remove the manual
-		// options parsing.
-		//
-		// See https://github.com/AdguardTeam/dnsproxy/issues/182.
-		if len(arg) > 13 {
-			if arg[:13] == "--config-path" {
-				fmt.Printf("Path: %s\n", arg[14:])
-				b, err := os.ReadFile(arg[14:])
-				if err != nil {
-					log.Fatalf("failed to read the config file %s: %v", arg[14:], err)
-				}
-				err = yaml.Unmarshal(b, options)
-				if err != nil {
-					log.Fatalf("failed to unmarshal the config file %s: %v", arg[14:], err)
-				}
+	options, err := parseOptions(os.Args[1:])
+	if err != nil {
+		if flagsErr, ok := err.(*goFlags.Error); ok {
+			if flagsErr.Type == goFlags.ErrHelp {
+				os.Exit(0)
 			}
+
+			// The parser has already printed the error.
+			os.Exit(1)
 		}
+
+		log.Fatalf("%s", err)
 	}
 
-	parser := goFlags.NewParser(options, goFlags.Default)
-	_, err := parser.Parse()
-	if err != nil {
-		if flagsErr, ok := err.(*goFlags.Error); ok && flagsErr.Type == goFlags.ErrHelp {
-			os.Exit(0)
+	if options.CheckConfig != "" {
+		os.Exit(checkConfig(options, os.Stdout))
+	}
+
+	if options.DNSCryptGenerate != "" {
+		err = generateDNSCryptConfig(options)
+		if err != nil {
+			log.Fatalf("%s", err)
 		}
 
-		os.Exit(1)
+		os.Exit(0)
 	}
 
 	run(options)
 }
 
+// parseOptions parses the command-line arguments and the YAML configuration
+// file from --config-path, if any.  The values specified on the command line
+// override the ones from the file, which in turn override the defaults, so the
+// result is the same whichever way a value is specified.
+func parseOptions(args []string) (options *Options, err error) {
+	cliOpts := &Options{}
+	parser := goFlags.NewParser(cliOpts, goFlags.Default)
+	_, err = parser.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if cliOpts.ConfigPath == "" {
+		return cliOpts, nil
+	}
+
+	// Set the defaults first, since the parser overwrites all the options not
+	// specified on the command line with those.
+	options = &Options{}
+	_, err = goFlags.NewParser(options, goFlags.None).ParseArgs(nil)
+	if err != nil {
+		return nil, fmt.Errorf("setting defaults: %w", err)
+	}
+
+	err = decodeConfigFile(cliOpts.ConfigPath, options, cliOpts.ConfigStrict)
+	if err != nil {
+		return nil, err
+	}
+
+	// Override the values from the file with the ones specified on the command
+	// line, including the configuration file path itself.
+	cliVal, val := reflect.ValueOf(cliOpts).Elem(), reflect.ValueOf(options).Elem()
+	for _, f := range reflect.VisibleFields(val.Type()) {
+		opt := parser.FindOptionByLongName(f.Tag.Get("long"))
+		if opt != nil && opt.IsSet() && !opt.IsSetDefault() {
+			val.FieldByIndex(f.Index).Set(cliVal.FieldByIndex(f.Index))
+		}
+	}
+
+	return options, nil
+}
+
+// decodeConfigFile decodes the YAML configuration file at path into options.
+// The options missing from the file are left as is.  If strict is true, the
+// unknown keys are considered errors.
+func decodeConfigFile(path string, options *Options, strict bool) (err error) {
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(strict)
+
+	err = dec.Decode(options)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+const (
+	// defaultShutdownTimeout is the time given to the servers to finish
+	// processing the requests on shutdown.
+	defaultShutdownTimeout = 10 * time.Second
+
+	// defaultStatsReadHeaderTimeout is the time given to the stats server
+	// clients to send the request headers.
+	defaultStatsReadHeaderTimeout = 10 * time.Second
+)
+
+// run runs dnsproxy until SIGINT or SIGTERM is received.
 func run(options *Options) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	err := runProxy(options, stop)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+// runProxy starts the DNS proxy and the stats server and runs them until stop
+// receives a value or [proxy.FinishSignal] is sent, then shuts them down.
+func runProxy(options *Options, stop <-chan os.Signal) (err error) {
 	if options.Verbose {
 		log.SetLevel(log.DEBUG)
 	}
+	var logFile *utils.RotatingFile
 	if options.LogOutput != "" {
-		// #nosec G302 -- Trust the file path that is given in the
-		// configuration.
-		file, err := os.OpenFile(options.LogOutput, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		var err error
+		logFile, err = openLogFile(options)
 		if err != nil {
 			//log.Fatalf("cannot create a log file: %s", err)
 			fmt.Printf("cannot create a log file: %s\n", err)
+		} else {
+			defer func() { _ = logFile.Close() }()
+			log.SetOutput(logFile)
 		}
-
-		defer func() { _ = file.Close() }()
-		log.SetOutput(file)
 	}
 
-	// rafal code
-	//runPprof(options)
-
 	log.Info("Starting dnsproxy %s", version.Version())
 
 	// Prepare the proxy server and its configuration.
-	conf := createProxyConfig(options)
+	conf, upsReloader := createProxyConfig(options)
 
 	dnsProxy, err := proxy.New(conf)
 	if err != nil {
@@ -313,22 +790,58 @@ func run(options *Options) {
 		log.Fatalf("cannot start the DNS proxy due to %s", err)
 	}
 
+	// Drop the privileges before anything is downloaded or written.
+	err = dropPrivileges(options)
+	if err != nil {
+		return fmt.Errorf("cannot drop privileges due to %w", err)
+	}
+
 	for _, domain := range options.DomainsExcludedFromBlockingLists {
 		proxy.Edm.AddDomain(domain)
 	}
 
 	for _, domain := range options.ExcludedFromCachingLists {
-		proxy.Efcm.AddDomain(tuple.New2(domain, ""))
+		proxy.Efcm.AddDomain(domain)
 	}
 
-	s := gocron.NewScheduler(time.UTC)
-	_, err = s.Every(1).Day().At("02:01").Do(func() { proxy.UpdateBlockedDomains(proxy.Bdm, options.BlockedDomainsLists) })
+	runtimePath := options.BlockedDomainsRuntimeFile
+	if runtimePath == "" {
+		runtimePath = defaultBlockedDomainsRuntimeFile
+	}
+
+	err = proxy.Bdm.SetRuntimeDomainsFile(runtimePath)
+	if err != nil {
+		log.Fatalf("cannot load domains blocked at runtime: %s", err)
+	}
+
+	err = proxy.ValidateBlockedDomainsLists(options.BlockedDomainsLists)
+	if err != nil {
+		log.Fatalf("invalid blocked domains lists: %s", err)
+	}
+
+	snapshotPath := options.BlockedDomainsSnapshot
+	if snapshotPath == "" {
+		snapshotPath = defaultBlockedDomainsSnapshot
+	}
+
+	err = proxy.LoadBlockedDomainsSnapshot(proxy.Bdm, snapshotPath, options.BlockedDomainsLists)
 	if err != nil {
-		log.Error("Can't start blocked domains updater.")
+		log.Info("not using blocked domains snapshot: %s", err)
 	}
-	_, err = s.Every(1).Minute().Do(func() { proxy.MonitorLogFile(options.LogOutput) })
+
+	s := gocron.NewScheduler(time.UTC)
+	maxAge := blockedDomainsMaxAge(options)
+	err = scheduleBlockedDomainsUpdates(s, options.BlockedDomainsUpdateSchedule, func() {
+		updateDomainsLists(options, maxAge)
+	})
 	if err != nil {
-		log.Error("Can't start log file monitor.")
+		log.Fatalf("cannot start blocked domains updater: %s", err)
+	}
+	if logFile != nil {
+		_, err = s.Every(logRotateCheckInterval(options)).Do(func() { rotateLogFile(logFile) })
+		if err != nil {
+			log.Error("Can't start log file monitor.")
+		}
 	}
 	_, err = s.Every(1).Hour().Do(func() { proxy.SM.SaveStats("stats.json") })
 	if err != nil {
@@ -339,6 +852,15 @@ func run(options *Options) {
 		log.Error("Can't start stats periodic save at 02:15.")
 	}
 
+	historyDays := options.StatsHistoryDays
+	if historyDays <= 0 {
+		historyDays = defaultStatsHistoryDays
+	}
+	_, err = s.Every(1).Day().At("00:00").Do(func() { proxy.SM.Rollover(time.Now().UTC(), historyDays) })
+	if err != nil {
+		log.Error("Can't start daily stats rollover.")
+	}
+
 	//_, err = s.Every(1).Day().At("02:20").Do(func() { proxy.FinishSignal <- true })
 	//if err != nil {
 	//	log.Error("Can't start FinishSignal at 02:20.")
@@ -351,116 +873,448 @@ func run(options *Options) {
 	s.StartAsync()
 	s.RunAll()
 
-	gin.SetMode(gin.ReleaseMode)
-	r := gin.New()
-	r.GET("/stats", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"stats": proxy.SM.GetStats()})
-	})
-	err = r.Run("0.0.0.0:" + strconv.Itoa(options.StatsPort))
-	if err != nil {
-		log.Fatalf("cannot start the stats server due to %s", err)
-		return
-	}
-
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGABRT, syscall.SIGKILL, syscall.SIGSTOP, syscall.SIGSEGV)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
 	go func() {
-		<-c
-		log.Info("Shutting down...")
-		proxy.SM.SaveStats("stats.json")
-	}()
-	///////////////////////////////////////////////////////////////////////////////
-	// end of rafal code
-	<-proxy.FinishSignal
+		for range hup {
+			log.Info("Reloading blocked domains lists on SIGHUP")
+			updateDomainsLists(options, maxAge)
+
+			if options.ForwardingZonesFile != "" {
+				log.Info("Reloading forwarding zones on SIGHUP")
+				if err := dnsProxy.ReloadForwardingZones(); err != nil {
+					log.Error("%s", err)
+				}
+			}
 
-	s.Stop()
-	// Stopping the proxy.
-	err = dnsProxy.Shutdown(ctx)
-	if err != nil {
-		log.Fatalf("cannot stop the DNS proxy due to %s", err)
-	}
-}
+			if len(options.LocalZones) > 0 {
+				log.Info("Reloading local zones on SIGHUP")
+				if err := dnsProxy.ReloadLocalZones(); err != nil {
+					log.Error("%s", err)
+				}
+			}
 
-// runPprof runs pprof server on localhost:6060 if it's enabled in the options.
-func runPprof(options *Options) {
-	if !options.Pprof {
-		return
-	}
+			if options.TLSCertPath != "" && options.TLSKeyPath != "" {
+				log.Info("Reloading tls certificate on SIGHUP")
+				if err := dnsProxy.ReloadTLSCertificate(); err != nil {
+					log.Error("%s", err)
+				}
+			}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/debug/pprof/", pprof.Index)
-	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
-	mux.Handle("/debug/pprof/allocs", pprof.Handler("allocs"))
-	mux.Handle("/debug/pprof/block", pprof.Handler("block"))
-	mux.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
-	mux.Handle("/debug/pprof/heap", pprof.Handler("heap"))
-	mux.Handle("/debug/pprof/mutex", pprof.Handler("mutex"))
-	mux.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
+			if options.ConfigPath != "" {
+				log.Info("Reloading ratelimit settings on SIGHUP")
+				if err := reloadRatelimit(dnsProxy, options); err != nil {
+					log.Error("%s", err)
+				}
 
-	go func() {
-		log.Info("pprof: listening on localhost:6060")
-		srv := &http.Server{
-			Addr:        "localhost:6060",
-			ReadTimeout: 60 * time.Second,
-			Handler:     mux,
-		}
-		err := srv.ListenAndServe()
-		log.Error("error while running the pprof server: %s", err)
+				log.Info("Reloading upstreams on SIGHUP")
+				if err := upsReloader.reloadFile(dnsProxy, options); err != nil {
+					log.Error("%s", err)
+				}
+			}
+		}
 	}()
-}
 
-// createProxyConfig creates proxy.Config from the command line arguments
-func createProxyConfig(options *Options) (conf *proxy.Config) {
-	conf = &proxy.Config{
-		RatelimitSubnetLenIPv4: options.RatelimitSubnetLenIPv4,
-		RatelimitSubnetLenIPv6: options.RatelimitSubnetLenIPv6,
-
-		Ratelimit:       options.Ratelimit,
-		CacheEnabled:    options.Cache,
-		CacheSizeBytes:  options.CacheSizeBytes,
-		CacheMinTTL:     options.CacheMinTTL,
-		CacheMaxTTL:     options.CacheMaxTTL,
-		CacheOptimistic: options.CacheOptimistic,
-		RefuseAny:       options.RefuseAny,
-		HTTP3:           options.HTTP3,
-		// TODO(e.burkov):  The following CIDRs are aimed to match any address.
-		// This is not quite proper approach to be used by default so think
-		// about configuring it.
-		TrustedProxies: netutil.SliceSubnetSet{
-			netip.MustParsePrefix("0.0.0.0/0"),
-			netip.MustParsePrefix("::0/0"),
-		},
-		EnableEDNSClientSubnet: options.EnableEDNSSubnet,
-		UDPBufferSize:          options.UDPBufferSize,
-		HTTPSServerName:        options.HTTPSServerName,
-		MaxGoroutines:          options.MaxGoRoutines,
-		UsePrivateRDNS:         options.UsePrivateRDNS,
-		PrivateSubnets:         netutil.SubnetSetFunc(netutil.IsLocallyServed),
-	}
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
 
-	if uiStr := options.HTTPSUserinfo; uiStr != "" {
-		user, pass, ok := strings.Cut(uiStr, ":")
-		if ok {
-			conf.Userinfo = url.UserPassword(user, pass)
-		} else {
-			conf.Userinfo = url.User(user)
-		}
+	// Register the health checks before the authentication, since the probes
+	// of the orchestrators and the load balancers don't send credentials.
+	registerHealthHandlers(r, dnsProxy)
+
+	if auth := statsAuth(options); auth != nil {
+		r.Use(auth)
 	}
+	r.GET("/stats", func(c *gin.Context) {
+		date := c.Query("date")
+		if date == "" {
+			c.JSON(http.StatusOK, gin.H{"stats": proxy.SM.Lifetime()})
+			return
+		}
 
-	// TODO(e.burkov):  Make these methods of [Options].
-	initUpstreams(conf, options)
-	initEDNS(conf, options)
-	initBogusNXDomain(conf, options)
-	initTLSConfig(conf, options)
-	initDNSCryptConfig(conf, options)
-	initListenAddrs(conf, options)
-	initSubnets(conf, options)
+		stats, ok := proxy.SM.Day(date)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no stats for date " + date})
+			return
+		}
 
-	return conf
-}
+		c.JSON(http.StatusOK, gin.H{"date": date, "stats": stats})
+	})
+	r.POST("/stats/reset", func(c *gin.Context) {
+		n := proxy.SM.Reset()
+		proxy.SM.SaveStats("stats.json")
+
+		c.JSON(http.StatusOK, gin.H{"removed": n})
+	})
+	r.DELETE("/stats", func(c *gin.Context) {
+		prefix := c.Query("prefix")
+		if prefix == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "prefix is required"})
+			return
+		}
+
+		n := proxy.SM.Delete(prefix)
+		proxy.SM.SaveStats("stats.json")
+
+		c.JSON(http.StatusOK, gin.H{"removed": n})
+	})
+	r.GET("/metrics", func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := proxy.WriteMetrics(c.Writer); err != nil {
+			log.Debug("writing metrics: %s", err)
+		}
+	})
+	r.GET("/stats/realtime", func(c *gin.Context) {
+		c.JSON(http.StatusOK, proxy.Rsm.Windows())
+	})
+	r.GET("/stats/upstreams", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"upstreams": dnsProxy.UpstreamStats()})
+	})
+	r.GET("/stats/cache", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"cache": proxy.SM.CacheStats()})
+	})
+	r.GET("/stats/clients", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"clients": proxy.SM.ClientStats()})
+	})
+	r.GET("/stats/top-blocked", func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultTopBlockedLimit)))
+		if err != nil || limit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a non-negative integer"})
+			return
+		}
+
+		c.JSON(http.StatusOK, proxy.SM.TopBlockedDomains(limit))
+	})
+	r.GET("/rewrites", func(c *gin.Context) {
+		rules := dnsProxy.Rewrites.Rules()
+		resp := make([]gin.H, 0, len(rules))
+		for _, rule := range rules {
+			resp = append(resp, gin.H{
+				"domain": rule.Domain,
+				"type":   dns.TypeToString[rule.Type()],
+				"answer": rule.Answer(),
+			})
+		}
+
+		c.JSON(http.StatusOK, gin.H{"rewrites": resp})
+	})
+	r.GET("/ratelimit", func(c *gin.Context) {
+		c.JSON(http.StatusOK, dnsProxy.RatelimitSettings())
+	})
+	r.PUT("/ratelimit", func(c *gin.Context) {
+		s := proxy.RatelimitSettings{}
+		err := c.ShouldBindJSON(&s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err = dnsProxy.SetRatelimit(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, dnsProxy.RatelimitSettings())
+	})
+	r.GET("/upstreams", func(c *gin.Context) {
+		c.JSON(http.StatusOK, upsReloader.current())
+	})
+	r.POST("/upstreams", func(c *gin.Context) {
+		lists := upsReloader.current()
+		err := c.ShouldBindJSON(&lists)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err = upsReloader.set(dnsProxy, lists)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, upsReloader.current())
+	})
+	r.GET("/blocklists", func(c *gin.Context) {
+		c.JSON(http.StatusOK, proxy.Bdm.Status(options.BlockedDomainsLists))
+	})
+	r.GET("/blocklists/custom/domains", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"domains": proxy.Bdm.RuntimeDomains()})
+	})
+	r.POST("/blocklists/custom/domains", func(c *gin.Context) {
+		req := struct {
+			Domain string `json:"domain"`
+		}{}
+
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err = proxy.Bdm.AddRuntimeDomain(req.Domain)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"domain": req.Domain})
+	})
+	r.DELETE("/blocklists/custom/domains/:domain", func(c *gin.Context) {
+		domain := c.Param("domain")
+
+		err := proxy.Bdm.RemoveRuntimeDomain(domain)
+		switch {
+		case errors.Is(err, proxy.ErrRuntimeDomainConflict):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, proxy.ErrRuntimeDomainNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusOK, gin.H{"domain": domain})
+		}
+	})
+	r.POST("/blocklists/reload", func(c *gin.Context) {
+		go updateDomainsLists(options, maxAge)
+		c.JSON(http.StatusAccepted, gin.H{"status": "reloading"})
+	})
+	statsSrv, err := runStatsServer(r, options)
+	if err != nil {
+		return fmt.Errorf("cannot start the stats server due to %w", err)
+	}
+
+	pprofSrv, err := runPprof(options)
+	if err != nil {
+		return fmt.Errorf("cannot start the pprof server due to %w", err)
+	}
+	///////////////////////////////////////////////////////////////////////////////
+	// end of rafal code
+
+	select {
+	case sig := <-stop:
+		log.Info("Received %s, shutting down...", sig)
+	case <-proxy.FinishSignal:
+		log.Info("Shutting down...")
+	}
+
+	return shutdown(dnsProxy, s, options.ShutdownGracePeriod.Duration, statsSrv, pprofSrv)
+}
+
+// shutdown stops the scheduled jobs, the HTTP servers, and the DNS proxy, and
+// saves the stats.  srvs may contain nils.  gracePeriod is the time the DNS
+// proxy waits for the requests in flight, it's given in addition to the usual
+// shutdown timeout.
+func shutdown(
+	dnsProxy *proxy.Proxy,
+	s *gocron.Scheduler,
+	gracePeriod time.Duration,
+	srvs ...*http.Server,
+) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout+gracePeriod)
+	defer cancel()
+
+	s.Stop()
+
+	var errs []error
+	for _, srv := range srvs {
+		if srv == nil {
+			continue
+		}
+
+		err = srv.Shutdown(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stopping the http server on %s: %w", srv.Addr, err))
+		}
+	}
+
+	err = dnsProxy.Shutdown(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("cannot stop the DNS proxy due to %w", err))
+	}
+
+	// Save the stats after the proxy is stopped, so that those include the
+	// last requests.
+	proxy.SM.SaveStats("stats.json")
+
+	return errors.Join(errs...)
+}
+
+// runPprof runs the pprof server on the address from options if it's enabled,
+// otherwise srv is nil.  The listener is created synchronously, so that the
+// binding errors are returned.
+func runPprof(options *Options) (srv *http.Server, err error) {
+	if !options.Pprof {
+		return nil, nil
+	}
+
+	addr, err := pprofAddr(options)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/pprof/allocs", pprof.Handler("allocs"))
+	mux.Handle("/debug/pprof/block", pprof.Handler("block"))
+	mux.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
+	mux.Handle("/debug/pprof/heap", pprof.Handler("heap"))
+	mux.Handle("/debug/pprof/mutex", pprof.Handler("mutex"))
+	mux.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
+
+	var h http.Handler = mux
+	if auth := statsAuth(options); auth != nil {
+		r := gin.New()
+		r.Use(auth)
+		r.Any("/debug/pprof/*name", gin.WrapH(mux))
+		h = r
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv = &http.Server{
+		Addr:        addr,
+		ReadTimeout: 60 * time.Second,
+		Handler:     h,
+	}
+
+	log.Info("pprof: listening on %s", l.Addr())
+
+	go func() {
+		defer log.OnPanic("pprof server")
+
+		serveErr := srv.Serve(l)
+		if !errors.Is(serveErr, http.ErrServerClosed) {
+			log.Error("error while running the pprof server: %s", serveErr)
+		}
+	}()
+
+	return srv, nil
+}
+
+// pprofAddr returns the validated address of the pprof server from options.
+// The non-loopback addresses are only allowed if the authentication is
+// configured, since the profiles reveal the internals of the process.
+func pprofAddr(options *Options) (addr string, err error) {
+	addr = options.PprofAddr
+	if addr == "" {
+		addr = defaultPprofAddr
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("pprof address: %w", err)
+	}
+
+	if isLoopbackHost(host) || statsAuth(options) != nil {
+		return addr, nil
+	}
+
+	return "", fmt.Errorf(
+		"pprof address %q is not a loopback one, but no stats server authentication is configured",
+		addr,
+	)
+}
+
+// isLoopbackHost returns true if host is "localhost" or a loopback IP address.
+// The empty host means all the interfaces, so it isn't a loopback one.
+func isLoopbackHost(host string) (ok bool) {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	ip, err := netip.ParseAddr(host)
+
+	return err == nil && ip.IsLoopback()
+}
+
+// createProxyConfig creates proxy.Config from the command line arguments.  ur
+// is used to replace the upstreams at runtime.
+func createProxyConfig(options *Options) (conf *proxy.Config, ur *upstreamsReloader) {
+	conf = &proxy.Config{
+		CacheEnabled:           options.Cache,
+		CacheSizeBytes:         options.CacheSizeBytes,
+		CacheMinTTL:            options.CacheMinTTL,
+		CacheMaxTTL:            options.CacheMaxTTL,
+		CacheOptimistic:        options.CacheOptimistic,
+		CacheOptimisticTTL:     options.CacheOptimisticTTL,
+		CachePrefetch:          options.CachePrefetch,
+		CachePrefetchHotSize:   options.CachePrefetchHotSize,
+		CachePrefetchRate:      options.CachePrefetchRate,
+		CacheServeStale:        options.CacheServeStale,
+		CacheStaleTTL:          options.CacheStaleTTL,
+		RefuseAny:              options.RefuseAny,
+		AnyHINFO:               options.AnyHINFO,
+		AnyHINFOTTL:            options.AnyHINFOTTL,
+		HTTP3:                  options.HTTP3,
+		EnableEDNSClientSubnet: options.EnableEDNSSubnet,
+		ECSPrefixLenIPv4:       options.ECSPrefixLenIPv4,
+		ECSPrefixLenIPv6:       options.ECSPrefixLenIPv6,
+		ECSMode:                proxy.ECSMode(options.ECSMode),
+		ECSClampPrefixLenIPv4:  options.ECSClampPrefixLenIPv4,
+		ECSClampPrefixLenIPv6:  options.ECSClampPrefixLenIPv6,
+		EDNSPadding:            options.EDNSPadding,
+		DNSCookies:             options.DNSCookies,
+		DNSCookiesRequire:      options.DNSCookiesRequire,
+		UDPBufferSize:          options.UDPBufferSize,
+		HTTPSServerName:        options.HTTPSServerName,
+		HTTPSPaths:             options.HTTPSPaths,
+		ClientIDServerName:     options.ClientIDServerName,
+		ClientIDFromCert:       options.TLSClientIDFromCert,
+		HTTPSJSON:              options.HTTPSJSON,
+		MaxGoroutines:          options.MaxGoRoutines,
+		TCPMaxConns:            options.TCPMaxConns,
+		TCPMaxConnsPerIP:       options.TCPMaxConnsPerIP,
+		TCPIdleTimeout:         options.TCPIdleTimeout.Duration,
+		TCPMaxQueriesPerConn:   options.TCPMaxQueriesPerConn,
+		ShutdownGracePeriod:    options.ShutdownGracePeriod.Duration,
+		UsePrivateRDNS:         options.UsePrivateRDNS,
+		PrivateSubnets:         netutil.SubnetSetFunc(netutil.IsLocallyServed),
+		RebindingProtection:    proxy.RebindingProtection(options.RebindingProtection),
+		RebindingAllowlist:     options.RebindingAllowlist,
+		FilterAAAADomains:      options.FilterAAAA,
+	}
+
+	if uiStr := options.HTTPSUserinfo; uiStr != "" {
+		user, pass, ok := strings.Cut(uiStr, ":")
+		if ok {
+			conf.Userinfo = url.UserPassword(user, pass)
+		} else {
+			conf.Userinfo = url.User(user)
+		}
+	}
+
+	// TODO(e.burkov):  Make these methods of [Options].
+	ur = initUpstreams(conf, options)
+	initRatelimit(conf, options)
+	initEDNS(conf, options)
+	initBogusNXDomain(conf, options)
+	initTLSConfig(conf, options)
+	initDNSCryptConfig(conf, options)
+	initListenAddrs(conf, options)
+	initSubnets(conf, options)
+	initBlocking(conf, options)
+	initStats(conf, options)
+	initQueryLog(conf, options)
+	initUpstreamHealthCheck(conf, options)
+	initUpstreamRetries(conf, options)
+	initMDNS(conf, options)
+	initHosts(conf, options)
+	initRewrites(conf, options)
+	initLocalZones(conf, options)
+
+	return conf, ur
+}
 
 // isEmpty returns false if uc contains at least a single upstream.  uc must not
 // be nil.
@@ -473,8 +1327,9 @@ func isEmpty(uc *proxy.UpstreamConfig) (ok bool) {
 		len(uc.SpecifiedDomainUpstreams) == 0
 }
 
-// initUpstreams inits upstream-related config
-func initUpstreams(config *proxy.Config, options *Options) {
+// initUpstreams inits upstream-related config.  ur is used to replace the
+// upstreams at runtime.
+func initUpstreams(config *proxy.Config, options *Options) (ur *upstreamsReloader) {
 	// Init upstreams
 
 	httpVersions := upstream.DefaultHTTPVersions
@@ -492,9 +1347,19 @@ func initUpstreams(config *proxy.Config, options *Options) {
 		InsecureSkipVerify: options.Insecure,
 		Timeout:            timeout,
 	}
-	boot, err := initBootstrap(options.BootstrapDNS, bootOpts)
+	initOutbound(bootOpts, options)
+	var bootCache *upstream.BootstrapCache
+	var err error
+	if options.BootstrapCacheFile != "" {
+		bootCache, err = upstream.NewBootstrapCache(options.BootstrapCacheFile)
+		if err != nil {
+			fatalf("error while loading bootstrap cache: %s", err)
+		}
+	}
+
+	boot, err := initBootstrap(options.BootstrapDNS, bootOpts, bootCache)
 	if err != nil {
-		log.Fatalf("error while initializing bootstrap: %s", err)
+		fatalf("error while initializing bootstrap: %s", err)
 	}
 
 	upsOpts := &upstream.Options{
@@ -502,52 +1367,232 @@ func initUpstreams(config *proxy.Config, options *Options) {
 		InsecureSkipVerify: options.Insecure,
 		Bootstrap:          boot,
 		Timeout:            timeout,
+		PadQueries:         options.EDNSPaddingUpstream,
+		RandomizeCase:      options.UpstreamRandomizeCase,
+		ForceTCP:           options.UpstreamForceTCP,
 	}
-	upstreams := loadServersList(options.Upstreams)
-
-	config.UpstreamConfig, err = proxy.ParseUpstreamsConfig(upstreams, upsOpts)
-	if err != nil {
-		log.Fatalf("error while parsing upstreams configuration: %s", err)
-	}
+	initOutbound(upsOpts, options)
 
 	privUpsOpts := &upstream.Options{
 		HTTPVersions: httpVersions,
 		Bootstrap:    boot,
 		Timeout:      min(defaultLocalTimeout, timeout),
+		PadQueries:   options.EDNSPaddingUpstream,
+	}
+	initOutbound(privUpsOpts, options)
+
+	ur = &upstreamsReloader{
+		mu:          &sync.Mutex{},
+		upsOpts:     upsOpts,
+		privUpsOpts: privUpsOpts,
+		lists: upstreamLists{
+			Upstreams:            options.Upstreams,
+			PrivateRDNSUpstreams: options.PrivateRDNSUpstreams,
+			Fallbacks:            options.Fallbacks,
+		},
 	}
-	privUpstreams := loadServersList(options.PrivateRDNSUpstreams)
 
-	private, err := proxy.ParseUpstreamsConfig(privUpstreams, privUpsOpts)
+	ups, err := ur.parse(ur.lists)
 	if err != nil {
-		log.Fatalf("error while parsing private rdns upstreams configuration: %s", err)
-	}
-	if !isEmpty(private) {
-		config.PrivateRDNSUpstreamConfig = private
+		fatalf("error while parsing upstreams configuration: %s", err)
 	}
 
-	fallbackUpstreams := loadServersList(options.Fallbacks)
-	fallbacks, err := proxy.ParseUpstreamsConfig(fallbackUpstreams, upsOpts)
-	if err != nil {
-		log.Fatalf("error while parsing fallback upstreams configuration: %s", err)
+	config.UpstreamConfig = ups.UpstreamConfig
+	config.PrivateRDNSUpstreamConfig = ups.PrivateRDNSUpstreamConfig
+	config.Fallbacks = ups.Fallbacks
+
+	for _, t := range options.FallbackTriggers {
+		config.FallbackTriggers = append(config.FallbackTriggers, proxy.FallbackTrigger(t))
 	}
 
-	if !isEmpty(fallbacks) {
-		config.Fallbacks = fallbacks
+	if options.ForwardingZonesFile != "" {
+		config.ForwardingZones, err = proxy.LoadForwardingZones(options.ForwardingZonesFile, upsOpts)
+		if err != nil {
+			fatalf("error while loading forwarding zones: %s", err)
+		}
 	}
 
 	if options.AllServers {
 		config.UpstreamMode = proxy.UModeParallel
 	} else if options.FastestAddress {
 		config.UpstreamMode = proxy.UModeFastestAddr
+	} else if options.RandomUpstream {
+		config.UpstreamMode = proxy.UModeRandom
 	} else {
 		config.UpstreamMode = proxy.UModeLoadBalance
 	}
+
+	return ur
+}
+
+// upstreamLists are the lists of the upstreams which may be replaced at
+// runtime.  Each element is either an upstream or a path to a file with them.
+type upstreamLists struct {
+	Upstreams            []string `json:"upstreams"`
+	PrivateRDNSUpstreams []string `json:"private_rdns_upstreams"`
+	Fallbacks            []string `json:"fallbacks"`
+}
+
+// upstreamsReloader creates the upstreams from the lists and replaces the
+// upstreams of the proxy with them.
+type upstreamsReloader struct {
+	// mu protects lists and serializes the replacements.
+	mu *sync.Mutex
+
+	// upsOpts are the options of the general upstreams and the fallbacks.
+	upsOpts *upstream.Options
+
+	// privUpsOpts are the options of the private RDNS upstreams.
+	privUpsOpts *upstream.Options
+
+	// lists are the lists the current upstreams are created from.
+	lists upstreamLists
+}
+
+// parse creates the upstreams from lists.  The empty private RDNS upstreams
+// and fallbacks are left nil.
+func (r *upstreamsReloader) parse(lists upstreamLists) (ups *proxy.Upstreams, err error) {
+	ups = &proxy.Upstreams{}
+	ups.UpstreamConfig, err = proxy.ParseUpstreamsConfig(
+		loadServersList(lists.Upstreams),
+		r.upsOpts,
+	)
+	if err != nil {
+		return nil, errors.WithDeferred(
+			fmt.Errorf("parsing upstreams: %w", err),
+			ups.UpstreamConfig.Close(),
+		)
+	}
+
+	private, err := proxy.ParseUpstreamsConfig(
+		loadServersList(lists.PrivateRDNSUpstreams),
+		r.privUpsOpts,
+	)
+	if err != nil {
+		err = fmt.Errorf("parsing private rdns upstreams: %w", err)
+
+		return nil, errors.WithDeferred(err, closeUpstreams(ups, private))
+	}
+
+	if !isEmpty(private) {
+		ups.PrivateRDNSUpstreamConfig = private
+	}
+
+	fallbacks, err := proxy.ParseUpstreamsConfig(loadServersList(lists.Fallbacks), r.upsOpts)
+	if err != nil {
+		err = fmt.Errorf("parsing fallbacks: %w", err)
+
+		return nil, errors.WithDeferred(err, closeUpstreams(ups, fallbacks))
+	}
+
+	if !isEmpty(fallbacks) {
+		ups.Fallbacks = fallbacks
+	}
+
+	return ups, nil
+}
+
+// closeUpstreams closes the upstreams created so far along with the partially
+// created uc.
+func closeUpstreams(ups *proxy.Upstreams, uc *proxy.UpstreamConfig) (err error) {
+	var errs []error
+	for _, c := range []*proxy.UpstreamConfig{
+		ups.UpstreamConfig,
+		ups.PrivateRDNSUpstreamConfig,
+		ups.Fallbacks,
+		uc,
+	} {
+		if c != nil {
+			errs = append(errs, c.Close())
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// current returns the lists the current upstreams are created from.
+func (r *upstreamsReloader) current() (lists upstreamLists) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.lists
+}
+
+// set creates the upstreams from lists and replaces the upstreams of p with
+// them.  The current upstreams are kept if lists are invalid.
+func (r *upstreamsReloader) set(p *proxy.Proxy, lists upstreamLists) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ups, err := r.parse(lists)
+	if err != nil {
+		return fmt.Errorf("replacing upstreams: %w", err)
+	}
+
+	err = p.SetUpstreams(ups)
+	if err != nil {
+		err = fmt.Errorf("replacing upstreams: %w", err)
+
+		return errors.WithDeferred(err, closeUpstreams(ups, nil))
+	}
+
+	r.lists = lists
+
+	return nil
+}
+
+// reloadFile reads the upstream lists from the config file again and replaces
+// the upstreams of p with the ones created from them.  The lists missing from
+// the file are kept as they currently are.
+func (r *upstreamsReloader) reloadFile(p *proxy.Proxy, options *Options) (err error) {
+	lists := r.current()
+	next := Options{
+		Upstreams:            lists.Upstreams,
+		PrivateRDNSUpstreams: lists.PrivateRDNSUpstreams,
+		Fallbacks:            lists.Fallbacks,
+	}
+
+	err = decodeConfigFile(options.ConfigPath, &next, options.ConfigStrict)
+	if err != nil {
+		return fmt.Errorf("reloading upstreams: %w", err)
+	}
+
+	return r.set(p, upstreamLists{
+		Upstreams:            next.Upstreams,
+		PrivateRDNSUpstreams: next.PrivateRDNSUpstreams,
+		Fallbacks:            next.Fallbacks,
+	})
+}
+
+// initOutbound sets the binding of the connections to the upstreams into opts.
+func initOutbound(opts *upstream.Options, options *Options) {
+	opts.OutboundInterface = options.OutboundInterface
+
+	var err error
+	if options.OutboundIPv4 != "" {
+		opts.OutboundIPv4, err = netip.ParseAddr(options.OutboundIPv4)
+		if err != nil {
+			fatalf("parsing outbound ipv4: %s", err)
+		}
+	}
+
+	if options.OutboundIPv6 != "" {
+		opts.OutboundIPv6, err = netip.ParseAddr(options.OutboundIPv6)
+		if err != nil {
+			fatalf("parsing outbound ipv6: %s", err)
+		}
+	}
 }
 
 // initBootstrap initializes the [upstream.Resolver] for bootstrapping upstream
 // servers.  It returns the default resolver if no bootstraps were specified.
-// The returned resolver will also use system hosts files first.
-func initBootstrap(bootstraps []string, opts *upstream.Options) (r upstream.Resolver, err error) {
+// The returned resolver will also use system hosts files first.  The results of
+// the lookups are persisted to c, which may be nil.
+func initBootstrap(
+	bootstraps []string,
+	opts *upstream.Options,
+	c *upstream.BootstrapCache,
+) (r upstream.Resolver, err error) {
 	var resolvers []upstream.Resolver
 
 	for i, b := range bootstraps {
@@ -557,7 +1602,7 @@ func initBootstrap(bootstraps []string, opts *upstream.Options) (r upstream.Reso
 			return nil, fmt.Errorf("creating bootstrap resolver at index %d: %w", i, err)
 		}
 
-		resolvers = append(resolvers, upstream.NewCachingResolver(ur))
+		resolvers = append(resolvers, upstream.NewPersistentCachingResolver(ur, c))
 	}
 
 	switch len(resolvers) {
@@ -583,7 +1628,7 @@ func initEDNS(config *proxy.Config, options *Options) {
 		if options.EnableEDNSSubnet {
 			ednsIP := net.ParseIP(options.EDNSAddr)
 			if ednsIP == nil {
-				log.Fatalf("cannot parse %s", options.EDNSAddr)
+				fatalf("cannot parse %s", options.EDNSAddr)
 			}
 			config.EDNSAddr = ednsIP
 		} else {
@@ -613,10 +1658,32 @@ func initTLSConfig(config *proxy.Config, options *Options) {
 	if options.TLSCertPath != "" && options.TLSKeyPath != "" {
 		tlsConfig, err := newTLSConfig(options)
 		if err != nil {
-			log.Fatalf("failed to load TLS config: %s", err)
+			fatalf("failed to load TLS config: %s", err)
 		}
 		config.TLSConfig = tlsConfig
+		config.TLSCertPath = options.TLSCertPath
+		config.TLSKeyPath = options.TLSKeyPath
+		config.TLSCertReloadInterval = options.TLSReloadInterval.Duration
+		config.TLSExtraCerts = tlsExtraCerts(options.TLSExtraCerts)
+	}
+}
+
+// tlsExtraCerts parses the additional certificates files, each as
+// "<crt-path>,<key-path>".
+func tlsExtraCerts(values []string) (files []proxy.TLSCertFiles) {
+	for i, v := range values {
+		certPath, keyPath, ok := strings.Cut(v, ",")
+		if !ok || certPath == "" || keyPath == "" {
+			fatalf("parsing tls-extra-cert at index %d: want '<crt-path>,<key-path>', got %q", i, v)
+		}
+
+		files = append(files, proxy.TLSCertFiles{
+			CertPath: certPath,
+			KeyPath:  keyPath,
+		})
 	}
+
+	return files
 }
 
 // initDNSCryptConfig inits the DNSCrypt config
@@ -625,46 +1692,123 @@ func initDNSCryptConfig(config *proxy.Config, options *Options) {
 		return
 	}
 
-	b, err := os.ReadFile(options.DNSCryptConfigPath)
-	if err != nil {
-		log.Fatalf("failed to read DNSCrypt config %s: %v", options.DNSCryptConfigPath, err)
-	}
-
-	rc := &dnscrypt.ResolverConfig{}
-	err = yaml.Unmarshal(b, rc)
+	rc, err := loadDNSCryptConfig(options)
 	if err != nil {
-		log.Fatalf("failed to unmarshal DNSCrypt config: %v", err)
+		fatalf("%s", err)
 	}
 
 	cert, err := rc.CreateCert()
 	if err != nil {
-		log.Fatalf("failed to create DNSCrypt certificate: %v", err)
+		fatalf("failed to create DNSCrypt certificate: %v", err)
 	}
 
 	config.DNSCryptResolverCert = cert
 	config.DNSCryptProviderName = rc.ProviderName
 }
 
-// initListenAddrs inits listen addrs
-func initListenAddrs(config *proxy.Config, options *Options) {
-	listenIPs := []netip.Addr{}
+// loadDNSCryptConfig reads the DNSCrypt configuration from the file configured
+// in options.
+func loadDNSCryptConfig(options *Options) (rc *dnscrypt.ResolverConfig, err error) {
+	path := options.DNSCryptConfigPath
 
-	if len(options.ListenAddrs) == 0 {
-		// If ListenAddrs has not been parsed through config file nor command
-		// line we set it to "0.0.0.0".
-		options.ListenAddrs = []string{"0.0.0.0"}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNSCrypt config %s: %w", path, err)
+	} else if fi.Mode().Perm()&0o077 != 0 {
+		log.Info("warning: DNSCrypt config %s with the provider secret key is accessible by others", path)
 	}
 
-	if len(options.ListenPorts) == 0 {
-		// If ListenPorts has not been parsed through config file nor command
-		// line we set it to 53.
-		options.ListenPorts = []int{53}
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNSCrypt config %s: %w", path, err)
 	}
 
-	for i, a := range options.ListenAddrs {
+	rc = &dnscrypt.ResolverConfig{}
+	err = yaml.Unmarshal(b, rc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal DNSCrypt config: %w", err)
+	}
+
+	return rc, nil
+}
+
+// generateDNSCryptConfig generates a new DNSCrypt provider identity for the
+// provider name from options, writes it to the DNSCrypt configuration file, and
+// prints the DNS stamp of the server.
+func generateDNSCryptConfig(options *Options) (err error) {
+	path := options.DNSCryptConfigPath
+	if path == "" {
+		return errors.Error("dnscrypt-generate requires dnscrypt-config")
+	}
+
+	rc, err := dnscrypt.GenerateResolverConfig(options.DNSCryptGenerate, nil)
+	if err != nil {
+		return fmt.Errorf("generating dnscrypt config: %w", err)
+	}
+
+	b, err := yaml.Marshal(rc)
+	if err != nil {
+		return fmt.Errorf("encoding dnscrypt config: %w", err)
+	}
+
+	// Don't overwrite the existing identity, since the clients pin its key.
+	//
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("writing dnscrypt config: %w", err)
+	}
+
+	_, err = f.Write(b)
+	err = errors.WithDeferred(err, f.Close())
+	if err != nil {
+		return fmt.Errorf("writing dnscrypt config: %w", err)
+	}
+
+	host := "127.0.0.1"
+	if len(options.ListenAddrs) > 0 {
+		host = options.ListenAddrs[0]
+	}
+
+	port := 443
+	if len(options.DNSCryptListenPorts) > 0 {
+		port = options.DNSCryptListenPorts[0]
+	}
+
+	stamp, err := rc.CreateStamp(netutil.JoinHostPort(host, uint16(port)))
+	if err != nil {
+		return fmt.Errorf("creating dns stamp: %w", err)
+	}
+
+	fmt.Printf("DNSCrypt configuration has been written to %s\n", path)
+	fmt.Printf("Provider name: %s\n", rc.ProviderName)
+	fmt.Printf("Provider public key: %s\n", rc.PublicKey)
+	fmt.Printf("DNS stamp: %s\n", stamp.String())
+
+	return nil
+}
+
+// initListenAddrs inits listen addrs
+func initListenAddrs(config *proxy.Config, options *Options) {
+	listenIPs := []netip.Addr{}
+
+	if len(options.ListenAddrs) == 0 {
+		// If ListenAddrs has not been parsed through config file nor command
+		// line we set it to "0.0.0.0".
+		options.ListenAddrs = []string{"0.0.0.0"}
+	}
+
+	if len(options.ListenPorts) == 0 {
+		// If ListenPorts has not been parsed through config file nor command
+		// line we set it to 53.
+		options.ListenPorts = []int{53}
+	}
+
+	for i, a := range options.ListenAddrs {
 		ip, err := netip.ParseAddr(a)
 		if err != nil {
-			log.Fatalf("parsing listen address at index %d: %s", i, a)
+			fatalf("parsing listen address at index %d: %s", i, a)
 		}
 
 		listenIPs = append(listenIPs, ip)
@@ -718,6 +1862,16 @@ func initListenAddrs(config *proxy.Config, options *Options) {
 			}
 		}
 	}
+
+	config.UnixListenPaths = options.ListenUnix
+	if options.ListenUnixMode != "" {
+		mode, err := strconv.ParseUint(options.ListenUnixMode, 8, 32)
+		if err != nil {
+			fatalf("parsing listen-unix-mode: %s", err)
+		}
+
+		config.UnixSocketMode = fs.FileMode(mode)
+	}
 }
 
 // mustParsePrefixes parses prefixes and considers any error as fatal, logging
@@ -726,7 +1880,7 @@ func mustParsePrefixes(prefixes []string, entity string) (prefs []netip.Prefix)
 	for i, p := range prefixes {
 		pref, err := netip.ParsePrefix(p)
 		if err != nil {
-			log.Fatalf("parsing %s at index %d: %v", entity, i, err)
+			fatalf("parsing %s at index %d: %v", entity, i, err)
 		}
 
 		prefs = append(prefs, pref)
@@ -735,8 +1889,132 @@ func mustParsePrefixes(prefixes []string, entity string) (prefs []netip.Prefix)
 	return prefs
 }
 
-// initSubnets sets the DNS64 configuration into conf.
+// trustedProxies returns the networks of the trusted proxy servers from
+// options.  Only the loopback addresses are trusted if none are specified.
+func trustedProxies(options *Options) (s netutil.SubnetSet) {
+	if len(options.TrustedProxies) == 0 {
+		return netutil.SliceSubnetSet{
+			netip.MustParsePrefix("127.0.0.0/8"),
+			netip.MustParsePrefix("::1/128"),
+		}
+	}
+
+	return netutil.SliceSubnetSet(mustParsePrefixes(options.TrustedProxies, "trusted proxy"))
+}
+
+// initLocalZones loads the zones answered authoritatively into conf.
+func initLocalZones(conf *proxy.Config, options *Options) {
+	if len(options.LocalZones) == 0 {
+		return
+	}
+
+	zones := make([]*proxy.LocalZone, 0, len(options.LocalZones))
+	for i, spec := range options.LocalZones {
+		origin, path, ok := strings.Cut(spec, "=")
+		if !ok || origin == "" || path == "" {
+			fatalf("local zone at index %d: want '<zone>=<path>', got %q", i, spec)
+		}
+
+		z, err := proxy.LoadLocalZone(origin, path)
+		if err != nil {
+			fatalf("loading local zone at index %d: %s", i, err)
+		}
+
+		zones = append(zones, z)
+	}
+
+	var err error
+	conf.LocalZones, err = proxy.NewLocalZones(zones...)
+	if err != nil {
+		fatalf("initializing local zones: %s", err)
+	}
+
+	log.Info("Serving local zones %q", conf.LocalZones.Zones())
+}
+
+// initRewrites sets the static rewrite rules into conf.  The rules from the
+// file come first.
+func initRewrites(conf *proxy.Config, options *Options) {
+	var rules []*proxy.RewriteRule
+	if options.RewritesFile != "" {
+		// #nosec G304 -- Trust the file path that is given in the
+		// configuration.
+		data, err := os.ReadFile(options.RewritesFile)
+		if err != nil {
+			fatalf("reading rewrites file: %s", err)
+		}
+
+		rules, err = proxy.ParseRewriteRules(bytes.NewReader(data))
+		if err != nil {
+			fatalf("parsing rewrites file %s: %s", options.RewritesFile, err)
+		}
+	}
+
+	for i, r := range options.Rewrites {
+		rule, err := proxy.ParseRewriteRule(r)
+		if err != nil {
+			fatalf("parsing rewrite at index %d: %s", i, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if len(rules) == 0 {
+		return
+	}
+
+	var err error
+	conf.Rewrites, err = proxy.NewRewrites(rules)
+	if err != nil {
+		fatalf("initializing rewrites: %s", err)
+	}
+}
+
+// initHosts sets the hosts files and the DHCP leases configuration into conf.
+func initHosts(conf *proxy.Config, options *Options) {
+	conf.HostsFiles = slices.Clone(options.HostsFiles)
+	conf.HostsReloadInterval = options.HostsReloadInterval.Duration
+	conf.DHCPLeasesFile = options.DHCPLeasesFile
+
+	if !options.SystemHosts {
+		return
+	}
+
+	paths, err := systemHostsPaths()
+	if err != nil {
+		fatalf("getting system hosts files: %s", err)
+	}
+
+	conf.HostsFiles = append(paths, conf.HostsFiles...)
+}
+
+// systemHostsPaths returns the absolute paths to the system hosts files.
+func systemHostsPaths() (paths []string, err error) {
+	paths, err = hostsfile.DefaultHostsPaths()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	// The default paths are relative to the root directory of the system
+	// volume.
+	root := string(filepath.Separator)
+	if runtime.GOOS == "windows" {
+		root = filepath.VolumeName(os.Getenv("SystemRoot")) + root
+	}
+
+	for i, p := range paths {
+		paths[i] = filepath.Join(root, filepath.FromSlash(p))
+	}
+
+	return paths, nil
+}
+
+// initSubnets sets the trusted proxies, DNS64, private and cache excluded
+// subnets configuration into conf.
 func initSubnets(conf *proxy.Config, options *Options) {
+	conf.TrustedProxies = trustedProxies(options)
+
 	if conf.UseDNS64 = options.DNS64; conf.UseDNS64 {
 		conf.DNS64Prefs = mustParsePrefixes(options.DNS64Prefix, "dns64 prefix")
 	}
@@ -747,6 +2025,392 @@ func initSubnets(conf *proxy.Config, options *Options) {
 			conf.PrivateSubnets = netutil.SliceSubnetSet(private)
 		}
 	}
+
+	var excluded netutil.SliceSubnetSet
+	for i, c := range options.CacheExcludedClients {
+		if ip, err := netip.ParseAddr(c); err == nil {
+			excluded = append(excluded, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+
+			continue
+		}
+
+		pref, err := netip.ParsePrefix(c)
+		if err != nil {
+			fatalf("parsing cache excluded client at index %d: %v", i, err)
+		}
+
+		excluded = append(excluded, pref.Masked())
+	}
+
+	if len(excluded) > 0 {
+		conf.CacheExcludedClients = excluded
+	}
+}
+
+// initBlocking sets the blocked domains response configuration into conf.
+func initBlocking(conf *proxy.Config, options *Options) {
+	conf.BlockingMode = proxy.BlockingMode(options.BlockingMode)
+	conf.BlockingDryRun = options.BlockingDryRun
+
+	var err error
+	if options.BlockingIPv4 != "" {
+		conf.BlockingIPv4, err = netip.ParseAddr(options.BlockingIPv4)
+		if err != nil {
+			fatalf("parsing blocking ipv4: %s", err)
+		}
+	}
+
+	if options.BlockingIPv6 != "" {
+		conf.BlockingIPv6, err = netip.ParseAddr(options.BlockingIPv6)
+		if err != nil {
+			fatalf("parsing blocking ipv6: %s", err)
+		}
+	}
+
+	for i, p := range options.BlockingPolicies {
+		client, lists, _ := strings.Cut(p, "=")
+		client = strings.TrimSpace(client)
+
+		pol := proxy.BlockingPolicy{Lists: []string{}}
+		if pref, err := netip.ParsePrefix(client); err == nil {
+			pol.Subnet = pref.Masked()
+		} else if err = proxy.ValidateClientID(client); err == nil {
+			pol.ClientID = client
+		} else {
+			fatalf("parsing blocking policy at index %d: %q is neither a subnet nor a client id", i, client)
+		}
+		for _, l := range strings.Split(lists, ",") {
+			if l = strings.TrimSpace(l); l != "" {
+				pol.Lists = append(pol.Lists, l)
+			}
+		}
+
+		conf.BlockingPolicies = append(conf.BlockingPolicies, pol)
+	}
+
+	for _, name := range options.BlockedQueryTypes {
+		qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			fatalf("unknown blocked query type %q", name)
+		}
+
+		conf.BlockedQueryTypes = append(conf.BlockedQueryTypes, qtype)
+	}
+
+	conf.BlockedAnswersStrict = options.BlockedAnswersStrict
+	for i, s := range options.BlockedAnswerSubnets {
+		p, err := proxynetutil.ParseSubnet(s)
+		if err != nil {
+			fatalf("parsing blocked answer subnet at index %d: %s", i, err)
+		}
+
+		conf.BlockedAnswerSubnets = append(conf.BlockedAnswerSubnets, p)
+	}
+}
+
+// initRatelimit sets the ratelimit configuration into conf.
+func initRatelimit(conf *proxy.Config, options *Options) {
+	s, err := ratelimitSettings(options)
+	if err != nil {
+		fatalf("parsing ratelimit settings: %s", err)
+	}
+
+	conf.Ratelimit = s.Ratelimit
+	conf.RatelimitWhitelist = s.Whitelist
+	conf.RatelimitSubnetLenIPv4 = s.SubnetLenIPv4
+	conf.RatelimitSubnetLenIPv6 = s.SubnetLenIPv6
+	conf.RatelimitSlip = s.Slip
+	conf.RatelimitCookie = s.Cookie
+}
+
+// ratelimitSettings returns the ratelimit settings from options.
+func ratelimitSettings(options *Options) (s proxy.RatelimitSettings, err error) {
+	s = proxy.RatelimitSettings{
+		Ratelimit:     options.Ratelimit,
+		SubnetLenIPv4: options.RatelimitSubnetLenIPv4,
+		SubnetLenIPv6: options.RatelimitSubnetLenIPv6,
+		Slip:          options.RatelimitSlip,
+		Cookie:        options.RatelimitCookie,
+	}
+
+	for i, a := range options.RatelimitWhitelist {
+		addr, parseErr := netip.ParseAddr(strings.TrimSpace(a))
+		if parseErr != nil {
+			return s, fmt.Errorf("ratelimit whitelist address at index %d: %w", i, parseErr)
+		}
+
+		s.Whitelist = append(s.Whitelist, addr)
+	}
+
+	return s, nil
+}
+
+// reloadRatelimit reads the ratelimit settings from the config file again and
+// applies them to p.  The settings missing from the file are kept as they were
+// specified on start.
+func reloadRatelimit(p *proxy.Proxy, options *Options) (err error) {
+	next := *options
+	err = decodeConfigFile(options.ConfigPath, &next, options.ConfigStrict)
+	if err != nil {
+		return fmt.Errorf("reloading ratelimit: %w", err)
+	}
+
+	s, err := ratelimitSettings(&next)
+	if err != nil {
+		return fmt.Errorf("reloading ratelimit: %w", err)
+	}
+
+	return p.SetRatelimit(s)
+}
+
+// initStats sets the per-client and per-domain statistics configuration into
+// conf.
+func initStats(conf *proxy.Config, options *Options) {
+	conf.ClientStatsLimit = statsLimit(options.ClientStatsLimit, defaultClientStatsLimit)
+	conf.ClientAnonymization = proxy.ClientAnonymization(options.ClientAnonymization)
+	conf.BlockedDomainsStatsLimit = statsLimit(
+		options.BlockedDomainsStatsLimit,
+		defaultBlockedDomainsStatsLimit,
+	)
+}
+
+// statsLimit returns the limit of the statistics entries for the value of the
+// option, which is zero if unset and negative if there is no limit.  The
+// returned zero means no limit.
+func statsLimit(opt, defaultLimit int) (limit int) {
+	switch {
+	case opt == 0:
+		return defaultLimit
+	case opt < 0:
+		return 0
+	default:
+		return opt
+	}
+}
+
+// initQueryLog sets the query log configuration into conf.
+func initQueryLog(conf *proxy.Config, options *Options) {
+	conf.QueryLogFormat = proxy.QueryLogFormat(options.QueryLogFormat)
+	conf.QueryLogFile = options.QueryLogFile
+	conf.QueryLogFilter = proxy.QueryLogFilter(options.QueryLogFilter)
+	conf.SlowQueryThreshold = options.SlowQueryThreshold.Duration
+}
+
+// initUpstreamHealthCheck sets the upstream health check configuration into
+// conf.
+func initUpstreamHealthCheck(conf *proxy.Config, options *Options) {
+	conf.UpstreamHealthCheckInterval = options.UpstreamHealthCheckInterval.Duration
+	conf.UpstreamHealthCheckFailures = options.UpstreamHealthCheckFailures
+	conf.UpstreamHealthCheckSuccesses = options.UpstreamHealthCheckSuccesses
+}
+
+// initUpstreamRetries sets the upstream retry configuration into conf.
+func initUpstreamRetries(conf *proxy.Config, options *Options) {
+	conf.UpstreamRetries = options.UpstreamRetries
+	conf.UpstreamTryTimeout = options.UpstreamTryTimeout.Duration
+	conf.UpstreamRetryBackoff = options.UpstreamRetryBackoff.Duration
+	conf.UpstreamQueryDeadline = options.UpstreamQueryDeadline.Duration
+}
+
+// initMDNS sets the multicast DNS configuration into conf.
+func initMDNS(conf *proxy.Config, options *Options) {
+	conf.MDNSEnabled = options.MDNS
+	conf.MDNSSingleLabel = options.MDNSSingleLabel
+	conf.MDNSTimeout = options.MDNSTimeout.Duration
+}
+
+// duration is a [timeutil.Duration] which can also be parsed from the
+// command-line arguments.
+type duration timeutil.Duration
+
+// type check
+var _ goFlags.Unmarshaler = (*duration)(nil)
+
+// UnmarshalFlag implements the [goFlags.Unmarshaler] interface for *duration.
+func (d *duration) UnmarshalFlag(s string) (err error) {
+	return (*timeutil.Duration)(d).UnmarshalText([]byte(s))
+}
+
+// UnmarshalText implements the [encoding.TextUnmarshaler] interface for
+// *duration.
+func (d *duration) UnmarshalText(b []byte) (err error) {
+	return (*timeutil.Duration)(d).UnmarshalText(b)
+}
+
+// MarshalText implements the [encoding.TextMarshaler] interface for duration.
+func (d duration) MarshalText() (text []byte, err error) {
+	return timeutil.Duration(d).MarshalText()
+}
+
+// fatalf logs the fatal configuration error and exits.  It's replaced while
+// checking the configuration, see [checkConfig].
+var fatalf = log.Fatalf
+
+// configCheckAbort is the panic value used by [checkConfig] to stop creating
+// the configuration at the first fatal error.
+type configCheckAbort struct {
+	err error
+}
+
+// configProblem is a problem found by [checkConfig].
+type configProblem struct {
+	// Check is the name of the failed check.
+	Check string `json:"check"`
+
+	// Target is the checked entity, e.g. the address of an upstream, if any.
+	Target string `json:"target,omitempty"`
+
+	// Error is the description of the problem.
+	Error string `json:"error"`
+}
+
+// configCheckResult is the summary printed by [checkConfig].
+type configCheckResult struct {
+	// Problems are the problems found, if any.
+	Problems []configProblem `json:"problems"`
+
+	// OK is true if there are no problems.
+	OK bool `json:"ok"`
+}
+
+// checkConfig validates the configuration from options without starting the
+// listeners, writes the JSON summary of the problems found to w, and returns
+// the exit code.  The remote domains lists are only downloaded if
+// [Options.CheckConfig] is "online".
+func checkConfig(options *Options, w io.Writer) (code int) {
+	res := &configCheckResult{
+		Problems: []configProblem{},
+	}
+	addProblem := func(check, target string, err error) {
+		res.Problems = append(res.Problems, configProblem{
+			Check:  check,
+			Target: target,
+			Error:  err.Error(),
+		})
+	}
+
+	if _, _, err := lookupAccount(options.User, options.Group); err != nil {
+		addProblem("user", options.User, err)
+	}
+
+	conf, err := checkedProxyConfig(options)
+	if err != nil {
+		addProblem("config", "", err)
+	} else {
+		checkListenAddrs(options, addProblem)
+
+		p, newErr := proxy.New(conf)
+		if newErr != nil {
+			addProblem("config", "", newErr)
+		} else {
+			for _, probe := range p.ProbeUpstreams() {
+				if probe.Err != nil {
+					addProblem("upstream", probe.Address, probe.Err)
+				}
+			}
+		}
+	}
+
+	online := options.CheckConfig == "online"
+	for _, sources := range [][]string{
+		options.BlockedDomainsLists,
+		options.AllowedDomainsLists,
+		options.ExcludedFromCachingSources,
+	} {
+		for _, src := range sources {
+			if _, listErr := proxy.CheckDomainsList(src, online); listErr != nil {
+				addProblem("list", src, listErr)
+			}
+		}
+	}
+
+	res.OK = len(res.Problems) == 0
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(res)
+	if err != nil {
+		log.Error("writing check result: %s", err)
+
+		return 1
+	}
+
+	if !res.OK {
+		return 1
+	}
+
+	return 0
+}
+
+// checkedProxyConfig is like [createProxyConfig] but returns the first fatal
+// configuration error instead of exiting.
+func checkedProxyConfig(options *Options) (conf *proxy.Config, err error) {
+	fatalf = func(format string, args ...any) {
+		panic(configCheckAbort{err: fmt.Errorf(format, args...)})
+	}
+	defer func() {
+		fatalf = log.Fatalf
+
+		v := recover()
+		if v == nil {
+			return
+		}
+
+		abort, ok := v.(configCheckAbort)
+		if !ok {
+			panic(v)
+		}
+
+		conf, err = nil, abort.err
+	}()
+
+	conf, _ = createProxyConfig(options)
+
+	return conf, nil
+}
+
+// checkListenAddrs reports the listen ports out of range and the listen
+// addresses which can't be bound on this host, as well as the pprof address not
+// allowed without authentication.  The addresses are bound with a random port,
+// so that the running instance doesn't interfere.
+func checkListenAddrs(options *Options, addProblem func(check, target string, err error)) {
+	for _, ports := range [][]int{
+		options.ListenPorts,
+		options.HTTPSListenPorts,
+		options.TLSListenPorts,
+		options.QUICListenPorts,
+		options.DNSCryptListenPorts,
+	} {
+		for _, port := range ports {
+			if port < 0 || port > math.MaxUint16 {
+				addProblem("listen", strconv.Itoa(port), errors.Error("port out of range"))
+			}
+		}
+	}
+
+	for _, a := range options.ListenAddrs {
+		ip, err := netip.ParseAddr(a)
+		if err != nil {
+			// Already reported by createProxyConfig.
+			continue
+		}
+
+		conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)))
+		if err != nil {
+			addProblem("listen", a, err)
+
+			continue
+		}
+
+		_ = conn.Close()
+	}
+
+	if options.Pprof {
+		if _, err := pprofAddr(options); err != nil {
+			addProblem("pprof", options.PprofAddr, err)
+		}
+	}
 }
 
 // IPv6 configuration
@@ -787,38 +2451,70 @@ func newTLSConfig(options *Options) (*tls.Config, error) {
 		tlsMaxVersion = tls.VersionTLS12
 	}
 
-	cert, err := loadX509KeyPair(options.TLSCertPath, options.TLSKeyPath)
-	if err != nil {
-		return nil, fmt.Errorf("could not load TLS cert: %s", err)
+	// The certificate is loaded by the proxy from the files, see
+	// [proxy.Config.TLSCertPath].
+	//
+	// #nosec G402 -- TLS MinVersion is configured by user.
+	conf := &tls.Config{
+		MinVersion: uint16(tlsMinVersion),
+		MaxVersion: uint16(tlsMaxVersion),
 	}
 
-	// #nosec G402 -- TLS MinVersion is configured by user.
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   uint16(tlsMinVersion),
-		MaxVersion:   uint16(tlsMaxVersion),
-	}, nil
-}
-
-// loadX509KeyPair reads and parses a public/private key pair from a pair of
-// files.  The files must contain PEM encoded data.  The certificate file may
-// contain intermediate certificates following the leaf certificate to form a
-// certificate chain.  On successful return, Certificate.Leaf will be nil
-// because the parsed form of the certificate is not retained.
-func loadX509KeyPair(certFile, keyFile string) (crt tls.Certificate, err error) {
-	// #nosec G304 -- Trust the file path that is given in the configuration.
-	certPEMBlock, err := os.ReadFile(certFile)
+	err := initClientAuth(conf, options)
 	if err != nil {
-		return tls.Certificate{}, err
+		return nil, fmt.Errorf("client authentication: %w", err)
+	}
+
+	return conf, nil
+}
+
+// Client certificate authentication modes.
+const (
+	clientAuthNone          = "none"
+	clientAuthVerifyIfGiven = "verify-if-given"
+	clientAuthRequire       = "require"
+)
+
+// initClientAuth sets the client certificate authentication of conf according
+// to options.
+func initClientAuth(conf *tls.Config, options *Options) (err error) {
+	mode := options.TLSClientAuth
+	if mode == "" {
+		mode = clientAuthNone
+		if options.TLSClientCAPath != "" {
+			mode = clientAuthRequire
+		}
+	}
+
+	switch mode {
+	case clientAuthNone:
+		conf.ClientAuth = tls.NoClientCert
+
+		return nil
+	case clientAuthVerifyIfGiven:
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	case clientAuthRequire:
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("bad mode %q", mode)
+	}
+
+	if options.TLSClientCAPath == "" {
+		return fmt.Errorf("mode %q requires the client ca", mode)
 	}
 
 	// #nosec G304 -- Trust the file path that is given in the configuration.
-	keyPEMBlock, err := os.ReadFile(keyFile)
+	b, err := os.ReadFile(options.TLSClientCAPath)
 	if err != nil {
-		return tls.Certificate{}, err
+		return fmt.Errorf("reading client ca: %w", err)
+	}
+
+	conf.ClientCAs = x509.NewCertPool()
+	if !conf.ClientCAs.AppendCertsFromPEM(b) {
+		return fmt.Errorf("no certificates found in %q", options.TLSClientCAPath)
 	}
 
-	return tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	return nil
 }
 
 // loadServersList loads a list of DNS servers from the specified list.  The
@@ -854,3 +2550,276 @@ func loadServersList(sources []string) []string {
 
 	return servers
 }
+
+// defaultBlockedDomainsUpdateSchedule is the default schedule of the blocked
+// domains lists updates, daily at 02:01 UTC.
+const defaultBlockedDomainsUpdateSchedule = "1 2 * * *"
+
+// defaultBlockedDomainsSnapshot is the default path to the file with the
+// compiled blocked domains lists.
+const defaultBlockedDomainsSnapshot = "blocked_domains.snapshot"
+
+// defaultTopBlockedLimit is the default number of the most blocked domains
+// returned by the stats server.
+const defaultTopBlockedLimit = 10
+
+// defaultBlockedDomainsRuntimeFile is the default path to the file the domains
+// blocked at runtime are persisted to.
+const defaultBlockedDomainsRuntimeFile = "blocked_domains_runtime.json"
+
+// defaultClientStatsLimit is the default maximum number of the clients
+// tracked in the per-client statistics.
+const defaultClientStatsLimit = 1000
+
+// defaultBlockedDomainsStatsLimit is the default maximum number of the blocked
+// domains tracked in the per-domain statistics.
+const defaultBlockedDomainsStatsLimit = 10_000
+
+// defaultLogMaxSize is the default size of the log file in megabytes it's
+// rotated after.
+const defaultLogMaxSize = 128
+
+// defaultLogMaxBackups is the default number of the rotated log files kept.
+const defaultLogMaxBackups = 3
+
+// defaultLogRotateCheckInterval is the default interval the size of the log
+// file is checked with.
+const defaultLogRotateCheckInterval = time.Minute
+
+// defaultStatsListenAddr is the default address the stats server listens on.
+const defaultStatsListenAddr = "127.0.0.1"
+
+// defaultPprofAddr is the default address the pprof server listens on.
+const defaultPprofAddr = "localhost:6060"
+
+// defaultStatsHistoryDays is the default number of days the daily statistics
+// are kept for.
+const defaultStatsHistoryDays = 30
+
+// defaultBlockedDomainsMaxAge is the default age after which the downloaded
+// blocked domains list is downloaded again.
+const defaultBlockedDomainsMaxAge = 6 * time.Hour
+
+// blockedDomainsMaxAge returns the validated maximum age of the downloaded
+// blocked domains lists from options.
+func blockedDomainsMaxAge(options *Options) (maxAge time.Duration) {
+	maxAge = options.BlockedDomainsMaxAge.Duration
+	if maxAge < 0 {
+		log.Fatalf("blocked-domains-max-age must not be negative, got %s", maxAge)
+	} else if maxAge == 0 {
+		maxAge = defaultBlockedDomainsMaxAge
+	}
+
+	return maxAge
+}
+
+// openLogFile opens the log file configured in options, which is rotated
+// according to options.
+func openLogFile(options *Options) (f *utils.RotatingFile, err error) {
+	maxSize := options.LogMaxSize
+	if maxSize <= 0 {
+		maxSize = defaultLogMaxSize
+	}
+
+	maxBackups := options.LogMaxBackups
+	if maxBackups == 0 {
+		maxBackups = defaultLogMaxBackups
+	}
+
+	return utils.OpenRotatingFile(options.LogOutput, int64(maxSize)<<20, maxBackups, options.LogCompress)
+}
+
+// logRotateCheckInterval returns the interval the size of the log file is
+// checked with.
+func logRotateCheckInterval(options *Options) (ivl time.Duration) {
+	ivl = options.LogRotateCheckInterval.Duration
+	if ivl < 0 {
+		log.Fatalf("log-rotate-check-interval must not be negative, got %s", ivl)
+	} else if ivl == 0 {
+		ivl = defaultLogRotateCheckInterval
+	}
+
+	return ivl
+}
+
+// rotateLogFile rotates f if it has grown too big.
+func rotateLogFile(f *utils.RotatingFile) {
+	rotated, err := f.RotateIfNeeded()
+	if err != nil {
+		log.Error("rotating log file: %s", err)
+	} else if rotated {
+		log.Info("log file has been rotated")
+	}
+}
+
+// updateDomainsLists updates the allowlists, the lists of the domains excluded
+// from caching, and then the blocked domains lists configured in options.  The
+// allowlists go first, so that the domains they allow aren't blocked by the
+// fresh blocked domains lists.
+func updateDomainsLists(options *Options, maxAge time.Duration) {
+	// The errors are logged and counted by the proxy package.
+	if len(options.AllowedDomainsLists) > 0 {
+		_ = proxy.UpdateAllowedDomains(proxy.Adm, options.AllowedDomainsLists, maxAge)
+	}
+
+	_ = proxy.UpdateExcludedFromCaching(proxy.Efcm, options.ExcludedFromCachingSources, maxAge)
+
+	proxy.UpdateBlockedDomains(proxy.Bdm, options.BlockedDomainsLists, maxAge)
+}
+
+// runStatsServer starts serving the stats API with h in a separate goroutine,
+// unless it's disabled, in which case srv is nil.  The listener is created
+// synchronously, so that the binding errors are returned.
+func runStatsServer(h http.Handler, options *Options) (srv *http.Server, err error) {
+	if options.StatsDisabled {
+		log.Info("stats server is disabled")
+
+		return nil, nil
+	}
+
+	host := options.StatsListenAddr
+	if host == "" {
+		host = defaultStatsListenAddr
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(options.StatsPort))
+
+	scheme := "http"
+	if options.StatsTLS {
+		if options.TLSCertPath == "" || options.TLSKeyPath == "" {
+			return nil, errors.Error("stats-tls requires tls-crt and tls-key")
+		}
+
+		scheme = "https"
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv = &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: defaultStatsReadHeaderTimeout,
+	}
+
+	log.Info("stats server listening on %s://%s", scheme, l.Addr())
+
+	go func() {
+		defer log.OnPanic("stats server")
+
+		var serveErr error
+		if options.StatsTLS {
+			serveErr = srv.ServeTLS(l, options.TLSCertPath, options.TLSKeyPath)
+		} else {
+			serveErr = srv.Serve(l)
+		}
+
+		if !errors.Is(serveErr, http.ErrServerClosed) {
+			log.Error("stats server: %s", serveErr)
+		}
+	}()
+
+	return srv, nil
+}
+
+// registerHealthHandlers adds the liveness and the readiness check handlers of
+// dnsProxy to r.  Both respond with 503 Service Unavailable and the description
+// of the failures in the JSON body if the check fails.
+func registerHealthHandlers(r gin.IRoutes, dnsProxy *proxy.Proxy) {
+	r.GET("/healthz", func(c *gin.Context) {
+		if err := dnsProxy.CheckLiveness(); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": err.Error()})
+
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+	r.GET("/readyz", func(c *gin.Context) {
+		if err := dnsProxy.CheckLiveness(); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"ready": false, "error": err.Error()})
+
+			return
+		}
+
+		readiness := dnsProxy.CheckReadiness()
+		if !readiness.Ready {
+			c.JSON(http.StatusServiceUnavailable, readiness)
+
+			return
+		}
+
+		c.JSON(http.StatusOK, readiness)
+	})
+}
+
+// statsAuth returns the middleware rejecting the stats server requests without
+// the credentials configured in options, or nil if none are configured.  The
+// request is accepted if it has either the bearer token or the basic
+// authentication credentials.
+func statsAuth(options *Options) (h gin.HandlerFunc) {
+	token := options.StatsAuthToken
+	user, pass := options.StatsAuthUser, options.StatsAuthPassword
+	useBasic := user != "" || pass != ""
+	if token == "" && !useBasic {
+		return nil
+	}
+
+	return func(c *gin.Context) {
+		if token != "" {
+			reqToken, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+			if ok && secureEqual(reqToken, token) {
+				c.Next()
+
+				return
+			}
+		}
+
+		if useBasic {
+			reqUser, reqPass, ok := c.Request.BasicAuth()
+
+			// Compare both to not leak which one is wrong through timing.
+			userOK := secureEqual(reqUser, user)
+			passOK := secureEqual(reqPass, pass)
+			if ok && userOK && passOK {
+				c.Next()
+
+				return
+			}
+
+			c.Header("WWW-Authenticate", `Basic realm="dnsproxy"`)
+		}
+
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	}
+}
+
+// secureEqual compares a and b in constant time.
+func secureEqual(a, b string) (ok bool) {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// scheduleBlockedDomainsUpdates adds the job calling update to s according to
+// schedule, which is either an interval, e.g. "1h", or a cron expression.  An
+// empty schedule means [defaultBlockedDomainsUpdateSchedule].
+func scheduleBlockedDomainsUpdates(s *gocron.Scheduler, schedule string, update func()) (err error) {
+	if schedule == "" {
+		schedule = defaultBlockedDomainsUpdateSchedule
+	}
+
+	if ivl, parseErr := time.ParseDuration(schedule); parseErr == nil {
+		if ivl <= 0 {
+			return fmt.Errorf("update interval must be positive, got %s", ivl)
+		}
+
+		_, err = s.Every(ivl).Do(update)
+	} else {
+		_, err = s.Cron(schedule).Do(update)
+	}
+
+	if err != nil {
+		return fmt.Errorf("schedule %q: %w", schedule, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 5 * time.Second
+
+// freePort returns a TCP port on the loopback interface which is very likely
+// to be free for both TCP and UDP.
+func freePort(t *testing.T) (port int) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	port = l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	return port
+}
+
+func TestRunProxy_shutdown(t *testing.T) {
+	// runProxy keeps its state files in the working directory.
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { require.NoError(t, os.Chdir(wd)) })
+
+	dnsPort := freePort(t)
+	dnsAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(dnsPort))
+	statsPort := freePort(t)
+	statsURL := "http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(statsPort)) + "/stats"
+
+	options, err := parseOptions([]string{
+		"--listen=127.0.0.1",
+		"--port=" + strconv.Itoa(dnsPort),
+		"--upstream=127.0.0.1:1",
+		"--stats-listen-addr=127.0.0.1",
+		"--stats_port=" + strconv.Itoa(statsPort),
+	})
+	require.NoError(t, err)
+
+	stop := make(chan os.Signal, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- runProxy(options, stop)
+	}()
+
+	require.Eventually(t, func() (ok bool) {
+		resp, getErr := http.Get(statsURL)
+		if getErr != nil {
+			return false
+		}
+
+		_ = resp.Body.Close()
+
+		return resp.StatusCode == http.StatusOK
+	}, testTimeout, testTimeout/100)
+
+	testutil.RequireSend[os.Signal](t, stop, syscall.SIGTERM, testTimeout)
+
+	err, _ = testutil.RequireReceive(t, errCh, testTimeout)
+	require.NoError(t, err)
+
+	_, err = http.Get(statsURL)
+	assert.Error(t, err)
+
+	_, err = net.Dial("tcp", dnsAddr)
+	assert.Error(t, err)
+
+	assert.FileExists(t, filepath.Join(dir, "stats.json"))
+}
+
+func TestRegisterHealthHandlers(t *testing.T) {
+	ups, err := upstream.AddressToUpstream("127.0.0.1:1", &upstream.Options{
+		Timeout: testTimeout / 10,
+	})
+	require.NoError(t, err)
+
+	dnsProxy, err := proxy.New(&proxy.Config{
+		UDPListenAddr: []*net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1)}},
+		UpstreamConfig: &proxy.UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies:         netutil.SliceSubnetSet{netip.MustParsePrefix("127.0.0.0/8")},
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+	require.NoError(t, err)
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	registerHealthHandlers(r, dnsProxy)
+
+	get := func(t *testing.T, path string) (code int, body map[string]any) {
+		t.Helper()
+
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		require.NoError(t, json.NewDecoder(rw.Body).Decode(&body))
+
+		return rw.Code, body
+	}
+
+	t.Run("not_started", func(t *testing.T) {
+		code, body := get(t, "/healthz")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, "unavailable", body["status"])
+
+		code, body = get(t, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, false, body["ready"])
+	})
+
+	ctx := context.Background()
+	require.NoError(t, dnsProxy.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return dnsProxy.Shutdown(ctx) })
+
+	t.Run("started", func(t *testing.T) {
+		code, body := get(t, "/healthz")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "ok", body["status"])
+
+		code, body = get(t, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, false, body["ready"])
+
+		upsStatus := testutil.RequireTypeAssert[[]any](t, body["upstreams"])
+		require.Len(t, upsStatus, 1)
+
+		st := testutil.RequireTypeAssert[map[string]any](t, upsStatus[0])
+		assert.Equal(t, ups.Address(), st["address"])
+		assert.Equal(t, false, st["ok"])
+		assert.NotEmpty(t, st["error"])
+	})
+}
+
+func TestPprofAddr(t *testing.T) {
+	testCases := []struct {
+		name       string
+		addr       string
+		token      string
+		wantAddr   string
+		wantErrMsg string
+	}{{
+		name:       "default",
+		addr:       "",
+		token:      "",
+		wantAddr:   defaultPprofAddr,
+		wantErrMsg: "",
+	}, {
+		name:       "loopback",
+		addr:       "127.0.0.1:6061",
+		token:      "",
+		wantAddr:   "127.0.0.1:6061",
+		wantErrMsg: "",
+	}, {
+		name:       "loopback_ipv6",
+		addr:       "[::1]:6061",
+		token:      "",
+		wantAddr:   "[::1]:6061",
+		wantErrMsg: "",
+	}, {
+		name:     "public_no_auth",
+		addr:     "192.0.2.1:6060",
+		token:    "",
+		wantAddr: "",
+		wantErrMsg: `pprof address "192.0.2.1:6060" is not a loopback one, ` +
+			`but no stats server authentication is configured`,
+	}, {
+		name:     "all_interfaces_no_auth",
+		addr:     ":6060",
+		token:    "",
+		wantAddr: "",
+		wantErrMsg: `pprof address ":6060" is not a loopback one, ` +
+			`but no stats server authentication is configured`,
+	}, {
+		name:       "public_auth",
+		addr:       "192.0.2.1:6060",
+		token:      "secret",
+		wantAddr:   "192.0.2.1:6060",
+		wantErrMsg: "",
+	}, {
+		name:       "bad",
+		addr:       "localhost",
+		token:      "",
+		wantAddr:   "",
+		wantErrMsg: "pprof address: address localhost: missing port in address",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, err := pprofAddr(&Options{
+				PprofAddr:      tc.addr,
+				StatsAuthToken: tc.token,
+			})
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			assert.Equal(t, tc.wantAddr, addr)
+		})
+	}
+}
+
+func TestRunPprof_auth(t *testing.T) {
+	const token = "secret"
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	srv, err := runPprof(&Options{
+		Pprof:          true,
+		PprofAddr:      addr,
+		StatsAuthToken: token,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		return srv.Shutdown(context.Background())
+	})
+
+	u := "http://" + addr + "/debug/pprof/cmdline"
+
+	resp, err := http.Get(u)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, resp.Body.Close)
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, resp.Body.Close)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
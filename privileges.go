@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// account is the user and the group the process switches to after binding the
+// sockets.
+type account struct {
+	// name is the name of the user, used for logging.
+	name string
+
+	// uid is the user ID.
+	uid int
+
+	// gid is the primary group ID.
+	gid int
+}
+
+// lookupAccount returns the account with the given user and group.  Both may be
+// given either by name or by numeric ID.  The primary group of the user is used
+// if groupName is empty.  ok is false if neither is set.
+func lookupAccount(userName, groupName string) (acc *account, ok bool, err error) {
+	if userName == "" && groupName == "" {
+		return nil, false, nil
+	} else if userName == "" {
+		return nil, false, fmt.Errorf("group %q is set without user", groupName)
+	}
+
+	u, err := user.Lookup(userName)
+	if err != nil {
+		var idErr error
+		u, idErr = user.LookupId(userName)
+		if idErr != nil {
+			return nil, false, fmt.Errorf("looking up user: %w", err)
+		}
+	}
+
+	acc = &account{name: u.Username}
+	acc.uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, false, fmt.Errorf("user %q: bad uid: %w", userName, err)
+	}
+
+	gidStr := u.Gid
+	if groupName != "" {
+		g, lookupErr := user.LookupGroup(groupName)
+		if lookupErr != nil {
+			g, err = user.LookupGroupId(groupName)
+			if err != nil {
+				return nil, false, fmt.Errorf("looking up group: %w", lookupErr)
+			}
+		}
+
+		gidStr = g.Gid
+	}
+
+	acc.gid, err = strconv.Atoi(gidStr)
+	if err != nil {
+		return nil, false, fmt.Errorf("group %q: bad gid: %w", groupName, err)
+	}
+
+	return acc, true, nil
+}
+
+// writablePaths returns the paths from options the process writes to after
+// dropping the privileges.  The directories are included for the files which
+// are replaced or rotated, since those are created anew.
+func writablePaths(options *Options) (paths []string) {
+	// The stats and the downloaded lists are kept in the working directory.
+	paths = []string{"."}
+
+	runtimePath := options.BlockedDomainsRuntimeFile
+	if runtimePath == "" {
+		runtimePath = defaultBlockedDomainsRuntimeFile
+	}
+
+	snapshotPath := options.BlockedDomainsSnapshot
+	if snapshotPath == "" {
+		snapshotPath = defaultBlockedDomainsSnapshot
+	}
+
+	files := []string{runtimePath, snapshotPath}
+	if options.LogOutput != "" {
+		files = append(files, options.LogOutput)
+	}
+
+	if options.QueryLogFile != "" {
+		files = append(files, options.QueryLogFile)
+	}
+
+	if options.BootstrapCacheFile != "" {
+		files = append(files, options.BootstrapCacheFile)
+	}
+
+	for _, f := range files {
+		paths = append(paths, filepath.Dir(f), f)
+	}
+
+	return paths
+}
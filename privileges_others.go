@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// dropPrivileges returns an error if the user or the group is set in options,
+// since switching those isn't supported on the current platform.
+func dropPrivileges(options *Options) (err error) {
+	if options.User == "" && options.Group == "" {
+		return nil
+	}
+
+	return errors.Error("user and group options are not supported on this platform")
+}
@@ -0,0 +1,112 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupAccount(t *testing.T) {
+	testCases := []struct {
+		wantAcc    *account
+		name       string
+		user       string
+		group      string
+		wantErrMsg string
+		wantOK     bool
+	}{{
+		wantAcc:    nil,
+		name:       "none",
+		user:       "",
+		group:      "",
+		wantErrMsg: "",
+		wantOK:     false,
+	}, {
+		wantAcc:    &account{name: "root", uid: 0, gid: 0},
+		name:       "name",
+		user:       "root",
+		group:      "",
+		wantErrMsg: "",
+		wantOK:     true,
+	}, {
+		wantAcc:    &account{name: "root", uid: 0, gid: 0},
+		name:       "ids",
+		user:       "0",
+		group:      "0",
+		wantErrMsg: "",
+		wantOK:     true,
+	}, {
+		wantAcc:    nil,
+		name:       "group_only",
+		user:       "",
+		group:      "root",
+		wantErrMsg: `group "root" is set without user`,
+		wantOK:     false,
+	}, {
+		wantAcc:    nil,
+		name:       "missing_user",
+		user:       "no-such-user-dnsproxy",
+		group:      "",
+		wantErrMsg: "looking up user: user: unknown user no-such-user-dnsproxy",
+		wantOK:     false,
+	}, {
+		wantAcc:    nil,
+		name:       "missing_group",
+		user:       "root",
+		group:      "no-such-group-dnsproxy",
+		wantErrMsg: "looking up group: group: unknown group no-such-group-dnsproxy",
+		wantOK:     false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			acc, ok, err := lookupAccount(tc.user, tc.group)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.wantAcc, acc)
+		})
+	}
+}
+
+func TestWritablePaths(t *testing.T) {
+	options := &Options{
+		BlockedDomainsRuntimeFile: "runtime/blocked.txt",
+		BlockedDomainsSnapshot:    "snapshot/blocked.bin",
+		BootstrapCacheFile:        "cache/bootstrap.json",
+	}
+
+	assert.Equal(t, []string{
+		".",
+		"runtime", "runtime/blocked.txt",
+		"snapshot", "snapshot/blocked.bin",
+		"cache", "cache/bootstrap.json",
+	}, writablePaths(options))
+}
+
+func TestCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "stats.json")
+	require.NoError(t, os.WriteFile(file, nil, 0o644))
+
+	cacheDir := filepath.Join(dir, "cache")
+	require.NoError(t, os.Mkdir(cacheDir, 0o755))
+
+	cacheFile := filepath.Join(cacheDir, "bootstrap.json")
+	require.NoError(t, os.WriteFile(cacheFile, nil, 0o644))
+
+	err := checkWritable([]string{
+		dir,
+		file,
+		filepath.Join(dir, "missing.txt"),
+		cacheDir,
+		cacheFile,
+	})
+	assert.NoError(t, err)
+}
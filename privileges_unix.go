@@ -0,0 +1,99 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/sys/unix"
+)
+
+// dropPrivileges switches the process to the user and the group from options,
+// if any, and makes sure that it can't regain the privileges.  It also checks
+// that the files written later are writable by that user.  It must be called
+// after all the privileged sockets are bound.
+func dropPrivileges(options *Options) (err error) {
+	acc, ok, err := lookupAccount(options.User, options.Group)
+	if err != nil || !ok {
+		return err
+	}
+
+	// Drop the supplementary groups first, since that requires the privileges.
+	err = syscall.Setgroups([]int{acc.gid})
+	if err != nil {
+		return fmt.Errorf("setting groups: %w", err)
+	}
+
+	err = syscall.Setgid(acc.gid)
+	if err != nil {
+		return fmt.Errorf("setting gid %d: %w", acc.gid, err)
+	}
+
+	err = syscall.Setuid(acc.uid)
+	if err != nil {
+		return fmt.Errorf("setting uid %d: %w", acc.uid, err)
+	}
+
+	err = checkCredentials(acc)
+	if err != nil {
+		return err
+	}
+
+	log.Info("dropped privileges to user %s (uid %d, gid %d)", acc.name, acc.uid, acc.gid)
+
+	err = checkWritable(writablePaths(options))
+	if err != nil {
+		return fmt.Errorf("checking paths writable by %s: %w", acc.name, err)
+	}
+
+	return nil
+}
+
+// checkCredentials returns an error if the real and effective IDs of the
+// process aren't the ones of acc, or if the root privileges can be regained.
+func checkCredentials(acc *account) (err error) {
+	if uid, euid := os.Getuid(), os.Geteuid(); uid != acc.uid || euid != acc.uid {
+		return fmt.Errorf("uid is %d and euid is %d after switching to %d", uid, euid, acc.uid)
+	}
+
+	if gid, egid := os.Getgid(), os.Getegid(); gid != acc.gid || egid != acc.gid {
+		return fmt.Errorf("gid is %d and egid is %d after switching to %d", gid, egid, acc.gid)
+	}
+
+	if acc.uid != 0 && syscall.Setuid(0) == nil {
+		return errors.Error("root privileges can be regained after switching user")
+	}
+
+	return nil
+}
+
+// checkWritable returns an error if any of the paths can't be written to by
+// the current user.  The missing paths are skipped, since they're checked
+// through their directories.
+func checkWritable(paths []string) (err error) {
+	var errs []error
+	for _, p := range paths {
+		mode := uint32(unix.W_OK)
+		fi, statErr := os.Stat(p)
+		if errors.Is(statErr, fs.ErrNotExist) {
+			continue
+		} else if statErr != nil {
+			errs = append(errs, statErr)
+
+			continue
+		} else if fi.IsDir() {
+			mode |= unix.X_OK
+		}
+
+		if accErr := unix.Access(p, mode); accErr != nil {
+			errs = append(errs, fmt.Errorf("%q is not writable: %w", p, accErr))
+		}
+	}
+
+	return errors.Join(errs...)
+}
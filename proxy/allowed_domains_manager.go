@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/utils"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Adm is a global instance of the AllowedDomainsManager struct.
+var Adm = newAllowedDomainsManager()
+
+// AllowedDomainsManager keeps the domains from the allowlists.  The allowed
+// domains are never blocked, even if they match a wildcard from a blocked
+// domains list.
+type AllowedDomainsManager struct {
+	// root is the root of the trie of the allowed domains and wildcards along
+	// with the bit masks of the allowlists they come from.
+	root *domainNode
+
+	// allowedLists are the names of the allowlists in the order of their bits
+	// in root.
+	allowedLists []string
+
+	numDomains int
+	mux        sync.Mutex
+
+	// updateMux serializes the updates of the allowlists.
+	updateMux sync.Mutex
+}
+
+func newAllowedDomainsManager() *AllowedDomainsManager {
+	return &AllowedDomainsManager{
+		root:         &domainNode{},
+		allowedLists: []string{},
+	}
+}
+
+// checkDomain returns true if the domain matches an entry of the allowlists.
+// allowedDomain is the matched entry and listName is the name of its list.
+func (r *AllowedDomainsManager) checkDomain(domain string) (ok bool, allowedDomain, listName string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.numDomains == 0 {
+		return false, "", ""
+	}
+
+	allowedDomain, ok = r.root.match(domain, func(uint64) bool { return true })
+	if !ok {
+		return false, "", ""
+	}
+
+	lists, _ := r.root.entryLists(allowedDomain)
+	for i, name := range r.allowedLists {
+		if lists&(1<<i) != 0 {
+			return true, allowedDomain, name
+		}
+	}
+
+	return true, allowedDomain, ""
+}
+
+// getNumDomains returns the number of the allowed domains and wildcards.
+func (r *AllowedDomainsManager) getNumDomains() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.numDomains
+}
+
+// UpdateAllowedDomains downloads the allowlists older than maxAge and reloads
+// all of them into r.  The allowlists are in the same formats as the blocked
+// domains lists, both the blocking and the exception rules of the adblock
+// syntax allow the domain along with its subdomains.  The previously loaded
+// entries of the lists which fail to update are kept.
+func UpdateAllowedDomains(r *AllowedDomainsManager, sources []string, maxAge time.Duration) (err error) {
+	r.updateMux.Lock()
+	defer r.updateMux.Unlock()
+
+	if len(sources) > maxBlockedLists {
+		return fmt.Errorf("too many allowlists: %d, max %d", len(sources), maxBlockedLists)
+	}
+
+	var errs []error
+	for _, source := range sources {
+		filePath, isLocal := blockedListFilePath(source)
+		if isLocal {
+			continue
+		}
+
+		fileSize, modificationTime, statErr := utils.GetFileInfo(filePath)
+		if statErr == nil && time.Since(modificationTime) <= maxAge && fileSize > 0 {
+			continue
+		}
+
+		_, err = utils.DownloadFromUrl(source, filePath)
+		if err != nil {
+			errs = append(errs, allowlistError(fmt.Errorf("downloading %s: %w", source, err)))
+		}
+	}
+
+	next := newAllowedDomainsManager()
+	for i, source := range sources {
+		filePath, _ := blockedListFilePath(source)
+		listName := utils.TrimExt(filePath)
+		next.allowedLists = append(next.allowedLists, listName)
+
+		domains, allowed, parseErr := parseBlockedDomainsFile(filePath, listName)
+		if parseErr != nil {
+			errs = append(errs, allowlistError(fmt.Errorf("loading %s: %w", filePath, parseErr)))
+
+			// Keep the previously loaded data of the list.
+			next.insertEntries(r.listEntries(listName), 1<<i)
+
+			continue
+		}
+
+		entries := make([]string, 0, len(domains)+2*len(allowed))
+		for _, domain := range domains {
+			entries = append(entries, domain.V1)
+		}
+
+		for _, domain := range allowed {
+			entries = append(entries, domain, "*."+domain)
+		}
+
+		next.insertEntries(entries, 1<<i)
+	}
+
+	r.mux.Lock()
+	r.root, r.allowedLists, r.numDomains = next.root, next.allowedLists, next.numDomains
+	r.mux.Unlock()
+
+	SM.Set("allowed_domains::num_domains", r.getNumDomains())
+	log.Info("total number of allowed domains %d", r.getNumDomains())
+
+	return errors.Join(errs...)
+}
+
+// insertEntries adds the entries marked with lists to r.  r is expected to be
+// unused by the other goroutines.
+func (r *AllowedDomainsManager) insertEntries(entries []string, lists uint64) {
+	for _, entry := range entries {
+		if r.root.insert(normalizeDomain(entry), lists) {
+			r.numDomains++
+		}
+	}
+}
+
+// listEntries returns the entries of r which come from the list with the given
+// name.
+func (r *AllowedDomainsManager) listEntries(list string) (entries []string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for i, name := range r.allowedLists {
+		if name != list {
+			continue
+		}
+
+		r.root.walk("", func(entry string, lists uint64) {
+			if lists&(1<<i) != 0 {
+				entries = append(entries, entry)
+			}
+		})
+	}
+
+	return entries
+}
+
+// allowlistError logs err occurred while updating the allowlists, counts it
+// in the statistics, and returns it.
+func allowlistError(err error) error {
+	log.Error("updating allowed domains: %s", err)
+
+	SM.Increment("allowed_domains::update_errors", 1)
+
+	return err
+}
+
+// The names of the sources of the allowed domains other than the allowlists.
+const (
+	// allowedSourceExcluded is the source of the domains excluded from
+	// blocking, see [Edm].
+	allowedSourceExcluded = "(excluded)"
+
+	// allowedSourceExceptions is the source of the domains allowed by the
+	// exception rules of the blocked domains lists.
+	allowedSourceExceptions = "(exceptions)"
+)
+
+// allowedBy returns true if the domain is never blocked.  The domains excluded
+// from blocking, the exception rules of the blocked domains lists, and the
+// allowlists are checked in that order.  rule is the matched entry and source
+// is the name of its allowlist or one of the allowedSource constants.
+func allowedBy(domain string) (rule, source string, ok bool) {
+	if Edm.checkDomain(domain) {
+		return domain, allowedSourceExcluded, true
+	}
+
+	if Bdm.checkException(domain) {
+		return domain, allowedSourceExceptions, true
+	}
+
+	ok, rule, source = Adm.checkDomain(domain)
+
+	return rule, source, ok
+}
+
+// isAllowedDomain returns true if the domain blocked by blockedDomain is
+// allowed, see allowedBy, and counts the hit in the statistics.
+func (p *Proxy) isAllowedDomain(domain, blockedDomain string) (ok bool) {
+	rule, source, ok := allowedBy(domain)
+	if !ok {
+		return false
+	}
+
+	log.Debug("dnsproxy: %s blocked by rule %s is allowed by rule %s from %s", domain, blockedDomain, rule, source)
+
+	SM.Increment("allowed_domains::allowed_responses", 1)
+	countDomain(p.allowedDomainsStats, "allowed_domains", source, domain)
+
+	return true
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setTestAllowedDomains replaces the contents of Adm with the allowlist with
+// the given name and contents for the duration of the test.
+func setTestAllowedDomains(t *testing.T, listName, contents string) {
+	t.Helper()
+
+	listPath := filepath.Join(t.TempDir(), listName+".txt")
+	err := os.WriteFile(listPath, []byte(contents), 0o644)
+	require.NoError(t, err)
+
+	prev := Adm
+	Adm = newAllowedDomainsManager()
+	t.Cleanup(func() { Adm = prev })
+
+	require.NoError(t, UpdateAllowedDomains(Adm, []string{listPath}, time.Hour))
+}
+
+func TestAllowedDomainsManager_checkDomain(t *testing.T) {
+	setTestAllowedDomains(t, "allowed", "CDN.Example.com\n*.static.example\n@@||safe.example^\n||adblock.example^\n")
+
+	testCases := []struct {
+		name     string
+		domain   string
+		wantRule string
+		want     bool
+	}{{
+		name:     "exact",
+		domain:   "cdn.example.com",
+		wantRule: "cdn.example.com",
+		want:     true,
+	}, {
+		name:     "exact_subdomain",
+		domain:   "sub.cdn.example.com",
+		wantRule: "",
+		want:     false,
+	}, {
+		name:     "wildcard",
+		domain:   "img.static.example",
+		wantRule: "*.static.example",
+		want:     true,
+	}, {
+		name:     "exception_rule",
+		domain:   "www.safe.example",
+		wantRule: "*.safe.example",
+		want:     true,
+	}, {
+		name:     "blocking_rule",
+		domain:   "adblock.example",
+		wantRule: "adblock.example",
+		want:     true,
+	}, {
+		name:     "not_allowed",
+		domain:   "example.com",
+		wantRule: "",
+		want:     false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, rule, list := Adm.checkDomain(tc.domain)
+			assert.Equal(t, tc.want, ok)
+			assert.Equal(t, tc.wantRule, rule)
+			if tc.want {
+				assert.Contains(t, list, "allowed")
+			}
+		})
+	}
+}
+
+func TestUpdateAllowedDomains_failedList(t *testing.T) {
+	prev := Adm
+	Adm = newAllowedDomainsManager()
+	t.Cleanup(func() { Adm = prev })
+
+	listPath := filepath.Join(t.TempDir(), "allowed.txt")
+	err := os.WriteFile(listPath, []byte("cdn.example.com\n"), 0o644)
+	require.NoError(t, err)
+
+	require.NoError(t, UpdateAllowedDomains(Adm, []string{listPath}, time.Hour))
+	require.NoError(t, os.Remove(listPath))
+
+	err = UpdateAllowedDomains(Adm, []string{listPath}, time.Hour)
+	require.Error(t, err)
+
+	ok, _, _ := Adm.checkDomain("cdn.example.com")
+	assert.True(t, ok)
+}
+
+func TestProxy_Resolve_allowedDomains(t *testing.T) {
+	setTestBlockedDomains(t, "ads", "*.example.com\n")
+	setTestAllowedDomains(t, "allowed", "cdn.example.com\n")
+
+	ansIP := net.IP{192, 0, 2, 2}
+	p := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{&testUpstream{ans: []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: "cdn.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   ansIP,
+			}}}},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		BlockingMode:           BlockingModeREFUSED,
+	})
+
+	prev, _ := SM.GetUint64("allowed_domains::allowed_responses")
+
+	resolve := func(t *testing.T, host string) (res *dns.Msg) {
+		t.Helper()
+
+		dctx := &DNSContext{
+			Req:   (&dns.Msg{}).SetQuestion(host, dns.TypeA),
+			Proto: ProtoUDP,
+			Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+
+		require.NoError(t, p.Resolve(dctx))
+		require.NotNil(t, dctx.Res)
+
+		return dctx.Res
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		res := resolve(t, "cdn.example.com.")
+		require.Len(t, res.Answer, 1)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, res.Answer[0])
+		assert.True(t, ansIP.Equal(a.A))
+
+		n, _ := SM.GetUint64("allowed_domains::allowed_responses")
+		assert.Equal(t, prev+1, n)
+	})
+
+	t.Run("blocked", func(t *testing.T) {
+		res := resolve(t, "ads.example.com.")
+		assert.Equal(t, dns.RcodeRefused, res.Rcode)
+	})
+}
+
+func TestAllowedBy(t *testing.T) {
+	setTestBlockedDomains(t, "ads", "*.example.com\n@@||safe.example.com^\n")
+	setTestAllowedDomains(t, "allowed", "cdn.example.com\n")
+
+	Edm.AddDomain("*.zone.example.com")
+	t.Cleanup(Edm.clear)
+
+	testCases := []struct {
+		name       string
+		domain     string
+		wantRule   string
+		wantSource string
+		wantOK     bool
+	}{{
+		name:       "excluded",
+		domain:     "ads.zone.example.com",
+		wantRule:   "ads.zone.example.com",
+		wantSource: allowedSourceExcluded,
+		wantOK:     true,
+	}, {
+		name:       "exception",
+		domain:     "img.safe.example.com",
+		wantRule:   "img.safe.example.com",
+		wantSource: allowedSourceExceptions,
+		wantOK:     true,
+	}, {
+		name:       "allowlist",
+		domain:     "cdn.example.com",
+		wantRule:   "cdn.example.com",
+		wantSource: "allowed",
+		wantOK:     true,
+	}, {
+		name:       "blocked",
+		domain:     "ads.example.com",
+		wantRule:   "",
+		wantSource: "",
+		wantOK:     false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule, source, ok := allowedBy(tc.domain)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.wantRule, rule)
+			assert.Equal(t, tc.wantSource, source)
+		})
+	}
+}
+
+func TestProxy_isAllowedDomain_statsLimit(t *testing.T) {
+	setTestStats(t)
+	setTestAllowedDomains(t, "allowed", "*.example.com\n")
+
+	p := &Proxy{allowedDomainsStats: newDomainsStatsTracker("allowed_domains", 1)}
+
+	require.True(t, p.isAllowedDomain("one.example.com", "*.example.com"))
+	require.True(t, p.isAllowedDomain("one.example.com", "*.example.com"))
+	require.True(t, p.isAllowedDomain("two.example.com", "*.example.com"))
+
+	assert.False(t, SM.Exists("allowed_domains::domains::allowed::one.example.com"))
+
+	n, ok := SM.GetUint64("allowed_domains::domains::allowed::two.example.com")
+	require.True(t, ok)
+	assert.Equal(t, uint64(1), n)
+
+	n, ok = SM.GetUint64("allowed_domains::domains::allowed::" + domainsOtherKey)
+	require.True(t, ok)
+	assert.Equal(t, uint64(2), n)
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+)
+
+// ClientAnonymization defines how the client addresses are recorded in the
+// logs and statistics.
+type ClientAnonymization string
+
+// ClientAnonymization values.
+const (
+	// ClientAnonymizationNone records the full addresses.
+	ClientAnonymizationNone ClientAnonymization = ""
+
+	// ClientAnonymizationTruncate records the /24 subnets of the IPv4
+	// addresses and the /48 subnets of the IPv6 ones.
+	ClientAnonymizationTruncate ClientAnonymization = "truncate"
+
+	// ClientAnonymizationHash records the hashes of the addresses salted with
+	// a random value generated on each start.
+	ClientAnonymizationHash ClientAnonymization = "hash"
+)
+
+// The lengths of the prefixes the client addresses are truncated to.
+const (
+	anonymizedPrefixLenIPv4 = 24
+	anonymizedPrefixLenIPv6 = 48
+)
+
+// validateClientAnonymization returns an error if the client anonymization
+// mode is unknown.
+func (p *Proxy) validateClientAnonymization() (err error) {
+	switch p.ClientAnonymization {
+	case
+		ClientAnonymizationNone,
+		ClientAnonymizationTruncate,
+		ClientAnonymizationHash:
+		return nil
+	default:
+		return fmt.Errorf("unknown client anonymization %q", p.ClientAnonymization)
+	}
+}
+
+// newAnonymizationSalt returns a new random salt for hashing the client
+// addresses.
+func newAnonymizationSalt() (salt []byte) {
+	salt = make([]byte, 16)
+	_, _ = rand.Read(salt)
+
+	return salt
+}
+
+// anonymizeAddr returns the representation of the client address addr
+// anonymized according to the configuration.  It must be used for every client
+// address written to the logs or used in the statistics keys.  The result is
+// suitable for the keys of [StatsManager].
+func (p *Proxy) anonymizeAddr(addr netip.Addr) (s string) {
+	addr = addr.Unmap()
+
+	switch p.ClientAnonymization {
+	case ClientAnonymizationTruncate:
+		bits := anonymizedPrefixLenIPv4
+		if addr.Is6() {
+			bits = anonymizedPrefixLenIPv6
+		}
+
+		pref, _ := addr.Prefix(bits)
+
+		return clientStatsKey(pref.Addr()) + "/" + strconv.Itoa(bits)
+	case ClientAnonymizationHash:
+		h := sha256.New()
+		_, _ = h.Write(p.anonymizationSalt)
+		_, _ = h.Write(addr.AsSlice())
+
+		return hex.EncodeToString(h.Sum(nil)[:8])
+	default:
+		return clientStatsKey(addr)
+	}
+}
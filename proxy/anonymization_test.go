@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxy_anonymizeAddr(t *testing.T) {
+	v4 := netip.MustParseAddr("192.0.2.123")
+	v6 := netip.MustParseAddr("2001:db8:1:2:3:4:5:6")
+
+	testCases := []struct {
+		name   string
+		mode   ClientAnonymization
+		wantV4 string
+		wantV6 string
+	}{{
+		name:   "none",
+		mode:   ClientAnonymizationNone,
+		wantV4: "192.0.2.123",
+		wantV6: "2001:0db8:0001:0002:0003:0004:0005:0006",
+	}, {
+		name:   "truncate",
+		mode:   ClientAnonymizationTruncate,
+		wantV4: "192.0.2.0/24",
+		wantV6: "2001:0db8:0001:0000:0000:0000:0000:0000/48",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: Config{ClientAnonymization: tc.mode}}
+
+			assert.Equal(t, tc.wantV4, p.anonymizeAddr(v4))
+			assert.Equal(t, tc.wantV4, p.anonymizeAddr(netip.AddrFrom16(v4.As16())))
+			assert.Equal(t, tc.wantV6, p.anonymizeAddr(v6))
+		})
+	}
+
+	t.Run("hash", func(t *testing.T) {
+		p := &Proxy{
+			Config:            Config{ClientAnonymization: ClientAnonymizationHash},
+			anonymizationSalt: newAnonymizationSalt(),
+		}
+
+		key := p.anonymizeAddr(v4)
+		assert.Len(t, key, 16)
+		assert.NotContains(t, key, "192")
+		assert.Equal(t, key, p.anonymizeAddr(v4))
+		assert.NotEqual(t, key, p.anonymizeAddr(v6))
+
+		other := &Proxy{
+			Config:            Config{ClientAnonymization: ClientAnonymizationHash},
+			anonymizationSalt: newAnonymizationSalt(),
+		}
+		assert.NotEqual(t, key, other.anonymizeAddr(v4))
+	})
+}
+
+func TestProxy_newQueryLogEntry_anonymized(t *testing.T) {
+	p := &Proxy{Config: Config{ClientAnonymization: ClientAnonymizationTruncate}}
+
+	d := &DNSContext{
+		Req:  (&dns.Msg{}).SetQuestion("anon.example.", dns.TypeA),
+		Addr: netip.MustParseAddrPort("192.0.2.123:5353"),
+	}
+
+	e := p.newQueryLogEntry(d, d.Req)
+	assert.Equal(t, "192.0.2.0/24", e.Client)
+}
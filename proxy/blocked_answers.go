@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"slices"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// filterBlockedAnswers returns resp with the A and AAAA records within the
+// BlockedAnswerSubnets of p removed.  If all the addresses of resp are blocked,
+// or BlockedAnswersStrict is set and any of them is, the blocked response for
+// req is returned instead.  resp is returned as is in the dry run mode.
+func (p *Proxy) filterBlockedAnswers(req, resp *dns.Msg) (filtered *dns.Msg) {
+	if resp == nil || len(p.BlockedAnswerSubnets) == 0 || len(resp.Answer) == 0 {
+		return resp
+	}
+
+	set := netutil.SliceSubnetSet(p.BlockedAnswerSubnets)
+	isBlocked := func(rr dns.RR) bool {
+		ip := proxyutil.IPFromRR(rr)
+
+		return ip.IsValid() && set.Contains(ip)
+	}
+
+	numAddrs, numBlocked := 0, 0
+	for _, rr := range resp.Answer {
+		if proxyutil.IPFromRR(rr).IsValid() {
+			numAddrs++
+		}
+
+		if isBlocked(rr) {
+			numBlocked++
+		}
+	}
+
+	if numBlocked == 0 {
+		return resp
+	}
+
+	isWhole := p.BlockedAnswersStrict || numBlocked == numAddrs
+	if isWhole {
+		SM.Increment("blocked_answers::blocked_responses", 1)
+	} else {
+		SM.Increment("blocked_answers::stripped_answers", uint64(numBlocked))
+	}
+
+	var qName string
+	if len(req.Question) > 0 {
+		qName = req.Question[0].Name
+	}
+
+	if p.BlockingDryRun {
+		log.Info("dnsproxy: dry run: %d of %d addresses for %s would be blocked", numBlocked, numAddrs, qName)
+
+		return resp
+	}
+
+	log.Debug("dnsproxy: %d of %d addresses for %s are blocked", numBlocked, numAddrs, qName)
+
+	if isWhole {
+		return p.genBlockedResponse(req)
+	}
+
+	resp.Answer = slices.DeleteFunc(resp.Answer, isBlocked)
+
+	return resp
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_filterBlockedAnswers(t *testing.T) {
+	newA := func(ip string) (rr dns.RR) {
+		return &dns.A{
+			Hdr: dns.RR_Header{Rrtype: dns.TypeA, Name: "host.", Class: dns.ClassINET, Ttl: 10},
+			A:   net.ParseIP(ip),
+		}
+	}
+
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Rrtype: dns.TypeCNAME, Name: "host.", Class: dns.ClassINET, Ttl: 10},
+		Target: "target.",
+	}
+
+	subnets := []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.0/24"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+
+	testCases := []struct {
+		name      string
+		ans       []dns.RR
+		wantAns   []dns.RR
+		strict    bool
+		dryRun    bool
+		wantBlock bool
+	}{{
+		name:      "not_blocked",
+		ans:       []dns.RR{newA("198.51.100.1")},
+		wantAns:   []dns.RR{newA("198.51.100.1")},
+		wantBlock: false,
+	}, {
+		name:      "all_blocked",
+		ans:       []dns.RR{cname, newA("192.0.2.1"), newA("192.0.2.2")},
+		wantBlock: true,
+	}, {
+		name:      "partial",
+		ans:       []dns.RR{cname, newA("192.0.2.1"), newA("198.51.100.1")},
+		wantAns:   []dns.RR{cname, newA("198.51.100.1")},
+		wantBlock: false,
+	}, {
+		name:      "partial_strict",
+		ans:       []dns.RR{newA("192.0.2.1"), newA("198.51.100.1")},
+		strict:    true,
+		wantBlock: true,
+	}, {
+		name:      "dry_run",
+		ans:       []dns.RR{newA("192.0.2.1"), newA("198.51.100.1")},
+		wantAns:   []dns.RR{newA("192.0.2.1"), newA("198.51.100.1")},
+		dryRun:    true,
+		wantBlock: false,
+	}, {
+		name: "aaaa",
+		ans: []dns.RR{&dns.AAAA{
+			Hdr:  dns.RR_Header{Rrtype: dns.TypeAAAA, Name: "host.", Class: dns.ClassINET, Ttl: 10},
+			AAAA: net.ParseIP("2001:db8::1"),
+		}},
+		wantBlock: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := mustNew(t, &Config{
+				UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+				TrustedProxies:         defaultTrustedProxies,
+				RatelimitSubnetLenIPv4: 24,
+				RatelimitSubnetLenIPv6: 64,
+				BlockingMode:           BlockingModeREFUSED,
+				BlockingDryRun:         tc.dryRun,
+				BlockedAnswerSubnets:   subnets,
+				BlockedAnswersStrict:   tc.strict,
+			})
+
+			req := (&dns.Msg{}).SetQuestion("host.", dns.TypeA)
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = tc.ans
+
+			filtered := p.filterBlockedAnswers(req, resp)
+			require.NotNil(t, filtered)
+
+			if tc.wantBlock {
+				assert.Equal(t, dns.RcodeRefused, filtered.Rcode)
+
+				return
+			}
+
+			assert.Equal(t, dns.RcodeSuccess, filtered.Rcode)
+			assert.Equal(t, tc.wantAns, filtered.Answer)
+		})
+	}
+}
+
+func TestProxy_filterBlockedAnswers_stats(t *testing.T) {
+	p := mustNew(t, &Config{
+		UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		BlockedAnswerSubnets:   []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+	})
+
+	prevBlocked, _ := SM.GetUint64("blocked_answers::blocked_responses")
+	prevStripped, _ := SM.GetUint64("blocked_answers::stripped_answers")
+
+	req := (&dns.Msg{}).SetQuestion("host.", dns.TypeA)
+	for _, ips := range [][]string{{"192.0.2.1"}, {"192.0.2.1", "192.0.2.2", "198.51.100.1"}} {
+		resp := (&dns.Msg{}).SetReply(req)
+		for _, ip := range ips {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Rrtype: dns.TypeA, Name: "host.", Class: dns.ClassINET, Ttl: 10},
+				A:   net.ParseIP(ip),
+			})
+		}
+
+		_ = p.filterBlockedAnswers(req, resp)
+	}
+
+	blocked, _ := SM.GetUint64("blocked_answers::blocked_responses")
+	stripped, _ := SM.GetUint64("blocked_answers::stripped_answers")
+	assert.Equal(t, prevBlocked+1, blocked)
+	assert.Equal(t, prevStripped+2, stripped)
+}
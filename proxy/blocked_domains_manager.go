@@ -4,17 +4,24 @@ package proxy
 
 import (
 	"bufio"
+	"fmt"
 	"github.com/AdguardTeam/dnsproxy/utils"
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/barweiss/go-tuple"
-	"github.com/golang-collections/collections/set"
 	"io"
+	"math/bits"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
 )
 
 var FinishSignal = make(chan bool, 1)
@@ -31,11 +38,55 @@ var Bdm = newBlockedDomainsManger()
 
 // BlockedDomainsManager is a class that manages blocked domains.
 type BlockedDomainsManager struct {
-	hosts             map[string]*set.Set
-	domainToListIndex map[string]int
-	blockedLists      []string
-	numDomains        int
-	mux               sync.Mutex
+	// root is the root of the trie of the blocked domains and wildcards
+	// along with the bit masks of the lists they come from.
+	root *domainNode
+
+	allowedHosts map[string]struct{}
+
+	// blockedLists are the names of the lists in the order of their bits in
+	// the masks stored in root.
+	blockedLists []string
+
+	// listIndexes are the indexes of the lists within blockedLists keyed by
+	// the lists' names.  It's rebuilt along with blockedLists on each reload,
+	// so that a name always maps to the same bit within a single set of
+	// entries.
+	listIndexes map[string]int
+
+	numDomains int
+	mux        sync.Mutex
+
+	// modTimes are the modification times of the lists' files at the moment
+	// they have been loaded.
+	modTimes map[string]time.Time
+
+	// listCounts are the numbers of the loaded and skipped entries of the
+	// lists keyed by the lists' names.
+	listCounts map[string]*blockedListCounts
+
+	// lastUpdate is the time of the last successful UpdateBlockedDomains run.
+	lastUpdate time.Time
+
+	// snapshotPath is the path of the file the compiled lists are saved to
+	// after the successful updates.  It's empty if the snapshot is disabled.
+	snapshotPath string
+
+	// runtimeDomains are the domains blocked at runtime via the API.  Unlike
+	// the other fields, they're kept across the updates.
+	runtimeDomains map[string]struct{}
+
+	// runtimePath is the path of the file runtimeDomains are persisted to.
+	runtimePath string
+
+	// runtimeMux serializes the changes of runtimeDomains along with their
+	// persisting.
+	runtimeMux sync.Mutex
+
+	// updateMux serializes the updates of the blocked domains lists so that
+	// the scheduled, signal-triggered and API-triggered updates don't
+	// interleave.
+	updateMux sync.Mutex
 }
 
 func newBlockedDomainsManger() *BlockedDomainsManager {
@@ -43,86 +94,194 @@ func newBlockedDomainsManger() *BlockedDomainsManager {
 	p := BlockedDomainsManager{}
 	p.mux.Lock()
 	defer p.mux.Unlock()
-	p.hosts = make(map[string]*set.Set)
-	p.domainToListIndex = make(map[string]int)
+	p.root = &domainNode{}
+	p.allowedHosts = make(map[string]struct{})
 	p.blockedLists = make([]string, 0)
+	p.listIndexes = make(map[string]int)
 	p.numDomains = 0
+	p.modTimes = make(map[string]time.Time)
+	p.listCounts = make(map[string]*blockedListCounts)
+	p.runtimeDomains = make(map[string]struct{})
 	return &p
 }
 
-func (r *BlockedDomainsManager) addDomain(domain tuple.T2[string, string]) {
+// addAllowedDomain adds the domain to the set of domains which are never
+// blocked along with all their subdomains.
+func (r *BlockedDomainsManager) addAllowedDomain(domain string) {
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
-	domainItems := strings.Split(domain.V1, ".")
-	reverse(domainItems)
+	r.allowedHosts[normalizeDomain(domain)] = struct{}{}
+}
 
-	_, ok := r.hosts[domainItems[0]]
-	if !ok {
-		r.hosts[domainItems[0]] = set.New()
+// checkException returns true if the domain or any of its parent domains is
+// allowed by an exception rule of the blocked domains lists.
+func (r *BlockedDomainsManager) checkException(domain string) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if len(r.allowedHosts) == 0 {
+		return false
+	}
+
+	for {
+		if _, ok := r.allowedHosts[domain]; ok {
+			return true
+		}
+
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return false
+		}
+		domain = domain[i+1:]
+	}
+}
+
+func (r *BlockedDomainsManager) addDomain(domain tuple.T2[string, string]) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	var mask uint64
+	if i, err := r.addList(domain.V2); err != nil {
+		log.Error("adding blocked domain %s: %s", domain.V1, err)
+	} else {
+		mask = 1 << i
 	}
 
-	if !r.hosts[domainItems[0]].Has(domain.V1) {
+	if r.root.insert(normalizeDomain(domain.V1), mask) {
 		r.numDomains++
 	}
-	r.hosts[domainItems[0]].Insert(domain.V1)
+}
+
+// normalizeDomain returns the domain in the form used by the blocked domains
+// lists, i.e. lowercased and without the trailing dot, since domain names are
+// case-insensitive.  Internationalized domain names are converted to their
+// IDNA A-label form, e.g. "xn--e1afmkfd.xn--p1ai" for "пример.рф", so that
+// Unicode entries match punycode queries and vice versa.
+func normalizeDomain(domain string) string {
+	domain = strings.TrimSuffix(domain, ".")
+	if !isASCII(domain) {
+		ascii, err := idna.Lookup.ToASCII(domain)
+		if err != nil {
+			// Fall back to the plain conversion, since the names in lists
+			// aren't always valid hostnames.
+			ascii, err = idna.Punycode.ToASCII(strings.ToLower(domain))
+		}
 
-	if len(r.blockedLists) == 0 {
-		r.blockedLists = append(r.blockedLists, domain.V2)
+		if err == nil {
+			domain = ascii
+		}
 	}
 
-	for i := 0; i < len(r.blockedLists); i++ {
-		if r.blockedLists[i] == domain.V2 {
-			r.domainToListIndex[domain.V1] = i
-			break
+	return strings.ToLower(domain)
+}
+
+// isASCII returns true if s only contains ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
 		}
 	}
+
+	return true
 }
 
-func (r *BlockedDomainsManager) checkDomain(domain string) (bool, string) {
+// maxBlockedLists is the maximum number of blocked domains lists which can be
+// distinguished by the per-client blocking policies, including the list of the
+// domains blocked at runtime.
+const maxBlockedLists = 64
+
+// ValidateBlockedDomainsLists returns an error if there are more blocked
+// domains lists in sources than can be loaded along with the list of the
+// domains blocked at runtime.
+func ValidateBlockedDomainsLists(sources []string) (err error) {
+	if maxLists := maxBlockedLists - 1; len(sources) > maxLists {
+		return fmt.Errorf("too many blocked domains lists: %d, max %d", len(sources), maxLists)
+	}
+
+	return nil
+}
+
+// addList registers the list with the given name in r, if it's not registered
+// yet, and returns the index of its bit.  r.mux is expected to be locked.
+func (r *BlockedDomainsManager) addList(name string) (idx int, err error) {
+	idx, ok := r.listIndexes[name]
+	if ok {
+		return idx, nil
+	}
+
+	if len(r.blockedLists) >= maxBlockedLists {
+		return 0, fmt.Errorf("no room for the %s list among %d lists", name, maxBlockedLists)
+	}
+
+	idx = len(r.blockedLists)
+	r.blockedLists = append(r.blockedLists, name)
+	r.listIndexes[name] = idx
+
+	return idx, nil
+}
+
+// listsMask returns the bit mask of the lists with the given names.  r.mux is
+// expected to be locked.
+func (r *BlockedDomainsManager) listsMask(lists []string) (mask uint64) {
+	for _, name := range lists {
+		if i, ok := r.listIndexes[name]; ok {
+			mask |= 1 << i
+		}
+	}
+
+	return mask
+}
 
+// hasList returns true if the blocked domain entry comes from the list with
+// the given name.
+func (r *BlockedDomainsManager) hasList(domain, list string) bool {
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
-	if len(r.hosts) > 0 {
-		domainItems := strings.Split(domain, ".")
+	lists, ok := r.root.entryLists(domain)
 
-		blockedDomains, ok := r.hosts[domainItems[len(domainItems)-1]]
-		if ok {
-			if blockedDomains.Has(domain) {
-				return true, domain
-			}
+	return ok && lists&r.listsMask([]string{list}) != 0
+}
 
-			for i := 0; i < len(domainItems); i++ {
-				tmpDomain := ""
-				for j := i; j < len(domainItems); j++ {
-					tmpDomain += domainItems[j] + "."
-				}
-				tmpDomain = strings.TrimSuffix(tmpDomain, ".")
-				tmpDomain = "*." + tmpDomain
-
-				if blockedDomains.Has(tmpDomain) {
-					return true, tmpDomain
-				}
-			}
-			return false, domain
-		}
-		return false, domain
-	} else {
+func (r *BlockedDomainsManager) checkDomain(domain string) (bool, string) {
+	return r.checkDomainInLists(domain, nil)
+}
+
+// checkDomainInLists is like checkDomain but only considers the entries from
+// the lists with the given names.  nil lists means all the lists.  The
+// exception rules aren't considered, see allowedBy.
+func (r *BlockedDomainsManager) checkDomainInLists(domain string, lists []string) (bool, string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.numDomains == 0 {
 		return false, domain
 	}
+
+	// isBlocked returns true if the entry is within the requested lists.  The
+	// domains blocked at runtime are blocked for everyone.
+	mask := r.listsMask(lists) | r.listsMask([]string{runtimeListName})
+	isBlocked := func(entryLists uint64) bool {
+		return lists == nil || entryLists&mask != 0
+	}
+
+	if entry, ok := r.root.match(domain, isBlocked); ok {
+		return true, entry
+	}
+
+	return false, domain
 }
 
 func (r *BlockedDomainsManager) getDomainListName(domain string) string {
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
-	if listIndex, ok := r.domainToListIndex[domain]; ok {
-
+	if lists, _ := r.root.entryLists(domain); lists != 0 {
+		listIndex := bits.TrailingZeros64(lists)
 		if listIndex < len(r.blockedLists) {
 			return r.blockedLists[listIndex]
-		} else {
-			return "unknown"
 		}
 	}
 
@@ -137,159 +296,587 @@ func (r *BlockedDomainsManager) getNumDomains() int {
 	return r.numDomains
 }
 
-func (r *BlockedDomainsManager) clear() {
+// swap replaces the contents of r with the ones of next.  next must not be
+// used after that.
+func (r *BlockedDomainsManager) swap(next *BlockedDomainsManager) {
+	next.mux.Lock()
+	defer next.mux.Unlock()
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.root = next.root
+	r.allowedHosts = next.allowedHosts
+	r.blockedLists = next.blockedLists
+	r.listIndexes = next.listIndexes
+	r.numDomains = next.numDomains
+	r.modTimes = next.modTimes
+	r.listCounts = next.listCounts
+}
+
+// updateModTime sets the modification time of the loaded list's file at
+// filePath to the current one, since the file has been touched without
+// changing its contents.  It returns true if the list is loaded.
+func (r *BlockedDomainsManager) updateModTime(filePath string) (ok bool) {
+	_, modificationTime, err := utils.GetFileInfo(filePath)
+	if err != nil {
+		return false
+	}
 
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
-	clear(r.hosts)
-	clear(r.domainToListIndex)
-	clear(r.blockedLists)
-	r.numDomains = 0
+	if _, ok = r.modTimes[filePath]; ok {
+		r.modTimes[filePath] = modificationTime
+	}
+
+	return ok
+}
+
+// blockedListCounts are the numbers of entries of a single blocked domains
+// list.
+type blockedListCounts struct {
+	// numDomains is the number of the loaded entries.
+	numDomains int
+
+	// numDuplicates is the number of the entries skipped since they're
+	// already covered by the other entries of the same list.
+	numDuplicates int
 }
 
-func UpdateBlockedDomains(r *BlockedDomainsManager, blockedDomainsUrls []string) {
+// counts returns the counts of the list with the given name, creating them if
+// necessary.  r.mux is expected to be locked unless r is being built.
+func (r *BlockedDomainsManager) counts(list string) (c *blockedListCounts) {
+	c, ok := r.listCounts[list]
+	if !ok {
+		c = &blockedListCounts{}
+		r.listCounts[list] = c
+	}
 
-	//log.Info("updating domains")
-	loadBlockedDomains(r, blockedDomainsUrls)
+	return c
+}
 
-	downloadDomains := false
+// BlockedListStatus is the status of a single blocked domains list.
+type BlockedListStatus struct {
+	// ModTime is the modification time of the local file of the list.  It's
+	// zero if the file doesn't exist.
+	ModTime time.Time `json:"mod_time"`
 
-	for _, blockedDomainUrl := range blockedDomainsUrls {
+	// Name is the name of the list used in the policies and statistics.
+	Name string `json:"name"`
 
-		tokens := strings.Split(blockedDomainUrl, "/")
-		filePath := tokens[len(tokens)-1]
-		if !strings.HasSuffix(filePath, ".txt") {
-			filePath += ".txt"
+	// Source is the configured URL or path of the list.
+	Source string `json:"source"`
+
+	// FileSize is the size of the local file of the list in bytes.
+	FileSize int64 `json:"file_size"`
+
+	// NumDomains is the number of the loaded entries.
+	NumDomains int `json:"num_domains"`
+
+	// NumDuplicates is the number of the skipped duplicated entries.
+	NumDuplicates int `json:"num_duplicates"`
+}
+
+// BlockedListsStatus is the status of all the blocked domains lists.
+type BlockedListsStatus struct {
+	// LastUpdate is the time of the last successful update of the lists.  It's
+	// zero if there were no updates yet.
+	LastUpdate time.Time `json:"last_update"`
+
+	// Lists are the statuses of the lists in the order of sources.
+	Lists []BlockedListStatus `json:"lists"`
+}
+
+// Status returns the status of the blocked domains lists loaded from sources.
+func (r *BlockedDomainsManager) Status(sources []string) (status BlockedListsStatus) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	status = BlockedListsStatus{
+		LastUpdate: r.lastUpdate,
+		Lists:      make([]BlockedListStatus, 0, len(sources)),
+	}
+
+	for _, source := range sources {
+		filePath, _ := blockedListFilePath(source)
+		listStatus := BlockedListStatus{
+			Name:   utils.TrimExt(filePath),
+			Source: source,
+		}
+
+		if c, ok := r.listCounts[listStatus.Name]; ok {
+			listStatus.NumDomains = c.numDomains
+			listStatus.NumDuplicates = c.numDuplicates
 		}
 
 		fileSize, modificationTime, err := utils.GetFileInfo(filePath)
+		if err == nil {
+			listStatus.FileSize = fileSize
+			listStatus.ModTime = modificationTime
+		}
+
+		status.Lists = append(status.Lists, listStatus)
+	}
+
+	return status
+}
 
+// blockedListFilePath returns the path of the local file for the blocked
+// domains list source, which is either a URL or a filesystem path, possibly
+// with the file:// scheme.  isLocal is true for the latter, such lists are
+// never downloaded.
+func blockedListFilePath(source string) (filePath string, isLocal bool) {
+	if strings.HasPrefix(source, "file://") {
+		u, err := url.Parse(source)
+		if err == nil {
+			return u.Path, true
+		}
+
+		return strings.TrimPrefix(source, "file://"), true
+	}
+
+	if !strings.Contains(source, "://") {
+		return source, true
+	}
+
+	return utils.UrlToFilePath(source), false
+}
+
+// CheckDomainsList parses the domains list from source, which is either a URL
+// or a local file as for [UpdateBlockedDomains], and returns the number of its
+// entries.  If online is true, the remote list is downloaded into a temporary
+// file, otherwise its previously downloaded copy is parsed, if there is one.
+func CheckDomainsList(source string, online bool) (n int, err error) {
+	filePath, isLocal := blockedListFilePath(source)
+	if !isLocal && online {
+		var dir string
+		dir, err = os.MkdirTemp("", "dnsproxy-check")
 		if err != nil {
-			downloadDomains = true
-		} else {
-			// TODO (rafalfr): blocked domains update interval
-			if time.Now().Sub(modificationTime).Seconds() > 6*3600 || fileSize == 0 {
-				if utils.CheckRemoteFileExists(blockedDomainUrl) {
-					e := os.Remove(filePath)
-					if e != nil {
-						log.Fatal(e)
-					}
-				}
-				downloadDomains = true
-			}
+			return 0, err
 		}
+		defer func() { err = errors.WithDeferred(err, os.RemoveAll(dir)) }()
+
+		filePath = filepath.Join(dir, filepath.Base(filePath))
+		_, err = utils.DownloadFromUrl(source, filePath)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return 0, err
+		}
+	} else if !isLocal {
+		if _, _, statErr := utils.GetFileInfo(filePath); statErr != nil {
+			// Not downloaded yet, so there is nothing to check offline.
+			return 0, nil
+		}
+	}
+
+	domains, allowed, err := parseBlockedDomainsFile(filePath, utils.TrimExt(filePath))
+	if err != nil {
+		return 0, err
 	}
-	if downloadDomains {
-		downloadDomains = false
-		loadBlockedDomains(r, blockedDomainsUrls)
+
+	return len(domains) + len(allowed), nil
+}
+
+// modTime returns the modification time of the file at filePath the list has
+// been loaded from, if it's loaded.
+func (r *BlockedDomainsManager) modTime(filePath string) (t time.Time, ok bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	t, ok = r.modTimes[filePath]
+
+	return t, ok
+}
+
+// isLocalListChanged returns true if the local file at filePath has been
+// modified since it was loaded into r.
+func (r *BlockedDomainsManager) isLocalListChanged(filePath string) bool {
+	_, modificationTime, err := utils.GetFileInfo(filePath)
+	if err != nil {
+		log.Error("checking blocked domains list %s: %s", filePath, err)
+
+		return false
 	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	loadedTime, ok := r.modTimes[filePath]
+
+	return !ok || !loadedTime.Equal(modificationTime)
 }
 
-func loadBlockedDomains(r *BlockedDomainsManager, blockedDomainsUrls []string) {
+// UpdateBlockedDomains downloads the blocked domains lists older than maxAge and
+// reloads all the lists into r if any of them has changed.  It's safe for
+// concurrent use, concurrent calls are serialized.
+func UpdateBlockedDomains(r *BlockedDomainsManager, blockedDomainsUrls []string, maxAge time.Duration) {
+	r.updateMux.Lock()
+	defer r.updateMux.Unlock()
 
-	// https://github.com/xpzouying/go-practice/blob/master/read_file_line_by_line/main.go
+	if err := ValidateBlockedDomainsLists(blockedDomainsUrls); err != nil {
+		log.Info("warning: not updating blocked domains: %s", err)
+
+		return
+	}
+
+	r.mux.Lock()
+	loaded := len(r.blockedLists) > 0
+	r.mux.Unlock()
+
+	var errs []error
+	if !loaded {
+		err := loadBlockedDomains(r, blockedDomainsUrls)
+		if err == nil {
+			r.saveSnapshot(blockedDomainsUrls)
+		}
+
+		errs = append(errs, err)
+	}
+
+	// touched is true if the modification times of the unchanged lists have
+	// been updated, which invalidates the snapshot.
+	refreshed, touched := false, false
 
 	for _, blockedDomainUrl := range blockedDomainsUrls {
-		tokens := strings.Split(blockedDomainUrl, "/")
-		filePath := tokens[len(tokens)-1]
-		if !strings.HasSuffix(filePath, ".txt") {
-			filePath += ".txt"
-		}
-
-		ok, _ := utils.FileExists(filePath)
-		if ok {
-			fileSize, _, _ := utils.GetFileInfo(filePath)
-			if fileSize == 0 {
-				err := utils.DownloadFromUrl(blockedDomainUrl)
-				if err != nil {
-					log.Fatal(err)
-					return
-				}
+
+		filePath, isLocal := blockedListFilePath(blockedDomainUrl)
+		if isLocal {
+			if r.isLocalListChanged(filePath) {
+				log.Info("blocked domains list %s changed", filePath)
+				refreshed = true
 			}
+
+			continue
+		}
+
+		fileSize, modificationTime, err := utils.GetFileInfo(filePath)
+
+		if err == nil && time.Since(modificationTime) <= maxAge && fileSize > 0 {
+			continue
+		}
+
+		modified, err := utils.DownloadFromUrl(blockedDomainUrl, filePath)
+		if err != nil {
+			// Keep the previous copy of the list, if any.
+			errs = append(errs, updateError(fmt.Errorf("downloading %s: %w", blockedDomainUrl, err)))
+
+			continue
+		}
+
+		if modified {
+			log.Info("blocked domains list %s refreshed", blockedDomainUrl)
+			refreshed = true
 		} else {
-			err := utils.DownloadFromUrl(blockedDomainUrl)
-			if err != nil {
-				log.Fatal(err)
-				return
-			}
+			log.Info("blocked domains list %s unchanged", blockedDomainUrl)
+			touched = r.updateModTime(filePath) || touched
 		}
 	}
 
-	r.clear()
+	if refreshed {
+		err := loadBlockedDomains(r, blockedDomainsUrls)
+		if err == nil {
+			r.saveSnapshot(blockedDomainsUrls)
+		}
 
-	allDomains := make([]tuple.T2[string, string], 0)
+		errs = append(errs, err)
+	} else if touched && errors.Join(errs...) == nil {
+		r.saveSnapshot(blockedDomainsUrls)
+	}
+
+	if errors.Join(errs...) != nil {
+		return
+	}
+
+	r.mux.Lock()
+	r.lastUpdate = time.Now()
+	r.mux.Unlock()
+}
+
+// updateError logs err occurred while updating the blocked domains lists,
+// counts it in the statistics, and returns it.
+func updateError(err error) error {
+	log.Error("updating blocked domains: %s", err)
+
+	SM.Increment("blocked_domains::update_errors", 1)
 
+	return err
+}
+
+// loadBlockedDomains downloads the missing blocked domains lists and loads all
+// the lists into r.  The errors of the individual lists are logged, and the
+// previously loaded data of the failed lists is kept.
+func loadBlockedDomains(r *BlockedDomainsManager, blockedDomainsUrls []string) (err error) {
+
+	// https://github.com/xpzouying/go-practice/blob/master/read_file_line_by_line/main.go
+
+	var errs []error
 	for _, blockedDomainUrl := range blockedDomainsUrls {
-		tokens := strings.Split(blockedDomainUrl, "/")
-		filePath := tokens[len(tokens)-1]
-		if !strings.HasSuffix(filePath, ".txt") {
-			filePath += ".txt"
+		filePath, isLocal := blockedListFilePath(blockedDomainUrl)
+		if isLocal {
+			continue
 		}
 
-		fileName := strings.TrimSuffix(filePath, filepath.Ext(filePath))
-		r.blockedLists = append(r.blockedLists, fileName)
+		fileSize, _, statErr := utils.GetFileInfo(filePath)
+		if statErr == nil && fileSize > 0 {
+			continue
+		}
 
-		f, err := os.OpenFile(filePath, os.O_RDONLY, os.ModePerm)
+		_, err = utils.DownloadFromUrl(blockedDomainUrl, filePath)
 		if err != nil {
-			log.Fatalf("open file error: %v", err)
-			return
-		}
-
-		rd := bufio.NewReader(f)
-		for {
-			line, err := rd.ReadString('\n')
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				log.Fatalf("read file line error: %v", err)
-				return
-			}
-			if !strings.HasPrefix(line, "#") {
-				line = strings.Trim(line, "\n ")
-				allDomains = append(allDomains, tuple.New2(line, fileName))
+			errs = append(errs, updateError(fmt.Errorf("downloading %s: %w", blockedDomainUrl, err)))
+		}
+	}
+
+	filePaths := make([]string, 0, len(blockedDomainsUrls))
+	for _, blockedDomainUrl := range blockedDomainsUrls {
+		filePath, _ := blockedListFilePath(blockedDomainUrl)
+
+		filePaths = append(filePaths, filePath)
+	}
+
+	errs = append(errs, loadBlockedDomainsFiles(r, filePaths))
+
+	return errors.Join(errs...)
+}
+
+// loadBlockedDomainsFiles parses the blocked domains lists from filePaths into a
+// fresh set of domains and then replaces the contents of r with it in a single
+// step, so that r keeps answering from the previous data during the load.  The
+// entries of the lists which fail to load are taken from r.
+func loadBlockedDomainsFiles(r *BlockedDomainsManager, filePaths []string) (err error) {
+	next := newBlockedDomainsManger()
+
+	allDomains := make([]tuple.T2[string, string], 0)
+
+	var errs []error
+	for _, filePath := range filePaths {
+		fileName := utils.TrimExt(filePath)
+		if _, listErr := next.addList(fileName); listErr != nil {
+			errs = append(errs, updateError(listErr))
+
+			continue
+		}
+
+		domains, allowed, parseErr := parseBlockedDomainsFile(filePath, fileName)
+		if parseErr != nil {
+			errs = append(errs, updateError(fmt.Errorf("loading %s: %w", filePath, parseErr)))
+
+			// Keep the previously loaded data of the list along with its
+			// modification time, so that it isn't considered changed and
+			// reloaded on each update.
+			domains, allowed = r.listEntries(fileName)
+			if modTime, ok := r.modTime(filePath); ok {
+				next.modTimes[filePath] = modTime
 			}
+			log.Info("keeping %d previously loaded entries of %s", len(domains), fileName)
+		} else if _, modificationTime, statErr := utils.GetFileInfo(filePath); statErr == nil {
+			next.modTimes[filePath] = modificationTime
 		}
 
-		err = f.Close()
-		if err != nil {
-			log.Fatalf("close file error: %v", err)
-			return
+		allDomains = append(allDomains, domains...)
+		for _, domain := range allowed {
+			next.addAllowedDomain(domain)
 		}
 	}
 
+	if _, listErr := next.addList(runtimeListName); listErr != nil {
+		errs = append(errs, updateError(listErr))
+	}
+	allDomains = append(allDomains, r.runtimeEntries()...)
+
 	sort.Slice(allDomains, func(i, j int) bool {
 		return len(allDomains[i].V1) < len(allDomains[j].V1)
 	})
 
 	numDuplicatedDomains := 0
 	for _, domain := range allDomains {
+		domain.V1 = normalizeDomain(domain.V1)
 		if Edm.checkDomain(domain.V1) == false {
-			ok, _ := r.checkDomain(domain.V1)
-			if ok == false {
-				r.addDomain(domain)
+			// Only consider the domain duplicated if it's already blocked by
+			// the same list, so that the per-client policies which don't
+			// include the other list still block it.
+			ok, blockedDomain := next.checkDomain(domain.V1)
+			if ok == false || !next.hasList(blockedDomain, domain.V2) {
+				next.addDomain(domain)
+				next.counts(domain.V2).numDomains++
 			} else {
 				numDuplicatedDomains++
+				next.counts(domain.V2).numDuplicates++
 			}
 		}
 	}
 
+	r.swap(next)
+
 	SM.Set("blocked_domains::num_domains", r.getNumDomains())
 	log.Info("total number of blocked domains %d", r.getNumDomains())
 	log.Info("number of duplicated domains %d", numDuplicatedDomains)
+
+	return errors.Join(errs...)
 }
 
-func MonitorLogFile(logFilePath string) {
+// parseBlockedDomainsFile parses the blocked domains list from the file at
+// filePath.  domains are the blocked entries marked with listName, allowed are
+// the domains from the exception rules.
+func parseBlockedDomainsFile(
+	filePath string,
+	listName string,
+) (domains []tuple.T2[string, string], allowed []string, err error) {
+	f, err := utils.OpenDecompressed(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	numUnsupportedRules := 0
+	rd := bufio.NewReader(f)
+	for {
+		line, readErr := rd.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return nil, nil, readErr
+		}
 
-	ok, err := utils.FileExists(logFilePath)
-	if ok && err == nil {
-		fileSize, _, err := utils.GetFileInfo(logFilePath)
-		if fileSize > 128*1024*1024 && err == nil {
-			e := os.Remove(logFilePath)
-			if e != nil {
-				log.Fatal(e)
+		line = strings.TrimSpace(line)
+		if isAdblockRule(line) {
+			domain, isException, ok := parseAdblockRule(line)
+			switch {
+			case !ok:
+				numUnsupportedRules++
+			case domain == "":
+				// A comment or a header.
+			case isException:
+				allowed = append(allowed, domain)
+			default:
+				domains = append(domains, tuple.New2(domain, listName))
+				domains = append(domains, tuple.New2("*."+domain, listName))
+			}
+		} else {
+			for _, domain := range parseBlockedDomainsLine(line) {
+				domains = append(domains, tuple.New2(domain, listName))
 			}
 		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	if numUnsupportedRules > 0 {
+		log.Info("skipped %d unsupported rules in %s", numUnsupportedRules, listName)
+	}
+
+	return domains, allowed, nil
+}
+
+// listEntries returns the entries of r which come from the list with the given
+// name along with all the allowed domains, since those aren't tracked per list.
+func (r *BlockedDomainsManager) listEntries(list string) (domains []tuple.T2[string, string], allowed []string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for domain := range r.allowedHosts {
+		allowed = append(allowed, domain)
+	}
+
+	mask := r.listsMask([]string{list})
+	if mask == 0 {
+		return nil, allowed
 	}
+
+	r.root.walk("", func(entry string, lists uint64) {
+		if lists&mask != 0 {
+			domains = append(domains, tuple.New2(entry, list))
+		}
+	})
+
+	return domains, allowed
+}
+
+// hostsIgnoredNames are the host names commonly found in hosts-format lists
+// which must never be treated as blocked domains.
+var hostsIgnoredNames = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+}
+
+// parseBlockedDomainsLine returns the domains found in a single line of a
+// blocked domains list.  Both the plain domain-per-line format and the hosts
+// file format, e.g. "0.0.0.0 doubleclick.net", are supported.  Comments, IP
+// addresses and localhost entries are skipped.
+func parseBlockedDomainsLine(line string) (domains []string) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+
+	for _, field := range strings.Fields(line) {
+		if _, ok := hostsIgnoredNames[field]; ok {
+			continue
+		}
+
+		if _, err := netip.ParseAddr(field); err == nil {
+			continue
+		}
+
+		domains = append(domains, field)
+	}
+
+	return domains
+}
+
+// isAdblockRule returns true if the trimmed line looks like an AdGuard or
+// Adblock Plus filtering rule rather than a plain domain or a hosts file entry.
+func isAdblockRule(line string) bool {
+	if strings.HasPrefix(line, "|") ||
+		strings.HasPrefix(line, "@@") ||
+		strings.HasPrefix(line, "!") ||
+		strings.HasPrefix(line, "[") ||
+		strings.HasPrefix(line, "/") {
+		return true
+	}
+
+	// Cosmetic rules, e.g. "example.com##.banner", and rules with modifiers.
+	return strings.Contains(line, "##") ||
+		strings.Contains(line, "#@#") ||
+		strings.Contains(line, "#$#") ||
+		strings.Contains(line, "#?#") ||
+		strings.Contains(line, "#%#") ||
+		strings.Contains(line, "$")
+}
+
+// parseAdblockRule parses the basic AdGuard filtering rule, i.e. "||domain^"
+// or the exception "@@||domain^".  The domain is empty for comments and
+// headers.  ok is false if the rule isn't supported.
+func parseAdblockRule(line string) (domain string, isException bool, ok bool) {
+	if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return "", false, true
+	}
+
+	line, isException = strings.CutPrefix(line, "@@")
+
+	rule, modifiers, hasModifiers := strings.Cut(line, "$")
+	if hasModifiers && modifiers != "important" {
+		return "", false, false
+	}
+
+	rule, ok = strings.CutPrefix(rule, "||")
+	if !ok {
+		return "", false, false
+	}
+
+	rule, ok = strings.CutSuffix(rule, "^")
+	if !ok || rule == "" || strings.ContainsAny(rule, "/*|^#") {
+		return "", false, false
+	}
+
+	return rule, isException, true
 }
@@ -0,0 +1,827 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/barweiss/go-tuple"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBlockedDomainsLine(t *testing.T) {
+	testCases := []struct {
+		name string
+		line string
+		want []string
+	}{{
+		name: "plain",
+		line: "doubleclick.net\n",
+		want: []string{"doubleclick.net"},
+	}, {
+		name: "wildcard",
+		line: "*.doubleclick.net",
+		want: []string{"*.doubleclick.net"},
+	}, {
+		name: "hosts_ipv4",
+		line: "0.0.0.0 doubleclick.net",
+		want: []string{"doubleclick.net"},
+	}, {
+		name: "hosts_ipv6",
+		line: "::  doubleclick.net",
+		want: []string{"doubleclick.net"},
+	}, {
+		name: "hosts_several",
+		line: "127.0.0.1\tads.example.com tracker.example.com",
+		want: []string{"ads.example.com", "tracker.example.com"},
+	}, {
+		name: "hosts_inline_comment",
+		line: "0.0.0.0 doubleclick.net # ads",
+		want: []string{"doubleclick.net"},
+	}, {
+		name: "localhost",
+		line: "127.0.0.1 localhost",
+		want: nil,
+	}, {
+		name: "ipv6_localhost",
+		line: "::1 localhost ip6-localhost ip6-loopback",
+		want: nil,
+	}, {
+		name: "only_ip",
+		line: "0.0.0.0",
+		want: nil,
+	}, {
+		name: "comment",
+		line: "# 0.0.0.0 doubleclick.net",
+		want: nil,
+	}, {
+		name: "empty",
+		line: "  \n",
+		want: nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, parseBlockedDomainsLine(tc.line))
+		})
+	}
+}
+
+func TestParseAdblockRule(t *testing.T) {
+	testCases := []struct {
+		name          string
+		line          string
+		wantDomain    string
+		wantException bool
+		wantOK        bool
+	}{{
+		name:       "basic",
+		line:       "||example.com^",
+		wantDomain: "example.com",
+		wantOK:     true,
+	}, {
+		name:          "exception",
+		line:          "@@||cdn.example.com^",
+		wantDomain:    "cdn.example.com",
+		wantException: true,
+		wantOK:        true,
+	}, {
+		name:       "important",
+		line:       "||example.com^$important",
+		wantDomain: "example.com",
+		wantOK:     true,
+	}, {
+		name:   "modifier",
+		line:   "||example.com^$third-party",
+		wantOK: false,
+	}, {
+		name:   "cosmetic",
+		line:   "example.com##.banner",
+		wantOK: false,
+	}, {
+		name:   "path",
+		line:   "||example.com/ads^",
+		wantOK: false,
+	}, {
+		name:   "regexp",
+		line:   "/ads[0-9]+/",
+		wantOK: false,
+	}, {
+		name:   "comment",
+		line:   "! Title: list",
+		wantOK: true,
+	}, {
+		name:   "header",
+		line:   "[Adblock Plus 2.0]",
+		wantOK: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.True(t, isAdblockRule(tc.line))
+
+			domain, isException, ok := parseAdblockRule(tc.line)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.wantDomain, domain)
+			assert.Equal(t, tc.wantException, isException)
+		})
+	}
+
+	assert.False(t, isAdblockRule("0.0.0.0 example.com"))
+	assert.False(t, isAdblockRule("*.example.com"))
+}
+
+func TestBlockedDomainsManager_allowed(t *testing.T) {
+	bdm := newBlockedDomainsManger()
+	bdm.addDomain(tuple.New2("example.com", "list"))
+	bdm.addDomain(tuple.New2("*.example.com", "list"))
+	bdm.addAllowedDomain("cdn.example.com")
+
+	blocked, _ := bdm.checkDomain("example.com")
+	assert.True(t, blocked)
+
+	blocked, _ = bdm.checkDomain("ads.example.com")
+	assert.True(t, blocked)
+
+	assert.False(t, bdm.checkException("example.com"))
+	assert.True(t, bdm.checkException("cdn.example.com"))
+	assert.True(t, bdm.checkException("img.cdn.example.com"))
+}
+
+func TestLoadBlockedDomainsFiles_atomic(t *testing.T) {
+	dir := t.TempDir()
+
+	oldList := filepath.Join(dir, "old.txt")
+	err := os.WriteFile(oldList, []byte("common.example\nold.example\n"), 0o644)
+	require.NoError(t, err)
+
+	newList := filepath.Join(dir, "new.txt")
+	newData := &strings.Builder{}
+	newData.WriteString("common.example\n")
+	for i := range 10_000 {
+		_, _ = fmt.Fprintf(newData, "host%d.new.example\n", i)
+	}
+	err = os.WriteFile(newList, []byte(newData.String()), 0o644)
+	require.NoError(t, err)
+
+	bdm := newBlockedDomainsManger()
+	require.NoError(t, loadBlockedDomainsFiles(bdm, []string{oldList}))
+
+	blocked, _ := bdm.checkDomain("common.example")
+	require.True(t, blocked)
+
+	stop := make(chan struct{})
+	unblocked := &atomic.Bool{}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if ok, _ := bdm.checkDomain("common.example"); !ok {
+					unblocked.Store(true)
+				}
+			}
+		}
+	}()
+
+	for i := range 10 {
+		if i%2 == 0 {
+			require.NoError(t, loadBlockedDomainsFiles(bdm, []string{newList}))
+		} else {
+			require.NoError(t, loadBlockedDomainsFiles(bdm, []string{oldList}))
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+
+	assert.False(t, unblocked.Load())
+}
+
+func TestLoadBlockedDomainsFiles_listNames(t *testing.T) {
+	dir := t.TempDir()
+
+	lists := map[string]string{
+		"ads":      "ads.example\n*.shared.example\n",
+		"trackers": "tracker.example\nshared.example\n",
+		"malware":  "malware.example\n",
+	}
+
+	filePaths := []string{}
+	for _, name := range []string{"ads", "trackers", "malware"} {
+		filePath := filepath.Join(dir, name+".txt")
+		require.NoError(t, os.WriteFile(filePath, []byte(lists[name]), 0o644))
+
+		filePaths = append(filePaths, filePath)
+	}
+
+	bdm := newBlockedDomainsManger()
+
+	// wantLists are the names of the lists of the blocking entries.
+	wantLists := map[string]string{
+		"ads.example":      "ads",
+		"*.shared.example": "ads",
+		"tracker.example":  "trackers",
+		"shared.example":   "trackers",
+		"malware.example":  "malware",
+	}
+
+	// Reload the same lists, then a subset in another order, and then the
+	// same lists again.
+	reloads := [][]string{filePaths, filePaths, {filePaths[2], filePaths[0]}, filePaths}
+	for i, paths := range reloads {
+		require.NoError(t, loadBlockedDomainsFiles(bdm, paths))
+
+		for domain := range wantLists {
+			ok, entry := bdm.checkDomain(domain)
+			if !ok {
+				continue
+			}
+
+			assert.Equalf(t, wantLists[entry], bdm.getDomainListName(entry), "reload %d: %s", i, domain)
+		}
+
+		assert.Len(t, bdm.blockedLists, len(paths)+1)
+		assert.Len(t, bdm.listIndexes, len(paths)+1)
+	}
+
+	ok, _ := bdm.checkDomain("tracker.example")
+	assert.True(t, ok)
+}
+
+func TestBlockedDomainsManager_addList(t *testing.T) {
+	bdm := newBlockedDomainsManger()
+
+	for i := range maxBlockedLists {
+		idx, err := bdm.addList(fmt.Sprintf("list%d", i))
+		require.NoError(t, err)
+		require.Equal(t, i, idx)
+	}
+
+	idx, err := bdm.addList("list7")
+	require.NoError(t, err)
+	assert.Equal(t, 7, idx)
+
+	_, err = bdm.addList("extra")
+	assert.Error(t, err)
+}
+
+func TestBlockedDomainsManager_checkDomainInLists(t *testing.T) {
+	dir := t.TempDir()
+
+	ads := filepath.Join(dir, "ads.txt")
+	err := os.WriteFile(ads, []byte("*.ads.example\ncommon.example\n"), 0o644)
+	require.NoError(t, err)
+
+	adult := filepath.Join(dir, "adult.txt")
+	err = os.WriteFile(adult, []byte("adult.example\ncommon.example\nx.ads.example\n"), 0o644)
+	require.NoError(t, err)
+
+	bdm := newBlockedDomainsManger()
+	require.NoError(t, loadBlockedDomainsFiles(bdm, []string{ads, adult}))
+
+	testCases := []struct {
+		name   string
+		domain string
+		lists  []string
+		want   bool
+	}{{
+		name:   "all_lists",
+		domain: "adult.example",
+		lists:  nil,
+		want:   true,
+	}, {
+		name:   "other_list",
+		domain: "adult.example",
+		lists:  []string{"ads"},
+		want:   false,
+	}, {
+		name:   "same_list",
+		domain: "adult.example",
+		lists:  []string{"adult"},
+		want:   true,
+	}, {
+		name:   "common_ads",
+		domain: "common.example",
+		lists:  []string{"ads"},
+		want:   true,
+	}, {
+		name:   "common_adult",
+		domain: "common.example",
+		lists:  []string{"adult"},
+		want:   true,
+	}, {
+		name:   "covered_by_other_list",
+		domain: "x.ads.example",
+		lists:  []string{"adult"},
+		want:   true,
+	}, {
+		name:   "no_lists",
+		domain: "common.example",
+		lists:  []string{},
+		want:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			blocked, _ := bdm.checkDomainInLists(tc.domain, tc.lists)
+			assert.Equal(t, tc.want, blocked)
+		})
+	}
+}
+
+func TestBlockedListFilePath(t *testing.T) {
+	testCases := []struct {
+		name        string
+		source      string
+		wantPath    string
+		wantIsLocal bool
+	}{{
+		name:        "url",
+		source:      "https://example.com/hosts",
+		wantPath:    "hosts.txt",
+		wantIsLocal: false,
+	}, {
+		name:        "file_url",
+		source:      "file:///etc/dnsproxy/internal.txt",
+		wantPath:    "/etc/dnsproxy/internal.txt",
+		wantIsLocal: true,
+	}, {
+		name:        "absolute_path",
+		source:      "/etc/dnsproxy/internal.txt",
+		wantPath:    "/etc/dnsproxy/internal.txt",
+		wantIsLocal: true,
+	}, {
+		name:        "relative_path",
+		source:      "lists/internal.txt",
+		wantPath:    "lists/internal.txt",
+		wantIsLocal: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filePath, isLocal := blockedListFilePath(tc.source)
+			assert.Equal(t, tc.wantPath, filePath)
+			assert.Equal(t, tc.wantIsLocal, isLocal)
+		})
+	}
+}
+
+func TestUpdateBlockedDomains_local(t *testing.T) {
+	listPath := filepath.Join(t.TempDir(), "internal.txt")
+	err := os.WriteFile(listPath, []byte("old.example\n"), 0o644)
+	require.NoError(t, err)
+
+	bdm := newBlockedDomainsManger()
+	UpdateBlockedDomains(bdm, []string{"file://" + listPath}, time.Hour)
+
+	blocked, _ := bdm.checkDomain("old.example")
+	assert.True(t, blocked)
+	assert.Equal(t, "internal", bdm.getDomainListName("old.example"))
+
+	err = os.WriteFile(listPath, []byte("new.example\n"), 0o644)
+	require.NoError(t, err)
+
+	// Make sure the modification time differs on filesystems with the coarse
+	// timestamps.
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(listPath, modTime, modTime))
+
+	UpdateBlockedDomains(bdm, []string{listPath}, time.Hour)
+
+	blocked, _ = bdm.checkDomain("old.example")
+	assert.False(t, blocked)
+
+	blocked, _ = bdm.checkDomain("new.example")
+	assert.True(t, blocked)
+}
+
+// blockedSink is a typed sink for benchmark results.
+var blockedSink bool
+
+// newBenchmarkBlockedList writes the list of n synthetic domains to a temporary
+// file and returns its path.
+func newBenchmarkBlockedList(b *testing.B, n int) (listPath string) {
+	b.Helper()
+
+	sb := &strings.Builder{}
+	for i := range n {
+		_, _ = fmt.Fprintf(sb, "host%d.sub%d.example%d.com\n", i, i%100, i%1000)
+		if i%10 == 0 {
+			_, _ = fmt.Fprintf(sb, "*.wild%d.example%d.net\n", i, i%1000)
+		}
+	}
+
+	listPath = filepath.Join(b.TempDir(), "bench.txt")
+	err := os.WriteFile(listPath, []byte(sb.String()), 0o644)
+	require.NoError(b, err)
+
+	return listPath
+}
+
+func BenchmarkBlockedDomainsManager(b *testing.B) {
+	const numDomains = 200_000
+
+	listPath := newBenchmarkBlockedList(b, numDomains)
+
+	b.Run("load", func(b *testing.B) {
+		var heap uint64
+		for range b.N {
+			bdm := newBlockedDomainsManger()
+
+			before := &runtime.MemStats{}
+			runtime.GC()
+			runtime.ReadMemStats(before)
+
+			require.NoError(b, loadBlockedDomainsFiles(bdm, []string{listPath}))
+
+			after := &runtime.MemStats{}
+			runtime.GC()
+			runtime.ReadMemStats(after)
+
+			heap = after.HeapAlloc - before.HeapAlloc
+			runtime.KeepAlive(bdm)
+		}
+
+		b.ReportMetric(float64(heap), "heap-B")
+	})
+
+	bdm := newBlockedDomainsManger()
+	require.NoError(b, loadBlockedDomainsFiles(bdm, []string{listPath}))
+
+	domains := []string{
+		"host12345.sub45.example345.com",
+		"deep.sub.wild120.example120.net",
+		"wild120.example120.net",
+		"not.blocked.example.org",
+		"host12345.sub46.example345.com",
+	}
+
+	b.Run("check", func(b *testing.B) {
+		b.ReportAllocs()
+
+		l := len(domains)
+		for i := range b.N {
+			blockedSink, _ = bdm.checkDomain(domains[i%l])
+		}
+	})
+
+	// goos: linux
+	// goarch: amd64
+	// pkg: github.com/AdguardTeam/dnsproxy/proxy
+	// cpu: Intel(R) Xeon(R) Processor
+	//
+	// Per-TLD sets of domain strings:
+	// BenchmarkBlockedDomainsManager/load	3		1074126733 ns/op	26263472 heap-B
+	// BenchmarkBlockedDomainsManager/check	1322296	885.2 ns/op		199 B/op	7 allocs/op
+	//
+	// Reversed-label trie:
+	// BenchmarkBlockedDomainsManager/load	3		371457958 ns/op		18155920 heap-B
+	// BenchmarkBlockedDomainsManager/check	9429604	137.6 ns/op		9 B/op		0 allocs/op
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	testCases := []struct {
+		name   string
+		domain string
+		want   string
+	}{{
+		name:   "ascii",
+		domain: "Example.ORG.",
+		want:   "example.org",
+	}, {
+		name:   "unicode",
+		domain: "пример.рф",
+		want:   "xn--e1afmkfd.xn--p1ai",
+	}, {
+		name:   "unicode_upper",
+		domain: "ПРИМЕР.РФ.",
+		want:   "xn--e1afmkfd.xn--p1ai",
+	}, {
+		name:   "punycode",
+		domain: "XN--E1AFMKFD.xn--p1ai",
+		want:   "xn--e1afmkfd.xn--p1ai",
+	}, {
+		name:   "wildcard",
+		domain: "*.пример.рф",
+		want:   "*.xn--e1afmkfd.xn--p1ai",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, normalizeDomain(tc.domain))
+		})
+	}
+}
+
+func TestBlockedDomainsManager_idna(t *testing.T) {
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "idn.txt")
+	err := os.WriteFile(listPath, []byte("пример.рф\nxn--80ak6aa92e.com\n"), 0o644)
+	require.NoError(t, err)
+
+	bdm := newBlockedDomainsManger()
+	require.NoError(t, loadBlockedDomainsFiles(bdm, []string{listPath}))
+
+	testCases := []struct {
+		name  string
+		query string
+	}{{
+		name:  "unicode_entry_punycode_query",
+		query: "xn--e1afmkfd.xn--p1ai.",
+	}, {
+		name:  "unicode_entry_unicode_query",
+		query: "пример.рф.",
+	}, {
+		name:  "punycode_entry_unicode_query",
+		query: "аррӏе.com.",
+	}, {
+		name:  "punycode_entry_punycode_query",
+		query: "xn--80ak6aa92e.com.",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			blocked, _ := bdm.checkDomain(normalizeDomain(tc.query))
+			assert.True(t, blocked)
+		})
+	}
+}
+
+func TestBlockedDomainsManager_Status(t *testing.T) {
+	dir := t.TempDir()
+
+	ads := filepath.Join(dir, "ads.txt")
+	err := os.WriteFile(ads, []byte("*.ads.example\nx.ads.example\nother.example\n"), 0o644)
+	require.NoError(t, err)
+
+	adult := filepath.Join(dir, "adult.txt")
+	err = os.WriteFile(adult, []byte("adult.example\n"), 0o644)
+	require.NoError(t, err)
+
+	missing := filepath.Join(dir, "missing.txt")
+
+	bdm := newBlockedDomainsManger()
+	UpdateBlockedDomains(bdm, []string{ads, "file://" + adult}, time.Hour)
+
+	status := bdm.Status([]string{ads, "file://" + adult, missing})
+	assert.NotZero(t, status.LastUpdate)
+	require.Len(t, status.Lists, 3)
+
+	adsStatus := status.Lists[0]
+	assert.Equal(t, "ads", adsStatus.Name)
+	assert.Equal(t, ads, adsStatus.Source)
+	assert.Equal(t, 2, adsStatus.NumDomains)
+	assert.Equal(t, 1, adsStatus.NumDuplicates)
+	assert.Positive(t, adsStatus.FileSize)
+	assert.NotZero(t, adsStatus.ModTime)
+
+	adultStatus := status.Lists[1]
+	assert.Equal(t, "adult", adultStatus.Name)
+	assert.Equal(t, 1, adultStatus.NumDomains)
+	assert.Zero(t, adultStatus.NumDuplicates)
+
+	missingStatus := status.Lists[2]
+	assert.Equal(t, "missing", missingStatus.Name)
+	assert.Zero(t, missingStatus.NumDomains)
+	assert.Zero(t, missingStatus.FileSize)
+	assert.Zero(t, missingStatus.ModTime)
+}
+
+func TestLoadBlockedDomainsFiles_failedList(t *testing.T) {
+	dir := t.TempDir()
+
+	ads := filepath.Join(dir, "ads.txt")
+	err := os.WriteFile(ads, []byte("old-ad.example\n"), 0o644)
+	require.NoError(t, err)
+
+	adult := filepath.Join(dir, "adult.txt")
+	err = os.WriteFile(adult, []byte("adult.example\n*.porn.example\n@@||safe.porn.example^\n"), 0o644)
+	require.NoError(t, err)
+
+	bdm := newBlockedDomainsManger()
+	require.NoError(t, loadBlockedDomainsFiles(bdm, []string{ads, adult}))
+
+	err = os.WriteFile(ads, []byte("new-ad.example\n"), 0o644)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(adult))
+
+	err = loadBlockedDomainsFiles(bdm, []string{ads, adult})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	testCases := []struct {
+		domain string
+		lists  []string
+		want   bool
+	}{{
+		domain: "old-ad.example",
+		lists:  nil,
+		want:   false,
+	}, {
+		domain: "new-ad.example",
+		lists:  []string{"ads"},
+		want:   true,
+	}, {
+		domain: "adult.example",
+		lists:  []string{"adult"},
+		want:   true,
+	}, {
+		domain: "www.porn.example",
+		lists:  []string{"adult"},
+		want:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.domain, func(t *testing.T) {
+			blocked, _ := bdm.checkDomainInLists(tc.domain, tc.lists)
+			assert.Equal(t, tc.want, blocked)
+		})
+	}
+
+	// The exceptions of the failed list are kept as well.
+	assert.True(t, bdm.checkException("safe.porn.example"))
+}
+
+func TestUpdateBlockedDomains_failedListModTime(t *testing.T) {
+	dir := t.TempDir()
+
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write([]byte("ad.example\n"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	ads := filepath.Join(dir, "ads.txt.gz")
+	require.NoError(t, os.WriteFile(ads, buf.Bytes(), 0o644))
+
+	other := filepath.Join(dir, "other.txt")
+	require.NoError(t, os.WriteFile(other, []byte("old.example\n"), 0o644))
+
+	lists := []string{"file://" + ads, "file://" + other}
+
+	bdm := newBlockedDomainsManger()
+	UpdateBlockedDomains(bdm, lists, time.Hour)
+
+	blocked, _ := bdm.checkDomain("ad.example")
+	require.True(t, blocked)
+
+	fi, err := os.Stat(ads)
+	require.NoError(t, err)
+
+	// Break the list without changing its modification time, and change the
+	// other one, so that the lists are reloaded.
+	require.NoError(t, os.WriteFile(ads, buf.Bytes()[:5], 0o644))
+	require.NoError(t, os.Chtimes(ads, fi.ModTime(), fi.ModTime()))
+
+	require.NoError(t, os.WriteFile(other, []byte("new.example\n"), 0o644))
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(other, modTime, modTime))
+
+	UpdateBlockedDomains(bdm, lists, time.Hour)
+
+	blocked, _ = bdm.checkDomain("new.example")
+	require.True(t, blocked)
+
+	blocked, _ = bdm.checkDomain("ad.example")
+	assert.True(t, blocked)
+
+	// The failed list isn't reloaded on the next update.
+	assert.False(t, bdm.isLocalListChanged(ads))
+	assert.False(t, bdm.isLocalListChanged(other))
+}
+
+func TestUpdateBlockedDomains_downloadError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+
+	local := filepath.Join(t.TempDir(), "local.txt")
+	err := os.WriteFile(local, []byte("local.example\n"), 0o644)
+	require.NoError(t, err)
+
+	bdm := newBlockedDomainsManger()
+	UpdateBlockedDomains(bdm, []string{srv.URL + "/remote.txt", local}, time.Hour)
+
+	blocked, _ := bdm.checkDomain("local.example")
+	assert.True(t, blocked)
+
+	status := bdm.Status([]string{srv.URL + "/remote.txt", local})
+	assert.Zero(t, status.LastUpdate)
+}
+
+func TestValidateBlockedDomainsLists(t *testing.T) {
+	sources := func(n int) (s []string) {
+		for i := range n {
+			s = append(s, fmt.Sprintf("list%d.txt", i))
+		}
+
+		return s
+	}
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		sources    []string
+	}{{
+		name:       "empty",
+		wantErrMsg: "",
+		sources:    nil,
+	}, {
+		name:       "max",
+		wantErrMsg: "",
+		sources:    sources(maxBlockedLists - 1),
+	}, {
+		name:       "too_many",
+		wantErrMsg: "too many blocked domains lists: 64, max 63",
+		sources:    sources(maxBlockedLists),
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, ValidateBlockedDomainsLists(tc.sources))
+		})
+	}
+}
+
+func TestCheckDomainsList(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/remote.txt" {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		_, _ = w.Write([]byte("one.example\n||two.example^\n@@||three.example^\n"))
+	}))
+	t.Cleanup(srv.Close)
+
+	local := filepath.Join(t.TempDir(), "local.txt")
+	err := os.WriteFile(local, []byte("local.example\n"), 0o644)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		source     string
+		wantErrMsg string
+		wantN      int
+		online     bool
+	}{{
+		name:       "local",
+		source:     local,
+		wantErrMsg: "",
+		wantN:      1,
+		online:     false,
+	}, {
+		name:       "local_missing",
+		source:     local + ".missing",
+		wantErrMsg: "open " + local + ".missing: no such file or directory",
+		wantN:      0,
+		online:     false,
+	}, {
+		name:       "remote_offline",
+		source:     srv.URL + "/not-downloaded-yet.txt",
+		wantErrMsg: "",
+		wantN:      0,
+		online:     false,
+	}, {
+		name:       "remote_online",
+		source:     srv.URL + "/remote.txt",
+		wantErrMsg: "",
+		wantN:      4,
+		online:     true,
+	}, {
+		name:       "remote_online_error",
+		source:     srv.URL + "/missing.txt",
+		wantErrMsg: "downloading " + srv.URL + "/missing.txt: bad status: 404 Not Found",
+		wantN:      0,
+		online:     true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, checkErr := CheckDomainsList(tc.source, tc.online)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, checkErr)
+
+			assert.Equal(t, tc.wantN, n)
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/barweiss/go-tuple"
+)
+
+// runtimeListName is the name of the synthetic list of the domains blocked at
+// runtime via the API.  Unlike the other lists, it applies to all the clients
+// regardless of the blocking policies.
+const runtimeListName = "runtime"
+
+const (
+	// ErrRuntimeDomainNotFound is returned when removing a domain which isn't
+	// blocked at runtime.
+	ErrRuntimeDomainNotFound errors.Error = "domain is not blocked at runtime"
+
+	// ErrRuntimeDomainConflict is returned when removing a domain which is
+	// still blocked by a downloaded list.
+	ErrRuntimeDomainConflict errors.Error = "domain is blocked by a downloaded list"
+)
+
+// runtimeDomainsFile is the structure of the file the domains blocked at
+// runtime are persisted to.
+type runtimeDomainsFile struct {
+	// Domains are the blocked domains and "*." wildcards.
+	Domains []string `json:"domains"`
+}
+
+// SetRuntimeDomainsFile loads the domains blocked at runtime from the file at
+// path into r and makes the further changes persist there.  A missing file
+// means there are no such domains.  It must be called before the lists are
+// loaded.
+func (r *BlockedDomainsManager) SetRuntimeDomainsFile(path string) (err error) {
+	r.runtimeMux.Lock()
+	defer r.runtimeMux.Unlock()
+
+	r.runtimePath = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	f := &runtimeDomainsFile{}
+	err = json.Unmarshal(data, f)
+	if err != nil {
+		return fmt.Errorf("decoding %s: %w", path, err)
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for _, domain := range f.Domains {
+		r.runtimeDomains[normalizeDomain(domain)] = struct{}{}
+	}
+
+	log.Info("loaded %d domains blocked at runtime from %s", len(f.Domains), path)
+
+	return nil
+}
+
+// AddRuntimeDomain blocks the domain, which may also be a "*." wildcard, for
+// all the clients until it's removed with RemoveRuntimeDomain.  The change
+// takes effect immediately and is persisted.
+func (r *BlockedDomainsManager) AddRuntimeDomain(domain string) (err error) {
+	domain = normalizeDomain(domain)
+	err = netutil.ValidateDomainName(strings.TrimPrefix(domain, "*."))
+	if err != nil {
+		return err
+	}
+
+	r.runtimeMux.Lock()
+	defer r.runtimeMux.Unlock()
+
+	r.mux.Lock()
+	mask, err := r.runtimeListMask()
+	if err != nil {
+		r.mux.Unlock()
+
+		return err
+	}
+
+	if r.root.insert(domain, mask) {
+		r.numDomains++
+		r.counts(runtimeListName).numDomains++
+	}
+	r.runtimeDomains[domain] = struct{}{}
+	numDomains := r.numDomains
+	r.mux.Unlock()
+
+	SM.Set("blocked_domains::num_domains", numDomains)
+	log.Info("blocked %s at runtime", domain)
+
+	return r.saveRuntimeDomains()
+}
+
+// RemoveRuntimeDomain unblocks the domain previously blocked with
+// AddRuntimeDomain.  It returns ErrRuntimeDomainConflict if the domain would
+// still be blocked by a downloaded list and ErrRuntimeDomainNotFound if the
+// domain isn't blocked at runtime.
+func (r *BlockedDomainsManager) RemoveRuntimeDomain(domain string) (err error) {
+	domain = normalizeDomain(domain)
+
+	r.runtimeMux.Lock()
+	defer r.runtimeMux.Unlock()
+
+	r.mux.Lock()
+	err = r.removeRuntimeDomain(domain)
+	numDomains := r.numDomains
+	r.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	SM.Set("blocked_domains::num_domains", numDomains)
+	log.Info("unblocked %s at runtime", domain)
+
+	return r.saveRuntimeDomains()
+}
+
+// removeRuntimeDomain removes the domain blocked at runtime from r.  r.mux is
+// expected to be locked.
+func (r *BlockedDomainsManager) removeRuntimeDomain(domain string) (err error) {
+	runtimeMask := r.listsMask([]string{runtimeListName})
+	isBlockedByLists := func(lists uint64) bool { return lists&^runtimeMask != 0 }
+
+	var blockedEntry string
+	if strings.HasPrefix(domain, "*.") {
+		if lists, ok := r.root.entryLists(domain); ok && isBlockedByLists(lists) {
+			blockedEntry = domain
+		}
+	} else {
+		blockedEntry, _ = r.root.match(domain, isBlockedByLists)
+	}
+
+	if blockedEntry != "" {
+		lists, _ := r.root.entryLists(blockedEntry)
+		listName := r.blockedLists[0]
+		for i, name := range r.blockedLists {
+			if lists&(1<<i) != 0 && name != runtimeListName {
+				listName = name
+
+				break
+			}
+		}
+
+		return fmt.Errorf("%w: %s matches %s from list %s", ErrRuntimeDomainConflict, domain, blockedEntry, listName)
+	}
+
+	if _, ok := r.runtimeDomains[domain]; !ok {
+		return ErrRuntimeDomainNotFound
+	}
+
+	delete(r.runtimeDomains, domain)
+	if r.root.remove(domain, runtimeMask) {
+		r.numDomains--
+		r.counts(runtimeListName).numDomains--
+	}
+
+	return nil
+}
+
+// RuntimeDomains returns the sorted domains blocked at runtime.
+func (r *BlockedDomainsManager) RuntimeDomains() (domains []string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	domains = make([]string, 0, len(r.runtimeDomains))
+	for domain := range r.runtimeDomains {
+		domains = append(domains, domain)
+	}
+	slices.Sort(domains)
+
+	return domains
+}
+
+// runtimeEntries returns the domains blocked at runtime marked with the
+// runtime list.
+func (r *BlockedDomainsManager) runtimeEntries() (entries []tuple.T2[string, string]) {
+	for _, domain := range r.RuntimeDomains() {
+		entries = append(entries, tuple.New2(domain, runtimeListName))
+	}
+
+	return entries
+}
+
+// runtimeListMask returns the bit mask of the runtime list adding the list to
+// r if necessary.  r.mux is expected to be locked.
+func (r *BlockedDomainsManager) runtimeListMask() (mask uint64, err error) {
+	i, err := r.addList(runtimeListName)
+	if err != nil {
+		return 0, err
+	}
+
+	return 1 << i, nil
+}
+
+// saveRuntimeDomains persists the domains blocked at runtime, if the file is
+// set.  r.runtimeMux is expected to be locked.
+func (r *BlockedDomainsManager) saveRuntimeDomains() (err error) {
+	if r.runtimePath == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(&runtimeDomainsFile{Domains: r.RuntimeDomains()}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := r.runtimePath + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, r.runtimePath)
+}
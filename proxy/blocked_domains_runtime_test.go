@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockedDomainsManager_runtimeDomains(t *testing.T) {
+	dir := t.TempDir()
+	runtimePath := filepath.Join(dir, "runtime.json")
+
+	ads := filepath.Join(dir, "ads.txt")
+	err := os.WriteFile(ads, []byte("ads.example\n*.tracker.example\n"), 0o644)
+	require.NoError(t, err)
+
+	bdm := newBlockedDomainsManger()
+	require.NoError(t, bdm.SetRuntimeDomainsFile(runtimePath))
+	require.NoError(t, loadBlockedDomainsFiles(bdm, []string{ads}))
+
+	require.NoError(t, bdm.AddRuntimeDomain("Incident.Example."))
+	require.NoError(t, bdm.AddRuntimeDomain("*.evil.example"))
+	require.NoError(t, bdm.AddRuntimeDomain("ads.example"))
+	assert.Error(t, bdm.AddRuntimeDomain("bad domain"))
+
+	// The domains blocked at runtime apply regardless of the policies.
+	blocked, _ := bdm.checkDomainInLists("incident.example", []string{})
+	assert.True(t, blocked)
+
+	blocked, _ = bdm.checkDomain("www.evil.example")
+	assert.True(t, blocked)
+
+	assert.Equal(t, []string{"*.evil.example", "ads.example", "incident.example"}, bdm.RuntimeDomains())
+
+	t.Run("reload", func(t *testing.T) {
+		require.NoError(t, loadBlockedDomainsFiles(bdm, []string{ads}))
+
+		blocked, _ = bdm.checkDomain("incident.example")
+		assert.True(t, blocked)
+	})
+
+	t.Run("persisted", func(t *testing.T) {
+		restarted := newBlockedDomainsManger()
+		require.NoError(t, restarted.SetRuntimeDomainsFile(runtimePath))
+		require.NoError(t, loadBlockedDomainsFiles(restarted, []string{ads}))
+
+		assert.Equal(t, bdm.RuntimeDomains(), restarted.RuntimeDomains())
+
+		blocked, _ = restarted.checkDomain("incident.example")
+		assert.True(t, blocked)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		require.NoError(t, bdm.RemoveRuntimeDomain("incident.example"))
+
+		blocked, _ = bdm.checkDomain("incident.example")
+		assert.False(t, blocked)
+
+		assert.ErrorIs(t, bdm.RemoveRuntimeDomain("incident.example"), ErrRuntimeDomainNotFound)
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		assert.ErrorIs(t, bdm.RemoveRuntimeDomain("ads.example"), ErrRuntimeDomainConflict)
+		assert.ErrorIs(t, bdm.RemoveRuntimeDomain("x.tracker.example"), ErrRuntimeDomainConflict)
+
+		blocked, _ = bdm.checkDomain("ads.example")
+		assert.True(t, blocked)
+	})
+
+	t.Run("persisted_removal", func(t *testing.T) {
+		restarted := newBlockedDomainsManger()
+		require.NoError(t, restarted.SetRuntimeDomainsFile(runtimePath))
+
+		assert.Equal(t, []string{"*.evil.example", "ads.example"}, restarted.RuntimeDomains())
+	})
+}
+
+func TestLoadBlockedDomainsSnapshot_runtimeDomains(t *testing.T) {
+	dir := t.TempDir()
+	runtimePath := filepath.Join(dir, "runtime.json")
+	snapshotPath := filepath.Join(dir, "blocked_domains.snapshot")
+
+	ads := filepath.Join(dir, "ads.txt")
+	err := os.WriteFile(ads, []byte("ads.example\n"), 0o644)
+	require.NoError(t, err)
+
+	sources := []string{ads}
+
+	bdm := newBlockedDomainsManger()
+	require.NoError(t, bdm.SetRuntimeDomainsFile(runtimePath))
+	require.NoError(t, bdm.AddRuntimeDomain("old.example"))
+	require.ErrorIs(t, LoadBlockedDomainsSnapshot(bdm, snapshotPath, sources), os.ErrNotExist)
+	require.NoError(t, loadBlockedDomains(bdm, sources))
+	bdm.saveSnapshot(sources)
+
+	// Change the domains blocked at runtime after the snapshot is saved.
+	require.NoError(t, bdm.RemoveRuntimeDomain("old.example"))
+	require.NoError(t, bdm.AddRuntimeDomain("new.example"))
+
+	restarted := newBlockedDomainsManger()
+	require.NoError(t, restarted.SetRuntimeDomainsFile(runtimePath))
+	require.NoError(t, LoadBlockedDomainsSnapshot(restarted, snapshotPath, sources))
+
+	for domain, want := range map[string]bool{
+		"ads.example": true,
+		"old.example": false,
+		"new.example": true,
+	} {
+		blocked, _ := restarted.checkDomain(domain)
+		assert.Equal(t, want, blocked, domain)
+	}
+}
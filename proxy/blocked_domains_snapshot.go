@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/utils"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// blockedDomainsSnapshot is the compiled contents of a BlockedDomainsManager
+// persisted so that the blocking works right after the start, without parsing
+// the lists.
+type blockedDomainsSnapshot struct {
+	// ModTimes are the modification times of the lists' files the snapshot
+	// has been compiled from, keyed by the files' paths.
+	ModTimes map[string]time.Time
+
+	// Counts are the numbers of the loaded and duplicated entries keyed by
+	// the lists' names.
+	Counts map[string][2]int
+
+	// Sources are the configured sources of the lists.
+	Sources []string
+
+	// Lists are the names of the lists in the order of their bits in
+	// EntryLists.
+	Lists []string
+
+	// Entries are the blocked domains and wildcards.
+	Entries []string
+
+	// EntryLists are the bit masks of the lists of the corresponding Entries.
+	EntryLists []uint64
+
+	// Allowed are the domains which are never blocked.
+	Allowed []string
+}
+
+// LoadBlockedDomainsSnapshot loads the compiled blocked domains lists from the
+// snapshot file at path into r, if it's been compiled from the same sources
+// and none of the lists' files has changed since.  It also makes the later
+// successful updates of r save the snapshot to path.
+func LoadBlockedDomainsSnapshot(r *BlockedDomainsManager, path string, sources []string) (err error) {
+	r.mux.Lock()
+	r.snapshotPath = path
+	r.mux.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	snap := &blockedDomainsSnapshot{}
+	err = gob.NewDecoder(f).Decode(snap)
+	if err != nil {
+		return fmt.Errorf("decoding snapshot: %w", err)
+	}
+
+	if !slices.Equal(snap.Sources, sources) {
+		return errors.Error("snapshot is compiled from other sources")
+	}
+
+	for _, source := range sources {
+		filePath, _ := blockedListFilePath(source)
+		_, modificationTime, statErr := utils.GetFileInfo(filePath)
+		if statErr != nil {
+			return fmt.Errorf("checking %s: %w", filePath, statErr)
+		}
+
+		if loadedTime, ok := snap.ModTimes[filePath]; !ok || !loadedTime.Equal(modificationTime) {
+			return fmt.Errorf("list %s has changed since the snapshot", filePath)
+		}
+	}
+
+	if len(snap.Entries) != len(snap.EntryLists) {
+		return errors.Error("malformed snapshot")
+	}
+
+	next := newBlockedDomainsManger()
+	for _, list := range snap.Lists {
+		if _, err = next.addList(list); err != nil {
+			return fmt.Errorf("malformed snapshot: %w", err)
+		}
+	}
+
+	if len(next.blockedLists) != len(snap.Lists) {
+		return errors.Error("malformed snapshot: duplicated lists")
+	}
+
+	next.modTimes = snap.ModTimes
+
+	// The domains blocked at runtime may have changed since the snapshot, so
+	// replace them with the current ones.
+	runtimeMask := next.listsMask([]string{runtimeListName})
+	for i, entry := range snap.Entries {
+		lists := snap.EntryLists[i]
+		if lists&runtimeMask != 0 {
+			lists &^= runtimeMask
+			if lists == 0 {
+				continue
+			}
+		}
+
+		if next.root.insert(entry, lists) {
+			next.numDomains++
+		}
+	}
+
+	for _, domain := range snap.Allowed {
+		next.allowedHosts[domain] = struct{}{}
+	}
+
+	for list, c := range snap.Counts {
+		if list != runtimeListName {
+			next.listCounts[list] = &blockedListCounts{numDomains: c[0], numDuplicates: c[1]}
+		}
+	}
+
+	if _, err = next.runtimeListMask(); err != nil {
+		return err
+	}
+
+	for _, entry := range r.runtimeEntries() {
+		next.addDomain(entry)
+		next.counts(runtimeListName).numDomains++
+	}
+
+	r.swap(next)
+
+	SM.Set("blocked_domains::num_domains", r.getNumDomains())
+	log.Info("loaded %d blocked domains from snapshot %s", r.getNumDomains(), path)
+
+	return nil
+}
+
+// saveSnapshot saves the contents of r compiled from sources to the snapshot
+// file, if it's enabled.  The errors are only logged, since the snapshot is
+// merely an optimization.
+func (r *BlockedDomainsManager) saveSnapshot(sources []string) {
+	r.mux.Lock()
+	path := r.snapshotPath
+	if path == "" {
+		r.mux.Unlock()
+
+		return
+	}
+
+	snap := &blockedDomainsSnapshot{
+		ModTimes: make(map[string]time.Time, len(r.modTimes)),
+		Counts:   make(map[string][2]int, len(r.listCounts)),
+		Sources:  slices.Clone(sources),
+		Lists:    slices.Clone(r.blockedLists),
+		Entries:  make([]string, 0, r.numDomains),
+	}
+
+	for filePath, modificationTime := range r.modTimes {
+		snap.ModTimes[filePath] = modificationTime
+	}
+
+	for list, c := range r.listCounts {
+		snap.Counts[list] = [2]int{c.numDomains, c.numDuplicates}
+	}
+
+	for domain := range r.allowedHosts {
+		snap.Allowed = append(snap.Allowed, domain)
+	}
+
+	r.root.walk("", func(entry string, lists uint64) {
+		snap.Entries = append(snap.Entries, entry)
+		snap.EntryLists = append(snap.EntryLists, lists)
+	})
+	r.mux.Unlock()
+
+	err := writeSnapshot(path, snap)
+	if err != nil {
+		log.Error("saving blocked domains snapshot: %s", err)
+
+		return
+	}
+
+	log.Debug("saved %d blocked domains to snapshot %s", len(snap.Entries), path)
+}
+
+// writeSnapshot encodes snap into the file at path.  The file is replaced
+// atomically, so that a crash doesn't leave a truncated snapshot.
+func writeSnapshot(path string, snap *blockedDomainsSnapshot) (err error) {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(f).Encode(snap)
+	err = errors.WithDeferred(err, f.Close())
+	if err != nil {
+		_ = os.Remove(tmpPath)
+
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
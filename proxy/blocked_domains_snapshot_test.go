@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadBlockedDomainsSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	snapshotPath := filepath.Join(dir, "blocked_domains.snapshot")
+
+	ads := filepath.Join(dir, "ads.txt")
+	err := os.WriteFile(ads, []byte("ads.example\n*.tracker.example\nx.tracker.example\n"), 0o644)
+	require.NoError(t, err)
+
+	adult := filepath.Join(dir, "adult.txt")
+	err = os.WriteFile(adult, []byte("adult.example\n@@||safe.adult.example^\n"), 0o644)
+	require.NoError(t, err)
+
+	sources := []string{ads, "file://" + adult}
+
+	// There is no snapshot yet, but the path is remembered for the updates.
+	bdm := newBlockedDomainsManger()
+	err = LoadBlockedDomainsSnapshot(bdm, snapshotPath, sources)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	UpdateBlockedDomains(bdm, sources, time.Hour)
+	require.FileExists(t, snapshotPath)
+
+	t.Run("success", func(t *testing.T) {
+		loaded := newBlockedDomainsManger()
+		require.NoError(t, LoadBlockedDomainsSnapshot(loaded, snapshotPath, sources))
+
+		assert.Equal(t, bdm.getNumDomains(), loaded.getNumDomains())
+		assert.Equal(t, bdm.Status(sources).Lists, loaded.Status(sources).Lists)
+
+		for _, domain := range []string{"ads.example", "a.tracker.example", "adult.example"} {
+			want, wantEntry := bdm.checkDomain(domain)
+			got, gotEntry := loaded.checkDomain(domain)
+			assert.Equal(t, want, got, domain)
+			assert.Equal(t, wantEntry, gotEntry, domain)
+		}
+
+		blocked, _ := loaded.checkDomainInLists("adult.example", []string{"ads"})
+		assert.False(t, blocked)
+
+		blocked, _ = loaded.checkDomainInLists("adult.example", []string{"adult"})
+		assert.True(t, blocked)
+
+		assert.True(t, loaded.checkException("safe.adult.example"))
+	})
+
+	t.Run("other_sources", func(t *testing.T) {
+		loaded := newBlockedDomainsManger()
+		err = LoadBlockedDomainsSnapshot(loaded, snapshotPath, []string{ads})
+		assert.Error(t, err)
+		assert.Zero(t, loaded.getNumDomains())
+	})
+
+	t.Run("changed_list", func(t *testing.T) {
+		modTime := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(ads, modTime, modTime))
+
+		loaded := newBlockedDomainsManger()
+		err = LoadBlockedDomainsSnapshot(loaded, snapshotPath, sources)
+		assert.Error(t, err)
+		assert.Zero(t, loaded.getNumDomains())
+	})
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"strings"
+)
+
+// domainsOtherKey is the name of the counter the hits of the domains evicted
+// from the per-domain statistics are added up into.  It can't be a valid domain
+// name.
+const domainsOtherKey = "(other)"
+
+// newDomainsStatsTracker returns a new tracker of at most limit domains in the
+// per-domain statistics of the given section, e.g. "blocked_domains".  The keys
+// are in the "<list>::<domain>" format.
+func newDomainsStatsTracker(section string, limit int) (l *statsLRU) {
+	return newStatsLRU(limit, func() (keys []string) {
+		for _, h := range sortDomainHits(SM.domainHits(section)) {
+			keys = append(keys, h.List+"::"+h.Domain)
+		}
+
+		return keys
+	})
+}
+
+// countDomain increments the counter of the hits for domain from the list with
+// the given name under the "<section>::domains" key.  If l evicts a domain, its
+// counter is added up into the "(other)" counter of its list.  l may be nil.
+func countDomain(l *statsLRU, section, listName, domain string) {
+	prefix := section + "::domains::"
+	key := listName + "::" + domain
+	if l != nil {
+		if evicted := l.touch(key); evicted != "" {
+			evictedList, _, _ := strings.Cut(evicted, "::")
+			SM.Fold(prefix+evicted, prefix+evictedList+"::"+domainsOtherKey)
+		}
+	}
+
+	SM.Increment(prefix+key, 1)
+}
+
+// countBlockedDomain increments the counter of the blocked responses for
+// domain blocked by the list with the given name.
+func (p *Proxy) countBlockedDomain(listName, domain string) {
+	countDomain(p.blockedDomainsStats, "blocked_domains", listName, domain)
+}
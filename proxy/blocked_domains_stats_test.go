@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_countBlockedDomain(t *testing.T) {
+	setTestStats(t)
+
+	require.NoError(t, SM.Set("blocked_domains::domains::ads::loaded.example", float64(5)))
+
+	p := &Proxy{blockedDomainsStats: newDomainsStatsTracker("blocked_domains", 2)}
+
+	p.countBlockedDomain("ads", "one.example")
+	p.countBlockedDomain("ads", "one.example")
+
+	// Evicts the loaded domain.
+	p.countBlockedDomain("trackers", "two.example")
+
+	// Evicts one.example, since two.example is blocked more recently.
+	p.countBlockedDomain("trackers", "two.example")
+	p.countBlockedDomain("trackers", "three.example")
+
+	assert.False(t, SM.Exists("blocked_domains::domains::ads::loaded.example"))
+	assert.False(t, SM.Exists("blocked_domains::domains::ads::one.example"))
+
+	other, ok := SM.GetUint64("blocked_domains::domains::ads::" + domainsOtherKey)
+	require.True(t, ok)
+	assert.Equal(t, uint64(7), other)
+
+	// The per-domain counters aren't kept per day.
+	assert.False(t, SM.Exists("today::blocked_domains::domains"))
+
+	top := SM.TopBlockedDomains(-1)
+	assert.Equal(t, map[string]uint64{"ads": 7, "trackers": 3}, top.ListTotals)
+	assert.Equal(t, []BlockedDomainHits{
+		{Domain: "two.example", List: "trackers", Hits: 2},
+		{Domain: "three.example", List: "trackers", Hits: 1},
+	}, top.Domains)
+}
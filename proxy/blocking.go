@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// BlockingMode is the type of response the proxy sends for blocked domains.
+type BlockingMode string
+
+// BlockingMode values.
+const (
+	// BlockingModeDefault is the same as [BlockingModeNullIP].
+	BlockingModeDefault BlockingMode = ""
+
+	// BlockingModeNullIP responds with the unspecified address, i.e. 0.0.0.0
+	// for A and :: for AAAA queries.
+	BlockingModeNullIP BlockingMode = "null-ip"
+
+	// BlockingModeNXDOMAIN responds with NXDOMAIN and a SOA record in the
+	// authority section.
+	BlockingModeNXDOMAIN BlockingMode = "nxdomain"
+
+	// BlockingModeREFUSED responds with REFUSED.
+	BlockingModeREFUSED BlockingMode = "refused"
+
+	// BlockingModeCustomIP responds with [Config.BlockingIPv4] for A and
+	// [Config.BlockingIPv6] for AAAA queries.  If the address for the
+	// requested family isn't set, NODATA response is sent.
+	BlockingModeCustomIP BlockingMode = "custom-ip"
+)
+
+// BlockingPolicy defines the blocked domains lists applied to the clients from
+// a subnet or to the client with an identifier.
+type BlockingPolicy struct {
+	// ClientID is the identifier of the client the policy applies to, see
+	// [DNSContext.ClientID].  If set, Subnet is ignored and the policy takes
+	// precedence over the subnet ones.
+	ClientID string
+
+	// Subnet is the subnet of the clients the policy applies to.
+	Subnet netip.Prefix
+
+	// Lists are the names of the blocked domains lists applied to the clients,
+	// i.e. the base names of the lists' files without extensions.
+	Lists []string
+}
+
+// blockedListsForClient returns the names of the blocked domains lists applied
+// to the client with addr and clientID, which may be empty.  It returns nil if
+// no policy matches, which means that all the lists are applied.  The policy
+// for clientID wins, otherwise the most specific matching subnet policy does.
+func (p *Proxy) blockedListsForClient(addr netip.Addr, clientID string) (lists []string) {
+	if clientID != "" {
+		for _, pol := range p.BlockingPolicies {
+			if pol.ClientID == clientID {
+				// Make sure an empty policy doesn't fall back to all the
+				// lists.
+				return append([]string{}, pol.Lists...)
+			}
+		}
+	}
+
+	addr = addr.Unmap()
+	bits := -1
+	for _, pol := range p.BlockingPolicies {
+		if pol.ClientID != "" {
+			continue
+		}
+
+		if pol.Subnet.Bits() > bits && pol.Subnet.Contains(addr) {
+			bits = pol.Subnet.Bits()
+			lists = pol.Lists
+		}
+	}
+
+	if bits >= 0 && lists == nil {
+		// Make sure an empty policy doesn't fall back to all the lists.
+		lists = []string{}
+	}
+
+	return lists
+}
+
+// isBlockedQueryType returns true if the queries of qtype for blocked domains
+// should be blocked.
+func (p *Proxy) isBlockedQueryType(qtype uint16) (ok bool) {
+	return len(p.BlockedQueryTypes) == 0 || slices.Contains(p.BlockedQueryTypes, qtype)
+}
+
+// clientStatsKey returns the representation of addr suitable for the keys of
+// [StatsManager], which uses "::" as the separator.
+func clientStatsKey(addr netip.Addr) (key string) {
+	addr = addr.Unmap()
+	if addr.Is6() {
+		return addr.StringExpanded()
+	}
+
+	return addr.String()
+}
+
+// blockedResponseTTL is the TTL of the records in responses for blocked
+// domains in seconds.
+const blockedResponseTTL = 3600
+
+// validateBlocking returns an error if the blocking configuration is invalid.
+func (p *Proxy) validateBlocking() (err error) {
+	for i, pol := range p.BlockingPolicies {
+		if pol.ClientID != "" {
+			err = ValidateClientID(pol.ClientID)
+			if err != nil {
+				return fmt.Errorf("blocking policy at index %d: %w", i, err)
+			}
+		} else if !pol.Subnet.IsValid() {
+			return fmt.Errorf("blocking policy at index %d: invalid subnet", i)
+		}
+	}
+
+	switch p.BlockingMode {
+	case BlockingModeDefault, BlockingModeNullIP, BlockingModeNXDOMAIN, BlockingModeREFUSED:
+		return nil
+	case BlockingModeCustomIP:
+		// Go on.
+	default:
+		return fmt.Errorf("unknown blocking mode %q", p.BlockingMode)
+	}
+
+	v4, v6 := p.BlockingIPv4, p.BlockingIPv6
+	if !v4.IsValid() && !v6.IsValid() {
+		return errors.Error("custom-ip blocking mode requires at least a single address")
+	}
+
+	if v4.IsValid() && !v4.Is4() {
+		return fmt.Errorf("blocking ipv4 %s is not an ipv4 address", v4)
+	}
+
+	if v6.IsValid() && (!v6.Is6() || v6.Is4In6()) {
+		return fmt.Errorf("blocking ipv6 %s is not an ipv6 address", v6)
+	}
+
+	return nil
+}
+
+// genBlockedResponse returns the response for the request to a blocked domain
+// according to the configured blocking mode.  Requests of types other than A
+// and AAAA are answered with NODATA unless the mode defines the response code.
+func (p *Proxy) genBlockedResponse(req *dns.Msg) (resp *dns.Msg) {
+	switch p.BlockingMode {
+	case BlockingModeNXDOMAIN:
+		return GenEmptyMessage(req, dns.RcodeNameError, retryNoError)
+	case BlockingModeREFUSED:
+		resp = &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeRefused)
+		resp.RecursionAvailable = true
+
+		return resp
+	case BlockingModeCustomIP:
+		return genBlockedAddrResponse(req, p.BlockingIPv4, p.BlockingIPv6)
+	default:
+		return genBlockedAddrResponse(req, netip.IPv4Unspecified(), netip.IPv6Unspecified())
+	}
+}
+
+// newBlockedEDE returns the extended DNS error for the responses blocked by the
+// blocked domains list with the given name.
+func newBlockedEDE(listName string) (ede *dns.EDNS0_EDE) {
+	return &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeBlocked,
+		ExtraText: listName,
+	}
+}
+
+// genBlockedAddrResponse returns the response containing the given address of
+// the requested family.  The response has no answers if the address of the
+// requested family is invalid or the request isn't an A or AAAA one.
+func genBlockedAddrResponse(req *dns.Msg, v4, v6 netip.Addr) (resp *dns.Msg) {
+	resp = genEmptyNoError(req)
+
+	q := req.Question[0]
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    blockedResponseTTL,
+	}
+
+	switch {
+	case q.Qtype == dns.TypeA && v4.IsValid():
+		resp.Answer = []dns.RR{&dns.A{Hdr: hdr, A: v4.AsSlice()}}
+	case q.Qtype == dns.TypeAAAA && v6.IsValid():
+		resp.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: v6.AsSlice()}}
+	}
+
+	return resp
+}
+
+// blockCNAMECloaking replaces the response in dctx with the blocked one if any
+// of the CNAME targets in its answer section is blocked, which reveals the
+// trackers hidden behind CNAME records of first-party domains.  The allowed
+// domains, see allowedBy, are never blocked, and neither are the targets of
+// their CNAME records.  It returns
+// true if the response has been replaced, which never happens in the dry run
+// mode.
+func (p *Proxy) blockCNAMECloaking(dctx *DNSContext) (blocked bool) {
+	if dctx.Res == nil || len(dctx.Req.Question) == 0 {
+		return false
+	}
+
+	qName := normalizeDomain(dctx.Req.Question[0].Name)
+	if _, _, ok := allowedBy(qName); ok {
+		return false
+	}
+
+	lists := p.blockedListsForClient(dctx.Addr.Addr(), dctx.ClientID)
+	for _, rr := range dctx.Res.Answer {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+
+		target := normalizeDomain(cname.Target)
+		ok, blockedDomain := Bdm.checkDomainInLists(target, lists)
+		if !ok || p.isAllowedDomain(target, blockedDomain) {
+			continue
+		}
+
+		log.Debug("dnsproxy: cname %s of %s is blocked by rule %s", target, qName, blockedDomain)
+
+		SM.Increment("blocked_domains::cname_blocked", 1)
+
+		if p.BlockingDryRun {
+			log.Info("dnsproxy: dry run: cname %s of %s would be blocked by rule %s", target, qName, blockedDomain)
+
+			return false
+		}
+
+		dctx.Res = p.genBlockedResponse(dctx.Req)
+		dctx.Upstream = nil
+		dctx.blockedList = Bdm.getDomainListName(blockedDomain)
+		dctx.ede = newBlockedEDE(dctx.blockedList)
+
+		return true
+	}
+
+	return false
+}
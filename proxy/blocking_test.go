@@ -0,0 +1,528 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_genBlockedResponse(t *testing.T) {
+	const host = "blocked.example."
+
+	reqA := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+	reqAAAA := (&dns.Msg{}).SetQuestion(host, dns.TypeAAAA)
+
+	customV4 := netip.MustParseAddr("192.0.2.1")
+	customV6 := netip.MustParseAddr("2001:db8::1")
+
+	testCases := []struct {
+		name      string
+		req       *dns.Msg
+		wantAddr  net.IP
+		conf      Config
+		wantRcode int
+		wantSOA   bool
+	}{{
+		name:      "default_a",
+		req:       reqA,
+		wantAddr:  net.IPv4zero,
+		conf:      Config{},
+		wantRcode: dns.RcodeSuccess,
+		wantSOA:   true,
+	}, {
+		name:      "null_ip_aaaa",
+		req:       reqAAAA,
+		wantAddr:  net.IPv6zero,
+		conf:      Config{BlockingMode: BlockingModeNullIP},
+		wantRcode: dns.RcodeSuccess,
+		wantSOA:   true,
+	}, {
+		name:      "nxdomain",
+		req:       reqA,
+		wantAddr:  nil,
+		conf:      Config{BlockingMode: BlockingModeNXDOMAIN},
+		wantRcode: dns.RcodeNameError,
+		wantSOA:   true,
+	}, {
+		name:      "refused",
+		req:       reqAAAA,
+		wantAddr:  nil,
+		conf:      Config{BlockingMode: BlockingModeREFUSED},
+		wantRcode: dns.RcodeRefused,
+		wantSOA:   false,
+	}, {
+		name:     "custom_ip_a",
+		req:      reqA,
+		wantAddr: customV4.AsSlice(),
+		conf: Config{
+			BlockingMode: BlockingModeCustomIP,
+			BlockingIPv4: customV4,
+			BlockingIPv6: customV6,
+		},
+		wantRcode: dns.RcodeSuccess,
+		wantSOA:   true,
+	}, {
+		name:     "custom_ip_aaaa",
+		req:      reqAAAA,
+		wantAddr: customV6.AsSlice(),
+		conf: Config{
+			BlockingMode: BlockingModeCustomIP,
+			BlockingIPv4: customV4,
+			BlockingIPv6: customV6,
+		},
+		wantRcode: dns.RcodeSuccess,
+		wantSOA:   true,
+	}, {
+		name:     "custom_ip_no_v6",
+		req:      reqAAAA,
+		wantAddr: nil,
+		conf: Config{
+			BlockingMode: BlockingModeCustomIP,
+			BlockingIPv4: customV4,
+		},
+		wantRcode: dns.RcodeSuccess,
+		wantSOA:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: tc.conf}
+			require.NoError(t, p.validateBlocking())
+
+			resp := p.genBlockedResponse(tc.req)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.req.Id, resp.Id)
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+
+			if tc.wantSOA {
+				require.Len(t, resp.Ns, 1)
+				assert.IsType(t, &dns.SOA{}, resp.Ns[0])
+			} else {
+				assert.Empty(t, resp.Ns)
+			}
+
+			if tc.wantAddr == nil {
+				assert.Empty(t, resp.Answer)
+
+				return
+			}
+
+			require.Len(t, resp.Answer, 1)
+
+			ans := resp.Answer[0]
+			assert.Equal(t, uint32(blockedResponseTTL), ans.Header().Ttl)
+			assert.Equal(t, host, ans.Header().Name)
+
+			switch ans := ans.(type) {
+			case *dns.A:
+				assert.True(t, tc.wantAddr.Equal(ans.A))
+			case *dns.AAAA:
+				assert.True(t, tc.wantAddr.Equal(ans.AAAA))
+			default:
+				t.Fatalf("unexpected answer type %T", ans)
+			}
+		})
+	}
+}
+
+func TestProxy_validateBlocking(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		conf       Config
+	}{{
+		name:       "unknown",
+		wantErrMsg: `unknown blocking mode "bad"`,
+		conf:       Config{BlockingMode: "bad"},
+	}, {
+		name: "bad_client_id",
+		wantErrMsg: `blocking policy at index 0: invalid client id "bad_id": ` +
+			`bad hostname label "bad_id": bad hostname label rune '_'`,
+		conf: Config{
+			BlockingPolicies: []BlockingPolicy{{ClientID: "bad_id"}},
+		},
+	}, {
+		name:       "custom_ip_empty",
+		wantErrMsg: "custom-ip blocking mode requires at least a single address",
+		conf:       Config{BlockingMode: BlockingModeCustomIP},
+	}, {
+		name:       "custom_ip_bad_v4",
+		wantErrMsg: "blocking ipv4 2001:db8::1 is not an ipv4 address",
+		conf: Config{
+			BlockingMode: BlockingModeCustomIP,
+			BlockingIPv4: netip.MustParseAddr("2001:db8::1"),
+		},
+	}, {
+		name:       "custom_ip_bad_v6",
+		wantErrMsg: "blocking ipv6 192.0.2.1 is not an ipv6 address",
+		conf: Config{
+			BlockingMode: BlockingModeCustomIP,
+			BlockingIPv6: netip.MustParseAddr("192.0.2.1"),
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: tc.conf}
+			assert.EqualError(t, p.validateBlocking(), tc.wantErrMsg)
+		})
+	}
+}
+
+func TestProxy_blockedListsForClient(t *testing.T) {
+	p := &Proxy{
+		Config: Config{
+			BlockingPolicies: []BlockingPolicy{{
+				Subnet: netip.MustParsePrefix("192.168.0.0/16"),
+				Lists:  []string{"ads"},
+			}, {
+				Subnet: netip.MustParsePrefix("192.168.10.0/24"),
+				Lists:  []string{"ads", "adult"},
+			}, {
+				Subnet: netip.MustParsePrefix("192.168.20.0/24"),
+				Lists:  nil,
+			}, {
+				ClientID: "kids",
+				Lists:    []string{"adult"},
+			}, {
+				ClientID: "admin",
+				Lists:    nil,
+			}},
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		clientID string
+		addr     netip.Addr
+		want     []string
+	}{{
+		name:     "no_policy",
+		clientID: "",
+		addr:     netip.MustParseAddr("10.0.0.1"),
+		want:     nil,
+	}, {
+		name:     "wide",
+		clientID: "",
+		addr:     netip.MustParseAddr("192.168.1.1"),
+		want:     []string{"ads"},
+	}, {
+		name:     "specific",
+		clientID: "",
+		addr:     netip.MustParseAddr("192.168.10.1"),
+		want:     []string{"ads", "adult"},
+	}, {
+		name:     "mapped",
+		clientID: "",
+		addr:     netip.MustParseAddr("::ffff:192.168.10.1"),
+		want:     []string{"ads", "adult"},
+	}, {
+		name:     "empty",
+		clientID: "",
+		addr:     netip.MustParseAddr("192.168.20.1"),
+		want:     []string{},
+	}, {
+		name:     "client_id",
+		clientID: "kids",
+		addr:     netip.MustParseAddr("192.168.10.1"),
+		want:     []string{"adult"},
+	}, {
+		name:     "client_id_empty",
+		clientID: "admin",
+		addr:     netip.MustParseAddr("10.0.0.1"),
+		want:     []string{},
+	}, {
+		name:     "unknown_client_id",
+		clientID: "phone",
+		addr:     netip.MustParseAddr("192.168.1.1"),
+		want:     []string{"ads"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, p.blockedListsForClient(tc.addr, tc.clientID))
+		})
+	}
+}
+
+// setTestBlockedDomains loads the list with the given contents into [Bdm] and
+// restores its previous contents on cleanup.
+func setTestBlockedDomains(t *testing.T, listName, contents string) {
+	t.Helper()
+
+	listPath := filepath.Join(t.TempDir(), listName+".txt")
+	err := os.WriteFile(listPath, []byte(contents), 0o644)
+	require.NoError(t, err)
+
+	prev := newBlockedDomainsManger()
+	prev.swap(Bdm)
+	t.Cleanup(func() { Bdm.swap(prev) })
+
+	require.NoError(t, loadBlockedDomainsFiles(Bdm, []string{listPath}))
+}
+
+func TestProxy_blockCNAMECloaking(t *testing.T) {
+	setTestBlockedDomains(t, "trackers", "tracker.example\n")
+
+	Edm.AddDomain("excluded.example")
+	t.Cleanup(Edm.clear)
+
+	newCNAME := func(name, target string) (rr dns.RR) {
+		return &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: target,
+		}
+	}
+
+	testCases := []struct {
+		name        string
+		host        string
+		answer      []dns.RR
+		wantBlocked bool
+	}{{
+		name:        "no_cname",
+		host:        "first.example.",
+		answer:      nil,
+		wantBlocked: false,
+	}, {
+		name: "direct",
+		host: "first.example.",
+		answer: []dns.RR{
+			newCNAME("first.example.", "tracker.example."),
+		},
+		wantBlocked: true,
+	}, {
+		name: "chain",
+		host: "first.example.",
+		answer: []dns.RR{
+			newCNAME("first.example.", "cdn.example."),
+			newCNAME("cdn.example.", "tracker.example."),
+		},
+		wantBlocked: true,
+	}, {
+		name: "not_blocked",
+		host: "first.example.",
+		answer: []dns.RR{
+			newCNAME("first.example.", "cdn.example."),
+		},
+		wantBlocked: false,
+	}, {
+		name: "excluded",
+		host: "excluded.example.",
+		answer: []dns.RR{
+			newCNAME("excluded.example.", "tracker.example."),
+		},
+		wantBlocked: false,
+	}}
+
+	p := &Proxy{}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA)
+			res := (&dns.Msg{}).SetReply(req)
+			res.Answer = tc.answer
+
+			dctx := &DNSContext{
+				Req:  req,
+				Res:  res,
+				Addr: netip.MustParseAddrPort("192.0.2.1:53"),
+			}
+
+			assert.Equal(t, tc.wantBlocked, p.blockCNAMECloaking(dctx))
+			if !tc.wantBlocked {
+				assert.Same(t, res, dctx.Res)
+
+				return
+			}
+
+			require.Len(t, dctx.Res.Answer, 1)
+			assert.IsType(t, &dns.A{}, dctx.Res.Answer[0])
+			assert.Equal(t, tc.host, dctx.Res.Answer[0].Header().Name)
+		})
+	}
+}
+
+func TestProxy_Resolve_blockedCase(t *testing.T) {
+	setTestBlockedDomains(t, "ads", "DoubleClick.NET\n*.Ads.Example.\n")
+
+	p := mustNew(t, &Config{
+		UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		BlockingMode:           BlockingModeREFUSED,
+	})
+
+	testCases := []struct {
+		name string
+		host string
+	}{{
+		name: "lower",
+		host: "doubleclick.net.",
+	}, {
+		name: "mixed",
+		host: "DoubleClick.NET.",
+	}, {
+		name: "randomized",
+		host: "dOuBlEcLiCk.nEt.",
+	}, {
+		name: "wildcard_randomized",
+		host: "wWw.aDs.ExAmPlE.",
+	}, {
+		name: "wildcard_upper",
+		host: "ADS.EXAMPLE.",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &DNSContext{
+				Req:   (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA),
+				Proto: ProtoUDP,
+				Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+			}
+
+			err := p.Resolve(dctx)
+			require.NoError(t, err)
+			require.NotNil(t, dctx.Res)
+
+			assert.Equal(t, dns.RcodeRefused, dctx.Res.Rcode)
+		})
+	}
+}
+
+func TestProxy_Resolve_blockedQueryTypes(t *testing.T) {
+	setTestBlockedDomains(t, "ads", "blocked.example\n")
+
+	p := mustNew(t, &Config{
+		UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	for _, qtype := range []uint16{dns.TypeHTTPS, dns.TypeSVCB, dns.TypeTXT, dns.TypeMX, dns.TypeCNAME} {
+		t.Run(dns.TypeToString[qtype], func(t *testing.T) {
+			dctx := &DNSContext{
+				Req:   (&dns.Msg{}).SetQuestion("blocked.example.", qtype),
+				Proto: ProtoUDP,
+				Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+			}
+
+			err := p.Resolve(dctx)
+			require.NoError(t, err)
+			require.NotNil(t, dctx.Res)
+
+			assert.Equal(t, dns.RcodeSuccess, dctx.Res.Rcode)
+			assert.Empty(t, dctx.Res.Answer)
+			require.Len(t, dctx.Res.Ns, 1)
+			assert.IsType(t, &dns.SOA{}, dctx.Res.Ns[0])
+		})
+	}
+}
+
+func TestProxy_isBlockedQueryType(t *testing.T) {
+	all := &Proxy{}
+	addrOnly := &Proxy{
+		Config: Config{
+			BlockedQueryTypes: []uint16{dns.TypeA, dns.TypeAAAA},
+		},
+	}
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeHTTPS, dns.TypeTXT} {
+		assert.True(t, all.isBlockedQueryType(qtype))
+	}
+
+	assert.True(t, addrOnly.isBlockedQueryType(dns.TypeA))
+	assert.True(t, addrOnly.isBlockedQueryType(dns.TypeAAAA))
+	assert.False(t, addrOnly.isBlockedQueryType(dns.TypeHTTPS))
+	assert.False(t, addrOnly.isBlockedQueryType(dns.TypeTXT))
+}
+
+func TestProxy_Resolve_blockingDryRun(t *testing.T) {
+	setTestBlockedDomains(t, "dryrun", "dry.example\ntracker.dry.example\n")
+
+	ansIP := net.IP{192, 0, 2, 2}
+	newUpstreamConf := func(ans ...dns.RR) (conf *UpstreamConfig) {
+		return &UpstreamConfig{Upstreams: []upstream.Upstream{&testUpstream{ans: ans}}}
+	}
+
+	// getCounter returns the value of the counter with the given key or zero.
+	getCounter := func(key string) (n uint64) {
+		n, _ = SM.GetUint64(key)
+
+		return n
+	}
+
+	t.Run("query", func(t *testing.T) {
+		p := mustNew(t, &Config{
+			UpstreamConfig: newUpstreamConf(&dns.A{
+				Hdr: dns.RR_Header{Name: "dry.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   ansIP,
+			}),
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+			BlockingDryRun:         true,
+		})
+
+		const domainKey = "blocked_domains::domains::dryrun::dry.example"
+		prevTotal, prevDomain := getCounter("blocked_domains::blocked_responses"), getCounter(domainKey)
+
+		dctx := &DNSContext{
+			Req:   (&dns.Msg{}).SetQuestion("dry.example.", dns.TypeA),
+			Proto: ProtoUDP,
+			Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+
+		err := p.Resolve(dctx)
+		require.NoError(t, err)
+		require.NotNil(t, dctx.Res)
+
+		require.Len(t, dctx.Res.Answer, 1)
+		a := testutil.RequireTypeAssert[*dns.A](t, dctx.Res.Answer[0])
+		assert.True(t, ansIP.Equal(a.A))
+
+		assert.Equal(t, prevTotal+1, getCounter("blocked_domains::blocked_responses"))
+		assert.Equal(t, prevDomain+1, getCounter(domainKey))
+	})
+
+	t.Run("cname", func(t *testing.T) {
+		p := mustNew(t, &Config{
+			UpstreamConfig: newUpstreamConf(&dns.CNAME{
+				Hdr:    dns.RR_Header{Name: "first.example.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: "tracker.dry.example.",
+			}, &dns.A{
+				Hdr: dns.RR_Header{Name: "tracker.dry.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   ansIP,
+			}),
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+			BlockingDryRun:         true,
+		})
+
+		prev := getCounter("blocked_domains::cname_blocked")
+
+		dctx := &DNSContext{
+			Req:   (&dns.Msg{}).SetQuestion("first.example.", dns.TypeA),
+			Proto: ProtoUDP,
+			Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+
+		err := p.Resolve(dctx)
+		require.NoError(t, err)
+		require.NotNil(t, dctx.Res)
+
+		assert.Len(t, dctx.Res.Answer, 2)
+		assert.Equal(t, prev+1, getCounter("blocked_domains::cname_blocked"))
+	})
+}
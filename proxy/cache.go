@@ -2,7 +2,9 @@ package proxy
 
 import (
 	"bytes"
+	"cmp"
 	"encoding/binary"
+	"fmt"
 	"math"
 	"net"
 	"slices"
@@ -12,6 +14,7 @@ import (
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	glcache "github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/mathutil"
 	"github.com/miekg/dns"
@@ -37,6 +40,15 @@ type cache struct {
 	// optimistic defines if the cache should return expired items and resolve
 	// those again.
 	optimistic bool
+
+	// optimisticTTL is the TTL of the expired responses returned by the
+	// optimistic cache.
+	optimisticTTL uint32
+
+	// staleTTL is the TTL of the expired responses served when the upstreams
+	// fail, see RFC 8767.  Zero means that the expired responses aren't served
+	// on failures.
+	staleTTL uint32
 }
 
 // cacheItem is a single cache entry.  It's a helper type to aggregate the
@@ -106,13 +118,31 @@ func (ci *cacheItem) pack() (packed []byte) {
 	return packed
 }
 
-// optimisticTTL is the default TTL for expired cached responses in seconds.
+// optimisticTTL is the default TTL for expired cached responses returned by the
+// optimistic cache in seconds.
 const optimisticTTL = 12 * 3600
 
+// defaultStaleTTL is the default TTL for expired cached responses served when
+// the upstreams fail in seconds.
+const defaultStaleTTL = 30
+
 // unpackItem converts the data into cacheItem using req as a request message.
 // expired is true if the item exists but expired.  The expired cached items are
 // only returned if c is optimistic.  req must not be nil.
 func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bool) {
+	var expiredTTL uint32
+	if c.optimistic {
+		expiredTTL = c.optimisticTTL
+	}
+
+	return unpackCacheItem(data, req, expiredTTL)
+}
+
+// unpackCacheItem converts the data into cacheItem using req as a request
+// message.  expired is true if the item exists but expired.  The expired cached
+// items are only returned with expiredTTL if it's not zero.  req must not be
+// nil.
+func unpackCacheItem(data []byte, req *dns.Msg, expiredTTL uint32) (ci *cacheItem, expired bool) {
 	if len(data) < minPackedLen {
 		return nil, false
 	}
@@ -122,11 +152,11 @@ func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bo
 	now := time.Now().Unix()
 	var ttl uint32
 	if expired = expire <= now; expired {
-		if !c.optimistic {
+		if expiredTTL == 0 {
 			return nil, expired
 		}
 
-		ttl = optimisticTTL
+		ttl = expiredTTL
 	} else {
 		ttl = uint32(expire - now)
 	}
@@ -156,11 +186,30 @@ func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bo
 	filterMsg(res, m, req.AuthenticatedData, doBit, ttl)
 
 	return &cacheItem{
-		m: res,
-		u: string(b.Next(b.Len())),
+		m:   res,
+		u:   string(b.Next(b.Len())),
+		ttl: ttl,
 	}, expired
 }
 
+// validateCache returns an error if the cache configuration is invalid.
+func (p *Proxy) validateCache() (err error) {
+	switch {
+	case p.CacheSizeBytes < 0:
+		return fmt.Errorf("negative cache size %d", p.CacheSizeBytes)
+	case p.CacheOptimisticTTL > 0 && !p.CacheOptimistic:
+		return errors.Error("optimistic ttl requires optimistic cache")
+	case p.CacheStaleTTL > 0 && !p.CacheServeStale:
+		return errors.Error("stale ttl requires serving stale responses")
+	case p.CachePrefetchHotSize < 0:
+		return fmt.Errorf("negative prefetch hot size %d", p.CachePrefetchHotSize)
+	case p.CachePrefetchRate < 0:
+		return fmt.Errorf("negative prefetch rate %d", p.CachePrefetchRate)
+	default:
+		return nil
+	}
+}
+
 // initCache initializes cache if it's enabled.
 func (p *Proxy) initCache() {
 	if !p.CacheEnabled {
@@ -172,8 +221,29 @@ func (p *Proxy) initCache() {
 	size := p.CacheSizeBytes
 	log.Info("dnsproxy: cache: enabled, size %d b", size)
 
-	p.cache = newCache(size, p.EnableEDNSClientSubnet, p.CacheOptimistic)
+	p.cache = newCache(size, p.cacheWithECS(), p.CacheOptimistic)
 	p.shortFlighter = newOptimisticResolver(p)
+
+	if p.CachePrefetch {
+		hotSize := cmp.Or(p.CachePrefetchHotSize, defaultPrefetchHotSize)
+		maxRate := cmp.Or(p.CachePrefetchRate, defaultPrefetchRate)
+		p.prefetcher = newPrefetcher(realClock{}, hotSize, maxRate)
+
+		log.Info("dnsproxy: cache: prefetching %d hot entries, max %d per second", hotSize, maxRate)
+	}
+
+	if p.CacheOptimisticTTL > 0 {
+		p.cache.optimisticTTL = p.CacheOptimisticTTL
+	}
+
+	if p.CacheServeStale {
+		p.cache.staleTTL = p.CacheStaleTTL
+		if p.cache.staleTTL == 0 {
+			p.cache.staleTTL = defaultStaleTTL
+		}
+
+		log.Info("dnsproxy: cache: serving stale responses with ttl %d s", p.cache.staleTTL)
+	}
 }
 
 // newCache returns a properly initialized cache.
@@ -183,6 +253,7 @@ func newCache(size int, withECS, optimistic bool) (c *cache) {
 		itemsWithSubnetLock: &sync.RWMutex{},
 		items:               createCache(size),
 		optimistic:          optimistic,
+		optimisticTTL:       optimisticTTL,
 	}
 
 	if withECS {
@@ -209,13 +280,45 @@ func (c *cache) get(req *dns.Msg) (ci *cacheItem, expired bool, key []byte) {
 		return nil, false, key
 	}
 
-	if ci, expired = c.unpackItem(data, req); ci == nil {
+	if ci, expired = c.unpackItem(data, req); ci == nil && !c.keepsStale(expired) {
 		c.items.Del(key)
+		if expired {
+			countCacheEviction(cacheEvictionTTL)
+		}
 	}
 
 	return ci, expired, key
 }
 
+// getStale returns the cached item for req with the TTL set to c.staleTTL if
+// it's expired.  key is the resulting key for req.  It returns nil if c doesn't
+// serve the expired responses.
+func (c *cache) getStale(req *dns.Msg) (ci *cacheItem, key []byte) {
+	c.itemsLock.RLock()
+	defer c.itemsLock.RUnlock()
+
+	if c.staleTTL == 0 || !canLookUpInCache(c.items, req) {
+		return nil, nil
+	}
+
+	key = msgToKey(req)
+	data := c.items.Get(key)
+	if data == nil {
+		return nil, key
+	}
+
+	ci, _ = unpackCacheItem(data, req, c.staleTTL)
+
+	return ci, key
+}
+
+// keepsStale returns true if the item, which is expired or not, should be kept
+// in c after it hasn't been returned by the lookup, so that it could be served
+// when the upstreams fail.
+func (c *cache) keepsStale(expired bool) (ok bool) {
+	return expired && c.staleTTL != 0
+}
+
 // getWithSubnet returns cached item for the req if it's found by n.  expired
 // is true if the item's TTL is expired.  k is the resulting key for req.  It's
 // returned to avoid recalculating it afterwards.
@@ -230,12 +333,52 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 		return nil, false, nil
 	}
 
+	data, k := c.findWithSubnet(req, n)
+	if data == nil {
+		return nil, false, k
+	}
+
+	if ci, expired = c.unpackItem(data, req); ci == nil && !c.keepsStale(expired) {
+		c.itemsWithSubnet.Del(k)
+		if expired {
+			countCacheEviction(cacheEvictionTTL)
+		}
+	}
+
+	return ci, expired, k
+}
+
+// getStaleWithSubnet returns the cached item for req found by n with the TTL
+// set to c.staleTTL if it's expired.  k is the resulting key for req.  It
+// returns nil if c doesn't serve the expired responses.
+func (c *cache) getStaleWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, k []byte) {
+	c.itemsWithSubnetLock.RLock()
+	defer c.itemsWithSubnetLock.RUnlock()
+
+	if c.staleTTL == 0 || !canLookUpInCache(c.itemsWithSubnet, req) {
+		return nil, nil
+	}
+
+	data, k := c.findWithSubnet(req, n)
+	if data == nil {
+		return nil, k
+	}
+
+	ci, _ = unpackCacheItem(data, req, c.staleTTL)
+
+	return ci, k
+}
+
+// findWithSubnet returns the packed cached item for req found by n using the
+// longest-prefix match, or nil if there is none.  k is the resulting key for
+// req.  c.itemsWithSubnetLock is expected to be locked.
+func (c *cache) findWithSubnet(req *dns.Msg, n *net.IPNet) (data, k []byte) {
 	ecsIP := n.IP.Mask(n.Mask)
 	ipLen := len(ecsIP)
 	m, _ := n.Mask.Size()
 
 	k = msgToKeyWithSubnet(req, ecsIP, m)
-	data := c.itemsWithSubnet.Get(k)
+	data = c.itemsWithSubnet.Get(k)
 
 	// In order to reduce allocations we apply mask on bits level.  As the key
 	// k has ecsIP in bytes slice representation, each iteration we can just
@@ -265,15 +408,7 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 		data = c.itemsWithSubnet.Get(k)
 	}
 
-	if data == nil {
-		return nil, false, k
-	}
-
-	if ci, expired = c.unpackItem(data, req); ci == nil {
-		c.itemsWithSubnet.Del(k)
-	}
-
-	return ci, expired, k
+	return data, k
 }
 
 // canLookUpInCache returns true if these parameters could be used to make a
@@ -287,6 +422,9 @@ func createCache(cacheSize int) (glc glcache.Cache) {
 	conf := glcache.Config{
 		MaxSize:   defaultCacheSize,
 		EnableLRU: true,
+		OnDelete: func(_, _ []byte) {
+			countCacheEviction(cacheEvictionSize)
+		},
 	}
 
 	if cacheSize > 0 {
@@ -310,6 +448,7 @@ func (c *cache) set(m *dns.Msg, u upstream.Upstream) {
 	defer c.itemsLock.Unlock()
 
 	c.items.Set(key, packed)
+	countCacheInsertion()
 }
 
 // setWithSubnet tries to add the ci into cache with subnet and ip used to
@@ -328,6 +467,26 @@ func (c *cache) setWithSubnet(m *dns.Msg, u upstream.Upstream, subnet *net.IPNet
 	defer c.itemsWithSubnetLock.Unlock()
 
 	c.itemsWithSubnet.Set(key, packed)
+	countCacheInsertion()
+}
+
+// recordSize records the current number of the entries and the size of c in
+// the statistics and metrics.
+func (c *cache) recordSize() {
+	c.itemsLock.RLock()
+	stats := c.items.Stats()
+	c.itemsLock.RUnlock()
+
+	count, size := stats.Count, stats.Size
+	if c.itemsWithSubnet != nil {
+		c.itemsWithSubnetLock.RLock()
+		stats = c.itemsWithSubnet.Stats()
+		c.itemsWithSubnetLock.RUnlock()
+
+		count, size = count+stats.Count, size+stats.Size
+	}
+
+	setCacheSize(count, size)
 }
 
 // clearItems empties the simple cache.
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPrefetchHotSize is the default number of the most hit cache keys
+	// which are prefetched.
+	defaultPrefetchHotSize = 100
+
+	// defaultPrefetchRate is the default maximum number of the prefetches per
+	// second.
+	defaultPrefetchRate = 10
+
+	// prefetchWindow is the duration of the window the cache hits are counted
+	// within to choose the most hit keys.
+	prefetchWindow = time.Minute
+
+	// prefetchThreshold is the remaining TTL of the cached response of a hot
+	// key in seconds at which the response is prefetched.
+	prefetchThreshold = 5
+
+	// prefetchMaxTracked is the maximum number of the cache keys the hits are
+	// counted for within a window, so that the counters don't grow unbounded.
+	prefetchMaxTracked = 10_000
+)
+
+// prefetcher chooses the cached responses to refresh before they expire, so
+// that the cache doesn't go cold for the popular names.  The hot keys are the
+// ones most hit within the previous window.
+type prefetcher struct {
+	// clock is used to get the current time.
+	clock clock
+
+	// mux protects the fields below.
+	mux sync.Mutex
+
+	// hits are the numbers of the hits of the cache keys within the current
+	// window.
+	hits map[string]uint64
+
+	// hot is the set of the most hit cache keys within the previous window.
+	hot map[string]unit
+
+	// windowStart is the start of the current window.
+	windowStart time.Time
+
+	// second is the current second of the rate limiting and numPrefetched is
+	// the number of the prefetches within it.
+	second        int64
+	numPrefetched int
+
+	// hotSize is the maximum number of the hot keys.
+	hotSize int
+
+	// maxRate is the maximum number of the prefetches per second.
+	maxRate int
+}
+
+// newPrefetcher returns a new properly initialized *prefetcher.  hotSize and
+// maxRate must be positive.
+func newPrefetcher(c clock, hotSize, maxRate int) (pf *prefetcher) {
+	return &prefetcher{
+		clock:       c,
+		hits:        map[string]uint64{},
+		hot:         map[string]unit{},
+		windowStart: c.Now(),
+		hotSize:     hotSize,
+		maxRate:     maxRate,
+	}
+}
+
+// hit counts the hit of the cache key and returns true if the response, which
+// expires in ttl seconds, should be prefetched.
+func (pf *prefetcher) hit(key []byte, ttl uint32) (ok bool) {
+	pf.mux.Lock()
+	defer pf.mux.Unlock()
+
+	now := pf.clock.Now()
+	if now.Sub(pf.windowStart) >= prefetchWindow {
+		pf.rotate(now)
+	}
+
+	k := string(key)
+	if _, tracked := pf.hits[k]; tracked || len(pf.hits) < prefetchMaxTracked {
+		pf.hits[k]++
+	}
+
+	if ttl > prefetchThreshold {
+		return false
+	}
+
+	if _, isHot := pf.hot[k]; !isHot {
+		return false
+	}
+
+	if sec := now.Unix(); sec != pf.second {
+		pf.second, pf.numPrefetched = sec, 0
+	}
+
+	if pf.numPrefetched >= pf.maxRate {
+		SM.Increment("cache::prefetch::limited", 1)
+
+		return false
+	}
+
+	pf.numPrefetched++
+	SM.Increment("cache::prefetch::refreshes", 1)
+
+	return true
+}
+
+// rotate makes the most hit keys of the current window hot and starts a new
+// window at now.  pf.mux is expected to be locked.
+func (pf *prefetcher) rotate(now time.Time) {
+	keys := make([]string, 0, len(pf.hits))
+	for k := range pf.hits {
+		keys = append(keys, k)
+	}
+
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Compare(pf.hits[b], pf.hits[a])
+	})
+
+	pf.hot = make(map[string]unit, min(len(keys), pf.hotSize))
+	for _, k := range keys[:min(len(keys), pf.hotSize)] {
+		pf.hot[k] = unit{}
+	}
+
+	pf.hits = map[string]uint64{}
+	pf.windowStart = now
+}
+
+// prefetchIfNeeded counts the hit of the cached response of d with the cache
+// key, which expires in ttl seconds, and refreshes it in the background if
+// it's hot and about to expire.
+func (p *Proxy) prefetchIfNeeded(d *DNSContext, key []byte, ttl uint32) {
+	if p.prefetcher == nil || key == nil {
+		return
+	}
+
+	if p.prefetcher.hit(key, ttl) {
+		p.refreshInBackground(d, key)
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetcher_hit(t *testing.T) {
+	setTestStats(t)
+
+	now := time.Unix(1_700_000_000, 0)
+	c := &fakeClock{onNow: func() (n time.Time) { return now }}
+
+	pf := newPrefetcher(c, 1, 2)
+
+	hot, cold, other := []byte("hot"), []byte("cold"), []byte("other")
+
+	// Nothing is hot within the first window.
+	for range 3 {
+		assert.False(t, pf.hit(hot, 1))
+	}
+	assert.False(t, pf.hit(cold, 1))
+
+	now = now.Add(prefetchWindow)
+
+	t.Run("not_expiring", func(t *testing.T) {
+		assert.False(t, pf.hit(hot, prefetchThreshold+1))
+	})
+
+	t.Run("cold", func(t *testing.T) {
+		assert.False(t, pf.hit(cold, 1))
+	})
+
+	t.Run("hot", func(t *testing.T) {
+		assert.True(t, pf.hit(hot, prefetchThreshold))
+		assert.True(t, pf.hit(hot, 1))
+	})
+
+	t.Run("rate_limited", func(t *testing.T) {
+		assert.False(t, pf.hit(hot, 1))
+
+		now = now.Add(time.Second)
+		assert.True(t, pf.hit(hot, 1))
+	})
+
+	n, _ := SM.GetUint64("cache::prefetch::refreshes")
+	assert.Equal(t, uint64(3), n)
+
+	n, _ = SM.GetUint64("cache::prefetch::limited")
+	assert.Equal(t, uint64(1), n)
+
+	t.Run("rotated", func(t *testing.T) {
+		for range 10 {
+			pf.hit(other, prefetchThreshold+1)
+		}
+
+		now = now.Add(prefetchWindow)
+		assert.False(t, pf.hit(hot, 1))
+		assert.True(t, pf.hit(other, 1))
+	})
+}
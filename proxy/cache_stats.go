@@ -0,0 +1,131 @@
+package proxy
+
+// Cache hit kinds used as the metric labels and in the statistics keys.
+const (
+	// cacheHitFresh is the hit of the response which hasn't expired.
+	cacheHitFresh = "fresh"
+
+	// cacheHitOptimistic is the hit of the expired response served by the
+	// optimistic cache.
+	cacheHitOptimistic = "optimistic"
+
+	// cacheHitStale is the hit of the expired response served since the
+	// upstreams have failed.
+	cacheHitStale = "stale"
+)
+
+// Cache eviction reasons used as the metric labels and in the statistics keys.
+const (
+	// cacheEvictionSize is the eviction of the least recently used entry on
+	// reaching the cache size limit.
+	cacheEvictionSize = "size"
+
+	// cacheEvictionTTL is the removal of the expired entry on lookup.
+	cacheEvictionTTL = "ttl"
+)
+
+// countCacheHit counts the cache hit of the given kind.
+func countCacheHit(kind string) {
+	metricCacheHits.inc(kind)
+	SM.Increment("cache::hits::"+kind, 1)
+}
+
+// countCacheMiss counts the cache miss.
+func countCacheMiss() {
+	metricCacheMisses.inc()
+	SM.Increment("cache::misses", 1)
+}
+
+// countCacheInsertion counts the response stored in the cache.
+func countCacheInsertion() {
+	metricCacheInsertions.inc()
+	SM.Increment("cache::insertions", 1)
+}
+
+// countCacheEviction counts the cache entry removed for the given reason.
+func countCacheEviction(reason string) {
+	metricCacheEvictions.inc(reason)
+	SM.Increment("cache::evictions::"+reason, 1)
+}
+
+// setCacheSize records the current number of the entries and the size of the
+// cache in bytes.
+func setCacheSize(count, size int) {
+	metricCacheEntries.set(float64(count))
+	metricCacheBytes.set(float64(size))
+
+	SM.Set("cache::cache_count", count)
+	SM.Set("cache::cache_size", size)
+}
+
+// CacheStats are the statistics of the response cache.
+type CacheStats struct {
+	// Entries is the current number of the cached responses.
+	Entries uint64 `json:"entries"`
+
+	// Bytes is the approximate current size of the cache in bytes.
+	Bytes uint64 `json:"bytes"`
+
+	// Insertions is the number of the responses stored in the cache.
+	Insertions uint64 `json:"insertions"`
+
+	// SizeEvictions is the number of the entries evicted on reaching the size
+	// limit.
+	SizeEvictions uint64 `json:"size_evictions"`
+
+	// TTLEvictions is the number of the expired entries removed.
+	TTLEvictions uint64 `json:"ttl_evictions"`
+
+	// FreshHits is the number of the responses served before they expired.
+	FreshHits uint64 `json:"fresh_hits"`
+
+	// OptimisticHits is the number of the expired responses served by the
+	// optimistic cache.
+	OptimisticHits uint64 `json:"optimistic_hits"`
+
+	// StaleHits is the number of the expired responses served since the
+	// upstreams have failed.
+	StaleHits uint64 `json:"stale_hits"`
+
+	// Misses is the number of the lookups which haven't found a response.
+	Misses uint64 `json:"misses"`
+
+	// HitRatio is the share of the lookups served from the cache, either
+	// fresh or optimistic.
+	HitRatio float64 `json:"hit_ratio"`
+
+	// FreshHitRatio is the share of the lookups served from the cache before
+	// the responses expired.
+	FreshHitRatio float64 `json:"fresh_hit_ratio"`
+}
+
+// CacheStats returns the statistics stored under the "cache" keys.
+func (r *StatsManager) CacheStats() (s CacheStats) {
+	get := func(key string) (n uint64) {
+		n, _ = r.GetUint64("cache::" + key)
+
+		return n
+	}
+
+	s = CacheStats{
+		Entries:        get("cache_count"),
+		Bytes:          get("cache_size"),
+		Insertions:     get("insertions"),
+		SizeEvictions:  get("evictions::" + cacheEvictionSize),
+		TTLEvictions:   get("evictions::" + cacheEvictionTTL),
+		FreshHits:      get("hits::" + cacheHitFresh),
+		OptimisticHits: get("hits::" + cacheHitOptimistic),
+		StaleHits:      get("hits::" + cacheHitStale),
+		Misses:         get("misses"),
+	}
+
+	// The stale hits are also counted as misses, since they're only served
+	// after the lookup has failed.
+	lookups := s.FreshHits + s.OptimisticHits + s.Misses
+	if lookups > 0 {
+		s.HitRatio = float64(s.FreshHits+s.OptimisticHits) / float64(lookups)
+		s.FreshHitRatio = float64(s.FreshHits) / float64(lookups)
+	}
+
+	return s
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsManager_CacheStats(t *testing.T) {
+	setTestStats(t)
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(m)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IP{192, 0, 2, 1},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return testUpsAddr },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+	})
+
+	for _, host := range []string{"one.example.", "one.example.", "one.example.", "two.example."} {
+		d := &DNSContext{
+			Req:   (&dns.Msg{}).SetQuestion(host, dns.TypeA),
+			Proto: ProtoUDP,
+			Addr:  netip.MustParseAddrPort("192.0.2.2:53"),
+		}
+
+		require.NoError(t, p.Resolve(d))
+	}
+
+	s := SM.CacheStats()
+	assert.Equal(t, uint64(2), s.Entries)
+	assert.Positive(t, s.Bytes)
+	assert.Equal(t, uint64(2), s.Insertions)
+	assert.Equal(t, uint64(2), s.FreshHits)
+	assert.Equal(t, uint64(2), s.Misses)
+	assert.Zero(t, s.OptimisticHits)
+	assert.Zero(t, s.StaleHits)
+	assert.InDelta(t, 0.5, s.HitRatio, 1e-9)
+	assert.InDelta(t, 0.5, s.FreshHitRatio, 1e-9)
+}
@@ -6,10 +6,12 @@ import (
 	"net/netip"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/stretchr/testify/assert"
@@ -947,3 +949,283 @@ func TestCache_IsCacheable_negative(t *testing.T) {
 		})
 	}
 }
+
+func TestProxy_Resolve_serveStale(t *testing.T) {
+	const staleTTL = 10
+
+	failing := &fakeUpstream{
+		onExchange: func(_ *dns.Msg) (resp *dns.Msg, err error) {
+			return nil, errors.Error("test error")
+		},
+		onAddress: func() (addr string) { return testUpsAddr },
+		onClose:   func() (err error) { return nil },
+	}
+
+	testCases := []struct {
+		name       string
+		serveStale bool
+		wantRcode  int
+	}{{
+		name:       "enabled",
+		serveStale: true,
+		wantRcode:  dns.RcodeSuccess,
+	}, {
+		name:       "disabled",
+		serveStale: false,
+		wantRcode:  dns.RcodeServerFailure,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setTestStats(t)
+
+			conf := &Config{
+				UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{failing}},
+				TrustedProxies:         defaultTrustedProxies,
+				RatelimitSubnetLenIPv4: 24,
+				RatelimitSubnetLenIPv6: 64,
+				CacheEnabled:           true,
+				CacheSizeBytes:         testCacheSize,
+				CacheServeStale:        tc.serveStale,
+			}
+			if tc.serveStale {
+				conf.CacheStaleTTL = staleTTL
+			}
+
+			p := mustNew(t, conf)
+
+			req := (&dns.Msg{}).SetQuestion("stale.example.", dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+
+			// Add the expired response into the cache.
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "stale.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IP{192, 0, 2, 1},
+			})
+			p.cache.items.Set(msgToKey(req), (&cacheItem{m: resp, u: testUpsAddr}).pack())
+
+			d := &DNSContext{
+				Req:   req,
+				Proto: ProtoUDP,
+				Addr:  netip.MustParseAddrPort("192.0.2.2:53"),
+			}
+
+			err := p.Resolve(d)
+			if tc.serveStale {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+			assert.Equal(t, tc.serveStale, d.fromStale)
+
+			n, _ := SM.GetUint64("cache::hits::stale")
+			if !tc.serveStale {
+				assert.Zero(t, n)
+
+				return
+			}
+
+			assert.Equal(t, uint64(1), n)
+
+			require.Len(t, d.Res.Answer, 1)
+			assert.EqualValues(t, staleTTL, d.Res.Answer[0].Header().Ttl)
+
+			opt := d.Res.IsEdns0()
+			require.NotNil(t, opt)
+			require.Len(t, opt.Option, 1)
+
+			ede := testutil.RequireTypeAssert[*dns.EDNS0_EDE](t, opt.Option[0])
+			assert.Equal(t, dns.ExtendedErrorCodeStaleAnswer, ede.InfoCode)
+		})
+	}
+}
+
+func TestProxy_validateCache(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		conf       Config
+	}{{
+		name:       "default",
+		wantErrMsg: "",
+		conf:       Config{},
+	}, {
+		name:       "valid",
+		wantErrMsg: "",
+		conf: Config{
+			CacheSizeBytes:     testCacheSize,
+			CacheOptimistic:    true,
+			CacheOptimisticTTL: 60,
+			CacheServeStale:    true,
+			CacheStaleTTL:      10,
+		},
+	}, {
+		name:       "negative_size",
+		wantErrMsg: "negative cache size -1",
+		conf:       Config{CacheSizeBytes: -1},
+	}, {
+		name:       "optimistic_ttl",
+		wantErrMsg: "optimistic ttl requires optimistic cache",
+		conf:       Config{CacheOptimisticTTL: 60},
+	}, {
+		name:       "stale_ttl",
+		wantErrMsg: "stale ttl requires serving stale responses",
+		conf:       Config{CacheStaleTTL: 10},
+	}, {
+		name:       "prefetch_hot_size",
+		wantErrMsg: "negative prefetch hot size -1",
+		conf:       Config{CachePrefetch: true, CachePrefetchHotSize: -1},
+	}, {
+		name:       "prefetch_rate",
+		wantErrMsg: "negative prefetch rate -1",
+		conf:       Config{CachePrefetch: true, CachePrefetchRate: -1},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: tc.conf}
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, p.validateCache())
+		})
+	}
+}
+
+func TestProxy_Resolve_optimisticTTL(t *testing.T) {
+	const ttl = 600
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return testUpsAddr },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+		CacheOptimistic:        true,
+		CacheOptimisticTTL:     ttl,
+	})
+
+	req := (&dns.Msg{}).SetQuestion("optimistic.example.", dns.TypeA)
+
+	// Add the expired response into the cache.
+	resp := (&dns.Msg{}).SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "optimistic.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{192, 0, 2, 1},
+	})
+	p.cache.items.Set(msgToKey(req), (&cacheItem{m: resp, u: testUpsAddr}).pack())
+
+	d := &DNSContext{
+		Req:   req,
+		Proto: ProtoUDP,
+		Addr:  netip.MustParseAddrPort("192.0.2.2:53"),
+	}
+
+	require.NoError(t, p.Resolve(d))
+	require.NotNil(t, d.Res)
+	require.Len(t, d.Res.Answer, 1)
+
+	assert.True(t, d.fromCache)
+	assert.EqualValues(t, ttl, d.Res.Answer[0].Header().Ttl)
+}
+
+func TestProxy_Resolve_cacheExcludedClients(t *testing.T) {
+	var numExchanges atomic.Uint32
+	newUps := func() (u upstream.Upstream) {
+		return &fakeUpstream{
+			onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+				numExchanges.Add(1)
+
+				resp = (&dns.Msg{}).SetReply(m)
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IP{192, 0, 2, 1},
+				})
+
+				return resp, nil
+			},
+			onAddress: func() (addr string) { return testUpsAddr },
+			onClose:   func() (err error) { return nil },
+		}
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{newUps()}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+		CacheExcludedClients: netutil.SliceSubnetSet{
+			netip.MustParsePrefix("192.0.2.0/24"),
+		},
+	})
+
+	customConf := NewCustomUpstreamConfig(
+		&UpstreamConfig{Upstreams: []upstream.Upstream{newUps()}},
+		true,
+		testCacheSize,
+		false,
+	)
+
+	testCases := []struct {
+		custom *CustomUpstreamConfig
+		name   string
+		addr   netip.AddrPort
+		want   uint32
+	}{{
+		custom: nil,
+		name:   "excluded",
+		addr:   netip.MustParseAddrPort("192.0.2.2:53"),
+		want:   2,
+	}, {
+		custom: nil,
+		name:   "excluded_mapped",
+		addr:   netip.MustParseAddrPort("[::ffff:192.0.2.2]:53"),
+		want:   2,
+	}, {
+		custom: customConf,
+		name:   "excluded_custom_cache",
+		addr:   netip.MustParseAddrPort("192.0.2.2:53"),
+		want:   2,
+	}, {
+		custom: nil,
+		name:   "not_excluded",
+		addr:   netip.MustParseAddrPort("198.51.100.2:53"),
+		want:   1,
+	}, {
+		custom: customConf,
+		name:   "not_excluded_custom_cache",
+		addr:   netip.MustParseAddrPort("198.51.100.2:53"),
+		want:   1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			numExchanges.Store(0)
+
+			for range 2 {
+				d := &DNSContext{
+					Req:                  (&dns.Msg{}).SetQuestion(tc.name+".example.", dns.TypeA),
+					Proto:                ProtoUDP,
+					Addr:                 tc.addr,
+					CustomUpstreamConfig: tc.custom,
+				}
+
+				require.NoError(t, p.Resolve(d))
+			}
+
+			assert.Equal(t, tc.want, numExchanges.Load())
+		})
+	}
+}
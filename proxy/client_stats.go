@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Client statistics counter names.
+const (
+	clientStatQueries   = "queries"
+	clientStatBlocked   = "blocked"
+	clientStatCacheHits = "cache_hits"
+)
+
+// validateClientStats returns an error if the per-client statistics
+// configuration is invalid.
+func (p *Proxy) validateClientStats() (err error) {
+	if p.ClientStatsLimit < 0 {
+		return fmt.Errorf("negative client stats limit %d", p.ClientStatsLimit)
+	}
+
+	return nil
+}
+
+// countClient increments the per-client statistics counter with the given
+// name for the client at addr.  The client is identified by clientID instead
+// of the address if it's not empty, see [DNSContext.ClientID].
+func (p *Proxy) countClient(addr netip.Addr, clientID, stat string) {
+	if p.clientStats == nil {
+		return
+	}
+
+	var key string
+	switch {
+	case clientID != "":
+		// Client identifiers are hostname labels, so they never contain the
+		// separator.
+		key = clientID
+	case addr.IsValid():
+		key = p.anonymizeAddr(addr)
+	default:
+		return
+	}
+
+	if evicted := p.clientStats.touch(key); evicted != "" {
+		SM.Delete("clients::" + evicted)
+	}
+
+	SM.Increment("clients::"+key+"::"+stat, 1)
+}
+
+// newClientStatsTracker returns a new tracker of at most limit clients in the
+// per-client statistics.
+func newClientStatsTracker(limit int) (l *statsLRU) {
+	return newStatsLRU(limit, func() (keys []string) {
+		for _, c := range SM.ClientStats() {
+			keys = append(keys, c.Client)
+		}
+
+		return keys
+	})
+}
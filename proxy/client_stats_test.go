@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setTestStats replaces the contents of SM with empty stats for the duration
+// of the test.
+func setTestStats(t *testing.T) {
+	t.Helper()
+
+	prev := SM.GetStats()
+	empty := map[string]any{}
+	SM.SetStats(&empty)
+	t.Cleanup(func() { SM.SetStats(&prev) })
+}
+
+func TestProxy_countClient(t *testing.T) {
+	setTestStats(t)
+
+	p := &Proxy{clientStats: newClientStatsTracker(2)}
+
+	first := netip.MustParseAddr("192.0.2.1")
+	second := netip.MustParseAddr("192.0.2.2")
+	third := netip.MustParseAddr("192.0.2.3")
+
+	p.countClient(first, "", clientStatQueries)
+	p.countClient(first, "", clientStatQueries)
+	p.countClient(first, "", clientStatBlocked)
+	p.countClient(second, "", clientStatQueries)
+	p.countClient(second, "", clientStatCacheHits)
+
+	// Make the second client the least recently active one.
+	p.countClient(first, "", clientStatQueries)
+	p.countClient(third, "", clientStatQueries)
+
+	p.countClient(netip.Addr{}, "", clientStatQueries)
+
+	clients := SM.ClientStats()
+	require.Len(t, clients, 2)
+
+	assert.Equal(t, ClientStats{Client: "192.0.2.1", Queries: 3, Blocked: 1}, clients[0])
+	assert.Equal(t, ClientStats{Client: "192.0.2.3", Queries: 1}, clients[1])
+	assert.False(t, SM.Exists("clients::192.0.2.2"))
+}
+
+func TestProxy_countClient_clientID(t *testing.T) {
+	setTestStats(t)
+
+	p := &Proxy{clientStats: newClientStatsTracker(0)}
+
+	addr := netip.MustParseAddr("192.0.2.1")
+	p.countClient(addr, "phone", clientStatQueries)
+	p.countClient(addr, "phone", clientStatBlocked)
+	p.countClient(addr, "", clientStatQueries)
+
+	assert.ElementsMatch(t, []ClientStats{
+		{Client: "phone", Queries: 1, Blocked: 1},
+		{Client: "192.0.2.1", Queries: 1},
+	}, SM.ClientStats())
+}
+
+func TestClientStatsTracker_seed(t *testing.T) {
+	setTestStats(t)
+
+	SM.Set("clients::192.0.2.1::queries", float64(10))
+	SM.Set("clients::192.0.2.2::queries", float64(5))
+
+	tr := newClientStatsTracker(2)
+
+	assert.Equal(t, "192.0.2.2", tr.touch("192.0.2.3"))
+	assert.Equal(t, "192.0.2.1", tr.touch("192.0.2.4"))
+	assert.Empty(t, tr.touch("192.0.2.3"))
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// ValidateClientID returns an error if id isn't a valid client identifier, see
+// [DNSContext.ClientID].  A valid identifier is a hostname label.
+func ValidateClientID(id string) (err error) {
+	err = netutil.ValidateHostnameLabel(id)
+	if err != nil {
+		return fmt.Errorf("invalid client id %q: %w", id, err)
+	}
+
+	return nil
+}
+
+// clientIDFromServerName returns the client identifier from the TLS server
+// name of the DoT or DoQ connection, which is expected to be the first label of
+// the subdomain of base, e.g. "phone" in "phone.dns.example".  id is empty if
+// srvName isn't a subdomain of base or base is empty.
+func clientIDFromServerName(srvName, base string) (id string, err error) {
+	if base == "" || srvName == "" {
+		return "", nil
+	}
+
+	srvName = strings.ToLower(strings.TrimSuffix(srvName, "."))
+	base = strings.ToLower(strings.TrimSuffix(base, "."))
+
+	id, ok := strings.CutSuffix(srvName, "."+base)
+	if !ok {
+		return "", nil
+	}
+
+	if strings.Contains(id, ".") {
+		return "", fmt.Errorf("client id %q is not a single label", id)
+	}
+
+	err = ValidateClientID(id)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return "", err
+	}
+
+	return id, nil
+}
+
+// clientIDFromDoHPath returns the client identifier from the URL path of the
+// DoH request, which is expected to be the next segment after one of paths,
+// e.g. "phone" in "/dns-query/phone".  ok is false if urlPath is none of paths
+// nor their subpaths.
+func clientIDFromDoHPath(urlPath string, paths []string) (id string, ok bool, err error) {
+	for _, p := range paths {
+		if urlPath == p {
+			return "", true, nil
+		}
+
+		id, ok = strings.CutPrefix(urlPath, strings.TrimSuffix(p, "/")+"/")
+		if !ok {
+			continue
+		}
+
+		id = strings.TrimSuffix(id, "/")
+		switch {
+		case id == "":
+			return "", true, nil
+		case strings.Contains(id, "/"):
+			return "", true, fmt.Errorf("client id %q contains slashes", id)
+		}
+
+		err = ValidateClientID(id)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return "", true, err
+		}
+
+		return id, true, nil
+	}
+
+	return "", false, nil
+}
+
+// clientIDFromCert returns the client identifier from the subject common name
+// of the verified client certificate of the TLS connection with state, see
+// [Config.ClientIDFromCert].  id is empty if there is no such certificate.
+func (p *Proxy) clientIDFromCert(state *tls.ConnectionState) (id string, err error) {
+	if !p.ClientIDFromCert || state == nil || len(state.VerifiedChains) == 0 {
+		return "", nil
+	}
+
+	id = strings.ToLower(state.VerifiedChains[0][0].Subject.CommonName)
+	err = ValidateClientID(id)
+	if err != nil {
+		return "", fmt.Errorf("client certificate: %w", err)
+	}
+
+	return id, nil
+}
+
+// connClientID returns the client identifier of the DoT or DoQ connection with
+// state.  The identifier from the client certificate takes precedence over the
+// one from the server name.
+func (p *Proxy) connClientID(state *tls.ConnectionState) (id string, err error) {
+	id, err = p.clientIDFromCert(state)
+	if id != "" || err != nil {
+		return id, err
+	}
+
+	return clientIDFromServerName(state.ServerName, p.ClientIDServerName)
+}
+
+// tlsClientID returns the client identifier of the TLS connection conn.  conn
+// must have completed the handshake.  id is empty if conn isn't a TLS one.
+func (p *Proxy) tlsClientID(conn net.Conn) (id string, err error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+
+	state := tlsConn.ConnectionState()
+
+	return p.connClientID(&state)
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIDFromServerName(t *testing.T) {
+	const base = "dns.example"
+
+	testCases := []struct {
+		name       string
+		srvName    string
+		base       string
+		wantID     string
+		wantErrMsg string
+	}{{
+		name:       "client_id",
+		srvName:    "phone.dns.example",
+		base:       base,
+		wantID:     "phone",
+		wantErrMsg: "",
+	}, {
+		name:       "case_and_fqdn",
+		srvName:    "Phone.DNS.example.",
+		base:       base,
+		wantID:     "phone",
+		wantErrMsg: "",
+	}, {
+		name:       "base",
+		srvName:    "dns.example",
+		base:       base,
+		wantID:     "",
+		wantErrMsg: "",
+	}, {
+		name:       "other_domain",
+		srvName:    "phone.other.example",
+		base:       base,
+		wantID:     "",
+		wantErrMsg: "",
+	}, {
+		name:       "no_base",
+		srvName:    "phone.dns.example",
+		base:       "",
+		wantID:     "",
+		wantErrMsg: "",
+	}, {
+		name:       "no_server_name",
+		srvName:    "",
+		base:       base,
+		wantID:     "",
+		wantErrMsg: "",
+	}, {
+		name:       "multiple_labels",
+		srvName:    "my.phone.dns.example",
+		base:       base,
+		wantID:     "",
+		wantErrMsg: `client id "my.phone" is not a single label`,
+	}, {
+		name:    "bad_label",
+		srvName: "-phone.dns.example",
+		base:    base,
+		wantID:  "",
+		wantErrMsg: `invalid client id "-phone": bad hostname label "-phone": ` +
+			`bad hostname label rune '-'`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			id, err := clientIDFromServerName(tc.srvName, tc.base)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.wantID, id)
+		})
+	}
+}
+
+func TestClientIDFromDoHPath(t *testing.T) {
+	paths := []string{"/dns-query", "/hidden/"}
+
+	testCases := []struct {
+		name       string
+		path       string
+		wantID     string
+		wantErrMsg string
+		wantOK     bool
+	}{{
+		name:       "no_client_id",
+		path:       "/dns-query",
+		wantID:     "",
+		wantErrMsg: "",
+		wantOK:     true,
+	}, {
+		name:       "client_id",
+		path:       "/dns-query/phone",
+		wantID:     "phone",
+		wantErrMsg: "",
+		wantOK:     true,
+	}, {
+		name:       "trailing_slash",
+		path:       "/dns-query/phone/",
+		wantID:     "phone",
+		wantErrMsg: "",
+		wantOK:     true,
+	}, {
+		name:       "empty_client_id",
+		path:       "/dns-query/",
+		wantID:     "",
+		wantErrMsg: "",
+		wantOK:     true,
+	}, {
+		name:       "path_with_slash",
+		path:       "/hidden/phone",
+		wantID:     "phone",
+		wantErrMsg: "",
+		wantOK:     true,
+	}, {
+		name:       "unknown",
+		path:       "/other/phone",
+		wantID:     "",
+		wantErrMsg: "",
+		wantOK:     false,
+	}, {
+		name:       "prefix_only",
+		path:       "/dns-queryphone",
+		wantID:     "",
+		wantErrMsg: "",
+		wantOK:     false,
+	}, {
+		name:       "nested",
+		path:       "/dns-query/phone/other",
+		wantID:     "",
+		wantErrMsg: `client id "phone/other" contains slashes`,
+		wantOK:     true,
+	}, {
+		name:   "bad_label",
+		path:   "/dns-query/bad_id",
+		wantID: "",
+		wantErrMsg: `invalid client id "bad_id": bad hostname label "bad_id": ` +
+			`bad hostname label rune '_'`,
+		wantOK: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			id, ok, err := clientIDFromDoHPath(tc.path, paths)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.wantID, id)
+		})
+	}
+}
+
+func TestProxy_connClientID(t *testing.T) {
+	newState := func(srvName, cn string) (state *tls.ConnectionState) {
+		state = &tls.ConnectionState{ServerName: srvName}
+		if cn != "" {
+			state.VerifiedChains = [][]*x509.Certificate{{{
+				Subject: pkix.Name{CommonName: cn},
+			}}}
+		}
+
+		return state
+	}
+
+	testCases := []struct {
+		state      *tls.ConnectionState
+		name       string
+		wantID     string
+		wantErrMsg string
+		fromCert   bool
+	}{{
+		state:      newState("phone.dns.example", "Laptop"),
+		name:       "cert",
+		wantID:     "laptop",
+		wantErrMsg: "",
+		fromCert:   true,
+	}, {
+		state:      newState("phone.dns.example", "Laptop"),
+		name:       "cert_disabled",
+		wantID:     "phone",
+		wantErrMsg: "",
+		fromCert:   false,
+	}, {
+		state:      newState("phone.dns.example", ""),
+		name:       "no_cert",
+		wantID:     "phone",
+		wantErrMsg: "",
+		fromCert:   true,
+	}, {
+		state:  newState("phone.dns.example", "my laptop"),
+		name:   "bad_cn",
+		wantID: "",
+		wantErrMsg: `client certificate: invalid client id "my laptop": ` +
+			`bad hostname label "my laptop": bad hostname label rune ' '`,
+		fromCert: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: Config{
+				ClientIDServerName: "dns.example",
+				ClientIDFromCert:   tc.fromCert,
+			}}
+
+			id, err := p.connClientID(tc.state)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.wantID, id)
+		})
+	}
+}
@@ -3,12 +3,12 @@ package proxy
 import (
 	"crypto/tls"
 	"fmt"
+	"io/fs"
 	"net"
 	"net/netip"
 	"net/url"
 	"time"
 
-	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
@@ -25,6 +25,8 @@ const (
 	UModeParallel
 	// UModeFastestAddr - use Fastest Address algorithm
 	UModeFastestAddr
+	// UModeRandom - queries to a single upstream server chosen at random
+	UModeRandom
 )
 
 // RequestHandler is an optional custom handler for DNS requests.  It's used
@@ -51,6 +53,9 @@ type ResponseHandler func(dctx *DNSContext, err error)
 type Config struct {
 	// TrustedProxies is the trusted list of CIDR networks to detect proxy
 	// servers addresses from where the DoH requests should be handled.  The
+	// client address is only taken from the X-Forwarded-For and similar
+	// headers of the requests coming from these networks, and the
+	// X-Forwarded-For chain is only followed through these networks.  The
 	// value of nil makes Proxy not trust any address.
 	TrustedProxies netutil.SubnetSet
 
@@ -89,6 +94,54 @@ type Config struct {
 	// general set fails responding.
 	Fallbacks *UpstreamConfig
 
+	// FallbackTriggers are the results of the exchange with the primary
+	// upstreams which make the proxy use Fallbacks.  If empty, only
+	// [FallbackTriggerError] is used.
+	FallbackTriggers []FallbackTrigger
+
+	// ForwardingZones are the conditional forwarding zones, which take priority
+	// over UpstreamConfig.  It may be nil.  See [Proxy.SetForwardingZones].
+	ForwardingZones *ForwardingZones
+
+	// LocalZones are the zones answered authoritatively after the hosts files
+	// and before the rewrites, the blocking, the cache, and the upstreams.  It
+	// may be nil.  See [Proxy.ReloadLocalZones].
+	LocalZones *LocalZones
+
+	// Rewrites are the static rewrite rules applied after the hosts files and
+	// before the blocking and the upstreams.  It may be nil.
+	Rewrites *Rewrites
+
+	// RebindingProtection is the handling of the upstream responses containing
+	// the private or special-purpose addresses, including PrivateSubnets, for
+	// the public domain names.  The protection is disabled by default.
+	RebindingProtection RebindingProtection
+
+	// RebindingAllowlist are the domains, along with their subdomains, which
+	// are allowed to resolve to the private addresses.
+	RebindingAllowlist []string
+
+	// FilterAAAADomains are the domains the AAAA records are filtered for: the
+	// AAAA requests for them are answered with NODATA, and the AAAA records for
+	// them are removed from the upstream responses.  An entry starting with
+	// "*." matches both the domain itself and all its subdomains.
+	FilterAAAADomains []string
+
+	// HostsFiles are the paths to the hosts files the A, AAAA, and PTR requests
+	// are answered from before the blocking and the upstreams.  The missing
+	// files are considered empty.
+	HostsFiles []string
+
+	// HostsReloadInterval is the interval between the checks of HostsFiles and
+	// DHCPLeasesFile for changes.  Zero means the default of one minute.
+	HostsReloadInterval time.Duration
+
+	// DHCPLeasesFile is the path to the DHCP leases file in the dnsmasq format
+	// the A, AAAA, and PTR requests for the leased hostnames and addresses are
+	// answered from right after the hosts files.  The missing file is
+	// considered empty.
+	DHCPLeasesFile string
+
 	// Userinfo is the sole permitted userinfo for the DoH basic authentication.
 	// If Userinfo is set, all DoH queries are required to have this basic
 	// authentication information.
@@ -98,6 +151,24 @@ type Config struct {
 	// DNS-over-HTTP, and DNS-over-QUIC servers.
 	TLSConfig *tls.Config
 
+	// TLSCertPath and TLSKeyPath are the paths to the PEM-encoded certificate
+	// chain and private key of the encrypted listeners.  If set, the
+	// certificate is served from these files instead of
+	// TLSConfig.Certificates and is replaced without restarting the listeners
+	// once the files change.  See [Proxy.ReloadTLSCertificate].
+	TLSCertPath string
+	TLSKeyPath  string
+
+	// TLSExtraCerts are the additional certificates of the encrypted
+	// listeners, each served to the clients requesting one of its names via
+	// SNI.  The certificate from TLSCertPath and TLSKeyPath is served to the
+	// other clients.  These are reloaded along with it.
+	TLSExtraCerts []TLSCertFiles
+
+	// TLSCertReloadInterval is the interval between the checks of TLSCertPath
+	// and TLSKeyPath for changes.  Zero means the default of one minute.
+	TLSCertReloadInterval time.Duration
+
 	// DNSCryptResolverCert is the DNSCrypt resolver certificate.  Required for
 	// DNSCrypt server.
 	DNSCryptResolverCert *dnscrypt.Cert
@@ -110,6 +181,29 @@ type Config struct {
 	// not empty.
 	HTTPSServerName string
 
+	// ClientIDServerName is the server name of the DoT and DoQ servers.  The
+	// first label of its subdomains the clients connect to is used as the
+	// client identifier, e.g. "phone" in "phone.dns.example" for
+	// "dns.example".  Client identifiers aren't parsed from the server names
+	// if it's empty.  See [DNSContext.ClientID].
+	ClientIDServerName string
+
+	// ClientIDFromCert makes the subject common name of the verified client
+	// certificate the client identifier of the DoT, DoH, and DoQ requests.  It
+	// takes precedence over the identifiers from the server name and the DoH
+	// path.  The client certificates are requested according to
+	// TLSConfig.ClientAuth.
+	ClientIDFromCert bool
+
+	// HTTPSPaths are the URL paths the DoH requests are served on by both the
+	// HTTP/2 and HTTP/3 servers.  The requests for the other paths are
+	// answered with 404.  If empty, only "/dns-query" is served.
+	HTTPSPaths []string
+
+	// HTTPSJSON enables the JSON DoH API, like the one provided by Google and
+	// Cloudflare, on the "/resolve" path of the HTTPS servers.
+	HTTPSJSON bool
+
 	// UDPListenAddr is the set of UDP addresses to listen for plain
 	// DNS-over-UDP requests.
 	UDPListenAddr []*net.UDPAddr
@@ -138,6 +232,39 @@ type Config struct {
 	// requests.
 	DNSCryptTCPListenAddr []*net.TCPAddr
 
+	// UnixListenPaths are the paths of the Unix domain sockets to listen for
+	// plain DNS-over-TCP requests on.  The stale socket files left by the
+	// previous runs are removed.  The sockets are removed on shutdown.
+	UnixListenPaths []string
+
+	// UnixSocketMode is the permissions of the Unix domain sockets.  Zero
+	// means 0o660.
+	UnixSocketMode fs.FileMode
+
+	// TCPMaxConns is the maximum number of the concurrent plain TCP, TLS, and
+	// Unix domain socket connections.  The connections over the limit are
+	// closed right after accepting.  Zero means no limit.
+	TCPMaxConns int
+
+	// TCPMaxConnsPerIP is the maximum number of the concurrent plain TCP and
+	// TLS connections from a single client IP address.  Zero means no limit.
+	TCPMaxConnsPerIP int
+
+	// TCPIdleTimeout is the time a TCP, TLS, or Unix domain socket connection
+	// is kept open while waiting for the next request.  Zero means the default
+	// of ten seconds.
+	TCPIdleTimeout time.Duration
+
+	// TCPMaxQueriesPerConn is the maximum number of requests served over a
+	// single TCP, TLS, or Unix domain socket connection, after which it's
+	// closed.  Zero means no limit.
+	TCPMaxQueriesPerConn int
+
+	// ShutdownGracePeriod is the maximum time [Proxy.Shutdown] waits for the
+	// requests in flight to be handled before closing the listeners.  Zero
+	// means the default of five seconds.
+	ShutdownGracePeriod time.Duration
+
 	// BogusNXDomain is the set of networks used to transform responses into
 	// NXDOMAIN ones if they contain at least a single IP address within these
 	// networks.  It's similar to dnsmasq's "bogus-nxdomain".
@@ -149,11 +276,78 @@ type Config struct {
 	DNS64Prefs []netip.Prefix
 
 	// RatelimitWhitelist is a list of IP addresses excluded from rate limiting.
+	// It, along with the other ratelimit settings, may be changed at runtime
+	// with [Proxy.SetRatelimit].
 	RatelimitWhitelist []netip.Addr
 
 	// EDNSAddr is the ECS IP used in request.
 	EDNSAddr net.IP
 
+	// BlockingMode defines the response sent for blocked domains.
+	BlockingMode BlockingMode
+
+	// BlockingIPv4 is the address to respond with to A requests for blocked
+	// domains when BlockingMode is [BlockingModeCustomIP].
+	BlockingIPv4 netip.Addr
+
+	// BlockingIPv6 is the address to respond with to AAAA requests for blocked
+	// domains when BlockingMode is [BlockingModeCustomIP].
+	BlockingIPv6 netip.Addr
+
+	// BlockingPolicies are the per-client sets of blocked domains lists.
+	// Clients not matching any of the policies are checked against all the
+	// lists.
+	BlockingPolicies []BlockingPolicy
+
+	// BlockingDryRun makes the proxy only count and log the queries for blocked
+	// domains, resolving them normally.
+	BlockingDryRun bool
+
+	// BlockedAnswerSubnets are the networks the addresses in the A and AAAA
+	// records of the responses are blocked within, regardless of the queried
+	// domain.  The matching records are removed from the responses, and the
+	// responses with no other addresses are replaced with the blocked ones.
+	BlockedAnswerSubnets []netip.Prefix
+
+	// BlockedAnswersStrict makes the responses with any of the addresses
+	// within BlockedAnswerSubnets replaced with the blocked ones.
+	BlockedAnswersStrict bool
+
+	// BlockedQueryTypes are the types of queries for blocked domains which
+	// are blocked.  If empty, queries of all types are blocked.
+	BlockedQueryTypes []uint16
+
+	// ClientStatsLimit is the maximum number of the clients tracked in the
+	// per-client statistics, the least recently active ones are evicted.  Zero
+	// means no limit.
+	ClientStatsLimit int
+
+	// ClientAnonymization defines how the client addresses are recorded in
+	// the logs and statistics.
+	ClientAnonymization ClientAnonymization
+
+	// BlockedDomainsStatsLimit is the maximum number of the blocked domains
+	// tracked in the per-domain statistics, the counters of the least recently
+	// blocked ones are added up into the "(other)" counter of their list.  The
+	// same limit applies to the per-domain statistics of the allowed
+	// responses.  Zero means no limit.
+	BlockedDomainsStatsLimit int
+
+	// QueryLogFormat defines how the queries and responses are logged.
+	QueryLogFormat QueryLogFormat
+
+	// QueryLogFilter defines which queries and responses are logged.
+	QueryLogFilter QueryLogFilter
+
+	// QueryLogFile is the path to the file the structured query log is
+	// written to.  It's required for QueryLogFormatJSON.
+	QueryLogFile string
+
+	// SlowQueryThreshold is the duration of the exchange with the upstream
+	// after which the query is logged as slow.  Zero disables the slow query
+	// log.
+	SlowQueryThreshold time.Duration
+
 	// TODO(s.chzhen):  Extract ratelimit settings to a separate structure.
 
 	// RatelimitSubnetLenIPv4 is a subnet length for IPv4 addresses used for
@@ -168,6 +362,18 @@ type Config struct {
 	// to disable).
 	Ratelimit int
 
+	// RatelimitSlip makes every RatelimitSlip-th ratelimited UDP request of a
+	// subnet answered with an empty truncated response instead of being
+	// dropped, so that the legitimate clients retry over TCP.  Zero means all
+	// the ratelimited requests are dropped.
+	RatelimitSlip uint
+
+	// RatelimitCookie is a maximum number of UDP requests per second from a
+	// given subnet presenting valid DNS cookies, see DNSCookies.  Those
+	// requests are counted separately from the other ones, so the spoofed
+	// requests don't affect the legitimate clients.  Zero means Ratelimit.
+	RatelimitCookie int
+
 	// CacheSizeBytes is the maximum cache size in bytes.
 	CacheSizeBytes int
 
@@ -196,9 +402,63 @@ type Config struct {
 	// value will be replaced with the default one.
 	FastestPingTimeout time.Duration
 
-	// RefuseAny makes proxy refuse the requests of type ANY.
+	// UpstreamHealthCheckInterval is the interval between the probes of the
+	// upstreams.  Zero disables the health checking.
+	UpstreamHealthCheckInterval time.Duration
+
+	// UpstreamHealthCheckFailures is the number of the consecutive failed
+	// probes after which an upstream is skipped.  Zero means the default of 3.
+	UpstreamHealthCheckFailures int
+
+	// UpstreamHealthCheckSuccesses is the number of the consecutive successful
+	// probes after which a skipped upstream is used again.  Zero means the
+	// default of 2.
+	UpstreamHealthCheckSuccesses int
+
+	// UpstreamRetries is the number of times the failed exchange with the
+	// upstreams is retried, preferring the upstreams which haven't failed yet.
+	// Zero disables the retries.
+	UpstreamRetries int
+
+	// UpstreamTryTimeout is the timeout of a single try of the exchange with
+	// the upstreams.  Zero means that only the timeouts of the upstreams
+	// themselves are used.
+	UpstreamTryTimeout time.Duration
+
+	// UpstreamRetryBackoff is the delay before the first retry, which is
+	// doubled for each next one.  Zero means the default of 50ms.
+	UpstreamRetryBackoff time.Duration
+
+	// UpstreamQueryDeadline is the overall time for the exchange with the
+	// upstreams, including the retries.  No retry is made after it.  Zero
+	// means no deadline.
+	UpstreamQueryDeadline time.Duration
+
+	// MDNSEnabled makes proxy resolve the names within the "local." domain
+	// using the multicast DNS queries instead of the upstreams, see RFC 6762.
+	// Those are answered with NXDOMAIN if there is no response.
+	MDNSEnabled bool
+
+	// MDNSSingleLabel makes proxy also resolve the single-label names as the
+	// ones within the "local." domain, see [Config.MDNSEnabled].
+	MDNSSingleLabel bool
+
+	// MDNSTimeout is the time to wait for the multicast DNS responses.  Zero
+	// means the default of 500ms.
+	MDNSTimeout time.Duration
+
+	// RefuseAny makes proxy refuse the requests of type ANY with
+	// NOTIMPLEMENTED.  It takes precedence over AnyHINFO.
 	RefuseAny bool
 
+	// AnyHINFO makes proxy answer the requests of type ANY with the synthetic
+	// HINFO record as RFC 8482 describes.
+	AnyHINFO bool
+
+	// AnyHINFOTTL is the TTL of the synthetic HINFO record, in seconds.  Zero
+	// means the default of 3789 seconds, see [Config.AnyHINFO].
+	AnyHINFOTTL uint32
+
 	// HTTP3 enables HTTP/3 support for HTTPS server.
 	HTTP3 bool
 
@@ -224,12 +484,83 @@ type Config struct {
 	// never be used for clients with public IP addresses.
 	EnableEDNSClientSubnet bool
 
+	// ECSPrefixLenIPv4 is the source prefix length of the IPv4 client subnet
+	// added to the requests when EnableEDNSClientSubnet is true.  It must be
+	// in range [0, 32], zero hides the client's address completely.
+	ECSPrefixLenIPv4 int
+
+	// ECSPrefixLenIPv6 is the source prefix length of the IPv6 client subnet
+	// added to the requests when EnableEDNSClientSubnet is true.  It must be
+	// in range [0, 128], zero hides the client's address completely.
+	ECSPrefixLenIPv6 int
+
+	// ECSMode defines how the EDNS Client Subnet option supplied by the client
+	// is sent to the upstreams.  The cached responses are keyed by the subnet
+	// actually sent, so that they aren't shared between the clients.
+	ECSMode ECSMode
+
+	// ECSClampPrefixLenIPv4 is the longest source prefix length of the IPv4
+	// client subnet sent to the upstreams in [ECSModeClamp].  It must be in
+	// range [0, 32].
+	ECSClampPrefixLenIPv4 int
+
+	// ECSClampPrefixLenIPv6 is the longest source prefix length of the IPv6
+	// client subnet sent to the upstreams in [ECSModeClamp].  It must be in
+	// range [0, 128].
+	ECSClampPrefixLenIPv6 int
+
+	// EDNSPadding makes proxy pad the responses sent over DNS-over-TLS,
+	// DNS-over-HTTPS, and DNS-over-QUIC to the requests having an OPT record as
+	// RFC 8467 recommends.
+	EDNSPadding bool
+
+	// DNSCookies enables the server DNS cookies on the UDP listeners as RFC 7873
+	// describes.  The server cookies are generated using a periodically rotated
+	// secret.
+	DNSCookies bool
+
+	// DNSCookiesRequire makes proxy require a valid server cookie from the
+	// ratelimited clients which have presented one before.  The requests
+	// without it are answered with BADCOOKIE if they have a client cookie and
+	// with an empty truncated response otherwise.  It's ignored unless
+	// DNSCookies is true.
+	DNSCookiesRequire bool
+
 	// CacheEnabled defines if the response cache should be used.
 	CacheEnabled bool
 
 	// CacheOptimistic defines if the optimistic cache mechanism should be used.
 	CacheOptimistic bool
 
+	// CacheOptimisticTTL is the TTL of the expired cached responses served by
+	// the optimistic cache in seconds.  Zero means the default of 12 hours.
+	CacheOptimisticTTL uint32
+
+	// CachePrefetch defines if the cached responses for the most queried
+	// domains should be refreshed before they expire.
+	CachePrefetch bool
+
+	// CachePrefetchHotSize is the number of the most hit cache entries within
+	// the last minute which are prefetched.  Zero means the default of 100.
+	CachePrefetchHotSize int
+
+	// CachePrefetchRate is the maximum number of the prefetches per second.
+	// Zero means the default of 10.
+	CachePrefetchRate int
+
+	// CacheServeStale defines if the expired cached responses should be served
+	// when the upstreams fail to resolve the request, see RFC 8767.
+	CacheServeStale bool
+
+	// CacheStaleTTL is the TTL of the expired cached responses served when the
+	// upstreams fail in seconds.  Zero means the default of 30 seconds.
+	CacheStaleTTL uint32
+
+	// CacheExcludedClients are the networks of the clients the requests of
+	// which are never answered from the cache and the responses to which are
+	// never cached.  It may be nil.
+	CacheExcludedClients netutil.SubnetSet
+
 	// UseDNS64 enables DNS64 handling.  If true, proxy will translate IPv4
 	// answers into IPv6 answers using first of DNS64Prefs.  Note also that PTR
 	// requests for addresses within the specified networks are considered
@@ -251,22 +582,23 @@ type Config struct {
 // validateConfig verifies that the supplied configuration is valid and returns
 // an error if it's not.
 func (p *Proxy) validateConfig() (err error) {
-	err = p.UpstreamConfig.validate()
+	err = p.validateUpstreams(p.configUpstreams())
 	if err != nil {
-		return fmt.Errorf("validating general upstreams: %w", err)
+		// Don't wrap the error since it's informative enough as is.
+		return err
 	}
 
-	err = ValidatePrivateConfig(p.PrivateRDNSUpstreamConfig, p.privateNets)
+	err = p.validateRetries()
 	if err != nil {
-		if p.UsePrivateRDNS || errors.Is(err, upstream.ErrNoUpstreams) {
-			return fmt.Errorf("validating private RDNS upstreams: %w", err)
-		}
+		return fmt.Errorf("validating upstream retries: %w", err)
+	}
+
+	if p.MDNSTimeout < 0 {
+		return fmt.Errorf("negative mdns timeout %s", p.MDNSTimeout)
 	}
 
-	// Allow [Proxy.Fallbacks] to be nil, but not empty.  nil means not to use
-	// fallbacks at all.
-	err = p.Fallbacks.validate()
-	if errors.Is(err, upstream.ErrNoUpstreams) {
+	err = p.validateFallbackTriggers()
+	if err != nil {
 		return fmt.Errorf("validating fallbacks: %w", err)
 	}
 
@@ -275,31 +607,95 @@ func (p *Proxy) validateConfig() (err error) {
 		return fmt.Errorf("validating ratelimit: %w", err)
 	}
 
-	p.logConfigInfo()
+	err = p.validateCache()
+	if err != nil {
+		return fmt.Errorf("validating cache: %w", err)
+	}
 
-	return nil
-}
+	err = p.validateBlocking()
+	if err != nil {
+		return fmt.Errorf("validating blocking: %w", err)
+	}
 
-// validateRatelimit validates ratelimit configuration and returns an error if
-// it's invalid.
-func (p *Proxy) validateRatelimit() (err error) {
-	if p.Ratelimit == 0 {
-		return nil
+	err = p.validateECS()
+	if err != nil {
+		return fmt.Errorf("validating ecs: %w", err)
+	}
+
+	err = p.validateClientStats()
+	if err != nil {
+		return fmt.Errorf("validating client stats: %w", err)
+	}
+
+	err = p.validateClientAnonymization()
+	if err != nil {
+		return fmt.Errorf("validating client anonymization: %w", err)
 	}
 
-	err = checkInclusion(p.RatelimitSubnetLenIPv4, 0, netutil.IPv4BitLen)
+	err = p.validateQueryLog()
 	if err != nil {
-		return fmt.Errorf("ratelimit subnet len ipv4 is invalid: %w", err)
+		return fmt.Errorf("validating query log: %w", err)
 	}
 
-	err = checkInclusion(p.RatelimitSubnetLenIPv6, 0, netutil.IPv6BitLen)
+	err = p.validateRebinding()
 	if err != nil {
-		return fmt.Errorf("ratelimit subnet len ipv6 is invalid: %w", err)
+		return fmt.Errorf("validating rebinding protection: %w", err)
 	}
 
+	err = p.validateHTTPSPaths()
+	if err != nil {
+		return fmt.Errorf("validating https paths: %w", err)
+	}
+
+	if p.HostsReloadInterval < 0 {
+		return fmt.Errorf("negative hosts reload interval %s", p.HostsReloadInterval)
+	}
+
+	if p.ShutdownGracePeriod < 0 {
+		return fmt.Errorf("negative shutdown grace period %s", p.ShutdownGracePeriod)
+	}
+
+	err = p.validateTLSCertPaths()
+	if err != nil {
+		return fmt.Errorf("validating tls certificate: %w", err)
+	}
+
+	err = p.validateTCPLimits()
+	if err != nil {
+		return fmt.Errorf("validating tcp limits: %w", err)
+	}
+
+	if p.SlowQueryThreshold < 0 {
+		return fmt.Errorf("negative slow query threshold %s", p.SlowQueryThreshold)
+	}
+
+	err = p.validateHealthCheck()
+	if err != nil {
+		return fmt.Errorf("validating upstream health check: %w", err)
+	}
+
+	if p.BlockedDomainsStatsLimit < 0 {
+		return fmt.Errorf("negative blocked domains stats limit %d", p.BlockedDomainsStatsLimit)
+	}
+
+	p.logConfigInfo()
+
 	return nil
 }
 
+// validateRatelimit validates ratelimit configuration and returns an error if
+// it's invalid.
+func (p *Proxy) validateRatelimit() (err error) {
+	s := &RatelimitSettings{
+		Ratelimit:     p.Ratelimit,
+		SubnetLenIPv4: p.RatelimitSubnetLenIPv4,
+		SubnetLenIPv6: p.RatelimitSubnetLenIPv6,
+		Cookie:        p.RatelimitCookie,
+	}
+
+	return s.validate()
+}
+
 // checkInclusion returns an error if a n is not in the inclusive range between
 // minN and maxN.
 func checkInclusion(n, minN, maxN int) (err error) {
@@ -326,10 +722,20 @@ func (p *Proxy) logConfigInfo() {
 			p.RatelimitSubnetLenIPv4,
 			p.RatelimitSubnetLenIPv6,
 		)
+
+		if p.RatelimitSlip > 0 {
+			log.Info("dnsproxy: ratelimit slip is set to %d", p.RatelimitSlip)
+		}
+	}
+
+	if p.DNSCookies {
+		log.Info("dnsproxy: dns cookies are enabled, required: %t", p.DNSCookiesRequire)
 	}
 
 	if p.RefuseAny {
 		log.Info("dnsproxy: server will refuse requests of type ANY")
+	} else if p.AnyHINFO {
+		log.Info("dnsproxy: server will answer requests of type ANY with hinfo")
 	}
 
 	if len(p.BogusNXDomain) > 0 {
@@ -363,6 +769,10 @@ func (p *Proxy) validateListenAddrs() error {
 		return errors.Error("cannot create dnscrypt listener without dnscrypt config")
 	}
 
+	if p.UnixSocketMode&^fs.ModePerm != 0 {
+		return fmt.Errorf("bad unix socket mode %s", p.UnixSocketMode)
+	}
+
 	return nil
 }
 
@@ -374,5 +784,6 @@ func (p *Proxy) hasListenAddrs() bool {
 		p.HTTPSListenAddr != nil ||
 		p.QUICListenAddr != nil ||
 		p.DNSCryptUDPListenAddr != nil ||
-		p.DNSCryptTCPListenAddr != nil
+		p.DNSCryptTCPListenAddr != nil ||
+		p.UnixListenPaths != nil
 }
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+// connLimiter limits the number of the concurrent TCP connections overall and
+// per client IP address.
+type connLimiter struct {
+	// mux protects total and perIP.
+	mux *sync.Mutex
+
+	// perIP are the numbers of the open connections by the client addresses.
+	perIP map[netip.Addr]int
+
+	// total is the number of the open connections.
+	total int
+
+	// max is the maximum number of the open connections.  Zero means no limit.
+	max int
+
+	// maxPerIP is the maximum number of the open connections from a single
+	// client address.  Zero means no limit.
+	maxPerIP int
+}
+
+// newConnLimiter returns a new *connLimiter with the limits from p.
+func (p *Proxy) newConnLimiter() (l *connLimiter) {
+	return &connLimiter{
+		mux:      &sync.Mutex{},
+		perIP:    map[netip.Addr]int{},
+		max:      p.TCPMaxConns,
+		maxPerIP: p.TCPMaxConnsPerIP,
+	}
+}
+
+// acquire registers a new connection from addr and returns true if it's within
+// the limits.  If it isn't, the stats key of the exceeded limit is returned.
+// The per-address limit isn't applied to invalid addresses, e.g. the clients of
+// the Unix domain sockets.
+func (l *connLimiter) acquire(addr netip.Addr) (ok bool, statKey string) {
+	addr = addr.Unmap()
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.max > 0 && l.total >= l.max {
+		return false, "tcp::rejected_max_conns"
+	}
+
+	if addr.IsValid() {
+		if l.maxPerIP > 0 && l.perIP[addr] >= l.maxPerIP {
+			return false, "tcp::rejected_max_conns_per_ip"
+		}
+
+		l.perIP[addr]++
+	}
+
+	l.total++
+
+	return true, ""
+}
+
+// release unregisters a connection from addr previously registered with
+// acquire.
+func (l *connLimiter) release(addr netip.Addr) {
+	addr = addr.Unmap()
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.total--
+
+	if !addr.IsValid() {
+		return
+	}
+
+	if l.perIP[addr]--; l.perIP[addr] <= 0 {
+		delete(l.perIP, addr)
+	}
+}
+
+// validateTCPLimits returns an error if the TCP connection limits are
+// configured improperly.
+func (p *Proxy) validateTCPLimits() (err error) {
+	switch {
+	case p.TCPMaxConns < 0:
+		return fmt.Errorf("negative max conns %d", p.TCPMaxConns)
+	case p.TCPMaxConnsPerIP < 0:
+		return fmt.Errorf("negative max conns per ip %d", p.TCPMaxConnsPerIP)
+	case p.TCPIdleTimeout < 0:
+		return fmt.Errorf("negative idle timeout %s", p.TCPIdleTimeout)
+	case p.TCPMaxQueriesPerConn < 0:
+		return fmt.Errorf("negative max queries per conn %d", p.TCPMaxQueriesPerConn)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLimiter(t *testing.T) {
+	first := netip.MustParseAddr("192.0.2.1")
+	second := netip.MustParseAddr("192.0.2.2")
+
+	l := (&Proxy{Config: Config{TCPMaxConns: 3, TCPMaxConnsPerIP: 2}}).newConnLimiter()
+
+	ok, _ := l.acquire(first)
+	require.True(t, ok)
+
+	ok, _ = l.acquire(netip.AddrFrom16(first.As16()))
+	require.True(t, ok)
+
+	ok, statKey := l.acquire(first)
+	assert.False(t, ok)
+	assert.Equal(t, "tcp::rejected_max_conns_per_ip", statKey)
+
+	ok, _ = l.acquire(second)
+	require.True(t, ok)
+
+	// The per-address limit isn't applied to the Unix domain sockets clients,
+	// but the overall one is.
+	ok, statKey = l.acquire(netip.Addr{})
+	assert.False(t, ok)
+	assert.Equal(t, "tcp::rejected_max_conns", statKey)
+
+	l.release(first)
+	ok, _ = l.acquire(first)
+	assert.True(t, ok)
+
+	l.release(first)
+	l.release(first)
+	l.release(second)
+	assert.Empty(t, l.perIP)
+	assert.Zero(t, l.total)
+}
+
+// startTestTCPProxy starts a proxy listening for plain TCP with conf limits and
+// answering all the requests with empty responses.
+func startTestTCPProxy(t *testing.T, conf *Config) (addr string) {
+	t.Helper()
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	conf.TCPListenAddr = []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)}
+	conf.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{ups}}
+	conf.TrustedProxies = defaultTrustedProxies
+	conf.RatelimitSubnetLenIPv4 = 24
+	conf.RatelimitSubnetLenIPv6 = 64
+
+	p := mustNew(t, conf)
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	return p.Addr(ProtoTCP).String()
+}
+
+// exchangeTCP sends a request over conn and returns an error if there is no
+// response.
+func exchangeTCP(conn *dns.Conn) (err error) {
+	err = conn.WriteMsg(newTestMessage())
+	if err != nil {
+		return err
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.ReadMsg()
+
+	return err
+}
+
+func TestProxy_tcpLimits(t *testing.T) {
+	const clientsNum = 3
+
+	testCases := []struct {
+		conf    *Config
+		name    string
+		statKey string
+	}{{
+		conf:    &Config{TCPMaxConns: clientsNum},
+		name:    "max_conns",
+		statKey: "tcp::rejected_max_conns",
+	}, {
+		conf:    &Config{TCPMaxConnsPerIP: clientsNum},
+		name:    "max_conns_per_ip",
+		statKey: "tcp::rejected_max_conns_per_ip",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setTestStats(t)
+
+			addr := startTestTCPProxy(t, tc.conf)
+
+			for range clientsNum {
+				conn, err := dns.Dial("tcp", addr)
+				require.NoError(t, err)
+				t.Cleanup(func() { _ = conn.Close() })
+
+				require.NoError(t, exchangeTCP(conn))
+			}
+
+			conn, err := dns.Dial("tcp", addr)
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = conn.Close() })
+
+			assert.Error(t, exchangeTCP(conn))
+
+			n, _ := SM.GetUint64(tc.statKey)
+			assert.Equal(t, uint64(1), n)
+		})
+	}
+}
+
+func TestProxy_tcpIdleTimeout(t *testing.T) {
+	setTestStats(t)
+
+	// Keep the timeout long enough for the first exchange to complete under
+	// the load of the other tests.
+	addr := startTestTCPProxy(t, &Config{TCPIdleTimeout: 500 * time.Millisecond})
+
+	conn, err := dns.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	require.NoError(t, exchangeTCP(conn))
+
+	time.Sleep(time.Second)
+	assert.Error(t, exchangeTCP(conn))
+
+	n, _ := SM.GetUint64("tcp::idle_timeouts")
+	assert.Equal(t, uint64(1), n)
+}
+
+func TestProxy_tcpMaxQueriesPerConn(t *testing.T) {
+	setTestStats(t)
+
+	addr := startTestTCPProxy(t, &Config{TCPMaxQueriesPerConn: 2})
+
+	conn, err := dns.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	require.NoError(t, exchangeTCP(conn))
+	require.NoError(t, exchangeTCP(conn))
+	assert.Error(t, exchangeTCP(conn))
+
+	n, _ := SM.GetUint64("tcp::max_queries_closes")
+	assert.Equal(t, uint64(1), n)
+}
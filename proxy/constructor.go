@@ -2,6 +2,10 @@ package proxy
 
 import "github.com/miekg/dns"
 
+// defaultAnyHINFOTTL is the default TTL of the synthetic HINFO record for the
+// ANY requests, in seconds.  It's the one RFC 8482 uses in its examples.
+const defaultAnyHINFOTTL uint32 = 3789
+
 // MessageConstructor creates DNS messages.
 type MessageConstructor interface {
 	// NewMsgNXDOMAIN creates a new response message replying to req with the
@@ -54,6 +58,23 @@ func (defaultMessageConstructor) NewMsgNOTIMPLEMENTED(req *dns.Msg) (resp *dns.M
 	return resp
 }
 
+// newMsgHINFO creates a new response message replying to the ANY request req
+// with the synthetic HINFO record with the given TTL, see RFC 8482.
+func newMsgHINFO(req *dns.Msg, ttl uint32) (resp *dns.Msg) {
+	resp = reply(req, dns.RcodeSuccess)
+	resp.Answer = []dns.RR{&dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypeHINFO,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Cpu: "RFC8482",
+	}}
+
+	return resp
+}
+
 // reply creates a new response message replying to req with the given code.
 func reply(req *dns.Msg, code int) (resp *dns.Msg) {
 	resp = (&dns.Msg{}).SetRcode(req, code)
@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// Lengths of the DNS cookies in bytes, see RFC 7873 Section 4.
+const (
+	clientCookieLen    = 8
+	serverCookieMinLen = 8
+	serverCookieMaxLen = 32
+
+	// serverCookieLen is the length of the server cookies generated by the
+	// proxy, see RFC 9018 Section 4.
+	serverCookieLen = 16
+)
+
+// serverCookieVersion is the version of the server cookies generated by the
+// proxy, see RFC 9018 Section 4.1.
+const serverCookieVersion = 1
+
+const (
+	// cookieSecretRotation is the interval of the server secret rotation.  The
+	// cookies generated with the previous secret are still accepted.
+	cookieSecretRotation = 1 * time.Hour
+
+	// cookieMaxAge is the maximum age of the accepted server cookies, see
+	// RFC 9018 Section 4.3.
+	cookieMaxAge = 1 * time.Hour
+
+	// cookieMaxSkew is the maximum time the timestamp of the accepted server
+	// cookies may be ahead of the current time, see RFC 9018 Section 4.3.
+	cookieMaxSkew = 5 * time.Minute
+)
+
+// cookieSecrets are the rotating secrets used to generate and validate the
+// server cookies.
+type cookieSecrets struct {
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// clock is used to get the current time.
+	clock clock
+
+	// rotated is the time the secrets have been rotated last time.
+	rotated time.Time
+
+	// cur is the secret used to generate the server cookies.
+	cur []byte
+
+	// prev is the previous secret, which is only used to validate the cookies.
+	// It's nil until the first rotation.
+	prev []byte
+}
+
+// newCookieSecrets returns the new properly initialized *cookieSecrets.
+func newCookieSecrets(c clock) (s *cookieSecrets) {
+	return &cookieSecrets{
+		mu:      &sync.Mutex{},
+		clock:   c,
+		rotated: c.Now(),
+		cur:     newCookieSecret(),
+	}
+}
+
+// newCookieSecret returns a new random secret for the server cookies.
+func newCookieSecret() (secret []byte) {
+	secret = make([]byte, 16)
+	_, _ = rand.Read(secret)
+
+	return secret
+}
+
+// secrets returns the current and the previous secrets along with the current
+// time, rotating the secrets if needed.
+func (s *cookieSecrets) secrets() (cur, prev []byte, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now = s.clock.Now()
+	if now.Sub(s.rotated) >= cookieSecretRotation {
+		s.prev, s.cur = s.cur, newCookieSecret()
+		s.rotated = now
+	}
+
+	return s.cur, s.prev, now
+}
+
+// generate returns a new server cookie for the client cookie of the client
+// with addr.
+func (s *cookieSecrets) generate(clientCookie []byte, addr netip.Addr) (cookie []byte) {
+	cur, _, now := s.secrets()
+
+	return newServerCookie(cur, clientCookie, uint32(now.Unix()), addr)
+}
+
+// isValid returns true if srvCookie has been generated by the proxy for the
+// client cookie of the client with addr and hasn't expired yet.
+func (s *cookieSecrets) isValid(clientCookie, srvCookie []byte, addr netip.Addr) (ok bool) {
+	if len(srvCookie) != serverCookieLen || srvCookie[0] != serverCookieVersion {
+		return false
+	}
+
+	cur, prev, now := s.secrets()
+
+	ts := time.Unix(int64(binary.BigEndian.Uint32(srvCookie[4:8])), 0)
+	if now.Sub(ts) > cookieMaxAge || ts.Sub(now) > cookieMaxSkew {
+		return false
+	}
+
+	for _, secret := range [][]byte{cur, prev} {
+		if secret == nil {
+			continue
+		}
+
+		want := newServerCookie(secret, clientCookie, uint32(ts.Unix()), addr)
+		if hmac.Equal(want, srvCookie) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newServerCookie returns the server cookie in the format described by RFC 9018
+// Section 4.  The hash is the truncated HMAC-SHA256 instead of SipHash-2-4,
+// since the secret is never shared with other servers anyway.
+func newServerCookie(secret, clientCookie []byte, ts uint32, addr netip.Addr) (cookie []byte) {
+	cookie = make([]byte, serverCookieLen)
+	cookie[0] = serverCookieVersion
+	binary.BigEndian.PutUint32(cookie[4:8], ts)
+
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(clientCookie)
+	_, _ = mac.Write(cookie[:8])
+	_, _ = mac.Write(addr.Unmap().AsSlice())
+	copy(cookie[8:], mac.Sum(nil))
+
+	return cookie
+}
+
+// initCookies initializes the DNS cookies handling if it's enabled.
+func (p *Proxy) initCookies() {
+	if !p.DNSCookies {
+		return
+	}
+
+	p.cookieSecrets = newCookieSecrets(p.time)
+	p.cookieClients = gocache.New(cookieMaxAge, cookieMaxAge)
+}
+
+// processCookie handles the DNS cookie of the UDP request in d, see
+// [Config.DNSCookies].  The COOKIE option is removed from the request, since
+// the cookies are only meaningful between the client and the proxy.  ok is
+// false if the cookie is malformed, in which case the FORMERR response is sent
+// as RFC 7873 Section 5.2.2 requires.
+func (p *Proxy) processCookie(d *DNSContext) (ok bool) {
+	if !p.DNSCookies || d.Proto != ProtoUDP {
+		return true
+	}
+
+	opt := d.Req.IsEdns0()
+	if opt == nil {
+		return true
+	}
+
+	var cookie []byte
+	var found, malformed bool
+	opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) (del bool) {
+		c, isCookie := o.(*dns.EDNS0_COOKIE)
+		if !isCookie {
+			return false
+		}
+
+		if !found {
+			found = true
+			cookie, malformed = parseCookie(c.Cookie)
+		}
+
+		return true
+	})
+
+	if !found {
+		return true
+	}
+
+	addr := d.Addr.Addr()
+	if malformed {
+		log.Debug("dnsproxy: malformed dns cookie from %s", p.anonymizeAddr(addr))
+
+		SM.Increment("cookies::malformed", 1)
+
+		d.Res = reply(d.Req, dns.RcodeFormatError)
+		p.respond(d)
+
+		return false
+	}
+
+	d.clientCookie = cookie[:clientCookieLen]
+	if len(cookie) == clientCookieLen {
+		SM.Increment("cookies::client_only", 1)
+
+		return true
+	}
+
+	if !p.cookieSecrets.isValid(d.clientCookie, cookie[clientCookieLen:], addr) {
+		SM.Increment("cookies::invalid", 1)
+
+		return true
+	}
+
+	SM.Increment("cookies::valid", 1)
+
+	d.cookieValid = true
+	p.cookieClients.SetDefault(addr.Unmap().String(), struct{}{})
+
+	return true
+}
+
+// parseCookie decodes the hex-encoded value of the COOKIE option.  malformed
+// is true if the value isn't a valid cookie.
+func parseCookie(s string) (cookie []byte, malformed bool) {
+	cookie, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, true
+	}
+
+	switch l := len(cookie); {
+	case l == clientCookieLen:
+		return cookie, false
+	case l < clientCookieLen+serverCookieMinLen, l > clientCookieLen+serverCookieMaxLen:
+		return nil, true
+	default:
+		return cookie, false
+	}
+}
+
+// requireCookie handles the ratelimited UDP request d from the client which
+// has presented a valid server cookie before, but hasn't presented it this
+// time, see [Config.DNSCookiesRequire].  Such requests are likely to be
+// spoofed, so those having a client cookie are answered with BADCOOKIE and a
+// fresh server cookie and the rest are answered with an empty truncated
+// response.  It returns false if d should be ratelimited as usual.
+func (p *Proxy) requireCookie(d *DNSContext) (handled bool) {
+	if !p.DNSCookies || !p.DNSCookiesRequire || d.cookieValid {
+		return false
+	}
+
+	addr := d.Addr.Addr()
+	if _, seen := p.cookieClients.Get(addr.Unmap().String()); !seen {
+		return false
+	}
+
+	if d.clientCookie != nil {
+		log.Debug("dnsproxy: requiring dns cookie from %s", p.anonymizeAddr(addr))
+
+		SM.Increment("cookies::bad_cookie", 1)
+		metricRatelimited.inc("badcookie")
+
+		d.Res = reply(d.Req, dns.RcodeBadCookie)
+	} else {
+		log.Debug("dnsproxy: requiring dns cookie from %s, truncating", p.anonymizeAddr(addr))
+
+		SM.Increment("ratelimit::slipped", 1)
+		metricRatelimited.inc("slip")
+
+		d.Res = genTruncatedResponse(d.Req)
+	}
+
+	p.respond(d)
+
+	return true
+}
+
+// addServerCookie adds the server cookie to the response in d if the request
+// has had a client cookie.  Any COOKIE options the response may already have
+// are removed.
+func (p *Proxy) addServerCookie(d *DNSContext) {
+	if d.clientCookie == nil || d.Res == nil {
+		return
+	}
+
+	opt := d.Res.IsEdns0()
+	if opt == nil {
+		d.calcFlagsAndSize()
+		opt = d.Res.SetEdns0(d.udpSize, d.doBit).IsEdns0()
+	}
+
+	opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) (del bool) {
+		return o.Option() == dns.EDNS0COOKIE
+	})
+
+	srvCookie := p.cookieSecrets.generate(d.clientCookie, d.Addr.Addr())
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(append(slices.Clone(d.clientCookie), srvCookie...)),
+	})
+}
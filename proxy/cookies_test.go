@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookieSecrets(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	s := newCookieSecrets(&fakeClock{onNow: func() (n time.Time) { return now }})
+
+	clientCookie := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	cookie := s.generate(clientCookie, addr)
+	require.Len(t, cookie, serverCookieLen)
+
+	assert.True(t, s.isValid(clientCookie, cookie, addr))
+	assert.True(t, s.isValid(clientCookie, cookie, netip.MustParseAddr("::ffff:192.0.2.1")))
+	assert.False(t, s.isValid(clientCookie, cookie, netip.MustParseAddr("192.0.2.2")))
+	assert.False(t, s.isValid([]byte{8, 7, 6, 5, 4, 3, 2, 1}, cookie, addr))
+	assert.False(t, s.isValid(clientCookie, cookie[:8], addr))
+
+	now = now.Add(cookieSecretRotation)
+	assert.True(t, s.isValid(clientCookie, cookie, addr), "previous secret")
+
+	now = now.Add(cookieSecretRotation)
+	assert.False(t, s.isValid(clientCookie, cookie, addr), "expired")
+
+	fresh := s.generate(clientCookie, addr)
+	now = now.Add(-cookieMaxSkew - time.Second)
+	assert.False(t, s.isValid(clientCookie, fresh, addr), "from the future")
+}
+
+func TestParseCookie(t *testing.T) {
+	testCases := []struct {
+		name          string
+		in            string
+		wantLen       int
+		wantMalformed bool
+	}{{
+		name:          "client_only",
+		in:            "0102030405060708",
+		wantLen:       8,
+		wantMalformed: false,
+	}, {
+		name:          "with_server",
+		in:            "0102030405060708" + "01000000655d3a0011223344556677",
+		wantLen:       23,
+		wantMalformed: false,
+	}, {
+		name:          "short_client",
+		in:            "01020304",
+		wantLen:       0,
+		wantMalformed: true,
+	}, {
+		name:          "short_server",
+		in:            "0102030405060708" + "0102",
+		wantLen:       0,
+		wantMalformed: true,
+	}, {
+		name:          "bad_hex",
+		in:            "zz",
+		wantLen:       0,
+		wantMalformed: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cookie, malformed := parseCookie(tc.in)
+			assert.Equal(t, tc.wantMalformed, malformed)
+			assert.Len(t, cookie, tc.wantLen)
+		})
+	}
+}
+
+func TestProxy_processCookie(t *testing.T) {
+	setTestStats(t)
+
+	p := &Proxy{time: realClock{}}
+	p.DNSCookies = true
+	p.initCookies()
+
+	clientCookie := "0102030405060708"
+	addr := netip.MustParseAddrPort("192.0.2.1:53")
+
+	// newContext returns the UDP request context having the given COOKIE
+	// option value.
+	newContext := func(cookie string) (d *DNSContext) {
+		req := newTestMessage()
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		o := req.IsEdns0()
+		o.Option = append(o.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+
+		return &DNSContext{
+			Proto: ProtoUDP,
+			Req:   req,
+			Addr:  addr,
+		}
+	}
+
+	d := newContext(clientCookie)
+	require.True(t, p.processCookie(d))
+
+	assert.False(t, d.cookieValid)
+	assert.Empty(t, d.Req.IsEdns0().Option)
+
+	d.Res = (&dns.Msg{}).SetReply(d.Req)
+	p.addServerCookie(d)
+
+	opt := d.Res.IsEdns0()
+	require.NotNil(t, opt)
+	require.Len(t, opt.Option, 1)
+
+	respCookie, ok := opt.Option[0].(*dns.EDNS0_COOKIE)
+	require.True(t, ok)
+	require.Len(t, respCookie.Cookie, 2*(clientCookieLen+serverCookieLen))
+
+	d = newContext(respCookie.Cookie)
+	require.True(t, p.processCookie(d))
+
+	assert.True(t, d.cookieValid)
+
+	_, seen := p.cookieClients.Get(addr.Addr().String())
+	assert.True(t, seen)
+
+	d = newContext(clientCookie + hex.EncodeToString(make([]byte, serverCookieLen)))
+	require.True(t, p.processCookie(d))
+
+	assert.False(t, d.cookieValid)
+	assert.NotNil(t, d.clientCookie)
+
+	valid, _ := SM.GetUint64("cookies::valid")
+	assert.Equal(t, uint64(1), valid)
+
+	invalid, _ := SM.GetUint64("cookies::invalid")
+	assert.Equal(t, uint64(1), invalid)
+}
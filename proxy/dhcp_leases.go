@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/hostsfile"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// dhcpLeases answers the requests for the hostnames and the addresses from the
+// DHCP leases file and reloads it when it changes.
+type dhcpLeases struct {
+	// mux protects storage and state.
+	mux *sync.RWMutex
+
+	// storage contains the leases having hostnames.
+	storage *hostsfile.DefaultStorage
+
+	// state is the last seen state of the file.
+	state hostsFileState
+
+	// done is closed when the leases are closed to stop the reloading.  It's
+	// recreated on each start.
+	done chan struct{}
+
+	// path is the path to the leases file.
+	path string
+
+	// interval is the interval between the checks of the file for changes.
+	interval time.Duration
+}
+
+// initDHCPLeases loads the configured DHCP leases file, if any.
+func (p *Proxy) initDHCPLeases() (err error) {
+	if p.DHCPLeasesFile == "" {
+		return nil
+	}
+
+	p.leases, err = newDHCPLeases(p.DHCPLeasesFile, p.HostsReloadInterval)
+	if err != nil {
+		return fmt.Errorf("dhcp leases: %w", err)
+	}
+
+	return nil
+}
+
+// newDHCPLeases returns a new *dhcpLeases with the file at path loaded.  The
+// missing file is considered empty.
+func newDHCPLeases(path string, interval time.Duration) (l *dhcpLeases, err error) {
+	l = &dhcpLeases{
+		mux:      &sync.RWMutex{},
+		path:     path,
+		interval: cmp.Or(interval, defaultHostsReloadInterval),
+	}
+
+	l.storage, l.state, err = loadDHCPLeases(path, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// loadDHCPLeases parses the dnsmasq leases file at path skipping the leases
+// expired at now and returns its state.
+func loadDHCPLeases(
+	path string,
+	now time.Time,
+) (strg *hostsfile.DefaultStorage, st hostsFileState, err error) {
+	// The error is always nil here since no readers passed.
+	strg, _ = hostsfile.NewDefaultStorage()
+
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Debug("dnsproxy: dhcp leases file %q doesn't exist", path)
+
+			return strg, hostsFileState{}, nil
+		}
+
+		return nil, hostsFileState{}, fmt.Errorf("loading leases file %q: %w", path, err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, hostsFileState{}, fmt.Errorf("loading leases file %q: %w", path, err)
+	}
+
+	err = parseDnsmasqLeases(strg, f, now)
+	if err != nil {
+		return nil, hostsFileState{}, fmt.Errorf("loading leases file %q: %w", path, err)
+	}
+
+	return strg, hostsFileState{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		exists:  true,
+	}, nil
+}
+
+// parseDnsmasqLeases parses the leases in the dnsmasq format from r into strg.
+// Each line of it is:
+//
+//	<expiry> <mac or iaid> <address> <hostname or *> <client id or *>
+//
+// The expiry is the Unix time, or zero for the infinite leases.  The leases
+// expired at now, without hostnames, or with invalid ones are skipped, as well
+// as the DUID line of the server.
+func parseDnsmasqLeases(strg *hostsfile.DefaultStorage, r io.Reader, now time.Time) (err error) {
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || fields[0] == "duid" {
+			continue
+		} else if len(fields) < 4 {
+			log.Debug("dnsproxy: dhcp leases: line %d: too few fields", lineNum)
+
+			continue
+		}
+
+		expiry, perr := strconv.ParseInt(fields[0], 10, 64)
+		if perr != nil {
+			log.Debug("dnsproxy: dhcp leases: line %d: bad expiry: %s", lineNum, perr)
+
+			continue
+		} else if expiry != 0 && !time.Unix(expiry, 0).After(now) {
+			continue
+		}
+
+		addr, perr := netip.ParseAddr(fields[2])
+		if perr != nil {
+			log.Debug("dnsproxy: dhcp leases: line %d: bad address: %s", lineNum, perr)
+
+			continue
+		}
+
+		host := fields[3]
+		if host == "*" {
+			continue
+		} else if perr = netutil.ValidateHostname(host); perr != nil {
+			log.Debug("dnsproxy: dhcp leases: line %d: %s", lineNum, perr)
+
+			continue
+		}
+
+		strg.Add(&hostsfile.Record{
+			Addr:  addr,
+			Names: []string{host},
+		})
+	}
+
+	return s.Err()
+}
+
+// start starts checking the file for changes every l.interval until l is
+// closed.  It must not be called concurrently with Close.
+func (l *dhcpLeases) start() {
+	done := make(chan struct{})
+	l.done = done
+
+	go func() {
+		defer log.OnPanic("dhcp leases reload")
+
+		ticker := time.NewTicker(l.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				l.reloadIfChanged()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// Close implements the [io.Closer] interface for *dhcpLeases.
+func (l *dhcpLeases) Close() (err error) {
+	close(l.done)
+
+	return nil
+}
+
+// reloadIfChanged reloads the file if it has changed.  The previously loaded
+// leases are kept if the file can't be loaded.
+func (l *dhcpLeases) reloadIfChanged() {
+	st, err := statHostsFile(l.path)
+	if err != nil {
+		log.Debug("dnsproxy: checking dhcp leases file: %s", err)
+
+		return
+	}
+
+	l.mux.RLock()
+	prev := l.state
+	l.mux.RUnlock()
+
+	if st.exists == prev.exists && st.size == prev.size && st.modTime.Equal(prev.modTime) {
+		return
+	}
+
+	strg, st, err := loadDHCPLeases(l.path, time.Now())
+	if err != nil {
+		log.Error("dnsproxy: reloading dhcp leases: %s", err)
+
+		return
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.storage, l.state = strg, st
+
+	log.Info("dnsproxy: dhcp leases reloaded")
+}
+
+// resolve returns the response for req from the leases, or nil if there is no
+// lease for it.  Only A, AAAA, and PTR requests are answered.
+func (l *dhcpLeases) resolve(req *dns.Msg) (resp *dns.Msg) {
+	q := req.Question[0]
+
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		addrs := l.storage.ByName(strings.TrimSuffix(q.Name, "."))
+		if len(addrs) == 0 {
+			return nil
+		}
+
+		return genHostsAddrResponse(req, addrs)
+	case dns.TypePTR:
+		addr, err := netutil.IPFromReversedAddr(q.Name)
+		if err != nil {
+			return nil
+		}
+
+		names := l.storage.ByAddr(addr)
+		if len(names) == 0 {
+			return nil
+		}
+
+		return genHostsPTRResponse(req, names)
+	default:
+		return nil
+	}
+}
+
+// replyFromDHCPLeases tries to answer the request from the DHCP leases.  It
+// returns true if dctx.Res is set.
+func (p *Proxy) replyFromDHCPLeases(dctx *DNSContext) (ok bool) {
+	if p.leases == nil || len(dctx.Req.Question) == 0 {
+		return false
+	}
+
+	resp := p.leases.resolve(dctx.Req)
+	if resp == nil {
+		return false
+	}
+
+	log.Debug("dnsproxy: answering %s from dhcp leases", dctx.Req.Question[0].Name)
+
+	dctx.Res = resp
+	dctx.Upstream = nil
+
+	return true
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/hostsfile"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDnsmasqLeases(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+
+	testCases := []struct {
+		name      string
+		in        string
+		host      string
+		wantAddrs []netip.Addr
+	}{{
+		name:      "ipv4",
+		in:        "1700000100 aa:bb:cc:dd:ee:ff 192.168.1.10 laptop 01:aa:bb:cc:dd:ee:ff\n",
+		host:      "laptop",
+		wantAddrs: []netip.Addr{netip.MustParseAddr("192.168.1.10")},
+	}, {
+		name: "ipv6",
+		in: "duid 00:01:00:01:2c:5e:1b:2a:aa:bb:cc:dd:ee:ff\n" +
+			"1700000100 1234 2001:db8::10 phone 00:02:00:00\n",
+		host:      "phone",
+		wantAddrs: []netip.Addr{netip.MustParseAddr("2001:db8::10")},
+	}, {
+		name:      "infinite",
+		in:        "0 aa:bb:cc:dd:ee:ff 192.168.1.11 printer *\n",
+		host:      "printer",
+		wantAddrs: []netip.Addr{netip.MustParseAddr("192.168.1.11")},
+	}, {
+		name:      "expired",
+		in:        "1699999999 aa:bb:cc:dd:ee:ff 192.168.1.12 old *\n",
+		host:      "old",
+		wantAddrs: nil,
+	}, {
+		name:      "no_hostname",
+		in:        "1700000100 aa:bb:cc:dd:ee:ff 192.168.1.13 * *\n",
+		host:      "*",
+		wantAddrs: nil,
+	}, {
+		name:      "invalid_hostname",
+		in:        "1700000100 aa:bb:cc:dd:ee:ff 192.168.1.14 bad_host! *\n",
+		host:      "bad_host!",
+		wantAddrs: nil,
+	}, {
+		name:      "bad_line",
+		in:        "garbage\n1700000100 aa:bb:cc:dd:ee:ff 192.168.1.15 tv *\n",
+		host:      "tv",
+		wantAddrs: []netip.Addr{netip.MustParseAddr("192.168.1.15")},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			strg, _ := hostsfile.NewDefaultStorage()
+			err := parseDnsmasqLeases(strg, strings.NewReader(tc.in), now)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantAddrs, strg.ByName(tc.host))
+		})
+	}
+}
+
+func TestProxy_Resolve_dhcpLeases(t *testing.T) {
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	err := os.WriteFile(leasesPath, []byte("0 aa:bb:cc:dd:ee:ff 192.168.1.10 Laptop *\n"), 0o644)
+	require.NoError(t, err)
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		DHCPLeasesFile:         leasesPath,
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	resolve := func(t *testing.T, host string, qtype uint16) (dctx *DNSContext) {
+		t.Helper()
+
+		dctx = &DNSContext{
+			Req:   (&dns.Msg{}).SetQuestion(host, qtype),
+			Proto: ProtoUDP,
+			Addr:  netip.MustParseAddrPort("192.168.1.2:53"),
+		}
+
+		require.NoError(t, p.Resolve(dctx))
+		require.NotNil(t, dctx.Res)
+
+		return dctx
+	}
+
+	t.Run("a", func(t *testing.T) {
+		dctx := resolve(t, "laptop.", dns.TypeA)
+
+		assert.Nil(t, dctx.Upstream)
+		require.Len(t, dctx.Res.Answer, 1)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, dctx.Res.Answer[0])
+		assert.Equal(t, net.IP{192, 168, 1, 10}, a.A)
+		assert.Equal(t, uint32(hostsResponseTTL), a.Hdr.Ttl)
+	})
+
+	t.Run("ptr", func(t *testing.T) {
+		dctx := resolve(t, "10.1.168.192.in-addr.arpa.", dns.TypePTR)
+
+		assert.Nil(t, dctx.Upstream)
+		require.Len(t, dctx.Res.Answer, 1)
+
+		ptr := testutil.RequireTypeAssert[*dns.PTR](t, dctx.Res.Answer[0])
+		assert.Equal(t, "laptop.", ptr.Ptr)
+	})
+
+	t.Run("ptr_not_leased", func(t *testing.T) {
+		dctx := resolve(t, "11.1.168.192.in-addr.arpa.", dns.TypePTR)
+
+		assert.Equal(t, ups, dctx.Upstream)
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		err = os.WriteFile(leasesPath, []byte("0 aa:bb:cc:dd:ee:ff 192.168.1.20 laptop *\n"), 0o644)
+		require.NoError(t, err)
+
+		// Make sure the change is noticed even on the file systems with the
+		// coarse modification times.
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(leasesPath, later, later))
+
+		p.leases.reloadIfChanged()
+
+		dctx := resolve(t, "laptop.", dns.TypeA)
+		require.Len(t, dctx.Res.Answer, 1)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, dctx.Res.Answer[0])
+		assert.Equal(t, net.IP{192, 168, 1, 20}, a.A)
+	})
+}
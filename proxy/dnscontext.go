@@ -6,6 +6,7 @@ import (
 	"net/netip"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/miekg/dns"
@@ -69,6 +70,16 @@ type DNSContext struct {
 	// Addr is the address of the client.
 	Addr netip.AddrPort
 
+	// ClientID is the identifier of the client parsed from the DoH request
+	// path or the TLS server name of the DoT and DoQ connections, see
+	// [Config.ClientIDServerName].  It's empty if the client hasn't sent any.
+	ClientID string
+
+	// TLSServerName is the server name requested by the DoT, DoH, or DoQ
+	// client via SNI.  The certificate served to the client is selected by it,
+	// see [Config.TLSExtraCerts].  It's empty if the client hasn't sent any.
+	TLSServerName string
+
 	// QueryDuration is the duration of a successful query to an upstream
 	// server or, if the upstream server is unavailable, to a fallback server.
 	QueryDuration time.Duration
@@ -99,6 +110,38 @@ type DNSContext struct {
 
 	// doBit is the DNSSEC OK flag from request's EDNS0 RR if presented.
 	doBit bool
+
+	// fromCache is true if the response has been served from the cache.
+	fromCache bool
+
+	// fromStale is true if the expired response has been served from the
+	// cache since the upstreams have failed.
+	fromStale bool
+
+	// fromFallback is true if the response has been received from the fallback
+	// upstreams.
+	fromFallback bool
+
+	// blockedList is the name of the blocked domains list the request has been
+	// blocked by.  It's empty if the request isn't blocked.
+	blockedList string
+
+	// ede is the extended DNS error of the response synthesized by the proxy,
+	// if any.  It's only added to the response if the request has EDNS0 RRs.
+	// See RFC 8914.
+	ede *dns.EDNS0_EDE
+
+	// clientCookie is the client cookie of the UDP request, see
+	// [Config.DNSCookies].  It's nil if the request has no cookie.
+	clientCookie []byte
+
+	// cookieValid is true if the UDP request has presented a valid server
+	// cookie.
+	cookieValid bool
+
+	// dohJSON is true if the request has been received via the JSON DoH API,
+	// see [Config.HTTPSJSON].
+	dohJSON bool
 }
 
 // newDNSContext returns a new properly initialized *DNSContext.
@@ -149,6 +192,23 @@ func (dctx *DNSContext) scrub() {
 		dctx.Res.SetEdns0(dctx.udpSize, dctx.doBit)
 	}
 
+	// The extended DNS errors are only added for the clients which sent EDNS0
+	// RRs.
+	if o := dctx.Res.IsEdns0(); o != nil && dctx.hasEDNS0 {
+		// Mark the stale responses as RFC 8767 recommends.
+		if dctx.fromStale {
+			o.Option = append(o.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+		}
+
+		if dctx.ede != nil {
+			o.Option = append(o.Option, dctx.ede)
+		}
+	}
+
+	// The padding of the upstream response is only meaningful for the
+	// transport it has been received over.
+	proxyutil.RemovePadding(dctx.Res)
+
 	dctx.Res.Truncate(int(dnsSize(dctx.Proto == ProtoUDP, dctx.Req)))
 	// Some devices require DNS message compression.
 	dctx.Res.Compress = true
@@ -0,0 +1,209 @@
+package proxy
+
+import "strings"
+
+// domainNodeFlags tells which entries are stored in a domainNode.
+type domainNodeFlags uint8
+
+// domainNodeFlags values.
+const (
+	// domainNodeExact means that the domain of the node itself is an entry.
+	domainNodeExact domainNodeFlags = 1 << iota
+
+	// domainNodeWildcard means that the "*." wildcard for the domain of the
+	// node is an entry.
+	domainNodeWildcard
+)
+
+// domainNode is a node of the trie of domain names keyed by their labels in
+// the reversed order, so that the common suffixes are only stored once.
+type domainNode struct {
+	// children are the nodes of the subdomains keyed by their leftmost label.
+	// It's nil for the leaves.
+	children map[string]*domainNode
+
+	// exactLists is the bit mask of the lists containing the domain itself.
+	exactLists uint64
+
+	// wildcardLists is the bit mask of the lists containing the "*." wildcard
+	// for the domain.
+	wildcardLists uint64
+
+	// flags tells which entries are stored in the node, since an entry may
+	// belong to none of the distinguishable lists.
+	flags domainNodeFlags
+}
+
+// cutLastLabel returns the rightmost label of domain and the rest of it without
+// the separating dot.  idx is the index of label within domain.
+func cutLastLabel(domain string) (rest, label string, idx int) {
+	i := strings.LastIndexByte(domain, '.')
+	if i < 0 {
+		return "", domain, 0
+	}
+
+	return domain[:i], domain[i+1:], i + 1
+}
+
+// insert adds the entry, which is either a domain or a "*." wildcard, to the
+// trie and marks it with lists.  added is true if there was no such entry.
+func (n *domainNode) insert(entry string, lists uint64) (added bool) {
+	domain, isWildcard := strings.CutPrefix(entry, "*.")
+
+	node := n
+	for domain != "" {
+		var label string
+		domain, label, _ = cutLastLabel(domain)
+
+		child, ok := node.children[label]
+		if !ok {
+			if node.children == nil {
+				node.children = map[string]*domainNode{}
+			}
+
+			child = &domainNode{}
+
+			// Clone the label so that the trie doesn't retain the whole line
+			// of the list it has been parsed from.
+			node.children[strings.Clone(label)] = child
+		}
+
+		node = child
+	}
+
+	flag, nodeLists := domainNodeExact, &node.exactLists
+	if isWildcard {
+		flag, nodeLists = domainNodeWildcard, &node.wildcardLists
+	}
+
+	added = node.flags&flag == 0
+	node.flags |= flag
+	*nodeLists |= lists
+
+	return added
+}
+
+// entryLists returns the bit mask of the lists containing the entry, which is
+// either a domain or a "*." wildcard.  ok is false if there is no such entry.
+func (n *domainNode) entryLists(entry string) (lists uint64, ok bool) {
+	domain, isWildcard := strings.CutPrefix(entry, "*.")
+
+	node := n
+	for node != nil && domain != "" {
+		var label string
+		domain, label, _ = cutLastLabel(domain)
+		node = node.children[label]
+	}
+
+	switch {
+	case node == nil:
+		return 0, false
+	case isWildcard:
+		return node.wildcardLists, node.flags&domainNodeWildcard != 0
+	default:
+		return node.exactLists, node.flags&domainNodeExact != 0
+	}
+}
+
+// match returns the entry matching domain for which isBlocked returns true for
+// its lists.  The domain itself is preferred, then the most specific "*."
+// wildcard, which matches both the domain it's for and all its subdomains.
+func (n *domainNode) match(domain string, isBlocked func(lists uint64) bool) (entry string, ok bool) {
+	wildcardIdx := -1
+
+	node, rest := n, domain
+	for rest != "" {
+		var label string
+		var idx int
+		rest, label, idx = cutLastLabel(rest)
+
+		node = node.children[label]
+		if node == nil {
+			break
+		}
+
+		if node.flags&domainNodeWildcard != 0 && isBlocked(node.wildcardLists) {
+			wildcardIdx = idx
+		}
+	}
+
+	if node != nil && node.flags&domainNodeExact != 0 && isBlocked(node.exactLists) {
+		return domain, true
+	}
+
+	if wildcardIdx >= 0 {
+		return "*." + domain[wildcardIdx:], true
+	}
+
+	return "", false
+}
+
+// walk calls fn for each entry of the trie, which is either a domain or a "*."
+// wildcard, along with the bit mask of its lists.  domain is the domain of n.
+func (n *domainNode) walk(domain string, fn func(entry string, lists uint64)) {
+	if n.flags&domainNodeExact != 0 {
+		fn(domain, n.exactLists)
+	}
+
+	if n.flags&domainNodeWildcard != 0 {
+		fn("*."+domain, n.wildcardLists)
+	}
+
+	for label, child := range n.children {
+		childDomain := label
+		if domain != "" {
+			childDomain = label + "." + domain
+		}
+
+		child.walk(childDomain, fn)
+	}
+}
+
+// remove clears the bits of lists from the entry, which is either a domain or
+// a "*." wildcard, and removes the entry if no lists are left.  The nodes left
+// without entries and children are removed as well.  removed is true if the
+// entry has been removed.
+func (n *domainNode) remove(entry string, lists uint64) (removed bool) {
+	domain, isWildcard := strings.CutPrefix(entry, "*.")
+
+	return n.removeFrom(domain, isWildcard, lists)
+}
+
+// removeFrom is the recursive part of remove.  domain is relative to n.
+func (n *domainNode) removeFrom(domain string, isWildcard bool, lists uint64) (removed bool) {
+	if domain != "" {
+		rest, label, _ := cutLastLabel(domain)
+		child := n.children[label]
+		if child == nil {
+			return false
+		}
+
+		removed = child.removeFrom(rest, isWildcard, lists)
+		if child.flags == 0 && len(child.children) == 0 {
+			delete(n.children, label)
+			if len(n.children) == 0 {
+				n.children = nil
+			}
+		}
+
+		return removed
+	}
+
+	flag, nodeLists := domainNodeExact, &n.exactLists
+	if isWildcard {
+		flag, nodeLists = domainNodeWildcard, &n.wildcardLists
+	}
+
+	if n.flags&flag == 0 {
+		return false
+	}
+
+	*nodeLists &^= lists
+	if *nodeLists != 0 {
+		return false
+	}
+
+	n.flags &^= flag
+
+	return true
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainNode_match(t *testing.T) {
+	root := &domainNode{}
+
+	assert.True(t, root.insert("exact.example", 1))
+	assert.True(t, root.insert("*.wild.example", 1))
+	assert.True(t, root.insert("*.sub.wild.example", 2))
+	assert.True(t, root.insert("sub.wild.example", 2))
+	assert.True(t, root.insert("*.com", 4))
+	assert.False(t, root.insert("exact.example", 2))
+
+	all := func(_ uint64) bool { return true }
+
+	testCases := []struct {
+		isBlocked func(lists uint64) bool
+		name      string
+		domain    string
+		wantEntry string
+		wantOK    bool
+	}{{
+		isBlocked: all,
+		name:      "exact",
+		domain:    "exact.example",
+		wantEntry: "exact.example",
+		wantOK:    true,
+	}, {
+		isBlocked: all,
+		name:      "exact_subdomain",
+		domain:    "a.exact.example",
+		wantEntry: "",
+		wantOK:    false,
+	}, {
+		isBlocked: all,
+		name:      "exact_parent",
+		domain:    "example",
+		wantEntry: "",
+		wantOK:    false,
+	}, {
+		isBlocked: all,
+		name:      "wildcard_itself",
+		domain:    "wild.example",
+		wantEntry: "*.wild.example",
+		wantOK:    true,
+	}, {
+		isBlocked: all,
+		name:      "wildcard_subdomain",
+		domain:    "a.b.wild.example",
+		wantEntry: "*.wild.example",
+		wantOK:    true,
+	}, {
+		isBlocked: all,
+		name:      "exact_over_wildcard",
+		domain:    "sub.wild.example",
+		wantEntry: "sub.wild.example",
+		wantOK:    true,
+	}, {
+		isBlocked: all,
+		name:      "most_specific_wildcard",
+		domain:    "a.sub.wild.example",
+		wantEntry: "*.sub.wild.example",
+		wantOK:    true,
+	}, {
+		isBlocked: func(lists uint64) bool { return lists&1 != 0 },
+		name:      "filtered_wildcard",
+		domain:    "a.sub.wild.example",
+		wantEntry: "*.wild.example",
+		wantOK:    true,
+	}, {
+		isBlocked: func(lists uint64) bool { return lists&2 != 0 },
+		name:      "filtered_exact",
+		domain:    "exact.example",
+		wantEntry: "exact.example",
+		wantOK:    true,
+	}, {
+		isBlocked: func(lists uint64) bool { return lists&8 != 0 },
+		name:      "filtered_out",
+		domain:    "a.sub.wild.example",
+		wantEntry: "",
+		wantOK:    false,
+	}, {
+		isBlocked: all,
+		name:      "tld_wildcard",
+		domain:    "anything.com",
+		wantEntry: "*.com",
+		wantOK:    true,
+	}, {
+		isBlocked: all,
+		name:      "unknown",
+		domain:    "unknown.org",
+		wantEntry: "",
+		wantOK:    false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			entry, ok := root.match(tc.domain, tc.isBlocked)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.wantEntry, entry)
+		})
+	}
+}
+
+func TestDomainNode_entryLists(t *testing.T) {
+	root := &domainNode{}
+	root.insert("a.example", 1)
+	root.insert("a.example", 2)
+	root.insert("*.a.example", 4)
+
+	lists, ok := root.entryLists("a.example")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), lists)
+
+	lists, ok = root.entryLists("*.a.example")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(4), lists)
+
+	_, ok = root.entryLists("example")
+	assert.False(t, ok)
+
+	_, ok = root.entryLists("b.a.example")
+	assert.False(t, ok)
+}
+
+func TestDomainNode_remove(t *testing.T) {
+	root := &domainNode{}
+	root.insert("a.b.example", 1)
+	root.insert("*.b.example", 1|2)
+	root.insert("c.example", 2)
+
+	assert.False(t, root.remove("a.example", 1))
+	assert.False(t, root.remove("*.b.example", 2))
+
+	_, ok := root.entryLists("*.b.example")
+	assert.True(t, ok)
+
+	// The nodes of b.example are kept, since it has a wildcard entry.
+	assert.True(t, root.remove("a.b.example", 1))
+
+	b := root.children["example"].children["b"]
+	require.NotNil(t, b)
+	assert.Nil(t, b.children)
+
+	assert.True(t, root.remove("*.b.example", 1))
+	assert.True(t, root.remove("c.example", 2))
+
+	assert.Nil(t, root.children)
+	assert.Equal(t, &domainNode{}, root)
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// ECSMode defines how the proxy treats the EDNS Client Subnet option supplied
+// by the client before sending the request to the upstreams.
+type ECSMode string
+
+// ECSMode values.
+const (
+	// ECSModeDefault is the same as [ECSModeOff].
+	ECSModeDefault ECSMode = ""
+
+	// ECSModeOff forwards the client-supplied option as is.
+	ECSModeOff ECSMode = "off"
+
+	// ECSModeStrip removes the client-supplied option.
+	ECSModeStrip ECSMode = "strip"
+
+	// ECSModeClamp shortens the source prefix of the client-supplied option to
+	// [Config.ECSClampPrefixLenIPv4] or [Config.ECSClampPrefixLenIPv6] if it's
+	// longer.  The option is removed if the length is zero.
+	ECSModeClamp ECSMode = "clamp"
+)
+
+// validateECS returns an error if the EDNS Client Subnet configuration is
+// invalid.
+func (p *Proxy) validateECS() (err error) {
+	if l := p.ECSPrefixLenIPv4; l < 0 || l > netutil.IPv4BitLen {
+		return fmt.Errorf("ipv4 prefix length %d out of range [0, %d]", l, netutil.IPv4BitLen)
+	}
+
+	if l := p.ECSPrefixLenIPv6; l < 0 || l > netutil.IPv6BitLen {
+		return fmt.Errorf("ipv6 prefix length %d out of range [0, %d]", l, netutil.IPv6BitLen)
+	}
+
+	switch p.ECSMode {
+	case ECSModeDefault, ECSModeOff, ECSModeStrip:
+		return nil
+	case ECSModeClamp:
+		// Go on.
+	default:
+		return fmt.Errorf("unknown ecs mode %q", p.ECSMode)
+	}
+
+	if l := p.ECSClampPrefixLenIPv4; l < 0 || l > netutil.IPv4BitLen {
+		return fmt.Errorf("ipv4 clamp prefix length %d out of range [0, %d]", l, netutil.IPv4BitLen)
+	}
+
+	if l := p.ECSClampPrefixLenIPv6; l < 0 || l > netutil.IPv6BitLen {
+		return fmt.Errorf("ipv6 clamp prefix length %d out of range [0, %d]", l, netutil.IPv6BitLen)
+	}
+
+	return nil
+}
+
+// scrubECS applies [Config.ECSMode] to the EDNS Client Subnet option of the
+// request from dctx.  It must be called before the option is used.
+func (p *Proxy) scrubECS(dctx *DNSContext) {
+	opt := dctx.Req.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	switch p.ECSMode {
+	case ECSModeStrip:
+		opt.Option = slices.DeleteFunc(opt.Option, isECSOption)
+	case ECSModeClamp:
+		opt.Option = slices.DeleteFunc(opt.Option, p.clampECS)
+	default:
+		// Forward the option as is.
+	}
+}
+
+// isECSOption returns true if e is an EDNS Client Subnet option.
+func isECSOption(e dns.EDNS0) (ok bool) {
+	_, ok = e.(*dns.EDNS0_SUBNET)
+
+	return ok
+}
+
+// clampECS shortens the source prefix of e, if it's an EDNS Client Subnet
+// option, to the configured length and masks its address accordingly.  del is
+// true if e should be removed from the request instead.
+func (p *Proxy) clampECS(e dns.EDNS0) (del bool) {
+	sn, ok := e.(*dns.EDNS0_SUBNET)
+	if !ok {
+		return false
+	}
+
+	var maxLen, bits int
+	switch sn.Family {
+	case 1:
+		maxLen, bits = p.ECSClampPrefixLenIPv4, netutil.IPv4BitLen
+	case 2:
+		maxLen, bits = p.ECSClampPrefixLenIPv6, netutil.IPv6BitLen
+	default:
+		// Don't forward the options which can't be clamped.
+		return true
+	}
+
+	if maxLen == 0 {
+		return true
+	}
+
+	if int(sn.SourceNetmask) > maxLen {
+		sn.SourceNetmask = uint8(maxLen)
+		sn.Address = sn.Address.Mask(net.CIDRMask(maxLen, bits))
+	}
+
+	return false
+}
+
+// cacheWithECS returns true if the cached responses should be keyed by the
+// EDNS Client Subnet sent to the upstreams.
+func (p *Proxy) cacheWithECS() (ok bool) {
+	return p.EnableEDNSClientSubnet || p.ECSMode == ECSModeClamp
+}
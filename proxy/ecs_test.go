@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newECSTestMessage returns a new A request for host with the EDNS Client
+// Subnet option for subnet, if it's valid.
+func newECSTestMessage(host string, subnet netip.Prefix) (req *dns.Msg) {
+	req = newHostTestMessage(host)
+	if !subnet.IsValid() {
+		return req
+	}
+
+	e := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(subnet.Bits()),
+		Address:       subnet.Addr().AsSlice(),
+	}
+	if subnet.Addr().Is6() {
+		e.Family = 2
+	}
+
+	req.SetEdns0(defaultUDPBufSize, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, e)
+
+	return req
+}
+
+func TestProxy_scrubECS(t *testing.T) {
+	testCases := []struct {
+		subnet  netip.Prefix
+		want    *net.IPNet
+		name    string
+		ecsMode ECSMode
+	}{{
+		subnet:  netip.MustParsePrefix("192.0.2.0/24"),
+		want:    &net.IPNet{IP: net.IP{192, 0, 2, 0}, Mask: net.CIDRMask(24, 32)},
+		name:    "off",
+		ecsMode: ECSModeOff,
+	}, {
+		subnet:  netip.MustParsePrefix("192.0.2.0/24"),
+		want:    nil,
+		name:    "strip",
+		ecsMode: ECSModeStrip,
+	}, {
+		subnet:  netip.MustParsePrefix("192.0.2.128/25"),
+		want:    &net.IPNet{IP: net.IP{192, 0, 0, 0}, Mask: net.CIDRMask(16, 32)},
+		name:    "clamp_ipv4",
+		ecsMode: ECSModeClamp,
+	}, {
+		subnet:  netip.MustParsePrefix("192.0.0.0/12"),
+		want:    &net.IPNet{IP: net.IP{192, 0, 0, 0}, Mask: net.CIDRMask(12, 32)},
+		name:    "clamp_coarser",
+		ecsMode: ECSModeClamp,
+	}, {
+		subnet: netip.MustParsePrefix("2001:db8:1:2::/64"),
+		want: &net.IPNet{
+			IP:   net.ParseIP("2001:db8:1::"),
+			Mask: net.CIDRMask(48, 128),
+		},
+		name:    "clamp_ipv6",
+		ecsMode: ECSModeClamp,
+	}, {
+		subnet:  netip.Prefix{},
+		want:    nil,
+		name:    "no_ecs",
+		ecsMode: ECSModeClamp,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: Config{
+				ECSMode:               tc.ecsMode,
+				ECSClampPrefixLenIPv4: 16,
+				ECSClampPrefixLenIPv6: 48,
+			}}
+
+			dctx := &DNSContext{Req: newECSTestMessage("host", tc.subnet)}
+			p.scrubECS(dctx)
+
+			got, _ := ecsFromMsg(dctx.Req)
+			if tc.want == nil {
+				assert.Nil(t, got)
+
+				return
+			}
+
+			require.NotNil(t, got)
+
+			assert.True(t, tc.want.IP.Equal(got.IP))
+			assert.Equal(t, tc.want.Mask, got.Mask)
+		})
+	}
+
+	t.Run("clamp_zero", func(t *testing.T) {
+		p := &Proxy{Config: Config{ECSMode: ECSModeClamp}}
+
+		dctx := &DNSContext{
+			Req: newECSTestMessage("host", netip.MustParsePrefix("192.0.2.0/24")),
+		}
+		p.scrubECS(dctx)
+
+		got, _ := ecsFromMsg(dctx.Req)
+		assert.Nil(t, got)
+	})
+}
+
+func TestProxy_validateECS(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		conf       Config
+	}{{
+		name:       "default",
+		wantErrMsg: "",
+		conf:       Config{},
+	}, {
+		name:       "strip",
+		wantErrMsg: "",
+		conf:       Config{ECSMode: ECSModeStrip},
+	}, {
+		name:       "clamp",
+		wantErrMsg: "",
+		conf: Config{
+			ECSMode:               ECSModeClamp,
+			ECSClampPrefixLenIPv4: 24,
+			ECSClampPrefixLenIPv6: 56,
+		},
+	}, {
+		name:       "prefix_lengths",
+		wantErrMsg: "",
+		conf: Config{
+			ECSPrefixLenIPv4: 32,
+			ECSPrefixLenIPv6: 128,
+		},
+	}, {
+		name:       "bad_prefix_ipv4",
+		wantErrMsg: "ipv4 prefix length 64 out of range [0, 32]",
+		conf:       Config{ECSPrefixLenIPv4: 64},
+	}, {
+		name:       "bad_prefix_ipv6",
+		wantErrMsg: "ipv6 prefix length 129 out of range [0, 128]",
+		conf:       Config{ECSPrefixLenIPv6: 129},
+	}, {
+		name:       "unknown",
+		wantErrMsg: `unknown ecs mode "bad"`,
+		conf:       Config{ECSMode: "bad"},
+	}, {
+		name:       "bad_ipv4",
+		wantErrMsg: "ipv4 clamp prefix length 33 out of range [0, 32]",
+		conf: Config{
+			ECSMode:               ECSModeClamp,
+			ECSClampPrefixLenIPv4: 33,
+		},
+	}, {
+		name:       "bad_ipv6",
+		wantErrMsg: "ipv6 clamp prefix length -1 out of range [0, 128]",
+		conf: Config{
+			ECSMode:               ECSModeClamp,
+			ECSClampPrefixLenIPv6: -1,
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: tc.conf}
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, p.validateECS())
+		})
+	}
+}
+
+func TestDNSContext_processECS(t *testing.T) {
+	testCases := []struct {
+		name    string
+		addr    netip.AddrPort
+		want    string
+		lenIPv4 uint8
+		lenIPv6 uint8
+	}{{
+		name:    "ipv4",
+		addr:    netip.MustParseAddrPort("1.2.100.1:53"),
+		want:    "1.2.96.0/20",
+		lenIPv4: 20,
+		lenIPv6: 56,
+	}, {
+		name:    "ipv6",
+		addr:    netip.MustParseAddrPort("[2a00:1450:1:2::1]:53"),
+		want:    "2a00:1450::/32",
+		lenIPv4: 24,
+		lenIPv6: 32,
+	}, {
+		name:    "ipv4_hidden",
+		addr:    netip.MustParseAddrPort("1.2.100.1:53"),
+		want:    "0.0.0.0/0",
+		lenIPv4: 0,
+		lenIPv6: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &DNSContext{
+				Req:  newHostTestMessage("host"),
+				Addr: tc.addr,
+			}
+			dctx.processECS(nil, tc.lenIPv4, tc.lenIPv6)
+
+			require.NotNil(t, dctx.ReqECS)
+			assert.Equal(t, tc.want, dctx.ReqECS.String())
+
+			sent, _ := ecsFromMsg(dctx.Req)
+			require.NotNil(t, sent)
+			assert.Equal(t, tc.want, sent.String())
+		})
+	}
+}
+
+func TestProxy_Resolve_ecsClampCache(t *testing.T) {
+	var sent []*net.IPNet
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			ecs, _ := ecsFromMsg(m)
+			sent = append(sent, ecs)
+
+			resp = (&dns.Msg{}).SetReply(m)
+			if opt := m.IsEdns0(); opt != nil {
+				// Echo the options with the scope of the whole subnet.
+				for _, e := range opt.Option {
+					if sn, ok := e.(*dns.EDNS0_SUBNET); ok {
+						sn.SourceScope = sn.SourceNetmask
+					}
+				}
+				resp.Extra = append(resp.Extra, opt)
+			}
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   m.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    300,
+				},
+				A: net.IP{192, 0, 2, 1},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		ECSMode:                ECSModeClamp,
+		ECSClampPrefixLenIPv4:  16,
+		ECSClampPrefixLenIPv6:  48,
+	})
+
+	resolve := func(subnet string) {
+		t.Helper()
+
+		d := &DNSContext{
+			Req:  newECSTestMessage("host", netip.MustParsePrefix(subnet)),
+			Addr: netip.MustParseAddrPort("192.0.2.2:1234"),
+		}
+		require.NoError(t, p.Resolve(d))
+	}
+
+	resolve("198.51.100.0/24")
+	require.Len(t, sent, 1)
+	require.NotNil(t, sent[0])
+	assert.Equal(t, "198.51.0.0/16", sent[0].String())
+
+	// The same clamped subnet is served from the cache.
+	resolve("198.51.1.0/24")
+	assert.Len(t, sent, 1)
+
+	// Another clamped subnet isn't.
+	resolve("203.0.113.0/24")
+	require.Len(t, sent, 2)
+	require.NotNil(t, sent[1])
+	assert.Equal(t, "203.0.0.0/16", sent[1].String())
+}
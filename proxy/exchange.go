@@ -21,6 +21,11 @@ func (p *Proxy) exchangeUpstreams(
 	switch p.UpstreamMode {
 	case UModeParallel:
 		return upstream.ExchangeParallel(ups, req)
+	case UModeRandom:
+		// Go on to the load-balancing mode with a single upstream.
+		if len(ups) > 1 {
+			ups = []upstream.Upstream{ups[p.randSrc.Uint64()%uint64(len(ups))]}
+		}
 	case UModeFastestAddr:
 		switch req.Question[0].Qtype {
 		case dns.TypeA, dns.TypeAAAA:
@@ -40,24 +45,30 @@ func (p *Proxy) exchangeUpstreams(
 		return resp, u, err
 	}
 
-	w := sampleuv.NewWeighted(p.calcWeights(ups), p.randSrc)
+	weights := p.calcWeights(ups)
+	w := sampleuv.NewWeighted(weights, p.randSrc)
 	var errs []error
 	for i, ok := w.Take(); ok; i, ok = w.Take() {
-		u = ups[i]
-
-		var elapsed time.Duration
-		resp, elapsed, err = exchange(u, req, p.time)
+		resp, u, err = p.exchangeMeasured(ups[i], req)
 		if err == nil {
-			p.updateRTT(u.Address(), elapsed)
-
 			return resp, u, nil
 		}
 
 		errs = append(errs, err)
+	}
 
-		// TODO(e.burkov):  Use the actual configured timeout or, perhaps, the
-		// actual measured elapsed time.
-		p.updateRTT(u.Address(), defaultTimeout)
+	// Only use the backup upstreams when all the weighted ones have failed.
+	for i, weight := range weights {
+		if weight != 0 {
+			continue
+		}
+
+		resp, u, err = p.exchangeMeasured(ups[i], req)
+		if err == nil {
+			return resp, u, nil
+		}
+
+		errs = append(errs, err)
 	}
 
 	err = fmt.Errorf("all upstreams failed to exchange request: %w", errors.Join(errs...))
@@ -65,6 +76,27 @@ func (p *Proxy) exchangeUpstreams(
 	return nil, nil, err
 }
 
+// exchangeMeasured exchanges req with u and updates its round-trip time
+// statistics.
+func (p *Proxy) exchangeMeasured(u upstream.Upstream, req *dns.Msg) (resp *dns.Msg, _ upstream.Upstream, err error) {
+	resp, elapsed, err := exchange(u, req, p.time)
+	if err != nil {
+		// TODO(e.burkov):  Use the actual measured elapsed time.
+		timeout, ok := p.upstreamTimeout(u.Address())
+		if !ok || timeout <= 0 {
+			timeout = defaultTimeout
+		}
+
+		p.updateRTT(u.Address(), timeout)
+
+		return nil, nil, err
+	}
+
+	p.updateRTT(u.Address(), elapsed)
+
+	return resp, u, nil
+}
+
 // exchange returns the result of the DNS request exchange with the given
 // upstream and the elapsed time in milliseconds.  It uses the given clock to
 // measure the request duration.
@@ -127,18 +159,39 @@ func (p *Proxy) calcWeights(ups []upstream.Upstream) (weights []float64) {
 	defer p.rttLock.Unlock()
 
 	for _, u := range ups {
-		stat := p.upstreamRTTStats[u.Address()]
+		addr := u.Address()
+		configured := p.upstreamWeight(addr)
+
+		stat := p.upstreamRTTStats[addr]
 		if stat.rttSum == 0 || stat.reqNum == 0 {
-			// Use 1 as the default weight.
-			weights = append(weights, 1)
+			// Use the configured weight as is until the RTT is measured.
+			weights = append(weights, configured)
 		} else {
-			weights = append(weights, 1/(stat.rttSum/stat.reqNum))
+			weights = append(weights, configured/(stat.rttSum/stat.reqNum))
 		}
 	}
 
 	return weights
 }
 
+// upstreamWeight returns the configured weight of the upstream with the given
+// address.  The weights of the upstreams from [CustomUpstreamConfig] aren't
+// considered.
+func (p *Proxy) upstreamWeight(addr string) (w float64) {
+	ups := p.upstreams()
+	for _, uc := range []*UpstreamConfig{
+		ups.UpstreamConfig,
+		ups.PrivateRDNSUpstreamConfig,
+		ups.Fallbacks,
+	} {
+		if weight, ok := uc.weight(addr); ok {
+			return float64(weight)
+		}
+	}
+
+	return defaultUpstreamWeight
+}
+
 // updateRTT updates the round-trip time in [upstreamRTTStats] for given
 // address.
 func (p *Proxy) updateRTT(address string, rtt time.Duration) {
@@ -11,6 +11,7 @@ import (
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/exp/rand"
 )
 
@@ -238,3 +239,153 @@ func TestProxy_Exchange_loadBalance(t *testing.T) {
 		})
 	}
 }
+
+func TestProxy_selectUpstreams_mode(t *testing.T) {
+	ups := []upstream.Upstream{
+		newUpstreamWithErrorRate(1_000, "one"),
+		newUpstreamWithErrorRate(1_000, "two"),
+		newUpstreamWithErrorRate(1_000, "three"),
+	}
+
+	req := newTestMessage()
+	cli := netip.AddrPortFrom(netutil.IPv4Localhost(), 1234)
+
+	testCases := []struct {
+		name string
+		mode UpstreamModeType
+	}{{
+		name: "load_balance",
+		mode: UModeLoadBalance,
+	}, {
+		name: "parallel",
+		mode: UModeParallel,
+	}, {
+		name: "fastest_addr",
+		mode: UModeFastestAddr,
+	}, {
+		name: "random",
+		mode: UModeRandom,
+	}}
+
+	for _, tc := range testCases {
+		p := mustNew(t, &Config{
+			UpstreamConfig:         &UpstreamConfig{Upstreams: ups},
+			UpstreamMode:           tc.mode,
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+		})
+
+		t.Run(tc.name, func(t *testing.T) {
+			selected, isPrivate := p.selectUpstreams(&DNSContext{Req: req, Addr: cli}, p.upstreams())
+			assert.False(t, isPrivate)
+			assert.Equal(t, ups, selected)
+		})
+	}
+}
+
+func TestProxy_Exchange_random(t *testing.T) {
+	const requestsNum = 300
+
+	stats := map[string]int64{}
+	ups := []upstream.Upstream{}
+	for _, name := range []string{"one", "two", "three"} {
+		ups = append(ups, measuredUpstream{
+			Upstream: newUpstreamWithErrorRate(requestsNum+1, name),
+			stats:    stats,
+		})
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig:         &UpstreamConfig{Upstreams: ups},
+		UpstreamMode:           UModeRandom,
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+	p.randSrc = rand.NewSource(42)
+
+	req := newTestMessage()
+	for range requestsNum {
+		_, _, err := p.exchangeUpstreams(req, ups)
+		require.NoError(t, err)
+	}
+
+	var total int64
+	for name, n := range stats {
+		assert.Positive(t, n, name)
+		total += n
+	}
+
+	assert.Len(t, stats, len(ups))
+	assert.Equal(t, int64(requestsNum), total)
+}
+
+func TestProxy_Exchange_weights(t *testing.T) {
+	const requestsNum = 1_000
+
+	stats := map[string]int64{}
+	newUps := func(name string, failing bool) (u upstream.Upstream) {
+		rate := uint(requestsNum + 1)
+		if failing {
+			rate = 1
+		}
+
+		return measuredUpstream{
+			Upstream: newUpstreamWithErrorRate(rate, name),
+			stats:    stats,
+		}
+	}
+
+	// Don't let the measured RTT affect the weights.
+	constClock := &fakeClock{onNow: func() (now time.Time) { return time.Unix(0, 0) }}
+
+	req := newTestMessage()
+	testCases := []struct {
+		wantStat map[string]int64
+		name     string
+		ups      []upstream.Upstream
+		weights  map[string]uint
+	}{{
+		wantStat: map[string]int64{"heavy": 891, "light": 109},
+		name:     "weighted",
+		ups:      []upstream.Upstream{newUps("heavy", false), newUps("light", false)},
+		weights:  map[string]uint{"heavy": 9},
+	}, {
+		wantStat: map[string]int64{"main": requestsNum},
+		name:     "backup_unused",
+		ups:      []upstream.Upstream{newUps("backup", false), newUps("main", false)},
+		weights:  map[string]uint{"backup": 0},
+	}, {
+		wantStat: map[string]int64{"main": requestsNum, "backup": requestsNum},
+		name:     "backup_used",
+		ups:      []upstream.Upstream{newUps("backup", false), newUps("main", true)},
+		weights:  map[string]uint{"backup": 0},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clear(stats)
+
+			p := mustNew(t, &Config{
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: tc.ups,
+					Weights:   tc.weights,
+				},
+				TrustedProxies:         defaultTrustedProxies,
+				RatelimitSubnetLenIPv4: 24,
+				RatelimitSubnetLenIPv6: 64,
+			})
+			p.time = constClock
+			p.randSrc = rand.NewSource(42)
+
+			for range requestsNum {
+				_, u, err := p.exchangeUpstreams(req, tc.ups)
+				require.NoError(t, err)
+				require.NotNil(t, u)
+			}
+
+			assert.Equal(t, tc.wantStat, stats)
+		})
+	}
+}
@@ -2,62 +2,79 @@ package proxy
 
 // TODO(rafal): nothing to do
 
-import "sync"
+import (
+	"strings"
+	"sync"
+)
 
 // Edm is a pointer to the ExcludedDomainsManager instance.
 var Edm = NewExcludedDomainsManager()
 
 // ExcludedDomainsManager is a struct that keeps track of the excluded domains. It is used to keep track of the number of excluded domains.
 type ExcludedDomainsManager struct {
-	hosts      []string
+	// root is the root of the trie of the excluded domains and "*."
+	// wildcards.  The wildcards exclude both the domain itself and all its
+	// subdomains.
+	root       *domainNode
 	numDomains int
 	mux        sync.Mutex
 }
 
-// NewExcludedDomainsManager creates a new ExcludedDomainsManager instance and returns it. It initializes the ExcludedDomainsManager with an empty slice of hosts and sets the number of domains to 0. The function returns a pointer to the created instance.
+// NewExcludedDomainsManager creates a new ExcludedDomainsManager instance and returns it. It initializes the ExcludedDomainsManager with an empty trie of hosts and sets the number of domains to 0. The function returns a pointer to the created instance.
 func NewExcludedDomainsManager() *ExcludedDomainsManager {
 	return &ExcludedDomainsManager{
-		hosts:      []string{},
+		root:       &domainNode{},
 		numDomains: 0,
 	}
 }
 
-// AddDomain is a method of the ExcludedDomainsManager class. It adds a domain to the list of excluded domains. It locks the mutex to ensure thread safety. It checks if the domain already exists in the list of excluded domains. If the domain does not exist, it appends the domain to the list of excluded domains and increments the number of domains.
+// AddDomain is a method of the ExcludedDomainsManager class. It adds a domain, which may also be a "*." wildcard, to the excluded domains. It locks the mutex to ensure thread safety. If the domain is not excluded yet, it increments the number of domains.
 func (r *ExcludedDomainsManager) AddDomain(domain string) {
 	r.mux.Lock()
-	for _, host := range r.hosts {
-		if host == domain {
-			r.mux.Unlock()
-			return
-		}
+	defer r.mux.Unlock()
+
+	if r.root.insert(normalizeDomain(domain), 0) {
+		r.numDomains++
 	}
-	r.hosts = append(r.hosts, domain)
-	r.numDomains++
-	r.mux.Unlock()
 }
 
-// CheckDomain checks if the domain is in the list of excluded domains. It locks the mutex to ensure thread safety. It returns true if the domain exists in the list of excluded domains, false otherwise.
+// CheckDomain checks if the domain, which may also be a "*." wildcard from a blocked domains list, is excluded. It locks the mutex to ensure thread safety. A wildcard is only excluded by the same wildcard or a wildcard for one of its parent domains.
 func (r *ExcludedDomainsManager) checkDomain(domain string) bool {
 	r.mux.Lock()
-	for _, host := range r.hosts {
-		if host == domain {
-			r.mux.Unlock()
+	defer r.mux.Unlock()
+
+	if r.numDomains == 0 {
+		return false
+	}
+
+	isAny := func(uint64) bool { return true }
+	if wildcardDomain, ok := strings.CutPrefix(domain, "*."); ok {
+		if _, ok = r.root.entryLists(domain); ok {
 			return true
 		}
+
+		entry, ok := r.root.match(wildcardDomain, isAny)
+
+		return ok && strings.HasPrefix(entry, "*.")
 	}
-	r.mux.Unlock()
-	return false
+
+	_, ok := r.root.match(domain, isAny)
+
+	return ok
 }
 
 // GetNumDomains returns the number of domains currently stored in the ExcludedDomainsManager. It locks the mutex to ensure thread safety. It returns the number of domains.
 func (r *ExcludedDomainsManager) getNumDomains() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
 	return r.numDomains
 }
 
 // Clear method clears the list of excluded domains in the ExcludedDomainsManager. It locks the mutex to ensure thread safety. It resets the number of domains to zero.
 func (r *ExcludedDomainsManager) clear() {
 	r.mux.Lock()
-	r.hosts = []string{}
+	r.root = &domainNode{}
 	r.numDomains = 0
 	r.mux.Unlock()
 }
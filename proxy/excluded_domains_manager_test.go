@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExcludedDomainsManager_checkDomain(t *testing.T) {
+	r := NewExcludedDomainsManager()
+	r.AddDomain("Exact.Example.")
+	r.AddDomain("*.zone.example")
+	r.AddDomain("*.zone.example")
+
+	assert.Equal(t, 2, r.getNumDomains())
+
+	testCases := []struct {
+		name   string
+		domain string
+		want   bool
+	}{{
+		name:   "exact",
+		domain: "exact.example",
+		want:   true,
+	}, {
+		name:   "exact_subdomain",
+		domain: "sub.exact.example",
+		want:   false,
+	}, {
+		name:   "exact_parent",
+		domain: "example",
+		want:   false,
+	}, {
+		name:   "wildcard_domain",
+		domain: "zone.example",
+		want:   true,
+	}, {
+		name:   "wildcard_subdomain",
+		domain: "a.b.zone.example",
+		want:   true,
+	}, {
+		name:   "wildcard_suffix_only",
+		domain: "otherzone.example",
+		want:   false,
+	}, {
+		name:   "list_wildcard_same",
+		domain: "*.zone.example",
+		want:   true,
+	}, {
+		name:   "list_wildcard_covered",
+		domain: "*.ads.zone.example",
+		want:   true,
+	}, {
+		name:   "list_wildcard_exact_only",
+		domain: "*.exact.example",
+		want:   false,
+	}, {
+		name:   "not_excluded",
+		domain: "other.example",
+		want:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, r.checkDomain(tc.domain))
+		})
+	}
+
+	r.clear()
+	assert.False(t, r.checkDomain("exact.example"))
+	assert.Zero(t, r.getNumDomains())
+}
+
+func TestLoadBlockedDomainsFiles_excludedWildcard(t *testing.T) {
+	Edm.AddDomain("*.zone.example")
+	t.Cleanup(Edm.clear)
+
+	setTestBlockedDomains(t, "ads", "ads.zone.example\n*.cdn.zone.example\nads.example\n")
+
+	for domain, want := range map[string]bool{
+		"ads.zone.example":     false,
+		"img.cdn.zone.example": false,
+		"ads.example":          true,
+	} {
+		ok, _ := Bdm.checkDomain(domain)
+		assert.Equal(t, want, ok, domain)
+	}
+}
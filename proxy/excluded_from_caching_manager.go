@@ -1,97 +1,217 @@
 package proxy
 
-// TODO (rafal): nothing
-
 import (
-	"github.com/barweiss/go-tuple"
-	"github.com/golang-collections/collections/set"
-	"strings"
+	"fmt"
 	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/utils"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
 )
 
 // Efcm is a global instance of the ExcludedFromCachingManager struct.
 var Efcm = newExcludedFromCachingManager()
 
-// ExcludedFromCachingManager is a class that manages blocked domains.
+// ExcludedFromCachingManager keeps the domains the responses for which are
+// never cached.  The domains come either from the configuration one by one or
+// from the lists in the same formats as the blocked domains lists.
 type ExcludedFromCachingManager struct {
-	hosts             map[string]*set.Set
-	domainToListIndex map[string]int
-	blockedLists      []string
-	numDomains        int
-	mux               sync.Mutex
+	// root is the root of the trie of the excluded domains and "*." wildcards
+	// along with the bit masks of the lists they come from.  The wildcards
+	// exclude both the domain itself and all its subdomains.
+	root *domainNode
+
+	// lists are the names of the lists in the order of their bits in root.
+	lists []string
+
+	// domains are the entries added with AddDomain, which are kept across the
+	// reloads of the lists.
+	domains []string
+
+	numDomains int
+	mux        sync.Mutex
+
+	// updateMux serializes the reloads of the lists.
+	updateMux sync.Mutex
 }
 
 func newExcludedFromCachingManager() *ExcludedFromCachingManager {
-
-	p := ExcludedFromCachingManager{}
-	p.mux.Lock()
-	defer p.mux.Unlock()
-	p.hosts = make(map[string]*set.Set)
-	p.domainToListIndex = make(map[string]int)
-	p.blockedLists = make([]string, 0)
-	p.numDomains = 0
-	return &p
+	return &ExcludedFromCachingManager{
+		root:  &domainNode{},
+		lists: []string{},
+	}
 }
 
-func (r *ExcludedFromCachingManager) AddDomain(domain tuple.T2[string, string]) {
+// AddDomain adds the domain, which may also be a "*." wildcard, to the
+// excluded domains.
+func (r *ExcludedFromCachingManager) AddDomain(domain string) {
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
-	domainItems := strings.Split(domain.V1, ".")
-	reverse(domainItems)
+	domain = normalizeDomain(domain)
+	r.domains = append(r.domains, domain)
+	if r.root.insert(domain, 0) {
+		r.numDomains++
+	}
+}
 
-	_, ok := r.hosts[domainItems[0]]
-	if !ok {
-		r.hosts[domainItems[0]] = set.New()
+// checkDomain returns true if the responses for the domain mustn't be cached.
+// excludedDomain is the matched entry.
+func (r *ExcludedFromCachingManager) checkDomain(domain string) (ok bool, excludedDomain string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.numDomains == 0 {
+		return false, ""
 	}
 
-	if !r.hosts[domainItems[0]].Has(domain.V1) {
-		r.numDomains++
+	excludedDomain, ok = r.root.match(domain, func(uint64) bool { return true })
+
+	return ok, excludedDomain
+}
+
+// getNumDomains returns the number of the excluded domains and wildcards.
+func (r *ExcludedFromCachingManager) getNumDomains() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.numDomains
+}
+
+// clear removes all the excluded domains, including the ones added with
+// AddDomain.
+func (r *ExcludedFromCachingManager) clear() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.root, r.lists, r.domains, r.numDomains = &domainNode{}, []string{}, nil, 0
+}
+
+// UpdateExcludedFromCaching downloads the lists older than maxAge and reloads
+// all of them into r along with the domains added with AddDomain.  Only the
+// blocking rules of the adblock syntax exclude the domain along with its
+// subdomains, the exception rules are ignored.  The previously loaded entries
+// of the lists which fail to update are kept.
+func UpdateExcludedFromCaching(r *ExcludedFromCachingManager, sources []string, maxAge time.Duration) (err error) {
+	r.updateMux.Lock()
+	defer r.updateMux.Unlock()
+
+	if len(sources) > maxBlockedLists {
+		return fmt.Errorf("too many excluded from caching lists: %d, max %d", len(sources), maxBlockedLists)
 	}
-	r.hosts[domainItems[0]].Insert(domain.V1)
 
-	if len(r.blockedLists) == 0 {
-		r.blockedLists = append(r.blockedLists, domain.V2)
+	var errs []error
+	for _, source := range sources {
+		filePath, isLocal := blockedListFilePath(source)
+		if isLocal {
+			continue
+		}
+
+		fileSize, modificationTime, statErr := utils.GetFileInfo(filePath)
+		if statErr == nil && time.Since(modificationTime) <= maxAge && fileSize > 0 {
+			continue
+		}
+
+		_, err = utils.DownloadFromUrl(source, filePath)
+		if err != nil {
+			errs = append(errs, excludedFromCachingError(fmt.Errorf("downloading %s: %w", source, err)))
+		}
 	}
 
-	for i := 0; i < len(r.blockedLists); i++ {
-		if r.blockedLists[i] == domain.V2 {
-			r.domainToListIndex[domain.V1] = i
-			break
+	r.mux.Lock()
+	domains := r.domains
+	r.mux.Unlock()
+
+	next := newExcludedFromCachingManager()
+	next.insertEntries(domains, 0)
+	for i, source := range sources {
+		filePath, _ := blockedListFilePath(source)
+		listName := utils.TrimExt(filePath)
+		next.lists = append(next.lists, listName)
+
+		parsed, _, parseErr := parseBlockedDomainsFile(filePath, listName)
+		if parseErr != nil {
+			errs = append(errs, excludedFromCachingError(fmt.Errorf("loading %s: %w", filePath, parseErr)))
+
+			// Keep the previously loaded data of the list.
+			next.insertEntries(r.listEntries(listName), 1<<i)
+
+			continue
+		}
+
+		entries := make([]string, 0, len(parsed))
+		for _, domain := range parsed {
+			entries = append(entries, domain.V1)
 		}
+
+		next.insertEntries(entries, 1<<i)
 	}
+
+	r.mux.Lock()
+	r.root, r.lists, r.numDomains = next.root, next.lists, next.numDomains
+	r.mux.Unlock()
+
+	SM.Set("excluded_from_caching::num_domains", r.getNumDomains())
+	SM.Set("excluded_from_caching::last_reload", time.Now().UTC().Format(time.RFC3339))
+	log.Info("total number of domains excluded from caching %d", r.getNumDomains())
+
+	return errors.Join(errs...)
 }
 
-func (r *ExcludedFromCachingManager) checkDomain(domain string) (bool, string) {
+// insertEntries adds the entries marked with lists to r.  r is expected to be
+// unused by the other goroutines.
+func (r *ExcludedFromCachingManager) insertEntries(entries []string, lists uint64) {
+	for _, entry := range entries {
+		if r.root.insert(normalizeDomain(entry), lists) {
+			r.numDomains++
+		}
+	}
+}
 
+// listEntries returns the entries of r which come from the list with the given
+// name.
+func (r *ExcludedFromCachingManager) listEntries(list string) (entries []string) {
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
-	if len(r.hosts) > 0 {
-		domainItems := strings.Split(domain, ".")
+	for i, name := range r.lists {
+		if name != list {
+			continue
+		}
 
-		blockedDomains, ok := r.hosts[domainItems[len(domainItems)-1]]
-		if ok {
-			if blockedDomains.Has(domain) {
-				return true, domain
+		r.root.walk("", func(entry string, lists uint64) {
+			if lists&(1<<i) != 0 {
+				entries = append(entries, entry)
 			}
+		})
+	}
 
-			for i := 0; i < len(domainItems); i++ {
-				tmpDomain := ""
-				for j := i; j < len(domainItems); j++ {
-					tmpDomain += domainItems[j] + "."
-				}
-				tmpDomain = strings.TrimSuffix(tmpDomain, ".")
-				tmpDomain = "*." + tmpDomain
-
-				if blockedDomains.Has(tmpDomain) {
-					return true, tmpDomain
-				}
-			}
-			return false, domain
-		}
-		return false, domain
-	} else {
-		return false, domain
+	return entries
+}
+
+// excludedFromCachingError logs err occurred while updating the excluded from
+// caching lists, counts it in the statistics, and returns it.
+func excludedFromCachingError(err error) error {
+	log.Error("updating domains excluded from caching: %s", err)
+
+	SM.Increment("excluded_from_caching::update_errors", 1)
+
+	return err
+}
+
+// isExcludedFromCaching returns true if the responses for the domain mustn't be
+// cached, and counts the hit in the statistics.
+func isExcludedFromCaching(domain string) (ok bool) {
+	ok, excludedDomain := Efcm.checkDomain(domain)
+	if !ok {
+		return false
 	}
+
+	log.Debug("dnsproxy: not caching response for %s excluded by rule %s", domain, excludedDomain)
+
+	SM.Increment("excluded_from_caching::excluded_responses", 1)
+	SM.Increment("excluded_from_caching::domains::"+domain, 1)
+
+	return true
 }
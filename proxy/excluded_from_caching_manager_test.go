@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExcludedFromCachingManager_checkDomain(t *testing.T) {
+	setTestStats(t)
+
+	listPath := filepath.Join(t.TempDir(), "nocache.txt")
+	err := os.WriteFile(listPath, []byte("0.0.0.0 listed.example\n||adblock.example^\n@@||exception.example^\n"), 0o644)
+	require.NoError(t, err)
+
+	r := newExcludedFromCachingManager()
+	r.AddDomain("Exact.Example.")
+	r.AddDomain("*.zone.example")
+
+	require.NoError(t, UpdateExcludedFromCaching(r, []string{listPath}, time.Hour))
+
+	assert.Equal(t, 5, r.getNumDomains())
+
+	n, _ := SM.GetUint64("excluded_from_caching::num_domains")
+	assert.Equal(t, uint64(5), n)
+
+	_, ok := SM.GetString("excluded_from_caching::last_reload")
+	assert.True(t, ok)
+
+	testCases := []struct {
+		name     string
+		domain   string
+		wantRule string
+		want     bool
+	}{{
+		name:     "exact",
+		domain:   "exact.example",
+		wantRule: "exact.example",
+		want:     true,
+	}, {
+		name:     "exact_subdomain",
+		domain:   "sub.exact.example",
+		wantRule: "",
+		want:     false,
+	}, {
+		name:     "wildcard_domain",
+		domain:   "zone.example",
+		wantRule: "*.zone.example",
+		want:     true,
+	}, {
+		name:     "wildcard_subdomain",
+		domain:   "a.b.zone.example",
+		wantRule: "*.zone.example",
+		want:     true,
+	}, {
+		name:     "wildcard_suffix_only",
+		domain:   "otherzone.example",
+		wantRule: "",
+		want:     false,
+	}, {
+		name:     "list",
+		domain:   "listed.example",
+		wantRule: "listed.example",
+		want:     true,
+	}, {
+		name:     "list_adblock",
+		domain:   "www.adblock.example",
+		wantRule: "*.adblock.example",
+		want:     true,
+	}, {
+		name:     "list_exception",
+		domain:   "exception.example",
+		wantRule: "",
+		want:     false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, rule := r.checkDomain(tc.domain)
+			assert.Equal(t, tc.want, ok)
+			assert.Equal(t, tc.wantRule, rule)
+		})
+	}
+
+	r.clear()
+	ok, _ = r.checkDomain("exact.example")
+	assert.False(t, ok)
+	assert.Zero(t, r.getNumDomains())
+}
+
+func TestUpdateExcludedFromCaching_failedList(t *testing.T) {
+	setTestStats(t)
+
+	listPath := filepath.Join(t.TempDir(), "nocache.txt")
+	err := os.WriteFile(listPath, []byte("listed.example\n"), 0o644)
+	require.NoError(t, err)
+
+	r := newExcludedFromCachingManager()
+	r.AddDomain("exact.example")
+
+	require.NoError(t, UpdateExcludedFromCaching(r, []string{listPath}, time.Hour))
+	require.NoError(t, os.Remove(listPath))
+
+	err = UpdateExcludedFromCaching(r, []string{listPath}, time.Hour)
+	require.Error(t, err)
+
+	for _, domain := range []string{"exact.example", "listed.example"} {
+		ok, _ := r.checkDomain(domain)
+		assert.True(t, ok, domain)
+	}
+
+	n, _ := SM.GetUint64("excluded_from_caching::update_errors")
+	assert.Equal(t, uint64(1), n)
+}
+
+func TestProxy_Resolve_excludedFromCaching(t *testing.T) {
+	setTestStats(t)
+
+	prev := Efcm
+	Efcm = newExcludedFromCachingManager()
+	t.Cleanup(func() { Efcm = prev })
+
+	Efcm.AddDomain("*.nocache.example")
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(m)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IP{192, 0, 2, 2},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake.example:53" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+	})
+
+	resolve := func(t *testing.T, host string) (fromCache bool) {
+		t.Helper()
+
+		dctx := &DNSContext{
+			Req:   (&dns.Msg{}).SetQuestion(host, dns.TypeA),
+			Proto: ProtoUDP,
+			Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+
+		require.NoError(t, p.Resolve(dctx))
+
+		return dctx.fromCache
+	}
+
+	for range 2 {
+		assert.False(t, resolve(t, "www.nocache.example."))
+	}
+
+	assert.False(t, resolve(t, "cached.example."))
+	assert.True(t, resolve(t, "cached.example."))
+
+	n, _ := SM.GetUint64("excluded_from_caching::excluded_responses")
+	assert.Equal(t, uint64(2), n)
+
+	n, _ = SM.GetUint64("excluded_from_caching::domains::www.nocache.example")
+	assert.Equal(t, uint64(2), n)
+}
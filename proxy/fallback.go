@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// FallbackTrigger is a condition of the result of the exchange with the
+// primary upstreams which makes the proxy resend the request to
+// [Config.Fallbacks].
+type FallbackTrigger string
+
+// FallbackTrigger values.
+const (
+	// FallbackTriggerError triggers on the errors of the exchange, e.g. the
+	// network ones and timeouts.
+	FallbackTriggerError FallbackTrigger = "error"
+
+	// FallbackTriggerServfail triggers on the SERVFAIL responses.
+	FallbackTriggerServfail FallbackTrigger = "servfail"
+
+	// FallbackTriggerRefused triggers on the REFUSED responses.
+	FallbackTriggerRefused FallbackTrigger = "refused"
+
+	// FallbackTriggerNXDomain triggers on the NXDOMAIN responses.
+	FallbackTriggerNXDomain FallbackTrigger = "nxdomain"
+)
+
+// defaultFallbackTriggers are the triggers used when none is configured.
+var defaultFallbackTriggers = []FallbackTrigger{FallbackTriggerError}
+
+// validateFallbackTriggers returns an error if any of the configured fallback
+// triggers is unknown.
+func (p *Proxy) validateFallbackTriggers() (err error) {
+	for i, t := range p.FallbackTriggers {
+		switch t {
+		case
+			FallbackTriggerError,
+			FallbackTriggerServfail,
+			FallbackTriggerRefused,
+			FallbackTriggerNXDomain:
+			// Go on.
+		default:
+			return fmt.Errorf("trigger at index %d: unknown trigger %q", i, t)
+		}
+	}
+
+	return nil
+}
+
+// fallbackTrigger returns the trigger matching the result of the exchange with
+// the primary upstreams.  ok is false if there is no such trigger or it isn't
+// configured.
+func (p *Proxy) fallbackTrigger(resp *dns.Msg, err error) (t FallbackTrigger, ok bool) {
+	switch {
+	case err != nil:
+		t = FallbackTriggerError
+	case resp == nil:
+		return "", false
+	case resp.Rcode == dns.RcodeServerFailure:
+		t = FallbackTriggerServfail
+	case resp.Rcode == dns.RcodeRefused:
+		t = FallbackTriggerRefused
+	case resp.Rcode == dns.RcodeNameError:
+		t = FallbackTriggerNXDomain
+	default:
+		return "", false
+	}
+
+	triggers := p.FallbackTriggers
+	if len(triggers) == 0 {
+		triggers = defaultFallbackTriggers
+	}
+
+	return t, slices.Contains(triggers, t)
+}
+
+// countFallbackTrigger records the use of the fallbacks due to t in the
+// statistics.
+func countFallbackTrigger(t FallbackTrigger) {
+	SM.Increment("fallback::triggers::"+string(t), 1)
+}
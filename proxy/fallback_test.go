@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_replyFromUpstream_fallbackTriggers(t *testing.T) {
+	// newUpstream returns a new upstream responding with rcode, or failing if
+	// rcode is negative.
+	newUpstream := func(rcode int, calls *int) (u upstream.Upstream) {
+		return &fakeUpstream{
+			onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+				*calls++
+				if rcode < 0 {
+					return nil, errors.Error("test error")
+				}
+
+				return (&dns.Msg{}).SetRcode(m, rcode), nil
+			},
+			onAddress: func() (addr string) { return "upstream.example:53" },
+			onClose:   func() (err error) { return nil },
+		}
+	}
+
+	testCases := []struct {
+		name         string
+		triggers     []FallbackTrigger
+		rcode        int
+		wantFallback bool
+	}{{
+		name:         "default_error",
+		triggers:     nil,
+		rcode:        -1,
+		wantFallback: true,
+	}, {
+		name:         "default_servfail",
+		triggers:     nil,
+		rcode:        dns.RcodeServerFailure,
+		wantFallback: false,
+	}, {
+		name:         "servfail",
+		triggers:     []FallbackTrigger{FallbackTriggerServfail},
+		rcode:        dns.RcodeServerFailure,
+		wantFallback: true,
+	}, {
+		name:         "refused",
+		triggers:     []FallbackTrigger{FallbackTriggerError, FallbackTriggerRefused},
+		rcode:        dns.RcodeRefused,
+		wantFallback: true,
+	}, {
+		name:         "nxdomain_not_configured",
+		triggers:     []FallbackTrigger{FallbackTriggerServfail, FallbackTriggerRefused},
+		rcode:        dns.RcodeNameError,
+		wantFallback: false,
+	}, {
+		name:         "nxdomain",
+		triggers:     []FallbackTrigger{FallbackTriggerNXDomain},
+		rcode:        dns.RcodeNameError,
+		wantFallback: true,
+	}, {
+		name:         "error_not_configured",
+		triggers:     []FallbackTrigger{FallbackTriggerServfail},
+		rcode:        -1,
+		wantFallback: false,
+	}, {
+		name:         "success",
+		triggers:     []FallbackTrigger{FallbackTriggerError, FallbackTriggerServfail},
+		rcode:        dns.RcodeSuccess,
+		wantFallback: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setTestStats(t)
+
+			var primaryCalls, fallbackCalls int
+			p := mustNew(t, &Config{
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{newUpstream(tc.rcode, &primaryCalls)},
+				},
+				Fallbacks: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{newUpstream(dns.RcodeSuccess, &fallbackCalls)},
+				},
+				FallbackTriggers:       tc.triggers,
+				TrustedProxies:         defaultTrustedProxies,
+				RatelimitSubnetLenIPv4: 24,
+				RatelimitSubnetLenIPv6: 64,
+			})
+
+			d := &DNSContext{Req: (&dns.Msg{}).SetQuestion("fallback.example.", dns.TypeA)}
+			_, _ = p.replyFromUpstream(d)
+
+			assert.Equal(t, 1, primaryCalls)
+			assert.Equal(t, tc.wantFallback, d.fromFallback)
+
+			var wantCalls, wantCount uint64
+			if tc.wantFallback {
+				wantCalls, wantCount = 1, 1
+
+				require.NotNil(t, d.Res)
+				assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+			}
+
+			assert.Equal(t, wantCalls, uint64(fallbackCalls))
+
+			trigger, _ := p.fallbackTrigger(newRcodeTestResp(tc.rcode))
+			n, _ := SM.GetUint64("fallback::triggers::" + string(trigger))
+			assert.Equal(t, wantCount, n)
+		})
+	}
+
+	t.Run("fallback_fails", func(t *testing.T) {
+		var primaryCalls, fallbackCalls int
+		p := mustNew(t, &Config{
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{
+					newUpstream(dns.RcodeServerFailure, &primaryCalls),
+				},
+			},
+			Fallbacks: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{newUpstream(-1, &fallbackCalls)},
+			},
+			FallbackTriggers:       []FallbackTrigger{FallbackTriggerServfail},
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+		})
+
+		d := &DNSContext{Req: (&dns.Msg{}).SetQuestion("fallback.example.", dns.TypeA)}
+		ok, err := p.replyFromUpstream(d)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		assert.Equal(t, 1, fallbackCalls)
+		assert.False(t, d.fromFallback)
+		assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+	})
+}
+
+// newRcodeTestResp returns the result of the exchange responding with rcode,
+// or failing if rcode is negative.
+func newRcodeTestResp(rcode int) (resp *dns.Msg, err error) {
+	if rcode < 0 {
+		return nil, errors.Error("test error")
+	}
+
+	return &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: rcode}}, nil
+}
+
+func TestProxy_validateFallbackTriggers(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		triggers   []FallbackTrigger
+	}{{
+		name:       "empty",
+		wantErrMsg: "",
+		triggers:   nil,
+	}, {
+		name:       "valid",
+		wantErrMsg: "",
+		triggers:   []FallbackTrigger{FallbackTriggerError, FallbackTriggerNXDomain},
+	}, {
+		name:       "unknown",
+		wantErrMsg: `trigger at index 1: unknown trigger "formerr"`,
+		triggers:   []FallbackTrigger{FallbackTriggerServfail, "formerr"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: Config{FallbackTriggers: tc.triggers}}
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, p.validateFallbackTriggers())
+		})
+	}
+}
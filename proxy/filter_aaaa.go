@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// newFilterAAAA returns the trie of the domains the AAAA records are filtered
+// for.  Each of domains is either a domain name or a "*." wildcard, which
+// matches both the domain itself and all its subdomains.  root is nil if
+// domains are empty.
+func newFilterAAAA(domains []string) (root *domainNode, err error) {
+	if len(domains) == 0 {
+		return nil, nil
+	}
+
+	root = &domainNode{}
+	for i, d := range domains {
+		d = normalizeDomain(d)
+		err = netutil.ValidateDomainName(strings.TrimPrefix(d, "*."))
+		if err != nil {
+			return nil, fmt.Errorf("filter aaaa domain at index %d: %w", i, err)
+		}
+
+		root.insert(d, 0)
+	}
+
+	return root, nil
+}
+
+// isAAAAFiltered returns true if the AAAA records for name are filtered.
+func (p *Proxy) isAAAAFiltered(name string) (ok bool) {
+	if p.filterAAAA == nil {
+		return false
+	}
+
+	_, ok = p.filterAAAA.match(normalizeDomain(name), func(uint64) bool { return true })
+
+	return ok
+}
+
+// filterAAAARequest answers the AAAA request of dctx with NODATA if its name is
+// filtered.  It returns true if dctx.Res is set.
+func (p *Proxy) filterAAAARequest(dctx *DNSContext) (ok bool) {
+	if len(dctx.Req.Question) != 1 {
+		return false
+	}
+
+	q := dctx.Req.Question[0]
+	if q.Qtype != dns.TypeAAAA || !p.isAAAAFiltered(q.Name) {
+		return false
+	}
+
+	log.Debug("dnsproxy: filtering aaaa request for %s", q.Name)
+
+	dctx.Res = genEmptyNoError(dctx.Req)
+	dctx.Upstream = nil
+
+	return true
+}
+
+// filterAAAAResponse removes the AAAA records for the filtered names from the
+// answer of the response in dctx, leaving the other records untouched.
+func (p *Proxy) filterAAAAResponse(dctx *DNSContext) {
+	if p.filterAAAA == nil || dctx.Res == nil {
+		return
+	}
+
+	n := 0
+	for _, rr := range dctx.Res.Answer {
+		hdr := rr.Header()
+		if hdr.Rrtype != dns.TypeAAAA || !p.isAAAAFiltered(hdr.Name) {
+			dctx.Res.Answer[n] = rr
+			n++
+		}
+	}
+
+	if n == len(dctx.Res.Answer) {
+		return
+	}
+
+	log.Debug("dnsproxy: filtered %d aaaa records", len(dctx.Res.Answer)-n)
+
+	clear(dctx.Res.Answer[n:])
+	dctx.Res.Answer = dctx.Res.Answer[:n]
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFilterAAAA(t *testing.T) {
+	root, err := newFilterAAAA(nil)
+	require.NoError(t, err)
+	assert.Nil(t, root)
+
+	_, err = newFilterAAAA([]string{"example.org", "*.bad domain"})
+	testutil.AssertErrorMsg(
+		t,
+		`filter aaaa domain at index 1: bad domain name "bad domain": `+
+			`bad top-level domain name label "bad domain": `+
+			`bad top-level domain name label rune ' '`,
+		err,
+	)
+}
+
+func TestProxy_Resolve_filterAAAA(t *testing.T) {
+	var upstreamReqs atomic.Int32
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			upstreamReqs.Add(1)
+
+			q := m.Question[0]
+			name := q.Name
+			resp = (&dns.Msg{}).SetReply(m)
+
+			if strings.EqualFold(name, "alias.example.") {
+				name = "v6.broken.example."
+				resp.Answer = append(resp.Answer, &dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:   q.Name,
+						Rrtype: dns.TypeCNAME,
+						Class:  dns.ClassINET,
+						Ttl:    300,
+					},
+					Target: name,
+				})
+			}
+
+			if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    300,
+					},
+					A: net.IP{192, 0, 2, 1},
+				})
+			}
+
+			if q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+				resp.Answer = append(resp.Answer, &dns.AAAA{
+					Hdr: dns.RR_Header{
+						Name:   name,
+						Rrtype: dns.TypeAAAA,
+						Class:  dns.ClassINET,
+						Ttl:    300,
+					},
+					AAAA: net.ParseIP("2001:db8::1"),
+				})
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		FilterAAAADomains:      []string{"*.broken.example", "Exact.Example."},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	// answerStrings returns the data of the answer records.
+	answerStrings := func(resp *dns.Msg) (res []string) {
+		for _, rr := range resp.Answer {
+			res = append(res, strings.TrimPrefix(rr.String(), rr.Header().String()))
+		}
+
+		return res
+	}
+
+	testCases := []struct {
+		name         string
+		host         string
+		want         []string
+		qtype        uint16
+		wantSOA      bool
+		wantUpstream bool
+	}{{
+		name:         "request_exact",
+		host:         "exact.example.",
+		want:         nil,
+		qtype:        dns.TypeAAAA,
+		wantSOA:      true,
+		wantUpstream: false,
+	}, {
+		name:         "request_wildcard",
+		host:         "www.broken.example.",
+		want:         nil,
+		qtype:        dns.TypeAAAA,
+		wantSOA:      true,
+		wantUpstream: false,
+	}, {
+		name:         "request_wildcard_itself",
+		host:         "broken.example.",
+		want:         nil,
+		qtype:        dns.TypeAAAA,
+		wantSOA:      true,
+		wantUpstream: false,
+	}, {
+		name:         "a_untouched",
+		host:         "exact.example.",
+		want:         []string{"192.0.2.1"},
+		qtype:        dns.TypeA,
+		wantSOA:      false,
+		wantUpstream: true,
+	}, {
+		name:         "response_dual",
+		host:         "exact.example.",
+		want:         []string{"192.0.2.1"},
+		qtype:        dns.TypeANY,
+		wantSOA:      false,
+		wantUpstream: true,
+	}, {
+		name:         "response_cname",
+		host:         "alias.example.",
+		want:         []string{"v6.broken.example."},
+		qtype:        dns.TypeAAAA,
+		wantSOA:      false,
+		wantUpstream: true,
+	}, {
+		name:         "not_filtered",
+		host:         "sub.exact.example.",
+		want:         []string{"2001:db8::1"},
+		qtype:        dns.TypeAAAA,
+		wantSOA:      false,
+		wantUpstream: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			upstreamReqs.Store(0)
+
+			dctx := &DNSContext{
+				Req:   (&dns.Msg{}).SetQuestion(tc.host, tc.qtype),
+				Proto: ProtoUDP,
+				Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+			}
+
+			require.NoError(t, p.Resolve(dctx))
+			require.NotNil(t, dctx.Res)
+
+			assert.Equal(t, dns.RcodeSuccess, dctx.Res.Rcode)
+			assert.Equal(t, tc.want, answerStrings(dctx.Res))
+			assert.Equal(t, tc.wantUpstream, upstreamReqs.Load() > 0)
+
+			if tc.wantSOA {
+				require.Len(t, dctx.Res.Ns, 1)
+
+				testutil.RequireTypeAssert[*dns.SOA](t, dctx.Res.Ns[0])
+			}
+		})
+	}
+}
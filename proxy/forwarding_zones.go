@@ -0,0 +1,347 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// forwardingZoneCacheOpt is the prefix of the option of the forwarding zone
+// which toggles caching of the responses for it.
+const forwardingZoneCacheOpt = "cache="
+
+// ForwardingZone is a single conditional forwarding zone.
+type ForwardingZone struct {
+	// Zone is the lowercased domain name of the zone without the trailing dot.
+	// The zone includes the domain itself and all its subdomains.
+	Zone string
+
+	// Upstreams are the addresses of the upstreams for the zone, in the same
+	// format as the ones accepted by [ParseUpstreamsConfig].
+	Upstreams []string
+
+	// Line is the number of the line the zone is defined at, starting with 1.
+	Line int
+
+	// Cache is false if the responses for the zone are never cached.
+	Cache bool
+}
+
+// ParseForwardingZones parses the forwarding zones from r.  Each non-empty
+// line, except for the comments starting with "#", defines a single zone:
+//
+//	<zone> <upstream> [<upstream>...] [cache=<bool>]
+//
+// For example:
+//
+//	corp.example  10.0.0.53 10.0.0.54
+//	lab.local     192.168.1.53|timeout=200ms  cache=false
+//
+// The caching is enabled by default.  Duplicate zones and zones within other
+// zones are rejected.  The errors contain the numbers of the offending lines.
+func ParseForwardingZones(r io.Reader) (zones []*ForwardingZone, err error) {
+	var errs []error
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		z, zErr := parseForwardingZone(text)
+		if zErr != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", line, zErr))
+
+			continue
+		}
+
+		z.Line = line
+		zones = append(zones, z)
+	}
+
+	if err = s.Err(); err != nil {
+		return nil, fmt.Errorf("reading forwarding zones: %w", err)
+	}
+
+	errs = append(errs, validateForwardingZones(zones)...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return zones, nil
+}
+
+// parseForwardingZone parses a single non-empty line of the forwarding zones.
+func parseForwardingZone(text string) (z *ForwardingZone, err error) {
+	fields := strings.Fields(text)
+
+	z = &ForwardingZone{
+		Zone:  strings.ToLower(strings.TrimSuffix(fields[0], ".")),
+		Cache: true,
+	}
+
+	if err = netutil.ValidateDomainName(z.Zone); err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	for _, f := range fields[1:] {
+		opt, ok := strings.CutPrefix(f, forwardingZoneCacheOpt)
+		if !ok {
+			z.Upstreams = append(z.Upstreams, f)
+
+			continue
+		}
+
+		z.Cache, err = strconv.ParseBool(opt)
+		if err != nil {
+			return nil, fmt.Errorf("bad cache option %q: %w", opt, err)
+		}
+	}
+
+	if len(z.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams for zone %q", z.Zone)
+	}
+
+	return z, nil
+}
+
+// validateForwardingZones returns the errors about the duplicate and the
+// nested zones.
+func validateForwardingZones(zones []*ForwardingZone) (errs []error) {
+	byName := make(map[string]*ForwardingZone, len(zones))
+	for _, z := range zones {
+		if prev, ok := byName[z.Zone]; ok {
+			errs = append(errs, fmt.Errorf(
+				"line %d: duplicate zone %q, first defined at line %d",
+				z.Line,
+				z.Zone,
+				prev.Line,
+			))
+
+			continue
+		}
+
+		byName[z.Zone] = z
+	}
+
+	for _, z := range zones {
+		for _, parent := range parentDomains(z.Zone) {
+			if prev, ok := byName[parent]; ok {
+				errs = append(errs, fmt.Errorf(
+					"line %d: zone %q overlaps zone %q at line %d",
+					z.Line,
+					z.Zone,
+					prev.Zone,
+					prev.Line,
+				))
+
+				break
+			}
+		}
+	}
+
+	return errs
+}
+
+// parentDomains returns the parent domains of the domain name, from the
+// closest one.
+func parentDomains(domain string) (parents []string) {
+	for {
+		_, domain, _ = strings.Cut(domain, ".")
+		if domain == "" {
+			return parents
+		}
+
+		parents = append(parents, domain)
+	}
+}
+
+// ForwardingZones are the conditional forwarding zones loaded from a file.
+// The upstreams for a zone take priority over the ones from
+// [Config.UpstreamConfig].
+type ForwardingZones struct {
+	// conf contains the upstreams of the zones as the domain-specific
+	// upstreams without any default ones.
+	conf *UpstreamConfig
+
+	// opts are the options the upstreams are created with.
+	opts *upstream.Options
+
+	// noCache contains the FQDNs of the zones the responses for which are
+	// never cached.
+	noCache map[string]unit
+
+	// path is the path to the file the zones are loaded from.
+	path string
+}
+
+// type check
+var _ io.Closer = (*ForwardingZones)(nil)
+
+// LoadForwardingZones loads the forwarding zones from the file at path and
+// creates their upstreams using opts.  See [ParseForwardingZones] for the
+// format of the file.
+func LoadForwardingZones(path string, opts *upstream.Options) (fz *ForwardingZones, err error) {
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening forwarding zones: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	zones, err := ParseForwardingZones(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	fz, err = NewForwardingZones(zones, opts)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	fz.path = path
+
+	return fz, nil
+}
+
+// NewForwardingZones returns the forwarding zones with the upstreams created
+// using opts.  The errors contain the numbers of the lines of the zones with
+// the invalid upstreams.
+func NewForwardingZones(zones []*ForwardingZone, opts *upstream.Options) (fz *ForwardingZones, err error) {
+	lines := make([]string, 0, len(zones))
+	noCache := map[string]unit{}
+	for _, z := range zones {
+		lines = append(lines, "[/"+z.Zone+"/]"+strings.Join(z.Upstreams, " "))
+		if !z.Cache {
+			noCache[z.Zone+"."] = unit{}
+		}
+	}
+
+	conf, err := ParseUpstreamsConfig(lines, opts)
+	if err != nil {
+		closeErr := conf.Close()
+
+		return nil, errors.WithDeferred(zoneLineErrors(zones, err), closeErr)
+	}
+
+	return &ForwardingZones{
+		conf:    conf,
+		opts:    opts,
+		noCache: noCache,
+	}, nil
+}
+
+// zoneLineErrors replaces the indexes of the lines within the errors returned
+// by [ParseUpstreamsConfig] with the numbers of the lines of the zones.
+func zoneLineErrors(zones []*ForwardingZone, err error) (res error) {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return err
+	}
+
+	var errs []error
+	for _, e := range joined.Unwrap() {
+		pe := &ParseError{}
+		if errors.As(e, &pe) && pe.Idx < len(zones) {
+			e = fmt.Errorf("line %d: %w", zones[pe.Idx].Line, pe.Unwrap())
+		}
+
+		errs = append(errs, e)
+	}
+
+	return errors.Join(errs...)
+}
+
+// upstreams returns the upstreams of the zone containing fqdn, if any.
+// getUpstreams is the same as for [UpstreamConfig].
+func (fz *ForwardingZones) upstreams(
+	getUpstreams func(uc *UpstreamConfig, fqdn string) (ups []upstream.Upstream),
+	fqdn string,
+) (ups []upstream.Upstream) {
+	if fz == nil {
+		return nil
+	}
+
+	return getUpstreams(fz.conf, fqdn)
+}
+
+// cacheDisabled returns true if fqdn belongs to a zone the responses for which
+// are never cached.
+func (fz *ForwardingZones) cacheDisabled(fqdn string) (ok bool) {
+	if fz == nil || len(fz.noCache) == 0 {
+		return false
+	}
+
+	fqdn = strings.ToLower(fqdn)
+	for ; fqdn != ""; _, fqdn, _ = strings.Cut(fqdn, ".") {
+		if _, ok = fz.noCache[fqdn]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// upstreamConfig returns the upstreams of the zones, if any.
+func (fz *ForwardingZones) upstreamConfig() (uc *UpstreamConfig) {
+	if fz == nil {
+		return nil
+	}
+
+	return fz.conf
+}
+
+// Close implements the [io.Closer] interface for *ForwardingZones.
+func (fz *ForwardingZones) Close() (err error) {
+	return fz.conf.Close()
+}
+
+// forwardingZones returns the current forwarding zones, if any.
+func (p *Proxy) forwardingZones() (fz *ForwardingZones) {
+	return p.zones.Load()
+}
+
+// ReloadForwardingZones loads the forwarding zones again from the same file as
+// the current ones and replaces them.  The current zones are kept if the file
+// is invalid.
+func (p *Proxy) ReloadForwardingZones() (err error) {
+	cur := p.forwardingZones()
+	if cur == nil || cur.path == "" {
+		return errors.Error("no forwarding zones file configured")
+	}
+
+	fz, err := LoadForwardingZones(cur.path, cur.opts)
+	if err != nil {
+		return fmt.Errorf("reloading forwarding zones: %w", err)
+	}
+
+	p.SetForwardingZones(fz)
+
+	return nil
+}
+
+// SetForwardingZones replaces the forwarding zones of p with fz and closes the
+// previous ones.  fz may be nil to disable the forwarding zones.
+func (p *Proxy) SetForwardingZones(fz *ForwardingZones) {
+	prev := p.zones.Swap(fz)
+	if prev == nil {
+		return
+	}
+
+	err := prev.Close()
+	if err != nil {
+		log.Debug("dnsproxy: closing previous forwarding zones: %s", err)
+	}
+
+	log.Info("dnsproxy: forwarding zones replaced")
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForwardingZones(t *testing.T) {
+	testCases := []struct {
+		name       string
+		in         string
+		wantErrMsg string
+		want       []*ForwardingZone
+	}{{
+		name: "valid",
+		in: "# Zones.\n" +
+			"\n" +
+			"Corp.Example. 10.0.0.53 10.0.0.54\n" +
+			"lab.local 192.168.1.53 cache=false\n",
+		wantErrMsg: "",
+		want: []*ForwardingZone{{
+			Zone:      "corp.example",
+			Upstreams: []string{"10.0.0.53", "10.0.0.54"},
+			Line:      3,
+			Cache:     true,
+		}, {
+			Zone:      "lab.local",
+			Upstreams: []string{"192.168.1.53"},
+			Line:      4,
+			Cache:     false,
+		}},
+	}, {
+		name:       "no_upstreams",
+		in:         "corp.example cache=true\n",
+		wantErrMsg: `line 1: no upstreams for zone "corp.example"`,
+		want:       nil,
+	}, {
+		name: "bad_cache",
+		in:   "corp.example 10.0.0.53 cache=maybe\n",
+		wantErrMsg: `line 1: bad cache option "maybe": ` +
+			`strconv.ParseBool: parsing "maybe": invalid syntax`,
+		want: nil,
+	}, {
+		name: "duplicate",
+		in:   "corp.example 10.0.0.53\nCORP.example 10.0.0.54\n",
+		wantErrMsg: `line 2: duplicate zone "corp.example", ` +
+			`first defined at line 1`,
+		want: nil,
+	}, {
+		name: "overlap",
+		in:   "dev.corp.example 10.0.0.54\n\ncorp.example 10.0.0.53\n",
+		wantErrMsg: `line 1: zone "dev.corp.example" overlaps zone ` +
+			`"corp.example" at line 3`,
+		want: nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			zones, err := ParseForwardingZones(strings.NewReader(tc.in))
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			assert.Equal(t, tc.want, zones)
+		})
+	}
+
+	t.Run("bad_zone", func(t *testing.T) {
+		// The message of the domain name validation error belongs to golibs,
+		// so only check the line number.
+		_, err := ParseForwardingZones(strings.NewReader("\ncorp..example 10.0.0.53\n"))
+		require.Error(t, err)
+
+		assert.True(t, strings.HasPrefix(err.Error(), "line 2: "), err.Error())
+	})
+}
+
+func TestNewForwardingZones_badUpstream(t *testing.T) {
+	zones := []*ForwardingZone{{
+		Zone:      "corp.example",
+		Upstreams: []string{"10.0.0.53"},
+		Line:      1,
+		Cache:     true,
+	}, {
+		Zone:      "lab.local",
+		Upstreams: []string{"bad://10.0.0.54"},
+		Line:      7,
+		Cache:     true,
+	}}
+
+	_, err := NewForwardingZones(zones, &upstream.Options{})
+	require.Error(t, err)
+
+	assert.True(t, strings.HasPrefix(err.Error(), "line 7: "), err.Error())
+}
+
+func TestProxy_forwardingZones(t *testing.T) {
+	const (
+		zonesFile = "forwarding_zones.conf"
+		corpAddr  = "10.0.0.53:53"
+		labAddr   = "192.168.1.53:53"
+	)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, zonesFile)
+	writeZones := func(t *testing.T, data string) {
+		t.Helper()
+
+		require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+	}
+
+	writeZones(t, "corp.example "+corpAddr+"\nlab.local "+labAddr+" cache=false\n")
+
+	fz, err := LoadForwardingZones(path, &upstream.Options{})
+	require.NoError(t, err)
+
+	dflt := &fakeUpstream{onAddress: func() (a string) { return "default" }}
+	p := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{dflt},
+		},
+		ForwardingZones:        fz,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		return p.forwardingZones().Close()
+	})
+
+	selectAddr := func(t *testing.T, host string) (addr string) {
+		t.Helper()
+
+		req := &dns.Msg{}
+		req.SetQuestion(host, dns.TypeA)
+
+		ups, _ := p.selectUpstreams(&DNSContext{Req: req}, p.upstreams())
+		require.Len(t, ups, 1)
+
+		return ups[0].Address()
+	}
+
+	assert.Equal(t, "10.0.0.53:53", selectAddr(t, "host.corp.example."))
+	assert.Equal(t, "192.168.1.53:53", selectAddr(t, "LAB.local."))
+	assert.Equal(t, "default", selectAddr(t, "example.org."))
+
+	newCtx := func(host string) (dctx *DNSContext) {
+		req := &dns.Msg{}
+		req.SetQuestion(host, dns.TypeA)
+
+		return &DNSContext{Req: req}
+	}
+
+	assert.True(t, p.cacheWorks(newCtx("host.corp.example.")))
+	assert.False(t, p.cacheWorks(newCtx("host.lab.local.")))
+
+	t.Run("reload", func(t *testing.T) {
+		writeZones(t, "corp.example "+labAddr+"\n")
+
+		require.NoError(t, p.ReloadForwardingZones())
+
+		assert.Equal(t, "192.168.1.53:53", selectAddr(t, "host.corp.example."))
+		assert.Equal(t, "default", selectAddr(t, "host.lab.local."))
+		assert.True(t, p.cacheWorks(newCtx("host.lab.local.")))
+	})
+
+	t.Run("reload_invalid", func(t *testing.T) {
+		writeZones(t, "corp.example\n")
+
+		err = p.ReloadForwardingZones()
+		testutil.AssertErrorMsg(
+			t,
+			"reloading forwarding zones: parsing "+path+
+				`: line 1: no upstreams for zone "corp.example"`,
+			err,
+		)
+
+		assert.Equal(t, "192.168.1.53:53", selectAddr(t, "host.corp.example."))
+	})
+}
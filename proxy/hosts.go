@@ -0,0 +1,353 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/hostsfile"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultHostsReloadInterval is the default interval between the checks
+	// of the hosts files for changes.
+	defaultHostsReloadInterval = time.Minute
+
+	// hostsResponseTTL is the TTL of the records generated from the hosts
+	// files.
+	hostsResponseTTL = 10
+)
+
+// hostsFileState is the state of a hosts file used to detect its changes.
+type hostsFileState struct {
+	// modTime is the modification time of the file.
+	modTime time.Time
+
+	// size is the size of the file.
+	size int64
+
+	// exists is false if the file doesn't exist.
+	exists bool
+}
+
+// hostsFiles answers the requests for the names and the addresses from the
+// hosts files and reloads the files when they change.
+type hostsFiles struct {
+	// mux protects storage and states.
+	mux *sync.RWMutex
+
+	// storage contains the records of all the files.
+	storage *hostsfile.DefaultStorage
+
+	// states are the last seen states of the files by their paths.
+	states map[string]hostsFileState
+
+	// done is closed when the files are closed to stop the reloading.  It's
+	// recreated on each start.
+	done chan struct{}
+
+	// paths are the paths to the hosts files.
+	paths []string
+
+	// interval is the interval between the checks of the files for changes.
+	interval time.Duration
+}
+
+// initHosts loads the configured hosts files, if any.
+func (p *Proxy) initHosts() (err error) {
+	if len(p.HostsFiles) == 0 {
+		return nil
+	}
+
+	p.hosts, err = newHostsFiles(p.HostsFiles, p.HostsReloadInterval)
+	if err != nil {
+		return fmt.Errorf("hosts files: %w", err)
+	}
+
+	return nil
+}
+
+// newHostsFiles returns a new *hostsFiles with the files at paths loaded.  The
+// files missing are considered empty.
+func newHostsFiles(paths []string, interval time.Duration) (hf *hostsFiles, err error) {
+	hf = &hostsFiles{
+		mux:      &sync.RWMutex{},
+		paths:    paths,
+		interval: cmp.Or(interval, defaultHostsReloadInterval),
+	}
+
+	hf.storage, hf.states, err = loadHostsFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	return hf, nil
+}
+
+// loadHostsFiles parses the files at paths and returns their states.
+func loadHostsFiles(
+	paths []string,
+) (strg *hostsfile.DefaultStorage, states map[string]hostsFileState, err error) {
+	// The error is always nil here since no readers passed.
+	strg, _ = hostsfile.NewDefaultStorage()
+	states = make(map[string]hostsFileState, len(paths))
+
+	for _, path := range paths {
+		var st hostsFileState
+		st, err = parseHostsFile(strg, path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading hosts file %q: %w", path, err)
+		}
+
+		states[path] = st
+	}
+
+	return strg, states, nil
+}
+
+// parseHostsFile parses the file at path into strg and returns its state.
+func parseHostsFile(strg *hostsfile.DefaultStorage, path string) (st hostsFileState, err error) {
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Debug("dnsproxy: hosts file %q doesn't exist", path)
+
+			return hostsFileState{}, nil
+		}
+
+		// Don't wrap the error since it's informative enough as is.
+		return hostsFileState{}, err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return hostsFileState{}, err
+	}
+
+	err = hostsfile.Parse(strg, f, nil)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return hostsFileState{}, err
+	}
+
+	return hostsFileState{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		exists:  true,
+	}, nil
+}
+
+// statHostsFile returns the current state of the file at path.
+func statHostsFile(path string) (st hostsFileState, err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return hostsFileState{}, nil
+		}
+
+		// Don't wrap the error since it's informative enough as is.
+		return hostsFileState{}, err
+	}
+
+	return hostsFileState{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		exists:  true,
+	}, nil
+}
+
+// start starts checking the files for changes every hf.interval until hf is
+// closed.  It must not be called concurrently with Close.
+func (hf *hostsFiles) start() {
+	done := make(chan struct{})
+	hf.done = done
+
+	go func() {
+		defer log.OnPanic("hosts files reload")
+
+		ticker := time.NewTicker(hf.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				hf.reloadIfChanged()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// Close implements the [io.Closer] interface for *hostsFiles.
+func (hf *hostsFiles) Close() (err error) {
+	close(hf.done)
+
+	return nil
+}
+
+// reloadIfChanged reloads all the files if any of them has changed.  The
+// previously loaded records are kept if the files can't be loaded.
+func (hf *hostsFiles) reloadIfChanged() {
+	if !hf.changed() {
+		return
+	}
+
+	strg, states, err := loadHostsFiles(hf.paths)
+	if err != nil {
+		log.Error("dnsproxy: reloading hosts files: %s", err)
+
+		return
+	}
+
+	hf.mux.Lock()
+	defer hf.mux.Unlock()
+
+	hf.storage, hf.states = strg, states
+
+	log.Info("dnsproxy: hosts files reloaded")
+}
+
+// changed returns true if any of the files has changed since it was loaded.
+func (hf *hostsFiles) changed() (ok bool) {
+	hf.mux.RLock()
+	defer hf.mux.RUnlock()
+
+	for _, path := range hf.paths {
+		st, err := statHostsFile(path)
+		if err != nil {
+			log.Debug("dnsproxy: checking hosts file: %s", err)
+
+			continue
+		}
+
+		prev := hf.states[path]
+		if st.exists != prev.exists || st.size != prev.size || !st.modTime.Equal(prev.modTime) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolve returns the response for req from the hosts files, or nil if the
+// files contain nothing for it.  Only A, AAAA, and PTR requests are answered.
+func (hf *hostsFiles) resolve(req *dns.Msg) (resp *dns.Msg) {
+	q := req.Question[0]
+
+	hf.mux.RLock()
+	defer hf.mux.RUnlock()
+
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		addrs := hf.storage.ByName(strings.TrimSuffix(q.Name, "."))
+		if len(addrs) == 0 {
+			return nil
+		}
+
+		return genHostsAddrResponse(req, addrs)
+	case dns.TypePTR:
+		addr, err := netutil.IPFromReversedAddr(q.Name)
+		if err != nil {
+			return nil
+		}
+
+		names := hf.storage.ByAddr(addr)
+		if len(names) == 0 {
+			return nil
+		}
+
+		return genHostsPTRResponse(req, names)
+	default:
+		return nil
+	}
+}
+
+// genHostsAddrResponse returns the response with the addresses of the
+// requested family.  The response has no answers if there are no addresses of
+// that family, since the name still exists.
+func genHostsAddrResponse(req *dns.Msg, addrs []netip.Addr) (resp *dns.Msg) {
+	resp = genEmptyNoError(req)
+
+	q := req.Question[0]
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    hostsResponseTTL,
+	}
+
+	for _, addr := range addrs {
+		var rr dns.RR
+		switch {
+		case q.Qtype == dns.TypeA && addr.Unmap().Is4():
+			rr = &dns.A{Hdr: hdr, A: addr.Unmap().AsSlice()}
+		case q.Qtype == dns.TypeAAAA && addr.Is6() && !addr.Is4In6():
+			rr = &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()}
+		default:
+			continue
+		}
+
+		resp.Answer = append(resp.Answer, rr)
+	}
+
+	if len(resp.Answer) > 0 {
+		resp.Ns = nil
+	}
+
+	return resp
+}
+
+// genHostsPTRResponse returns the response with the names for the requested
+// address.
+func genHostsPTRResponse(req *dns.Msg, names []string) (resp *dns.Msg) {
+	resp = genEmptyNoError(req)
+	resp.Ns = nil
+
+	q := req.Question[0]
+	for _, name := range names {
+		resp.Answer = append(resp.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    hostsResponseTTL,
+			},
+			Ptr: dns.Fqdn(strings.ToLower(name)),
+		})
+	}
+
+	return resp
+}
+
+// replyFromHosts tries to answer the request from the hosts files.  It returns
+// true if dctx.Res is set.
+func (p *Proxy) replyFromHosts(dctx *DNSContext) (ok bool) {
+	if p.hosts == nil || len(dctx.Req.Question) == 0 {
+		return false
+	}
+
+	resp := p.hosts.resolve(dctx.Req)
+	if resp == nil {
+		return false
+	}
+
+	log.Debug("dnsproxy: answering %s from hosts files", dctx.Req.Question[0].Name)
+
+	dctx.Res = resp
+	dctx.Upstream = nil
+
+	return true
+}
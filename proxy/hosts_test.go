@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_hosts(t *testing.T) {
+	setTestBlockedDomains(t, "ads", "router.lan\nblocked.example\n")
+
+	dir := t.TempDir()
+	hostsPath := filepath.Join(dir, "hosts")
+	extraPath := filepath.Join(dir, "hosts.extra")
+
+	err := os.WriteFile(hostsPath, []byte("192.168.1.1 router.lan Router\n"), 0o644)
+	require.NoError(t, err)
+
+	err = os.WriteFile(extraPath, []byte("2001:db8::1 nas.lan\n"), 0o644)
+	require.NoError(t, err)
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		HostsFiles:             []string{hostsPath, extraPath, filepath.Join(dir, "missing")},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		BlockingMode:           BlockingModeREFUSED,
+	})
+
+	resolve := func(t *testing.T, host string, qtype uint16) (dctx *DNSContext) {
+		t.Helper()
+
+		dctx = &DNSContext{
+			Req:   (&dns.Msg{}).SetQuestion(host, qtype),
+			Proto: ProtoUDP,
+			Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+
+		require.NoError(t, p.Resolve(dctx))
+		require.NotNil(t, dctx.Res)
+
+		return dctx
+	}
+
+	t.Run("a_over_blocked", func(t *testing.T) {
+		dctx := resolve(t, "ROUTER.lan.", dns.TypeA)
+
+		assert.Nil(t, dctx.Upstream)
+		assert.Equal(t, dns.RcodeSuccess, dctx.Res.Rcode)
+		require.Len(t, dctx.Res.Answer, 1)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, dctx.Res.Answer[0])
+		assert.Equal(t, net.IP{192, 168, 1, 1}, a.A)
+		assert.Equal(t, uint32(hostsResponseTTL), a.Hdr.Ttl)
+	})
+
+	t.Run("aaaa_nodata", func(t *testing.T) {
+		dctx := resolve(t, "router.lan.", dns.TypeAAAA)
+
+		assert.Nil(t, dctx.Upstream)
+		assert.Equal(t, dns.RcodeSuccess, dctx.Res.Rcode)
+		assert.Empty(t, dctx.Res.Answer)
+	})
+
+	t.Run("aaaa_extra", func(t *testing.T) {
+		dctx := resolve(t, "nas.lan.", dns.TypeAAAA)
+
+		require.Len(t, dctx.Res.Answer, 1)
+
+		aaaa := testutil.RequireTypeAssert[*dns.AAAA](t, dctx.Res.Answer[0])
+		assert.Equal(t, net.ParseIP("2001:db8::1"), aaaa.AAAA)
+	})
+
+	t.Run("ptr", func(t *testing.T) {
+		dctx := resolve(t, "1.1.168.192.in-addr.arpa.", dns.TypePTR)
+
+		require.Len(t, dctx.Res.Answer, 2)
+
+		ptr := testutil.RequireTypeAssert[*dns.PTR](t, dctx.Res.Answer[0])
+		assert.Equal(t, "router.lan.", ptr.Ptr)
+	})
+
+	t.Run("blocked_not_in_hosts", func(t *testing.T) {
+		dctx := resolve(t, "blocked.example.", dns.TypeA)
+
+		assert.Equal(t, dns.RcodeRefused, dctx.Res.Rcode)
+	})
+
+	t.Run("upstream", func(t *testing.T) {
+		dctx := resolve(t, "example.org.", dns.TypeA)
+
+		assert.Equal(t, ups, dctx.Upstream)
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		err = os.WriteFile(hostsPath, []byte("192.168.1.2 router.lan\n"), 0o644)
+		require.NoError(t, err)
+
+		// Make sure the change is noticed even on the file systems with the
+		// coarse modification times.
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(hostsPath, later, later))
+
+		p.hosts.reloadIfChanged()
+
+		dctx := resolve(t, "router.lan.", dns.TypeA)
+		require.Len(t, dctx.Res.Answer, 1)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, dctx.Res.Answer[0])
+		assert.Equal(t, net.IP{192, 168, 1, 2}, a.A)
+	})
+}
+
+func TestProxy_Init_hosts(t *testing.T) {
+	hostsPath := filepath.Join(t.TempDir(), "hosts")
+	err := os.WriteFile(hostsPath, []byte("192.168.1.1 router.lan\n"), 0o644)
+	require.NoError(t, err)
+
+	p := &Proxy{
+		Config: Config{
+			UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+			HostsFiles:             []string{hostsPath},
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+		},
+	}
+	require.NoError(t, p.Init())
+
+	dctx := &DNSContext{
+		Req:   (&dns.Msg{}).SetQuestion("router.lan.", dns.TypeA),
+		Proto: ProtoUDP,
+		Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+	}
+
+	require.True(t, p.replyFromHosts(dctx))
+	require.Len(t, dctx.Res.Answer, 1)
+
+	a := testutil.RequireTypeAssert[*dns.A](t, dctx.Res.Answer[0])
+	assert.Equal(t, net.IP{192, 168, 1, 1}, a.A)
+}
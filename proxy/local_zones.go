@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// maxLocalCNAMEChain is the maximum number of the CNAME records within a local
+// zone followed for a single request.
+const maxLocalCNAMEChain = 8
+
+// LocalZone is a zone dnsproxy is authoritative for.
+type LocalZone struct {
+	// soa is the SOA record of the zone.
+	soa *dns.SOA
+
+	// records maps the lowercased owner names to their records.
+	records map[string][]dns.RR
+
+	// names contains the lowercased names existing in the zone, including the
+	// empty non-terminals.
+	names map[string]unit
+
+	// origin is the lowercased FQDN of the zone.
+	origin string
+
+	// path is the path to the file the zone is loaded from, if any.
+	path string
+}
+
+// LoadLocalZone loads the zone with the given origin from the file in the RFC
+// 1035 format at path.
+func LoadLocalZone(origin, path string) (z *LocalZone, err error) {
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening zone %q: %w", origin, err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	z, err = ParseLocalZone(origin, f, path)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	z.path = path
+
+	return z, nil
+}
+
+// ParseLocalZone parses the zone with the given origin from r in the RFC 1035
+// format.  filename is only used in the error messages.  The zone must contain
+// a single SOA record at its apex, and all the records must belong to it.
+func ParseLocalZone(origin string, r io.Reader, filename string) (z *LocalZone, err error) {
+	origin = strings.ToLower(dns.Fqdn(origin))
+	if _, ok := dns.IsDomainName(origin); !ok {
+		return nil, fmt.Errorf("bad zone name %q", origin)
+	}
+
+	z = &LocalZone{
+		records: map[string][]dns.RR{},
+		names:   map[string]unit{},
+		origin:  origin,
+	}
+
+	zp := dns.NewZoneParser(r, origin, filename)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		err = z.add(rr)
+		if err != nil {
+			return nil, fmt.Errorf("zone %q: %w", origin, err)
+		}
+	}
+
+	if err = zp.Err(); err != nil {
+		return nil, fmt.Errorf("zone %q: %w", origin, err)
+	}
+
+	if z.soa == nil {
+		return nil, fmt.Errorf("zone %q: no soa record", origin)
+	}
+
+	return z, nil
+}
+
+// add adds rr to z.
+func (z *LocalZone) add(rr dns.RR) (err error) {
+	hdr := rr.Header()
+	name := strings.ToLower(hdr.Name)
+	if !dns.IsSubDomain(z.origin, name) {
+		return fmt.Errorf("record %q is out of zone", rr)
+	}
+
+	if soa, ok := rr.(*dns.SOA); ok {
+		switch {
+		case name != z.origin:
+			return fmt.Errorf("soa record %q is not at the zone apex", rr)
+		case z.soa != nil:
+			return fmt.Errorf("duplicate soa record %q", rr)
+		default:
+			z.soa = soa
+		}
+	}
+
+	z.records[name] = append(z.records[name], rr)
+
+	for n := name; n != z.origin && n != ""; _, n, _ = strings.Cut(n, ".") {
+		z.names[n] = unit{}
+	}
+
+	z.names[z.origin] = unit{}
+
+	return nil
+}
+
+// lookup returns the records for the lowercased fqdn within z.  The records
+// matched by a wildcard are returned with fqdn as the owner name.  exists is
+// false if there is no such name in z.
+func (z *LocalZone) lookup(fqdn string) (rrs []dns.RR, exists bool) {
+	if _, exists = z.names[fqdn]; exists {
+		return z.records[fqdn], true
+	}
+
+	// Find the closest encloser and check its wildcard, see RFC 4592.
+	for n := fqdn; n != z.origin && n != ""; {
+		_, n, _ = strings.Cut(n, ".")
+		if _, ok := z.names[n]; !ok {
+			continue
+		}
+
+		wildcard := z.records["*."+n]
+		for _, rr := range wildcard {
+			rr = dns.Copy(rr)
+			rr.Header().Name = fqdn
+			rrs = append(rrs, rr)
+		}
+
+		return rrs, len(rrs) > 0
+	}
+
+	return nil, false
+}
+
+// answer returns the authoritative response to req, which must be within z.
+func (z *LocalZone) answer(req *dns.Msg) (resp *dns.Msg) {
+	q := req.Question[0]
+
+	resp = &dns.Msg{}
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+
+	name := strings.ToLower(q.Name)
+	for range maxLocalCNAMEChain {
+		rrs, exists := z.lookup(name)
+		if !exists {
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = z.negativeSOA()
+
+			return resp
+		}
+
+		var cname *dns.CNAME
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			switch {
+			case hdr.Rrtype == q.Qtype, q.Qtype == dns.TypeANY:
+				resp.Answer = append(resp.Answer, rr)
+			case hdr.Rrtype == dns.TypeCNAME:
+				cname = rr.(*dns.CNAME)
+			}
+		}
+
+		if cname == nil || len(resp.Answer) > 0 {
+			break
+		}
+
+		resp.Answer = append(resp.Answer, cname)
+
+		name = strings.ToLower(cname.Target)
+		if !dns.IsSubDomain(z.origin, name) {
+			// Let the client resolve the target out of the zone.
+			return resp
+		}
+	}
+
+	if len(resp.Answer) == 0 {
+		resp.Ns = z.negativeSOA()
+	}
+
+	return resp
+}
+
+// negativeSOA returns the SOA record for the negative responses, with the TTL
+// set according to RFC 2308.
+func (z *LocalZone) negativeSOA() (ns []dns.RR) {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+
+	return []dns.RR{soa}
+}
+
+// LocalZones are the zones dnsproxy is authoritative for.
+type LocalZones struct {
+	// zones are sorted by the length of the origins, from the longest, so that
+	// the most specific zone is matched first.
+	zones []*LocalZone
+}
+
+// NewLocalZones returns the local zones.  It returns an error if the same
+// origin is used twice.
+func NewLocalZones(zones ...*LocalZone) (lz *LocalZones, err error) {
+	zones = slices.Clone(zones)
+	slices.SortStableFunc(zones, func(a, b *LocalZone) (res int) {
+		return len(b.origin) - len(a.origin)
+	})
+
+	for i := 1; i < len(zones); i++ {
+		if zones[i].origin == zones[i-1].origin {
+			return nil, fmt.Errorf("duplicate zone %q", zones[i].origin)
+		}
+	}
+
+	return &LocalZones{zones: zones}, nil
+}
+
+// Zones returns the origins of the zones.  lz may be nil.
+func (lz *LocalZones) Zones() (origins []string) {
+	if lz == nil {
+		return nil
+	}
+
+	for _, z := range lz.zones {
+		origins = append(origins, z.origin)
+	}
+
+	return origins
+}
+
+// match returns the most specific zone containing fqdn, if any.
+func (lz *LocalZones) match(fqdn string) (z *LocalZone) {
+	if lz == nil {
+		return nil
+	}
+
+	fqdn = strings.ToLower(fqdn)
+	for _, z = range lz.zones {
+		if dns.IsSubDomain(z.origin, fqdn) {
+			return z
+		}
+	}
+
+	return nil
+}
+
+// reload returns the zones loaded again from the same files.  The zones not
+// loaded from a file are kept as is.
+func (lz *LocalZones) reload() (reloaded *LocalZones, err error) {
+	zones := make([]*LocalZone, 0, len(lz.zones))
+	for _, z := range lz.zones {
+		if z.path != "" {
+			z, err = LoadLocalZone(z.origin, z.path)
+			if err != nil {
+				// Don't wrap the error since it's informative enough as is.
+				return nil, err
+			}
+		}
+
+		zones = append(zones, z)
+	}
+
+	return NewLocalZones(zones...)
+}
+
+// localZones returns the current local zones, if any.
+func (p *Proxy) localZones() (lz *LocalZones) {
+	return p.authZones.Load()
+}
+
+// ReloadLocalZones loads the local zones again from their files and replaces
+// them.  The current zones are kept if any of the files is invalid.
+func (p *Proxy) ReloadLocalZones() (err error) {
+	cur := p.localZones()
+	if cur == nil {
+		return errors.Error("no local zones configured")
+	}
+
+	lz, err := cur.reload()
+	if err != nil {
+		return fmt.Errorf("reloading local zones: %w", err)
+	}
+
+	p.authZones.Store(lz)
+
+	log.Info("dnsproxy: local zones reloaded")
+
+	return nil
+}
+
+// replyFromLocalZones answers the request from the local zones.  It returns
+// true if dctx.Res is set.
+func (p *Proxy) replyFromLocalZones(dctx *DNSContext) (ok bool) {
+	if len(dctx.Req.Question) != 1 {
+		return false
+	}
+
+	z := p.localZones().match(dctx.Req.Question[0].Name)
+	if z == nil {
+		return false
+	}
+
+	dctx.Res = z.answer(dctx.Req)
+	dctx.Upstream = nil
+
+	return true
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testZone is the contents of the zone file used in tests.
+const testZone = `$TTL 3600
+@       IN SOA  ns.home.arpa. admin.home.arpa. 1 7200 3600 1209600 300
+@       IN NS   ns
+ns      IN A    192.168.1.2
+router  IN A    192.168.1.1
+www     IN CNAME router
+ext     IN CNAME example.org.
+*.dev   IN A    192.168.1.100
+a.b     IN TXT  "empty non-terminal above"
+`
+
+func TestParseLocalZone(t *testing.T) {
+	testCases := []struct {
+		name       string
+		origin     string
+		data       string
+		wantErrMsg string
+	}{{
+		name:       "valid",
+		origin:     "home.arpa",
+		data:       testZone,
+		wantErrMsg: "",
+	}, {
+		name:       "no_soa",
+		origin:     "home.arpa",
+		data:       "router IN A 192.168.1.1\n",
+		wantErrMsg: `zone "home.arpa.": no soa record`,
+	}, {
+		name:   "out_of_zone",
+		origin: "home.arpa",
+		data:   testZone + "example.org. IN A 192.0.2.1\n",
+		wantErrMsg: `zone "home.arpa.": record "example.org.\t3600\tIN\tA\t` +
+			`192.0.2.1" is out of zone`,
+	}, {
+		name:   "duplicate_soa",
+		origin: "home.arpa",
+		data:   testZone + "@ IN SOA ns admin 2 7200 3600 1209600 300\n",
+		wantErrMsg: `zone "home.arpa.": duplicate soa record "home.arpa.\t3600\t` +
+			`IN\tSOA\tns.home.arpa. admin.home.arpa. 2 7200 3600 1209600 300"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseLocalZone(tc.origin, strings.NewReader(tc.data), "test")
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+
+	t.Run("syntax", func(t *testing.T) {
+		_, err := ParseLocalZone("home.arpa", strings.NewReader(testZone+"bad IN A x\n"), "test")
+		require.Error(t, err)
+
+		// The position is reported by the zone parser.
+		assert.Contains(t, err.Error(), "line: 10:")
+	})
+}
+
+func TestProxy_Resolve_localZones(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "home.arpa.zone")
+	require.NoError(t, os.WriteFile(path, []byte(testZone), 0o644))
+
+	z, err := LoadLocalZone("home.arpa", path)
+	require.NoError(t, err)
+
+	lz, err := NewLocalZones(z)
+	require.NoError(t, err)
+
+	var upstreamReqs atomic.Int32
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			upstreamReqs.Add(1)
+
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		LocalZones:             lz,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	resolve := func(t *testing.T, host string, qtype uint16) (resp *dns.Msg) {
+		t.Helper()
+
+		dctx := &DNSContext{
+			Req:   (&dns.Msg{}).SetQuestion(host, qtype),
+			Proto: ProtoUDP,
+			Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+
+		require.NoError(t, p.Resolve(dctx))
+		require.NotNil(t, dctx.Res)
+
+		return dctx.Res
+	}
+
+	testCases := []struct {
+		name      string
+		host      string
+		wantAns   []string
+		qtype     uint16
+		wantRcode int
+		wantSOA   bool
+	}{{
+		name:      "a",
+		host:      "Router.home.arpa.",
+		wantAns:   []string{"192.168.1.1"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantSOA:   false,
+	}, {
+		name:      "nodata",
+		host:      "router.home.arpa.",
+		wantAns:   nil,
+		qtype:     dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+		wantSOA:   true,
+	}, {
+		name:      "nxdomain",
+		host:      "missing.home.arpa.",
+		wantAns:   nil,
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+		wantSOA:   true,
+	}, {
+		name:      "empty_non_terminal",
+		host:      "b.home.arpa.",
+		wantAns:   nil,
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantSOA:   true,
+	}, {
+		name:      "cname",
+		host:      "www.home.arpa.",
+		wantAns:   []string{"router.home.arpa.", "192.168.1.1"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantSOA:   false,
+	}, {
+		name:      "cname_out_of_zone",
+		host:      "ext.home.arpa.",
+		wantAns:   []string{"example.org."},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantSOA:   false,
+	}, {
+		name:      "wildcard",
+		host:      "app.dev.home.arpa.",
+		wantAns:   []string{"192.168.1.100"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantSOA:   false,
+	}, {
+		name:      "apex_ns",
+		host:      "home.arpa.",
+		wantAns:   []string{"ns.home.arpa."},
+		qtype:     dns.TypeNS,
+		wantRcode: dns.RcodeSuccess,
+		wantSOA:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := resolve(t, tc.host, tc.qtype)
+
+			assert.True(t, resp.Authoritative)
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+
+			var ans []string
+			for _, rr := range resp.Answer {
+				ans = append(ans, strings.TrimPrefix(rr.String(), rr.Header().String()))
+			}
+
+			assert.Equal(t, tc.wantAns, ans)
+
+			if !tc.wantSOA {
+				assert.Empty(t, resp.Ns)
+
+				return
+			}
+
+			require.Len(t, resp.Ns, 1)
+
+			soa := testutil.RequireTypeAssert[*dns.SOA](t, resp.Ns[0])
+			assert.Equal(t, uint32(300), soa.Hdr.Ttl)
+		})
+	}
+
+	assert.Zero(t, upstreamReqs.Load())
+
+	t.Run("outside", func(t *testing.T) {
+		resp := resolve(t, "example.org.", dns.TypeA)
+
+		assert.False(t, resp.Authoritative)
+		assert.Equal(t, int32(1), upstreamReqs.Load())
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		data := strings.Replace(testZone, "192.168.1.1\n", "192.168.1.254\n", 1)
+		require.NoError(t, os.WriteFile(path, []byte(data), 0o644))
+
+		require.NoError(t, p.ReloadLocalZones())
+
+		resp := resolve(t, "router.home.arpa.", dns.TypeA)
+		require.Len(t, resp.Answer, 1)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+		assert.Equal(t, "192.168.1.254", a.A.String())
+	})
+
+	t.Run("reload_invalid", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte("router IN A 192.168.1.1\n"), 0o644))
+
+		testutil.AssertErrorMsg(
+			t,
+			`reloading local zones: zone "home.arpa.": no soa record`,
+			p.ReloadLocalZones(),
+		)
+
+		resp := resolve(t, "router.home.arpa.", dns.TypeA)
+		assert.Len(t, resp.Answer, 1)
+	})
+}
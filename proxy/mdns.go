@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// defaultMDNSTimeout is the default time to wait for the multicast DNS
+// responses.
+const defaultMDNSTimeout = 500 * time.Millisecond
+
+// mdnsDomain is the domain resolved using multicast DNS, see RFC 6762.
+const mdnsDomain = "local."
+
+// mdnsCacheFlush is the cache-flush bit of the class of the multicast DNS
+// records, see RFC 6762 Section 10.2.
+const mdnsCacheFlush = 1 << 15
+
+// mdnsGroups are the multicast DNS group addresses.  The IPv6 one requires the
+// interface to be specified, so only the IPv4 one is used.
+var mdnsGroups = []*net.UDPAddr{{
+	IP:   net.IPv4(224, 0, 0, 251),
+	Port: 5353,
+}}
+
+// mdnsClient resolves the names using the one-shot multicast DNS queries, see
+// RFC 6762 Section 5.1.
+type mdnsClient struct {
+	// groups are the addresses the queries are sent to.
+	groups []*net.UDPAddr
+
+	// timeout is the time to wait for the responses.
+	timeout time.Duration
+}
+
+// newMDNSClient returns a new multicast DNS client waiting for the responses
+// for timeout, or for the default time if it's zero.
+func newMDNSClient(timeout time.Duration) (c *mdnsClient) {
+	if timeout == 0 {
+		timeout = defaultMDNSTimeout
+	}
+
+	return &mdnsClient{
+		groups:  mdnsGroups,
+		timeout: timeout,
+	}
+}
+
+// mdnsResult is the result of a query sent to a single group.
+type mdnsResult struct {
+	resp *dns.Msg
+	err  error
+}
+
+// exchange sends the query for name of type qt to all the groups and returns
+// the first response answering it.  resp is nil if there is no response within
+// the timeout.
+func (c *mdnsClient) exchange(name string, qt uint16) (resp *dns.Msg, err error) {
+	q := &dns.Msg{}
+	q.SetQuestion(name, qt)
+	q.RecursionDesired = false
+
+	resCh := make(chan mdnsResult, len(c.groups))
+	for _, g := range c.groups {
+		go func() {
+			defer log.OnPanic("mdns query")
+
+			res := mdnsResult{}
+			res.resp, res.err = c.query(q, g)
+			resCh <- res
+		}()
+	}
+
+	var errs []error
+	for range c.groups {
+		res := <-resCh
+		if res.resp != nil {
+			return res.resp, nil
+		} else if res.err != nil {
+			errs = append(errs, res.err)
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// query sends q to group from an ephemeral port, so that the responders reply
+// with unicast, and waits for the response to it.
+func (c *mdnsClient) query(q *dns.Msg, group *net.UDPAddr) (resp *dns.Msg, err error) {
+	network := "udp4"
+	if group.IP.To4() == nil {
+		network = "udp6"
+	}
+
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, fmt.Errorf("opening socket: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	data, err := q.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing query: %w", err)
+	}
+
+	err = conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return nil, fmt.Errorf("setting deadline: %w", err)
+	}
+
+	_, err = conn.WriteToUDP(data, group)
+	if err != nil {
+		return nil, fmt.Errorf("sending query to %s: %w", group, err)
+	}
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		var n int
+		n, _, err = conn.ReadFromUDP(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("reading response: %w", err)
+		}
+
+		resp = &dns.Msg{}
+		if resp.Unpack(buf[:n]) == nil && resp.Response && resp.Id == q.Id {
+			return resp, nil
+		}
+	}
+}
+
+// mdnsName returns the name to resolve using multicast DNS for the requested
+// fqdn and true, if it should be.  The names within the forwarding zones are
+// resolved by the upstreams configured for those.
+func (p *Proxy) mdnsName(fqdn string) (name string, ok bool) {
+	name = strings.ToLower(fqdn)
+	switch {
+	case name != mdnsDomain && dns.IsSubDomain(mdnsDomain, name):
+		// Go on.
+	case p.MDNSSingleLabel && dns.CountLabel(name) == 1:
+		name += mdnsDomain
+	default:
+		return "", false
+	}
+
+	if p.forwardingZones().upstreams((*UpstreamConfig).getUpstreamsForDomain, fqdn) != nil {
+		return "", false
+	}
+
+	return name, true
+}
+
+// replyFromMDNS tries to resolve the request within dctx using multicast DNS
+// and returns true if it's the one for a .local name, or a single-label one if
+// [Config.MDNSSingleLabel] is set.  Those are answered with NXDOMAIN if there is
+// no response and never sent to the upstreams.
+func (p *Proxy) replyFromMDNS(dctx *DNSContext) (ok bool) {
+	if p.mdns == nil || len(dctx.Req.Question) != 1 {
+		return false
+	}
+
+	q := dctx.Req.Question[0]
+	name, ok := p.mdnsName(q.Name)
+	if !ok {
+		return false
+	}
+
+	resp, err := p.mdns.exchange(name, q.Qtype)
+	if err != nil {
+		log.Debug("dnsproxy: mdns: resolving %s: %s", name, err)
+	}
+
+	dctx.Res = mdnsAnswer(dctx.Req, resp, name)
+	if dctx.Res == nil {
+		dctx.Res = p.messages.NewMsgNXDOMAIN(dctx.Req)
+	}
+	dctx.Upstream = nil
+
+	return true
+}
+
+// mdnsAnswer returns the reply to req containing the records for name from
+// resp, which may be nil, renamed to the requested name.  res is nil if resp
+// has no records for name.
+func mdnsAnswer(req, resp *dns.Msg, name string) (res *dns.Msg) {
+	if resp == nil {
+		return nil
+	}
+
+	q := req.Question[0]
+	res = (&dns.Msg{}).SetReply(req)
+	res.RecursionAvailable = true
+
+	found := false
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		if !strings.EqualFold(hdr.Name, name) {
+			continue
+		}
+
+		found = true
+		if q.Qtype != dns.TypeANY && hdr.Rrtype != q.Qtype && hdr.Rrtype != dns.TypeCNAME {
+			continue
+		}
+
+		rr = dns.Copy(rr)
+		hdr = rr.Header()
+		hdr.Name = q.Name
+		hdr.Class &^= mdnsCacheFlush
+		res.Answer = append(res.Answer, rr)
+	}
+
+	if !found {
+		return nil
+	}
+
+	return res
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startMDNSResponder starts a unicast responder answering the A queries for
+// name with addr the way multicast DNS responders do and returns its address.
+func startMDNSResponder(t *testing.T, name string, addr netip.Addr) (group *net.UDPAddr) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, from, rerr := conn.ReadFromUDP(buf)
+			if rerr != nil {
+				return
+			}
+
+			req := &dns.Msg{}
+			if req.Unpack(buf[:n]) != nil || req.Question[0].Name != name {
+				continue
+			}
+
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Authoritative = true
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET | mdnsCacheFlush,
+					Ttl:    120,
+				},
+				A: addr.AsSlice(),
+			}}
+
+			data, _ := resp.Pack()
+			_, _ = conn.WriteToUDP(data, from)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestProxy_replyFromMDNS(t *testing.T) {
+	const (
+		hostName   = "host.local."
+		shortDelay = 50 * time.Millisecond
+	)
+
+	addr := netip.MustParseAddr("192.168.1.10")
+	group := startMDNSResponder(t, hostName, addr)
+
+	testCases := []struct {
+		name        string
+		qname       string
+		wantAnswer  string
+		qtype       uint16
+		wantRcode   int
+		singleLabel bool
+		wantOK      bool
+	}{{
+		name:        "local",
+		qname:       "HOST.local.",
+		wantAnswer:  "HOST.local.\t120\tIN\tA\t192.168.1.10",
+		qtype:       dns.TypeA,
+		wantRcode:   dns.RcodeSuccess,
+		singleLabel: false,
+		wantOK:      true,
+	}, {
+		name:        "local_nodata",
+		qname:       hostName,
+		wantAnswer:  "",
+		qtype:       dns.TypeAAAA,
+		wantRcode:   dns.RcodeSuccess,
+		singleLabel: false,
+		wantOK:      true,
+	}, {
+		name:        "local_missing",
+		qname:       "missing.local.",
+		wantAnswer:  "",
+		qtype:       dns.TypeA,
+		wantRcode:   dns.RcodeNameError,
+		singleLabel: false,
+		wantOK:      true,
+	}, {
+		name:        "single_label",
+		qname:       "host.",
+		wantAnswer:  "host.\t120\tIN\tA\t192.168.1.10",
+		qtype:       dns.TypeA,
+		wantRcode:   dns.RcodeSuccess,
+		singleLabel: true,
+		wantOK:      true,
+	}, {
+		name:        "single_label_disabled",
+		qname:       "host.",
+		wantAnswer:  "",
+		qtype:       dns.TypeA,
+		wantRcode:   dns.RcodeSuccess,
+		singleLabel: false,
+		wantOK:      false,
+	}, {
+		name:        "public",
+		qname:       "example.org.",
+		wantAnswer:  "",
+		qtype:       dns.TypeA,
+		wantRcode:   dns.RcodeSuccess,
+		singleLabel: true,
+		wantOK:      false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{
+				Config: Config{
+					MDNSSingleLabel: tc.singleLabel,
+				},
+				messages: defaultMessageConstructor{},
+				mdns: &mdnsClient{
+					groups:  []*net.UDPAddr{group},
+					timeout: shortDelay,
+				},
+			}
+
+			dctx := &DNSContext{Req: (&dns.Msg{}).SetQuestion(tc.qname, tc.qtype)}
+			ok := p.replyFromMDNS(dctx)
+			require.Equal(t, tc.wantOK, ok)
+
+			if !ok {
+				assert.Nil(t, dctx.Res)
+
+				return
+			}
+
+			require.NotNil(t, dctx.Res)
+
+			assert.Equal(t, tc.wantRcode, dctx.Res.Rcode)
+			if tc.wantAnswer == "" {
+				assert.Empty(t, dctx.Res.Answer)
+			} else {
+				require.Len(t, dctx.Res.Answer, 1)
+
+				assert.Equal(t, tc.wantAnswer, dctx.Res.Answer[0].String())
+			}
+		})
+	}
+}
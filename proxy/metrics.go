@@ -0,0 +1,455 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The metrics exposed in the Prometheus text format by WriteMetrics.  The
+// "upstream" label is always the address of the upstream, see upstreamName, so
+// that the metrics of the same upstream can be joined.
+var (
+	metricQueries = newCounterVec(
+		"dnsproxy_queries_total",
+		"Total number of the DNS queries received.",
+		"proto", "qtype",
+	)
+	metricResponses = newCounterVec(
+		"dnsproxy_responses_total",
+		"Total number of the DNS responses sent.",
+		"rcode",
+	)
+	metricCacheHits = newCounterVec(
+		"dnsproxy_cache_hits_total",
+		"Total number of the DNS responses served from the cache.",
+		"kind",
+	)
+	metricCacheMisses = newCounterVec(
+		"dnsproxy_cache_misses_total",
+		"Total number of the cache lookups which haven't found a response.",
+	)
+	metricCacheInsertions = newCounterVec(
+		"dnsproxy_cache_insertions_total",
+		"Total number of the DNS responses stored in the cache.",
+	)
+	metricCacheEvictions = newCounterVec(
+		"dnsproxy_cache_evictions_total",
+		"Total number of the entries removed from the cache.",
+		"reason",
+	)
+	metricCacheEntries = newGauge(
+		"dnsproxy_cache_entries",
+		"Current number of the entries in the cache.",
+	)
+	metricCacheBytes = newGauge(
+		"dnsproxy_cache_size_bytes",
+		"Approximate current size of the cache in bytes.",
+	)
+	metricBlocked = newCounterVec(
+		"dnsproxy_blocked_responses_total",
+		"Total number of the queries for the blocked domains.",
+		"list",
+	)
+	metricRebinding = newCounterVec(
+		"dnsproxy_rebinding_responses_total",
+		"Total number of the upstream responses with the private addresses for the public domains.",
+		"action",
+	)
+	metricRatelimited = newCounterVec(
+		"dnsproxy_ratelimited_queries_total",
+		"Total number of the ratelimited UDP queries.",
+		"action",
+	)
+	metricUpstreamResponses = newCounterVec(
+		"dnsproxy_upstream_responses_total",
+		"Total number of the DNS responses received from the upstreams.",
+		"upstream",
+	)
+	metricUpstreamErrors = newCounterVec(
+		"dnsproxy_upstream_errors_total",
+		"Total number of the failed exchanges with the upstreams.",
+		"upstream",
+	)
+	metricUpstreamTimeouts = newCounterVec(
+		"dnsproxy_upstream_timeouts_total",
+		"Total number of the timed out exchanges with the upstreams.",
+		"upstream",
+	)
+	metricUpstreamRTTP95 = newGaugeVecFunc(
+		"dnsproxy_upstream_rtt_p95_seconds",
+		"95th percentile of the durations of the recent successful exchanges with the upstreams.",
+		func() (values map[string]float64) {
+			values = map[string]float64{}
+			for name, d := range recentUpstreams.p95RTTs() {
+				values[name] = d.Seconds()
+			}
+
+			return values
+		},
+		"upstream",
+	)
+	metricQueryDuration = newHistogramVec(
+		"dnsproxy_query_duration_seconds",
+		"Duration of the exchanges with the upstreams.",
+		[]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		"upstream",
+	)
+)
+
+// allMetrics are the metrics in the order they're written by WriteMetrics.
+var allMetrics = []metric{
+	metricQueries,
+	metricResponses,
+	metricCacheHits,
+	metricCacheMisses,
+	metricCacheInsertions,
+	metricCacheEvictions,
+	metricCacheEntries,
+	metricCacheBytes,
+	metricBlocked,
+	metricRebinding,
+	metricRatelimited,
+	metricUpstreamResponses,
+	metricUpstreamErrors,
+	metricUpstreamTimeouts,
+	metricUpstreamRTTP95,
+	metricQueryDuration,
+}
+
+// WriteMetrics writes all the metrics to w in the Prometheus text exposition
+// format.
+func WriteMetrics(w io.Writer) (err error) {
+	bw := bufio.NewWriter(w)
+	for _, m := range allMetrics {
+		m.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+// metric is a named set of time series.
+type metric interface {
+	// write writes the metric in the Prometheus text exposition format to w.
+	write(w *bufio.Writer)
+}
+
+// metricLabels is the common part of the metrics with labels.
+type metricLabels struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// key returns the key of the time series with the given label values.
+func (l *metricLabels) key(values []string) (key string) {
+	if len(values) != len(l.labels) {
+		panic(fmt.Errorf("metric %s: got %d label values, want %d", l.name, len(values), len(l.labels)))
+	}
+
+	return strings.Join(values, "\x00")
+}
+
+// writeHeader writes the HELP and TYPE lines of the metric.
+func (l *metricLabels) writeHeader(w *bufio.Writer, typ string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", l.name, l.help, l.name, typ)
+}
+
+// writeSeries writes a single sample of the metric with the given name suffix,
+// label values from key, and the extra label.
+func (l *metricLabels) writeSeries(w *bufio.Writer, suffix, key, extra, value string) {
+	_, _ = w.WriteString(l.name + suffix)
+
+	pairs := []string{}
+	if len(l.labels) > 0 {
+		for i, v := range strings.Split(key, "\x00") {
+			pairs = append(pairs, l.labels[i]+`="`+escapeLabelValue(v)+`"`)
+		}
+	}
+
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+
+	if len(pairs) > 0 {
+		_, _ = w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+
+	_, _ = w.WriteString(" " + value + "\n")
+}
+
+// labelValueReplacer escapes the label values as the text format requires.
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabelValue returns v escaped for the text exposition format.
+func escapeLabelValue(v string) (escaped string) {
+	return labelValueReplacer.Replace(v)
+}
+
+// counterVec is a counter partitioned by the label values.
+type counterVec struct {
+	metricLabels
+
+	// mux protects values.
+	mux    sync.RWMutex
+	values map[string]*atomic.Uint64
+}
+
+// newCounterVec returns a new counter with the given label names.
+func newCounterVec(name, help string, labels ...string) (c *counterVec) {
+	return &counterVec{
+		metricLabels: metricLabels{name: name, help: help, labels: labels},
+		values:       map[string]*atomic.Uint64{},
+	}
+}
+
+// inc increments the counter with the given label values.
+func (c *counterVec) inc(values ...string) {
+	key := c.key(values)
+
+	c.mux.RLock()
+	v, ok := c.values[key]
+	c.mux.RUnlock()
+
+	if !ok {
+		c.mux.Lock()
+		v, ok = c.values[key]
+		if !ok {
+			v = &atomic.Uint64{}
+			c.values[key] = v
+		}
+		c.mux.Unlock()
+	}
+
+	v.Add(1)
+}
+
+// type check
+var _ metric = (*counterVec)(nil)
+
+// write implements the [metric] interface for *counterVec.
+func (c *counterVec) write(w *bufio.Writer) {
+	c.writeHeader(w, "counter")
+
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		c.writeSeries(w, "", "", "", "0")
+
+		return
+	}
+
+	for _, key := range sortedKeys(c.values) {
+		c.writeSeries(w, "", key, "", strconv.FormatUint(c.values[key].Load(), 10))
+	}
+}
+
+// gauge is a single time series which value may go up and down.
+type gauge struct {
+	metricLabels
+
+	// bits are the bits of the float64 value.
+	bits atomic.Uint64
+}
+
+// newGauge returns a new gauge without labels.
+func newGauge(name, help string) (g *gauge) {
+	return &gauge{
+		metricLabels: metricLabels{name: name, help: help},
+	}
+}
+
+// set sets the value of the gauge to v.
+func (g *gauge) set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+// type check
+var _ metric = (*gauge)(nil)
+
+// write implements the [metric] interface for *gauge.
+func (g *gauge) write(w *bufio.Writer) {
+	g.writeHeader(w, "gauge")
+	g.writeSeries(w, "", "", "", formatFloat(math.Float64frombits(g.bits.Load())))
+}
+
+// gaugeVecFunc is a gauge partitioned by the label values, which are
+// calculated on writing.
+type gaugeVecFunc struct {
+	metricLabels
+
+	// values returns the current values of the gauge by the keys of the label
+	// values, see [metricLabels.key].
+	values func() (values map[string]float64)
+}
+
+// newGaugeVecFunc returns a new gauge with the given label names, which values
+// are returned by values.
+func newGaugeVecFunc(
+	name string,
+	help string,
+	values func() (values map[string]float64),
+	labels ...string,
+) (g *gaugeVecFunc) {
+	return &gaugeVecFunc{
+		metricLabels: metricLabels{name: name, help: help, labels: labels},
+		values:       values,
+	}
+}
+
+// type check
+var _ metric = (*gaugeVecFunc)(nil)
+
+// write implements the [metric] interface for *gaugeVecFunc.
+func (g *gaugeVecFunc) write(w *bufio.Writer) {
+	g.writeHeader(w, "gauge")
+
+	values := g.values()
+	for _, key := range sortedKeys(values) {
+		g.writeSeries(w, "", key, "", formatFloat(values[key]))
+	}
+}
+
+// histogram is a single time series of a histogramVec.
+type histogram struct {
+	// mux protects the fields below.
+	mux sync.Mutex
+
+	// counts are the non-cumulative numbers of the observations within each
+	// of the buckets, the last one is for +Inf.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram partitioned by the label values.
+type histogramVec struct {
+	metricLabels
+
+	// buckets are the sorted upper bounds of the buckets.
+	buckets []float64
+
+	// mux protects values.
+	mux    sync.RWMutex
+	values map[string]*histogram
+}
+
+// newHistogramVec returns a new histogram with the given buckets and label
+// names.
+func newHistogramVec(name, help string, buckets []float64, labels ...string) (h *histogramVec) {
+	return &histogramVec{
+		metricLabels: metricLabels{name: name, help: help, labels: labels},
+		buckets:      buckets,
+		values:       map[string]*histogram{},
+	}
+}
+
+// observe adds the duration d to the histogram with the given label values.
+func (h *histogramVec) observe(d time.Duration, values ...string) {
+	key := h.key(values)
+
+	h.mux.RLock()
+	v, ok := h.values[key]
+	h.mux.RUnlock()
+
+	if !ok {
+		h.mux.Lock()
+		v, ok = h.values[key]
+		if !ok {
+			v = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+			h.values[key] = v
+		}
+		h.mux.Unlock()
+	}
+
+	sec := d.Seconds()
+	i, _ := slices.BinarySearch(h.buckets, sec)
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	v.counts[i]++
+	v.sum += sec
+	v.count++
+}
+
+// type check
+var _ metric = (*histogramVec)(nil)
+
+// write implements the [metric] interface for *histogramVec.
+func (h *histogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w, "histogram")
+
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+
+		v.mux.Lock()
+		var cumulative uint64
+		for i, n := range v.counts {
+			cumulative += n
+
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+
+			h.writeSeries(w, "_bucket", key, `le="`+formatFloat(le)+`"`, strconv.FormatUint(cumulative, 10))
+		}
+
+		h.writeSeries(w, "_sum", key, "", formatFloat(v.sum))
+		h.writeSeries(w, "_count", key, "", strconv.FormatUint(v.count, 10))
+		v.mux.Unlock()
+	}
+}
+
+// formatFloat formats f as the text exposition format requires.
+func formatFloat(f float64) (s string) {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sortedKeys returns the sorted keys of m, so that the output is stable.
+func sortedKeys[T any](m map[string]T) (keys []string) {
+	keys = make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+// qtypeLabel returns the label value for the query type, limiting the
+// cardinality of the label to the known types.
+func qtypeLabel(qtype uint16) (label string) {
+	if s, ok := dns.TypeToString[qtype]; ok {
+		return s
+	}
+
+	return "other"
+}
+
+// rcodeLabel returns the label value for the response code.
+func rcodeLabel(rcode int) (label string) {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+
+	return "other"
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterVec_write(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter.", "qtype", "upstream")
+	c.inc("A", "tls://one")
+	c.inc("A", "tls://one")
+	c.inc("AAAA", `quo"te`)
+
+	sb := &strings.Builder{}
+	w := bufio.NewWriter(sb)
+	c.write(w)
+	require.NoError(t, w.Flush())
+
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{qtype="A",upstream="tls://one"} 2
+test_total{qtype="AAAA",upstream="quo\"te"} 1
+`
+	assert.Equal(t, want, sb.String())
+
+	assert.Panics(t, func() { c.inc("A") })
+}
+
+func TestCounterVec_write_noLabels(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter.")
+
+	sb := &strings.Builder{}
+	w := bufio.NewWriter(sb)
+	c.write(w)
+	require.NoError(t, w.Flush())
+
+	assert.Contains(t, sb.String(), "\ntest_total 0\n")
+}
+
+func TestGauge_write(t *testing.T) {
+	g := newGauge("test_bytes", "Test gauge.")
+	g.set(42)
+	g.set(1.5)
+
+	sb := &strings.Builder{}
+	w := bufio.NewWriter(sb)
+	g.write(w)
+	require.NoError(t, w.Flush())
+
+	want := `# HELP test_bytes Test gauge.
+# TYPE test_bytes gauge
+test_bytes 1.5
+`
+	assert.Equal(t, want, sb.String())
+}
+
+func TestGaugeVecFunc_write(t *testing.T) {
+	g := newGaugeVecFunc("test_seconds", "Test gauge.", func() (values map[string]float64) {
+		return map[string]float64{"tls://two": 0.25, "tls://one": 1}
+	}, "upstream")
+
+	sb := &strings.Builder{}
+	w := bufio.NewWriter(sb)
+	g.write(w)
+	require.NoError(t, w.Flush())
+
+	want := `# HELP test_seconds Test gauge.
+# TYPE test_seconds gauge
+test_seconds{upstream="tls://one"} 1
+test_seconds{upstream="tls://two"} 0.25
+`
+	assert.Equal(t, want, sb.String())
+}
+
+func TestHistogramVec_write(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Test histogram.", []float64{0.01, 0.1}, "upstream")
+	h.observe(5*time.Millisecond, "u")
+	h.observe(50*time.Millisecond, "u")
+	h.observe(time.Second, "u")
+
+	sb := &strings.Builder{}
+	w := bufio.NewWriter(sb)
+	h.write(w)
+	require.NoError(t, w.Flush())
+
+	want := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{upstream="u",le="0.01"} 1
+test_seconds_bucket{upstream="u",le="0.1"} 2
+test_seconds_bucket{upstream="u",le="+Inf"} 3
+test_seconds_sum{upstream="u"} 1.055
+test_seconds_count{upstream="u"} 3
+`
+	assert.Equal(t, want, sb.String())
+}
+
+func TestWriteMetrics(t *testing.T) {
+	setTestBlockedDomains(t, "metrics", "blocked.example\n")
+
+	p := mustNew(t, &Config{
+		UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	dctx := p.newDNSContext(ProtoUDP, (&dns.Msg{}).SetQuestion("blocked.example.", dns.TypeA))
+	dctx.Addr = netip.MustParseAddrPort("127.0.0.1:1")
+
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(localhostAnyPort))
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	dctx.Conn = conn
+	require.NoError(t, p.handleDNSRequest(dctx))
+
+	prevTypes, _ := SM.GetUint64("queries::types::A")
+	prevRcodes, _ := SM.GetUint64("answers::rcodes::NOERROR")
+
+	require.NoError(t, p.handleDNSRequest(dctx))
+
+	types, _ := SM.GetUint64("queries::types::A")
+	rcodes, _ := SM.GetUint64("answers::rcodes::NOERROR")
+	assert.Equal(t, prevTypes+1, types)
+	assert.Equal(t, prevRcodes+1, rcodes)
+
+	sb := &strings.Builder{}
+	require.NoError(t, WriteMetrics(sb))
+
+	out := sb.String()
+	assert.Contains(t, out, `dnsproxy_queries_total{proto="udp",qtype="A"}`)
+	assert.Contains(t, out, `dnsproxy_responses_total{rcode="NOERROR"}`)
+	assert.Contains(t, out, `dnsproxy_blocked_responses_total{list="metrics"}`)
+	assert.Contains(t, out, "# TYPE dnsproxy_query_duration_seconds histogram")
+}
+
+func TestWriteMetrics_upstreamLabel(t *testing.T) {
+	const upsAddr = "tls://metrics.example:853"
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(m)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   m.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: net.IP{192, 0, 2, 1},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return upsAddr },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	dctx := p.newDNSContext(ProtoUDP, (&dns.Msg{}).SetQuestion("label.example.", dns.TypeA))
+	dctx.Addr = netip.MustParseAddrPort("127.0.0.1:1")
+
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(localhostAnyPort))
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	dctx.Conn = conn
+	require.NoError(t, p.handleDNSRequest(dctx))
+
+	sb := &strings.Builder{}
+	require.NoError(t, WriteMetrics(sb))
+
+	out := sb.String()
+	assert.Contains(t, out, `dnsproxy_upstream_responses_total{upstream="`+upsAddr+`"}`)
+	assert.Contains(t, out, `dnsproxy_query_duration_seconds_count{upstream="`+upsAddr+`"}`)
+}
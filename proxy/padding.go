@@ -0,0 +1,27 @@
+package proxy
+
+import "github.com/AdguardTeam/dnsproxy/proxyutil"
+
+// padResponse pads the response in d as RFC 8467 recommends, if it's sent over
+// an encrypted transport and the request has an OPT record, see
+// [Config.EDNSPadding].
+func (p *Proxy) padResponse(d *DNSContext) {
+	if !p.EDNSPadding || d.Res == nil || d.Req == nil {
+		return
+	}
+
+	switch d.Proto {
+	case ProtoTLS, ProtoHTTPS, ProtoQUIC:
+		// Go on.
+	default:
+		return
+	}
+
+	d.calcFlagsAndSize()
+	if !d.hasEDNS0 {
+		return
+	}
+
+	maxSize := int(dnsSize(d.Proto == ProtoUDP, d.Req))
+	proxyutil.Pad(d.Res, proxyutil.PaddingBlockResponse, maxSize)
+}
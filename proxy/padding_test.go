@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// paddingLen returns the length of the padding option of m, or -1 if there is
+// none.
+func paddingLen(m *dns.Msg) (n int) {
+	o := m.IsEdns0()
+	if o == nil {
+		return -1
+	}
+
+	for _, opt := range o.Option {
+		if pad, ok := opt.(*dns.EDNS0_PADDING); ok {
+			return len(pad.Padding)
+		}
+	}
+
+	return -1
+}
+
+func TestProxy_padResponse(t *testing.T) {
+	testCases := []struct {
+		name       string
+		proto      Proto
+		wantPadded bool
+		enabled    bool
+		edns       bool
+	}{{
+		name:       "tls",
+		proto:      ProtoTLS,
+		wantPadded: true,
+		enabled:    true,
+		edns:       true,
+	}, {
+		name:       "https",
+		proto:      ProtoHTTPS,
+		wantPadded: true,
+		enabled:    true,
+		edns:       true,
+	}, {
+		name:       "quic",
+		proto:      ProtoQUIC,
+		wantPadded: true,
+		enabled:    true,
+		edns:       true,
+	}, {
+		name:       "udp",
+		proto:      ProtoUDP,
+		wantPadded: false,
+		enabled:    true,
+		edns:       true,
+	}, {
+		name:       "no_edns",
+		proto:      ProtoTLS,
+		wantPadded: false,
+		enabled:    true,
+		edns:       false,
+	}, {
+		name:       "disabled",
+		proto:      ProtoTLS,
+		wantPadded: false,
+		enabled:    false,
+		edns:       true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: Config{EDNSPadding: tc.enabled}}
+
+			req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+			if tc.edns {
+				req.SetEdns0(dns.DefaultMsgSize, false)
+			}
+
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   []byte{192, 0, 2, 1},
+			}}
+
+			// The padding of the upstream is removed.
+			resp.SetEdns0(dns.DefaultMsgSize, false)
+			resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_PADDING{
+				Padding: make([]byte, 7),
+			})
+
+			d := &DNSContext{Proto: tc.proto, Req: req, Res: resp}
+			d.scrub()
+			p.padResponse(d)
+
+			if !tc.wantPadded {
+				assert.Equal(t, -1, paddingLen(d.Res))
+
+				return
+			}
+
+			require.NotEqual(t, -1, paddingLen(d.Res))
+
+			b, err := d.Res.Pack()
+			require.NoError(t, err)
+
+			assert.Zero(t, len(b)%468)
+		})
+	}
+}
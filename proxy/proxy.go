@@ -6,7 +6,6 @@ import (
 	"cmp"
 	"context"
 	"fmt"
-	"github.com/AdguardTeam/dnsproxy/utils"
 	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/quic-go/quic-go"
 	"io"
@@ -38,6 +37,10 @@ const (
 	minDNSPacketSize = 12 + 5
 )
 
+// defaultShutdownGracePeriod is the default time given to the requests in
+// flight to be handled on shutdown.
+const defaultShutdownGracePeriod = 5 * time.Second
+
 // Proto is the DNS protocol.
 type Proto string
 
@@ -55,6 +58,8 @@ const (
 	ProtoQUIC Proto = "quic"
 	// ProtoDNSCrypt is the DNSCrypt protocol.
 	ProtoDNSCrypt Proto = "dnscrypt"
+	// ProtoUnix is the plain DNS-over-TCP protocol over a Unix domain socket.
+	ProtoUnix Proto = "unix"
 )
 
 // Proxy combines the proxy server state and configuration.  It must not be used
@@ -109,6 +114,48 @@ type Proxy struct {
 	// repetitions.
 	shortFlighter *optimisticResolver
 
+	// prefetcher chooses the cached responses to refresh before they expire.
+	// It's nil if the prefetching is disabled.
+	prefetcher *prefetcher
+
+	// healthChecker probes the upstreams and keeps their health state.  It's
+	// nil if the health checking is disabled.
+	healthChecker *healthChecker
+
+	// upstreamSet contains the upstreams currently used.  It's replaced with
+	// [Proxy.SetUpstreams].
+	upstreamSet atomic.Pointer[upstreamSet]
+
+	// zones are the conditional forwarding zones, if any.  It's replaced with
+	// [Proxy.SetForwardingZones].
+	zones atomic.Pointer[ForwardingZones]
+
+	// authZones are the local zones answered authoritatively, if any.  It's
+	// replaced with [Proxy.ReloadLocalZones].
+	authZones atomic.Pointer[LocalZones]
+
+	// mdns resolves the .local names, if enabled.
+	mdns *mdnsClient
+
+	// readiness performs the readiness checks.
+	readiness *readinessChecker
+
+	// filterAAAA is the trie of the domains the AAAA records are filtered for.
+	// It's nil if there are no such domains configured.
+	filterAAAA *domainNode
+
+	// hosts answers the requests from the hosts files.  It's nil if there are
+	// no hosts files configured.
+	hosts *hostsFiles
+
+	// leases answers the requests from the DHCP leases file.  It's nil if
+	// there is no leases file configured.
+	leases *dhcpLeases
+
+	// certs provides the certificate of the encrypted listeners from the files.
+	// It's nil if there are no certificate files configured.
+	certs *tlsCerts
+
 	// recDetector detects recursive requests that may appear when resolving
 	// requests for private addresses.
 	recDetector *recursionDetector
@@ -127,6 +174,13 @@ type Proxy struct {
 	// tlsListen are the listened TCP connections with TLS.
 	tlsListen []net.Listener
 
+	// unixListen are the listened Unix domain sockets.
+	unixListen []*net.UnixListener
+
+	// connLimits limits the number of the concurrent connections accepted by
+	// tcpListen, tlsListen, and unixListen.
+	connLimits *connLimiter
+
 	// quicListen are the listened QUIC connections.
 	quicListen []*quic.EarlyListener
 
@@ -168,6 +222,32 @@ type Proxy struct {
 	// empty.
 	dns64Prefs netutil.SliceSubnetSet
 
+	// clientStats tracks the clients in the per-client statistics.
+	clientStats *statsLRU
+
+	// anonymizationSalt is the salt used to hash the client addresses.
+	anonymizationSalt []byte
+
+	// blockedDomainsStats tracks the domains in the per-domain statistics of
+	// the blocked responses.
+	blockedDomainsStats *statsLRU
+
+	// allowedDomainsStats tracks the domains in the per-domain statistics of
+	// the allowed responses.
+	allowedDomainsStats *statsLRU
+
+	// cookieSecrets are the secrets of the server cookies.  It's nil unless
+	// DNSCookies is true.
+	cookieSecrets *cookieSecrets
+
+	// cookieClients are the addresses of the clients which have presented a
+	// valid server cookie recently.  It's nil unless DNSCookies is true.
+	cookieClients *gocache.Cache
+
+	// queryLog is the structured query log.  It's nil unless
+	// QueryLogFormatJSON is used.
+	queryLog *jsonQueryLog
+
 	// Config is the proxy configuration.
 	//
 	// TODO(a.garipov): Remove this embed and create a proper initializer.
@@ -185,7 +265,8 @@ type Proxy struct {
 	// Also make it a pointer.
 	sync.RWMutex
 
-	// ratelimitLock protects ratelimitBuckets.
+	// ratelimitLock protects ratelimitBuckets and the ratelimit settings of
+	// Config, since those may be changed at runtime.
 	ratelimitLock sync.Mutex
 
 	// rttLock protects upstreamRTTStats.
@@ -193,8 +274,17 @@ type Proxy struct {
 	// TODO(e.burkov):  Make it a pointer.
 	rttLock sync.Mutex
 
+	// inFlight tracks the requests being handled, so that Shutdown is able to
+	// wait for them.  Its counter is only increased under the read lock of the
+	// proxy while it's not draining.
+	inFlight sync.WaitGroup
+
 	// started indicates if the proxy has been started.
 	started bool
+
+	// draining indicates if the proxy is shutting down and waits for the
+	// requests in flight.  The new requests are dropped meanwhile.
+	draining bool
 }
 
 // New creates a new Proxy with the specified configuration.  c must not be nil.
@@ -230,6 +320,15 @@ func New(c *Config) (p *Proxy, err error) {
 			defaultMessageConstructor{},
 		),
 		recDetector: newRecursionDetector(recursionTTL, cachedRecurrentReqNum),
+		readiness:   newReadinessChecker(realClock{}, defaultReadinessTTL),
+	}
+
+	p.upstreamSet.Store(newUpstreamSet(p.configUpstreams()))
+	p.zones.Store(c.ForwardingZones)
+	p.authZones.Store(c.LocalZones)
+
+	if c.MDNSEnabled {
+		p.mdns = newMDNSClient(c.MDNSTimeout)
 	}
 
 	// TODO(e.burkov):  Validate config separately and add the contract to the
@@ -247,6 +346,26 @@ func New(c *Config) (p *Proxy, err error) {
 
 	p.initCache()
 
+	err = p.initHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.initDHCPLeases()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.initTLSCerts()
+	if err != nil {
+		return nil, err
+	}
+
+	p.filterAAAA, err = newFilterAAAA(p.FilterAAAADomains)
+	if err != nil {
+		return nil, err
+	}
+
 	if p.MaxGoroutines > 0 {
 		log.Info("dnsproxy: max goroutines is set to %d", p.MaxGoroutines)
 
@@ -272,6 +391,13 @@ func New(c *Config) (p *Proxy, err error) {
 	p.RatelimitWhitelist = slices.Clone(p.RatelimitWhitelist)
 	slices.SortFunc(p.RatelimitWhitelist, netip.Addr.Compare)
 
+	p.clientStats = newClientStatsTracker(p.ClientStatsLimit)
+	p.anonymizationSalt = newAnonymizationSalt()
+	p.blockedDomainsStats = newDomainsStatsTracker("blocked_domains", p.BlockedDomainsStatsLimit)
+	p.allowedDomainsStats = newDomainsStatsTracker("allowed_domains", p.BlockedDomainsStatsLimit)
+	p.initCookies()
+	p.connLimits = p.newConnLimiter()
+
 	return p, nil
 }
 
@@ -285,8 +411,38 @@ func (p *Proxy) Init() (err error) {
 		return fmt.Errorf("basic auth: %w", err)
 	}
 
+	p.upstreamSet.Store(newUpstreamSet(p.configUpstreams()))
+	p.zones.Store(p.ForwardingZones)
+	p.authZones.Store(p.LocalZones)
+
+	if p.MDNSEnabled {
+		p.mdns = newMDNSClient(p.MDNSTimeout)
+	}
+
+	p.readiness = newReadinessChecker(realClock{}, defaultReadinessTTL)
+
 	p.initCache()
 
+	err = p.initHosts()
+	if err != nil {
+		return err
+	}
+
+	err = p.initDHCPLeases()
+	if err != nil {
+		return err
+	}
+
+	err = p.initTLSCerts()
+	if err != nil {
+		return err
+	}
+
+	p.filterAAAA, err = newFilterAAAA(p.FilterAAAADomains)
+	if err != nil {
+		return err
+	}
+
 	if p.MaxGoroutines > 0 {
 		// rafal
 		//log.Info("dnsproxy: max goroutines is set to %d", p.MaxGoroutines)
@@ -325,6 +481,12 @@ func (p *Proxy) Init() (err error) {
 	slices.SortFunc(p.RatelimitWhitelist, netip.Addr.Compare)
 
 	p.time = realClock{}
+	p.clientStats = newClientStatsTracker(p.ClientStatsLimit)
+	p.anonymizationSalt = newAnonymizationSalt()
+	p.blockedDomainsStats = newDomainsStatsTracker("blocked_domains", p.BlockedDomainsStatsLimit)
+	p.allowedDomainsStats = newDomainsStatsTracker("allowed_domains", p.BlockedDomainsStatsLimit)
+	p.initCookies()
+	p.connLimits = p.newConnLimiter()
 
 	return nil
 }
@@ -364,11 +526,44 @@ func (p *Proxy) Start(ctx context.Context) (err error) {
 		return err
 	}
 
+	if p.QueryLogFormat == QueryLogFormatJSON {
+		p.queryLog, err = newJSONQueryLog(p.QueryLogFile, queryLogFlushInterval)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+	}
+
 	err = p.startListeners(ctx)
 	if err != nil {
 		return fmt.Errorf("starting listeners: %w", err)
 	}
 
+	p.logUpstreamTimeouts()
+
+	if p.UpstreamHealthCheckInterval > 0 {
+		p.healthChecker = newHealthChecker(
+			p.time,
+			upstreamsToCheck(p.upstreams().UpstreamConfig),
+			p.UpstreamHealthCheckInterval,
+			p.UpstreamHealthCheckFailures,
+			p.UpstreamHealthCheckSuccesses,
+		)
+		p.healthChecker.start()
+	}
+
+	if p.hosts != nil {
+		p.hosts.start()
+	}
+
+	if p.leases != nil {
+		p.leases.start()
+	}
+
+	if p.certs != nil {
+		p.certs.start()
+	}
+
 	p.started = true
 
 	return nil
@@ -386,29 +581,44 @@ func closeAll[C io.Closer](errs []error, closers ...C) (appended []error) {
 	return errs
 }
 
-// Shutdown implements the [service.Interface] for *Proxy.
-//
-// TODO(e.burkov):  Use the context.
-func (p *Proxy) Shutdown(_ context.Context) (err error) {
+// Shutdown implements the [service.Interface] for *Proxy.  It stops accepting
+// new requests and waits for the ones in flight for up to
+// [Config.ShutdownGracePeriod], or until ctx is done, before closing the
+// listeners and the upstreams.
+func (p *Proxy) Shutdown(ctx context.Context) (err error) {
 	log.Info("dnsproxy: stopping server")
 
 	p.Lock()
-	defer p.Unlock()
-
 	if !p.started {
+		p.Unlock()
+
 		log.Info("dnsproxy: dns proxy server is not started")
 
 		return nil
 	}
 
+	// Stop accepting new connections, the accepted ones are served until the
+	// requests in flight are handled.
 	errs := closeAll(nil, p.tcpListen...)
 	p.tcpListen = nil
 
+	errs = closeAll(errs, p.tlsListen...)
+	p.tlsListen = nil
+
+	p.draining = true
+	p.Unlock()
+
+	p.drain(ctx)
+
+	p.Lock()
+	defer p.Unlock()
+
 	errs = closeAll(errs, p.udpListen...)
 	p.udpListen = nil
 
-	errs = closeAll(errs, p.tlsListen...)
-	p.tlsListen = nil
+	// Closing the listeners also removes the socket files.
+	errs = closeAll(errs, p.unixListen...)
+	p.unixListen = nil
 
 	if p.httpsServer != nil {
 		errs = closeAll(errs, p.httpsServer)
@@ -441,17 +651,43 @@ func (p *Proxy) Shutdown(_ context.Context) (err error) {
 	errs = closeAll(errs, p.dnsCryptTCPListen...)
 	p.dnsCryptTCPListen = nil
 
-	for _, u := range []*UpstreamConfig{
-		p.UpstreamConfig,
-		p.PrivateRDNSUpstreamConfig,
-		p.Fallbacks,
-	} {
-		if u != nil {
-			errs = closeAll(errs, u)
-		}
+	if p.queryLog != nil {
+		// Don't reset the field, since the requests being processed may still
+		// use it.
+		errs = closeAll(errs, p.queryLog)
+	}
+
+	if p.healthChecker != nil {
+		// Don't reset the field, since the requests being processed may still
+		// use it.
+		errs = closeAll(errs, p.healthChecker)
+	}
+
+	err = p.upstreams().close()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if p.hosts != nil {
+		// Don't reset the field, since the requests being processed may still
+		// use it.
+		errs = closeAll(errs, p.hosts)
+	}
+
+	if p.leases != nil {
+		errs = closeAll(errs, p.leases)
+	}
+
+	if p.certs != nil {
+		errs = closeAll(errs, p.certs)
+	}
+
+	if fz := p.forwardingZones(); fz != nil {
+		errs = closeAll(errs, fz)
 	}
 
 	p.started = false
+	p.draining = false
 
 	log.Println("dnsproxy: stopped dns proxy server")
 
@@ -462,8 +698,53 @@ func (p *Proxy) Shutdown(_ context.Context) (err error) {
 	return nil
 }
 
+// drain waits for the requests in flight to be handled for up to
+// [Config.ShutdownGracePeriod], or until ctx is done.  p must be draining.
+func (p *Proxy) drain(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		defer log.OnPanic("dnsproxy: draining")
+
+		p.inFlight.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(cmp.Or(p.ShutdownGracePeriod, defaultShutdownGracePeriod))
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		log.Debug("dnsproxy: requests in flight handled")
+	case <-timer.C:
+		log.Info("dnsproxy: shutdown grace period is over, dropping requests in flight")
+	case <-ctx.Done():
+		log.Info("dnsproxy: dropping requests in flight: %s", ctx.Err())
+	}
+}
+
+// startRequest registers a new request in flight and returns true, unless the
+// proxy is draining.  finishRequest must be called after the request is handled
+// if ok is true.
+func (p *Proxy) startRequest() (ok bool) {
+	p.RLock()
+	defer p.RUnlock()
+
+	if p.draining {
+		return false
+	}
+
+	p.inFlight.Add(1)
+
+	return true
+}
+
+// finishRequest unregisters the request in flight registered by startRequest.
+func (p *Proxy) finishRequest() {
+	p.inFlight.Done()
+}
+
 // Addrs returns all listen addresses for the specified proto or nil if the proxy does not listen to it.
-// proto must be "tcp", "tls", "https", "quic", or "udp"
+// proto must be "tcp", "tls", "https", "quic", "dnscrypt", "unix", or "udp"
 func (p *Proxy) Addrs(proto Proto) []net.Addr {
 	p.RLock()
 	defer p.RUnlock()
@@ -481,6 +762,11 @@ func (p *Proxy) Addrs(proto Proto) []net.Addr {
 			addrs = append(addrs, l.Addr())
 		}
 
+	case ProtoUnix:
+		for _, l := range p.unixListen {
+			addrs = append(addrs, l.Addr())
+		}
+
 	case ProtoHTTPS:
 		for _, l := range p.httpsListen {
 			addrs = append(addrs, l.Addr())
@@ -506,14 +792,14 @@ func (p *Proxy) Addrs(proto Proto) []net.Addr {
 		}
 
 	default:
-		panic("proto must be 'tcp', 'tls', 'https', 'quic', 'dnscrypt' or 'udp'")
+		panic("proto must be 'tcp', 'tls', 'https', 'quic', 'dnscrypt', 'unix' or 'udp'")
 	}
 
 	return addrs
 }
 
 // Addr returns the first listen address for the specified proto or null if the proxy does not listen to it
-// proto must be "tcp", "tls", "https", "quic", or "udp"
+// proto must be "tcp", "tls", "https", "quic", "dnscrypt", "unix", or "udp"
 func (p *Proxy) Addr(proto Proto) net.Addr {
 	p.RLock()
 	defer p.RUnlock()
@@ -530,6 +816,12 @@ func (p *Proxy) Addr(proto Proto) net.Addr {
 		}
 		return p.tlsListen[0].Addr()
 
+	case ProtoUnix:
+		if len(p.unixListen) == 0 {
+			return nil
+		}
+		return p.unixListen[0].Addr()
+
 	case ProtoHTTPS:
 		if len(p.httpsListen) == 0 {
 			return nil
@@ -554,20 +846,23 @@ func (p *Proxy) Addr(proto Proto) net.Addr {
 		}
 		return p.dnsCryptUDPListen[0].LocalAddr()
 	default:
-		panic("proto must be 'tcp', 'tls', 'https', 'quic', 'dnscrypt' or 'udp'")
+		panic("proto must be 'tcp', 'tls', 'https', 'quic', 'dnscrypt', 'unix' or 'udp'")
 	}
 }
 
 // selectUpstreams returns the upstreams to use for the specified host.  It
-// firstly considers custom upstreams if those aren't empty and then the
-// configured ones.  The returned slice may be empty or nil.
-func (p *Proxy) selectUpstreams(d *DNSContext) (upstreams []upstream.Upstream, isPrivate bool) {
+// firstly considers custom upstreams if those aren't empty and then the ones
+// from ups.  The returned slice may be empty or nil.
+func (p *Proxy) selectUpstreams(
+	d *DNSContext,
+	ups *Upstreams,
+) (upstreams []upstream.Upstream, isPrivate bool) {
 	q := d.Req.Question[0]
 	host := q.Name
 
 	if d.RequestedPrivateRDNS != (netip.Prefix{}) || p.shouldStripDNS64(d.Req) {
 		// Use private upstreams.
-		private := p.PrivateRDNSUpstreamConfig
+		private := ups.PrivateRDNSUpstreamConfig
 		if p.UsePrivateRDNS && d.IsPrivateClient && private != nil {
 			// This may only be a PTR, SOA, and NS request.
 			upstreams = private.getUpstreamsForDomain(host)
@@ -589,18 +884,16 @@ func (p *Proxy) selectUpstreams(d *DNSContext) (upstreams []upstream.Upstream, i
 		}
 	}
 
-	// Use configured.
-	upstreams = getUpstreams(p.UpstreamConfig, host)
-
-	// TODO (rafal): use random upstream server if flag in configuration set
-	//////////////////////////////////////////////////////////////////////////
-	if upstreams != nil && len(upstreams) > 0 {
-		randomIndex, _ := utils.GetRandomValue(0, int64(len(upstreams)))
-		upstreams = upstreams[randomIndex : randomIndex+1]
+	// Use the forwarding zone, if any.
+	upstreams = p.forwardingZones().upstreams(getUpstreams, host)
+	if len(upstreams) > 0 {
+		return upstreams, false
 	}
-	////////////////////////////////////////////////////////////////////////
 
-	return upstreams, false
+	// Use configured.
+	upstreams = getUpstreams(ups.UpstreamConfig, host)
+
+	return p.filterHealthy(upstreams), false
 }
 
 // replyFromUpstream tries to resolve the request via configured upstream
@@ -608,7 +901,10 @@ func (p *Proxy) selectUpstreams(d *DNSContext) (upstreams []upstream.Upstream, i
 func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 	req := d.Req
 
-	upstreams, isPrivate := p.selectUpstreams(d)
+	set := p.acquireUpstreams()
+	defer set.release()
+
+	upstreams, isPrivate := p.selectUpstreams(d, set.ups)
 	if len(upstreams) == 0 {
 		d.Res = p.messages.NewMsgNXDOMAIN(req)
 
@@ -623,41 +919,55 @@ func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 	//src := "upstream"	// rafal
 
 	// Perform the DNS request.
-	resp, u, err := p.exchangeUpstreams(req, upstreams)
+	resp, u, err := p.exchangeWithRetries(req, upstreams)
+	rtt := time.Since(start)
+	recordUpstreamResult(u, rtt, err)
+
+	// Check the primary result before it's modified below.
+	trigger, useFallback := p.fallbackTrigger(resp, err)
 	if dns64Ups := p.performDNS64(req, resp, upstreams); dns64Ups != nil {
 		u = dns64Ups
 	} else if p.isBogusNXDomain(resp) {
 		log.Debug("dnsproxy: replying from upstream: response contains bogus-nxdomain ip")
 		resp = p.messages.NewMsgNXDOMAIN(req)
+		d.ede = &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeForgedAnswer,
+			ExtraText: "bogus nxdomain",
+		}
 	}
 
-	if err != nil && !isPrivate && p.Fallbacks != nil {
-		log.Debug("dnsproxy: replying from upstream: using fallback due to %s", err)
-		if err != nil && p.Fallbacks != nil {
-			// rafal
-			//log.Debug("proxy: replying from upstream: using fallback due to %s", err)
+	if fallbacks := set.ups.Fallbacks; useFallback && !isPrivate && fallbacks != nil {
+		log.Debug("dnsproxy: replying from upstream: using fallback due to %s: %v", trigger, err)
+		countFallbackTrigger(trigger)
+
+		// Reset the timer.
+		start = time.Now()
+		//src = "fallback"	// rafal
 
-			// Reset the timer.
-			start = time.Now()
-			//src = "fallback"	// rafal
+		// upstreams mustn't appear empty since they have been validated when
+		// creating proxy.
+		upstreams = fallbacks.getUpstreamsForDomain(req.Question[0].Name)
 
-			// upstreams mustn't appear empty since they have been validated when
-			// creating proxy.
-			upstreams = p.Fallbacks.getUpstreamsForDomain(req.Question[0].Name)
+		fbResp, fbU, fbErr := upstream.ExchangeParallel(upstreams, req)
+		recordUpstreamResult(fbU, time.Since(start), fbErr)
 
-			resp, u, err = upstream.ExchangeParallel(upstreams, req)
+		// Keep the response of the primary upstreams if the fallbacks have
+		// failed as well.
+		if fbErr == nil || resp == nil {
+			resp, u, err = fbResp, fbU, fbErr
+			rtt = time.Since(start)
+			d.fromFallback = true
 		}
 	}
 
-	if err != nil {
-		// rafal
-		//log.Debug("proxy: replying from %s: %s", src, err)
+	if resp == nil && p.CacheServeStale && p.replyFromStaleCache(d) {
+		log.Debug("dnsproxy: replying from upstream: serving stale response due to %s", err)
+
+		return false, nil
 	}
 
 	if resp != nil {
-		d.QueryDuration = time.Since(start)
 		//log.Debug("dnsproxy: replying from %s: rtt is %s", src, d.QueryDuration)
-		rtt := time.Since(start)
 		// rafal
 		//log.Debug("proxy: replying from %s: rtt is %s", src, rtt)
 
@@ -675,13 +985,14 @@ func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 func (p *Proxy) handleExchangeResult(d *DNSContext, req, resp *dns.Msg, u upstream.Upstream) {
 	if resp == nil {
 		d.Res = p.messages.NewMsgSERVFAIL(req)
-		d.hasEDNS0 = false
+		d.ede = &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNetworkError}
 
 		return
 	}
 
 	// TODO (rafal): print only if configured
 	//log.Info("reply from %s for %s", u.Address(), resp.Question[0].Name)
+	resp = p.filterBlockedAnswers(req, resp)
 	d.Upstream = u
 	d.Res = resp
 
@@ -715,8 +1026,12 @@ const defaultUDPBufSize = 2048
 // Resolve is the default resolving method used by the DNS proxy to query
 // upstream servers.  It expects dctx is filled with the request, the client's
 func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
+	p.scrubECS(dctx)
 	if p.EnableEDNSClientSubnet {
-		dctx.processECS(p.EDNSAddr)
+		dctx.processECS(p.EDNSAddr, uint8(p.ECSPrefixLenIPv4), uint8(p.ECSPrefixLenIPv6))
+	} else if p.ECSMode == ECSModeClamp {
+		// Account for the forwarded client subnet in the cache keys.
+		dctx.ReqECS, _ = ecsFromMsg(dctx.Req)
 	}
 
 	dctx.calcFlagsAndSize()
@@ -730,49 +1045,63 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 	//	}
 	//}
 
-	replyFromUpstream := true
+	// The hosts files, the DHCP leases, and the local zones take precedence
+	// over the blocked domains lists, so that the local infrastructure can't
+	// be blocked by accident.
+	answeredLocally := p.replyFromHosts(dctx) ||
+		p.replyFromDHCPLeases(dctx) ||
+		p.replyFromLocalZones(dctx)
+
+	var rewritten *rewriteResult
+	if !answeredLocally {
+		// The rewrite rules are applied before the blocking, since those are
+		// configured explicitly.  The CNAME targets are still checked.
+		rewritten, answeredLocally = p.rewrite(dctx)
+	}
+
+	if !answeredLocally {
+		answeredLocally = p.filterAAAARequest(dctx)
+	}
+
+	if !answeredLocally {
+		// The .local names must never leak to the upstreams.
+		answeredLocally = p.replyFromMDNS(dctx)
+	}
+
+	replyFromUpstream := !answeredLocally
 	var queryDomain string
 	// rafal code
 	////////////////////////////////////////////////////////////////////////////////
 	for _, rr := range dctx.Req.Question {
 
-		if t := rr.Qtype; t == dns.TypeA || t == dns.TypeAAAA {
-			queryDomain = ""
-			queryDomain = strings.Trim(rr.Name, "\n ")
-			queryDomain = strings.TrimSuffix(rr.Name, ".")
-			ok, blockedDomain := Bdm.checkDomain(queryDomain)
+		if !answeredLocally && p.isBlockedQueryType(rr.Qtype) {
+			queryDomain = normalizeDomain(strings.Trim(rr.Name, "\n "))
+			clientAddr := dctx.Addr.Addr()
+			ok, blockedDomain := Bdm.checkDomainInLists(queryDomain, p.blockedListsForClient(clientAddr, dctx.ClientID))
+			if ok && p.isAllowedDomain(queryDomain, blockedDomain) {
+				ok = false
+			}
+
 			if ok == true {
-				if SM.Exists("blocked_domains::blocked_responses") {
-					SM.Set("blocked_domains::blocked_responses", SM.Get("blocked_domains::blocked_responses").(uint64)+1)
-				} else {
-					SM.Set("blocked_domains::blocked_responses", uint64(1))
-				}
+				SM.Increment("blocked_domains::blocked_responses", 1)
+
+				p.countClient(clientAddr, dctx.ClientID, clientStatBlocked)
 
 				listName := Bdm.getDomainListName(blockedDomain)
-				if SM.Exists("blocked_domains::domains::" + listName + "::" + queryDomain) {
-					SM.Set("blocked_domains::domains::"+listName+"::"+queryDomain, SM.Get("blocked_domains::domains::"+listName+"::"+queryDomain).(uint64)+1)
-				} else {
-					SM.Set("blocked_domains::domains::"+listName+"::"+queryDomain, uint64(1))
-				}
+				metricBlocked.inc(listName)
+				Rsm.addBlocked()
+				p.countBlockedDomain(listName, queryDomain)
+
+				if p.BlockingDryRun {
+					log.Info("dnsproxy: dry run: %s would be blocked by rule %s from list %s", queryDomain, blockedDomain, listName)
 
-				r := GenEmptyMessage(dctx.Req, dns.RcodeSuccess, retryNoError)
-				r.Id = dctx.Req.Id
-				if t == dns.TypeA {
-					ra := new(dns.A)
-					ra.Hdr = dns.RR_Header{Name: queryDomain + ".", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}
-					ra.A = net.ParseIP("0.0.0.0")
-					r.Answer = make([]dns.RR, 1)
-					r.Answer[0] = ra
-				} else {
-					ra := new(dns.AAAA)
-					ra.Hdr = dns.RR_Header{Name: queryDomain + ".", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 3600}
-					ra.AAAA = net.ParseIP("::")
-					r.Answer = make([]dns.RR, 1)
-					r.Answer[0] = ra
+					continue
 				}
-				r.Question = dctx.Req.Question
-				dctx.Res = r
+
+				dctx.Res = p.genBlockedResponse(dctx.Req)
 				dctx.Upstream = nil
+				dctx.blockedList = listName
+				dctx.ede = newBlockedEDE(listName)
 				replyFromUpstream = false
 				ok = true
 				err = nil
@@ -790,6 +1119,10 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 		cacheWorks := p.cacheWorks(dctx)
 		if cacheWorks {
 			if p.replyFromCache(dctx) {
+				p.countClient(dctx.Addr.Addr(), dctx.ClientID, clientStatCacheHits)
+				p.blockCNAMECloaking(dctx)
+				rewritten.restore(dctx)
+
 				// Complete the response from cache.
 				dctx.scrub()
 
@@ -803,6 +1136,11 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 
 		var ok bool
 		ok, err = p.replyFromUpstream(dctx)
+		if ok {
+			p.checkSlowQuery(dctx)
+			p.protectFromRebinding(dctx)
+			p.filterAAAAResponse(dctx)
+		}
 
 		// Don't cache the responses having CD flag, just like Dnsmasq does.  It
 		// prevents the cache from being poisoned with unvalidated answers which may
@@ -814,15 +1152,22 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 		// TODO (rafal)
 		////////////////////////////////////////////////////////////////////////////////
 		if cacheWorks && ok && !dctx.Res.CheckingDisabled {
-			ok, queryDomain = Efcm.checkDomain(queryDomain)
-			if !ok {
+			if !isExcludedFromCaching(queryDomain) {
 				// Cache the response with DNSSEC RRs.
 				p.cacheResp(dctx)
 			}
 		}
+
+		// Check the CNAME targets after caching, since the cached response is
+		// checked once again when it's served.
+		if ok {
+			p.blockCNAMECloaking(dctx)
+		}
 		///////////////////////////////////////////////////////////////////////////////
 	}
 
+	rewritten.restore(dctx)
+
 	// It is possible that the response is nil if the upstream hasn't been
 	// chosen.
 	if dctx.Res != nil {
@@ -846,6 +1191,10 @@ func (p *Proxy) cacheWorks(dctx *DNSContext) (ok bool) {
 	switch {
 	case p.cache == nil:
 		reason = "disabled"
+	case p.CacheExcludedClients != nil && p.CacheExcludedClients.Contains(dctx.Addr.Addr().Unmap()):
+		// Don't use any cache, including the one of the custom upstreams, for
+		// the clients which need the fresh responses.
+		reason = "client excluded from cache"
 	case dctx.RequestedPrivateRDNS != netip.Prefix{}:
 		// Don't cache the requests intended for local upstream servers, those
 		// should be fast enough as is.
@@ -861,6 +1210,8 @@ func (p *Proxy) cacheWorks(dctx *DNSContext) (ok bool) {
 		reason = "custom upstreams cache is not configured"
 	case dctx.Req.CheckingDisabled:
 		reason = "dnssec check disabled"
+	case p.forwardingZones().cacheDisabled(dctx.Req.Question[0].Name):
+		reason = "forwarding zone cache disabled"
 	default:
 		return true
 	}
@@ -870,8 +1221,9 @@ func (p *Proxy) cacheWorks(dctx *DNSContext) (ok bool) {
 	return false
 }
 
-// processECS adds EDNS Client Subnet data into the request from d.
-func (dctx *DNSContext) processECS(cliIP net.IP) {
+// processECS adds EDNS Client Subnet data into the request from d.  lenIPv4
+// and lenIPv6 are the source prefix lengths of the added option.
+func (dctx *DNSContext) processECS(cliIP net.IP, lenIPv4, lenIPv6 uint8) {
 	if ecs, _ := ecsFromMsg(dctx.Req); ecs != nil {
 		if ones, _ := ecs.Mask.Size(); ones != 0 {
 			dctx.ReqECS = ecs
@@ -894,7 +1246,7 @@ func (dctx *DNSContext) processECS(cliIP net.IP) {
 	if !netutil.IsSpecialPurpose(cliAddr) {
 		// A Stub Resolver MUST set SCOPE PREFIX-LENGTH to 0.  See RFC 7871
 		// Section 6.
-		dctx.ReqECS = setECS(dctx.Req, cliIP, 0)
+		dctx.ReqECS = setECS(dctx.Req, cliIP, lenIPv4, lenIPv6, 0)
 
 		// rafal
 		//log.Debug("dnsproxy: setting ecs: %s", dctx.ReqECS)
@@ -20,6 +20,7 @@ import (
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	glcache "github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
@@ -114,6 +115,19 @@ func requireResponse(t testing.TB, req, reply *dns.Msg) {
 func newTLSConfig(t *testing.T) (conf *tls.Config, certPem []byte) {
 	t.Helper()
 
+	certPem, keyPem := newTestCertPEM(t, tlsServerName)
+
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	require.NoError(t, err)
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}, ServerName: tlsServerName}, certPem
+}
+
+// newTestCertPEM returns a new PEM-encoded self-signed certificate for srvName
+// and its private key.
+func newTestCertPEM(t *testing.T, srvName string) (certPem, keyPem []byte) {
+	t.Helper()
+
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	require.NoError(t, err)
 
@@ -134,7 +148,7 @@ func newTLSConfig(t *testing.T) (conf *tls.Config, certPem []byte) {
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		IsCA:                  true,
-		DNSNames:              []string{tlsServerName},
+		DNSNames:              []string{srvName},
 	}
 
 	derBytes, err := x509.CreateCertificate(
@@ -150,15 +164,12 @@ func newTLSConfig(t *testing.T) (conf *tls.Config, certPem []byte) {
 		Type:  "CERTIFICATE",
 		Bytes: derBytes,
 	})
-	keyPem := pem.EncodeToMemory(&pem.Block{
+	keyPem = pem.EncodeToMemory(&pem.Block{
 		Type:  "RSA PRIVATE KEY",
 		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
 	})
 
-	cert, err := tls.X509KeyPair(certPem, keyPem)
-	require.NoError(t, err)
-
-	return &tls.Config{Certificates: []tls.Certificate{cert}, ServerName: tlsServerName}, certPem
+	return certPem, keyPem
 }
 
 // firstIP returns the first IP address from the DNS response.
@@ -201,7 +212,7 @@ func (u *testUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 		u.ecsReqMask, _ = ecs.Mask.Size()
 	}
 	if u.ecsIP != nil {
-		setECS(resp, u.ecsIP, 24)
+		setECS(resp, u.ecsIP, 24, 56, 24)
 	}
 
 	return resp, nil
@@ -882,6 +893,82 @@ func TestRefuseAny(t *testing.T) {
 	assert.Equal(t, dns.RcodeNotImplemented, r.Rcode)
 }
 
+func TestProxy_validateRequest_any(t *testing.T) {
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	testCases := []struct {
+		name      string
+		wantTTL   uint32
+		wantRcode int
+		refuseAny bool
+		anyHINFO  bool
+		ttl       uint32
+	}{{
+		name:      "hinfo_default_ttl",
+		wantTTL:   defaultAnyHINFOTTL,
+		wantRcode: dns.RcodeSuccess,
+		refuseAny: false,
+		anyHINFO:  true,
+		ttl:       0,
+	}, {
+		name:      "hinfo_ttl",
+		wantTTL:   600,
+		wantRcode: dns.RcodeSuccess,
+		refuseAny: false,
+		anyHINFO:  true,
+		ttl:       600,
+	}, {
+		name:      "refuse_precedence",
+		wantTTL:   0,
+		wantRcode: dns.RcodeNotImplemented,
+		refuseAny: true,
+		anyHINFO:  true,
+		ttl:       0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := mustNew(t, &Config{
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{ups},
+				},
+				TrustedProxies:         defaultTrustedProxies,
+				RatelimitSubnetLenIPv4: 24,
+				RatelimitSubnetLenIPv6: 64,
+				RefuseAny:              tc.refuseAny,
+				AnyHINFO:               tc.anyHINFO,
+				AnyHINFOTTL:            tc.ttl,
+			})
+
+			dctx := p.newDNSContext(ProtoUDP, (&dns.Msg{}).SetQuestion("example.org.", dns.TypeANY))
+			dctx.Addr = netip.MustParseAddrPort("192.0.2.1:53")
+
+			resp := p.validateRequest(dctx)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			if tc.wantRcode != dns.RcodeSuccess {
+				assert.Empty(t, resp.Answer)
+
+				return
+			}
+
+			require.Len(t, resp.Answer, 1)
+
+			hinfo := testutil.RequireTypeAssert[*dns.HINFO](t, resp.Answer[0])
+			assert.Equal(t, "RFC8482", hinfo.Cpu)
+			assert.Equal(t, tc.wantTTL, hinfo.Hdr.Ttl)
+			assert.Equal(t, "example.org.", hinfo.Hdr.Name)
+		})
+	}
+}
+
 func TestInvalidDNSRequest(t *testing.T) {
 	dnsProxy := mustNew(t, &Config{
 		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
@@ -1126,7 +1213,7 @@ func TestECS(t *testing.T) {
 		ip := net.IP{1, 2, 3, 4}
 
 		m := &dns.Msg{}
-		subnet := setECS(m, ip, 16)
+		subnet := setECS(m, ip, 24, 56, 16)
 
 		ones, _ := subnet.Mask.Size()
 		assert.Equal(t, 24, ones)
@@ -1144,7 +1231,7 @@ func TestECS(t *testing.T) {
 		ip := net.IP{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
 
 		m := &dns.Msg{}
-		subnet := setECS(m, ip, 48)
+		subnet := setECS(m, ip, 24, 56, 48)
 
 		ones, _ := subnet.Mask.Size()
 		assert.Equal(t, 56, ones)
@@ -1187,6 +1274,8 @@ func TestECSProxy(t *testing.T) {
 		RatelimitSubnetLenIPv4: 24,
 		RatelimitSubnetLenIPv6: 64,
 		EnableEDNSClientSubnet: true,
+		ECSPrefixLenIPv4:       24,
+		ECSPrefixLenIPv6:       56,
 		CacheEnabled:           true,
 	})
 
@@ -1294,6 +1383,8 @@ func TestECSProxyCacheMinMaxTTL(t *testing.T) {
 		RatelimitSubnetLenIPv4: 24,
 		RatelimitSubnetLenIPv6: 64,
 		EnableEDNSClientSubnet: true,
+		ECSPrefixLenIPv4:       24,
+		ECSPrefixLenIPv6:       56,
 		CacheEnabled:           true,
 		CacheMinTTL:            20,
 		CacheMaxTTL:            40,
@@ -1583,3 +1674,202 @@ func TestProxy_HandleDNSRequest_private(t *testing.T) {
 		})
 	}
 }
+
+func TestProxy_Resolve_extendedErrors(t *testing.T) {
+	setTestBlockedDomains(t, "ads", "blocked.example\n")
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			q := m.Question[0]
+			if q.Name == "fail.example." {
+				return nil, errors.Error("test upstream error")
+			}
+
+			resp = (&dns.Msg{}).SetReply(m)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: net.IP{192, 0, 2, 53},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		BogusNXDomain:          []netip.Prefix{netip.MustParsePrefix("192.0.2.53/32")},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		BlockingMode:           BlockingModeNXDOMAIN,
+	})
+
+	testCases := []struct {
+		wantEDE   *dns.EDNS0_EDE
+		name      string
+		host      string
+		wantRcode int
+	}{{
+		wantEDE: &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeBlocked,
+			ExtraText: "ads",
+		},
+		name:      "blocked",
+		host:      "blocked.example.",
+		wantRcode: dns.RcodeNameError,
+	}, {
+		wantEDE: &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeForgedAnswer,
+			ExtraText: "bogus nxdomain",
+		},
+		name:      "bogus_nxdomain",
+		host:      "bogus.example.",
+		wantRcode: dns.RcodeNameError,
+	}, {
+		wantEDE:   &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNetworkError},
+		name:      "upstream_failure",
+		host:      "fail.example.",
+		wantRcode: dns.RcodeServerFailure,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+
+			dctx := &DNSContext{
+				Req:   req,
+				Proto: ProtoUDP,
+				Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+			}
+
+			_ = p.Resolve(dctx)
+			require.NotNil(t, dctx.Res)
+
+			assert.Equal(t, tc.wantRcode, dctx.Res.Rcode)
+
+			opt := dctx.Res.IsEdns0()
+			require.NotNil(t, opt)
+			require.Len(t, opt.Option, 1)
+
+			assert.Equal(t, tc.wantEDE, opt.Option[0])
+		})
+
+		t.Run(tc.name+"_no_edns", func(t *testing.T) {
+			dctx := &DNSContext{
+				Req:   (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA),
+				Proto: ProtoUDP,
+				Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+			}
+
+			_ = p.Resolve(dctx)
+			require.NotNil(t, dctx.Res)
+
+			assert.Equal(t, tc.wantRcode, dctx.Res.Rcode)
+			assert.Nil(t, dctx.Res.IsEdns0())
+		})
+	}
+}
+
+func TestProxy_Shutdown_drain(t *testing.T) {
+	const gracePeriod = 500 * time.Millisecond
+
+	testCases := []struct {
+		name    string
+		release bool
+		wantRes bool
+	}{{
+		name:    "drained",
+		release: true,
+		wantRes: true,
+	}, {
+		name:    "grace_period_over",
+		release: false,
+		wantRes: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			exchanged := make(chan struct{}, 1)
+			release := make(chan struct{})
+			t.Cleanup(func() { close(release) })
+
+			ups := &fakeUpstream{
+				onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+					exchanged <- struct{}{}
+					<-release
+
+					return (&dns.Msg{}).SetReply(m), nil
+				},
+				onAddress: func() (addr string) { return "upstream" },
+				onClose:   func() (err error) { return nil },
+			}
+
+			p := mustNew(t, &Config{
+				UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{ups},
+				},
+				ShutdownGracePeriod:    gracePeriod,
+				TrustedProxies:         defaultTrustedProxies,
+				RatelimitSubnetLenIPv4: 24,
+				RatelimitSubnetLenIPv6: 64,
+			})
+			require.NoError(t, p.Start(context.Background()))
+
+			addr := p.Addr(ProtoUDP).String()
+			client := &dns.Client{Net: "udp", Timeout: 2 * gracePeriod}
+
+			resCh := make(chan *dns.Msg, 1)
+			go func() {
+				res, _, _ := client.Exchange(newTestMessage(), addr)
+				resCh <- res
+			}()
+
+			testutil.RequireReceive(t, exchanged, defaultTimeout)
+
+			errCh := make(chan error, 1)
+			go func() { errCh <- p.Shutdown(context.Background()) }()
+
+			// The requests received while draining are dropped.
+			require.Eventually(t, func() (ok bool) {
+				p.RLock()
+				defer p.RUnlock()
+
+				return p.draining
+			}, defaultTimeout, gracePeriod/50)
+
+			dropClient := &dns.Client{Net: "udp", Timeout: gracePeriod / 5}
+			_, _, err := dropClient.Exchange(newHostTestMessage("other.example"), addr)
+			require.Error(t, err)
+
+			var netErr net.Error
+			require.ErrorAs(t, err, &netErr)
+			assert.True(t, netErr.Timeout())
+
+			if tc.release {
+				testutil.RequireSend(t, release, struct{}{}, defaultTimeout)
+			}
+
+			err, _ = testutil.RequireReceive(t, errCh, defaultTimeout)
+			require.NoError(t, err)
+
+			res, _ := testutil.RequireReceive(t, resCh, defaultTimeout)
+			if tc.wantRes {
+				require.NotNil(t, res)
+				assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+			} else {
+				assert.Nil(t, res)
+			}
+		})
+	}
+}
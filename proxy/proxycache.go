@@ -28,14 +28,11 @@ func (p *Proxy) replyFromCache(d *DNSContext) (hit bool) {
 
 	// rafal
 	////////////////////////////////////////////////////
-	SM.Set("cache::cache_size", p.cache.items.Stats().Size)
-	SM.Set("cache::cache_count", p.cache.items.Stats().Count)
-	//SM.Set("cache::cache_hits", p.cache.items.Stats().Hit)
-	//SM.Set("cache::cache_misses", p.cache.items.Stats().Miss)
+	p.cache.recordSize()
 	////////////////////////////////////////////////////
 	// end rafal
 
-	if !p.Config.EnableEDNSClientSubnet {
+	if !p.cacheWithECS() {
 		ci, expired, key = dctxCache.get(d.Req)
 		//hitMsg = "serving cached response"	// rafal
 	} else if d.ReqECS != nil {
@@ -47,33 +44,85 @@ func (p *Proxy) replyFromCache(d *DNSContext) (hit bool) {
 	}
 
 	if hit = ci != nil; !hit {
+		countCacheMiss()
+
 		return hit
 	}
 
+	if expired {
+		countCacheHit(cacheHitOptimistic)
+	} else {
+		countCacheHit(cacheHitFresh)
+	}
+
 	d.Res = ci.m
 	d.CachedUpstreamAddr = ci.u
+	d.fromCache = true
 
 	//log.Debug("dnsproxy: cache: %s", hitMsg)	// rafal
 
 	if dctxCache.optimistic && expired {
-		// Build a reduced clone of the current context to avoid data race.
-		minCtxClone := &DNSContext{
-			// It is only read inside the optimistic resolver.
-			CustomUpstreamConfig: d.CustomUpstreamConfig,
-			ReqECS:               cloneIPNet(d.ReqECS),
-			IsPrivateClient:      d.IsPrivateClient,
-		}
-		if d.Req != nil {
-			minCtxClone.Req = d.Req.Copy()
-			addDO(minCtxClone.Req)
-		}
-
-		go p.shortFlighter.ResolveOnce(minCtxClone, key)
+		p.refreshInBackground(d, key)
+	} else if !expired && dctxCache == p.cache {
+		p.prefetchIfNeeded(d, key, ci.ttl)
 	}
 
 	return hit
 }
 
+// replyFromStaleCache tries to get the expired response for d from the cache
+// after the upstreams have failed to resolve it, as RFC 8767 describes, and
+// starts refreshing it in the background.  Returns true on success.
+func (p *Proxy) replyFromStaleCache(d *DNSContext) (ok bool) {
+	if !p.cacheWorks(d) {
+		return false
+	}
+
+	dctxCache := p.cacheForContext(d)
+
+	var ci *cacheItem
+	var key []byte
+	if p.cacheWithECS() && d.ReqECS != nil {
+		ci, key = dctxCache.getStaleWithSubnet(d.Req, d.ReqECS)
+	} else {
+		ci, key = dctxCache.getStale(d.Req)
+	}
+
+	if ci == nil {
+		return false
+	}
+
+	d.Res = ci.m
+	d.CachedUpstreamAddr = ci.u
+	d.fromCache = true
+	d.fromStale = true
+
+	countCacheHit(cacheHitStale)
+
+	p.refreshInBackground(d, key)
+
+	return true
+}
+
+// refreshInBackground resolves the request from d once again with the
+// optimistic resolver and caches the response.  key is the cache key of the
+// request.
+func (p *Proxy) refreshInBackground(d *DNSContext, key []byte) {
+	// Build a reduced clone of the current context to avoid data race.
+	minCtxClone := &DNSContext{
+		// It is only read inside the optimistic resolver.
+		CustomUpstreamConfig: d.CustomUpstreamConfig,
+		ReqECS:               cloneIPNet(d.ReqECS),
+		IsPrivateClient:      d.IsPrivateClient,
+	}
+	if d.Req != nil {
+		minCtxClone.Req = d.Req.Copy()
+		addDO(minCtxClone.Req)
+	}
+
+	go p.shortFlighter.ResolveOnce(minCtxClone, key)
+}
+
 // cloneIPNet returns a deep clone of n.
 func cloneIPNet(n *net.IPNet) (clone *net.IPNet) {
 	if n == nil {
@@ -90,8 +139,11 @@ func cloneIPNet(n *net.IPNet) (clone *net.IPNet) {
 // cache is present in d, it's used first.
 func (p *Proxy) cacheResp(d *DNSContext) {
 	dctxCache := p.cacheForContext(d)
+	if dctxCache == p.cache {
+		defer p.cache.recordSize()
+	}
 
-	if !p.EnableEDNSClientSubnet {
+	if !p.cacheWithECS() {
 		dctxCache.set(d.Res, d.Upstream)
 
 		return
@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// QueryLogFormat defines how the queries and responses are logged.
+type QueryLogFormat string
+
+// QueryLogFormat values.
+const (
+	// QueryLogFormatText writes the human-readable lines to the main log.
+	QueryLogFormatText QueryLogFormat = ""
+
+	// QueryLogFormatJSON writes a JSON object per line to the query log file.
+	QueryLogFormatJSON QueryLogFormat = "json"
+)
+
+// QueryLogFilter defines which queries and responses are logged.
+type QueryLogFilter string
+
+// QueryLogFilter values.
+const (
+	// QueryLogFilterAll logs all the queries and responses.
+	QueryLogFilterAll QueryLogFilter = ""
+
+	// QueryLogFilterBlocked logs only the responses to the blocked queries.
+	QueryLogFilterBlocked QueryLogFilter = "blocked"
+
+	// QueryLogFilterNone logs nothing.
+	QueryLogFilterNone QueryLogFilter = "none"
+)
+
+// isLogged returns true if m, which is either the request or the response of
+// d, should be logged according to the query log filter.
+func (p *Proxy) isLogged(d *DNSContext, m *dns.Msg) (ok bool) {
+	switch p.QueryLogFilter {
+	case QueryLogFilterBlocked:
+		return m.Response && d.blockedList != "" && len(m.Question) > 0
+	case QueryLogFilterNone:
+		return false
+	default:
+		return true
+	}
+}
+
+// queryLogFlushInterval is the interval the buffered query log is written to
+// the file with.
+const queryLogFlushInterval = time.Second
+
+// validateQueryLog returns an error if the query log configuration is invalid.
+func (p *Proxy) validateQueryLog() (err error) {
+	switch p.QueryLogFilter {
+	case QueryLogFilterAll, QueryLogFilterBlocked, QueryLogFilterNone:
+		// Go on.
+	default:
+		return fmt.Errorf("unknown query log filter %q", p.QueryLogFilter)
+	}
+
+	switch p.QueryLogFormat {
+	case QueryLogFormatText:
+		return nil
+	case QueryLogFormatJSON:
+		if p.QueryLogFile == "" {
+			return errors.Error("json query log requires the query log file")
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unknown query log format %q", p.QueryLogFormat)
+	}
+}
+
+// queryLogEntry is a single query or response in the structured query log.
+type queryLogEntry struct {
+	// Time is the time the entry is written at.
+	Time time.Time `json:"time"`
+
+	// Type is either "query" or "response".
+	Type string `json:"type"`
+
+	// Client is the address of the client.
+	Client string `json:"client"`
+
+	// Proto is the protocol the query has been received over.
+	Proto Proto `json:"proto"`
+
+	// QName and QType are the question of the query.
+	QName string `json:"qname"`
+	QType string `json:"qtype"`
+
+	// Rcode is the response code, it's empty for the queries.
+	Rcode string `json:"rcode,omitempty"`
+
+	// Upstream is the address of the upstream which has resolved the query.
+	Upstream string `json:"upstream,omitempty"`
+
+	// Answers are the addresses from the answer section.
+	Answers []string `json:"answers,omitempty"`
+
+	// DurationMs is the duration of the exchange with the upstream in
+	// milliseconds.
+	DurationMs float64 `json:"duration_ms,omitempty"`
+
+	// Cached is true if the response has been served from the cache.
+	Cached bool `json:"cached,omitempty"`
+
+	// Blocked is true if the query has been blocked.
+	Blocked bool `json:"blocked,omitempty"`
+
+	// List is the name of the blocked domains list the query has been blocked
+	// by.
+	List string `json:"list,omitempty"`
+}
+
+// newQueryLogEntry returns the entry for m, which is either the request or the
+// response of d.
+func (p *Proxy) newQueryLogEntry(d *DNSContext, m *dns.Msg) (e *queryLogEntry) {
+	e = &queryLogEntry{
+		Time:   time.Now(),
+		Type:   "query",
+		Client: p.anonymizeAddr(d.Addr.Addr()),
+		Proto:  d.Proto,
+	}
+
+	if len(m.Question) > 0 {
+		e.QName = m.Question[0].Name
+		e.QType = qtypeLabel(m.Question[0].Qtype)
+	}
+
+	if !m.Response {
+		return e
+	}
+
+	e.Type = "response"
+	e.Rcode = rcodeLabel(m.Rcode)
+	e.Cached = d.fromCache
+	e.Blocked = d.blockedList != ""
+	e.List = d.blockedList
+	e.DurationMs = float64(d.QueryDuration) / float64(time.Millisecond)
+	if d.Upstream != nil {
+		e.Upstream = d.Upstream.Address()
+	}
+
+	for _, rr := range m.Answer {
+		if ip := proxyutil.IPFromRR(rr); ip.IsValid() {
+			e.Answers = append(e.Answers, ip.String())
+		}
+	}
+
+	return e
+}
+
+// jsonQueryLog writes the query log entries as JSON objects, one per line, to a
+// file.  The writes are buffered and flushed periodically.
+type jsonQueryLog struct {
+	// mux protects the fields below.
+	mux sync.Mutex
+
+	file *os.File
+	buf  *bufio.Writer
+	enc  *json.Encoder
+
+	// done is closed when the log is closed to stop the flushing.
+	done chan struct{}
+
+	closed bool
+}
+
+// newJSONQueryLog opens the file at path for appending and returns the query
+// log writing to it and flushing the buffer every flushIvl.
+func newJSONQueryLog(path string, flushIvl time.Duration) (l *jsonQueryLog, err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening query log: %w", err)
+	}
+
+	buf := bufio.NewWriter(f)
+	l = &jsonQueryLog{
+		file: f,
+		buf:  buf,
+		enc:  json.NewEncoder(buf),
+		done: make(chan struct{}),
+	}
+
+	go l.flushPeriodically(flushIvl)
+
+	return l, nil
+}
+
+// write writes e to the log.  It does nothing if the log is closed.
+func (l *jsonQueryLog) write(e *queryLogEntry) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.closed {
+		return
+	}
+
+	err := l.enc.Encode(e)
+	if err != nil {
+		log.Debug("dnsproxy: writing query log: %s", err)
+	}
+}
+
+// flushPeriodically flushes the buffer every ivl until the log is closed.
+func (l *jsonQueryLog) flushPeriodically(ivl time.Duration) {
+	defer log.OnPanic("query log flush")
+
+	ticker := time.NewTicker(ivl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.mux.Lock()
+			err := l.buf.Flush()
+			l.mux.Unlock()
+
+			if err != nil {
+				log.Debug("dnsproxy: flushing query log: %s", err)
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Close implements the [io.Closer] interface for *jsonQueryLog.  It flushes
+// the buffer and closes the file.
+func (l *jsonQueryLog) Close() (err error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.closed {
+		return nil
+	}
+
+	l.closed = true
+	close(l.done)
+
+	return errors.Join(l.buf.Flush(), l.file.Close())
+}
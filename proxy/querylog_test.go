@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_validateQueryLog(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		conf       Config
+	}{{
+		name:       "text",
+		wantErrMsg: "",
+		conf:       Config{},
+	}, {
+		name:       "json",
+		wantErrMsg: "",
+		conf:       Config{QueryLogFormat: QueryLogFormatJSON, QueryLogFile: "querylog.json"},
+	}, {
+		name:       "json_no_file",
+		wantErrMsg: "json query log requires the query log file",
+		conf:       Config{QueryLogFormat: QueryLogFormatJSON},
+	}, {
+		name:       "unknown",
+		wantErrMsg: `unknown query log format "xml"`,
+		conf:       Config{QueryLogFormat: "xml"},
+	}, {
+		name:       "filter_blocked",
+		wantErrMsg: "",
+		conf:       Config{QueryLogFilter: QueryLogFilterBlocked},
+	}, {
+		name:       "filter_unknown",
+		wantErrMsg: `unknown query log filter "allowed"`,
+		conf:       Config{QueryLogFilter: "allowed"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: tc.conf}
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, p.validateQueryLog())
+		})
+	}
+}
+
+func TestProxy_mylogDNSMessage_json(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "querylog.json")
+
+	ql, err := newJSONQueryLog(path, time.Hour)
+	require.NoError(t, err)
+
+	p := &Proxy{queryLog: ql}
+
+	req := (&dns.Msg{}).SetQuestion("log.example.", dns.TypeA)
+	resp := (&dns.Msg{}).SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "log.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{192, 0, 2, 2},
+	})
+
+	d := &DNSContext{
+		Req:           req,
+		Res:           resp,
+		Proto:         ProtoTCP,
+		Addr:          netip.MustParseAddrPort("192.0.2.1:5353"),
+		QueryDuration: 1500 * time.Microsecond,
+		fromCache:     true,
+	}
+
+	p.mylogDNSMessage(d, "req")
+	p.mylogDNSMessage(d, "res")
+
+	d.fromCache = false
+	d.blockedList = "ads"
+	d.Res = p.genBlockedResponse(req)
+	p.mylogDNSMessage(d, "res")
+
+	require.NoError(t, ql.Close())
+
+	// Writing to the closed log is a no-op.
+	p.mylogDNSMessage(d, "req")
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, f.Close)
+
+	var entries []queryLogEntry
+	for s := bufio.NewScanner(f); s.Scan(); {
+		e := queryLogEntry{}
+		require.NoError(t, json.Unmarshal(s.Bytes(), &e))
+
+		// Don't compare the time.
+		assert.False(t, e.Time.IsZero())
+		e.Time = time.Time{}
+
+		entries = append(entries, e)
+	}
+
+	assert.Equal(t, []queryLogEntry{{
+		Type:   "query",
+		Client: "192.0.2.1",
+		Proto:  ProtoTCP,
+		QName:  "log.example.",
+		QType:  "A",
+	}, {
+		Type:       "response",
+		Client:     "192.0.2.1",
+		Proto:      ProtoTCP,
+		QName:      "log.example.",
+		QType:      "A",
+		Rcode:      "NOERROR",
+		Answers:    []string{"192.0.2.2"},
+		DurationMs: 1.5,
+		Cached:     true,
+	}, {
+		Type:       "response",
+		Client:     "192.0.2.1",
+		Proto:      ProtoTCP,
+		QName:      "log.example.",
+		QType:      "A",
+		Rcode:      "NOERROR",
+		Answers:    []string{"0.0.0.0"},
+		DurationMs: 1.5,
+		Blocked:    true,
+		List:       "ads",
+	}}, entries)
+}
+
+func TestProxy_mylogDNSMessage_filter(t *testing.T) {
+	req := (&dns.Msg{}).SetQuestion("filter.example.", dns.TypeA)
+
+	p := &Proxy{}
+	allowed := &DNSContext{
+		Req:   req,
+		Res:   (&dns.Msg{}).SetReply(req),
+		Proto: ProtoUDP,
+		Addr:  netip.MustParseAddrPort("192.0.2.1:5353"),
+	}
+	blocked := &DNSContext{
+		Req:         req,
+		Res:         p.genBlockedResponse(req),
+		Proto:       ProtoUDP,
+		Addr:        netip.MustParseAddrPort("192.0.2.1:5353"),
+		blockedList: "ads",
+	}
+
+	testCases := []struct {
+		name      string
+		filter    QueryLogFilter
+		wantLines []string
+	}{{
+		name:   "all",
+		filter: QueryLogFilterAll,
+		wantLines: []string{
+			"Q#", "A#", "Q#", "A#",
+		},
+	}, {
+		name:   "blocked",
+		filter: QueryLogFilterBlocked,
+		wantLines: []string{
+			"B#",
+		},
+	}, {
+		name:      "none",
+		filter:    QueryLogFilterNone,
+		wantLines: nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w := log.Writer()
+			log.SetOutput(buf)
+			t.Cleanup(func() { log.SetOutput(w) })
+
+			p.QueryLogFilter = tc.filter
+			for _, d := range []*DNSContext{allowed, blocked} {
+				p.mylogDNSMessage(d, "req")
+				p.mylogDNSMessage(d, "res")
+			}
+
+			var prefixes []string
+			for s := bufio.NewScanner(buf); s.Scan(); {
+				line := s.Text()
+				require.GreaterOrEqual(t, len(line), 2)
+
+				prefixes = append(prefixes, line[:2])
+				if line[:2] == "B#" {
+					assert.Contains(t, line, "filter.example.")
+					assert.Contains(t, line, "ads")
+					assert.Contains(t, line, "192.0.2.1")
+				}
+			}
+
+			assert.Equal(t, tc.wantLines, prefixes)
+		})
+	}
+}
+
+func TestAnswerSummary(t *testing.T) {
+	hdr := func(rrtype uint16) (h dns.RR_Header) {
+		return dns.RR_Header{Name: "summary.example.", Rrtype: rrtype, Class: dns.ClassINET}
+	}
+
+	cname := &dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: "target.example."}
+	txt := &dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: []string{"text"}}
+	a := &dns.A{Hdr: hdr(dns.TypeA), A: net.IP{192, 0, 2, 1}}
+	aaaa := &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: net.ParseIP("2001:db8::1")}
+
+	testCases := []struct {
+		name   string
+		want   string
+		answer []dns.RR
+	}{{
+		name:   "no_data",
+		want:   "no data",
+		answer: nil,
+	}, {
+		name:   "txt",
+		want:   "no data",
+		answer: []dns.RR{txt},
+	}, {
+		name:   "cname",
+		want:   "target.example.",
+		answer: []dns.RR{cname, txt},
+	}, {
+		name:   "cname_a",
+		want:   "192.0.2.1",
+		answer: []dns.RR{cname, a},
+	}, {
+		name:   "aaaa",
+		want:   "2001:db8::1",
+		answer: []dns.RR{aaaa, a},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, answerSummary(&dns.Msg{Answer: tc.answer}))
+		})
+	}
+}
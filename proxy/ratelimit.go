@@ -1,43 +1,48 @@
 package proxy
 
 import (
+	"cmp"
+	"fmt"
 	"net/netip"
 	"slices"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
 	rate "github.com/beefsack/go-rate"
+	"github.com/miekg/dns"
 	gocache "github.com/patrickmn/go-cache"
 )
 
-func (p *Proxy) limiterForIP(ip string) interface{} {
-	p.ratelimitLock.Lock()
-	defer p.ratelimitLock.Unlock()
-	if p.ratelimitBuckets == nil {
-		p.ratelimitBuckets = gocache.New(time.Hour, time.Hour)
-	}
-
-	// check if ratelimiter for that IP already exists, if not, create
-	value, found := p.ratelimitBuckets.Get(ip)
-	if !found {
-		value = rate.New(p.Ratelimit, time.Second)
-		p.ratelimitBuckets.Set(ip, value, time.Hour)
-	}
+// ratelimiter is the rate limiter of the clients from a single subnet.
+type ratelimiter struct {
+	*rate.RateLimiter
 
-	return value
+	// limited is the number of the queries limited so far, used to slip every
+	// [Config.RatelimitSlip]-th of them.
+	limited atomic.Uint64
 }
 
-func (p *Proxy) isRatelimited(addr netip.Addr) (ok bool) {
+// limiterFor returns the rate limiter of the subnet of addr along with the
+// slip ratio, see [Config.RatelimitSlip].  The requests presenting valid DNS
+// cookies, i.e. having cookie set to true, are limited separately, see
+// [Config.RatelimitCookie].  rl is nil if the requests from addr aren't
+// ratelimited.
+func (p *Proxy) limiterFor(addr netip.Addr, cookie bool) (rl *ratelimiter, slipRatio uint64) {
+	p.ratelimitLock.Lock()
+	defer p.ratelimitLock.Unlock()
+
 	if p.Ratelimit <= 0 {
 		// The ratelimit is disabled.
-		return false
+		return nil, 0
 	}
 
 	addr = addr.Unmap()
-	// Already sorted by [Proxy.Init].
-	_, ok = slices.BinarySearchFunc(p.RatelimitWhitelist, addr, netip.Addr.Compare)
+	// Already sorted by [Proxy.Init] and [Proxy.SetRatelimit].
+	_, ok := slices.BinarySearchFunc(p.RatelimitWhitelist, addr, netip.Addr.Compare)
 	if ok {
-		return false
+		return nil, 0
 	}
 
 	var pref netip.Prefix
@@ -48,17 +53,166 @@ func (p *Proxy) isRatelimited(addr netip.Addr) (ok bool) {
 	}
 	pref = pref.Masked()
 
+	if p.ratelimitBuckets == nil {
+		p.ratelimitBuckets = gocache.New(time.Hour, time.Hour)
+	}
+
 	// TODO(s.chzhen):  Improve caching.  Decrease allocations.
 	ipStr := pref.Addr().String()
-	value := p.limiterForIP(ipStr)
-	rl, ok := value.(*rate.RateLimiter)
+	limit := p.Ratelimit
+	if cookie {
+		ipStr = "cookie:" + ipStr
+		limit = cmp.Or(p.RatelimitCookie, p.Ratelimit)
+	}
+
+	// check if ratelimiter for that IP already exists, if not, create
+	value, found := p.ratelimitBuckets.Get(ipStr)
+	if !found {
+		value = &ratelimiter{RateLimiter: rate.New(limit, time.Second)}
+		p.ratelimitBuckets.Set(ipStr, value, time.Hour)
+	}
+
+	rl, ok = value.(*ratelimiter)
 	if !ok {
 		log.Error("dnsproxy: %T found in ratelimit cache", value)
 
-		return false
+		return nil, 0
+	}
+
+	return rl, uint64(p.RatelimitSlip)
+}
+
+func (p *Proxy) isRatelimited(addr netip.Addr) (ok bool) {
+	ok, _ = p.ratelimit(addr, false)
+
+	return ok
+}
+
+// ratelimit returns true if the query from addr should be limited.  cookie is
+// true if the query has presented a valid DNS cookie.  slip is true if the
+// limited query should be answered with a truncated response instead of being
+// dropped, see [Config.RatelimitSlip].
+func (p *Proxy) ratelimit(addr netip.Addr, cookie bool) (limited, slip bool) {
+	rl, slipRatio := p.limiterFor(addr, cookie)
+	if rl == nil {
+		return false, false
+	}
+
+	if allow, _ := rl.Try(); allow {
+		return false, false
+	}
+
+	return true, slipRatio > 0 && rl.limited.Add(1)%slipRatio == 0
+}
+
+// genTruncatedResponse returns the empty truncated response to req, which makes
+// the client retry over TCP.
+func genTruncatedResponse(req *dns.Msg) (resp *dns.Msg) {
+	resp = reply(req, dns.RcodeSuccess)
+	resp.Truncated = true
+
+	return resp
+}
+
+// RatelimitSettings are the ratelimit settings which can be changed at runtime,
+// see the corresponding fields of [Config].
+type RatelimitSettings struct {
+	// Whitelist is a list of IP addresses excluded from rate limiting.
+	Whitelist []netip.Addr `json:"whitelist"`
+
+	// Ratelimit is a maximum number of requests per second from a given
+	// subnet, zero disables the ratelimit.
+	Ratelimit int `json:"ratelimit"`
+
+	// SubnetLenIPv4 is a subnet length for IPv4 addresses.
+	SubnetLenIPv4 int `json:"subnet_len_ipv4"`
+
+	// SubnetLenIPv6 is a subnet length for IPv6 addresses.
+	SubnetLenIPv6 int `json:"subnet_len_ipv6"`
+
+	// Slip is the ratio of the ratelimited UDP requests answered with a
+	// truncated response.
+	Slip uint `json:"slip"`
+
+	// Cookie is a maximum number of requests per second from a given subnet
+	// presenting valid DNS cookies, zero means Ratelimit.
+	Cookie int `json:"cookie"`
+}
+
+// validate returns an error if s is invalid.
+func (s *RatelimitSettings) validate() (err error) {
+	if s.Ratelimit == 0 {
+		return nil
+	}
+
+	if s.Cookie < 0 {
+		return fmt.Errorf("negative ratelimit for cookies %d", s.Cookie)
+	}
+
+	err = checkInclusion(s.SubnetLenIPv4, 0, netutil.IPv4BitLen)
+	if err != nil {
+		return fmt.Errorf("ratelimit subnet len ipv4 is invalid: %w", err)
+	}
+
+	err = checkInclusion(s.SubnetLenIPv6, 0, netutil.IPv6BitLen)
+	if err != nil {
+		return fmt.Errorf("ratelimit subnet len ipv6 is invalid: %w", err)
+	}
+
+	return nil
+}
+
+// RatelimitSettings returns the current ratelimit settings of p.
+func (p *Proxy) RatelimitSettings() (s RatelimitSettings) {
+	p.ratelimitLock.Lock()
+	defer p.ratelimitLock.Unlock()
+
+	return RatelimitSettings{
+		Whitelist:     slices.Clone(p.RatelimitWhitelist),
+		Ratelimit:     p.Ratelimit,
+		SubnetLenIPv4: p.RatelimitSubnetLenIPv4,
+		SubnetLenIPv6: p.RatelimitSubnetLenIPv6,
+		Slip:          p.RatelimitSlip,
+		Cookie:        p.RatelimitCookie,
+	}
+}
+
+// SetRatelimit atomically replaces the ratelimit settings of p with s.  The
+// buckets of the clients are reset if the limit or the subnet lengths change,
+// so that the new limit applies immediately.  It's safe for concurrent use.
+func (p *Proxy) SetRatelimit(s RatelimitSettings) (err error) {
+	err = s.validate()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	whitelist := slices.Clone(s.Whitelist)
+	for i, addr := range whitelist {
+		whitelist[i] = addr.Unmap()
+	}
+	slices.SortFunc(whitelist, netip.Addr.Compare)
+
+	p.ratelimitLock.Lock()
+	defer p.ratelimitLock.Unlock()
+
+	reset := p.Ratelimit != s.Ratelimit ||
+		p.RatelimitSubnetLenIPv4 != s.SubnetLenIPv4 ||
+		p.RatelimitSubnetLenIPv6 != s.SubnetLenIPv6 ||
+		p.RatelimitCookie != s.Cookie
+
+	p.RatelimitWhitelist = whitelist
+	p.Ratelimit = s.Ratelimit
+	p.RatelimitSubnetLenIPv4 = s.SubnetLenIPv4
+	p.RatelimitSubnetLenIPv6 = s.SubnetLenIPv6
+	p.RatelimitSlip = s.Slip
+	p.RatelimitCookie = s.Cookie
+
+	if reset && p.ratelimitBuckets != nil {
+		p.ratelimitBuckets.Flush()
 	}
 
-	allow, _ := rl.Try()
+	log.Info("dnsproxy: ratelimit settings replaced, %d rps", s.Ratelimit)
 
-	return !allow
+	return nil
 }
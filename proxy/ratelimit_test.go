@@ -9,6 +9,7 @@ import (
 
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -95,3 +96,184 @@ func TestWhitelist(t *testing.T) {
 		t.Fatal("Second request must have been allowed due to whitelist")
 	}
 }
+
+func TestProxy_isRatelimited_subnet(t *testing.T) {
+	testCases := []struct {
+		name    string
+		first   string
+		others  []string
+		outside string
+	}{{
+		name:    "ipv4",
+		first:   "192.0.2.1",
+		others:  []string{"192.0.2.2", "192.0.2.100", "::ffff:192.0.2.254"},
+		outside: "192.0.3.1",
+	}, {
+		name:    "ipv6",
+		first:   "2001:db8:0:1::1",
+		others:  []string{"2001:db8:0:1::2", "2001:db8:0:ff:1:2:3:4", "2001:db8:0:1:ffff::"},
+		outside: "2001:db8:0:100::1",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{}
+			p.Ratelimit = 1
+			p.RatelimitSubnetLenIPv4 = 24
+			p.RatelimitSubnetLenIPv6 = 56
+
+			require.False(t, p.isRatelimited(netip.MustParseAddr(tc.first)))
+
+			for _, addr := range tc.others {
+				assert.Truef(t, p.isRatelimited(netip.MustParseAddr(addr)), "address %s", addr)
+			}
+
+			assert.False(t, p.isRatelimited(netip.MustParseAddr(tc.outside)))
+		})
+	}
+
+	t.Run("whitelist", func(t *testing.T) {
+		p := &Proxy{}
+		p.Ratelimit = 1
+		p.RatelimitSubnetLenIPv4 = 24
+		p.RatelimitWhitelist = []netip.Addr{netip.MustParseAddr("192.0.2.2")}
+
+		require.False(t, p.isRatelimited(netip.MustParseAddr("192.0.2.1")))
+		require.True(t, p.isRatelimited(netip.MustParseAddr("192.0.2.3")))
+
+		// The whitelist is matched against the full address, not the subnet.
+		assert.False(t, p.isRatelimited(netip.MustParseAddr("192.0.2.2")))
+	})
+}
+
+func TestProxy_ratelimit_slip(t *testing.T) {
+	testCases := []struct {
+		name     string
+		wantSlip []bool
+		slip     uint
+	}{{
+		name:     "disabled",
+		wantSlip: []bool{false, false, false, false},
+		slip:     0,
+	}, {
+		name:     "every",
+		wantSlip: []bool{true, true, true, true},
+		slip:     1,
+	}, {
+		name:     "every_second",
+		wantSlip: []bool{false, true, false, true},
+		slip:     2,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{}
+			p.Ratelimit = 1
+			p.RatelimitSlip = tc.slip
+			p.RatelimitSubnetLenIPv4 = 24
+
+			addr := netip.MustParseAddr("192.0.2.1")
+
+			limited, slip := p.ratelimit(addr, false)
+			require.False(t, limited)
+			require.False(t, slip)
+
+			for i, want := range tc.wantSlip {
+				limited, slip = p.ratelimit(addr, false)
+				require.True(t, limited)
+				assert.Equalf(t, want, slip, "request %d", i)
+			}
+		})
+	}
+}
+
+func TestGenTruncatedResponse(t *testing.T) {
+	req := newTestMessage()
+	resp := genTruncatedResponse(req)
+
+	assert.True(t, resp.Truncated)
+	assert.True(t, resp.Response)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, req.Id, resp.Id)
+	assert.Empty(t, resp.Answer)
+}
+
+func TestProxy_SetRatelimit(t *testing.T) {
+	p := &Proxy{}
+	p.Ratelimit = 1
+	p.RatelimitSubnetLenIPv4 = 24
+	p.RatelimitSubnetLenIPv6 = 64
+
+	addr := netip.MustParseAddr("192.0.2.1")
+	require.False(t, p.isRatelimited(addr))
+	require.True(t, p.isRatelimited(addr))
+
+	t.Run("whitelist", func(t *testing.T) {
+		err := p.SetRatelimit(RatelimitSettings{
+			Whitelist:     []netip.Addr{netip.MustParseAddr("::ffff:192.0.2.1")},
+			Ratelimit:     1,
+			SubnetLenIPv4: 24,
+			SubnetLenIPv6: 64,
+		})
+		require.NoError(t, err)
+
+		assert.False(t, p.isRatelimited(addr))
+
+		// The bucket of the subnet is kept.
+		assert.True(t, p.isRatelimited(netip.MustParseAddr("192.0.2.2")))
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		err := p.SetRatelimit(RatelimitSettings{
+			Ratelimit:     2,
+			SubnetLenIPv4: 24,
+			SubnetLenIPv6: 64,
+		})
+		require.NoError(t, err)
+
+		assert.False(t, p.isRatelimited(addr))
+		assert.False(t, p.isRatelimited(addr))
+		assert.True(t, p.isRatelimited(addr))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		prev := p.RatelimitSettings()
+
+		err := p.SetRatelimit(RatelimitSettings{
+			Ratelimit:     1,
+			SubnetLenIPv4: 33,
+			SubnetLenIPv6: 64,
+		})
+		testutil.AssertErrorMsg(
+			t,
+			"ratelimit subnet len ipv4 is invalid: value 33 greater than max 32",
+			err,
+		)
+
+		assert.Equal(t, prev, p.RatelimitSettings())
+	})
+}
+
+func TestProxy_ratelimit_cookie(t *testing.T) {
+	p := &Proxy{}
+	p.Ratelimit = 1
+	p.RatelimitCookie = 2
+	p.RatelimitSubnetLenIPv4 = 24
+
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	limited, _ := p.ratelimit(addr, false)
+	require.False(t, limited)
+
+	limited, _ = p.ratelimit(addr, false)
+	require.True(t, limited)
+
+	// The requests with valid cookies have their own bucket and limit.
+	for i := range 2 {
+		limited, _ = p.ratelimit(addr, true)
+		assert.Falsef(t, limited, "request %d", i)
+	}
+
+	limited, _ = p.ratelimit(addr, true)
+	assert.True(t, limited)
+}
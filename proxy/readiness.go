@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// defaultReadinessTTL is the time the result of the readiness check is reused
+// for, so that the frequent probes don't load the upstreams.
+const defaultReadinessTTL = 5 * time.Second
+
+// errNotStarted is returned by [Proxy.CheckLiveness] if the proxy isn't
+// serving requests.
+const errNotStarted errors.Error = "dns proxy server is not started"
+
+// errShutdownInProgress is returned by [Proxy.CheckLiveness] if the proxy is
+// draining the requests in flight.
+const errShutdownInProgress errors.Error = "dns proxy server is shutting down"
+
+// errNoListeners is returned by [Proxy.CheckLiveness] if the proxy has no
+// listeners bound.
+const errNoListeners errors.Error = "no listeners bound"
+
+// Readiness is the result of the readiness check of the proxy.
+type Readiness struct {
+	// CheckedAt is the time the check has been performed.
+	CheckedAt time.Time `json:"checked_at"`
+
+	// Upstreams are the results of the test resolution through each of the
+	// general upstreams.
+	Upstreams []UpstreamReadiness `json:"upstreams"`
+
+	// Ready is true if at least one of the general upstreams has responded.
+	Ready bool `json:"ready"`
+}
+
+// UpstreamReadiness is the result of the test resolution through an upstream.
+type UpstreamReadiness struct {
+	// Address is the address of the upstream.
+	Address string `json:"address"`
+
+	// Error is the error of the test resolution, if any.
+	Error string `json:"error,omitempty"`
+
+	// OK is true if the upstream has responded.
+	OK bool `json:"ok"`
+}
+
+// readinessChecker performs the readiness checks, caches their results for
+// ttl, and shares a single check in flight between the concurrent callers.
+type readinessChecker struct {
+	// clock is used to get the time of the checks.
+	clock clock
+
+	// mux protects last and running.
+	mux *sync.Mutex
+
+	// last is the result of the last check, if any.
+	last *Readiness
+
+	// running is closed when the check in flight completes.  It's nil if
+	// there is no check in flight.
+	running chan struct{}
+
+	// ttl is the time the result of a check is reused for.
+	ttl time.Duration
+}
+
+// newReadinessChecker returns a new properly initialized *readinessChecker.
+func newReadinessChecker(c clock, ttl time.Duration) (rc *readinessChecker) {
+	return &readinessChecker{
+		clock: c,
+		mux:   &sync.Mutex{},
+		ttl:   ttl,
+	}
+}
+
+// check returns the cached result of the check, if it's fresh, or the result
+// of the check in flight, or the result of a new check performed using probe.
+func (rc *readinessChecker) check(probe func() (ups []UpstreamProbe)) (r *Readiness) {
+	rc.mux.Lock()
+	if rc.last != nil && rc.clock.Now().Sub(rc.last.CheckedAt) < rc.ttl {
+		defer rc.mux.Unlock()
+
+		return rc.last
+	}
+
+	if running := rc.running; running != nil {
+		rc.mux.Unlock()
+		<-running
+
+		rc.mux.Lock()
+		defer rc.mux.Unlock()
+
+		return rc.last
+	}
+
+	running := make(chan struct{})
+	rc.running = running
+	rc.mux.Unlock()
+
+	r = &Readiness{}
+	defer func() {
+		rc.mux.Lock()
+		defer rc.mux.Unlock()
+
+		rc.last, rc.running = r, nil
+		close(running)
+	}()
+
+	for _, res := range probe() {
+		ur := UpstreamReadiness{
+			Address: res.Address,
+			OK:      res.Err == nil,
+		}
+		if res.Err != nil {
+			ur.Error = res.Err.Error()
+		}
+
+		r.Ready = r.Ready || ur.OK
+		r.Upstreams = append(r.Upstreams, ur)
+	}
+
+	r.CheckedAt = rc.clock.Now()
+
+	return r
+}
+
+// CheckReadiness returns the result of the test resolution through each of the
+// general upstreams of p.  The result is reused for a few seconds and the
+// concurrent calls share a single check, so that the frequent readiness probes
+// don't load the upstreams.  r must not be modified.
+func (p *Proxy) CheckReadiness() (r *Readiness) {
+	return p.readiness.check(p.probeGeneralUpstreams)
+}
+
+// probeGeneralUpstreams sends a test query to each of the general upstreams of
+// p and returns the results in the order of the upstreams.
+func (p *Proxy) probeGeneralUpstreams() (res []UpstreamProbe) {
+	return probeAllUpstreams(upstreamsToCheck(p.upstreams().UpstreamConfig))
+}
+
+// CheckLiveness returns an error if p isn't started, is shutting down, or has
+// no listeners bound.  It doesn't send any queries.
+func (p *Proxy) CheckLiveness() (err error) {
+	p.RLock()
+	defer p.RUnlock()
+
+	switch {
+	case !p.started:
+		return errNotStarted
+	case p.draining:
+		return errShutdownInProgress
+	case len(p.udpListen)+len(p.tcpListen)+len(p.tlsListen)+len(p.unixListen)+
+		len(p.httpsListen)+len(p.h3Listen)+len(p.quicListen)+
+		len(p.dnsCryptUDPListen)+len(p.dnsCryptTCPListen) == 0:
+		return errNoListeners
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadinessChecker_check(t *testing.T) {
+	const (
+		ttl     = 5 * time.Second
+		testErr = errors.Error("test error")
+	)
+
+	now := time.Unix(1_700_000_000, 0)
+	rc := newReadinessChecker(&fakeClock{onNow: func() (n time.Time) { return now }}, ttl)
+
+	probes := 0
+	probe := func() (ups []UpstreamProbe) {
+		probes++
+
+		return []UpstreamProbe{{
+			Err:     testErr,
+			Address: "bad",
+		}, {
+			Err:     nil,
+			Address: "good",
+		}}
+	}
+
+	r := rc.check(probe)
+	require.NotNil(t, r)
+
+	assert.True(t, r.Ready)
+	assert.Equal(t, now, r.CheckedAt)
+	assert.Equal(t, []UpstreamReadiness{{
+		Address: "bad",
+		Error:   testErr.Error(),
+		OK:      false,
+	}, {
+		Address: "good",
+		Error:   "",
+		OK:      true,
+	}}, r.Upstreams)
+
+	now = now.Add(ttl / 2)
+	assert.Same(t, r, rc.check(probe))
+	assert.Equal(t, 1, probes)
+
+	now = now.Add(ttl)
+	assert.NotSame(t, r, rc.check(probe))
+	assert.Equal(t, 2, probes)
+}
+
+func TestReadinessChecker_check_concurrent(t *testing.T) {
+	const callers = 10
+
+	rc := newReadinessChecker(realClock{}, time.Minute)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	probes := &atomic.Int32{}
+	probe := func() (ups []UpstreamProbe) {
+		if probes.Add(1) == 1 {
+			close(started)
+		}
+
+		<-release
+
+		return []UpstreamProbe{{Address: "good"}}
+	}
+
+	results := make(chan *Readiness, callers)
+	wg := &sync.WaitGroup{}
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			results <- rc.check(probe)
+		}()
+	}
+
+	testutil.RequireReceive(t, started, defaultTimeout)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	assert.Equal(t, int32(1), probes.Load())
+	for r := range results {
+		assert.True(t, r.Ready)
+	}
+}
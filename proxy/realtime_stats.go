@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Rsm is a global instance of the RealtimeStatsManager struct.
+var Rsm = newRealtimeStatsManager(time.Now)
+
+// realtimeWindowSeconds is the length of the longest sliding window, which is
+// also the number of the per-second slots kept.
+const realtimeWindowSeconds = 15 * 60
+
+// realtimeWindows are the lengths of the reported sliding windows keyed by
+// their names.
+var realtimeWindows = []struct {
+	name    string
+	seconds int64
+}{
+	{name: "1m", seconds: 60},
+	{name: "5m", seconds: 5 * 60},
+	{name: "15m", seconds: realtimeWindowSeconds},
+}
+
+// Latency histogram buckets.  The upper bound of the i-th bucket is
+// latencyFirstBound << i, the last bucket holds the longer durations.
+const (
+	latencyFirstBound = 100 * time.Microsecond
+	numLatencyBuckets = 20
+)
+
+// realtimeSlot holds the counters of a single second.  The counters are reset
+// by the first writer of a new second, so a few events racing with the reset
+// may be lost, which is fine for the approximate statistics.
+type realtimeSlot struct {
+	// sec is the Unix time of the second the counters are for.
+	sec atomic.Int64
+
+	queries atomic.Uint64
+	blocked atomic.Uint64
+	latency [numLatencyBuckets + 1]atomic.Uint64
+}
+
+// RealtimeStatsManager keeps the statistics of the recent queries in a ring
+// buffer of the per-second counters.  It's safe for concurrent use and takes no
+// locks.
+type RealtimeStatsManager struct {
+	// now returns the current time.
+	now func() time.Time
+
+	slots [realtimeWindowSeconds]realtimeSlot
+}
+
+// newRealtimeStatsManager creates a new RealtimeStatsManager using now as the
+// source of the current time.
+func newRealtimeStatsManager(now func() time.Time) (r *RealtimeStatsManager) {
+	r = &RealtimeStatsManager{now: now}
+	for i := range r.slots {
+		r.slots[i].sec.Store(-1)
+	}
+
+	return r
+}
+
+// slot returns the slot for the current second resetting it if it's still
+// holding the counters of an older second.
+func (r *RealtimeStatsManager) slot() (s *realtimeSlot) {
+	sec := r.now().Unix()
+	s = &r.slots[sec%realtimeWindowSeconds]
+
+	old := s.sec.Load()
+	if old != sec && s.sec.CompareAndSwap(old, sec) {
+		s.queries.Store(0)
+		s.blocked.Store(0)
+		for i := range s.latency {
+			s.latency[i].Store(0)
+		}
+	}
+
+	return s
+}
+
+// addQuery counts a query resolved within d.  d is zero for the queries which
+// haven't been sent to the upstreams, those aren't counted in the latency.
+func (r *RealtimeStatsManager) addQuery(d time.Duration) {
+	s := r.slot()
+	s.queries.Add(1)
+
+	if d > 0 {
+		s.latency[latencyBucket(d)].Add(1)
+	}
+}
+
+// addBlocked counts a query for a blocked domain.
+func (r *RealtimeStatsManager) addBlocked() {
+	r.slot().blocked.Add(1)
+}
+
+// latencyBucket returns the index of the latency histogram bucket for d.
+func latencyBucket(d time.Duration) (i int) {
+	for bound := latencyFirstBound; i < numLatencyBuckets && d > bound; bound <<= 1 {
+		i++
+	}
+
+	return i
+}
+
+// RealtimeWindow is the statistics of the queries within a sliding window.
+type RealtimeWindow struct {
+	// QPS is the average number of the queries per second.
+	QPS float64 `json:"qps"`
+
+	// BlockedPerSecond is the average number of the queries for the blocked
+	// domains per second.
+	BlockedPerSecond float64 `json:"blocked_per_second"`
+
+	// P50, P95, and P99 are the percentiles of the durations of the queries
+	// sent to the upstreams in milliseconds.  Those are the upper bounds of the
+	// histogram buckets, so they're approximate.
+	P50 float64 `json:"p50_ms"`
+	P95 float64 `json:"p95_ms"`
+	P99 float64 `json:"p99_ms"`
+}
+
+// Windows returns the statistics of the 1m, 5m and 15m sliding windows keyed by
+// their names.  The current second is not included, since it's incomplete.
+func (r *RealtimeStatsManager) Windows() (windows map[string]RealtimeWindow) {
+	now := r.now().Unix()
+
+	windows = make(map[string]RealtimeWindow, len(realtimeWindows))
+	for _, w := range realtimeWindows {
+		var queries, blocked uint64
+		var latency [numLatencyBuckets + 1]uint64
+
+		for sec := now - w.seconds; sec < now; sec++ {
+			if sec < 0 {
+				continue
+			}
+
+			s := &r.slots[sec%realtimeWindowSeconds]
+			if s.sec.Load() != sec {
+				continue
+			}
+
+			queries += s.queries.Load()
+			blocked += s.blocked.Load()
+			for i := range latency {
+				latency[i] += s.latency[i].Load()
+			}
+		}
+
+		windows[w.name] = RealtimeWindow{
+			QPS:              float64(queries) / float64(w.seconds),
+			BlockedPerSecond: float64(blocked) / float64(w.seconds),
+			P50:              latencyPercentile(latency[:], 0.50),
+			P95:              latencyPercentile(latency[:], 0.95),
+			P99:              latencyPercentile(latency[:], 0.99),
+		}
+	}
+
+	return windows
+}
+
+// latencyPercentile returns the p-th percentile of the latency histogram in
+// milliseconds, or zero if it's empty.
+func latencyPercentile(hist []uint64, p float64) (ms float64) {
+	var total uint64
+	for _, n := range hist {
+		total += n
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(p*float64(total) + 0.5)
+	rank = max(rank, 1)
+
+	var cumulative uint64
+	for i, n := range hist {
+		cumulative += n
+		if cumulative >= rank {
+			// The last bucket has no upper bound, so report the lower one.
+			i = min(i, numLatencyBuckets-1)
+
+			return float64(latencyFirstBound<<i) / float64(time.Millisecond)
+		}
+	}
+
+	return 0
+}
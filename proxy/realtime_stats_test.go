@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRealtimeStatsManager_Windows(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	now := &atomic.Int64{}
+	now.Store(start.Unix())
+
+	r := newRealtimeStatsManager(func() time.Time { return time.Unix(now.Load(), 0) })
+
+	// 10 minutes ago: 600 queries with 50ms latency.
+	now.Store(start.Unix() - 600)
+	for range 600 {
+		r.addQuery(50 * time.Millisecond)
+	}
+
+	// Within the last minute: 60 queries, 6 blocked, 1ms latency except a
+	// single slow one.
+	now.Store(start.Unix() - 30)
+	for i := range 60 {
+		d := time.Millisecond
+		if i == 0 {
+			d = time.Second
+		}
+
+		r.addQuery(d)
+	}
+
+	for range 6 {
+		r.addBlocked()
+	}
+
+	// The current second isn't reported.
+	now.Store(start.Unix())
+	r.addQuery(time.Millisecond)
+
+	windows := r.Windows()
+
+	m1 := windows["1m"]
+	assert.InDelta(t, 1.0, m1.QPS, 1e-9)
+	assert.InDelta(t, 0.1, m1.BlockedPerSecond, 1e-9)
+	assert.InDelta(t, 1.6, m1.P50, 1e-9)
+	assert.InDelta(t, 1.6, m1.P95, 1e-9)
+	assert.InDelta(t, 1.6, m1.P99, 1e-9)
+
+	m5 := windows["5m"]
+	assert.InDelta(t, 60.0/300, m5.QPS, 1e-9)
+
+	m15 := windows["15m"]
+	assert.InDelta(t, 660.0/900, m15.QPS, 1e-9)
+	assert.InDelta(t, 51.2, m15.P50, 1e-9)
+	assert.InDelta(t, 51.2, m15.P95, 1e-9)
+
+	// The slot of the old second is reused after the whole ring.
+	now.Store(start.Unix() - 600 + realtimeWindowSeconds)
+	r.addQuery(0)
+	now.Store(start.Unix() - 600 + realtimeWindowSeconds + 1)
+	assert.InDelta(t, 1.0/60, r.Windows()["1m"].QPS, 1e-9)
+}
+
+func TestRealtimeStatsManager_concurrent(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	r := newRealtimeStatsManager(func() time.Time { return now })
+
+	wg := &sync.WaitGroup{}
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for range 1000 {
+				r.addQuery(time.Millisecond)
+				r.addBlocked()
+			}
+		}()
+	}
+	wg.Wait()
+
+	s := r.slot()
+	assert.Equal(t, uint64(10_000), s.queries.Load())
+	assert.Equal(t, uint64(10_000), s.blocked.Load())
+}
+
+func TestLatencyBucket(t *testing.T) {
+	assert.Equal(t, 0, latencyBucket(50*time.Microsecond))
+	assert.Equal(t, 0, latencyBucket(100*time.Microsecond))
+	assert.Equal(t, 1, latencyBucket(101*time.Microsecond))
+	assert.Equal(t, numLatencyBuckets, latencyBucket(time.Hour))
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// RebindingProtection is the handling of the upstream responses containing the
+// private or special-purpose addresses for the public domain names.
+type RebindingProtection string
+
+// RebindingProtection values.
+const (
+	// RebindingProtectionDisabled disables the protection.
+	RebindingProtectionDisabled RebindingProtection = ""
+
+	// RebindingProtectionStrip removes the offending address records from the
+	// response.
+	RebindingProtectionStrip RebindingProtection = "strip"
+
+	// RebindingProtectionReject replaces the response with a REFUSED one.
+	RebindingProtectionReject RebindingProtection = "reject"
+)
+
+// localDomains are the domains, along with their subdomains, the names of which
+// are considered private.  The single-label names are considered private as
+// well.
+var localDomains = []string{
+	"home.arpa.",
+	"internal.",
+	"lan.",
+	"local.",
+	"localdomain.",
+	"localhost.",
+}
+
+// validateRebinding returns an error if the rebinding protection settings are
+// invalid.
+func (p *Proxy) validateRebinding() (err error) {
+	switch p.RebindingProtection {
+	case
+		RebindingProtectionDisabled,
+		RebindingProtectionStrip,
+		RebindingProtectionReject:
+		// Go on.
+	default:
+		return fmt.Errorf("bad mode %q", p.RebindingProtection)
+	}
+
+	for i, d := range p.RebindingAllowlist {
+		err = netutil.ValidateDomainName(strings.TrimSuffix(d, "."))
+		if err != nil {
+			return fmt.Errorf("allowlist domain at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// isRebindingAllowed returns true if the response for the lowercased fqdn may
+// contain the private addresses.
+func (p *Proxy) isRebindingAllowed(fqdn string) (ok bool) {
+	if strings.Count(fqdn, ".") <= 1 {
+		// Single-label name.
+		return true
+	}
+
+	for _, d := range localDomains {
+		if dns.IsSubDomain(d, fqdn) {
+			return true
+		}
+	}
+
+	for _, d := range p.RebindingAllowlist {
+		if dns.IsSubDomain(dns.Fqdn(strings.ToLower(d)), fqdn) {
+			return true
+		}
+	}
+
+	// The zones forwarded explicitly are likely to be private.
+	return p.forwardingZones().upstreams((*UpstreamConfig).getUpstreamsForDomain, fqdn) != nil
+}
+
+// isRebindingAddr returns true if addr mustn't appear in the responses for the
+// public domain names.  The DNS64-synthesized addresses are allowed.
+func (p *Proxy) isRebindingAddr(addr netip.Addr) (ok bool) {
+	addr = addr.Unmap()
+	if p.dns64Prefs.Contains(addr) || dns64WellKnownPref.Contains(addr) {
+		return false
+	}
+
+	return netutil.IsSpecialPurpose(addr) || p.privateNets.Contains(addr)
+}
+
+// protectFromRebinding applies the rebinding protection to the response from
+// the upstream in dctx.  dctx.Upstream must not be nil.
+func (p *Proxy) protectFromRebinding(dctx *DNSContext) {
+	if p.RebindingProtection == RebindingProtectionDisabled ||
+		dctx.Res == nil ||
+		len(dctx.Req.Question) == 0 {
+		return
+	}
+
+	fqdn := strings.ToLower(dctx.Req.Question[0].Name)
+	if p.isRebindingAllowed(fqdn) {
+		return
+	}
+
+	var stripped []dns.RR
+	answer := dctx.Res.Answer[:0:0]
+	for _, rr := range dctx.Res.Answer {
+		var addr netip.Addr
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(rr.A)
+		case *dns.AAAA:
+			addr, _ = netip.AddrFromSlice(rr.AAAA)
+		}
+
+		if addr.IsValid() && p.isRebindingAddr(addr) {
+			stripped = append(stripped, rr)
+
+			continue
+		}
+
+		answer = append(answer, rr)
+	}
+
+	if len(stripped) == 0 {
+		return
+	}
+
+	log.Info(
+		"warning: dnsproxy: possible dns rebinding: %s: %d private answers from %s, %s",
+		fqdn,
+		len(stripped),
+		dctx.Upstream.Address(),
+		p.RebindingProtection,
+	)
+
+	SM.Increment("rebinding::"+string(p.RebindingProtection), 1)
+	metricRebinding.inc(string(p.RebindingProtection))
+
+	if p.RebindingProtection == RebindingProtectionReject {
+		resp := &dns.Msg{}
+		resp.SetRcode(dctx.Req, dns.RcodeRefused)
+		resp.RecursionAvailable = true
+		dctx.Res = resp
+
+		return
+	}
+
+	dctx.Res.Answer = answer
+}
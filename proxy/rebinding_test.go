@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_rebinding(t *testing.T) {
+	setTestStats(t)
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			q := m.Question[0]
+			hdr := dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: q.Qtype,
+				Class:  dns.ClassINET,
+				Ttl:    300,
+			}
+
+			resp = (&dns.Msg{}).SetReply(m)
+			if q.Qtype == dns.TypeAAAA {
+				resp.Answer = append(resp.Answer, &dns.AAAA{
+					Hdr:  hdr,
+					AAAA: net.ParseIP("::1"),
+				}, &dns.AAAA{
+					Hdr:  hdr,
+					AAAA: net.ParseIP("2001:4860::1"),
+				})
+
+				return resp, nil
+			}
+
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: hdr,
+				A:   net.IP{192, 168, 1, 10},
+			}, &dns.A{
+				Hdr: hdr,
+				A:   net.IP{8, 8, 8, 8},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	newProxy := func(t *testing.T, mode RebindingProtection) (p *Proxy) {
+		t.Helper()
+
+		return mustNew(t, &Config{
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{ups},
+			},
+			RebindingProtection:    mode,
+			RebindingAllowlist:     []string{"ddns.example"},
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+		})
+	}
+
+	resolve := func(t *testing.T, p *Proxy, host string, qtype uint16) (resp *dns.Msg) {
+		t.Helper()
+
+		dctx := &DNSContext{
+			Req:   (&dns.Msg{}).SetQuestion(host, qtype),
+			Proto: ProtoUDP,
+			Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+
+		require.NoError(t, p.Resolve(dctx))
+		require.NotNil(t, dctx.Res)
+
+		return dctx.Res
+	}
+
+	// answerStrings returns the data of the answer records.
+	answerStrings := func(resp *dns.Msg) (res []string) {
+		for _, rr := range resp.Answer {
+			res = append(res, strings.TrimPrefix(rr.String(), rr.Header().String()))
+		}
+
+		return res
+	}
+
+	testCases := []struct {
+		name      string
+		mode      RebindingProtection
+		host      string
+		want      []string
+		qtype     uint16
+		wantRcode int
+	}{{
+		name:      "disabled",
+		mode:      RebindingProtectionDisabled,
+		host:      "attacker.example.",
+		want:      []string{"192.168.1.10", "8.8.8.8"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "strip_a",
+		mode:      RebindingProtectionStrip,
+		host:      "attacker.example.",
+		want:      []string{"8.8.8.8"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "strip_aaaa",
+		mode:      RebindingProtectionStrip,
+		host:      "attacker.example.",
+		want:      []string{"2001:4860::1"},
+		qtype:     dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "reject",
+		mode:      RebindingProtectionReject,
+		host:      "attacker.example.",
+		want:      nil,
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeRefused,
+	}, {
+		name:      "allowlisted",
+		mode:      RebindingProtectionReject,
+		host:      "Home.DDNS.example.",
+		want:      []string{"192.168.1.10", "8.8.8.8"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "local_domain",
+		mode:      RebindingProtectionReject,
+		host:      "router.lan.",
+		want:      []string{"192.168.1.10", "8.8.8.8"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "single_label",
+		mode:      RebindingProtectionReject,
+		host:      "router.",
+		want:      []string{"192.168.1.10", "8.8.8.8"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newProxy(t, tc.mode)
+			resp := resolve(t, p, tc.host, tc.qtype)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			assert.Equal(t, tc.want, answerStrings(resp))
+		})
+	}
+
+	stripped, _ := SM.GetUint64("rebinding::strip")
+	assert.Equal(t, uint64(2), stripped)
+
+	rejected, _ := SM.GetUint64("rebinding::reject")
+	assert.Equal(t, uint64(1), rejected)
+}
+
+func TestProxy_validateRebinding(t *testing.T) {
+	testCases := []struct {
+		name       string
+		mode       RebindingProtection
+		wantErrMsg string
+		allowlist  []string
+	}{{
+		name:       "valid",
+		mode:       RebindingProtectionStrip,
+		wantErrMsg: "",
+		allowlist:  []string{"ddns.example.", "home.example"},
+	}, {
+		name:       "bad_mode",
+		mode:       "drop",
+		wantErrMsg: `bad mode "drop"`,
+		allowlist:  nil,
+	}, {
+		name: "bad_domain",
+		mode: RebindingProtectionReject,
+		wantErrMsg: `allowlist domain at index 0: bad domain name "bad domain": ` +
+			`bad top-level domain name label "bad domain": ` +
+			`bad top-level domain name label rune ' '`,
+		allowlist: []string{"bad domain"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: Config{
+				RebindingProtection: tc.mode,
+				RebindingAllowlist:  tc.allowlist,
+			}}
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, p.validateRebinding())
+		})
+	}
+}
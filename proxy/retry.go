@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// defaultUpstreamRetryBackoff is the default delay before the first retry of
+// the failed exchange with the upstreams.
+const defaultUpstreamRetryBackoff = 50 * time.Millisecond
+
+// errTryTimeout is returned when a single try of the exchange with the
+// upstreams exceeds [Config.UpstreamTryTimeout].
+const errTryTimeout errors.Error = "try timed out"
+
+// upstreamStatRetries is the name of the per-upstream counter of the retries
+// caused by its failures.
+const upstreamStatRetries = "retries"
+
+// validateRetries returns an error if the retry settings are invalid.
+func (p *Proxy) validateRetries() (err error) {
+	switch {
+	case p.UpstreamRetries < 0:
+		return fmt.Errorf("negative retries %d", p.UpstreamRetries)
+	case p.UpstreamTryTimeout < 0:
+		return fmt.Errorf("negative try timeout %s", p.UpstreamTryTimeout)
+	case p.UpstreamRetryBackoff < 0:
+		return fmt.Errorf("negative backoff %s", p.UpstreamRetryBackoff)
+	case p.UpstreamQueryDeadline < 0:
+		return fmt.Errorf("negative query deadline %s", p.UpstreamQueryDeadline)
+	default:
+		return nil
+	}
+}
+
+// exchangeWithRetries resolves req using ups and retries the failed exchanges
+// as [Config.UpstreamRetries] and the related settings define.  Each retry
+// prefers the upstreams which haven't failed yet.
+func (p *Proxy) exchangeWithRetries(
+	req *dns.Msg,
+	ups []upstream.Upstream,
+) (resp *dns.Msg, u upstream.Upstream, err error) {
+	if p.UpstreamRetries == 0 && p.UpstreamTryTimeout == 0 && p.UpstreamQueryDeadline == 0 {
+		return p.exchangeUpstreams(req, ups)
+	}
+
+	var deadline time.Time
+	if p.UpstreamQueryDeadline > 0 {
+		deadline = time.Now().Add(p.UpstreamQueryDeadline)
+	}
+
+	failed := map[string]unit{}
+	backoff := cmp.Or(p.UpstreamRetryBackoff, defaultUpstreamRetryBackoff)
+	for try := 0; ; try++ {
+		start := time.Now()
+		resp, u, err = p.exchangeTry(req, retryUpstreams(ups, failed), deadline)
+		if err == nil || try == p.UpstreamRetries {
+			return resp, u, err
+		}
+
+		if !deadline.IsZero() && time.Now().Add(backoff).After(deadline) {
+			log.Debug("dnsproxy: upstreams: not retrying %s: query deadline exceeded", &req.Question[0])
+
+			return resp, u, err
+		}
+
+		// Record the failed try here, since only the result of the last one is
+		// recorded by the caller.
+		recordUpstreamResult(u, time.Since(start), err)
+		SM.Increment("upstreams::"+statsKeyPart(upstreamName(u))+"::"+upstreamStatRetries, 1)
+		if u != nil {
+			failed[u.Address()] = unit{}
+		}
+
+		log.Debug(
+			"dnsproxy: upstreams: retrying %s in %s, retry %d of %d: %s",
+			&req.Question[0],
+			backoff,
+			try+1,
+			p.UpstreamRetries,
+			err,
+		)
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// retryUpstreams returns the upstreams from ups which haven't failed yet, or
+// all of ups if all of them have.
+func retryUpstreams(ups []upstream.Upstream, failed map[string]unit) (res []upstream.Upstream) {
+	if len(failed) == 0 {
+		return ups
+	}
+
+	for _, u := range ups {
+		if _, ok := failed[u.Address()]; !ok {
+			res = append(res, u)
+		}
+	}
+
+	if len(res) == 0 {
+		return ups
+	}
+
+	return res
+}
+
+// exchangeResult is the result of a single try of the exchange with the
+// upstreams.
+type exchangeResult struct {
+	resp *dns.Msg
+	u    upstream.Upstream
+	err  error
+}
+
+// exchangeTry resolves req using ups within [Config.UpstreamTryTimeout] and
+// deadline, if any of them is set.  u is the only one of ups on timeout.
+func (p *Proxy) exchangeTry(
+	req *dns.Msg,
+	ups []upstream.Upstream,
+	deadline time.Time,
+) (resp *dns.Msg, u upstream.Upstream, err error) {
+	timeout := p.UpstreamTryTimeout
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if timeout == 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+
+	if timeout <= 0 {
+		return p.exchangeUpstreams(req, ups)
+	}
+
+	// Use a copy of req, since the abandoned exchange may still use it while
+	// the next try is made.
+	reqCopy := req.Copy()
+	resCh := make(chan exchangeResult, 1)
+	go func() {
+		defer log.OnPanic("upstream exchange try")
+
+		res := exchangeResult{}
+		res.resp, res.u, res.err = p.exchangeUpstreams(reqCopy, ups)
+		resCh <- res
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-resCh:
+		return res.resp, res.u, res.err
+	case <-timer.C:
+		if len(ups) == 1 {
+			u = ups[0]
+		}
+
+		return nil, u, fmt.Errorf("%w after %s", errTryTimeout, timeout)
+	}
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/rand"
+)
+
+// newRetryTestUpstream returns a new upstream with addr, which calls onCall
+// with the number of the call starting from 1 and responds successfully if it
+// returns true.
+func newRetryTestUpstream(addr string, onCall func(n int32) (ok bool)) (u *fakeUpstream) {
+	var calls atomic.Int32
+
+	return &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			if !onCall(calls.Add(1)) {
+				return nil, errors.Error("test error")
+			}
+
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (a string) { return addr },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+// newRetryTestProxy returns a new proxy with ups and the retry settings from
+// conf.
+func newRetryTestProxy(t *testing.T, conf *Config, ups ...upstream.Upstream) (p *Proxy) {
+	t.Helper()
+
+	conf.UpstreamConfig = &UpstreamConfig{Upstreams: ups}
+	conf.TrustedProxies = defaultTrustedProxies
+	conf.RatelimitSubnetLenIPv4 = 24
+	conf.RatelimitSubnetLenIPv6 = 64
+
+	return mustNew(t, conf)
+}
+
+func TestProxy_exchangeWithRetries(t *testing.T) {
+	const (
+		badAddr  = "bad.example:53"
+		goodAddr = "good.example:53"
+	)
+
+	req := (&dns.Msg{}).SetQuestion("retry.example.", dns.TypeA)
+
+	t.Run("no_retries", func(t *testing.T) {
+		setTestStats(t)
+
+		var calls atomic.Int32
+		u := newRetryTestUpstream(badAddr, func(n int32) (ok bool) {
+			calls.Store(n)
+
+			return n > 1
+		})
+		p := newRetryTestProxy(t, &Config{}, u)
+
+		_, _, err := p.exchangeWithRetries(req, p.UpstreamConfig.Upstreams)
+		require.Error(t, err)
+
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("same_upstream", func(t *testing.T) {
+		setTestStats(t)
+
+		var calls atomic.Int32
+		u := newRetryTestUpstream(badAddr, func(n int32) (ok bool) {
+			calls.Store(n)
+
+			return n > 1
+		})
+		p := newRetryTestProxy(t, &Config{
+			UpstreamRetries:      2,
+			UpstreamRetryBackoff: time.Millisecond,
+		}, u)
+
+		resp, gotU, err := p.exchangeWithRetries(req, p.UpstreamConfig.Upstreams)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		assert.Equal(t, u, gotU)
+		assert.Equal(t, int32(2), calls.Load())
+
+		n, _ := SM.GetUint64("upstreams::" + statsKeyPart(badAddr) + "::" + upstreamStatRetries)
+		assert.Equal(t, uint64(1), n)
+	})
+
+	t.Run("other_upstream", func(t *testing.T) {
+		setTestStats(t)
+
+		var badCalls atomic.Int32
+		bad := newRetryTestUpstream(badAddr, func(n int32) (ok bool) {
+			badCalls.Store(n)
+
+			return false
+		})
+		good := newRetryTestUpstream(goodAddr, func(_ int32) (ok bool) { return true })
+
+		p := newRetryTestProxy(t, &Config{
+			UpstreamMode:         UModeRandom,
+			UpstreamRetries:      1,
+			UpstreamRetryBackoff: time.Millisecond,
+		}, bad, good)
+		p.randSrc = rand.NewSource(42)
+
+		const queries = 10
+		for range queries {
+			_, gotU, err := p.exchangeWithRetries(req, p.UpstreamConfig.Upstreams)
+			require.NoError(t, err)
+
+			assert.Equal(t, good, gotU)
+		}
+
+		// The failed upstream is never chosen twice for the same query.
+		n, _ := SM.GetUint64("upstreams::" + statsKeyPart(badAddr) + "::" + upstreamStatRetries)
+		assert.Equal(t, uint64(badCalls.Load()), n)
+		assert.LessOrEqual(t, badCalls.Load(), int32(queries))
+	})
+
+	t.Run("try_timeout", func(t *testing.T) {
+		setTestStats(t)
+
+		unblock := make(chan struct{})
+		t.Cleanup(func() { close(unblock) })
+
+		u := newRetryTestUpstream(badAddr, func(n int32) (ok bool) {
+			if n == 1 {
+				<-unblock
+			}
+
+			return true
+		})
+		p := newRetryTestProxy(t, &Config{
+			UpstreamRetries:      1,
+			UpstreamTryTimeout:   50 * time.Millisecond,
+			UpstreamRetryBackoff: time.Millisecond,
+		}, u)
+
+		start := time.Now()
+		resp, _, err := p.exchangeWithRetries(req, p.UpstreamConfig.Upstreams)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		setTestStats(t)
+
+		var calls atomic.Int32
+		u := newRetryTestUpstream(badAddr, func(n int32) (ok bool) {
+			calls.Store(n)
+
+			return false
+		})
+		p := newRetryTestProxy(t, &Config{
+			UpstreamRetries:       10,
+			UpstreamRetryBackoff:  20 * time.Millisecond,
+			UpstreamQueryDeadline: 100 * time.Millisecond,
+		}, u)
+
+		_, _, err := p.exchangeWithRetries(req, p.UpstreamConfig.Upstreams)
+		require.Error(t, err)
+
+		// The backoffs of 20, 40, and 80 ms exceed the deadline before the
+		// fourth retry.
+		assert.Less(t, calls.Load(), int32(5))
+	})
+}
+
+func TestProxy_validateRetries(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		conf       Config
+	}{{
+		name:       "default",
+		wantErrMsg: "",
+		conf:       Config{},
+	}, {
+		name:       "valid",
+		wantErrMsg: "",
+		conf: Config{
+			UpstreamRetries:       2,
+			UpstreamTryTimeout:    time.Second,
+			UpstreamRetryBackoff:  time.Millisecond,
+			UpstreamQueryDeadline: 3 * time.Second,
+		},
+	}, {
+		name:       "negative_retries",
+		wantErrMsg: "negative retries -1",
+		conf:       Config{UpstreamRetries: -1},
+	}, {
+		name:       "negative_deadline",
+		wantErrMsg: "negative query deadline -1s",
+		conf:       Config{UpstreamQueryDeadline: -time.Second},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: tc.conf}
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, p.validateRetries())
+		})
+	}
+}
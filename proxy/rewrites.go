@@ -0,0 +1,335 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+const (
+	// rewriteResponseTTL is the TTL of the records generated from the rewrite
+	// rules.
+	rewriteResponseTTL = 60
+
+	// maxRewriteChain is the maximum number of the CNAME rewrites applied to a
+	// single request, which prevents the loops.
+	maxRewriteChain = 10
+
+	// rewriteWildcardPrefix is the prefix of the domain of a rewrite rule which
+	// matches all the subdomains of the rest of the domain.
+	rewriteWildcardPrefix = "*."
+)
+
+// RewriteRule is a static rewrite of the responses for a domain.  Either Addr
+// or Target is set.
+type RewriteRule struct {
+	// Addr is the address the A or AAAA requests are answered with.
+	Addr netip.Addr
+
+	// Domain is the lowercased domain name without the trailing dot.  It may
+	// also start with "*." to match all the subdomains of the rest of it, but
+	// not the domain itself.
+	Domain string
+
+	// Target is the lowercased CNAME target without the trailing dot.
+	Target string
+}
+
+// ParseRewriteRule parses the rewrite rule in the "<domain> <answer>" format,
+// where the answer is either an IP address or a CNAME target domain name.
+func ParseRewriteRule(s string) (r *RewriteRule, err error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("want 2 fields, got %d", len(fields))
+	}
+
+	domain := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+	err = netutil.ValidateDomainName(strings.TrimPrefix(domain, rewriteWildcardPrefix))
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	r = &RewriteRule{Domain: domain}
+
+	r.Addr, err = netip.ParseAddr(fields[1])
+	if err == nil {
+		return r, nil
+	}
+
+	r.Target = strings.ToLower(strings.TrimSuffix(fields[1], "."))
+	err = netutil.ValidateDomainName(r.Target)
+	if err != nil {
+		return nil, fmt.Errorf("bad answer %q: neither an ip address nor a domain name", fields[1])
+	}
+
+	return r, nil
+}
+
+// Type returns the type of the records the rule answers with.
+func (r *RewriteRule) Type() (qtype uint16) {
+	switch {
+	case r.Target != "":
+		return dns.TypeCNAME
+	case r.Addr.Unmap().Is4():
+		return dns.TypeA
+	default:
+		return dns.TypeAAAA
+	}
+}
+
+// Answer returns the string representation of the answer of the rule.
+func (r *RewriteRule) Answer() (s string) {
+	if r.Target != "" {
+		return r.Target
+	}
+
+	return r.Addr.Unmap().String()
+}
+
+// ParseRewriteRules parses the rewrite rules from r, one per line.  The empty
+// lines and the comments starting with "#" are skipped.  The errors contain
+// the numbers of the offending lines.
+func ParseRewriteRules(r io.Reader) (rules []*RewriteRule, err error) {
+	var errs []error
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		rule, rErr := ParseRewriteRule(text)
+		if rErr != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", line, rErr))
+
+			continue
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if err = s.Err(); err != nil {
+		return nil, fmt.Errorf("reading rewrite rules: %w", err)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return rules, nil
+}
+
+// Rewrites are the static rewrite rules applied before the resolving.  The
+// rules for the exact domains take priority over the wildcard ones, and the
+// more specific wildcards take priority over the less specific ones.
+type Rewrites struct {
+	// byDomain maps the domains of the rules, including the wildcard ones, to
+	// the rules.
+	byDomain map[string][]*RewriteRule
+
+	// rules are all the rules in the original order.
+	rules []*RewriteRule
+}
+
+// NewRewrites returns the rewrites with the given rules.  It returns an error
+// if a CNAME rule is combined with any other rule for the same domain.
+func NewRewrites(rules []*RewriteRule) (rw *Rewrites, err error) {
+	rw = &Rewrites{
+		byDomain: map[string][]*RewriteRule{},
+		rules:    rules,
+	}
+
+	var errs []error
+	for i, r := range rules {
+		prev := rw.byDomain[r.Domain]
+		hasCNAME := slices.ContainsFunc(prev, func(p *RewriteRule) (ok bool) { return p.Target != "" })
+		if hasCNAME || (len(prev) > 0 && r.Target != "") {
+			errs = append(errs, fmt.Errorf("rule at index %d: cname for %q conflicts with other rules", i, r.Domain))
+
+			continue
+		}
+
+		rw.byDomain[r.Domain] = append(prev, r)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return rw, nil
+}
+
+// Rules returns all the rules of rw.  rw may be nil.
+func (rw *Rewrites) Rules() (rules []*RewriteRule) {
+	if rw == nil {
+		return nil
+	}
+
+	return slices.Clone(rw.rules)
+}
+
+// match returns the rules for the lowercased fqdn, if any.
+func (rw *Rewrites) match(fqdn string) (rules []*RewriteRule) {
+	if rw == nil || len(rw.byDomain) == 0 {
+		return nil
+	}
+
+	domain := strings.TrimSuffix(fqdn, ".")
+	if rules = rw.byDomain[domain]; rules != nil {
+		return rules
+	}
+
+	for _, parent := range parentDomains(domain) {
+		if rules = rw.byDomain[rewriteWildcardPrefix+parent]; rules != nil {
+			return rules
+		}
+	}
+
+	return nil
+}
+
+// rewriteResult is the state of the request rewritten to the CNAME target.
+type rewriteResult struct {
+	// name is the original name of the question.
+	name string
+
+	// cnames are the CNAME records of the chain from the original name to the
+	// target.
+	cnames []dns.RR
+}
+
+// rewrite applies the rewrite rules to the request of dctx.  If the rules
+// answer the request, dctx.Res is set and ok is true.  If the request is
+// rewritten to a CNAME target to resolve, the question of dctx.Req is changed
+// and res is not nil, see [rewriteResult.restore].
+func (p *Proxy) rewrite(dctx *DNSContext) (res *rewriteResult, ok bool) {
+	if p.Rewrites == nil || len(dctx.Req.Question) != 1 {
+		return nil, false
+	}
+
+	q := &dctx.Req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	var cnames []dns.RR
+	for range maxRewriteChain {
+		rules := p.Rewrites.match(name)
+		if len(rules) == 0 {
+			break
+		}
+
+		if target := rules[0].Target; target != "" {
+			cnames = append(cnames, &dns.CNAME{
+				Hdr: dns.RR_Header{
+					Name:   dns.Fqdn(name),
+					Rrtype: dns.TypeCNAME,
+					Class:  dns.ClassINET,
+					Ttl:    rewriteResponseTTL,
+				},
+				Target: dns.Fqdn(target),
+			})
+			name = dns.Fqdn(target)
+
+			continue
+		}
+
+		dctx.Res = genRewriteResponse(dctx.Req, cnames, rules)
+
+		return nil, true
+	}
+
+	if len(cnames) == 0 {
+		return nil, false
+	}
+
+	// Preserve the case of the original name in the answer.
+	cnames[0].Header().Name = q.Name
+
+	if q.Qtype == dns.TypeCNAME {
+		dctx.Res = genEmptyNoError(dctx.Req)
+		dctx.Res.Ns = nil
+		dctx.Res.Answer = cnames
+
+		return nil, true
+	}
+
+	log.Debug("dnsproxy: rewriting %s to %s", q.Name, name)
+
+	res = &rewriteResult{
+		name:   q.Name,
+		cnames: cnames,
+	}
+	q.Name = name
+
+	return res, false
+}
+
+// genRewriteResponse returns the response to req with the CNAME chain and the
+// addresses of the requested family from rules.  The other requests have no
+// answers besides the CNAME chain.
+func genRewriteResponse(req *dns.Msg, cnames []dns.RR, rules []*RewriteRule) (resp *dns.Msg) {
+	resp = genEmptyNoError(req)
+
+	q := req.Question[0]
+	name := q.Name
+	if len(cnames) > 0 {
+		cnames[0].Header().Name = q.Name
+		name = cnames[len(cnames)-1].(*dns.CNAME).Target
+	}
+
+	resp.Answer = append(resp.Answer, cnames...)
+
+	hdr := dns.RR_Header{
+		Name:   name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    rewriteResponseTTL,
+	}
+
+	for _, r := range rules {
+		if r.Type() != q.Qtype {
+			continue
+		}
+
+		if q.Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: r.Addr.Unmap().AsSlice()})
+		} else {
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: r.Addr.AsSlice()})
+		}
+	}
+
+	if len(resp.Answer) > 0 {
+		resp.Ns = nil
+	}
+
+	return resp
+}
+
+// restore restores the original question of dctx and prepends the CNAME chain
+// to the answer of the response, if any.  res may be nil.
+func (res *rewriteResult) restore(dctx *DNSContext) {
+	if res == nil {
+		return
+	}
+
+	dctx.Req.Question[0].Name = res.name
+
+	if dctx.Res == nil {
+		return
+	}
+
+	if len(dctx.Res.Question) > 0 {
+		dctx.Res.Question[0].Name = res.name
+	}
+
+	dctx.Res.Answer = append(slices.Clone(res.cnames), dctx.Res.Answer...)
+}
@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRewriteRule(t *testing.T) {
+	testCases := []struct {
+		want       *RewriteRule
+		name       string
+		in         string
+		wantErrMsg string
+	}{{
+		want: &RewriteRule{
+			Addr:   netip.MustParseAddr("192.168.1.10"),
+			Domain: "cloud.vendor.example",
+		},
+		name:       "a",
+		in:         "Cloud.Vendor.Example. 192.168.1.10",
+		wantErrMsg: "",
+	}, {
+		want: &RewriteRule{
+			Addr:   netip.MustParseAddr("2001:db8::10"),
+			Domain: "*.vendor.example",
+		},
+		name:       "aaaa_wildcard",
+		in:         "*.vendor.example 2001:db8::10",
+		wantErrMsg: "",
+	}, {
+		want: &RewriteRule{
+			Domain: "api.vendor.example",
+			Target: "proxy.lan",
+		},
+		name:       "cname",
+		in:         "api.vendor.example  Proxy.LAN.",
+		wantErrMsg: "",
+	}, {
+		want:       nil,
+		name:       "no_answer",
+		in:         "api.vendor.example",
+		wantErrMsg: "want 2 fields, got 1",
+	}, {
+		want: nil,
+		name: "bad_answer",
+		in:   "api.vendor.example bad_target!",
+		wantErrMsg: `bad answer "bad_target!": neither an ip address nor a ` +
+			`domain name`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := ParseRewriteRule(tc.in)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			assert.Equal(t, tc.want, r)
+		})
+	}
+}
+
+func TestParseRewriteRules(t *testing.T) {
+	rules, err := ParseRewriteRules(strings.NewReader(
+		"# Rewrites.\n\nvendor.example 192.168.1.10\nbad\n",
+	))
+	testutil.AssertErrorMsg(t, "line 4: want 2 fields, got 1", err)
+	assert.Nil(t, rules)
+}
+
+func TestNewRewrites(t *testing.T) {
+	a := &RewriteRule{Domain: "vendor.example", Addr: netip.MustParseAddr("192.168.1.10")}
+	aaaa := &RewriteRule{Domain: "vendor.example", Addr: netip.MustParseAddr("2001:db8::10")}
+	cname := &RewriteRule{Domain: "vendor.example", Target: "proxy.lan"}
+
+	_, err := NewRewrites([]*RewriteRule{a, aaaa})
+	require.NoError(t, err)
+
+	_, err = NewRewrites([]*RewriteRule{a, cname})
+	testutil.AssertErrorMsg(
+		t,
+		`rule at index 1: cname for "vendor.example" conflicts with other rules`,
+		err,
+	)
+
+	_, err = NewRewrites([]*RewriteRule{cname, aaaa})
+	testutil.AssertErrorMsg(
+		t,
+		`rule at index 1: cname for "vendor.example" conflicts with other rules`,
+		err,
+	)
+}
+
+func TestProxy_Resolve_rewrites(t *testing.T) {
+	var rules []*RewriteRule
+	for _, s := range []string{
+		"cloud.vendor.example 192.168.1.10",
+		"*.vendor.example 192.168.1.20",
+		"*.vendor.example 2001:db8::20",
+		"api.vendor.example proxy.lan",
+		"chain.vendor.example api.vendor.example",
+		"remote.vendor.example target.example",
+	} {
+		r, err := ParseRewriteRule(s)
+		require.NoError(t, err)
+
+		rules = append(rules, r)
+	}
+
+	rw, err := NewRewrites(rules)
+	require.NoError(t, err)
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(m)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   m.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    300,
+				},
+				A: net.IP{203, 0, 113, 1},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		Rewrites:               rw,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	resolve := func(t *testing.T, host string, qtype uint16) (dctx *DNSContext) {
+		t.Helper()
+
+		dctx = &DNSContext{
+			Req:   (&dns.Msg{}).SetQuestion(host, qtype),
+			Proto: ProtoUDP,
+			Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+
+		require.NoError(t, p.Resolve(dctx))
+		require.NotNil(t, dctx.Res)
+
+		assert.Equal(t, host, dctx.Req.Question[0].Name)
+		assert.Equal(t, host, dctx.Res.Question[0].Name)
+
+		return dctx
+	}
+
+	// answerStrings returns the types and the data of the answer records.
+	answerStrings := func(resp *dns.Msg) (res []string) {
+		for _, rr := range resp.Answer {
+			hdr := rr.Header()
+			res = append(res, strings.TrimPrefix(rr.String(), hdr.String()))
+		}
+
+		return res
+	}
+
+	testCases := []struct {
+		name  string
+		host  string
+		want  []string
+		qtype uint16
+	}{{
+		name:  "exact",
+		host:  "cloud.vendor.example.",
+		want:  []string{"192.168.1.10"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "exact_nodata",
+		host:  "cloud.vendor.example.",
+		want:  nil,
+		qtype: dns.TypeAAAA,
+	}, {
+		name:  "wildcard",
+		host:  "WWW.vendor.example.",
+		want:  []string{"2001:db8::20"},
+		qtype: dns.TypeAAAA,
+	}, {
+		name:  "chain_to_wildcard",
+		host:  "chain.vendor.example.",
+		want:  []string{"api.vendor.example.", "proxy.lan.", "203.0.113.1"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "cname_upstream",
+		host:  "Remote.Vendor.Example.",
+		want:  []string{"target.example.", "203.0.113.1"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "cname_cached",
+		host:  "remote.vendor.example.",
+		want:  []string{"target.example.", "203.0.113.1"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "cname_request",
+		host:  "api.vendor.example.",
+		want:  []string{"proxy.lan."},
+		qtype: dns.TypeCNAME,
+	}, {
+		name:  "not_rewritten",
+		host:  "vendor.example.",
+		want:  []string{"203.0.113.1"},
+		qtype: dns.TypeA,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := resolve(t, tc.host, tc.qtype)
+
+			assert.Equal(t, dns.RcodeSuccess, dctx.Res.Rcode)
+			assert.Equal(t, tc.want, answerStrings(dctx.Res))
+
+			if len(dctx.Res.Answer) > 0 {
+				assert.Equal(t, tc.host, dctx.Res.Answer[0].Header().Name)
+			}
+		})
+	}
+
+	t.Run("rules", func(t *testing.T) {
+		assert.Equal(t, rules, p.Rewrites.Rules())
+		assert.Equal(t, dns.TypeCNAME, rules[3].Type())
+		assert.Equal(t, "2001:db8::20", rules[2].Answer())
+	})
+}
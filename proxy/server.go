@@ -1,11 +1,14 @@
 package proxy
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"github.com/AdguardTeam/dnsproxy/utils"
 	"github.com/quic-go/quic-go"
+	"io"
 	"net"
+	"net/http"
 	"net/url"
 	"strings"
 	"sync/atomic"
@@ -28,6 +31,9 @@ var numAnswers atomic.Uint64
 // numCacheHits is used to count the number of cache hits
 var numCacheHits atomic.Uint64
 
+// numBlocked is used to count the number of logged blocked responses
+var numBlocked atomic.Uint64
+
 ////////////////////////////////////////////////////
 
 // startListeners configures and starts listener loops
@@ -47,6 +53,11 @@ func (p *Proxy) startListeners(ctx context.Context) error {
 		return err
 	}
 
+	err = p.createUnixListeners()
+	if err != nil {
+		return err
+	}
+
 	err = p.createHTTPSListeners()
 	if err != nil {
 		return err
@@ -74,6 +85,10 @@ func (p *Proxy) startListeners(ctx context.Context) error {
 		go p.tcpPacketLoop(l, ProtoTLS, p.requestsSema)
 	}
 
+	for _, l := range p.unixListen {
+		go p.tcpPacketLoop(l, ProtoUnix, p.requestsSema)
+	}
+
 	for _, l := range p.httpsListen {
 		go func(l net.Listener) { _ = p.httpsServer.Serve(l) }(l)
 	}
@@ -97,13 +112,27 @@ func (p *Proxy) startListeners(ctx context.Context) error {
 	return nil
 }
 
-// handleDNSRequest processes the context.  The only error it returns is the one
-// from the [RequestHandler], or [Resolve] if the [RequestHandler] is not set.
-// d is left without a response as the documentation to [BeforeRequestHandler]
-// says, and if it's ratelimited.
+// errShuttingDown is returned by handleDNSRequest for the requests received
+// while the proxy is shutting down.
+const errShuttingDown errors.Error = "proxy is shutting down"
+
+// handleDNSRequest processes the context.  The errors it returns are the one
+// from the [RequestHandler], or [Resolve] if the [RequestHandler] is not set,
+// and errShuttingDown.  d is left without a response as the documentation to
+// [BeforeRequestHandler] says, if it's ratelimited, and if the proxy is
+// shutting down.
 func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
 	// handleDNSRequest processes the incoming packet bytes and returns with an optional response packet.
 
+	if !p.startRequest() {
+		if d.HTTPResponseWriter != nil {
+			http.Error(d.HTTPResponseWriter, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		}
+
+		return errShuttingDown
+	}
+	defer p.finishRequest()
+
 	// rafal
 	p.mylogDNSMessage(d, "req")
 	// end rafal
@@ -115,6 +144,12 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
 		return nil
 	}
 
+	if len(d.Req.Question) > 0 {
+		metricQueries.inc(string(d.Proto), qtypeLabel(d.Req.Question[0].Qtype))
+		SM.Increment("queries::types::"+qtypeStatsKey(d.Req.Question[0].Qtype), 1)
+		p.countClient(d.Addr.Addr(), d.ClientID, clientStatQueries)
+	}
+
 	ip := d.Addr.Addr()
 	d.IsPrivateClient = p.privateNets.Contains(ip)
 
@@ -126,11 +161,20 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
 	//
 	// TODO(e.burkov):  Investigate if written above true and move to UDP server
 	// implementation?
-	if d.Proto == ProtoUDP && p.isRatelimited(ip) {
-		log.Debug("dnsproxy: ratelimiting %s based on IP only", d.Addr)
+	if d.Proto == ProtoUDP {
+		if !p.processCookie(d) {
+			return nil
+		}
 
-		// Don't reply to ratelimitted clients.
-		return nil
+		if limited, slip := p.ratelimit(ip, d.cookieValid); limited {
+			if p.requireCookie(d) {
+				return nil
+			}
+
+			p.handleRatelimited(d, slip)
+
+			return nil
+		}
 	}
 
 	d.Res = p.validateRequest(d)
@@ -144,6 +188,11 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
 
 	// rafal
 	p.mylogDNSMessage(d, "res")
+	if d.Res != nil {
+		metricResponses.inc(rcodeLabel(d.Res.Rcode))
+		SM.Increment("answers::rcodes::"+rcodeStatsKey(d.Res.Rcode), 1)
+	}
+	Rsm.addQuery(d.QueryDuration)
 	// end rafal
 
 	p.logDNSMessage(d.Res)
@@ -153,6 +202,30 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
 	return err
 }
 
+// handleRatelimited handles the ratelimited UDP request d.  The request is
+// dropped unless slip is true, in which case the truncated response is sent, so
+// that the client retries over TCP, which isn't ratelimited.
+func (p *Proxy) handleRatelimited(d *DNSContext, slip bool) {
+	ip := d.Addr.Addr()
+	if !slip {
+		log.Debug("dnsproxy: ratelimiting %s based on IP only", p.anonymizeAddr(ip))
+
+		SM.Increment("ratelimit::dropped", 1)
+		metricRatelimited.inc("drop")
+
+		// Don't reply to ratelimitted clients.
+		return
+	}
+
+	log.Debug("dnsproxy: ratelimiting %s based on IP only, slipping", p.anonymizeAddr(ip))
+
+	SM.Increment("ratelimit::slipped", 1)
+	metricRatelimited.inc("slip")
+
+	d.Res = genTruncatedResponse(d.Req)
+	p.respond(d)
+}
+
 // validateRequest returns a response for invalid request or nil if the request
 // is ok.
 func (p *Proxy) validateRequest(d *DNSContext) (resp *dns.Msg) {
@@ -168,12 +241,16 @@ func (p *Proxy) validateRequest(d *DNSContext) (resp *dns.Msg) {
 		log.Debug("dnsproxy: refusing type=ANY request")
 
 		return p.messages.NewMsgNOTIMPLEMENTED(d.Req)
+	case p.AnyHINFO && d.Req.Question[0].Qtype == dns.TypeANY:
+		log.Debug("dnsproxy: answering type=ANY request with hinfo")
+
+		return newMsgHINFO(d.Req, cmp.Or(p.AnyHINFOTTL, defaultAnyHINFOTTL))
 	case p.recDetector.check(d.Req):
 		log.Debug("dnsproxy: recursion detected resolving %q", d.Req.Question[0].Name)
 
 		return p.messages.NewMsgNXDOMAIN(d.Req)
 	case d.isForbiddenARPA(p.privateNets):
-		log.Debug("dnsproxy: %s requests a private arpa domain %q", d.Addr, d.Req.Question[0].Name)
+		log.Debug("dnsproxy: %s requests a private arpa domain %q", p.anonymizeAddr(d.Addr.Addr()), d.Req.Question[0].Name)
 
 		return p.messages.NewMsgNXDOMAIN(d.Req)
 	default:
@@ -220,6 +297,9 @@ func (p *Proxy) respond(d *DNSContext) {
 		_ = d.Conn.SetWriteDeadline(time.Now().Add(defaultTimeout))
 	}
 
+	p.addServerCookie(d)
+	p.padResponse(d)
+
 	var err error
 
 	switch d.Proto {
@@ -229,6 +309,8 @@ func (p *Proxy) respond(d *DNSContext) {
 		err = p.respondTCP(d)
 	case ProtoTLS:
 		err = p.respondTCP(d)
+	case ProtoUnix:
+		err = p.respondTCP(d)
 	case ProtoHTTPS:
 		err = p.respondHTTPS(d)
 	case ProtoQUIC:
@@ -279,59 +361,73 @@ func (p *Proxy) mylogDNSMessage(d *DNSContext, messageType string) {
 		return
 	}
 
+	// The counters are updated regardless of the log format and filter, but
+	// the regular text lines are only written if the structured query log is
+	// disabled and all the queries are logged.
+	w := log.Writer()
+	switch {
+	case !p.isLogged(d, m):
+		w = io.Discard
+	case p.queryLog != nil:
+		p.queryLog.write(p.newQueryLogEntry(d, m))
+		w = io.Discard
+	case p.QueryLogFilter == QueryLogFilterBlocked:
+		numBlocked.Add(1)
+		message := fmt.Sprintf(
+			"B#%-10d%-50.49s by %-25.25s for %-30.30s\n",
+			numBlocked.Load(),
+			m.Question[0].Name,
+			d.blockedList,
+			p.anonymizeAddr(d.Addr.Addr()),
+		)
+		_, _ = w.Write([]byte(message))
+		w = io.Discard
+	}
+
 	if m.Response {
-		if len(m.Answer) > 0 {
-			numAnswers.Add(1)
-			answerDomain := strings.Trim(m.Answer[0].Header().Name, " \n\t")
-			ipAddress := ""
-			for _, answer := range m.Answer {
-				if answer.Header().Rrtype == dns.TypeA {
-					ipAddress = answer.(*dns.A).A.String()
-					break
-				} else if answer.Header().Rrtype == dns.TypeAAAA {
-					ipAddress = answer.(*dns.AAAA).AAAA.String()
-					break
-				}
+		numAnswers.Add(1)
+		source := ""
+		if d.Upstream != nil {
+			u, err := url.Parse(d.Upstream.Address())
+			upstreamHost := ""
+			if err == nil {
+				upstreamHost = u.Host
+			}
+			upstreamHost = strings.Trim(upstreamHost, " \n\t")
+			source = utils.ShortText(upstreamHost, 50)
+			if len(m.Answer) > 0 {
+				SM.Increment("resolvers::"+upstreamHost, 1)
+				metricUpstreamResponses.inc(upstreamName(d.Upstream))
 			}
-			ipAddress = strings.Trim(ipAddress, " \n\t")
-			if d.Upstream != nil {
-				upstreamAddress := d.Upstream.Address()
-				u, err := url.Parse(upstreamAddress)
-				upstreamHost := ""
-				if err == nil {
-					upstreamHost = u.Host
-				}
-				upstreamHost = strings.Trim(upstreamHost, " \n\t")
-				message := fmt.Sprintf("A#%-10d%-50.49s%-25.25s from %-50.50s\n", numAnswers.Load(), answerDomain, ipAddress, utils.ShortText(upstreamHost, 50))
-				if SM.Exists("resolvers::" + upstreamHost) {
-					SM.Set("resolvers::"+upstreamHost, SM.Get("resolvers::"+upstreamHost).(uint64)+1)
-				} else {
-					SM.Set("resolvers::"+upstreamHost, uint64(1))
-				}
-				_, err = log.Writer().Write([]byte(message))
-				if err != nil {
-					return
-				}
-			} else {
+		} else {
+			if len(m.Answer) > 0 {
 				numCacheHits.Add(1)
-				if SM.Exists("local::num_cache_and_blocked_responses") {
-					SM.Set("local::num_cache_and_blocked_responses", SM.Get("local::num_cache_and_blocked_responses").(uint64)+1)
-				} else {
-					SM.Set("local::num_cache_and_blocked_responses", uint64(1))
-				}
-				message := fmt.Sprintf("A#%-10d%-50.49s%-25.25s from cache (#%d)\n", numAnswers.Load(), answerDomain, ipAddress, numCacheHits.Load())
-				_, err := log.Writer().Write([]byte(message))
-				if err != nil {
-					return
-				}
+				SM.Increment("local::num_cache_and_blocked_responses", 1)
 			}
+			source = fmt.Sprintf("cache (#%d)", numCacheHits.Load())
+		}
+
+		message := fmt.Sprintf(
+			"A#%-10d%-50.49s%-25.25s %-8.8s %-5.5s %8.2fms %3d from %s\n",
+			numAnswers.Load(),
+			responseDomain(m),
+			answerSummary(m),
+			rcodeLabel(m.Rcode),
+			d.Proto,
+			float64(d.QueryDuration)/float64(time.Millisecond),
+			len(m.Answer),
+			source,
+		)
+		_, err := w.Write([]byte(message))
+		if err != nil {
+			return
 		}
 	} else {
 		if len(m.Question) > 0 {
 			numQueries.Add(1)
-			sourceAddress := d.Addr.String()
+			sourceAddress := p.anonymizeAddr(d.Addr.Addr())
 			message := fmt.Sprintf("Q#%-10d%-75.75s from %-30.30s\n", numQueries.Load(), m.Question[0].Name, sourceAddress)
-			_, err := log.Writer().Write([]byte(message))
+			_, err := w.Write([]byte(message))
 			if err != nil {
 				return
 			}
@@ -340,3 +436,42 @@ func (p *Proxy) mylogDNSMessage(d *DNSContext, messageType string) {
 	//////////////////////////////////////////////////////////////////////////////
 	// end rafal code
 }
+
+// responseDomain returns the name of the first answer of m, or the name of the
+// question if there are no answers.
+func responseDomain(m *dns.Msg) (domain string) {
+	if len(m.Answer) > 0 {
+		return strings.Trim(m.Answer[0].Header().Name, " \n\t")
+	}
+
+	if len(m.Question) > 0 {
+		return m.Question[0].Name
+	}
+
+	return ""
+}
+
+// answerSummary returns the first address from the answer section of m.  If
+// there is none, it returns the target of the first CNAME record, or "no data"
+// if there is no such record either.
+func answerSummary(m *dns.Msg) (summary string) {
+	var cname string
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			return rr.A.String()
+		case *dns.AAAA:
+			return rr.AAAA.String()
+		case *dns.CNAME:
+			if cname == "" {
+				cname = rr.Target
+			}
+		}
+	}
+
+	if cname != "" {
+		return cname
+	}
+
+	return "no data"
+}
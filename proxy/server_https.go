@@ -13,6 +13,7 @@ import (
 
 	"github.com/AdguardTeam/golibs/httphdr"
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
@@ -90,17 +91,49 @@ func (p *Proxy) createHTTPSListeners() (err error) {
 	return nil
 }
 
+// defaultDoHPath is the URL path the DoH requests are served on if
+// [Config.HTTPSPaths] is empty.
+const defaultDoHPath = "/dns-query"
+
+// httpsPaths returns the URL paths the DoH requests are served on.
+func (p *Proxy) httpsPaths() (paths []string) {
+	if len(p.HTTPSPaths) == 0 {
+		return []string{defaultDoHPath}
+	}
+
+	return p.HTTPSPaths
+}
+
+// validateHTTPSPaths returns an error if any of the configured DoH paths is
+// invalid.
+func (p *Proxy) validateHTTPSPaths() (err error) {
+	for i, path := range p.HTTPSPaths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("path at index %d: %q is not absolute", i, path)
+		}
+
+		if p.HTTPSJSON && path == dohJSONPath {
+			return fmt.Errorf("path at index %d: %q is used by the json api", i, path)
+		}
+	}
+
+	return nil
+}
+
 // ServeHTTP is the http.Handler implementation that handles DoH queries.
 // Here is what it returns:
 //
-//   - http.StatusBadRequest if there is no DNS request data;
+//   - http.StatusNotFound if the path is neither one of [Config.HTTPSPaths], nor
+//     their subpath containing the client identifier, nor the JSON API one;
+//   - http.StatusBadRequest if there is no DNS request data or the client
+//     identifier is invalid;
 //   - http.StatusUnsupportedMediaType if request content type is not
 //     "application/dns-message";
 //   - http.StatusMethodNotAllowed if request method is not GET or POST.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//log.Debug("dnsproxy: incoming https request on %s", r.URL)	// rafal
 
-	raddr, prx, err := remoteAddr(r)
+	raddr, err := remoteAddr(r, p.TrustedProxies)
 	if err != nil {
 		//log.Debug("dnsproxy: warning: getting real ip: %s", err)	// rafal
 	}
@@ -109,7 +142,64 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	clientID, isDoH, err := clientIDFromDoHPath(r.URL.Path, p.httpsPaths())
+	if err != nil {
+		log.Debug("dnsproxy: parsing client id: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	certID, err := p.clientIDFromCert(r.TLS)
+	if err != nil {
+		log.Debug("dnsproxy: parsing client id: %s", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+		return
+	} else if certID != "" {
+		clientID = certID
+	}
+
+	var req *dns.Msg
+	isJSON := false
+	switch path := r.URL.Path; {
+	case isDoH:
+		req = readDoHRequest(w, r)
+	case p.HTTPSJSON && path == dohJSONPath:
+		req, isJSON = readJSONRequest(w, r), true
+	default:
+		log.Debug("dnsproxy: unknown https path %q", path)
+		http.NotFound(w, r)
+
+		return
+	}
+
+	if req == nil {
+		// The error has already been written.
+		return
+	}
+
+	d := p.newDNSContext(ProtoHTTPS, req)
+	d.Addr = raddr
+	d.ClientID = clientID
+	if r.TLS != nil {
+		d.TLSServerName = r.TLS.ServerName
+	}
+	d.HTTPRequest = r
+	d.HTTPResponseWriter = w
+	d.dohJSON = isJSON
+
+	err = p.handleDNSRequest(d)
+	if err != nil {
+		log.Debug("dnsproxy: handling dns (%s) request: %s", d.Proto, err)
+	}
+}
+
+// readDoHRequest returns the DNS message from the DoH request r in the wire
+// format.  If the request is invalid, it writes the error to w and returns nil.
+func readDoHRequest(w http.ResponseWriter, r *http.Request) (req *dns.Msg) {
 	var buf []byte
+	var err error
 
 	switch r.Method {
 	case http.MethodGet:
@@ -119,7 +209,7 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			log.Debug("dnsproxy: parsing dns request from get param %q: %v", dnsParam, err)
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 
-			return
+			return nil
 		}
 	case http.MethodPost:
 		contentType := r.Header.Get("Content-Type")
@@ -127,7 +217,7 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			log.Debug("dnsproxy: unsupported media type %q", contentType)
 			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
 
-			return
+			return nil
 		}
 
 		buf, err = io.ReadAll(r.Body)
@@ -135,7 +225,7 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			log.Debug("dnsproxy: reading http request body: %s", err)
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 
-			return
+			return nil
 		}
 
 		defer log.OnCloserError(r.Body, log.DEBUG)
@@ -143,35 +233,18 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		log.Debug("dnsproxy: bad http method %q", r.Method)
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 
-		return
+		return nil
 	}
 
-	req := &dns.Msg{}
+	req = &dns.Msg{}
 	if err = req.Unpack(buf); err != nil {
 		log.Debug("dnsproxy: unpacking http msg: %s", err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 
-		return
-	}
-
-	d := p.newDNSContext(ProtoHTTPS, req)
-	d.Addr = raddr
-	d.HTTPRequest = r
-	d.HTTPResponseWriter = w
-
-	if prx.IsValid() {
-		//log.Debug("dnsproxy: request came from proxy server %s", prx)	// rafal
-
-		if !p.TrustedProxies.Contains(prx.Addr()) {
-			//log.Debug("dnsproxy: proxy %s is not trusted, using original remote addr", prx)	// rafal
-			d.Addr = prx
-		}
+		return nil
 	}
 
-	err = p.handleDNSRequest(d)
-	if err != nil {
-		log.Debug("dnsproxy: handling dns (%s) request: %s", d.Proto, err)
-	}
+	return req
 }
 
 // checkBasicAuth checks the basic authorization data, if necessary, and if the
@@ -221,6 +294,10 @@ func (p *Proxy) respondHTTPS(d *DNSContext) (err error) {
 		return nil
 	}
 
+	if d.dohJSON {
+		return p.respondJSON(w, resp)
+	}
+
 	bytes, err := resp.Pack()
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -246,7 +323,12 @@ func (p *Proxy) respondHTTPS(d *DNSContext) (err error) {
 //  2. [httphdr.TrueClientIP]
 //  3. [httphdr.XRealIP]
 //  4. [httphdr.XForwardedFor]
-func realIPFromHdrs(r *http.Request) (realIP netip.Addr, err error) {
+//
+// The [httphdr.XForwardedFor] chain is walked from the right, i.e. from the
+// hop closest to the proxy, and the first address not within trusted is used,
+// since the hops to the left of it may be forged by the client.  trusted must
+// not be nil.
+func realIPFromHdrs(r *http.Request, trusted netutil.SubnetSet) (realIP netip.Addr, err error) {
 	for _, h := range []string{
 		httphdr.CFConnectingIP,
 		httphdr.TrueClientIP,
@@ -258,28 +340,48 @@ func realIPFromHdrs(r *http.Request) (realIP netip.Addr, err error) {
 		}
 	}
 
-	xff := r.Header.Get(httphdr.XForwardedFor)
-	firstComma := strings.IndexByte(xff, ',')
-	if firstComma > 0 {
-		xff = xff[:firstComma]
+	hops := strings.Split(r.Header.Get(httphdr.XForwardedFor), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		var hop netip.Addr
+		hop, err = netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// Don't look further than the hop the proxies failed to record.
+			break
+		}
+
+		realIP = hop
+		if !trusted.Contains(hop) {
+			return realIP, nil
+		}
 	}
 
-	return netip.ParseAddr(strings.TrimSpace(xff))
+	if realIP.IsValid() {
+		// All the hops are trusted proxies, so use the farthest one.
+		return realIP, nil
+	}
+
+	return netip.Addr{}, err
 }
 
-// remoteAddr returns the real client's address and the IP address of the latest
-// proxy server if any.
-func remoteAddr(r *http.Request) (addr, prx netip.AddrPort, err error) {
+// remoteAddr returns the real client's address.  The headers of r are only
+// used if the address r has been received from is within trusted, otherwise
+// they may be spoofed by the client.  The value of nil for trusted means that
+// no address is trusted.
+func remoteAddr(r *http.Request, trusted netutil.SubnetSet) (addr netip.AddrPort, err error) {
 	host, err := netip.ParseAddrPort(r.RemoteAddr)
 	if err != nil {
-		return netip.AddrPort{}, netip.AddrPort{}, err
+		return netip.AddrPort{}, err
+	}
+
+	if trusted == nil || !trusted.Contains(host.Addr()) {
+		return host, nil
 	}
 
-	realIP, err := realIPFromHdrs(r)
+	realIP, err := realIPFromHdrs(r, trusted)
 	if err != nil {
 		log.Debug("dnsproxy: getting ip address from http request: %s", err)
 
-		return host, netip.AddrPort{}, nil
+		return host, nil
 	}
 
 	log.Debug("dnsproxy: using ip address from http request: %s", realIP)
@@ -288,5 +390,5 @@ func remoteAddr(r *http.Request) (addr, prx netip.AddrPort, err error) {
 	// X-Forwarded-Port, etc.
 	addr = netip.AddrPortFrom(realIP, 0)
 
-	return addr, host, nil
+	return addr, nil
 }
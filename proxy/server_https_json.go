@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// dohJSONPath is the URL path of the JSON DoH API, see [Config.HTTPSJSON].
+const dohJSONPath = "/resolve"
+
+// dohJSONContentType is the content type of the JSON DoH API responses.
+const dohJSONContentType = "application/dns-json"
+
+// dohJSONQuestion is the question of the JSON DoH API response.
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// dohJSONRR is the resource record of the JSON DoH API response.
+type dohJSONRR struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+	TTL  uint32 `json:"TTL"`
+	Type uint16 `json:"type"`
+}
+
+// dohJSONResponse is the response of the JSON DoH API in the format used by
+// Google and Cloudflare.
+type dohJSONResponse struct {
+	Question   []dohJSONQuestion `json:"Question"`
+	Answer     []dohJSONRR       `json:"Answer,omitempty"`
+	Authority  []dohJSONRR       `json:"Authority,omitempty"`
+	Additional []dohJSONRR       `json:"Additional,omitempty"`
+	Status     int               `json:"Status"`
+	TC         bool              `json:"TC"`
+	RD         bool              `json:"RD"`
+	RA         bool              `json:"RA"`
+	AD         bool              `json:"AD"`
+	CD         bool              `json:"CD"`
+}
+
+// readJSONRequest returns the DNS message built from the query parameters of
+// the JSON DoH API request r, i.e. GET /resolve?name=&type=.  The type may be
+// either a number or a mnemonic and defaults to A.  If the request is invalid,
+// it writes the error to w and returns nil.
+func readJSONRequest(w http.ResponseWriter, r *http.Request) (req *dns.Msg) {
+	if r.Method != http.MethodGet {
+		log.Debug("dnsproxy: bad json api method %q", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return nil
+	}
+
+	req, err := newJSONRequestMsg(r.URL.Query())
+	if err != nil {
+		log.Debug("dnsproxy: parsing json api request: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return nil
+	}
+
+	return req
+}
+
+// newJSONRequestMsg returns the DNS message built from the query parameters of
+// the JSON DoH API request.
+func newJSONRequestMsg(q url.Values) (req *dns.Msg, err error) {
+	name := q.Get("name")
+	if name == "" {
+		return nil, errors.Error("missing name")
+	}
+
+	name = dns.Fqdn(name)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("bad name %q", name)
+	}
+
+	qtype := dns.TypeA
+	if t := q.Get("type"); t != "" {
+		qtype, err = parseJSONQType(t)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return nil, err
+		}
+	}
+
+	req = (&dns.Msg{}).SetQuestion(name, qtype)
+	req.CheckingDisabled = isJSONFlagSet(q.Get("cd"))
+	if isJSONFlagSet(q.Get("do")) {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	return req, nil
+}
+
+// parseJSONQType parses the type parameter of the JSON DoH API request.
+func parseJSONQType(s string) (qtype uint16, err error) {
+	if n, parseErr := strconv.ParseUint(s, 10, 16); parseErr == nil {
+		return uint16(n), nil
+	}
+
+	qtype, ok := dns.StringToType[strings.ToUpper(s)]
+	if !ok {
+		return 0, fmt.Errorf("bad type %q", s)
+	}
+
+	return qtype, nil
+}
+
+// isJSONFlagSet returns true if the flag parameter of the JSON DoH API request
+// is set.
+func isJSONFlagSet(s string) (ok bool) {
+	return s == "1" || strings.EqualFold(s, "true")
+}
+
+// newJSONResponse converts resp into the JSON DoH API response.
+func newJSONResponse(resp *dns.Msg) (jr *dohJSONResponse) {
+	jr = &dohJSONResponse{
+		Question:   make([]dohJSONQuestion, 0, len(resp.Question)),
+		Answer:     newJSONRRs(resp.Answer),
+		Authority:  newJSONRRs(resp.Ns),
+		Additional: newJSONRRs(resp.Extra),
+		Status:     resp.Rcode,
+		TC:         resp.Truncated,
+		RD:         resp.RecursionDesired,
+		RA:         resp.RecursionAvailable,
+		AD:         resp.AuthenticatedData,
+		CD:         resp.CheckingDisabled,
+	}
+
+	for _, q := range resp.Question {
+		jr.Question = append(jr.Question, dohJSONQuestion{Name: q.Name, Type: q.Qtype})
+	}
+
+	return jr
+}
+
+// newJSONRRs converts rrs into the JSON DoH API records.  OPT pseudo-records
+// are skipped.
+func newJSONRRs(rrs []dns.RR) (jrrs []dohJSONRR) {
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		jrrs = append(jrrs, dohJSONRR{
+			Name: hdr.Name,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+			TTL:  hdr.Ttl,
+			Type: hdr.Rrtype,
+		})
+	}
+
+	return jrrs
+}
+
+// respondJSON writes resp to the JSON DoH API client.
+func (p *Proxy) respondJSON(w http.ResponseWriter, resp *dns.Msg) (err error) {
+	b, err := json.Marshal(newJSONResponse(resp))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+		return fmt.Errorf("marshaling json response: %w", err)
+	}
+
+	if srvName := p.Config.HTTPSServerName; srvName != "" {
+		w.Header().Set(httphdr.Server, srvName)
+	}
+
+	w.Header().Set(httphdr.ContentType, dohJSONContentType)
+	_, err = w.Write(b)
+
+	return err
+}
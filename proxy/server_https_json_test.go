@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestHTTPSProxy returns a new proxy answering all the A requests with
+// 192.0.2.1 and serving DoH on paths.
+func newTestHTTPSProxy(t *testing.T, paths []string, withJSON bool) (p *Proxy) {
+	t.Helper()
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(m)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   m.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    300,
+				},
+				A: net.IP{192, 0, 2, 1},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	return mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		HTTPSPaths:             paths,
+		HTTPSJSON:              withJSON,
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+}
+
+func TestProxy_ServeHTTP_paths(t *testing.T) {
+	packed, err := newTestMessage().Pack()
+	require.NoError(t, err)
+
+	query := "?dns=" + base64.RawURLEncoding.EncodeToString(packed)
+
+	testCases := []struct {
+		name       string
+		path       string
+		paths      []string
+		wantStatus int
+	}{{
+		name:       "default",
+		path:       "/dns-query",
+		paths:      nil,
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "default_unknown",
+		path:       "/other",
+		paths:      nil,
+		wantStatus: http.StatusNotFound,
+	}, {
+		name:       "custom",
+		path:       "/hidden",
+		paths:      []string{"/dns-query", "/hidden"},
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "custom_replaces_default",
+		path:       "/dns-query",
+		paths:      []string{"/hidden"},
+		wantStatus: http.StatusNotFound,
+	}, {
+		name:       "client_id",
+		path:       "/dns-query/phone",
+		paths:      nil,
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "bad_client_id",
+		path:       "/dns-query/bad_id",
+		paths:      nil,
+		wantStatus: http.StatusBadRequest,
+	}, {
+		name:       "json_disabled",
+		path:       "/resolve",
+		paths:      nil,
+		wantStatus: http.StatusNotFound,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestHTTPSProxy(t, tc.paths, false)
+
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path+query, nil))
+
+			assert.Equal(t, tc.wantStatus, w.Code)
+		})
+	}
+}
+
+func TestProxy_ServeHTTP_json(t *testing.T) {
+	p := newTestHTTPSProxy(t, nil, true)
+
+	testCases := []struct {
+		name       string
+		target     string
+		wantType   uint16
+		wantStatus int
+	}{{
+		name:       "default_type",
+		target:     "/resolve?name=example.org",
+		wantType:   dns.TypeA,
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "mnemonic_type",
+		target:     "/resolve?name=example.org&type=aaaa",
+		wantType:   dns.TypeAAAA,
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "numeric_type",
+		target:     "/resolve?name=example.org.&type=16",
+		wantType:   dns.TypeTXT,
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "no_name",
+		target:     "/resolve?type=A",
+		wantType:   0,
+		wantStatus: http.StatusBadRequest,
+	}, {
+		name:       "bad_type",
+		target:     "/resolve?name=example.org&type=bad",
+		wantType:   0,
+		wantStatus: http.StatusBadRequest,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			require.Equal(t, tc.wantStatus, w.Code)
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+
+			assert.Equal(t, dohJSONContentType, w.Header().Get(httphdr.ContentType))
+
+			resp := &dohJSONResponse{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+
+			assert.Equal(t, dns.RcodeSuccess, resp.Status)
+			require.Len(t, resp.Question, 1)
+			assert.Equal(t, dohJSONQuestion{Name: "example.org.", Type: tc.wantType}, resp.Question[0])
+		})
+	}
+
+	t.Run("answer", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/resolve?name=example.org", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &dohJSONResponse{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+
+		assert.Equal(t, []dohJSONRR{{
+			Name: "example.org.",
+			Data: "192.0.2.1",
+			TTL:  300,
+			Type: dns.TypeA,
+		}}, resp.Answer)
+	})
+
+	t.Run("post", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/resolve?name=example.org", nil))
+
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+}
+
+func TestProxy_validateHTTPSPaths(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		paths      []string
+		withJSON   bool
+	}{{
+		name:       "valid",
+		wantErrMsg: "",
+		paths:      []string{"/dns-query", "/resolve"},
+		withJSON:   false,
+	}, {
+		name:       "relative",
+		wantErrMsg: `path at index 0: "dns-query" is not absolute`,
+		paths:      []string{"dns-query"},
+		withJSON:   false,
+	}, {
+		name:       "json_conflict",
+		wantErrMsg: `path at index 1: "/resolve" is used by the json api`,
+		paths:      []string{"/dns-query", "/resolve"},
+		withJSON:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: Config{
+				HTTPSPaths: tc.paths,
+				HTTPSJSON:  tc.withJSON,
+			}}
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, p.validateHTTPSPaths())
+		})
+	}
+}
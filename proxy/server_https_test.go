@@ -14,6 +14,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
@@ -200,6 +201,13 @@ func TestAddrsFromRequest(t *testing.T) {
 		hdrs: map[string]string{
 			"X-Forwarded-For": strings.Join([]string{theIPStr, "invalid"}, ","),
 		},
+		wantIP:  netip.Addr{},
+		wantErr: `ParseAddr("invalid"): unable to parse IP`,
+	}, {
+		name: "x-forwarded-for_invalid_client",
+		hdrs: map[string]string{
+			"X-Forwarded-For": strings.Join([]string{"invalid", theIPStr}, ","),
+		},
 		wantIP:  theIP,
 		wantErr: "",
 	}, {
@@ -235,7 +243,7 @@ func TestAddrsFromRequest(t *testing.T) {
 
 		t.Run(tc.name, func(t *testing.T) {
 			var ip netip.Addr
-			ip, err = realIPFromHdrs(r)
+			ip, err = realIPFromHdrs(r, defaultTrustedProxies)
 			testutil.AssertErrorMsg(t, tc.wantErr, err)
 
 			assert.Equal(t, tc.wantIP, ip)
@@ -250,85 +258,146 @@ func TestRemoteAddr(t *testing.T) {
 		theIP     = netip.AddrFrom4([4]byte{1, 2, 3, 4})
 		anotherIP = netip.AddrFrom4([4]byte{1, 2, 3, 5})
 		thirdIP   = netip.AddrFrom4([4]byte{1, 2, 3, 6})
+		proxyIP   = netip.AddrFrom4([4]byte{192, 0, 2, 1})
+		nextIP    = netip.AddrFrom4([4]byte{192, 0, 2, 2})
 
 		theIPStr     = theIP.String()
 		anotherIPStr = anotherIP.String()
 		thirdIPStr   = thirdIP.String()
+		nextIPStr    = nextIP.String()
 	)
 
 	rAddr := netip.AddrPortFrom(theIP, thePort)
+	proxyAddr := netip.AddrPortFrom(proxyIP, thePort)
+
+	proxiesSubnet := netutil.SliceSubnetSet{netip.MustParsePrefix("192.0.2.0/24")}
 
 	testCases := []struct {
+		trusted    netutil.SubnetSet
+		hdrs       map[string]string
 		name       string
 		remoteAddr string
-		hdrs       map[string]string
 		wantErr    string
 		wantIP     netip.AddrPort
-		wantProxy  netip.AddrPort
 	}{{
+		trusted:    defaultTrustedProxies,
+		hdrs:       nil,
 		name:       "no_proxy",
 		remoteAddr: rAddr.String(),
-		hdrs:       nil,
 		wantErr:    "",
 		wantIP:     netip.AddrPortFrom(theIP, thePort),
-		wantProxy:  netip.AddrPort{},
 	}, {
-		name:       "proxied_with_cloudflare",
-		remoteAddr: rAddr.String(),
+		trusted: defaultTrustedProxies,
 		hdrs: map[string]string{
 			"CF-Connecting-IP": anotherIPStr,
 		},
-		wantErr:   "",
-		wantIP:    netip.AddrPortFrom(anotherIP, 0),
-		wantProxy: netip.AddrPortFrom(theIP, thePort),
-	}, {
-		name:       "proxied_once",
+		name:       "proxied_with_cloudflare",
 		remoteAddr: rAddr.String(),
+		wantErr:    "",
+		wantIP:     netip.AddrPortFrom(anotherIP, 0),
+	}, {
+		trusted: defaultTrustedProxies,
 		hdrs: map[string]string{
 			"X-Forwarded-For": anotherIPStr,
 		},
-		wantErr:   "",
-		wantIP:    netip.AddrPortFrom(anotherIP, 0),
-		wantProxy: netip.AddrPortFrom(theIP, thePort),
+		name:       "proxied_once",
+		remoteAddr: rAddr.String(),
+		wantErr:    "",
+		wantIP:     netip.AddrPortFrom(anotherIP, 0),
 	}, {
+		trusted: defaultTrustedProxies,
+		hdrs: map[string]string{
+			"X-Forwarded-For": strings.Join([]string{anotherIPStr, thirdIPStr}, ","),
+		},
 		name:       "proxied_multiple",
 		remoteAddr: rAddr.String(),
+		wantErr:    "",
+		wantIP:     netip.AddrPortFrom(anotherIP, 0),
+	}, {
+		trusted: proxiesSubnet,
 		hdrs: map[string]string{
-			"X-Forwarded-For": strings.Join([]string{anotherIPStr, thirdIPStr}, ","),
+			"X-Forwarded-For": strings.Join([]string{anotherIPStr, thirdIPStr, nextIPStr}, ","),
 		},
-		wantErr:   "",
-		wantIP:    netip.AddrPortFrom(anotherIP, 0),
-		wantProxy: netip.AddrPortFrom(theIP, thePort),
+		name:       "nested_proxies",
+		remoteAddr: proxyAddr.String(),
+		wantErr:    "",
+		wantIP:     netip.AddrPortFrom(thirdIP, 0),
 	}, {
+		trusted: proxiesSubnet,
+		hdrs: map[string]string{
+			"X-Forwarded-For": strings.Join([]string{anotherIPStr, nextIPStr}, ","),
+		},
+		name:       "nested_trusted_only",
+		remoteAddr: proxyAddr.String(),
+		wantErr:    "",
+		wantIP:     netip.AddrPortFrom(anotherIP, 0),
+	}, {
+		trusted: proxiesSubnet,
+		hdrs: map[string]string{
+			"X-Forwarded-For": nextIPStr,
+		},
+		name:       "all_trusted",
+		remoteAddr: proxyAddr.String(),
+		wantErr:    "",
+		wantIP:     netip.AddrPortFrom(nextIP, 0),
+	}, {
+		trusted: proxiesSubnet,
+		hdrs: map[string]string{
+			"X-Forwarded-For": strings.Join([]string{anotherIPStr, "invalid"}, ","),
+		},
+		name:       "nested_invalid",
+		remoteAddr: proxyAddr.String(),
+		wantErr:    "",
+		wantIP:     proxyAddr,
+	}, {
+		trusted: proxiesSubnet,
+		hdrs: map[string]string{
+			"X-Forwarded-For": anotherIPStr,
+			"X-Real-IP":       thirdIPStr,
+		},
+		name:       "untrusted_peer",
+		remoteAddr: rAddr.String(),
+		wantErr:    "",
+		wantIP:     rAddr,
+	}, {
+		trusted: nil,
+		hdrs: map[string]string{
+			"X-Forwarded-For": anotherIPStr,
+		},
+		name:       "no_trusted",
+		remoteAddr: proxyAddr.String(),
+		wantErr:    "",
+		wantIP:     proxyAddr,
+	}, {
+		trusted:    defaultTrustedProxies,
+		hdrs:       nil,
 		name:       "no_port",
 		remoteAddr: theIPStr,
-		hdrs:       nil,
 		wantErr:    "not an ip:port",
 		wantIP:     netip.AddrPort{},
-		wantProxy:  netip.AddrPort{},
 	}, {
+		trusted:    defaultTrustedProxies,
+		hdrs:       nil,
 		name:       "bad_port",
 		remoteAddr: theIPStr + ":notport",
-		hdrs:       nil,
 		wantErr:    `invalid port "notport" parsing "1.2.3.4:notport"`,
 		wantIP:     netip.AddrPort{},
-		wantProxy:  netip.AddrPort{},
 	}, {
+		trusted:    defaultTrustedProxies,
+		hdrs:       nil,
 		name:       "bad_host",
 		remoteAddr: "host:1",
-		hdrs:       nil,
 		wantErr:    `ParseAddr("host"): unable to parse IP`,
 		wantIP:     netip.AddrPort{},
-		wantProxy:  netip.AddrPort{},
 	}, {
-		name:       "bad_proxied_host",
-		remoteAddr: "host:1",
+		trusted: defaultTrustedProxies,
 		hdrs: map[string]string{
 			"CF-Connecting-IP": theIPStr,
 		},
-		wantErr:   `ParseAddr("host"): unable to parse IP`,
-		wantIP:    netip.AddrPort{},
-		wantProxy: netip.AddrPort{},
+		name:       "bad_proxied_host",
+		remoteAddr: "host:1",
+		wantErr:    `ParseAddr("host"): unable to parse IP`,
+		wantIP:     netip.AddrPort{},
 	}}
 
 	for _, tc := range testCases {
@@ -341,8 +410,8 @@ func TestRemoteAddr(t *testing.T) {
 		}
 
 		t.Run(tc.name, func(t *testing.T) {
-			var addr, prx netip.AddrPort
-			addr, prx, err = remoteAddr(r)
+			var addr netip.AddrPort
+			addr, err = remoteAddr(r, tc.trusted)
 			if tc.wantErr != "" {
 				testutil.AssertErrorMsg(t, tc.wantErr, err)
 
@@ -351,7 +420,6 @@ func TestRemoteAddr(t *testing.T) {
 
 			require.NoError(t, err)
 			assert.Equal(t, tc.wantIP, addr)
-			assert.Equal(t, tc.wantProxy, prx)
 		})
 	}
 }
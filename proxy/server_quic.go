@@ -237,8 +237,19 @@ func (p *Proxy) handleQUICStream(stream quic.Stream, conn quic.Connection) {
 		return
 	}
 
+	tlsState := conn.ConnectionState().TLS
+	clientID, err := p.connClientID(&tlsState)
+	if err != nil {
+		log.Debug("dnsproxy: handling quic: %s", err)
+		closeQUICConn(conn, DoQCodeProtocolError)
+
+		return
+	}
+
 	d := p.newDNSContext(ProtoQUIC, req)
 	d.Addr = netutil.NetAddrToAddrPort(conn.RemoteAddr())
+	d.ClientID = clientID
+	d.TLSServerName = tlsState.ServerName
 	d.QUICStream = stream
 	d.QUICConnection = conn
 	d.DoQVersion = doqVersion
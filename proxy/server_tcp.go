@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
@@ -58,8 +59,8 @@ func (p *Proxy) createTLSListeners() (err error) {
 	return nil
 }
 
-// tcpPacketLoop listens for incoming TCP packets.  proto must be either "tcp"
-// or "tls".
+// tcpPacketLoop listens for incoming TCP packets.  proto must be either "tcp",
+// "tls", or "unix".
 //
 // See also the comment on Proxy.requestsSema.
 func (p *Proxy) tcpPacketLoop(l net.Listener, proto Proto, reqSema syncutil.Semaphore) {
@@ -77,15 +78,27 @@ func (p *Proxy) tcpPacketLoop(l net.Listener, proto Proto, reqSema syncutil.Sema
 			break
 		}
 
+		clientAddr := netutil.NetAddrToAddrPort(clientConn.RemoteAddr()).Addr()
+		if ok, statKey := p.connLimits.acquire(clientAddr); !ok {
+			log.Debug("dnsproxy: %s: rejecting conn from %s: %s", proto, clientConn.RemoteAddr(), statKey)
+			SM.Increment(statKey, 1)
+			_ = clientConn.Close()
+
+			continue
+		}
+
 		// TODO(d.kolyshev): Pass and use context from above.
 		err = reqSema.Acquire(context.Background())
 		if err != nil {
 			log.Error("dnsproxy: tcp: acquiring semaphore: %s", err)
+			p.connLimits.release(clientAddr)
+			_ = clientConn.Close()
 
 			break
 		}
 		go func() {
 			defer reqSema.Release()
+			defer p.connLimits.release(clientAddr)
 
 			p.handleTCPConnection(clientConn, proto)
 		}()
@@ -93,7 +106,7 @@ func (p *Proxy) tcpPacketLoop(l net.Listener, proto Proto, reqSema syncutil.Sema
 }
 
 // handleTCPConnection starts a loop that handles an incoming TCP connection.
-// proto must be either ProtoTCP or ProtoTLS.
+// proto must be either ProtoTCP, ProtoTLS, or ProtoUnix.
 func (p *Proxy) handleTCPConnection(conn net.Conn, proto Proto) {
 	defer log.OnPanic("proxy.handleTCPConnection")
 
@@ -106,14 +119,19 @@ func (p *Proxy) handleTCPConnection(conn net.Conn, proto Proto) {
 		}
 	}()
 
-	for {
+	idleTimeout := cmp.Or(p.TCPIdleTimeout, defaultTimeout)
+
+	var clientID, srvName string
+	for reqNum := 0; ; reqNum++ {
 		p.RLock()
-		if !p.started {
+		stopped := !p.started || p.draining
+		p.RUnlock()
+
+		if stopped {
 			return
 		}
-		p.RUnlock()
 
-		err := conn.SetDeadline(time.Now().Add(defaultTimeout))
+		err := conn.SetDeadline(time.Now().Add(idleTimeout))
 		if err != nil {
 			// Consider deadline errors non-critical.
 			//logWithNonCrit(err, "handling tcp: setting deadline")	// rafal
@@ -121,6 +139,9 @@ func (p *Proxy) handleTCPConnection(conn net.Conn, proto Proto) {
 
 		packet, err := readPrefixed(conn)
 		if err != nil {
+			if netErr := net.Error(nil); errors.As(err, &netErr) && netErr.Timeout() {
+				SM.Increment("tcp::idle_timeouts", 1)
+			}
 			//logWithNonCrit(err, "handling tcp: reading msg")
 
 			break
@@ -134,14 +155,40 @@ func (p *Proxy) handleTCPConnection(conn net.Conn, proto Proto) {
 			return
 		}
 
+		if reqNum == 0 {
+			// The handshake is completed by the first read.
+			clientID, err = p.tlsClientID(conn)
+			if err != nil {
+				log.Debug("dnsproxy: handling tls: %s", err)
+
+				return
+			}
+
+			srvName = connServerName(conn)
+		}
+
 		d := p.newDNSContext(proto, req)
 		d.Addr = netutil.NetAddrToAddrPort(conn.RemoteAddr())
+		if proto == ProtoUnix {
+			d.Addr = unixClientAddr
+		}
+		d.ClientID = clientID
+		d.TLSServerName = srvName
 		d.Conn = conn
 
 		err = p.handleDNSRequest(d)
-		if err != nil {
+		if errors.Is(err, errShuttingDown) {
+			return
+		} else if err != nil {
 			logWithNonCrit(err, fmt.Sprintf("handling tcp: handling %s request", d.Proto))
 		}
+
+		if maxReqs := p.TCPMaxQueriesPerConn; maxReqs > 0 && reqNum+1 >= maxReqs {
+			log.Debug("dnsproxy: %s: closing conn from %s after %d requests", proto, conn.RemoteAddr(), maxReqs)
+			SM.Increment("tcp::max_queries_closes", 1)
+
+			return
+		}
 	}
 }
 
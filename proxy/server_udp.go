@@ -68,10 +68,12 @@ func (p *Proxy) udpPacketLoop(conn *net.UDPConn, reqSema syncutil.Semaphore) {
 	b := make([]byte, dns.MaxMsgSize)
 	for {
 		p.RLock()
-		if !p.started {
+		started := p.started
+		p.RUnlock()
+
+		if !started {
 			return
 		}
-		p.RUnlock()
 
 		n, localIP, remoteAddr, err := proxynetutil.UDPRead(conn, b, p.udpOOBSize)
 		// documentation says to handle the packet even if err occurs, so do that first
@@ -113,7 +115,7 @@ func (p *Proxy) udpHandlePacket(
 	remoteAddr *net.UDPAddr,
 	conn *net.UDPConn,
 ) {
-	log.Debug("dnsproxy: handling new udp packet from %s", remoteAddr)
+	log.Debug("dnsproxy: handling new udp packet from %s", p.anonymizeAddr(remoteAddr.AddrPort().Addr()))
 
 	req := &dns.Msg{}
 	err := req.Unpack(packet)
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// defaultUnixSocketMode is the default permissions of the Unix domain sockets.
+const defaultUnixSocketMode fs.FileMode = 0o660
+
+// unixClientAddr is the address of the clients connected over the Unix domain
+// sockets.  These are always local, so they're considered connected over the
+// loopback.
+var unixClientAddr = netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 0)
+
+// createUnixListeners creates the Unix domain socket listeners for plain
+// DNS-over-TCP.
+func (p *Proxy) createUnixListeners() (err error) {
+	mode := cmp.Or(p.UnixSocketMode, defaultUnixSocketMode)
+
+	for _, path := range p.UnixListenPaths {
+		log.Info("dnsproxy: creating unix server socket %s", path)
+
+		err = removeStaleSocket(path)
+		if err != nil {
+			return fmt.Errorf("listening on unix socket: %w", err)
+		}
+
+		var l *net.UnixListener
+		l, err = net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			return fmt.Errorf("listening on unix socket %q: %w", path, err)
+		}
+
+		p.unixListen = append(p.unixListen, l)
+
+		err = os.Chmod(path, mode)
+		if err != nil {
+			return fmt.Errorf("setting mode of unix socket %q: %w", path, err)
+		}
+
+		log.Info("dnsproxy: listening to unix://%s", l.Addr())
+	}
+
+	return nil
+}
+
+// removeStaleSocket removes the socket file at path if it's left by a crashed
+// process, i.e. nothing accepts the connections on it.  It returns an error if
+// path is another kind of file or the socket is in use.
+func removeStaleSocket(path string) (err error) {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%q exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		_ = conn.Close()
+
+		return fmt.Errorf("%q is in use", path)
+	} else if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("checking %q: %w", path, err)
+	}
+
+	log.Info("dnsproxy: removing stale unix socket %s", path)
+
+	return os.Remove(path)
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_unix(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "dns.sock")
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UnixListenPaths: []string{sockPath},
+		UnixSocketMode:  0o600,
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+
+	fi, err := os.Stat(sockPath)
+	require.NoError(t, err)
+
+	assert.Equal(t, fs.FileMode(0o600), fi.Mode().Perm())
+	assert.Equal(t, sockPath, p.Addr(ProtoUnix).String())
+
+	c, err := net.Dial("unix", sockPath)
+	require.NoError(t, err)
+
+	conn := &dns.Conn{Conn: c}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	req := newTestMessage()
+	require.NoError(t, conn.WriteMsg(req))
+
+	resp, err := conn.ReadMsg()
+	require.NoError(t, err)
+
+	assert.Equal(t, req.Id, resp.Id)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	require.NoError(t, p.Shutdown(ctx))
+
+	_, err = os.Stat(sockPath)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("stale", func(t *testing.T) {
+		sockPath := filepath.Join(dir, "stale.sock")
+
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sockPath, Net: "unix"})
+		require.NoError(t, err)
+
+		// Imitate a crash.
+		l.SetUnlinkOnClose(false)
+		require.NoError(t, l.Close())
+
+		require.NoError(t, removeStaleSocket(sockPath))
+
+		_, err = os.Stat(sockPath)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("in_use", func(t *testing.T) {
+		sockPath := filepath.Join(dir, "used.sock")
+
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sockPath, Net: "unix"})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+
+		assert.Error(t, removeStaleSocket(sockPath))
+	})
+
+	t.Run("not_socket", func(t *testing.T) {
+		path := filepath.Join(dir, "file")
+		require.NoError(t, os.WriteFile(path, nil, 0o600))
+
+		assert.Error(t, removeStaleSocket(path))
+		assert.FileExists(t, path)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		assert.NoError(t, removeStaleSocket(filepath.Join(dir, "missing.sock")))
+	})
+}
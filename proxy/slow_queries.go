@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// statsSlowQueriesKey is the stats key of the number of the slow queries.
+const statsSlowQueriesKey = "slow_queries"
+
+// checkSlowQuery logs the query of d and counts it in the statistics if the
+// exchange with the upstream has taken longer than the slow query threshold.
+// d is expected to have the response from the upstream.
+func (p *Proxy) checkSlowQuery(d *DNSContext) {
+	if p.SlowQueryThreshold <= 0 || d.QueryDuration <= p.SlowQueryThreshold {
+		return
+	}
+
+	SM.Increment(statsSlowQueriesKey, 1)
+
+	qname := ""
+	if len(d.Req.Question) > 0 {
+		qname = d.Req.Question[0].Name
+	}
+
+	log.Info(
+		"warning: dnsproxy: slow query %q: upstream %s, duration %s, fallback %t",
+		qname,
+		upstreamName(d.Upstream),
+		d.QueryDuration,
+		d.fromFallback,
+	)
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxy_checkSlowQuery(t *testing.T) {
+	testCases := []struct {
+		name      string
+		threshold time.Duration
+		duration  time.Duration
+		wantSlow  bool
+	}{{
+		name:      "disabled",
+		threshold: 0,
+		duration:  time.Minute,
+		wantSlow:  false,
+	}, {
+		name:      "fast",
+		threshold: time.Second,
+		duration:  time.Millisecond,
+		wantSlow:  false,
+	}, {
+		name:      "threshold",
+		threshold: time.Second,
+		duration:  time.Second,
+		wantSlow:  false,
+	}, {
+		name:      "slow",
+		threshold: time.Second,
+		duration:  2 * time.Second,
+		wantSlow:  true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setTestStats(t)
+
+			p := &Proxy{Config: Config{SlowQueryThreshold: tc.threshold}}
+			p.checkSlowQuery(&DNSContext{
+				Req:           (&dns.Msg{}).SetQuestion("slow.example.", dns.TypeA),
+				QueryDuration: tc.duration,
+			})
+
+			n, _ := SM.GetUint64(statsSlowQueriesKey)
+			if tc.wantSlow {
+				assert.Equal(t, uint64(1), n)
+			} else {
+				assert.Zero(t, n)
+			}
+		})
+	}
+}
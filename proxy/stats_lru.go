@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"container/list"
+	"sync"
+)
+
+// statsLRU tracks the recently updated keys of the statistics, so that the
+// least recently updated ones are evicted once there are too many of them.
+type statsLRU struct {
+	// mux protects the fields below.
+	mux sync.Mutex
+
+	// order is the list of the keys, the most recently updated one first.
+	order *list.List
+
+	// elems are the elements of order keyed by the keys.
+	elems map[string]*list.Element
+
+	// seed returns the keys already present in the statistics, the ones to be
+	// evicted last first.
+	seed func() (keys []string)
+
+	// limit is the maximum number of the tracked keys.  Zero means no limit.
+	limit int
+
+	// seeded is true if the keys returned by seed have been added to order.
+	seeded bool
+}
+
+// newStatsLRU returns a new tracker of at most limit keys, initially holding
+// the keys returned by seed.
+func newStatsLRU(limit int, seed func() (keys []string)) (l *statsLRU) {
+	return &statsLRU{
+		order: list.New(),
+		elems: map[string]*list.Element{},
+		seed:  seed,
+		limit: limit,
+	}
+}
+
+// touch marks key as the most recently updated one.  evicted is the key which
+// should be removed from the statistics, if any.
+func (l *statsLRU) touch(key string) (evicted string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if !l.seeded {
+		// The statistics may have been loaded from the file after the tracker
+		// has been created.
+		for _, k := range l.seed() {
+			if _, ok := l.elems[k]; !ok {
+				l.elems[k] = l.order.PushBack(k)
+			}
+		}
+
+		l.seeded = true
+	}
+
+	if e, ok := l.elems[key]; ok {
+		l.order.MoveToFront(e)
+
+		return ""
+	}
+
+	l.elems[key] = l.order.PushFront(key)
+	if l.limit == 0 || l.order.Len() <= l.limit {
+		return ""
+	}
+
+	last := l.order.Back()
+	l.order.Remove(last)
+
+	evicted = last.Value.(string)
+	delete(l.elems, evicted)
+
+	return evicted
+}
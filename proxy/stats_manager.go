@@ -3,9 +3,14 @@ package proxy
 // TODO (rafal): nothing
 
 import (
+	"cmp"
 	"encoding/json"
+	"fmt"
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -26,24 +31,42 @@ func NewStatsManager() *StatsManager {
 	}
 }
 
-// Set sets a value in the StatsManager with the given key and value or creates a new entry with the given key and value if the key does not exist in the StatsManager
-func (r *StatsManager) Set(key string, value any) {
+// Set sets a value in the StatsManager with the given key and value or creates a new entry with the given key and value if the key does not exist in the StatsManager.  It returns an error and changes nothing if the key goes through an existing leaf value or if a non-map value would replace an existing subtree.
+func (r *StatsManager) Set(key string, value any) (err error) {
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
 	keyParts := strings.Split(key, "::")
-	if len(keyParts) == 1 {
-		r.stats[keyParts[0]] = value
-	} else {
-		stats := r.stats
-		for i := 0; i < len(keyParts)-1; i++ {
-			if _, ok := stats[keyParts[i]]; !ok {
-				stats[keyParts[i]] = make(map[string]any)
-			}
-			stats = stats[keyParts[i]].(map[string]any)
+
+	stats := r.stats
+	for i, part := range keyParts[:len(keyParts)-1] {
+		v, ok := stats[part]
+		if !ok {
+			next := make(map[string]any)
+			stats[part] = next
+			stats = next
+
+			continue
 		}
-		stats[keyParts[len(keyParts)-1]] = value
+
+		next, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("setting stats %q: %q is not a subtree", key, strings.Join(keyParts[:i+1], "::"))
+		}
+
+		stats = next
 	}
+
+	name := keyParts[len(keyParts)-1]
+	if _, isMap := stats[name].(map[string]any); isMap {
+		if _, ok := value.(map[string]any); !ok {
+			return fmt.Errorf("setting stats %q: cannot replace a subtree with %T", key, value)
+		}
+	}
+
+	stats[name] = value
+
+	return nil
 }
 
 // Get gets a value from the StatsManager with the given key and returns it or nil if not found
@@ -51,24 +74,194 @@ func (r *StatsManager) Get(key string) any {
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
+	v, _ := r.lookup(key)
+
+	return v
+}
+
+// GetUint64 returns the counter with the given key.  The float64 values loaded
+// from JSON are converted to uint64.  ok is false if there is no such value or
+// it's not a number.
+func (r *StatsManager) GetUint64(key string) (n uint64, ok bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	v, _ := r.lookup(key)
+	switch v := v.(type) {
+	case uint64:
+		return v, true
+	case int64:
+		return uint64(v), v >= 0
+	case int:
+		return uint64(v), v >= 0
+	case float64:
+		return uint64(v), v >= 0
+	default:
+		return 0, false
+	}
+}
+
+// GetString returns the string value with the given key.  ok is false if
+// there is no such value or it's not a string.
+func (r *StatsManager) GetString(key string) (s string, ok bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	v, _ := r.lookup(key)
+	s, ok = v.(string)
+
+	return s, ok
+}
+
+// GetMap returns the copy of the subtree with the given key.  ok is false if
+// there is no such value or it's not a subtree.
+func (r *StatsManager) GetMap(key string) (m map[string]any, ok bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	v, _ := r.lookup(key)
+	m, ok = v.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+
+	return copyStats(m), true
+}
+
+// lookup returns the value with the given key.  ok is false if there is no
+// such value, including the case when the key goes through a leaf value.
+// r.mux is expected to be locked.
+func (r *StatsManager) lookup(key string) (v any, ok bool) {
 	keyParts := strings.Split(key, "::")
-	if len(keyParts) == 1 {
-		if _, ok := r.stats[keyParts[0]]; ok {
-			return r.stats[keyParts[0]]
-		} else {
-			return nil
+
+	stats := r.stats
+	for _, part := range keyParts[:len(keyParts)-1] {
+		stats, ok = stats[part].(map[string]any)
+		if !ok {
+			return nil, false
 		}
-	} else {
-		stats := r.stats
-		for i := 0; i < len(keyParts)-1; i++ {
-			if _, ok := stats[keyParts[i]]; !ok {
-				return nil
-			} else {
-				stats = stats[keyParts[i]].(map[string]any)
-			}
+	}
+
+	v, ok = stats[keyParts[len(keyParts)-1]]
+
+	return v, ok
+}
+
+// Increment adds delta to the uint64 counter with the given key, creating it if
+// it does not exist.  The read-modify-write is done under a single lock, so the
+// concurrent increments are never lost.  The float64 values loaded from JSON are
+// converted to uint64, and the leaves of any other type are replaced.  Like
+// [StatsManager.Set], it never replaces a subtree with a counter nor treats a
+// leaf as a subtree, such updates are logged and dropped instead.  The
+// counter of the current day under the "today" key is incremented as well,
+// unless it's a per-client or a per-domain one, see [isDailyKey].
+func (r *StatsManager) Increment(key string, delta uint64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.increment(key, delta)
+	if isDailyKey(key) {
+		r.increment(statsTodayKey+"::"+key, delta)
+	}
+}
+
+// increment adds delta to the uint64 counter with the given key.  Nothing is
+// changed if the key is a subtree or is within a leaf, see [counterParent].
+// r.mux is expected to be locked.
+func (r *StatsManager) increment(key string, delta uint64) {
+	stats, name, ok := r.counterParent(key)
+	if !ok {
+		return
+	}
+
+	switch v := stats[name].(type) {
+	case uint64:
+		stats[name] = v + delta
+	case float64:
+		stats[name] = uint64(v) + delta
+	default:
+		stats[name] = delta
+	}
+}
+
+// Add is like Increment but for the int64 values, so that delta may be
+// negative.
+func (r *StatsManager) Add(key string, delta int64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.add(key, delta)
+	if isDailyKey(key) {
+		r.add(statsTodayKey+"::"+key, delta)
+	}
+}
+
+// add adds delta to the int64 counter with the given key.  Nothing is changed
+// if the key is a subtree or is within a leaf, see [counterParent].  r.mux is
+// expected to be locked.
+func (r *StatsManager) add(key string, delta int64) {
+	stats, name, ok := r.counterParent(key)
+	if !ok {
+		return
+	}
+
+	switch v := stats[name].(type) {
+	case int64:
+		stats[name] = v + delta
+	case uint64:
+		stats[name] = int64(v) + delta
+	case float64:
+		stats[name] = int64(v) + delta
+	default:
+		stats[name] = delta
+	}
+}
+
+// parent returns the map containing the value with the given key along with the
+// name of the value within it, creating the intermediate maps if necessary.  ok
+// is false if one of the intermediate values is a leaf, since it must not be
+// replaced with a subtree.  r.mux is expected to be locked.
+func (r *StatsManager) parent(key string) (stats map[string]any, name string, ok bool) {
+	keyParts := strings.Split(key, "::")
+
+	stats = r.stats
+	for _, part := range keyParts[:len(keyParts)-1] {
+		v, exists := stats[part]
+		if !exists {
+			next := make(map[string]any)
+			stats[part] = next
+			stats = next
+
+			continue
+		}
+
+		stats, ok = v.(map[string]any)
+		if !ok {
+			return nil, "", false
 		}
-		return stats[keyParts[len(keyParts)-1]]
 	}
+
+	return stats, keyParts[len(keyParts)-1], true
+}
+
+// counterParent is like [parent] but ok is also false if the value with the
+// given key is a subtree, since it must not be replaced with a counter.  The
+// refusals are logged.  r.mux is expected to be locked.
+func (r *StatsManager) counterParent(key string) (stats map[string]any, name string, ok bool) {
+	stats, name, ok = r.parent(key)
+	if !ok {
+		log.Error("stats: updating counter %q: a parent key is not a subtree", key)
+
+		return nil, "", false
+	}
+
+	if _, isMap := stats[name].(map[string]any); isMap {
+		log.Error("stats: updating counter %q: cannot replace a subtree", key)
+
+		return nil, "", false
+	}
+
+	return stats, name, true
 }
 
 // AsJsonPretty returns a JSON representation of the StatsManager as a byte array instance using the json.Marshal function and the json.MarshalIndent function
@@ -84,22 +277,9 @@ func (r *StatsManager) Exists(key string) bool {
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
-	keyParts := strings.Split(key, "::")
-	if len(keyParts) == 1 {
-		_, ok := r.stats[keyParts[0]]
-		return ok
-	} else {
-		stats := r.stats
-		for i := 0; i < len(keyParts)-1; i++ {
-			if _, ok := stats[keyParts[i]]; !ok {
-				return false
-			} else {
-				stats = stats[keyParts[i]].(map[string]any)
-			}
-		}
-		_, ok := stats[keyParts[len(keyParts)-1]]
-		return ok
-	}
+	_, ok := r.lookup(key)
+
+	return ok
 }
 
 // GetStats returns the stats map of the StatsManager as a map[string]any instance
@@ -154,18 +334,19 @@ func (r *StatsManager) LoadStats(filePath string) {
 	}
 
 	r.mux.Unlock()
-	if r.Get("time::since") == nil {
+	if !r.Exists("time::since") {
 		currentTime := time.Now().Format("2006-01-02 15:04:05")
-		r.Set("time::since", currentTime)
+		_ = r.Set("time::since", currentTime)
 	}
 }
 
-// SaveStats saves the stats map of the StatsManager to the given file path
+// SaveStats saves the stats map of the StatsManager to the given file path.  The stats are copied under the lock, so that the marshaling and writing don't block the other users of r.
 func (r *StatsManager) SaveStats(filePath string) {
 	r.mux.Lock()
-	defer r.mux.Unlock()
+	stats := copyStats(r.stats)
+	r.mux.Unlock()
 
-	bytes, err := json.Marshal(&r.stats)
+	bytes, err := json.Marshal(stats)
 	if err != nil {
 		log.Error("Error converting stats to JSON: %s", filePath)
 		return
@@ -194,3 +375,445 @@ func (r *StatsManager) CopyStats(srcStats *map[string]interface{}, dstStats *map
 		}
 	}
 }
+
+// Reset removes all the stats and returns the number of the removed values.
+// The time the stats are collected since is set to the current time.
+func (r *StatsManager) Reset() (n int) {
+	r.mux.Lock()
+	n = countValues(r.stats)
+	r.stats = make(map[string]any)
+	r.mux.Unlock()
+
+	_ = r.Set("time::since", time.Now().Format("2006-01-02 15:04:05"))
+
+	return n
+}
+
+// Fold removes the counter with the given key adding its value to the counter
+// with the key into, and returns the moved value.  The counters of the current
+// day are folded as well, if any.
+func (r *StatsManager) Fold(key, into string) (n uint64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	n = r.fold(key, into)
+	if isDailyKey(key) {
+		r.fold(statsTodayKey+"::"+key, statsTodayKey+"::"+into)
+	}
+
+	return n
+}
+
+// fold removes the counter with the given key adding its value to the counter
+// with the key into.  r.mux is expected to be locked.
+func (r *StatsManager) fold(key, into string) (n uint64) {
+	v, ok := r.lookup(key)
+	if !ok {
+		return 0
+	} else if _, isMap := v.(map[string]any); isMap {
+		return 0
+	}
+
+	// Make sure the value isn't lost if it can't be added to into.
+	if _, _, ok = r.counterParent(into); !ok {
+		return 0
+	}
+
+	stats, name, _ := r.parent(key)
+	delete(stats, name)
+
+	n = asUint64(v)
+	r.increment(into, n)
+
+	return n
+}
+
+// Delete removes the value or the whole subtree of the stats with the given
+// key, e.g. "blocked_domains::domains", and returns the number of the removed
+// values.
+func (r *StatsManager) Delete(key string) (n int) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	keyParts := strings.Split(key, "::")
+
+	stats := r.stats
+	for _, part := range keyParts[:len(keyParts)-1] {
+		next, ok := stats[part].(map[string]any)
+		if !ok {
+			return 0
+		}
+
+		stats = next
+	}
+
+	name := keyParts[len(keyParts)-1]
+	v, ok := stats[name]
+	if !ok {
+		return 0
+	}
+
+	delete(stats, name)
+	if m, isMap := v.(map[string]any); isMap {
+		return countValues(m)
+	}
+
+	return 1
+}
+
+// The keys of the daily statistics.
+const (
+	// statsTodayKey is the key of the counters of the current day.
+	statsTodayKey = "today"
+
+	// statsHistoryKey is the key of the counters of the previous days keyed
+	// by the dates in the YYYY-MM-DD format.
+	statsHistoryKey = "history"
+
+	// statsTodayDateKey is the key of the date of the current day.
+	statsTodayDateKey = "time::today"
+)
+
+// statsLifetimeOnlyPrefixes are the prefixes of the keys of the counters which
+// aren't kept per day.  The number of such counters is only limited for the
+// lifetime statistics, so mirroring them into the current day and then into the
+// history would grow the statistics without bound.
+var statsLifetimeOnlyPrefixes = []string{
+	"allowed_domains::domains::",
+	"blocked_domains::domains::",
+	"clients::",
+}
+
+// isDailyKey returns true if the counter with the given key is also kept for
+// the current day.
+func isDailyKey(key string) (ok bool) {
+	for _, pref := range statsLifetimeOnlyPrefixes {
+		if strings.HasPrefix(key, pref) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// statsDateLayout is the layout of the dates of the daily statistics.
+const statsDateLayout = time.DateOnly
+
+// Rollover moves the counters of the current day into the history, if the
+// day has ended by now, and removes the history older than keepDays days.  The
+// date of the current day is kept under the "time::today" key, so that the
+// days which have ended while the proxy wasn't running are also rolled over.
+// If the history already has the date, the counters are added up.
+func (r *StatsManager) Rollover(now time.Time, keepDays int) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	day := now.Format(statsDateLayout)
+	timeStats, name, ok := r.parent(statsTodayDateKey)
+	if !ok {
+		log.Error("stats: rolling over: a parent key of %q is not a subtree", statsTodayDateKey)
+
+		return
+	}
+
+	prevDay, _ := timeStats[name].(string)
+	if prevDay == day {
+		return
+	}
+
+	timeStats[name] = day
+
+	today, _ := r.stats[statsTodayKey].(map[string]any)
+	delete(r.stats, statsTodayKey)
+
+	history, ok := r.stats[statsHistoryKey].(map[string]any)
+	if !ok {
+		history = make(map[string]any)
+		r.stats[statsHistoryKey] = history
+	}
+
+	if prevDay != "" && len(today) > 0 {
+		dayStats, _ := history[prevDay].(map[string]any)
+		history[prevDay] = mergeCounters(dayStats, today)
+	}
+
+	oldest := now.AddDate(0, 0, -keepDays).Format(statsDateLayout)
+	for d := range history {
+		// The dates in the YYYY-MM-DD format sort lexicographically.
+		if d < oldest {
+			delete(history, d)
+		}
+	}
+}
+
+// mergeCounters adds the counters from src to dst and returns dst, which is
+// created if it's nil.
+func mergeCounters(dst, src map[string]any) (merged map[string]any) {
+	if dst == nil {
+		dst = make(map[string]any, len(src))
+	}
+
+	for k, v := range src {
+		switch v := v.(type) {
+		case map[string]any:
+			sub, _ := dst[k].(map[string]any)
+			dst[k] = mergeCounters(sub, v)
+		case int64:
+			dst[k] = v + asInt64(dst[k])
+		default:
+			dst[k] = asUint64(v) + asUint64(dst[k])
+		}
+	}
+
+	return dst
+}
+
+// Day returns the copy of the counters of the day with the given date in the
+// YYYY-MM-DD format.  ok is false if there are no counters for the date.
+func (r *StatsManager) Day(date string) (stats map[string]any, ok bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	key := statsHistoryKey + "::" + date
+	if today, _ := r.lookup(statsTodayDateKey); date == today {
+		key = statsTodayKey
+	}
+
+	v, _ := r.lookup(key)
+	day, ok := v.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+
+	return copyStats(day), true
+}
+
+// Lifetime returns the copy of the lifetime stats, i.e. without the daily
+// ones.
+func (r *StatsManager) Lifetime() (stats map[string]any) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	stats = copyStats(r.stats)
+	delete(stats, statsTodayKey)
+	delete(stats, statsHistoryKey)
+
+	return stats
+}
+
+// copyStats returns the deep copy of stats.
+func copyStats(stats map[string]any) (c map[string]any) {
+	c = make(map[string]any, len(stats))
+	for k, v := range stats {
+		if m, ok := v.(map[string]any); ok {
+			c[k] = copyStats(m)
+		} else {
+			c[k] = v
+		}
+	}
+
+	return c
+}
+
+// countValues returns the number of the values within stats, not counting the
+// nested maps themselves.
+func countValues(stats map[string]any) (n int) {
+	for _, v := range stats {
+		if m, ok := v.(map[string]any); ok {
+			n += countValues(m)
+		} else {
+			n++
+		}
+	}
+
+	return n
+}
+
+// qtypeStatsKey returns the name of the query type used in the stats keys, e.g.
+// "HTTPS" for 65.  Unknown types are named by their numbers.
+func qtypeStatsKey(qtype uint16) (key string) {
+	if s, ok := dns.TypeToString[qtype]; ok {
+		return s
+	}
+
+	return strconv.FormatUint(uint64(qtype), 10)
+}
+
+// rcodeStatsKey returns the name of the response code used in the stats keys,
+// e.g. "NXDOMAIN" for 3.  Unknown codes are named by their numbers.
+func rcodeStatsKey(rcode int) (key string) {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+
+	return strconv.Itoa(rcode)
+}
+
+// BlockedDomainHits is the number of the blocked responses for a domain from a
+// blocked domains list.
+type BlockedDomainHits struct {
+	// Domain is the queried domain.
+	Domain string `json:"domain"`
+
+	// List is the name of the list the domain is blocked by.
+	List string `json:"list"`
+
+	// Hits is the number of the blocked responses.
+	Hits uint64 `json:"hits"`
+}
+
+// TopBlocked is the aggregated statistics of the blocked responses.
+type TopBlocked struct {
+	// ListTotals are the numbers of the blocked responses keyed by the lists'
+	// names.
+	ListTotals map[string]uint64 `json:"list_totals"`
+
+	// Domains are the most blocked domains sorted by the number of hits in the
+	// descending order.
+	Domains []BlockedDomainHits `json:"domains"`
+}
+
+// TopBlockedDomains aggregates the per-domain counters stored under the
+// "blocked_domains::domains::<list>::<domain>" keys into the per-list totals
+// and the limit most blocked domains.  The counters are copied first, so that
+// the sorting doesn't block the other users of r.
+func (r *StatsManager) TopBlockedDomains(limit int) (top TopBlocked) {
+	hits := r.domainHits("blocked_domains")
+
+	top.ListTotals = map[string]uint64{}
+	for _, h := range hits {
+		top.ListTotals[h.List] += h.Hits
+	}
+
+	// The counters of the evicted domains are only included in the totals.
+	hits = sortDomainHits(hits)
+
+	if limit >= 0 && limit < len(hits) {
+		hits = hits[:limit]
+	}
+	top.Domains = hits
+
+	return top
+}
+
+// sortDomainHits sorts hits by the number of hits in the descending order and
+// removes the counters of the evicted domains.
+func sortDomainHits(hits []BlockedDomainHits) (sorted []BlockedDomainHits) {
+	slices.SortFunc(hits, func(a, b BlockedDomainHits) int {
+		if c := cmp.Compare(b.Hits, a.Hits); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(a.Domain, b.Domain)
+	})
+
+	return slices.DeleteFunc(hits, func(h BlockedDomainHits) (ok bool) {
+		return h.Domain == domainsOtherKey
+	})
+}
+
+// domainHits returns the copy of the per-domain counters stored under the
+// "<section>::domains::<list>::<domain>" keys, e.g. the ones of the blocked
+// responses for the "blocked_domains" section.
+func (r *StatsManager) domainHits(section string) (hits []BlockedDomainHits) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	hits = []BlockedDomainHits{}
+
+	sectionStats, _ := r.stats[section].(map[string]any)
+	lists, _ := sectionStats["domains"].(map[string]any)
+	for list, domains := range lists {
+		domainsMap, ok := domains.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		for domain, v := range domainsMap {
+			n := asUint64(v)
+			if n == 0 {
+				continue
+			}
+
+			hits = append(hits, BlockedDomainHits{Domain: domain, List: list, Hits: n})
+		}
+	}
+
+	return hits
+}
+
+// ClientStats are the per-client statistics.
+type ClientStats struct {
+	// Client is the address of the client, possibly anonymized.
+	Client string `json:"client"`
+
+	// Queries is the number of the queries from the client.
+	Queries uint64 `json:"queries"`
+
+	// Blocked is the number of the queries for the blocked domains.
+	Blocked uint64 `json:"blocked"`
+
+	// CacheHits is the number of the responses served from the cache.
+	CacheHits uint64 `json:"cache_hits"`
+}
+
+// ClientStats returns the statistics stored under the "clients::<client>" keys
+// sorted by the number of queries in the descending order.
+func (r *StatsManager) ClientStats() (clients []ClientStats) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	clients = []ClientStats{}
+
+	clientsMap, _ := r.stats["clients"].(map[string]any)
+	for client, v := range clientsMap {
+		counters, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		clients = append(clients, ClientStats{
+			Client:    client,
+			Queries:   asUint64(counters[clientStatQueries]),
+			Blocked:   asUint64(counters[clientStatBlocked]),
+			CacheHits: asUint64(counters[clientStatCacheHits]),
+		})
+	}
+
+	slices.SortFunc(clients, func(a, b ClientStats) int {
+		if c := cmp.Compare(b.Queries, a.Queries); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(a.Client, b.Client)
+	})
+
+	return clients
+}
+
+// asUint64 returns v as uint64 converting the float64 values loaded from JSON.
+// It returns zero for the values of the other types.
+func asUint64(v any) (n uint64) {
+	switch v := v.(type) {
+	case uint64:
+		return v
+	case float64:
+		return uint64(v)
+	default:
+		return 0
+	}
+}
+
+// asInt64 is like asUint64 but for the int64 values.
+func asInt64(v any) (n int64) {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case uint64:
+		return int64(v)
+	case float64:
+		return int64(v)
+	default:
+		return 0
+	}
+}
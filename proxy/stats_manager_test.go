@@ -0,0 +1,396 @@
+package proxy
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsManager_TopBlockedDomains(t *testing.T) {
+	sm := NewStatsManager()
+	sm.Set("blocked_domains::blocked_responses", uint64(16))
+	sm.Set("blocked_domains::domains::ads::a.example", uint64(5))
+	sm.Set("blocked_domains::domains::ads::b.example", uint64(1))
+	sm.Set("blocked_domains::domains::ads::c.example", uint64(5))
+	sm.Set("blocked_domains::domains::adult::d.example", uint64(3))
+	// Loaded from the saved statistics.
+	sm.Set("blocked_domains::domains::adult::e.example", float64(2))
+
+	wantTotals := map[string]uint64{"ads": 11, "adult": 5}
+
+	testCases := []struct {
+		name  string
+		want  []BlockedDomainHits
+		limit int
+	}{{
+		name: "top_3",
+		want: []BlockedDomainHits{
+			{Domain: "a.example", List: "ads", Hits: 5},
+			{Domain: "c.example", List: "ads", Hits: 5},
+			{Domain: "d.example", List: "adult", Hits: 3},
+		},
+		limit: 3,
+	}, {
+		name:  "zero",
+		want:  []BlockedDomainHits{},
+		limit: 0,
+	}, {
+		name: "more_than_all",
+		want: []BlockedDomainHits{
+			{Domain: "a.example", List: "ads", Hits: 5},
+			{Domain: "c.example", List: "ads", Hits: 5},
+			{Domain: "d.example", List: "adult", Hits: 3},
+			{Domain: "e.example", List: "adult", Hits: 2},
+			{Domain: "b.example", List: "ads", Hits: 1},
+		},
+		limit: 10,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			top := sm.TopBlockedDomains(tc.limit)
+			assert.Equal(t, wantTotals, top.ListTotals)
+			assert.Equal(t, tc.want, top.Domains)
+		})
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		top := NewStatsManager().TopBlockedDomains(10)
+		assert.Empty(t, top.ListTotals)
+		assert.Empty(t, top.Domains)
+	})
+}
+
+func TestStatsManager_Increment(t *testing.T) {
+	const (
+		numGoroutines = 50
+		numIncrements = 1000
+	)
+
+	sm := NewStatsManager()
+
+	wg := &sync.WaitGroup{}
+	for range numGoroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for range numIncrements {
+				sm.Increment("counters::hits", 1)
+				sm.Add("counters::balance", -1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, uint64(numGoroutines*numIncrements), sm.Get("counters::hits"))
+	assert.Equal(t, int64(-numGoroutines*numIncrements), sm.Get("counters::balance"))
+}
+
+func TestStatsManager_Increment_loaded(t *testing.T) {
+	stats := map[string]any{}
+	err := json.Unmarshal([]byte(`{"counters":{"hits":41,"balance":3},"flat":"value"}`), &stats)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	sm := NewStatsManager()
+	sm.SetStats(&stats)
+
+	sm.Increment("counters::hits", 1)
+	sm.Add("counters::balance", -5)
+	sm.Increment("flat::nested", 2)
+
+	assert.Equal(t, uint64(42), sm.Get("counters::hits"))
+	assert.Equal(t, int64(-2), sm.Get("counters::balance"))
+
+	// The leaf isn't treated as a subtree.
+	assert.Nil(t, sm.Get("flat::nested"))
+	assert.Equal(t, "value", sm.Get("flat"))
+}
+
+func TestStatsManager_leafAndBranch(t *testing.T) {
+	testCases := []struct {
+		update func(sm *StatsManager)
+		name   string
+	}{{
+		update: func(sm *StatsManager) { sm.Increment("leaf::nested", 1) },
+		name:   "increment_leaf_as_branch",
+	}, {
+		update: func(sm *StatsManager) { sm.Increment("branch", 1) },
+		name:   "increment_over_branch",
+	}, {
+		update: func(sm *StatsManager) { sm.Add("leaf::nested", -1) },
+		name:   "add_leaf_as_branch",
+	}, {
+		update: func(sm *StatsManager) { sm.Add("branch", -1) },
+		name:   "add_over_branch",
+	}, {
+		update: func(sm *StatsManager) { sm.Fold("branch::counter", "leaf::nested") },
+		name:   "fold_into_leaf_as_branch",
+	}, {
+		update: func(sm *StatsManager) { sm.Fold("leaf", "branch") },
+		name:   "fold_into_branch",
+	}, {
+		update: func(sm *StatsManager) { sm.Fold("branch", "other") },
+		name:   "fold_branch",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sm := NewStatsManager()
+			require.NoError(t, sm.Set("leaf", uint64(5)))
+			require.NoError(t, sm.Set("branch::counter", uint64(7)))
+
+			tc.update(sm)
+
+			assert.Equal(t, uint64(5), sm.Get("leaf"))
+			assert.Equal(t, uint64(7), sm.Get("branch::counter"))
+			assert.Nil(t, sm.Get("leaf::nested"))
+			assert.Nil(t, sm.Get("other"))
+		})
+	}
+}
+
+func TestStatsManager_Set(t *testing.T) {
+	sm := NewStatsManager()
+	require.NoError(t, sm.Set("cache::size", uint64(1)))
+	require.NoError(t, sm.Set("blocked_domains::domains::ads::a.example", uint64(2)))
+
+	testCases := []struct {
+		value      any
+		name       string
+		key        string
+		wantErrMsg string
+	}{{
+		value:      uint64(3),
+		name:       "leaf_as_branch",
+		key:        "cache::size::nested",
+		wantErrMsg: `setting stats "cache::size::nested": "cache::size" is not a subtree`,
+	}, {
+		value:      uint64(3),
+		name:       "leaf_over_branch",
+		key:        "blocked_domains::domains",
+		wantErrMsg: `setting stats "blocked_domains::domains": cannot replace a subtree with uint64`,
+	}, {
+		value:      map[string]any{},
+		name:       "branch_over_branch",
+		key:        "blocked_domains::domains",
+		wantErrMsg: "",
+	}, {
+		value:      "value",
+		name:       "leaf_over_leaf",
+		key:        "cache::size",
+		wantErrMsg: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := sm.Set(tc.key, tc.value)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+
+	// The collisions don't break the lookups.
+	assert.Nil(t, sm.Get("cache::size::nested"))
+	assert.False(t, sm.Exists("cache::size::nested"))
+
+	_, ok := sm.GetUint64("cache::size")
+	assert.False(t, ok)
+
+	s, ok := sm.GetString("cache::size")
+	require.True(t, ok)
+	assert.Equal(t, "value", s)
+}
+
+func TestStatsManager_typedGetters(t *testing.T) {
+	sm := NewStatsManager()
+	require.NoError(t, sm.Set("counters::loaded", float64(5)))
+	require.NoError(t, sm.Set("counters::negative", int64(-1)))
+	require.NoError(t, sm.Set("time::since", "2024-03-01 00:00:00"))
+	sm.Increment("counters::hits", 3)
+
+	n, ok := sm.GetUint64("counters::hits")
+	require.True(t, ok)
+	assert.Equal(t, uint64(3), n)
+
+	n, ok = sm.GetUint64("counters::loaded")
+	require.True(t, ok)
+	assert.Equal(t, uint64(5), n)
+
+	_, ok = sm.GetUint64("counters::negative")
+	assert.False(t, ok)
+
+	_, ok = sm.GetUint64("counters")
+	assert.False(t, ok)
+
+	_, ok = sm.GetUint64("time::since::nested")
+	assert.False(t, ok)
+
+	_, ok = sm.GetString("counters::hits")
+	assert.False(t, ok)
+
+	m, ok := sm.GetMap("counters")
+	require.True(t, ok)
+	assert.Len(t, m, 3)
+
+	// The returned map is a copy.
+	delete(m, "hits")
+	assert.True(t, sm.Exists("counters::hits"))
+
+	_, ok = sm.GetMap("counters::hits")
+	assert.False(t, ok)
+}
+
+func TestStatsManager_Delete(t *testing.T) {
+	sm := NewStatsManager()
+	sm.Set("blocked_domains::domains::ads::one.example", uint64(1))
+	sm.Set("blocked_domains::domains::ads::two.example", uint64(2))
+	sm.Set("blocked_domains::domains::trackers::three.example", uint64(3))
+	sm.Set("blocked_domains::blocked_responses", uint64(6))
+	sm.Set("resolvers::dns.example", uint64(10))
+
+	assert.Equal(t, 0, sm.Delete("blocked_domains::missing"))
+	assert.Equal(t, 0, sm.Delete("resolvers::dns.example::nested"))
+
+	assert.Equal(t, 1, sm.Delete("blocked_domains::domains::ads::one.example"))
+	assert.Equal(t, 2, sm.Delete("blocked_domains::domains"))
+	assert.False(t, sm.Exists("blocked_domains::domains"))
+	assert.Equal(t, uint64(6), sm.Get("blocked_domains::blocked_responses"))
+
+	assert.Equal(t, 2, sm.Reset())
+	assert.False(t, sm.Exists("resolvers"))
+	assert.True(t, sm.Exists("time::since"))
+}
+
+func TestStatsManager_Rollover(t *testing.T) {
+	day := func(d int) (date time.Time) {
+		return time.Date(2024, time.March, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	sm := NewStatsManager()
+	sm.Rollover(day(1), 2)
+
+	sm.Increment("queries::types::A", 2)
+	sm.Add("counters::balance", -1)
+	sm.Set("gauges::clients", uint64(7))
+
+	// The per-client and per-domain counters are only kept for the lifetime.
+	sm.Increment("clients::192.0.2.1::queries", 1)
+	sm.Increment("blocked_domains::domains::ads::ads.example", 1)
+
+	today, ok := sm.Day("2024-03-01")
+	require.True(t, ok)
+	assert.Equal(t, map[string]any{
+		"queries":  map[string]any{"types": map[string]any{"A": uint64(2)}},
+		"counters": map[string]any{"balance": int64(-1)},
+	}, today)
+
+	// Running again on the same day changes nothing.
+	sm.Rollover(day(1).Add(time.Hour), 2)
+	_, ok = sm.Day("2024-03-01")
+	require.True(t, ok)
+
+	sm.Rollover(day(2), 2)
+	sm.Increment("queries::types::A", 1)
+
+	prev, ok := sm.Day("2024-03-01")
+	require.True(t, ok)
+	assert.Equal(t, today, prev)
+
+	today, ok = sm.Day("2024-03-02")
+	require.True(t, ok)
+	assert.Equal(t, map[string]any{
+		"queries": map[string]any{"types": map[string]any{"A": uint64(1)}},
+	}, today)
+
+	_, ok = sm.Day("2024-02-29")
+	assert.False(t, ok)
+
+	// The days ended while not running are rolled over into the last
+	// recorded one.
+	sm.Rollover(day(5), 3)
+
+	_, ok = sm.Day("2024-03-01")
+	assert.False(t, ok)
+
+	prev, ok = sm.Day("2024-03-03")
+	assert.False(t, ok)
+	assert.Nil(t, prev)
+
+	prev, ok = sm.Day("2024-03-02")
+	require.True(t, ok)
+	assert.Equal(t, today, prev)
+
+	_, ok = sm.Day("2024-03-05")
+	assert.False(t, ok)
+
+	lifetime := sm.Lifetime()
+	assert.NotContains(t, lifetime, statsTodayKey)
+	assert.NotContains(t, lifetime, statsHistoryKey)
+	assert.Equal(t, uint64(3), sm.Get("queries::types::A"))
+}
+
+func TestMergeCounters(t *testing.T) {
+	dst := map[string]any{
+		"a": uint64(1),
+		"b": map[string]any{"c": float64(2)},
+		"d": int64(-3),
+	}
+	src := map[string]any{
+		"a": uint64(2),
+		"b": map[string]any{"c": uint64(1), "e": uint64(5)},
+		"d": int64(1),
+		"f": uint64(4),
+	}
+
+	assert.Equal(t, map[string]any{
+		"a": uint64(3),
+		"b": map[string]any{"c": uint64(3), "e": uint64(5)},
+		"d": int64(-2),
+		"f": uint64(4),
+	}, mergeCounters(dst, src))
+}
+
+func TestStatsManager_SaveStats(t *testing.T) {
+	sm := NewStatsManager()
+	sm.Increment("queries::types::A", 3)
+	require.NoError(t, sm.Set("time::since", "2024-03-01 00:00:00"))
+
+	path := filepath.Join(t.TempDir(), "stats.json")
+	sm.SaveStats(path)
+
+	// Changes after saving don't affect the file.
+	sm.Increment("queries::types::A", 1)
+
+	loaded := NewStatsManager()
+	loaded.LoadStats(path)
+
+	n, ok := loaded.GetUint64("queries::types::A")
+	require.True(t, ok)
+	assert.Equal(t, uint64(3), n)
+
+	since, ok := loaded.GetString("time::since")
+	require.True(t, ok)
+	assert.Equal(t, "2024-03-01 00:00:00", since)
+}
+
+func TestStatsKeys(t *testing.T) {
+	assert.Equal(t, "A", qtypeStatsKey(dns.TypeA))
+	assert.Equal(t, "HTTPS", qtypeStatsKey(dns.TypeHTTPS))
+	assert.Equal(t, "SVCB", qtypeStatsKey(dns.TypeSVCB))
+	assert.Equal(t, "ANY", qtypeStatsKey(dns.TypeANY))
+	assert.Equal(t, "65000", qtypeStatsKey(65000))
+
+	assert.Equal(t, "NOERROR", rcodeStatsKey(dns.RcodeSuccess))
+	assert.Equal(t, "NXDOMAIN", rcodeStatsKey(dns.RcodeNameError))
+	assert.Equal(t, "SERVFAIL", rcodeStatsKey(dns.RcodeServerFailure))
+	assert.Equal(t, "4000", rcodeStatsKey(4000))
+}
@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// defaultTLSCertReloadInterval is the default interval between the checks of
+// the certificate files for changes.
+const defaultTLSCertReloadInterval = time.Minute
+
+// TLSCertFiles are the paths to the PEM-encoded certificate chain and private
+// key files.
+type TLSCertFiles struct {
+	// CertPath is the path to the certificate chain.
+	CertPath string
+
+	// KeyPath is the path to the private key.
+	KeyPath string
+}
+
+// tlsCerts provides the certificates of the encrypted listeners loaded from
+// the files and reloads them when the files change.
+type tlsCerts struct {
+	// certs are the currently served certificates in the order of files.  It's
+	// never nil.
+	certs atomic.Pointer[[]*tls.Certificate]
+
+	// mux protects states and serializes the reloads.
+	mux *sync.Mutex
+
+	// done is closed when the certificates are closed to stop the reloading.
+	// It's recreated on each start.
+	done chan struct{}
+
+	// files are the certificate files.  The first ones are the default
+	// certificate served when no other one matches the server name.
+	files []TLSCertFiles
+
+	// states are the states of the certificate and key files, in that order
+	// for each of files, at the last load attempt.
+	states []hostsFileState
+
+	// interval is the interval between the checks of the files for changes.
+	interval time.Duration
+}
+
+// initTLSCerts loads the configured certificate files, if any, and makes them
+// the source of the certificate of p.TLSConfig.
+func (p *Proxy) initTLSCerts() (err error) {
+	if p.TLSCertPath == "" {
+		return nil
+	}
+
+	files := append([]TLSCertFiles{{
+		CertPath: p.TLSCertPath,
+		KeyPath:  p.TLSKeyPath,
+	}}, p.TLSExtraCerts...)
+
+	p.certs, err = newTLSCerts(files, p.TLSCertReloadInterval)
+	if err != nil {
+		return fmt.Errorf("tls certificate: %w", err)
+	}
+
+	// Don't modify the configuration passed by the user.
+	p.TLSConfig = p.TLSConfig.Clone()
+	p.TLSConfig.Certificates = nil
+	p.TLSConfig.GetCertificate = p.certs.getCertificate
+
+	return nil
+}
+
+// validateTLSCertPaths returns an error if the certificate files are
+// configured improperly.
+func (p *Proxy) validateTLSCertPaths() (err error) {
+	switch {
+	case (p.TLSCertPath == "") != (p.TLSKeyPath == ""):
+		return errors.Error("both certificate and key paths must be set")
+	case p.TLSCertPath == "" && len(p.TLSExtraCerts) > 0:
+		return errors.Error("extra certificates require the default one")
+	case p.TLSCertPath != "" && p.TLSConfig == nil:
+		return errors.Error("certificate paths require tls config")
+	case p.TLSCertReloadInterval < 0:
+		return fmt.Errorf("negative reload interval %s", p.TLSCertReloadInterval)
+	}
+
+	for i, f := range p.TLSExtraCerts {
+		if f.CertPath == "" || f.KeyPath == "" {
+			return fmt.Errorf("extra certificate at index %d: both paths must be set", i)
+		}
+	}
+
+	return nil
+}
+
+// newTLSCerts returns a new *tlsCerts with the certificates from files loaded.
+// files must not be empty.
+func newTLSCerts(files []TLSCertFiles, interval time.Duration) (c *tlsCerts, err error) {
+	c = &tlsCerts{
+		mux:      &sync.Mutex{},
+		files:    files,
+		states:   make([]hostsFileState, 2*len(files)),
+		interval: cmp.Or(interval, defaultTLSCertReloadInterval),
+	}
+
+	err = c.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// getCertificate implements the [tls.Config.GetCertificate] callback for
+// *tlsCerts.  It returns the first certificate supporting the server name and
+// the parameters of hello, or the default one if none does.
+func (c *tlsCerts) getCertificate(hello *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
+	certs := *c.certs.Load()
+	if hello != nil && hello.ServerName != "" {
+		for _, cert = range certs[1:] {
+			if hello.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+	}
+
+	return certs[0], nil
+}
+
+// paths returns the paths of all the files in the order of states.
+func (c *tlsCerts) paths() (paths []string) {
+	for _, f := range c.files {
+		paths = append(paths, f.CertPath, f.KeyPath)
+	}
+
+	return paths
+}
+
+// reload loads the certificates from the files and replaces the served ones.
+// The served certificates are kept if any of the files can't be loaded.
+func (c *tlsCerts) reload() (err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	// Remember the states even if the loading fails, so that the broken files
+	// aren't reloaded until they change again.
+	for i, path := range c.paths() {
+		c.states[i], err = statHostsFile(path)
+		if err != nil {
+			log.Debug("dnsproxy: checking tls certificate file: %s", err)
+		}
+	}
+
+	certs := make([]*tls.Certificate, 0, len(c.files))
+	for _, f := range c.files {
+		var cert *tls.Certificate
+		cert, err = loadTLSCert(f.CertPath, f.KeyPath)
+		if err != nil {
+			return fmt.Errorf("certificate %q: %w", f.CertPath, err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	c.certs.Store(&certs)
+
+	return nil
+}
+
+// loadTLSCert reads and parses the PEM-encoded certificate chain and the
+// private key from the files.  It returns an error if they don't match.
+func loadTLSCert(certPath, keyPath string) (cert *tls.Certificate, err error) {
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading certificate: %w", err)
+	}
+
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading key: %w", err)
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	// Parse the leaf once, since it's used to match the server names of each
+	// handshake.
+	pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing leaf certificate: %w", err)
+	}
+
+	return &pair, nil
+}
+
+// start starts checking the files for changes every c.interval until c is
+// closed.  It must not be called concurrently with Close.
+func (c *tlsCerts) start() {
+	done := make(chan struct{})
+	c.done = done
+
+	go func() {
+		defer log.OnPanic("tls certificate reload")
+
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.reloadIfChanged()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// Close implements the [io.Closer] interface for *tlsCerts.
+func (c *tlsCerts) Close() (err error) {
+	close(c.done)
+
+	return nil
+}
+
+// reloadIfChanged reloads the certificates if any of the files has changed
+// since the last load attempt.
+func (c *tlsCerts) reloadIfChanged() {
+	if !c.changed() {
+		return
+	}
+
+	err := c.reload()
+	if err != nil {
+		log.Error("dnsproxy: reloading tls certificates, keeping the previous ones: %s", err)
+
+		return
+	}
+
+	log.Info("dnsproxy: tls certificates reloaded")
+}
+
+// changed returns true if any of the files has changed since the last load
+// attempt.
+func (c *tlsCerts) changed() (ok bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for i, path := range c.paths() {
+		st, err := statHostsFile(path)
+		if err != nil {
+			log.Debug("dnsproxy: checking tls certificate file: %s", err)
+
+			continue
+		}
+
+		prev := c.states[i]
+		if st.exists != prev.exists || st.size != prev.size || !st.modTime.Equal(prev.modTime) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReloadTLSCertificate reloads the certificates of the encrypted listeners from
+// [Config.TLSCertPath], [Config.TLSKeyPath], and [Config.TLSExtraCerts].  The
+// new certificates are used for the new connections without restarting the
+// listeners.  The previous certificates are kept if any of the files can't be
+// loaded.
+func (p *Proxy) ReloadTLSCertificate() (err error) {
+	if p.certs == nil {
+		return errors.Error("no tls certificate files configured")
+	}
+
+	err = p.certs.reload()
+	if err != nil {
+		return fmt.Errorf("reloading tls certificate: %w", err)
+	}
+
+	log.Info("dnsproxy: tls certificates reloaded")
+
+	return nil
+}
+
+// connServerName returns the server name requested by the client of the TLS
+// connection conn, if any.  conn must have completed the handshake.
+func connServerName(conn net.Conn) (srvName string) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	return tlsConn.ConnectionState().ServerName
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSCerts_reload(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	writeFiles := func(t *testing.T, certPem, keyPem []byte) {
+		t.Helper()
+
+		require.NoError(t, os.WriteFile(certPath, certPem, 0o600))
+		require.NoError(t, os.WriteFile(keyPath, keyPem, 0o600))
+	}
+
+	certPem, keyPem := newTestCertPEM(t, tlsServerName)
+	writeFiles(t, certPem, keyPem)
+
+	wantCert, err := tls.X509KeyPair(certPem, keyPem)
+	require.NoError(t, err)
+
+	c, err := newTLSCerts([]TLSCertFiles{{CertPath: certPath, KeyPath: keyPath}}, 0)
+	require.NoError(t, err)
+
+	assertServed := func(t *testing.T, want tls.Certificate) {
+		t.Helper()
+
+		cert, certErr := c.getCertificate(nil)
+		require.NoError(t, certErr)
+
+		assert.Equal(t, want.Certificate, cert.Certificate)
+	}
+
+	assertServed(t, wantCert)
+	assert.False(t, c.changed())
+
+	newCertPem, newKeyPem := newTestCertPEM(t, tlsServerName)
+
+	t.Run("mismatched_key", func(t *testing.T) {
+		writeFiles(t, newCertPem, keyPem)
+
+		require.Error(t, c.reload())
+		assertServed(t, wantCert)
+
+		// The broken files aren't reloaded until they change again.
+		assert.False(t, c.changed())
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		writeFiles(t, newCertPem, newKeyPem)
+
+		modTime := time.Now().Add(time.Second)
+		require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+		require.True(t, c.changed())
+
+		wantCert, err = tls.X509KeyPair(newCertPem, newKeyPem)
+		require.NoError(t, err)
+
+		c.reloadIfChanged()
+		assertServed(t, wantCert)
+		assert.False(t, c.changed())
+	})
+}
+
+func TestTLSCerts_getCertificate(t *testing.T) {
+	const (
+		defaultName = "dns.example"
+		familyName  = "family.dns.example"
+		adultsName  = "adults.dns.example"
+	)
+
+	dir := t.TempDir()
+
+	var files []TLSCertFiles
+	wantCerts := map[string]tls.Certificate{}
+	for _, name := range []string{defaultName, familyName, adultsName} {
+		certPem, keyPem := newTestCertPEM(t, name)
+
+		f := TLSCertFiles{
+			CertPath: filepath.Join(dir, name+".crt"),
+			KeyPath:  filepath.Join(dir, name+".key"),
+		}
+		require.NoError(t, os.WriteFile(f.CertPath, certPem, 0o600))
+		require.NoError(t, os.WriteFile(f.KeyPath, keyPem, 0o600))
+		files = append(files, f)
+
+		cert, err := tls.X509KeyPair(certPem, keyPem)
+		require.NoError(t, err)
+
+		wantCerts[name] = cert
+	}
+
+	c, err := newTLSCerts(files, 0)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		srvName  string
+		wantName string
+	}{{
+		name:     "family",
+		srvName:  familyName,
+		wantName: familyName,
+	}, {
+		name:     "adults",
+		srvName:  adultsName,
+		wantName: adultsName,
+	}, {
+		name:     "unknown",
+		srvName:  "other.example",
+		wantName: defaultName,
+	}, {
+		name:     "no_sni",
+		srvName:  "",
+		wantName: defaultName,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cert, certErr := c.getCertificate(&tls.ClientHelloInfo{
+				ServerName:        tc.srvName,
+				SupportedVersions: []uint16{tls.VersionTLS13},
+			})
+			require.NoError(t, certErr)
+
+			assert.Equal(t, wantCerts[tc.wantName].Certificate, cert.Certificate)
+		})
+	}
+}
+
+func TestProxy_validateTLSCertPaths(t *testing.T) {
+	testCases := []struct {
+		conf       *Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &Config{},
+		name:       "none",
+		wantErrMsg: "",
+	}, {
+		conf: &Config{
+			TLSConfig:   &tls.Config{},
+			TLSCertPath: "cert.pem",
+			TLSKeyPath:  "key.pem",
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf: &Config{
+			TLSConfig:   &tls.Config{},
+			TLSCertPath: "cert.pem",
+		},
+		name:       "no_key",
+		wantErrMsg: "both certificate and key paths must be set",
+	}, {
+		conf: &Config{
+			TLSCertPath: "cert.pem",
+			TLSKeyPath:  "key.pem",
+		},
+		name:       "no_tls_config",
+		wantErrMsg: "certificate paths require tls config",
+	}, {
+		conf: &Config{
+			TLSConfig:             &tls.Config{},
+			TLSCertPath:           "cert.pem",
+			TLSKeyPath:            "key.pem",
+			TLSCertReloadInterval: -time.Second,
+		},
+		name:       "negative_interval",
+		wantErrMsg: "negative reload interval -1s",
+	}, {
+		conf: &Config{
+			TLSConfig: &tls.Config{},
+			TLSExtraCerts: []TLSCertFiles{{
+				CertPath: "family.pem",
+				KeyPath:  "family.key",
+			}},
+		},
+		name:       "extra_without_default",
+		wantErrMsg: "extra certificates require the default one",
+	}, {
+		conf: &Config{
+			TLSConfig:   &tls.Config{},
+			TLSCertPath: "cert.pem",
+			TLSKeyPath:  "key.pem",
+			TLSExtraCerts: []TLSCertFiles{{
+				CertPath: "family.pem",
+			}},
+		},
+		name:       "extra_no_key",
+		wantErrMsg: "extra certificate at index 0: both paths must be set",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: *tc.conf}
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, p.validateTLSCertPaths())
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultHealthCheckFailures is the default number of the consecutive
+	// failed probes after which an upstream is considered unhealthy.
+	defaultHealthCheckFailures = 3
+
+	// defaultHealthCheckSuccesses is the default number of the consecutive
+	// successful probes after which an unhealthy upstream is considered healthy
+	// again.
+	defaultHealthCheckSuccesses = 2
+)
+
+// UpstreamHealth is the health state of an upstream.
+type UpstreamHealth struct {
+	// LastCheck is the time of the last probe.
+	LastCheck time.Time `json:"last_check"`
+
+	// LastError is the error of the last failed probe, if any.
+	LastError string `json:"last_error,omitempty"`
+
+	// ConsecutiveFailures is the number of the failed probes in a row.
+	ConsecutiveFailures int `json:"consecutive_failures"`
+
+	// consecutiveSuccesses is the number of the successful probes in a row.
+	consecutiveSuccesses int
+
+	// Healthy is false if the upstream is skipped when selecting the upstreams
+	// for a request.
+	Healthy bool `json:"healthy"`
+}
+
+// healthChecker periodically probes the upstreams and keeps their health
+// state.
+type healthChecker struct {
+	// clock is used to get the time of the probes.
+	clock clock
+
+	// mux protects states and upstreams.
+	mux *sync.Mutex
+
+	// states are the health states of the upstreams by their addresses.
+	states map[string]*UpstreamHealth
+
+	// done is closed when the checker is closed to stop the probing.
+	done chan struct{}
+
+	// upstreams are the probed upstreams.
+	upstreams []upstream.Upstream
+
+	// interval is the interval between the probes.
+	interval time.Duration
+
+	// failures is the number of the consecutive failed probes after which an
+	// upstream is considered unhealthy.
+	failures int
+
+	// successes is the number of the consecutive successful probes after which
+	// an unhealthy upstream is considered healthy again.
+	successes int
+}
+
+// newHealthChecker returns a new properly initialized *healthChecker for the
+// upstreams.  All the upstreams are considered healthy until probed.
+func newHealthChecker(
+	c clock,
+	ups []upstream.Upstream,
+	interval time.Duration,
+	failures int,
+	successes int,
+) (hc *healthChecker) {
+	hc = &healthChecker{
+		clock:     c,
+		mux:       &sync.Mutex{},
+		states:    make(map[string]*UpstreamHealth, len(ups)),
+		done:      make(chan struct{}),
+		upstreams: ups,
+		interval:  interval,
+		failures:  cmp.Or(failures, defaultHealthCheckFailures),
+		successes: cmp.Or(successes, defaultHealthCheckSuccesses),
+	}
+
+	for _, u := range ups {
+		hc.states[u.Address()] = &UpstreamHealth{Healthy: true}
+	}
+
+	return hc
+}
+
+// start starts probing the upstreams every hc.interval until hc is closed.
+func (hc *healthChecker) start() {
+	go func() {
+		defer log.OnPanic("upstream health check")
+
+		ticker := time.NewTicker(hc.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				hc.probeAll()
+			case <-hc.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close implements the [io.Closer] interface for *healthChecker.
+func (hc *healthChecker) Close() (err error) {
+	close(hc.done)
+
+	return nil
+}
+
+// probeAll probes all the upstreams concurrently and waits for the results.
+func (hc *healthChecker) probeAll() {
+	hc.mux.Lock()
+	ups := hc.upstreams
+	hc.mux.Unlock()
+
+	wg := &sync.WaitGroup{}
+	for _, u := range ups {
+		wg.Add(1)
+		go func() {
+			defer log.OnPanic("upstream health probe")
+			defer wg.Done()
+
+			hc.probe(u)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// setUpstreams replaces the probed upstreams with ups.  The health states of
+// the upstreams kept are preserved, and the new ones are considered healthy
+// until probed.
+func (hc *healthChecker) setUpstreams(ups []upstream.Upstream) {
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+
+	states := make(map[string]*UpstreamHealth, len(ups))
+	for _, u := range ups {
+		addr := u.Address()
+		if h, ok := hc.states[addr]; ok {
+			states[addr] = h
+		} else {
+			states[addr] = &UpstreamHealth{Healthy: true}
+		}
+	}
+
+	hc.upstreams = ups
+	hc.states = states
+}
+
+// probe sends a lightweight query to u and updates its health state.
+func (hc *healthChecker) probe(u upstream.Upstream) {
+	hc.update(u.Address(), probeUpstream(u))
+}
+
+// probeUpstream sends a lightweight query to u and returns the error, if any.
+func probeUpstream(u upstream.Upstream) (err error) {
+	req := &dns.Msg{}
+	req.SetQuestion(".", dns.TypeNS)
+
+	_, err = u.Exchange(req)
+
+	return err
+}
+
+// UpstreamProbe is the result of probing an upstream with a test query.
+type UpstreamProbe struct {
+	// Err is the error of the probe, if any.
+	Err error
+
+	// Address is the address of the upstream.
+	Address string
+}
+
+// ProbeUpstreams concurrently sends a test query to each of the upstreams of
+// p, including the private, the fallback, and the forwarding zones ones, and
+// returns the results in the order of the upstreams.
+func (p *Proxy) ProbeUpstreams() (res []UpstreamProbe) {
+	ups := p.upstreams()
+	var all []upstream.Upstream
+	seen := map[string]unit{}
+	for _, uc := range []*UpstreamConfig{
+		ups.UpstreamConfig,
+		ups.PrivateRDNSUpstreamConfig,
+		ups.Fallbacks,
+		p.forwardingZones().upstreamConfig(),
+	} {
+		for _, u := range upstreamsToCheck(uc) {
+			if _, ok := seen[u.Address()]; !ok {
+				seen[u.Address()] = unit{}
+				all = append(all, u)
+			}
+		}
+	}
+
+	return probeAllUpstreams(all)
+}
+
+// probeAllUpstreams concurrently sends a test query to each of ups and returns
+// the results in the same order.
+func probeAllUpstreams(ups []upstream.Upstream) (res []UpstreamProbe) {
+	res = make([]UpstreamProbe, len(ups))
+	wg := &sync.WaitGroup{}
+	for i, u := range ups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer log.OnPanic("probing upstream")
+
+			res[i] = UpstreamProbe{
+				Err:     probeUpstream(u),
+				Address: u.Address(),
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return res
+}
+
+// update updates the health state of the upstream with the given address
+// according to the result of its probe.
+func (hc *healthChecker) update(addr string, err error) {
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+
+	h, ok := hc.states[addr]
+	if !ok {
+		return
+	}
+
+	h.LastCheck = hc.clock.Now()
+
+	if err != nil {
+		h.LastError = err.Error()
+		h.ConsecutiveFailures++
+		h.consecutiveSuccesses = 0
+
+		if h.Healthy && h.ConsecutiveFailures >= hc.failures {
+			h.Healthy = false
+			log.Info("warning: dnsproxy: upstream %s is unhealthy: %s", addr, err)
+			SM.Increment("upstreams::"+statsKeyPart(addr)+"::ejections", 1)
+		}
+
+		return
+	}
+
+	h.ConsecutiveFailures = 0
+	h.consecutiveSuccesses++
+
+	if !h.Healthy && h.consecutiveSuccesses >= hc.successes {
+		h.Healthy = true
+		h.LastError = ""
+		log.Info("dnsproxy: upstream %s is healthy again", addr)
+	}
+}
+
+// isHealthy returns false if the upstream with the given address is known to
+// be unhealthy.
+func (hc *healthChecker) isHealthy(addr string) (ok bool) {
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+
+	h, ok := hc.states[addr]
+
+	return !ok || h.Healthy
+}
+
+// health returns a copy of the health state of the upstream with the given
+// address, if it's probed.
+func (hc *healthChecker) health(addr string) (h *UpstreamHealth) {
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+
+	state, ok := hc.states[addr]
+	if !ok {
+		return nil
+	}
+
+	c := *state
+
+	return &c
+}
+
+// validateHealthCheck returns an error if the upstream health check settings
+// are invalid.
+func (p *Proxy) validateHealthCheck() (err error) {
+	switch {
+	case p.UpstreamHealthCheckInterval < 0:
+		return fmt.Errorf("negative interval %s", p.UpstreamHealthCheckInterval)
+	case p.UpstreamHealthCheckFailures < 0:
+		return fmt.Errorf("negative failures threshold %d", p.UpstreamHealthCheckFailures)
+	case p.UpstreamHealthCheckSuccesses < 0:
+		return fmt.Errorf("negative successes threshold %d", p.UpstreamHealthCheckSuccesses)
+	default:
+		return nil
+	}
+}
+
+// filterHealthy returns the healthy upstreams of ups.  It returns ups as is if
+// none of them is healthy, so that the requests aren't failed without trying.
+func (p *Proxy) filterHealthy(ups []upstream.Upstream) (healthy []upstream.Upstream) {
+	hc := p.healthChecker
+	if hc == nil {
+		return ups
+	}
+
+	for _, u := range ups {
+		if hc.isHealthy(u.Address()) {
+			healthy = append(healthy, u)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return ups
+	}
+
+	return healthy
+}
+
+// upstreamsToCheck returns the unique upstreams of conf to probe.
+func upstreamsToCheck(conf *UpstreamConfig) (ups []upstream.Upstream) {
+	if conf == nil {
+		return nil
+	}
+
+	seen := map[string]unit{}
+	add := func(us []upstream.Upstream) {
+		for _, u := range us {
+			if _, ok := seen[u.Address()]; !ok {
+				seen[u.Address()] = unit{}
+				ups = append(ups, u)
+			}
+		}
+	}
+
+	add(conf.Upstreams)
+	for _, us := range conf.DomainReservedUpstreams {
+		add(us)
+	}
+
+	for _, us := range conf.SpecifiedDomainUpstreams {
+		add(us)
+	}
+
+	return ups
+}
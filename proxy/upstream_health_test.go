@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newHealthTestUpstream returns an upstream with the given address which fails
+// the exchanges while failing is true.
+func newHealthTestUpstream(addr string, failing *atomic.Bool) (u upstream.Upstream) {
+	return &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			if failing.Load() {
+				return nil, assert.AnError
+			}
+
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (a string) { return addr },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+func TestHealthChecker_probeAll(t *testing.T) {
+	setTestStats(t)
+
+	now := time.Unix(0, 0)
+	clock := &fakeClock{onNow: func() (n time.Time) { return now }}
+
+	failing := &atomic.Bool{}
+	good := newHealthTestUpstream("good", &atomic.Bool{})
+	bad := newHealthTestUpstream("bad", failing)
+
+	ups := []upstream.Upstream{good, bad}
+	hc := newHealthChecker(clock, ups, time.Second, 2, 2)
+	p := &Proxy{
+		Config: Config{
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: ups,
+				Timeouts:  map[string]time.Duration{"good": time.Second},
+			},
+		},
+		healthChecker: hc,
+	}
+	require.Equal(t, ups, p.filterHealthy(ups))
+
+	failing.Store(true)
+
+	hc.probeAll()
+	assert.True(t, hc.isHealthy("bad"))
+	assert.Equal(t, ups, p.filterHealthy(ups))
+
+	hc.probeAll()
+	assert.False(t, hc.isHealthy("bad"))
+	assert.Equal(t, []upstream.Upstream{good}, p.filterHealthy(ups))
+
+	h := hc.health("bad")
+	require.NotNil(t, h)
+	assert.Equal(t, 2, h.ConsecutiveFailures)
+	assert.Equal(t, assert.AnError.Error(), h.LastError)
+	assert.Equal(t, now, h.LastCheck)
+
+	n, _ := SM.GetUint64("upstreams::bad::ejections")
+	assert.Equal(t, uint64(1), n)
+
+	t.Run("all_unhealthy", func(t *testing.T) {
+		only := []upstream.Upstream{bad}
+		assert.Equal(t, only, p.filterHealthy(only))
+	})
+
+	failing.Store(false)
+
+	hc.probeAll()
+	assert.False(t, hc.isHealthy("bad"))
+
+	hc.probeAll()
+	assert.True(t, hc.isHealthy("bad"))
+	assert.Equal(t, ups, p.filterHealthy(ups))
+
+	h = hc.health("bad")
+	require.NotNil(t, h)
+	assert.Zero(t, h.ConsecutiveFailures)
+	assert.Empty(t, h.LastError)
+
+	// Only check the probed upstreams, since [SM] is global and other tests
+	// may record the stats of their upstreams concurrently.
+	stats := map[string]UpstreamStats{}
+	for _, s := range p.UpstreamStats() {
+		if s.Upstream == "good" || s.Upstream == "bad" {
+			stats[s.Upstream] = s
+		}
+	}
+
+	require.Len(t, stats, 2)
+
+	for addr, s := range stats {
+		require.NotNil(t, s.Health, addr)
+		assert.True(t, s.Health.Healthy, addr)
+	}
+
+	assert.Equal(t, int64(1000), stats["good"].TimeoutMs)
+	assert.Zero(t, stats["bad"].TimeoutMs)
+}
+
+func TestProxy_validateHealthCheck(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		conf       Config
+	}{{
+		name:       "disabled",
+		wantErrMsg: "",
+		conf:       Config{},
+	}, {
+		name:       "valid",
+		wantErrMsg: "",
+		conf: Config{
+			UpstreamHealthCheckInterval:  time.Second,
+			UpstreamHealthCheckFailures:  3,
+			UpstreamHealthCheckSuccesses: 1,
+		},
+	}, {
+		name:       "negative_interval",
+		wantErrMsg: "negative interval -1s",
+		conf:       Config{UpstreamHealthCheckInterval: -time.Second},
+	}, {
+		name:       "negative_failures",
+		wantErrMsg: "negative failures threshold -1",
+		conf:       Config{UpstreamHealthCheckFailures: -1},
+	}, {
+		name:       "negative_successes",
+		wantErrMsg: "negative successes threshold -1",
+		conf:       Config{UpstreamHealthCheckSuccesses: -1},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: tc.conf}
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, p.validateHealthCheck())
+		})
+	}
+}
+
+func TestProxy_ProbeUpstreams(t *testing.T) {
+	failing, healthy := &atomic.Bool{}, &atomic.Bool{}
+	failing.Store(true)
+
+	general := newHealthTestUpstream("general.example:53", healthy)
+	reserved := newHealthTestUpstream("reserved.example:53", failing)
+	fallback := newHealthTestUpstream("fallback.example:53", healthy)
+
+	p := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{general},
+			DomainReservedUpstreams: map[string][]upstream.Upstream{
+				"reserved.example.": {reserved, general},
+			},
+		},
+		Fallbacks:              &UpstreamConfig{Upstreams: []upstream.Upstream{fallback}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	res := p.ProbeUpstreams()
+	require.Len(t, res, 3)
+
+	assert.Equal(t, "general.example:53", res[0].Address)
+	assert.NoError(t, res[0].Err)
+
+	assert.Equal(t, "reserved.example:53", res[1].Address)
+	assert.Error(t, res[1].Err)
+
+	assert.Equal(t, "fallback.example:53", res[2].Address)
+	assert.NoError(t, res[2].Err)
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Upstreams are the upstream configurations which may be replaced while the
+// proxy is running.  See [Proxy.SetUpstreams].
+type Upstreams struct {
+	// UpstreamConfig is the general set of upstreams.  It must not be nil.
+	UpstreamConfig *UpstreamConfig
+
+	// PrivateRDNSUpstreamConfig is the set of upstreams for reverse lookups of
+	// private addresses.  It may be nil.
+	PrivateRDNSUpstreamConfig *UpstreamConfig
+
+	// Fallbacks is the set of upstreams used when the general ones fail.  It
+	// may be nil.
+	Fallbacks *UpstreamConfig
+}
+
+// close closes all the upstream configurations of ups.
+func (ups *Upstreams) close() (err error) {
+	var errs []error
+	for _, uc := range []*UpstreamConfig{
+		ups.UpstreamConfig,
+		ups.PrivateRDNSUpstreamConfig,
+		ups.Fallbacks,
+	} {
+		if uc != nil {
+			errs = closeAll(errs, uc)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// configUpstreams returns the upstream configurations from the configuration
+// of p.
+func (p *Proxy) configUpstreams() (ups *Upstreams) {
+	return &Upstreams{
+		UpstreamConfig:            p.UpstreamConfig,
+		PrivateRDNSUpstreamConfig: p.PrivateRDNSUpstreamConfig,
+		Fallbacks:                 p.Fallbacks,
+	}
+}
+
+// upstreamSet is the set of upstreams used by the requests being processed.
+type upstreamSet struct {
+	// mu is read-locked by the requests using the upstreams, so that those
+	// aren't closed until the requests are processed.
+	mu *sync.RWMutex
+
+	// ups are the upstream configurations.
+	ups *Upstreams
+
+	// closed is true if the upstreams have been closed and replaced.  It's
+	// protected by mu.
+	closed bool
+}
+
+// newUpstreamSet returns a new properly initialized *upstreamSet.
+func newUpstreamSet(ups *Upstreams) (s *upstreamSet) {
+	return &upstreamSet{
+		mu:  &sync.RWMutex{},
+		ups: ups,
+	}
+}
+
+// release marks the upstreams of s as no longer used by the request.
+func (s *upstreamSet) release() {
+	s.mu.RUnlock()
+}
+
+// closeDrained waits for the requests using s to be processed and closes the
+// upstreams.
+func (s *upstreamSet) closeDrained() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	err := s.ups.close()
+	if err != nil {
+		log.Debug("dnsproxy: closing previous upstreams: %s", err)
+	}
+}
+
+// acquireUpstreams returns the current upstream set and prevents it from being
+// closed until released.  The caller must call [upstreamSet.release] when the
+// request is processed.
+func (p *Proxy) acquireUpstreams() (s *upstreamSet) {
+	for {
+		s = p.upstreamSet.Load()
+		s.mu.RLock()
+		if !s.closed {
+			return s
+		}
+
+		// The set has been replaced meanwhile, so load the new one.
+		s.mu.RUnlock()
+	}
+}
+
+// upstreams returns the current upstream configurations, or the configured
+// ones if p isn't initialized yet.  Those must not be used for exchanges, use
+// [Proxy.acquireUpstreams] instead.
+func (p *Proxy) upstreams() (ups *Upstreams) {
+	if s := p.upstreamSet.Load(); s != nil {
+		return s.ups
+	}
+
+	return p.configUpstreams()
+}
+
+// validateUpstreams returns an error if ups aren't valid according to the
+// configuration of p.
+func (p *Proxy) validateUpstreams(ups *Upstreams) (err error) {
+	err = ups.UpstreamConfig.validate()
+	if err != nil {
+		return fmt.Errorf("validating general upstreams: %w", err)
+	}
+
+	err = ValidatePrivateConfig(ups.PrivateRDNSUpstreamConfig, p.privateNets)
+	if err != nil {
+		if p.UsePrivateRDNS || errors.Is(err, upstream.ErrNoUpstreams) {
+			return fmt.Errorf("validating private RDNS upstreams: %w", err)
+		}
+	}
+
+	// Allow [Upstreams.Fallbacks] to be nil, but not empty.  nil means not to
+	// use fallbacks at all.
+	err = ups.Fallbacks.validate()
+	if errors.Is(err, upstream.ErrNoUpstreams) {
+		return fmt.Errorf("validating fallbacks: %w", err)
+	}
+
+	return nil
+}
+
+// SetUpstreams validates ups and replaces the upstreams of p with them.  The
+// previous upstreams are closed once the requests being processed don't use
+// them anymore.  The current upstreams are kept if ups are invalid, and the
+// caller remains responsible for closing ups then.
+func (p *Proxy) SetUpstreams(ups *Upstreams) (err error) {
+	err = p.validateUpstreams(ups)
+	if err != nil {
+		return err
+	}
+
+	prev := p.upstreamSet.Swap(newUpstreamSet(ups))
+
+	if p.healthChecker != nil {
+		p.healthChecker.setUpstreams(upstreamsToCheck(ups.UpstreamConfig))
+	}
+
+	go func() {
+		defer log.OnPanic("closing previous upstreams")
+
+		prev.closeDrained()
+	}()
+
+	log.Info("dnsproxy: upstreams replaced")
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newReloadTestUpstream returns a new upstream with addr, which calls onExchange
+// before responding and sets closed on closing.
+func newReloadTestUpstream(
+	addr string,
+	onExchange func(),
+	closed *atomic.Bool,
+) (u *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			onExchange()
+
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (a string) { return addr },
+		onClose: func() (err error) {
+			closed.Store(true)
+
+			return nil
+		},
+	}
+}
+
+func TestProxy_SetUpstreams(t *testing.T) {
+	const (
+		oldAddr = "old.example:53"
+		newAddr = "new.example:53"
+
+		testTimeout = 1 * time.Second
+	)
+
+	entered, unblock := make(chan struct{}), make(chan struct{})
+	var oldBlocks atomic.Bool
+	oldBlocks.Store(true)
+
+	oldClosed := &atomic.Bool{}
+	oldUps := newReloadTestUpstream(oldAddr, func() {
+		if oldBlocks.Load() {
+			entered <- struct{}{}
+			<-unblock
+		}
+	}, oldClosed)
+
+	p := mustNew(t, &Config{
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{oldUps}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	newReq := func() (d *DNSContext) {
+		return &DNSContext{Req: (&dns.Msg{}).SetQuestion("reload.example.", dns.TypeA)}
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		oldBlocks.Store(false)
+		t.Cleanup(func() { oldBlocks.Store(true) })
+
+		err := p.SetUpstreams(&Upstreams{UpstreamConfig: &UpstreamConfig{}})
+		testutil.AssertErrorMsg(
+			t,
+			"validating general upstreams: no upstream specified",
+			err,
+		)
+
+		d := newReq()
+		_, err = p.replyFromUpstream(d)
+		require.NoError(t, err)
+
+		assert.Equal(t, oldUps, d.Upstream)
+		assert.False(t, oldClosed.Load())
+	})
+
+	t.Run("drain", func(t *testing.T) {
+		inFlight := newReq()
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := p.replyFromUpstream(inFlight)
+			errCh <- err
+		}()
+
+		testutil.RequireReceive(t, entered, testTimeout)
+
+		newClosed := &atomic.Bool{}
+		newUps := newReloadTestUpstream(newAddr, func() {}, newClosed)
+		err := p.SetUpstreams(&Upstreams{
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{newUps}},
+		})
+		require.NoError(t, err)
+
+		d := newReq()
+		_, err = p.replyFromUpstream(d)
+		require.NoError(t, err)
+
+		assert.Equal(t, newUps, d.Upstream)
+		assert.False(t, oldClosed.Load())
+
+		testutil.RequireSend(t, unblock, struct{}{}, testTimeout)
+		err, _ = testutil.RequireReceive(t, errCh, testTimeout)
+		require.NoError(t, err)
+
+		assert.Equal(t, oldUps, inFlight.Upstream)
+		assert.Eventually(t, oldClosed.Load, testTimeout, testTimeout/100)
+		assert.False(t, newClosed.Load())
+	})
+}
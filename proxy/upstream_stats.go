@@ -0,0 +1,447 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// upstreamStatsNone is the name of the upstream in the statistics of the
+// failed exchanges which can't be attributed to a single upstream.
+const upstreamStatsNone = "none"
+
+// Upstream statistics counter names.
+const (
+	upstreamStatResponses = "responses"
+	upstreamStatErrors    = "errors"
+	upstreamStatTimeouts  = "timeouts"
+	upstreamStatLatency   = "latency"
+
+	// upstreamStatRTTSum is the sum of the durations of the successful
+	// exchanges in microseconds.
+	upstreamStatRTTSum = "rtt_sum_us"
+)
+
+// upstreamLatencyBuckets are the buckets of the per-upstream latency
+// histograms.  The upper bound of the last one is zero, since it holds all the
+// longer durations.
+var upstreamLatencyBuckets = []struct {
+	name  string
+	bound time.Duration
+}{
+	{name: "<10ms", bound: 10 * time.Millisecond},
+	{name: "<50ms", bound: 50 * time.Millisecond},
+	{name: "<100ms", bound: 100 * time.Millisecond},
+	{name: "<250ms", bound: 250 * time.Millisecond},
+	{name: "<1s", bound: time.Second},
+	{name: ">=1s"},
+}
+
+// upstreamLatencyBucket returns the name of the latency histogram bucket for d.
+func upstreamLatencyBucket(d time.Duration) (name string) {
+	last := len(upstreamLatencyBuckets) - 1
+	for _, b := range upstreamLatencyBuckets[:last] {
+		if d < b.bound {
+			return b.name
+		}
+	}
+
+	return upstreamLatencyBuckets[last].name
+}
+
+// upstreamName returns the name of u used in the statistics.
+func upstreamName(u upstream.Upstream) (name string) {
+	if u == nil {
+		return upstreamStatsNone
+	}
+
+	return u.Address()
+}
+
+// recordUpstreamResult records the result of the exchange with u, which took
+// rtt, in the metrics and in the statistics under the "upstreams::<upstream>"
+// keys.  u is nil if the failed exchange can't be attributed to a single
+// upstream.
+func recordUpstreamResult(u upstream.Upstream, rtt time.Duration, err error) {
+	name := upstreamName(u)
+	key := "upstreams::" + statsKeyPart(name) + "::"
+
+	if err != nil {
+		metricUpstreamErrors.inc(name)
+		SM.Increment(key+upstreamStatErrors, 1)
+		if isTimeout(err) {
+			metricUpstreamTimeouts.inc(name)
+			SM.Increment(key+upstreamStatTimeouts, 1)
+		}
+
+		recentUpstreams.recordError(name, err)
+
+		return
+	}
+
+	metricQueryDuration.observe(rtt, name)
+	SM.Increment(key+upstreamStatResponses, 1)
+	SM.Increment(key+upstreamStatLatency+"::"+upstreamLatencyBucket(rtt), 1)
+	SM.Increment(key+upstreamStatRTTSum, uint64(rtt.Microseconds()))
+	recentUpstreams.recordRTT(name, rtt)
+}
+
+// isTimeout returns true if err is caused by a timeout.
+func isTimeout(err error) (ok bool) {
+	if netErr := net.Error(nil); errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, errTryTimeout)
+}
+
+// upstreamRecentRTTs is the number of the recent round-trip times of each
+// upstream the percentiles are calculated from.
+const upstreamRecentRTTs = 1000
+
+// upstreamRecent is the recent state of an upstream, which isn't persisted.
+type upstreamRecent struct {
+	// lastErrTime is the time of the last failed exchange, if any.
+	lastErrTime time.Time
+
+	// lastErr is the error of the last failed exchange, if any.
+	lastErr string
+
+	// rtts are the durations of the recent successful exchanges.  It's used as
+	// a ring buffer once it's full.
+	rtts []time.Duration
+
+	// next is the index in rtts to be overwritten next when it's full.
+	next int
+}
+
+// upstreamRecentStats keeps the recent state of the upstreams by their names.
+type upstreamRecentStats struct {
+	// mux protects upstreams.
+	mux *sync.Mutex
+
+	// upstreams are the recent states of the upstreams by their names.
+	upstreams map[string]*upstreamRecent
+}
+
+// recentUpstreams is the recent state of all the upstreams.
+var recentUpstreams = newUpstreamRecentStats()
+
+// newUpstreamRecentStats returns a new properly initialized
+// *upstreamRecentStats.
+func newUpstreamRecentStats() (s *upstreamRecentStats) {
+	return &upstreamRecentStats{
+		mux:       &sync.Mutex{},
+		upstreams: map[string]*upstreamRecent{},
+	}
+}
+
+// get returns the recent state of the upstream with the given name creating it
+// if needed.  s.mux must be locked.
+func (s *upstreamRecentStats) get(name string) (r *upstreamRecent) {
+	r, ok := s.upstreams[name]
+	if !ok {
+		r = &upstreamRecent{}
+		s.upstreams[name] = r
+	}
+
+	return r
+}
+
+// recordRTT records the duration of the successful exchange with the upstream.
+func (s *upstreamRecentStats) recordRTT(name string, rtt time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	r := s.get(name)
+	if len(r.rtts) < upstreamRecentRTTs {
+		r.rtts = append(r.rtts, rtt)
+
+		return
+	}
+
+	r.rtts[r.next] = rtt
+	r.next = (r.next + 1) % upstreamRecentRTTs
+}
+
+// recordError records the failed exchange with the upstream.
+func (s *upstreamRecentStats) recordError(name string, err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	r := s.get(name)
+	r.lastErr = err.Error()
+	r.lastErrTime = time.Now()
+}
+
+// fill sets the recent statistics of the upstream into us.
+func (s *upstreamRecentStats) fill(us *UpstreamStats) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	r, ok := s.upstreams[us.Upstream]
+	if !ok {
+		return
+	}
+
+	us.P95RTTMs = durationMs(percentile(r.rtts, 95))
+	if r.lastErr != "" {
+		us.LastError = r.lastErr
+		t := r.lastErrTime
+		us.LastErrorTime = &t
+	}
+}
+
+// p95RTTs returns the 95th percentiles of the recent round-trip times of the
+// upstreams by their names.
+func (s *upstreamRecentStats) p95RTTs() (rtts map[string]time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	rtts = make(map[string]time.Duration, len(s.upstreams))
+	for name, r := range s.upstreams {
+		if len(r.rtts) > 0 {
+			rtts[name] = percentile(r.rtts, 95)
+		}
+	}
+
+	return rtts
+}
+
+// percentile returns the p-th percentile of durs using the nearest-rank
+// method, or zero if durs is empty.  durs isn't modified.
+func percentile(durs []time.Duration, p int) (d time.Duration) {
+	if len(durs) == 0 {
+		return 0
+	}
+
+	sorted := slices.Clone(durs)
+	slices.Sort(sorted)
+
+	// Calculate ceil(p * n / 100) - 1 in integers.
+	rank := (p*len(sorted) + 99) / 100
+
+	return sorted[max(rank-1, 0)]
+}
+
+// durationMs returns d in milliseconds with the fractional part.
+func durationMs(d time.Duration) (ms float64) {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// UpstreamLatencyBucket is a bucket of the latency histogram of an upstream.
+type UpstreamLatencyBucket struct {
+	// Bucket is the name of the bucket, e.g. "<10ms".
+	Bucket string `json:"bucket"`
+
+	// Count is the number of the responses within the bucket.
+	Count uint64 `json:"count"`
+}
+
+// UpstreamStats are the per-upstream statistics.
+type UpstreamStats struct {
+	// Upstream is the address of the upstream.
+	Upstream string `json:"upstream"`
+
+	// Latency is the histogram of the durations of the successful exchanges
+	// with the upstream.
+	Latency []UpstreamLatencyBucket `json:"latency"`
+
+	// LastErrorTime is the time of the last failed exchange with the upstream
+	// since the start.  It's nil if there were none.
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+
+	// LastError is the error of the last failed exchange with the upstream
+	// since the start, if any.
+	LastError string `json:"last_error,omitempty"`
+
+	// Queries is the number of all the exchanges with the upstream.
+	Queries uint64 `json:"queries"`
+
+	// Responses is the number of the successful exchanges with the upstream.
+	Responses uint64 `json:"responses"`
+
+	// Errors is the number of the failed exchanges with the upstream,
+	// including the timed out ones.
+	Errors uint64 `json:"errors"`
+
+	// Timeouts is the number of the timed out exchanges with the upstream.
+	Timeouts uint64 `json:"timeouts"`
+
+	// OtherErrors is the number of the failed exchanges with the upstream
+	// other than the timed out ones.
+	OtherErrors uint64 `json:"other_errors"`
+
+	// AvgRTTMs is the average duration of the successful exchanges with the
+	// upstream in milliseconds.
+	AvgRTTMs float64 `json:"avg_rtt_ms"`
+
+	// P95RTTMs is the 95th percentile of the durations of the recent
+	// successful exchanges with the upstream since the start in milliseconds.
+	P95RTTMs float64 `json:"p95_rtt_ms"`
+
+	// Retries is the number of the retries caused by the failed exchanges with
+	// the upstream.
+	Retries uint64 `json:"retries,omitempty"`
+
+	// TimeoutMs is the effective timeout of the upstream in milliseconds.  It's
+	// zero if the timeout isn't known.
+	TimeoutMs int64 `json:"timeout_ms,omitempty"`
+
+	// Health is the health state of the upstream.  It's nil if the health
+	// checking is disabled or the upstream isn't probed.
+	Health *UpstreamHealth `json:"health,omitempty"`
+}
+
+// UpstreamStats returns the statistics stored under the
+// "upstreams::<upstream>" keys sorted by the number of responses in the
+// descending order.
+func (r *StatsManager) UpstreamStats() (upstreams []UpstreamStats) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	upstreams = []UpstreamStats{}
+
+	upstreamsMap, _ := r.stats["upstreams"].(map[string]any)
+	for name, v := range upstreamsMap {
+		counters, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		latency, _ := counters[upstreamStatLatency].(map[string]any)
+		buckets := make([]UpstreamLatencyBucket, 0, len(upstreamLatencyBuckets))
+		for _, b := range upstreamLatencyBuckets {
+			buckets = append(buckets, UpstreamLatencyBucket{
+				Bucket: b.name,
+				Count:  asUint64(latency[b.name]),
+			})
+		}
+
+		responses := asUint64(counters[upstreamStatResponses])
+		errs := asUint64(counters[upstreamStatErrors])
+		timeouts := asUint64(counters[upstreamStatTimeouts])
+
+		var avgRTT time.Duration
+		if responses > 0 {
+			avgRTT = time.Duration(asUint64(counters[upstreamStatRTTSum])/responses) * time.Microsecond
+		}
+
+		upstreams = append(upstreams, UpstreamStats{
+			Upstream:    unescapeStatsKeyPart(name),
+			Latency:     buckets,
+			Queries:     responses + errs,
+			Responses:   responses,
+			Errors:      errs,
+			Timeouts:    timeouts,
+			OtherErrors: errs - min(timeouts, errs),
+			AvgRTTMs:    durationMs(avgRTT),
+			Retries:     asUint64(counters[upstreamStatRetries]),
+		})
+	}
+
+	slices.SortFunc(upstreams, func(a, b UpstreamStats) int {
+		if c := cmp.Compare(b.Responses, a.Responses); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(a.Upstream, b.Upstream)
+	})
+
+	return upstreams
+}
+
+// UpstreamStats returns the statistics of the upstreams from [SM] along with
+// their recent state, their timeouts, and their health state, if the health
+// checking is enabled.  The configured upstreams without any statistics yet
+// are also included.
+func (p *Proxy) UpstreamStats() (upstreams []UpstreamStats) {
+	upstreams = SM.UpstreamStats()
+
+	seen := map[string]unit{}
+	for i := range upstreams {
+		seen[upstreams[i].Upstream] = unit{}
+	}
+
+	for _, u := range upstreamsToCheck(p.upstreams().UpstreamConfig) {
+		addr := u.Address()
+		if _, ok := seen[addr]; !ok {
+			seen[addr] = unit{}
+			upstreams = append(upstreams, UpstreamStats{
+				Upstream: addr,
+				Latency:  []UpstreamLatencyBucket{},
+			})
+		}
+	}
+
+	for i := range upstreams {
+		s := &upstreams[i]
+		recentUpstreams.fill(s)
+
+		if timeout, ok := p.upstreamTimeout(s.Upstream); ok {
+			s.TimeoutMs = timeout.Milliseconds()
+		}
+
+		if p.healthChecker != nil {
+			s.Health = p.healthChecker.health(s.Upstream)
+		}
+	}
+
+	return upstreams
+}
+
+// upstreamTimeout returns the effective timeout of the upstream with the given
+// address and true if it's known.  The upstreams from [CustomUpstreamConfig]
+// aren't considered.
+func (p *Proxy) upstreamTimeout(addr string) (d time.Duration, ok bool) {
+	ups := p.upstreams()
+	for _, uc := range []*UpstreamConfig{
+		ups.UpstreamConfig,
+		ups.PrivateRDNSUpstreamConfig,
+		ups.Fallbacks,
+	} {
+		if d, ok = uc.timeout(addr); ok {
+			return d, true
+		}
+	}
+
+	return 0, false
+}
+
+// logUpstreamTimeouts logs the effective timeouts of the configured upstreams.
+func (p *Proxy) logUpstreamTimeouts() {
+	for _, u := range upstreamsToCheck(p.upstreams().UpstreamConfig) {
+		addr := u.Address()
+		if d, ok := p.upstreamTimeout(addr); ok {
+			log.Info("dnsproxy: upstream %s timeout is %s", addr, d)
+		}
+	}
+}
+
+// statsKeyPartReplacer escapes the separators of the stats keys.
+var statsKeyPartReplacer = strings.NewReplacer("%", "%25", "::", "%3A%3A")
+
+// statsKeyPart returns s escaped to be used as a single part of a stats key,
+// e.g. an IPv6 address.
+func statsKeyPart(s string) (part string) {
+	return statsKeyPartReplacer.Replace(s)
+}
+
+// statsKeyPartUnreplacer reverts statsKeyPartReplacer.
+var statsKeyPartUnreplacer = strings.NewReplacer("%3A%3A", "::", "%25", "%")
+
+// unescapeStatsKeyPart reverts statsKeyPart.
+func unescapeStatsKeyPart(part string) (s string) {
+	return statsKeyPartUnreplacer.Replace(part)
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamLatencyBucket(t *testing.T) {
+	testCases := []struct {
+		want string
+		d    time.Duration
+	}{{
+		want: "<10ms",
+		d:    0,
+	}, {
+		want: "<10ms",
+		d:    9 * time.Millisecond,
+	}, {
+		want: "<50ms",
+		d:    10 * time.Millisecond,
+	}, {
+		want: "<250ms",
+		d:    200 * time.Millisecond,
+	}, {
+		want: "<1s",
+		d:    999 * time.Millisecond,
+	}, {
+		want: ">=1s",
+		d:    time.Second,
+	}, {
+		want: ">=1s",
+		d:    time.Minute,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.d.String(), func(t *testing.T) {
+			assert.Equal(t, tc.want, upstreamLatencyBucket(tc.d))
+		})
+	}
+}
+
+func TestStatsKeyPart(t *testing.T) {
+	for _, s := range []string{"1.2.3.4:53", "[2001:db8::1]:53", "[fe80::1%25eth0]:53", "a%3A%3Ab"} {
+		part := statsKeyPart(s)
+		assert.NotContains(t, part, "::")
+		assert.Equal(t, s, unescapeStatsKeyPart(part))
+	}
+}
+
+func TestProxy_replyFromUpstream_upstreamStats(t *testing.T) {
+	setTestStats(t)
+
+	const (
+		primaryAddr  = "[2001:db8::1]:53"
+		fallbackAddr = "fallback.example:53"
+	)
+
+	primary := &fakeUpstream{
+		onExchange: func(_ *dns.Msg) (resp *dns.Msg, err error) {
+			return nil, errors.Error("test error")
+		},
+		onAddress: func() (addr string) { return primaryAddr },
+		onClose:   func() (err error) { return nil },
+	}
+	fallback := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return fallbackAddr },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{primary}},
+		Fallbacks:              &UpstreamConfig{Upstreams: []upstream.Upstream{fallback}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	for range 2 {
+		d := &DNSContext{Req: (&dns.Msg{}).SetQuestion("stats.example.", dns.TypeA)}
+
+		ok, err := p.replyFromUpstream(d)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		assert.Equal(t, fallback, d.Upstream)
+		assert.True(t, d.fromFallback)
+	}
+
+	// The fake exchanges are fast enough for all the responses to be in the
+	// first bucket.
+	wantLatency := make([]UpstreamLatencyBucket, 0, len(upstreamLatencyBuckets))
+	for _, b := range upstreamLatencyBuckets {
+		wantLatency = append(wantLatency, UpstreamLatencyBucket{Bucket: b.name})
+	}
+	wantLatency[0].Count = 2
+
+	emptyLatency := make([]UpstreamLatencyBucket, len(wantLatency))
+	copy(emptyLatency, wantLatency)
+	emptyLatency[0].Count = 0
+
+	got := SM.UpstreamStats()
+	require.Len(t, got, 2)
+
+	// The fake exchanges are fast enough for the average to be well within the
+	// first bucket, but it's not exactly known.
+	assert.Less(t, got[0].AvgRTTMs, 10.0)
+	got[0].AvgRTTMs = 0
+
+	assert.Equal(t, []UpstreamStats{{
+		Upstream:  fallbackAddr,
+		Latency:   wantLatency,
+		Queries:   2,
+		Responses: 2,
+	}, {
+		Upstream:    primaryAddr,
+		Latency:     emptyLatency,
+		Queries:     2,
+		Errors:      2,
+		OtherErrors: 2,
+	}}, got)
+}
+
+// setTestRecentUpstreams replaces the recent state of the upstreams with an
+// empty one for the duration of the test.
+func setTestRecentUpstreams(t *testing.T) {
+	t.Helper()
+
+	prev := recentUpstreams
+	recentUpstreams = newUpstreamRecentStats()
+	t.Cleanup(func() { recentUpstreams = prev })
+}
+
+func TestProxy_UpstreamStats_recent(t *testing.T) {
+	setTestStats(t)
+	setTestRecentUpstreams(t)
+
+	const addr = "upstream.example:53"
+
+	u := &fakeUpstream{
+		onExchange: func(_ *dns.Msg) (resp *dns.Msg, err error) { panic("not implemented") },
+		onAddress:  func() (a string) { return addr },
+		onClose:    func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	for i := range 100 {
+		recordUpstreamResult(u, time.Duration(i+1)*time.Millisecond, nil)
+	}
+
+	recordUpstreamResult(u, 0, fmt.Errorf("reading: %w", os.ErrDeadlineExceeded))
+	recordUpstreamResult(u, 0, fmt.Errorf("try: %w", errTryTimeout))
+	recordUpstreamResult(u, 0, errors.Error("test error"))
+
+	got := p.UpstreamStats()
+	require.Len(t, got, 1)
+
+	s := got[0]
+	assert.Equal(t, uint64(103), s.Queries)
+	assert.Equal(t, uint64(100), s.Responses)
+	assert.Equal(t, uint64(3), s.Errors)
+	assert.Equal(t, uint64(2), s.Timeouts)
+	assert.Equal(t, uint64(1), s.OtherErrors)
+	assert.InDelta(t, 50.5, s.AvgRTTMs, 0.001)
+	assert.InDelta(t, 95.0, s.P95RTTMs, 0.001)
+	assert.Equal(t, "test error", s.LastError)
+	assert.NotNil(t, s.LastErrorTime)
+
+	sb := &strings.Builder{}
+	require.NoError(t, WriteMetrics(sb))
+
+	assert.Contains(t, sb.String(), `dnsproxy_upstream_rtt_p95_seconds{upstream="`+addr+`"} 0.095`)
+}
+
+func TestPercentile(t *testing.T) {
+	durs := []time.Duration{5, 1, 4, 2, 3}
+
+	testCases := []struct {
+		name string
+		durs []time.Duration
+		p    int
+		want time.Duration
+	}{{
+		name: "empty",
+		durs: nil,
+		p:    95,
+		want: 0,
+	}, {
+		name: "single",
+		durs: []time.Duration{7},
+		p:    95,
+		want: 7,
+	}, {
+		name: "p95",
+		durs: durs,
+		p:    95,
+		want: 5,
+	}, {
+		name: "p50",
+		durs: durs,
+		p:    50,
+		want: 3,
+	}, {
+		name: "p0",
+		durs: durs,
+		p:    0,
+		want: 1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, percentile(tc.durs, tc.p))
+		})
+	}
+
+	// The slice mustn't be sorted in place.
+	assert.Equal(t, []time.Duration{5, 1, 4, 2, 3}, durs)
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"io"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/container"
@@ -32,8 +34,36 @@ type UpstreamConfig struct {
 
 	// Upstreams is a list of default upstreams.
 	Upstreams []upstream.Upstream
+
+	// Weights maps the addresses of the upstreams to their weights in the
+	// load-balancing mode.  The upstreams missing here have the weight of 1.
+	// The upstreams with zero weight are only used when all the others fail.
+	Weights map[string]uint
+
+	// Timeouts maps the addresses of the upstreams to their effective
+	// timeouts, either the default one from [upstream.Options] or the one
+	// specified for the upstream.
+	Timeouts map[string]time.Duration
 }
 
+// defaultUpstreamWeight is the weight of the upstream without an explicit one.
+const defaultUpstreamWeight = 1
+
+// Names of the upstream parameters.
+const (
+	// upstreamWeightParam is the name of the upstream parameter which
+	// specifies its weight.
+	upstreamWeightParam = "weight"
+
+	// upstreamTimeoutParam is the name of the upstream parameter which
+	// specifies its timeout.
+	upstreamTimeoutParam = "timeout"
+
+	// upstreamTCPParam is the name of the upstream parameter which makes the
+	// plain DNS upstream send all the queries over TCP.  It has no value.
+	upstreamTCPParam = "tcp"
+)
+
 // type check
 var _ io.Closer = (*UpstreamConfig)(nil)
 
@@ -57,6 +87,23 @@ var _ io.Closer = (*UpstreamConfig)(nil)
 // Where <upstreamString> is one or many upstreams separated by space (e.g.
 // `1.1.1.1` or `1.1.1.1 2.2.2.2`).
 //
+// # Upstream parameters
+//
+// Each upstream may have optional "|"-separated parameters.  The weight is used
+// by the load-balancing mode along with the measured round-trip times, the
+// timeout overrides the one from opts, and the tcp makes the plain DNS upstream
+// send all the queries over TCP, like [upstream.Options.ForceTCP] does.  For
+// example:
+//
+//	https://dns.example/dns-query|weight=9
+//	tls://backup.example|weight=0|timeout=5s
+//	[/lan/]192.168.1.1|timeout=200ms
+//	192.0.2.1|tcp
+//
+// The default weight is 1.  The upstreams with zero weight are only used as a
+// backup when all the other upstreams fail.  If the same upstream is specified
+// several times with different weights, the last one is used.
+//
 // More specific domains take priority over less specific domains.  To exclude
 // more specific domains from reserved upstreams querying you should use the
 // following syntax:
@@ -104,6 +151,8 @@ func ParseUpstreamsConfig(
 		specifiedDomainUpstreams: map[string][]upstream.Upstream{},
 		subdomainsOnlyUpstreams:  map[string][]upstream.Upstream{},
 		subdomainsOnlyExclusions: container.NewMapSet[string](),
+		weights:                  map[string]uint{},
+		timeouts:                 map[string]time.Duration{},
 	}
 
 	return p.parse(lines)
@@ -158,6 +207,13 @@ type configParser struct {
 
 	// upstreams is a list of default upstreams.
 	upstreams []upstream.Upstream
+
+	// weights maps the addresses of the upstreams to their explicit weights.
+	weights map[string]uint
+
+	// timeouts maps the addresses of the upstreams to their effective
+	// timeouts.
+	timeouts map[string]time.Duration
 }
 
 // parse returns UpstreamConfig and error if upstreams configuration is invalid.
@@ -180,6 +236,8 @@ func (p *configParser) parse(lines []string) (c *UpstreamConfig, err error) {
 		DomainReservedUpstreams:  p.domainReservedUpstreams,
 		SpecifiedDomainUpstreams: p.specifiedDomainUpstreams,
 		SubdomainExclusions:      p.subdomainsOnlyExclusions,
+		Weights:                  p.weights,
+		Timeouts:                 p.timeouts,
 	}, errors.Join(errs...)
 }
 
@@ -247,20 +305,44 @@ func splitConfigLine(confLine string) (upstreams, domains []string, err error) {
 
 // specifyUpstream specifies the upstream for domains.
 func (p *configParser) specifyUpstream(domains []string, u string, idx int) (err error) {
-	dnsUpstream, ok := p.upstreamsIndex[u]
+	u, params, err := splitUpstreamParams(u)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	opts := p.options.Clone()
+	key := u
+	if params.timeout > 0 {
+		opts.Timeout = params.timeout
+		key += "|" + upstreamTimeoutParam + "=" + params.timeout.String()
+	}
+
+	if params.forceTCP {
+		opts.ForceTCP = true
+		key += "|" + upstreamTCPParam
+	}
+
+	dnsUpstream, ok := p.upstreamsIndex[key]
 	// TODO(e.burkov):  Improve identifying duplicate upstreams.
 	if !ok {
 		// create an upstream
-		dnsUpstream, err = upstream.AddressToUpstream(u, p.options.Clone())
+		dnsUpstream, err = upstream.AddressToUpstream(u, opts)
 		if err != nil {
 			return fmt.Errorf("cannot prepare the upstream: %s", err)
 		}
 
 		// save to the index
-		p.upstreamsIndex[u] = dnsUpstream
+		p.upstreamsIndex[key] = dnsUpstream
 	}
 
 	addr := dnsUpstream.Address()
+	if params.hasWeight {
+		p.weights[addr] = params.weight
+	}
+
+	p.timeouts[addr] = opts.Timeout
+
 	if len(domains) == 0 {
 		// TODO(s.chzhen):  Handle duplicates.
 		p.upstreams = append(p.upstreams, dnsUpstream)
@@ -280,6 +362,86 @@ func (p *configParser) specifyUpstream(domains []string, u string, idx int) (err
 	return nil
 }
 
+// upstreamParams are the optional parameters of an upstream in the
+// configuration.
+type upstreamParams struct {
+	// weight is the weight of the upstream, if hasWeight is true.
+	weight uint
+
+	// hasWeight is true if the weight is specified.
+	hasWeight bool
+
+	// timeout is the timeout of the upstream, if positive.
+	timeout time.Duration
+
+	// forceTCP is true if the plain DNS upstream should only use TCP.
+	forceTCP bool
+}
+
+// splitUpstreamParams splits the optional "|"-separated parameters off the
+// upstream string u.
+func splitUpstreamParams(u string) (addr string, params upstreamParams, err error) {
+	addr, paramsStr, ok := strings.Cut(u, "|")
+	if !ok {
+		return addr, params, nil
+	}
+
+	for _, param := range strings.Split(paramsStr, "|") {
+		name, val, hasVal := strings.Cut(param, "=")
+		switch name {
+		case upstreamWeightParam:
+			var w uint64
+			w, err = strconv.ParseUint(val, 10, 32)
+			if err != nil {
+				return "", params, fmt.Errorf("bad upstream weight %q: %w", val, err)
+			}
+
+			params.weight, params.hasWeight = uint(w), true
+		case upstreamTimeoutParam:
+			params.timeout, err = time.ParseDuration(val)
+			if err != nil {
+				return "", params, fmt.Errorf("bad upstream timeout %q: %w", val, err)
+			} else if params.timeout <= 0 {
+				return "", params, fmt.Errorf("bad upstream timeout %q: must be positive", val)
+			}
+		case upstreamTCPParam:
+			if hasVal {
+				return "", params, fmt.Errorf("upstream parameter %q takes no value", name)
+			}
+
+			params.forceTCP = true
+		default:
+			return "", params, fmt.Errorf("unknown upstream parameter %q", name)
+		}
+	}
+
+	return addr, params, nil
+}
+
+// weight returns the weight of the upstream with the given address and true if
+// it's explicitly specified in uc.
+func (uc *UpstreamConfig) weight(addr string) (w uint, ok bool) {
+	if uc == nil {
+		return 0, false
+	}
+
+	w, ok = uc.Weights[addr]
+
+	return w, ok
+}
+
+// timeout returns the timeout of the upstream with the given address and true
+// if it's known to uc.
+func (uc *UpstreamConfig) timeout(addr string) (d time.Duration, ok bool) {
+	if uc == nil {
+		return 0, false
+	}
+
+	d, ok = uc.Timeouts[addr]
+
+	return d, ok
+}
+
 // excludeFromReserved excludes more specific domains from reserved upstreams
 // querying.
 func (p *configParser) excludeFromReserved(domains []string) {
@@ -482,3 +482,159 @@ func assertUpstreamsAddrs(tb testing.TB, ups []upstream.Upstream, want []string)
 		assert.Equalf(tb, want[i], up.Address(), "at index %d", i)
 	}
 }
+
+func TestParseUpstreamsConfig_weights(t *testing.T) {
+	config, err := ParseUpstreamsConfig([]string{
+		"udp://192.0.2.1:53|weight=9",
+		"192.0.2.2|weight=0",
+		"192.0.2.3",
+		"[/" + firstLevelDomain + "/]192.0.2.4|weight=2 192.0.2.5",
+	}, nil)
+	require.NoError(t, err)
+	require.Len(t, config.Upstreams, 3)
+
+	reserved := config.DomainReservedUpstreams[firstLevelFQDN]
+	require.Len(t, reserved, 2)
+
+	testCases := []struct {
+		u          upstream.Upstream
+		name       string
+		wantWeight uint
+		wantOK     bool
+	}{{
+		u:          config.Upstreams[0],
+		name:       "weighted",
+		wantWeight: 9,
+		wantOK:     true,
+	}, {
+		u:          config.Upstreams[1],
+		name:       "backup",
+		wantWeight: 0,
+		wantOK:     true,
+	}, {
+		u:          config.Upstreams[2],
+		name:       "default",
+		wantWeight: 0,
+		wantOK:     false,
+	}, {
+		u:          reserved[0],
+		name:       "reserved_weighted",
+		wantWeight: 2,
+		wantOK:     true,
+	}, {
+		u:          reserved[1],
+		name:       "reserved_default",
+		wantWeight: 0,
+		wantOK:     false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w, ok := config.weight(tc.u.Address())
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.wantWeight, w)
+		})
+	}
+
+	t.Run("bad", func(t *testing.T) {
+		_, err = ParseUpstreamsConfig([]string{"192.0.2.1|port=53"}, nil)
+		testutil.AssertErrorMsg(
+			t,
+			`parsing error at index 0: unknown upstream parameter "port"`,
+			err,
+		)
+
+		_, err = ParseUpstreamsConfig([]string{"192.0.2.1|weight=-1"}, nil)
+		testutil.AssertErrorMsg(
+			t,
+			`parsing error at index 0: bad upstream weight "-1": `+
+				`strconv.ParseUint: parsing "-1": invalid syntax`,
+			err,
+		)
+	})
+}
+
+func TestParseUpstreamsConfig_timeouts(t *testing.T) {
+	const defaultTimeout = 10 * time.Second
+
+	config, err := ParseUpstreamsConfig([]string{
+		"192.0.2.1|timeout=200ms",
+		"192.0.2.2|weight=2|timeout=5s",
+		"192.0.2.3",
+		"[/" + firstLevelDomain + "/]192.0.2.4|timeout=1s",
+	}, &upstream.Options{Timeout: defaultTimeout})
+	require.NoError(t, err)
+	require.Len(t, config.Upstreams, 3)
+
+	reserved := config.DomainReservedUpstreams[firstLevelFQDN]
+	require.Len(t, reserved, 1)
+
+	testCases := []struct {
+		u    upstream.Upstream
+		name string
+		want time.Duration
+	}{{
+		u:    config.Upstreams[0],
+		name: "timeout",
+		want: 200 * time.Millisecond,
+	}, {
+		u:    config.Upstreams[1],
+		name: "weight_and_timeout",
+		want: 5 * time.Second,
+	}, {
+		u:    config.Upstreams[2],
+		name: "default",
+		want: defaultTimeout,
+	}, {
+		u:    reserved[0],
+		name: "reserved",
+		want: time.Second,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, ok := config.timeout(tc.u.Address())
+			require.True(t, ok)
+
+			assert.Equal(t, tc.want, d)
+		})
+	}
+
+	w, ok := config.weight(config.Upstreams[1].Address())
+	require.True(t, ok)
+
+	assert.Equal(t, uint(2), w)
+
+	t.Run("bad", func(t *testing.T) {
+		_, err = ParseUpstreamsConfig([]string{"192.0.2.1|timeout=0s"}, nil)
+		testutil.AssertErrorMsg(
+			t,
+			`parsing error at index 0: bad upstream timeout "0s": must be positive`,
+			err,
+		)
+	})
+}
+
+func TestParseUpstreamsConfig_tcp(t *testing.T) {
+	config, err := ParseUpstreamsConfig([]string{
+		"192.0.2.1|tcp",
+		"192.0.2.1",
+		"tls://192.0.2.2|tcp",
+	}, nil)
+	require.NoError(t, err)
+
+	assertUpstreamsAddrs(t, config.Upstreams, []string{
+		"tcp://192.0.2.1:53",
+		"192.0.2.1:53",
+		"tls://192.0.2.2:853",
+	})
+
+	t.Run("bad", func(t *testing.T) {
+		_, err = ParseUpstreamsConfig([]string{"192.0.2.1|tcp=1"}, nil)
+		testutil.AssertErrorMsg(
+			t,
+			`parsing error at index 0: upstream parameter "tcp" takes no value`,
+			err,
+		)
+	})
+}
@@ -5,6 +5,7 @@ package proxyutil
 import (
 	"encoding/binary"
 	"net/netip"
+	"slices"
 
 	"github.com/miekg/dns"
 )
@@ -34,3 +35,54 @@ func IPFromRR(rr dns.RR) (ip netip.Addr) {
 
 	return ip
 }
+
+// The block sizes of the EDNS(0) padding policy recommended by RFC 8467.
+const (
+	// PaddingBlockQuery is the size of the block the queries are padded to.
+	PaddingBlockQuery = 128
+
+	// PaddingBlockResponse is the size of the block the responses are padded
+	// to.
+	PaddingBlockResponse = 468
+)
+
+// RemovePadding removes the EDNS(0) padding options, see RFC 7830, from the
+// OPT record of m.  o is the OPT record of m, if any.
+func RemovePadding(m *dns.Msg) (o *dns.OPT) {
+	o = m.IsEdns0()
+	if o == nil {
+		return nil
+	}
+
+	o.Option = slices.DeleteFunc(o.Option, func(opt dns.EDNS0) (ok bool) {
+		_, ok = opt.(*dns.EDNS0_PADDING)
+
+		return ok
+	})
+
+	return o
+}
+
+// Pad replaces the EDNS(0) padding option of m, if any, with the one making the
+// length of the packed m a multiple of blockSize.  m is left without padding if
+// it has no OPT record or if the padded length would exceed maxSize.  m should
+// be packed with the same compression setting it has now.
+func Pad(m *dns.Msg, blockSize, maxSize int) {
+	o := RemovePadding(m)
+	if o == nil {
+		return
+	}
+
+	pad := &dns.EDNS0_PADDING{}
+	o.Option = append(o.Option, pad)
+
+	l := m.Len()
+	n := (blockSize - l%blockSize) % blockSize
+	if l+n > maxSize {
+		o.Option = o.Option[:len(o.Option)-1]
+
+		return
+	}
+
+	pad.Padding = make([]byte, n)
+}
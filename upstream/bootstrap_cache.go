@@ -0,0 +1,122 @@
+package upstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// BootstrapCache keeps the results of the lookups made by the caching
+// resolvers in a file, so that the upstreams can be dialed with the last known
+// addresses right after the start.  It's safe for concurrent use.
+type BootstrapCache struct {
+	// mu protects entries and the file.
+	mu *sync.Mutex
+
+	// entries are the results of the lookups by the lower-case FQDNs of the
+	// hosts.
+	entries map[string]*bootstrapCacheEntry
+
+	// path is the path to the file.
+	path string
+}
+
+// bootstrapCacheEntry is a persisted result of a lookup.
+type bootstrapCacheEntry struct {
+	// Expire is the time the result expires at according to the TTLs of the
+	// records.
+	Expire time.Time `json:"expire"`
+
+	// Addrs are the resolved addresses.
+	Addrs []netip.Addr `json:"addrs"`
+}
+
+// NewBootstrapCache returns a new bootstrap cache persisted to the file at
+// path, loading the previous results from it.  The missing file is created on
+// the first successful lookup.
+func NewBootstrapCache(path string) (c *BootstrapCache, err error) {
+	c = &BootstrapCache{
+		mu:      &sync.Mutex{},
+		entries: map[string]*bootstrapCacheEntry{},
+		path:    path,
+	}
+
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading bootstrap cache: %w", err)
+	}
+
+	err = json.Unmarshal(data, &c.entries)
+	if err != nil {
+		return nil, fmt.Errorf("parsing bootstrap cache %s: %w", path, err)
+	}
+
+	return c, nil
+}
+
+// get returns the last known addresses of host, which must be in a lower-case
+// FQDN form, regardless of their expiration.
+func (c *BootstrapCache) get(host string) (addrs []netip.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[host]
+	if !ok {
+		return nil
+	}
+
+	return e.Addrs
+}
+
+// set stores the result of the lookup of host, which must be in a lower-case
+// FQDN form, and writes the file if the addresses have changed.  The empty
+// results aren't stored, since those can't be dialed.
+func (c *BootstrapCache) set(host string, res *ipResult) {
+	if len(res.addrs) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prev, ok := c.entries[host]
+	c.entries[host] = &bootstrapCacheEntry{
+		Expire: res.expire,
+		Addrs:  slices.Clone(res.addrs),
+	}
+
+	if ok && slices.Equal(prev.Addrs, res.addrs) {
+		return
+	}
+
+	err := c.write()
+	if err != nil {
+		log.Error("bootstrap: writing cache: %s", err)
+	}
+}
+
+// write writes the entries to the file.  c.mu is expected to be locked.
+func (c *BootstrapCache) write() (err error) {
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := c.path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, c.path)
+}
@@ -74,8 +74,16 @@ type dnsOverHTTPS struct {
 	// separately to reduce allocations during logging and error reporting.
 	addrRedacted string
 
+	// bind is the configuration of the local end of the QUIC connections.  The
+	// TCP ones are bound by the dialer.  It's nil if it's not configured.
+	bind *bootstrap.Bind
+
 	// timeout is used in HTTP client and for H3 probes.
 	timeout time.Duration
+
+	// padQueries tells if the queries should be padded, see
+	// [Options.PadQueries].
+	padQueries bool
 }
 
 // newDoH returns the DNS-over-HTTPS Upstream.
@@ -116,7 +124,9 @@ func newDoH(addr *url.URL, opts *Options) (u Upstream, err error) {
 		},
 		clientMu:     &sync.Mutex{},
 		addrRedacted: addr.Redacted(),
+		bind:         opts.bind(),
 		timeout:      opts.Timeout,
+		padQueries:   opts.PadQueries,
 	}
 	for _, v := range httpVersions {
 		ups.tlsConf.NextProtos = append(ups.tlsConf.NextProtos, string(v))
@@ -137,6 +147,10 @@ func (p *dnsOverHTTPS) Address() string { return p.addrRedacted }
 
 // Exchange implements the Upstream interface for *dnsOverHTTPS.
 func (p *dnsOverHTTPS) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	if p.padQueries {
+		m = padQuery(m)
+	}
+
 	// In order to maximize HTTP cache friendliness, DoH clients using media
 	// formats that include the ID field from the DNS message header, such
 	// as "application/dns-message", SHOULD use a DNS ID of 0 in every DNS
@@ -550,7 +564,7 @@ func (p *dnsOverHTTPS) createTransportH3(
 			tlsCfg *tls.Config,
 			cfg *quic.Config,
 		) (c quic.EarlyConnection, err error) {
-			c, err = quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+			c, err = dialQUIC(ctx, p.bind, addr, tlsCfg, cfg)
 			return c, err
 		},
 		DisableCompression: true,
@@ -641,7 +655,7 @@ func (p *dnsOverHTTPS) probeQUIC(addr string, tlsConfig *tls.Config, ch chan err
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(t))
 	defer cancel()
 
-	conn, err := quic.DialAddrEarly(ctx, addr, tlsConfig, p.getQUICConfig())
+	conn, err := dialQUIC(ctx, p.bind, addr, tlsConfig, p.getQUICConfig())
 	if err != nil {
 		ch <- fmt.Errorf("opening quic connection to %s: %w", p.addrRedacted, err)
 		return
@@ -11,6 +11,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
@@ -87,8 +88,16 @@ type dnsOverQUIC struct {
 	// bytesPoolGuard protects bytesPool.
 	bytesPoolMu *sync.Mutex
 
+	// bind is the configuration of the local end of the connections.  It's
+	// nil if it's not configured.
+	bind *bootstrap.Bind
+
 	// timeout is the timeout for the upstream connection.
 	timeout time.Duration
+
+	// padQueries tells if the queries should be padded, see
+	// [Options.PadQueries].
+	padQueries bool
 }
 
 // newDoQ returns the DNS-over-QUIC Upstream.
@@ -98,6 +107,7 @@ func newDoQ(addr *url.URL, opts *Options) (u Upstream, err error) {
 	u = &dnsOverQUIC{
 		getDialer: newDialerInitializer(addr, opts),
 		addr:      addr,
+		bind:      opts.bind(),
 		quicConfig: &quic.Config{
 			KeepAlivePeriod: QUICKeepAlivePeriod,
 			TokenStore:      newQUICTokenStore(),
@@ -123,6 +133,7 @@ func newDoQ(addr *url.URL, opts *Options) (u Upstream, err error) {
 		connMu:       &sync.Mutex{},
 		bytesPoolMu:  &sync.Mutex{},
 		timeout:      opts.Timeout,
+		padQueries:   opts.PadQueries,
 	}
 
 	runtime.SetFinalizer(u, (*dnsOverQUIC).Close)
@@ -138,6 +149,10 @@ func (p *dnsOverQUIC) Address() string { return p.addr.String() }
 
 // Exchange implements the [Upstream] interface for *dnsOverQUIC.
 func (p *dnsOverQUIC) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	if p.padQueries {
+		m = padQuery(m)
+	}
+
 	// When sending queries over a QUIC connection, the DNS Message ID MUST be
 	// set to zero.
 	id := m.Id
@@ -347,7 +362,7 @@ func (p *dnsOverQUIC) openConnection() (conn quic.Connection, err error) {
 	ctx, cancel := p.withDeadline(context.Background())
 	defer cancel()
 
-	conn, err = quic.DialAddrEarly(ctx, addr, p.tlsConf.Clone(), p.getQUICConfig())
+	conn, err = dialQUIC(ctx, p.bind, addr, p.tlsConf.Clone(), p.getQUICConfig())
 	if err != nil {
 		return nil, fmt.Errorf("dialing quic connection to %s: %w", p.addr, err)
 	}
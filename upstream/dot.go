@@ -45,6 +45,10 @@ type dnsOverTLS struct {
 	// This leads to weak performance for all exchanges coming across such
 	// connections.
 	conns []net.Conn
+
+	// padQueries tells if the queries should be padded, see
+	// [Options.PadQueries].
+	padQueries bool
 }
 
 // newDoT returns the DNS-over-TLS Upstream.
@@ -69,7 +73,8 @@ func newDoT(addr *url.URL, opts *Options) (ups Upstream, err error) {
 			VerifyPeerCertificate: opts.VerifyServerCertificate,
 			VerifyConnection:      opts.VerifyConnection,
 		},
-		connsMu: &sync.Mutex{},
+		connsMu:    &sync.Mutex{},
+		padQueries: opts.PadQueries,
 	}
 
 	runtime.SetFinalizer(tlsUps, (*dnsOverTLS).Close)
@@ -85,6 +90,10 @@ func (p *dnsOverTLS) Address() string { return p.addr.String() }
 
 // Exchange implements the [Upstream] interface for *dnsOverTLS.
 func (p *dnsOverTLS) Exchange(m *dns.Msg) (reply *dns.Msg, err error) {
+	if p.padQueries {
+		m = padQuery(m)
+	}
+
 	h, err := p.getDialer()
 	if err != nil {
 		return nil, fmt.Errorf("getting conn to %s: %w", p.addr, err)
@@ -2,6 +2,7 @@ package upstream
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"net"
@@ -42,10 +43,14 @@ type plainDNS struct {
 
 	// timeout is the timeout for DNS requests.
 	timeout time.Duration
+
+	// randomizeCase is true if the case of the query names sent over UDP
+	// should be randomized, see [Options.RandomizeCase].
+	randomizeCase bool
 }
 
 // newPlain returns the plain DNS Upstream.  addr.Scheme should be either "udp"
-// or "tcp".
+// or "tcp".  It's changed to "tcp" if opts.ForceTCP is true.
 func newPlain(addr *url.URL, opts *Options) (u *plainDNS, err error) {
 	switch addr.Scheme {
 	case networkUDP, networkTCP:
@@ -54,13 +59,18 @@ func newPlain(addr *url.URL, opts *Options) (u *plainDNS, err error) {
 		return nil, fmt.Errorf("unsupported url scheme: %s", addr.Scheme)
 	}
 
+	if opts.ForceTCP {
+		addr.Scheme = networkTCP
+	}
+
 	addPort(addr, defaultPortPlain)
 
 	return &plainDNS{
-		addr:      addr,
-		getDialer: newDialerInitializer(addr, opts),
-		net:       addr.Scheme,
-		timeout:   opts.Timeout,
+		addr:          addr,
+		getDialer:     newDialerInitializer(addr, opts),
+		net:           addr.Scheme,
+		timeout:       opts.Timeout,
+		randomizeCase: opts.RandomizeCase,
 	}, nil
 }
 
@@ -140,12 +150,18 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 
 	addr := p.Address()
 
-	resp, err = p.dialExchange(p.net, dial, req)
 	if p.net != networkUDP {
 		// The network is already TCP.
-		return resp, err
+		return p.dialExchange(p.net, dial, req)
 	}
 
+	udpReq := req
+	if p.randomizeCase {
+		udpReq = withRandomCase(req)
+	}
+
+	resp, err = p.dialExchange(p.net, dial, udpReq)
+
 	if resp == nil {
 		// There is likely an error with the upstream.
 		return resp, err
@@ -163,11 +179,69 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 		return p.dialExchange(networkTCP, dial, req)
 	}
 
+	if err == nil && udpReq != req {
+		err = restoreCase(resp, udpReq, req)
+		if err != nil {
+			// The response is likely spoofed, so try TCP.
+			log.Debug("plain %s: %s, using tcp", addr, err)
+
+			return p.dialExchange(networkTCP, dial, req)
+		}
+	}
+
 	// There is either no error or the error isn't related to the received
 	// message.
 	return resp, err
 }
 
+// errCaseMismatch is returned when the query name in the response doesn't
+// match the randomized one exactly.
+const errCaseMismatch errors.Error = "query name case mismatch"
+
+// withRandomCase returns a copy of req with the case of the letters of the
+// query name randomized.  req must have a single question.
+func withRandomCase(req *dns.Msg) (randomized *dns.Msg) {
+	name := []byte(req.Question[0].Name)
+
+	bits := make([]byte, len(name))
+	_, err := rand.Read(bits)
+	if err != nil {
+		log.Error("plain: randomizing query name case: %s", err)
+
+		return req
+	}
+
+	for i, c := range name {
+		if bits[i]&1 == 1 && ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			name[i] = c ^ 0x20
+		}
+	}
+
+	randomized = req.Copy()
+	randomized.Question[0].Name = string(name)
+
+	return randomized
+}
+
+// restoreCase returns an error if the query name of resp isn't exactly the one
+// of randomized.  Otherwise, it restores the original query name of req in the
+// question and the answer sections of resp.  resp must be validated.
+func restoreCase(resp, randomized, req *dns.Msg) (err error) {
+	randName, origName := randomized.Question[0].Name, req.Question[0].Name
+	if resp.Question[0].Name != randName {
+		return fmt.Errorf("%w: got %q", errCaseMismatch, resp.Question[0].Name)
+	}
+
+	resp.Question[0].Name = origName
+	for _, rr := range resp.Answer {
+		if hdr := rr.Header(); hdr.Name == randName {
+			hdr.Name = origName
+		}
+	}
+
+	return nil
+}
+
 // Close implements the [Upstream] interface for *plainDNS.
 func (p *plainDNS) Close() (err error) {
 	return nil
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
+	"runtime"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -138,6 +141,188 @@ func TestUpstream_plainDNS_fallbackToTCP(t *testing.T) {
 	}
 }
 
+func TestUpstream_plainDNS_randomizeCase(t *testing.T) {
+	testCases := []struct {
+		name    string
+		mangle  bool
+		wantUDP int
+		wantTCP int
+	}{{
+		name:    "echoed",
+		mangle:  false,
+		wantUDP: 1,
+		wantTCP: 0,
+	}, {
+		name:    "mangled",
+		mangle:  true,
+		wantUDP: 1,
+		wantTCP: 1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var udpReqNum, tcpReqNum atomic.Uint32
+			udpNames := make(chan string, 1)
+			srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+				pt := testutil.PanicT{}
+
+				resp := respondToTestMessage(req)
+				if w.RemoteAddr().Network() == networkUDP {
+					udpReqNum.Add(1)
+					testutil.RequireSend(pt, udpNames, req.Question[0].Name, timeout)
+
+					if tc.mangle {
+						resp.Question[0].Name = strings.ToLower(req.Question[0].Name)
+					}
+				} else {
+					tcpReqNum.Add(1)
+				}
+
+				require.NoError(pt, w.WriteMsg(resp))
+			})
+			testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+			addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+			u, err := AddressToUpstream(addr, &Options{
+				Timeout:       timeout,
+				RandomizeCase: true,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			req := createTestMessage()
+			origName := req.Question[0].Name
+
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
+
+			sent, ok := testutil.RequireReceive(t, udpNames, timeout)
+			require.True(t, ok)
+
+			assert.True(t, strings.EqualFold(origName, sent))
+			assert.NotEqual(t, origName, sent)
+
+			assert.Equal(t, origName, req.Question[0].Name)
+			assert.Equal(t, origName, resp.Question[0].Name)
+
+			assert.Equal(t, tc.wantUDP, int(udpReqNum.Load()))
+			assert.Equal(t, tc.wantTCP, int(tcpReqNum.Load()))
+		})
+	}
+
+	t.Run("tcp", func(t *testing.T) {
+		names := make(chan string, 1)
+		srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			pt := testutil.PanicT{}
+
+			testutil.RequireSend(pt, names, req.Question[0].Name, timeout)
+			require.NoError(pt, w.WriteMsg(respondToTestMessage(req)))
+		})
+		testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+		addr := fmt.Sprintf("tcp://127.0.0.1:%d", srv.port)
+		u, err := AddressToUpstream(addr, &Options{
+			Timeout:       timeout,
+			RandomizeCase: true,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		req := createTestMessage()
+		_, err = u.Exchange(req)
+		require.NoError(t, err)
+
+		sent, ok := testutil.RequireReceive(t, names, timeout)
+		require.True(t, ok)
+
+		assert.Equal(t, req.Question[0].Name, sent)
+	})
+}
+
+func TestUpstream_plainDNS_forceTCP(t *testing.T) {
+	var udpReqNum atomic.Uint32
+	remotes := make(chan string, 2)
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		pt := testutil.PanicT{}
+
+		if w.RemoteAddr().Network() == networkUDP {
+			udpReqNum.Add(1)
+		} else {
+			testutil.RequireSend(pt, remotes, w.RemoteAddr().String(), timeout)
+		}
+
+		require.NoError(pt, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Timeout:  timeout,
+		ForceTCP: true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	assert.Equal(t, "tcp://"+addr, u.Address())
+
+	for range 2 {
+		req := createTestMessage()
+		resp, exchErr := u.Exchange(req)
+		require.NoError(t, exchErr)
+		requireResponse(t, req, resp)
+	}
+
+	first, ok := testutil.RequireReceive(t, remotes, timeout)
+	require.True(t, ok)
+
+	second, ok := testutil.RequireReceive(t, remotes, timeout)
+	require.True(t, ok)
+
+	// Each exchange uses its own connection.
+	assert.NotEqual(t, first, second)
+	assert.Zero(t, udpReqNum.Load())
+
+	t.Run("timeout", func(t *testing.T) {
+		unblock := make(chan struct{})
+		blockSrv := startDNSServer(t, func(_ dns.ResponseWriter, _ *dns.Msg) {
+			<-unblock
+		})
+		testutil.CleanupAndRequireSuccess(t, func() (err error) {
+			close(unblock)
+
+			return blockSrv.Close()
+		})
+
+		const exchTimeout = 100 * time.Millisecond
+
+		blockAddr := fmt.Sprintf("127.0.0.1:%d", blockSrv.port)
+		bu, uErr := AddressToUpstream(blockAddr, &Options{
+			Timeout:  exchTimeout,
+			ForceTCP: true,
+		})
+		require.NoError(t, uErr)
+		testutil.CleanupAndRequireSuccess(t, bu.Close)
+
+		start := time.Now()
+		_, uErr = bu.Exchange(createTestMessage())
+
+		var netErr net.Error
+		require.ErrorAs(t, uErr, &netErr)
+
+		assert.True(t, netErr.Timeout())
+		assert.Less(t, time.Since(start), timeout)
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		dot, uErr := AddressToUpstream("tls://127.0.0.1:853", &Options{ForceTCP: true})
+		require.NoError(t, uErr)
+		testutil.CleanupAndRequireSuccess(t, dot.Close)
+
+		assert.Equal(t, "tls://127.0.0.1:853", dot.Address())
+	})
+}
+
 // testDNSServer is a simple DNS server that can be used in unit-tests.
 type testDNSServer struct {
 	udpListener net.PacketConn
@@ -195,3 +380,42 @@ func (s *testDNSServer) Close() (err error) {
 
 	return errors.WithDeferred(udpErr, tcpErr)
 }
+
+func TestUpstream_plainDNS_outboundIPv4(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only linux routes the whole 127.0.0.0/8 to the loopback by default")
+	}
+
+	const srcIP = "127.0.0.2"
+
+	remotes := make(chan net.Addr, 2)
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		pt := testutil.PanicT{}
+
+		testutil.RequireSend(pt, remotes, w.RemoteAddr(), timeout)
+		require.NoError(pt, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	for _, scheme := range []string{"udp", "tcp"} {
+		t.Run(scheme, func(t *testing.T) {
+			addr := fmt.Sprintf("%s://127.0.0.1:%d", scheme, srv.port)
+			u, err := AddressToUpstream(addr, &Options{
+				OutboundIPv4: netip.MustParseAddr(srcIP),
+				Timeout:      timeout,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			checkUpstream(t, u, addr)
+
+			remote, ok := testutil.RequireReceive(t, remotes, timeout)
+			require.True(t, ok)
+
+			ipp, err := netip.ParseAddrPort(remote.String())
+			require.NoError(t, err)
+
+			assert.Equal(t, srcIP, ipp.Addr().String())
+		})
+	}
+}
@@ -261,26 +261,46 @@ func (r *UpstreamResolver) resolveAsync(resCh chan<- any, host, network string)
 }
 
 // CachingResolver is a [Resolver] that caches the results of lookups.  It's
-// required to be created with [NewCachingResolver].
+// required to be created with [NewCachingResolver] or
+// [NewPersistentCachingResolver].
 type CachingResolver struct {
 	// resolver is the underlying resolver to use for lookups.
 	resolver *UpstreamResolver
 
-	// mu protects cached and it's elements.
+	// store is the persistent storage of the results of lookups.  It may be
+	// nil.
+	store *BootstrapCache
+
+	// mu protects cached, it's elements, and refreshing.
 	mu *sync.RWMutex
 
 	// cached is the set of cached results sorted by [resolveResult.name].
 	//
 	// TODO(e.burkov):  Use expiration cache.
 	cached map[string]*ipResult
+
+	// refreshing is the set of hosts the last known addresses of which are
+	// being re-validated.
+	refreshing map[string]struct{}
 }
 
 // NewCachingResolver creates a new caching resolver that uses r for lookups.
 func NewCachingResolver(r *UpstreamResolver) (cr *CachingResolver) {
+	return NewPersistentCachingResolver(r, nil)
+}
+
+// NewPersistentCachingResolver is like [NewCachingResolver] but also stores the
+// results of lookups in c, which may be nil.  When there is no unexpired result
+// cached, the last known addresses from c are returned right away and
+// re-validated in the background, so that the ones which stopped working are
+// replaced as soon as the lookup succeeds.
+func NewPersistentCachingResolver(r *UpstreamResolver, c *BootstrapCache) (cr *CachingResolver) {
 	return &CachingResolver{
-		resolver: r,
-		mu:       &sync.RWMutex{},
-		cached:   map[string]*ipResult{},
+		resolver:   r,
+		store:      c,
+		mu:         &sync.RWMutex{},
+		cached:     map[string]*ipResult{},
+		refreshing: map[string]struct{}{},
 	}
 }
 
@@ -304,17 +324,71 @@ func (r *CachingResolver) LookupNetIP(
 		return addrs, nil
 	}
 
-	newRes, err := r.resolver.lookupNetIP(ctx, network, host)
+	if r.store != nil {
+		addrs = r.store.get(host)
+		if addrs != nil {
+			r.refreshAsync(network, host)
+
+			return addrs, nil
+		}
+	}
+
+	newRes, err := r.resolve(ctx, network, host)
 	if err != nil {
 		return []netip.Addr{}, err
 	}
 
+	return newRes.addrs, nil
+}
+
+// resolve looks host up and caches the result.  host must be in a lower-case
+// FQDN form.
+func (r *CachingResolver) resolve(
+	ctx context.Context,
+	network bootstrap.Network,
+	host string,
+) (res *ipResult, err error) {
+	res, err = r.resolver.lookupNetIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	r.cached[host] = res
+	r.mu.Unlock()
 
-	r.cached[host] = newRes
+	if r.store != nil {
+		r.store.set(host, res)
+	}
 
-	return newRes.addrs, nil
+	return res, nil
+}
+
+// refreshAsync looks host up in the background unless it's already being done.
+// host must be in a lower-case FQDN form.
+func (r *CachingResolver) refreshAsync(network bootstrap.Network, host string) {
+	r.mu.Lock()
+	_, ok := r.refreshing[host]
+	r.refreshing[host] = struct{}{}
+	r.mu.Unlock()
+
+	if ok {
+		return
+	}
+
+	go func() {
+		defer log.OnPanic("bootstrap: refreshing")
+		defer func() {
+			r.mu.Lock()
+			delete(r.refreshing, host)
+			r.mu.Unlock()
+		}()
+
+		_, err := r.resolve(context.Background(), network, host)
+		if err != nil {
+			log.Debug("bootstrap: refreshing last known addresses of %s: %s", host, err)
+		}
+	}()
 }
 
 // findCached returns the cached addresses for host if it's not expired yet, and
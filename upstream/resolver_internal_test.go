@@ -3,6 +3,9 @@ package upstream
 import (
 	"context"
 	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
@@ -99,3 +102,122 @@ func TestCachingResolver_staleness(t *testing.T) {
 		require.Empty(t, cached)
 	})
 }
+
+func TestCachingResolver_persistent(t *testing.T) {
+	const (
+		fqdn    = "persistent.example."
+		timeout = 1 * time.Second
+	)
+
+	oldIP := netip.MustParseAddr("1.2.3.4")
+	newIP := netip.MustParseAddr("1.2.3.5")
+
+	// newUpstream returns an upstream responding with ip, or failing if it's
+	// invalid, and sending the requested types to reqs.
+	newUpstream := func(ip netip.Addr, reqs chan<- uint16) (u *dnsproxytest.FakeUpstream) {
+		return &dnsproxytest.FakeUpstream{
+			OnAddress: func() (_ string) { panic("not implemented") },
+			OnClose:   func() (_ error) { panic("not implemented") },
+			OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				q := req.Question[0]
+				if reqs != nil {
+					reqs <- q.Qtype
+				}
+
+				if !ip.IsValid() {
+					return nil, assert.AnError
+				}
+
+				resp = (&dns.Msg{}).SetReply(req)
+				if q.Qtype == dns.TypeA {
+					resp.Answer = append(resp.Answer, &dns.A{
+						Hdr: dns.RR_Header{
+							Name:   q.Name,
+							Rrtype: dns.TypeA,
+							Class:  dns.ClassINET,
+							Ttl:    60,
+						},
+						A: ip.AsSlice(),
+					})
+				}
+
+				return resp, nil
+			},
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "bootstrap.json")
+
+	c, err := NewBootstrapCache(path)
+	require.NoError(t, err)
+
+	r := NewPersistentCachingResolver(&UpstreamResolver{Upstream: newUpstream(oldIP, nil)}, c)
+	addrs, err := r.LookupNetIP(context.Background(), bootstrap.NetworkIP, fqdn)
+	require.NoError(t, err)
+
+	assert.Equal(t, []netip.Addr{oldIP}, addrs)
+	require.FileExists(t, path)
+
+	t.Run("bootstrap_fails", func(t *testing.T) {
+		c, err = NewBootstrapCache(path)
+		require.NoError(t, err)
+
+		reqs := make(chan uint16, 2)
+		r = NewPersistentCachingResolver(&UpstreamResolver{Upstream: newUpstream(netip.Addr{}, reqs)}, c)
+
+		addrs, err = r.LookupNetIP(context.Background(), bootstrap.NetworkIP, fqdn)
+		require.NoError(t, err)
+
+		assert.Equal(t, []netip.Addr{oldIP}, addrs)
+
+		// The addresses are re-validated in the background.
+		testutil.RequireReceive(t, reqs, timeout)
+	})
+
+	t.Run("revalidated", func(t *testing.T) {
+		c, err = NewBootstrapCache(path)
+		require.NoError(t, err)
+
+		r = NewPersistentCachingResolver(&UpstreamResolver{Upstream: newUpstream(newIP, nil)}, c)
+
+		addrs, err = r.LookupNetIP(context.Background(), bootstrap.NetworkIP, fqdn)
+		require.NoError(t, err)
+
+		assert.Equal(t, []netip.Addr{oldIP}, addrs)
+
+		assert.Eventually(t, func() (ok bool) {
+			addrs, err = r.LookupNetIP(context.Background(), bootstrap.NetworkIP, fqdn)
+
+			return err == nil && slices.Equal(addrs, []netip.Addr{newIP})
+		}, timeout, timeout/100)
+
+		c, err = NewBootstrapCache(path)
+		require.NoError(t, err)
+
+		assert.Equal(t, []netip.Addr{newIP}, c.get(fqdn))
+	})
+}
+
+func TestNewBootstrapCache(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("missing", func(t *testing.T) {
+		c, err := NewBootstrapCache(filepath.Join(dir, "missing.json"))
+		require.NoError(t, err)
+
+		assert.Nil(t, c.get("missing.example."))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.json")
+		err := os.WriteFile(path, []byte("["), 0o644)
+		require.NoError(t, err)
+
+		_, err = NewBootstrapCache(path)
+		testutil.AssertErrorMsg(
+			t,
+			"parsing bootstrap cache "+path+": unexpected end of JSON input",
+			err,
+		)
+	})
+}
@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
@@ -92,9 +93,37 @@ type Options struct {
 	// InsecureSkipVerify disables verifying the server's certificate.
 	InsecureSkipVerify bool
 
+	// OutboundInterface is the name of the network interface the connections
+	// to the upstream are bound to.  It's only supported on Linux.  It isn't
+	// applied to DNSCrypt upstreams.
+	OutboundInterface string
+
+	// OutboundIPv4 is the source address of the connections to the IPv4
+	// addresses of the upstream.  It isn't applied to DNSCrypt upstreams.
+	OutboundIPv4 netip.Addr
+
+	// OutboundIPv6 is the source address of the connections to the IPv6
+	// addresses of the upstream.  It isn't applied to DNSCrypt upstreams.
+	OutboundIPv6 netip.Addr
+
 	// PreferIPv6 tells the bootstrapper to prefer IPv6 addresses for an
 	// upstream.
 	PreferIPv6 bool
+
+	// PadQueries makes the DNS-over-HTTPS, DNS-over-QUIC, and DNS-over-TLS
+	// upstreams pad the queries having an OPT record as RFC 8467 recommends.
+	PadQueries bool
+
+	// RandomizeCase makes the plain DNS upstreams randomize the case of the
+	// letters of the query names sent over UDP, as the 0x20 technique
+	// describes, and retry over TCP if the response doesn't echo the name
+	// exactly.  It isn't applied to the other upstreams.
+	RandomizeCase bool
+
+	// ForceTCP makes the plain DNS upstreams send all the queries over TCP
+	// instead of falling back to it on truncated responses.  It isn't applied
+	// to the other upstreams.
+	ForceTCP bool
 }
 
 // Clone copies o to a new struct.  Note, that this is not a deep clone.
@@ -111,6 +140,26 @@ func (o *Options) Clone() (clone *Options) {
 		QUICTracer:                o.QUICTracer,
 		RootCAs:                   o.RootCAs,
 		CipherSuites:              o.CipherSuites,
+		OutboundInterface:         o.OutboundInterface,
+		OutboundIPv4:              o.OutboundIPv4,
+		OutboundIPv6:              o.OutboundIPv6,
+		PadQueries:                o.PadQueries,
+		RandomizeCase:             o.RandomizeCase,
+		ForceTCP:                  o.ForceTCP,
+	}
+}
+
+// bind returns the configuration of the local end of the connections to the
+// upstream, or nil if it's not configured.
+func (o *Options) bind() (b *bootstrap.Bind) {
+	if o.OutboundInterface == "" && !o.OutboundIPv4.IsValid() && !o.OutboundIPv6.IsValid() {
+		return nil
+	}
+
+	return &bootstrap.Bind{
+		Interface: o.OutboundInterface,
+		IPv4:      o.OutboundIPv4,
+		IPv6:      o.OutboundIPv6,
 	}
 }
 
@@ -177,6 +226,11 @@ func AddressToUpstream(addr string, opts *Options) (u Upstream, err error) {
 		opts = &Options{}
 	}
 
+	err = opts.bind().Validate()
+	if err != nil {
+		return nil, fmt.Errorf("binding outbound connections: %w", err)
+	}
+
 	var uu *url.URL
 	if strings.Contains(addr, "://") {
 		uu, err = url.Parse(addr)
@@ -365,7 +419,7 @@ type DialerInitializer func() (handler bootstrap.DialHandler, err error)
 func newDialerInitializer(u *url.URL, opts *Options) (di DialerInitializer) {
 	if _, err := netip.ParseAddrPort(u.Host); err == nil {
 		// Don't resolve the address of the server since it's already an IP.
-		handler := bootstrap.NewDialContext(opts.Timeout, u.Host)
+		handler := bootstrap.NewBoundDialContext(opts.Timeout, opts.bind(), u.Host)
 
 		return func() (h bootstrap.DialHandler, dialerErr error) {
 			return handler, nil
@@ -379,6 +433,60 @@ func newDialerInitializer(u *url.URL, opts *Options) (di DialerInitializer) {
 	}
 
 	return func() (h bootstrap.DialHandler, err error) {
-		return bootstrap.ResolveDialContext(u, opts.Timeout, boot, opts.PreferIPv6)
+		return bootstrap.ResolveBoundDialContext(u, opts.Timeout, boot, opts.PreferIPv6, opts.bind())
+	}
+}
+
+// dialQUIC dials an early QUIC connection to addr, which must be an IP address
+// with port.  The UDP socket is bound according to b, which may be nil.
+func dialQUIC(
+	ctx context.Context,
+	b *bootstrap.Bind,
+	addr string,
+	tlsConf *tls.Config,
+	conf *quic.Config,
+) (conn quic.EarlyConnection, err error) {
+	if b == nil {
+		return quic.DialAddrEarly(ctx, addr, tlsConf, conf)
 	}
+
+	remote, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing address: %w", err)
+	}
+
+	pconn, err := b.ListenPacket(ctx, remote.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("binding udp socket: %w", err)
+	}
+
+	conn, err = quic.DialEarly(ctx, pconn, net.UDPAddrFromAddrPort(remote), tlsConf, conf)
+	if err != nil {
+		return nil, errors.WithDeferred(err, pconn.Close())
+	}
+
+	// The socket passed from outside isn't closed along with the connection.
+	go func() {
+		<-conn.Context().Done()
+
+		closeErr := pconn.Close()
+		if closeErr != nil {
+			log.Debug("dnsproxy: closing udp socket for %s: %s", addr, closeErr)
+		}
+	}()
+
+	return conn, nil
+}
+
+// padQuery returns the copy of m padded as RFC 8467 recommends, if m has an OPT
+// record.  Otherwise, it returns m itself.
+func padQuery(m *dns.Msg) (padded *dns.Msg) {
+	if m.IsEdns0() == nil {
+		return m
+	}
+
+	padded = m.Copy()
+	proxyutil.Pad(padded, proxyutil.PaddingBlockQuery, dns.MaxMsgSize)
+
+	return padded
 }
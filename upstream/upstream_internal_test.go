@@ -728,3 +728,27 @@ func publicKey(priv any) (pub any) {
 		return nil
 	}
 }
+
+func TestPadQuery(t *testing.T) {
+	t.Run("edns", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+
+		padded := padQuery(req)
+		require.NotSame(t, req, padded)
+
+		b, err := padded.Pack()
+		require.NoError(t, err)
+
+		assert.Zero(t, len(b)%128)
+
+		// The original query is left intact.
+		assert.Empty(t, req.IsEdns0().Option)
+	})
+
+	t.Run("no_edns", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+		assert.Same(t, req, padQuery(req))
+	})
+}
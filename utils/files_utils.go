@@ -3,7 +3,12 @@ package utils
 // TODO (rafal): nothing
 
 import (
+	"bufio"
+	"compress/gzip"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -50,3 +55,73 @@ func GetFileInfo(filePath string) (int64, time.Time, error) {
 
 	return fileSize, modificationTime, nil
 }
+
+// gzipExt is the extension of gzip-compressed files.
+const gzipExt = ".gz"
+
+// UrlToFilePath returns the name of the local file the file from url is saved
+// to, which is the last path element of url.  The ".txt" extension is added
+// unless the name already has it or it's a compressed file, which keeps its
+// extension.
+func UrlToFilePath(url string) string {
+	tokens := strings.Split(url, "/")
+	filePath := tokens[len(tokens)-1]
+	if !strings.HasSuffix(filePath, ".txt") && !strings.HasSuffix(filePath, gzipExt) {
+		filePath += ".txt"
+	}
+
+	return filePath
+}
+
+// TrimExt returns the base name of filePath without extensions, including the
+// extension of the compressed file, e.g. "list" for "/path/to/list.txt.gz".
+func TrimExt(filePath string) string {
+	name := strings.TrimSuffix(filepath.Base(filePath), gzipExt)
+
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// gzipReadCloser closes both the gzip reader and the underlying file.
+type gzipReadCloser struct {
+	*gzip.Reader
+	file *os.File
+}
+
+// Close implements the io.Closer interface for *gzipReadCloser.
+func (rc *gzipReadCloser) Close() (err error) {
+	err = rc.Reader.Close()
+	closeErr := rc.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// OpenDecompressed opens the file at filePath for reading and transparently
+// decompresses it if it's gzip-compressed.  The compression is detected by the
+// content, so that the files with misleading names are read properly as well.
+func OpenDecompressed(filePath string) (rc io.ReadCloser, err error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(2)
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, f}, nil
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		_ = f.Close()
+
+		return nil, err
+	}
+
+	return &gzipReadCloser{Reader: zr, file: f}, nil
+}
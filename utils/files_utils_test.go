@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUrlToFilePath(t *testing.T) {
+	testCases := []struct {
+		url      string
+		wantPath string
+		wantName string
+	}{{
+		url:      "https://example.com/hosts",
+		wantPath: "hosts.txt",
+		wantName: "hosts",
+	}, {
+		url:      "https://example.com/list.txt",
+		wantPath: "list.txt",
+		wantName: "list",
+	}, {
+		url:      "https://example.com/list.txt.gz",
+		wantPath: "list.txt.gz",
+		wantName: "list",
+	}, {
+		url:      "https://example.com/hosts.gz",
+		wantPath: "hosts.gz",
+		wantName: "hosts",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.wantPath, func(t *testing.T) {
+			filePath := UrlToFilePath(tc.url)
+			assert.Equal(t, tc.wantPath, filePath)
+			assert.Equal(t, tc.wantName, TrimExt(filePath))
+		})
+	}
+}
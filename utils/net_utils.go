@@ -3,69 +3,173 @@ package utils
 // TODO (rafal): nothing
 
 import (
-	"errors"
-	"github.com/AdguardTeam/golibs/log"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
 )
 
-// DownloadFromUrl example.com/file.txt", "/path/to/save/file.txt")
-// handle error
+// downloadMeta is the validators of the previously downloaded file persisted
+// in the sidecar file next to it.
+type downloadMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// metaFilePath returns the path of the sidecar file with the validators of
+// the file at filePath.
+func metaFilePath(filePath string) string {
+	return filePath + ".meta"
+}
+
+// readDownloadMeta returns the validators of the file at filePath.  It returns
+// an empty meta if the file or its sidecar file doesn't exist.
+func readDownloadMeta(filePath string) (meta downloadMeta) {
+	fileSize, _, err := GetFileInfo(filePath)
+	if err != nil || fileSize == 0 {
+		return downloadMeta{}
+	}
+
+	data, err := os.ReadFile(metaFilePath(filePath))
+	if err != nil {
+		return downloadMeta{}
+	}
 
-func DownloadFromUrl(url string, opFilePath ...string) error {
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		log.Debug("parsing %s: %s", metaFilePath(filePath), err)
+
+		return downloadMeta{}
+	}
+
+	return meta
+}
+
+// DownloadFromUrl downloads the file from url and saves it to the path given
+// as the optional argument or to the last path element of url with the ".txt"
+// extension.  If the file has been downloaded before, the request is sent with
+// the If-None-Match and If-Modified-Since headers and the local file is kept
+// intact when the server responds with 304 Not Modified, in which case only
+// its modification time is updated and modified is false.  The gzip content
+// encoding is requested and the body is decompressed transparently, while the
+// files which are compressed themselves, e.g. "list.txt.gz", are saved as is.
+func DownloadFromUrl(url string, opFilePath ...string) (modified bool, err error) {
 
 	filePath := ""
 
 	if len(opFilePath) > 0 {
 		filePath = opFilePath[0]
 	} else {
-		tokens := strings.Split(url, "/")
-		filePath = tokens[len(tokens)-1]
-		if !strings.HasSuffix(filePath, ".txt") {
-			filePath += ".txt"
-		}
+		filePath = UrlToFilePath(url)
 	}
 
-	output, err := os.Create(filePath)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		log.Error("Error while creating", filePath, "-", err)
-		return err
+		return false, err
 	}
-	defer func(output *os.File) {
-		err := output.Close()
-		if err != nil {
-			log.Error("Error while closing output file ", filePath, "-", err)
-			return
-		}
-	}(output)
 
-	response, err := http.Get(url)
+	// Setting the header explicitly disables the transparent decompression
+	// of the transport, so the body is decompressed below.
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	meta := readDownloadMeta(filePath)
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+
+	response, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Error("Error while downloading", url, "-", err)
-		return err
+		log.Error("Error while downloading %s - %s", url, err)
+		return false, err
 	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
 		if err != nil {
-			log.Error("Error while closing output file ", filePath, "-", err)
+			log.Error("Error while closing response body of %s - %s", url, err)
 		}
 	}(response.Body)
 
 	// Check server response
-	if response.StatusCode != http.StatusOK {
-		log.Error("bad status: %s\n", response.Status)
-		return errors.New("")
+	switch response.StatusCode {
+	case http.StatusOK:
+		// Go on.
+	case http.StatusNotModified:
+		now := time.Now()
+		err = os.Chtimes(filePath, now, now)
+		if err != nil {
+			return false, err
+		}
+
+		return false, nil
+	default:
+		return false, fmt.Errorf("downloading %s: bad status: %s", url, response.Status)
+	}
+
+	// Write to a temporary file first so that a failed download doesn't
+	// destroy the previous copy.
+	tmpPath := filePath + ".tmp"
+	output, err := os.Create(tmpPath)
+	if err != nil {
+		log.Error("Error while creating %s - %s", tmpPath, err)
+		return false, err
+	}
+
+	var body io.Reader = response.Body
+	if strings.EqualFold(response.Header.Get("Content-Encoding"), "gzip") {
+		zr, zErr := gzip.NewReader(response.Body)
+		if zErr != nil {
+			_ = output.Close()
+			_ = os.Remove(tmpPath)
+			return false, fmt.Errorf("downloading %s: %w", url, zErr)
+		}
+		defer func() { _ = zr.Close() }()
+
+		body = zr
 	}
 
-	_, err = io.Copy(output, response.Body)
+	_, err = io.Copy(output, body)
+	if err != nil {
+		log.Error("Error while downloading %s - %s", url, err)
+		_ = output.Close()
+		_ = os.Remove(tmpPath)
+		return false, err
+	}
+
+	err = output.Close()
+	if err != nil {
+		log.Error("Error while closing output file %s - %s", tmpPath, err)
+		_ = os.Remove(tmpPath)
+		return false, err
+	}
+
+	err = os.Rename(tmpPath, filePath)
+	if err != nil {
+		return false, err
+	}
+
+	meta = downloadMeta{
+		ETag:         response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+	}
+	data, err := json.Marshal(meta)
+	if err == nil {
+		err = os.WriteFile(metaFilePath(filePath), data, 0o644)
+	}
 	if err != nil {
-		log.Error("Error while downloading", url, "-", err)
-		return err
+		// The file itself is downloaded, so only log the error.
+		log.Error("Error while saving %s - %s", metaFilePath(filePath), err)
 	}
 
-	return nil
+	return true, nil
 }
 
 /**
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadFromUrl_conditional(t *testing.T) {
+	const (
+		etag = `"v1"`
+		body = "blocked.example\n"
+	)
+
+	var requests, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	filePath := filepath.Join(t.TempDir(), "list.txt")
+
+	modified, err := DownloadFromUrl(srv.URL, filePath)
+	require.NoError(t, err)
+	assert.True(t, modified)
+
+	modified, err = DownloadFromUrl(srv.URL, filePath)
+	require.NoError(t, err)
+	assert.False(t, modified)
+
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, 1, notModified)
+
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(data))
+
+	// An empty local file must be downloaded unconditionally.
+	require.NoError(t, os.WriteFile(filePath, nil, 0o644))
+
+	modified, err = DownloadFromUrl(srv.URL, filePath)
+	require.NoError(t, err)
+	assert.True(t, modified)
+	assert.Equal(t, 1, notModified)
+}
+
+func TestDownloadFromUrl_gzip(t *testing.T) {
+	const body = "blocked.example\n"
+
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write([]byte(body))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/encoded.txt":
+			assert.Contains(t, r.Header.Get("Accept-Encoding"), "gzip")
+			w.Header().Set("Content-Encoding", "gzip")
+		case "/list.txt.gz":
+			w.Header().Set("Content-Type", "application/gzip")
+		}
+
+		_, _ = w.Write(buf.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	for _, name := range []string{"encoded.txt", "list.txt.gz"} {
+		t.Run(name, func(t *testing.T) {
+			url := srv.URL + "/" + name
+			filePath := filepath.Join(dir, UrlToFilePath(url))
+			assert.Equal(t, name, filepath.Base(filePath))
+
+			_, err := DownloadFromUrl(url, filePath)
+			require.NoError(t, err)
+
+			rc, err := OpenDecompressed(filePath)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, rc.Close()) })
+
+			data, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(data))
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// RotatingFile is an io.Writer appending to a file, which is rotated by
+// RotateIfNeeded once it grows over the size limit.  The rotated data are kept
+// in the files with the ".1", ".2", etc. suffixes, the most recent one first,
+// optionally compressed with gzip.
+type RotatingFile struct {
+	// mux protects file.
+	mux  sync.Mutex
+	file *os.File
+
+	// rotateMux serializes the rotations without blocking the writes while
+	// the rotated data are compressed.
+	rotateMux sync.Mutex
+
+	path string
+
+	// maxSize is the size in bytes the file is rotated after.
+	maxSize int64
+
+	// maxBackups is the number of the rotated files kept.  If it's zero, the
+	// file is truncated instead.
+	maxBackups int
+
+	// compress makes the rotated files compressed.
+	compress bool
+}
+
+// OpenRotatingFile opens the file at path for appending and returns the
+// RotatingFile writing to it.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int, compress bool) (f *RotatingFile, err error) {
+	f = &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: max(maxBackups, 0),
+		compress:   compress,
+	}
+
+	f.file, err = openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// openAppend opens the file at path for appending, creating it if necessary.
+func openAppend(path string) (f *os.File, err error) {
+	// #nosec G302 -- Trust the file path that is given in the configuration.
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+}
+
+// type check
+var _ io.WriteCloser = (*RotatingFile)(nil)
+
+// Write implements the io.Writer interface for *RotatingFile.
+func (f *RotatingFile) Write(b []byte) (n int, err error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return f.file.Write(b)
+}
+
+// Close implements the io.Closer interface for *RotatingFile.
+func (f *RotatingFile) Close() (err error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return f.file.Close()
+}
+
+// RotateIfNeeded rotates the file if it has grown over the size limit.
+func (f *RotatingFile) RotateIfNeeded() (rotated bool, err error) {
+	f.rotateMux.Lock()
+	defer f.rotateMux.Unlock()
+
+	f.mux.Lock()
+	fi, err := f.file.Stat()
+	f.mux.Unlock()
+	if err != nil {
+		return false, fmt.Errorf("checking log file size: %w", err)
+	}
+
+	if fi.Size() <= f.maxSize {
+		return false, nil
+	}
+
+	return true, f.rotate()
+}
+
+// rotate moves the current data of the file into the first rotated file and
+// reopens the file.  f.rotateMux is expected to be locked.
+func (f *RotatingFile) rotate() (err error) {
+	if f.maxBackups == 0 {
+		f.mux.Lock()
+		defer f.mux.Unlock()
+
+		return f.file.Truncate(0)
+	}
+
+	err = f.shiftBackups()
+	if err != nil {
+		return err
+	}
+
+	first := f.backupPath(1)
+	if f.compress {
+		// Compress it after reopening the file to not block the writes.
+		first = f.path + ".1.tmp"
+	}
+
+	moved, err := f.reopen(first)
+	if err != nil {
+		return err
+	}
+
+	if !moved || !f.compress {
+		return nil
+	}
+
+	return compressFile(first, f.backupPath(1))
+}
+
+// reopen renames the current file to path and opens a new one.  moved is false
+// if the current file has been removed by someone else, so there was nothing to
+// rename.
+func (f *RotatingFile) reopen(path string) (moved bool, err error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	err = os.Rename(f.path, path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("renaming log file: %w", err)
+	}
+
+	moved = err == nil
+
+	file, err := openAppend(f.path)
+	if err != nil {
+		return moved, fmt.Errorf("reopening log file: %w", err)
+	}
+
+	_ = f.file.Close()
+	f.file = file
+
+	return moved, nil
+}
+
+// shiftBackups removes the oldest rotated file and increments the numbers of
+// the other ones.
+func (f *RotatingFile) shiftBackups() (err error) {
+	err = os.Remove(f.backupPath(f.maxBackups))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing oldest log file: %w", err)
+	}
+
+	for i := f.maxBackups - 1; i > 0; i-- {
+		err = os.Rename(f.backupPath(i), f.backupPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("renaming log file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// backupPath returns the path to the i-th rotated file.
+func (f *RotatingFile) backupPath(i int) (path string) {
+	path = f.path + "." + strconv.Itoa(i)
+	if f.compress {
+		path += ".gz"
+	}
+
+	return path
+}
+
+// compressFile writes the gzipped contents of the file at src to dst and
+// removes src.
+func compressFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("compressing log file: %w", err)
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("compressing log file: %w", err)
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("compressing log file: %w", err)
+	}
+
+	return os.Remove(src)
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeAndRotate writes data to f and rotates it if needed.
+func writeAndRotate(t *testing.T, f *RotatingFile, data string) (rotated bool) {
+	t.Helper()
+
+	_, err := f.Write([]byte(data))
+	require.NoError(t, err)
+
+	rotated, err = f.RotateIfNeeded()
+	require.NoError(t, err)
+
+	return rotated
+}
+
+// readFile returns the contents of the file at path, decompressing it if
+// necessary.
+func readFile(t *testing.T, path string) (data string) {
+	t.Helper()
+
+	rc, err := OpenDecompressed(path)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, rc.Close)
+
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+
+	return string(b)
+}
+
+func TestRotatingFile(t *testing.T) {
+	testCases := []struct {
+		name     string
+		suffix   string
+		compress bool
+	}{{
+		name:     "plain",
+		suffix:   "",
+		compress: false,
+	}, {
+		name:     "compressed",
+		suffix:   ".gz",
+		compress: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dnsproxy.log")
+
+			f, err := OpenRotatingFile(path, 4, 2, tc.compress)
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, f.Close)
+
+			assert.False(t, writeAndRotate(t, f, "1234"))
+			assert.True(t, writeAndRotate(t, f, "5"))
+			assert.True(t, writeAndRotate(t, f, "abcde"))
+			assert.True(t, writeAndRotate(t, f, "fghij"))
+			assert.False(t, writeAndRotate(t, f, "k"))
+
+			assert.Equal(t, "k", readFile(t, path))
+			assert.Equal(t, "fghij", readFile(t, path+".1"+tc.suffix))
+			assert.Equal(t, "abcde", readFile(t, path+".2"+tc.suffix))
+			assert.NoFileExists(t, path+".3"+tc.suffix)
+			assert.NoFileExists(t, path+".1.tmp")
+		})
+	}
+
+	t.Run("no_backups", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dnsproxy.log")
+
+		f, err := OpenRotatingFile(path, 4, 0, false)
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, f.Close)
+
+		assert.True(t, writeAndRotate(t, f, "12345"))
+		assert.False(t, writeAndRotate(t, f, "abc"))
+
+		assert.Equal(t, "abc", readFile(t, path))
+		assert.NoFileExists(t, path+".1")
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dnsproxy.log")
+
+		f, err := OpenRotatingFile(path, 4, 1, false)
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, f.Close)
+
+		require.NoError(t, os.Remove(path))
+
+		// The removed file is still written to, until it's rotated.
+		assert.True(t, writeAndRotate(t, f, "12345"))
+		assert.False(t, writeAndRotate(t, f, "abc"))
+
+		assert.Equal(t, "abc", readFile(t, path))
+		assert.NoFileExists(t, path+".1")
+	})
+}